@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+)
+
+// adam7Pass is one of the seven passes of an Adam7 interlaced PNG: the
+// pixels at x0+dx*i, y0+dy*j
+type adam7Pass struct {
+	x0, y0, dx, dy int
+}
+
+// adam7Passes are the passes in the order they are stored
+var adam7Passes = []adam7Pass{
+	{0, 0, 8, 8}, {4, 0, 8, 8}, {0, 4, 4, 8}, {2, 0, 4, 4}, {0, 2, 2, 4}, {1, 0, 2, 2}, {0, 1, 1, 2},
+}
+
+// pixels returns the pixels of the pass from the rows of pix, and the size
+// of the reduced image they form
+func (p adam7Pass) pixels(pix []color.NRGBA64, width, height int) (sub []color.NRGBA64, w, h int) {
+	w = (width - p.x0 + p.dx - 1) / p.dx
+	h = (height - p.y0 + p.dy - 1) / p.dy
+	if w <= 0 || h <= 0 {
+		return nil, 0, 0
+	}
+	sub = make([]color.NRGBA64, 0, w*h)
+	for y := p.y0; y < height; y += p.dy {
+		for x := p.x0; x < width; x += p.dx {
+			sub = append(sub, pix[y*width+x])
+		}
+	}
+	return sub, w, h
+}
+
+// interlacePNG rewrites an encoded PNG as an Adam7 interlaced one with the
+// same color type and bit depth. Like image/png, it filters palette images
+// with filter none and other images adaptively.
+func interlacePNG(ctx context.Context, data []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode PNG: %w", err)
+	}
+	if len(data) < 29 {
+		return nil, fmt.Errorf("PNG header too short")
+	}
+	if data[28] == 1 {
+		return data, nil
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	pix := pngPixels(img)
+
+	// Bit depth and color type follow the IHDR chunk's length, type, width
+	// and height
+	l := pngLayout{depth: data[24], colorType: data[25]}
+	filter := pngFilterAdaptive
+	if l.colorType == 3 {
+		paletted, ok := img.(*image.Paletted)
+		if !ok {
+			return nil, fmt.Errorf("palette PNG decoded as %T", img)
+		}
+		for _, c := range paletted.Palette {
+			l.palette = append(l.palette, pngColor(c))
+		}
+		filter = 0
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	filtered := filterPNGPasses(pngPasses(pix, width, height, l, true), l.bpp(), filter)
+	out := encodePNGChunks(width, height, l, true, zlibCompress(filtered, zlib.DefaultCompression))
+	slog.Info("Interlaced PNG", "before", len(data), "after", len(out))
+	return out, nil
+}
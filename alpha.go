@@ -0,0 +1,46 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+)
+
+// defaultBackground is used to flatten transparency for formats without an
+// alpha channel when no -background is given
+var defaultBackground = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+
+// formatSupportsAlpha reports whether an output format can store transparency
+func formatSupportsAlpha(format string) bool {
+	switch strings.ToLower(format) {
+	case "jpeg", "jpg", "pnm", "ppm", "pgm", "pbm", "ascii", "ansi":
+		return false
+	}
+	return true
+}
+
+// isOpaqueImage reports whether every pixel of img is fully opaque
+func isOpaqueImage(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// flattenAlpha composites img over a solid background colour, removing all
+// transparency. 16-bit images stay 16-bit.
+func flattenAlpha(img image.Image, bg color.Color) image.Image {
+	if isOpaqueImage(img) {
+		return img
+	}
+
+	bounds := img.Bounds()
+	var dst draw.Image = image.NewRGBA(bounds)
+	if imageDepth(img) == 16 {
+		dst = image.NewRGBA64(bounds)
+	}
+	draw.Draw(dst, bounds, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Over)
+	return dst
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// archiveImageExts are the extensions of archive entries that are processed;
+// other entries such as text files or folder metadata are skipped
+var archiveImageExts = []string{".jpg", ".jpeg", ".png", ".gif", ".tif", ".tiff", ".qoi", ".pbm", ".pgm", ".ppm", ".pnm", ".pdf"}
+
+// archiveExt returns the normalized archive extension of path (.zip, .tar or
+// .tgz), or "" if path is not an archive
+func archiveExt(path string) string {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return ".zip"
+	case strings.HasSuffix(lower, ".tar"):
+		return ".tar"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return ".tgz"
+	}
+	return ""
+}
+
+// isArchive reports whether path names a zip or tar archive
+func isArchive(path string) bool {
+	return archiveExt(path) != ""
+}
+
+// archiveName returns inputFile with its archive extension normalized, so
+// that photos.tar.gz becomes photos.tgz
+func archiveName(inputFile string) string {
+	stem := inputFile
+	for _, suffix := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(strings.ToLower(stem), suffix) {
+			stem = stem[:len(stem)-len(suffix)]
+			break
+		}
+	}
+	return stem + archiveExt(inputFile)
+}
+
+// archiveOutputPath returns the path of the archive holding the results for
+// the archive at inputFile. It has the same archive type as the input.
+func (o *processOptions) archiveOutputPath(inputFile string) (string, error) {
+	return generateOutputPath(archiveName(inputFile), o.OutputFile, o.ResizePercent, o.CompressLevel, "")
+}
+
+// archiveEntryName returns the name of the output entry for the input entry
+// name, keeping its folder within the archive
+func (o *processOptions) archiveEntryName(name string) string {
+	ext := outputExtension(o.ConvertToIco, o.outputFormat(name))
+	return path.Join(path.Dir(name), outputFilename(path.Base(name), o.ResizePercent, o.CompressLevel, ext))
+}
+
+// archiveWriter adds files to a zip or tar archive
+type archiveWriter interface {
+	Add(name string, data []byte, modified time.Time) error
+	Close() error
+}
+
+// zipArchiveWriter writes entries to a zip archive
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchiveWriter) Add(name string, data []byte, modified time.Time) error {
+	// Encoded images are already compressed, so they are stored as-is
+	w, err := a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+// tarArchiveWriter writes entries to a tar archive, optionally gzipped
+type tarArchiveWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (a *tarArchiveWriter) Add(name string, data []byte, modified time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modified, Typeflag: tar.TypeReg}
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := a.tw.Write(data)
+	return err
+}
+
+func (a *tarArchiveWriter) Close() error {
+	err := a.tw.Close()
+	if a.gz != nil {
+		err = errors.Join(err, a.gz.Close())
+	}
+	return err
+}
+
+// newArchiveWriter returns a writer for an archive of type ext on w
+func newArchiveWriter(w io.Writer, ext string) archiveWriter {
+	switch ext {
+	case ".zip":
+		return &zipArchiveWriter{zw: zip.NewWriter(w)}
+	case ".tgz":
+		gz := gzip.NewWriter(w)
+		return &tarArchiveWriter{tw: tar.NewWriter(gz), gz: gz}
+	default:
+		return &tarArchiveWriter{tw: tar.NewWriter(w)}
+	}
+}
+
+// walkArchive calls fn with the name, modification time and a reader for the
+// contents of every regular file in the archive at archivePath, reading
+// entries one at a time without extracting them to disk
+func walkArchive(archivePath string, fn func(name string, modified time.Time, r io.Reader) error) error {
+	// Archives in object storage are downloaded into memory
+	var src io.ReaderAt
+	var size int64
+	if isObjectURI(archivePath) {
+		data, err := readObject(archivePath)
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %w", err)
+		}
+		src, size = bytes.NewReader(data), int64(len(data))
+	} else {
+		file, err := os.Open(archivePath)
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %w", err)
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %w", err)
+		}
+		src, size = file, info.Size()
+	}
+
+	if archiveExt(archivePath) == ".zip" {
+		zr, err := zip.NewReader(src, size)
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %w", err)
+		}
+
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", f.Name, err)
+			}
+			err = fn(f.Name, f.Modified, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var r io.Reader = io.NewSectionReader(src, 0, size)
+	if archiveExt(archivePath) == ".tgz" {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(header.Name, header.ModTime, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// isArchiveImage reports whether an archive entry should be processed
+func isArchiveImage(name string) bool {
+	base := path.Base(name)
+	if strings.HasPrefix(base, ".") || strings.HasPrefix(name, "__MACOSX/") {
+		return false
+	}
+	return slices.Contains(archiveImageExts, strings.ToLower(path.Ext(base)))
+}
+
+// reproducibleModTime is the date of every entry of archives written with
+// -reproducible, the earliest a ZIP file can record
+var reproducibleModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// processArchive processes every image in the archive at inputFile and
+// writes the results to a new archive of the same type. Images that fail are
+// logged and left out; the archive is still written, and an error reports
+// how many failed. Each image gets its own -timeout, and the archive is
+// abandoned once ctx is done.
+func processArchive(ctx context.Context, o *processOptions, inputFile string) (result processResult, err error) {
+	outPath, err := o.outputPath(inputFile)
+	if err != nil {
+		return result, fmt.Errorf("failed to generate output path: %w", err)
+	}
+	result.Output = outPath
+
+	// Archives for object storage are assembled in memory and uploaded at the end
+	var out io.Writer
+	var upload *bytes.Buffer
+	var file *atomicFile
+	if isObjectURI(outPath) {
+		upload = &bytes.Buffer{}
+		out = upload
+	} else if file, err = createAtomic(outPath); err != nil {
+		return result, fmt.Errorf("failed to create output archive: %w", err)
+	} else {
+		out = file
+	}
+	aw := newArchiveWriter(out, archiveExt(inputFile))
+
+	processed, failed := 0, 0
+	err = walkArchive(inputFile, func(name string, modified time.Time, r io.Reader) error {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("archive processing interrupted: %w", err)
+		}
+		if !isArchiveImage(name) {
+			slog.Debug("Skipping archive entry", "entry", name)
+			return nil
+		}
+		// Names climbing out of the archive's folder would be unpacked
+		// outside the destination by tools that trust them
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			slog.Warn("Skipping archive entry with an unsafe name", "archive", inputFile, "entry", name)
+			return nil
+		}
+
+		entryName := o.archiveEntryName(name)
+		var encoded bytes.Buffer
+		data, err := inputLimits.readInput(r)
+		if err == nil {
+			jobCtx, cancel := o.jobContext(ctx)
+			_, err = processImageCached(jobCtx, o, name, data, outPath+":"+entryName, &encoded)
+			cancel()
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if err != nil {
+			slog.Error("Could not process archive entry", "archive", inputFile, "entry", name, "error", err)
+			failed++
+			return nil
+		}
+		if o.Reproducible {
+			modified = reproducibleModTime
+		}
+		if err := aw.Add(entryName, encoded.Bytes(), modified); err != nil {
+			return fmt.Errorf("failed to write %s to output archive: %w", entryName, err)
+		}
+		processed++
+		return nil
+	})
+	err = errors.Join(err, aw.Close())
+	switch {
+	case err == nil && upload != nil:
+		err = writeObject(outPath, upload.Bytes())
+	case err == nil:
+		err = file.Commit()
+	case file != nil:
+		file.Abort()
+	}
+	if err != nil {
+		return result, err
+	}
+
+	slog.Info("Archive processed", "path", outPath, "images", processed, "failed", failed)
+	if failed > 0 {
+		return result, fmt.Errorf("%d of %d images in the archive failed to process", failed, processed+failed)
+	}
+	return result, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// atomicFile is a file that appears at its path only once it is complete.
+// It is written to a hidden temporary file in the same directory, which
+// Commit renames into place, so that anything watching the directory never
+// sees a partially written file.
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+// createAtomic starts writing the file at path
+func createAtomic(path string) (*atomicFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: f, path: path}, nil
+}
+
+// Commit closes the file and moves it to its path, replacing any file there
+func (f *atomicFile) Commit() error {
+	err := f.File.Close()
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Abort closes and removes the file, leaving any file at its path untouched
+func (f *atomicFile) Abort() {
+	f.File.Close()
+	os.Remove(f.Name())
+}
+
+// writeFileAtomic writes data to path through an atomicFile
+func writeFileAtomic(path string, data []byte) error {
+	f, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Commit()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog"
+	"math"
+)
+
+// removeBackgroundOp makes the background around a subject transparent: the
+// area connected to the image's edges whose color is within tolerance of the
+// key color
+type removeBackgroundOp struct {
+	key       *color.NRGBA // nil picks the most common color on the edges
+	tolerance float64      // percent of the distance from black to white
+}
+
+// Apply flood fills the background from the edges, so areas of the key color
+// inside the subject are kept. Subject pixels next to the background within
+// twice the tolerance become partly transparent, with the key color's tint
+// taken out, which softens the outline.
+func (op removeBackgroundOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width == 0 || height == 0 {
+		return img, nil
+	}
+	dst := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	drawParallel(dst, dst.Rect, img, img.Bounds().Min)
+
+	key := op.key
+	if key == nil {
+		c := edgeColor(dst)
+		key = &c
+	}
+	k := [3]float64{float64(key.R) * 0x101, float64(key.G) * 0x101, float64(key.B) * 0x101}
+	sample := func(i, c int) float64 {
+		return float64(uint32(dst.Pix[i*8+c*2])<<8 | uint32(dst.Pix[i*8+c*2+1]))
+	}
+	distance := func(i int) float64 {
+		var d float64
+		for c := range 3 {
+			d += (sample(i, c) - k[c]) * (sample(i, c) - k[c])
+		}
+		return math.Sqrt(d)
+	}
+	limit := op.tolerance / 100 * 0xffff * math.Sqrt(3)
+	matches := func(i int) bool {
+		return sample(i, 3) == 0 || distance(i) <= limit
+	}
+
+	// Flood fill the background from every matching edge pixel
+	background := make([]bool, width*height)
+	var queue []int
+	visit := func(x, y int) {
+		if i := y*width + x; !background[i] && matches(i) {
+			background[i] = true
+			queue = append(queue, i)
+		}
+	}
+	for x := range width {
+		visit(x, 0)
+		visit(x, height-1)
+	}
+	for y := range height {
+		visit(0, y)
+		visit(width-1, y)
+	}
+	for len(queue) > 0 {
+		i := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		x, y := i%width, i/width
+		if x > 0 {
+			visit(x-1, y)
+		}
+		if x < width-1 {
+			visit(x+1, y)
+		}
+		if y > 0 {
+			visit(x, y-1)
+		}
+		if y < height-1 {
+			visit(x, y+1)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	touchesBackground := func(x, y int) bool {
+		return x > 0 && background[y*width+x-1] || x < width-1 && background[y*width+x+1] ||
+			y > 0 && background[(y-1)*width+x] || y < height-1 && background[(y+1)*width+x]
+	}
+	removed := 0
+	for y := range height {
+		for x := range width {
+			i := y*width + x
+			p := dst.Pix[i*8 : i*8+8]
+			if background[i] {
+				clear(p)
+				removed++
+				continue
+			}
+			if limit == 0 || !touchesBackground(x, y) {
+				continue
+			}
+			d := distance(i)
+			if d >= 2*limit {
+				continue
+			}
+			// The pixel is taken to be a mix of the subject and the key color
+			a := (d - limit) / limit
+			for c := range 3 {
+				v := uint16(min(0xffff, max(0, math.Round(k[c]+(sample(i, c)-k[c])/a))))
+				p[c*2], p[c*2+1] = uint8(v>>8), uint8(v)
+			}
+			v := uint16(math.Round(sample(i, 3) * a))
+			p[6], p[7] = uint8(v>>8), uint8(v)
+		}
+	}
+	slog.Info("Removed background", "key", fmt.Sprintf("#%02x%02x%02x", key.R, key.G, key.B), "removed", fmt.Sprintf("%.1f%%", float64(removed)*100/float64(width*height)))
+
+	if imageDepth(img) == 16 {
+		return dst, nil
+	}
+	out := image.NewNRGBA(dst.Rect)
+	for i := range width * height {
+		for c := range 4 {
+			v := uint32(dst.Pix[i*8+c*2])<<8 | uint32(dst.Pix[i*8+c*2+1])
+			out.Pix[i*4+c] = uint8((v*0xff + 0x7fff) / 0xffff)
+		}
+	}
+	return out, nil
+}
+
+// edgeColor returns the most common color along the edges of img, averaged
+// over the edge pixels that round to it at 4 bits per channel
+func edgeColor(img *image.NRGBA64) color.NRGBA {
+	b := img.Bounds()
+	var count [1 << 12]int
+	var sum [1 << 12][3]int
+	add := func(x, y int) {
+		c := img.NRGBA64At(x, y)
+		if c.A == 0 {
+			return
+		}
+		r, g, bl := int(c.R>>8), int(c.G>>8), int(c.B>>8)
+		i := r>>4<<8 | g>>4<<4 | bl>>4
+		count[i]++
+		sum[i][0] += r
+		sum[i][1] += g
+		sum[i][2] += bl
+	}
+	for x := b.Min.X; x < b.Max.X; x++ {
+		add(x, b.Min.Y)
+		add(x, b.Max.Y-1)
+	}
+	for y := b.Min.Y + 1; y < b.Max.Y-1; y++ {
+		add(b.Min.X, y)
+		add(b.Max.X-1, y)
+	}
+	best := 0
+	for i := range count {
+		if count[i] > count[best] {
+			best = i
+		}
+	}
+	if count[best] == 0 {
+		return color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	}
+	n := count[best]
+	return color.NRGBA{uint8((sum[best][0] + n/2) / n), uint8((sum[best][1] + n/2) / n), uint8((sum[best][2] + n/2) / n), 0xff}
+}
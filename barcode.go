@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/font"
+)
+
+// code128Patterns are the bar and space widths in modules of each Code 128
+// symbol value, starting with a bar. 103 to 105 are the start symbols for
+// code sets A, B and C, and 106 is the stop symbol.
+var code128Patterns = [107]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+const (
+	code128CodeC  = 99
+	code128CodeB  = 100
+	code128StartB = 104
+	code128StartC = 105
+	code128Stop   = 106
+)
+
+// encodeCode128 returns the modules of a Code 128 symbol for printable
+// ASCII text, true for bars. Runs of digits long enough to save space are
+// encoded two to a symbol in code set C, the rest in code set B.
+func encodeCode128(text string) ([]bool, error) {
+	if text == "" {
+		return nil, fmt.Errorf("nothing to encode")
+	}
+	for _, r := range text {
+		if r < ' ' || r > '~' {
+			return nil, fmt.Errorf("Code 128 encodes printable ASCII, not %q", r)
+		}
+	}
+
+	var values []int
+	set := 0
+	use := func(s int) {
+		switch {
+		case len(values) == 0 && s == code128CodeC:
+			values = append(values, code128StartC)
+		case len(values) == 0:
+			values = append(values, code128StartB)
+		case s != set:
+			values = append(values, s)
+		}
+		set = s
+	}
+	for i := 0; i < len(text); {
+		run := 0
+		for i+run < len(text) && text[i+run] >= '0' && text[i+run] <= '9' {
+			run++
+		}
+		// Code set C pays off for 4 digits at either end of the text, and for
+		// 6 in the middle, where it costs a switch there and back
+		if run < 6 && !(run >= 4 && (i == 0 || i+run == len(text))) {
+			use(code128CodeB)
+			values = append(values, int(text[i]-' '))
+			i++
+			continue
+		}
+		if run%2 == 1 {
+			// The odd digit goes in code set B so that the rest pair up
+			use(code128CodeB)
+			values = append(values, int(text[i]-' '))
+			i, run = i+1, run-1
+		}
+		use(code128CodeC)
+		for end := i + run; i < end; i += 2 {
+			values = append(values, int(text[i]-'0')*10+int(text[i+1]-'0'))
+		}
+	}
+
+	checksum := values[0]
+	for i, v := range values[1:] {
+		checksum += (i + 1) * v
+	}
+	values = append(values, checksum%103, code128Stop)
+
+	var modules []bool
+	for _, v := range values {
+		for i, w := range code128Patterns[v] {
+			for range w - '0' {
+				modules = append(modules, i%2 == 0)
+			}
+		}
+	}
+	return modules, nil
+}
+
+// eanPatterns are the modules of each digit in the left half of an EAN
+// symbol with odd parity, as 7 bits. Even parity digits are the reverse of
+// their right half patterns, which are the complements of these.
+var eanPatterns = [10]int{0x0d, 0x19, 0x13, 0x3d, 0x23, 0x31, 0x2f, 0x3b, 0x37, 0x0b}
+
+// ean13Parity gives, for the first digit of an EAN-13 code, which of the
+// following six digits use even parity, from the left as the high bit
+var ean13Parity = [10]int{0x00, 0x0b, 0x0d, 0x0e, 0x13, 0x19, 0x1c, 0x15, 0x16, 0x1a}
+
+// eanCheckDigit returns the check digit for the digits of an EAN code
+// without it: weights alternate 3 and 1 from the rightmost digit
+func eanCheckDigit(digits string) byte {
+	sum := 0
+	for i := range len(digits) {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// eanSymbol is an encoded EAN-13 or EAN-8 code
+type eanSymbol struct {
+	digits  string // all digits, including the check digit
+	modules []bool
+	guards  []bool // modules of the guard bars, which extend below the others
+}
+
+// encodeEAN encodes an EAN code of length 13 or 8 digits, adding the check
+// digit if it is left out, or checking it if it is given
+func encodeEAN(text string, length int) (*eanSymbol, error) {
+	for _, r := range text {
+		if r < '0' || r > '9' {
+			return nil, fmt.Errorf("EAN-%d encodes digits only, not %q", length, r)
+		}
+	}
+	switch len(text) {
+	case length - 1:
+		text += string(eanCheckDigit(text))
+	case length:
+		if want := eanCheckDigit(text[:length-1]); text[length-1] != want {
+			return nil, fmt.Errorf("invalid check digit %c for %s; expected %c", text[length-1], text[:length-1], want)
+		}
+	default:
+		return nil, fmt.Errorf("EAN-%d takes %d digits, or %d without the check digit", length, length, length-1)
+	}
+
+	e := &eanSymbol{digits: text}
+	add := func(bits, n int, guard bool) {
+		for i := n - 1; i >= 0; i-- {
+			e.modules = append(e.modules, bits>>i&1 == 1)
+			e.guards = append(e.guards, guard)
+		}
+	}
+	left, right, parity := text[:length/2], text[length/2:], 0
+	if length == 13 {
+		left, right, parity = text[1:7], text[7:], ean13Parity[text[0]-'0']
+	}
+	add(0b101, 3, true)
+	for i, c := range left {
+		p := eanPatterns[c-'0']
+		if parity>>(len(left)-1-i)&1 == 1 {
+			p = reverseBits(^p&0x7f, 7)
+		}
+		add(p, 7, false)
+	}
+	add(0b01010, 5, true)
+	for _, c := range right {
+		add(^eanPatterns[c-'0']&0x7f, 7, false)
+	}
+	add(0b101, 3, true)
+	return e, nil
+}
+
+// reverseBits reverses the order of the low n bits of v
+func reverseBits(v, n int) int {
+	r := 0
+	for range n {
+		r = r<<1 | v&1
+		v >>= 1
+	}
+	return r
+}
+
+// barcodeLabel holds the settings a barcode is drawn with
+type barcodeLabel struct {
+	module int  // pixels per module
+	height int  // bar height in pixels
+	margin int  // quiet zone on each side in modules
+	text   bool // print the encoded text under the bars
+}
+
+// drawBarcode draws modules as bars with the text under them. Guards, if
+// given, mark the bars that extend down beside the text, as on EAN codes.
+func drawBarcode(modules, guards []bool, text []barcodeText, l barcodeLabel) (*image.Gray, error) {
+	m := l.module
+	var face font.Face
+	textHeight := 0
+	if l.text {
+		var err error
+		if face, err = loadFontFace("mono", float64(8*m)); err != nil {
+			return nil, err
+		}
+		defer face.Close()
+		textHeight = face.Metrics().Height.Ceil()
+	}
+
+	pad := 2 * m
+	img := image.NewGray(image.Rect(0, 0, (len(modules)+2*l.margin)*m, pad+l.height+textHeight+pad))
+	draw.Draw(img, img.Rect, image.White, image.Point{}, draw.Src)
+	for i, bar := range modules {
+		if !bar {
+			continue
+		}
+		bottom := pad + l.height
+		if guards != nil && guards[i] {
+			bottom += textHeight / 2
+		}
+		x := (l.margin + i) * m
+		draw.Draw(img, image.Rect(x, pad, x+m, bottom), image.Black, image.Point{}, draw.Src)
+	}
+	if face != nil {
+		for _, t := range text {
+			drawText(img, face, []string{t.text}, (l.margin+t.start)*m, pad+l.height, t.width*m, t.align, color.Black)
+		}
+	}
+	return img, nil
+}
+
+// barcodeText is a piece of the human-readable line, placed over a span of
+// modules from start, which may be negative to reach into the quiet zone
+type barcodeText struct {
+	text         string
+	start, width int
+	align        string
+}
+
+// runBarcode implements the barcode subcommand
+func runBarcode(args []string) error {
+	fs := flag.NewFlagSet("barcode", flag.ExitOnError)
+	symbology := fs.String("type", "code128", "Barcode type: code128, ean13 or ean8")
+	outputFile := fs.String("output", "barcode.png", "Output image file path")
+	dpi := fs.Float64("dpi", 300, "Resolution of the printer in dots per inch, recorded in JPEG and PNG output")
+	moduleMM := fs.Float64("module", 0.33, "Width of the narrowest bar in millimetres, rounded to whole dots at -dpi")
+	heightMM := fs.Float64("height", 15, "Height of the bars in millimetres")
+	margin := fs.Int("margin", 11, "Quiet zone left and right of the bars in modules")
+	text := fs.Bool("text", true, "Print the encoded text under the bars")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s barcode [flags] data\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected the data to encode as the only argument")
+	}
+	if !(*dpi >= 1 && *dpi <= maxDPI) {
+		return fmt.Errorf("dpi must be between 1 and %d", maxDPI)
+	}
+	if !(*moduleMM > 0) || !(*heightMM > 0) {
+		return fmt.Errorf("module and height must be positive")
+	}
+	if *margin < 0 {
+		return fmt.Errorf("margin cannot be negative")
+	}
+	label := barcodeLabel{
+		module: max(1, int(math.Round(*moduleMM**dpi/25.4))),
+		height: max(1, int(math.Round(*heightMM**dpi/25.4))),
+		margin: *margin,
+		text:   *text,
+	}
+
+	data := fs.Arg(0)
+	var img *image.Gray
+	var err error
+	switch strings.ToLower(*symbology) {
+	case "code128":
+		var modules []bool
+		if modules, err = encodeCode128(data); err != nil {
+			return err
+		}
+		img, err = drawBarcode(modules, nil, []barcodeText{{data, 0, len(modules), "center"}}, label)
+	case "ean13", "ean8":
+		length := 13
+		if strings.ToLower(*symbology) == "ean8" {
+			length = 8
+		}
+		var e *eanSymbol
+		if e, err = encodeEAN(data, length); err != nil {
+			return err
+		}
+		half := length / 2
+		parts := []barcodeText{{e.digits[:half], 3, 28, "center"}, {e.digits[half:], 36, 28, "center"}}
+		if length == 13 {
+			// The first digit is printed in front of the bars
+			parts = []barcodeText{{e.digits[:1], -*margin, *margin - 1, "right"}, {e.digits[1:7], 3, 42, "center"}, {e.digits[7:], 50, 42, "center"}}
+		}
+		data = e.digits
+		img, err = drawBarcode(e.modules, e.guards, parts, label)
+	default:
+		return fmt.Errorf("invalid barcode type %q: expected code128, ean13 or ean8", *symbology)
+	}
+	if err != nil {
+		return err
+	}
+
+	outPath, err := prepareOutputPath("barcode", *outputFile)
+	if err != nil {
+		return err
+	}
+	format := formatFromExt(outPath)
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, format, 0); err != nil {
+		return err
+	}
+	encoded, err := embedMetadata(buf.Bytes(), format, imageMetadata{DPI: *dpi})
+	if err != nil {
+		return fmt.Errorf("failed to record density: %w", err)
+	}
+	if err := writeFileAtomic(outPath, encoded); err != nil {
+		return fmt.Errorf("failed to write %s: %w", outPath, err)
+	}
+
+	slog.Info("Barcode saved", "data", data, "size", fmt.Sprintf("%dx%d", img.Rect.Dx(), img.Rect.Dy()), "module", label.module, "path", outPath)
+	return nil
+}
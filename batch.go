@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// errBatchPartial is returned by a batch run that completed but could not
+// process every input
+var errBatchPartial = errors.New("some inputs failed to process")
+
+// errUpToDate is returned by processBatchInput for inputs skipped by -incremental
+var errUpToDate = errors.New("output is up to date")
+
+// batchFailure records one input that could not be processed, with the
+// output and options of its job, if any
+type batchFailure struct {
+	Input   string            `json:"input"`
+	Output  string            `json:"output,omitempty"`
+	Options map[string]string `json:"options,omitempty"`
+	Error   string            `json:"error"`
+}
+
+// batchManifest is the machine-readable summary written after a batch run.
+// Its failed inputs can be processed again with -retry.
+type batchManifest struct {
+	Started   time.Time      `json:"started"`
+	Processed int            `json:"processed"`
+	Skipped   int            `json:"skipped"`
+	Failed    []batchFailure `json:"failed"`
+}
+
+// processSafely runs processFile, turning a panic on a malformed input into
+// an error so that the rest of the batch can continue
+func processSafely(ctx context.Context, o *processOptions, inputFile string) (result processResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while processing: %v", r)
+		}
+	}()
+	return processFile(ctx, o, inputFile, nil)
+}
+
+// processBatchInput processes the input of one job of a batch run. With a
+// non-nil state, inputs whose output is up to date are skipped with
+// errUpToDate and the source of every new output is recorded. The options of
+// the input's sidecar file, if it has one, and then of the job apply on top
+// of o.
+func processBatchInput(ctx context.Context, o *processOptions, state *incrementalState, job batchJob) (processResult, error) {
+	inputFile := job.Input
+	o, sidecar, err := o.withSidecar(inputFile)
+	if err != nil {
+		return processResult{}, err
+	}
+	if o, err = o.withOptions(job.Options); err != nil {
+		return processResult{}, fmt.Errorf("invalid job options: %w", err)
+	}
+	if job.Output != "" {
+		withOutput := *o
+		withOutput.OutputFile = job.Output
+		o = &withOutput
+	}
+	if state == nil {
+		return processSafely(ctx, o, inputFile)
+	}
+
+	// Only local files have the modification times and contents to compare
+	outPath, err := o.outputPath(inputFile)
+	if err != nil {
+		return processResult{}, fmt.Errorf("failed to generate output path: %w", err)
+	}
+	if isObjectURI(inputFile) || isObjectURI(outPath) {
+		return processSafely(ctx, o, inputFile)
+	}
+	ok, hash, err := state.upToDate(inputFile, outPath)
+	if err != nil {
+		return processResult{}, err
+	}
+	if ok && sidecar != "" {
+		// An edited sidecar changes the output even if the input has not
+		ok = !newerThan(sidecar, outPath)
+	}
+	if ok {
+		slog.Debug("Skipping unchanged input", "input", inputFile, "output", outPath)
+		return processResult{Output: outPath}, errUpToDate
+	}
+
+	result, err := processSafely(ctx, o, inputFile)
+	if err != nil {
+		return result, err
+	}
+	return result, state.record(inputFile, outPath, hash)
+}
+
+// readBatchManifest returns the jobs of the failed inputs listed in a
+// manifest file
+func readBatchManifest(path string) ([]batchJob, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var manifest batchManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+
+	jobs := make([]batchJob, 0, len(manifest.Failed))
+	for _, f := range manifest.Failed {
+		jobs = append(jobs, batchJob{Input: f.Input, Output: f.Output, Options: f.Options})
+	}
+	return jobs, nil
+}
+
+// writeBatchManifest writes manifest as indented JSON to path
+func writeBatchManifest(path string, manifest batchManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+func runBatch(args []string) error {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	opts := addProcessFlags(fs)
+	failures := fs.String("failures", "failures.json", "Name of the failure manifest written to output/batch")
+	retry := fs.String("retry", "", "Failure manifest from an earlier run whose failed inputs are processed again")
+	report := fs.String("report", "", "Name of a report written to output/batch listing each output with its dimensions, sizes and checksums. The extension selects JSON (.json), CSV (.csv) or an HTML page with before/after thumbnails and SSIM (.html)")
+	incremental := fs.Bool("incremental", false, "Skip inputs whose output is newer than the input or was produced from identical content")
+	fileList := addFileListFlag(fs, "File naming input images one per line, or - to read the list from stdin")
+	jobFile := fs.String("jobs", "", "JSON or CSV file listing inputs, each with its own output name and options")
+	cacheDir := fs.String("cache-dir", "", "Directory where processed images are cached, so that inputs with identical content and options are not processed again")
+	cacheSize := fs.Int64("cache-size", 1024, "Maximum size of the -cache-dir cache in MB; least recently used images are removed beyond it. 0 means no limit")
+	presetFile := fs.String("preset", "", "Preset file setting options by name, as written by the tui subcommand; flags given on the command line take precedence")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s batch [flags] [image-or-pattern ...]\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	if *presetFile != "" {
+		if err := applyPreset(fs, *presetFile); err != nil {
+			return err
+		}
+	}
+
+	inputs, err := collectInputs(fs.Args(), *fileList)
+	if err != nil {
+		return err
+	}
+	jobs := inputJobs(opts.skipBackups(inputs))
+	if *jobFile != "" {
+		listed, err := readJobs(*jobFile)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, listed...)
+	}
+	if *retry != "" {
+		retried, err := readBatchManifest(*retry)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, retried...)
+	}
+	if err := opts.setup(); err != nil {
+		return err
+	}
+	if *cacheDir != "" {
+		if resultCache, err = newDiskCache(*cacheDir, *cacheSize<<20); err != nil {
+			return err
+		}
+	}
+	ctx, stop, release := handleSignals()
+	defer release()
+	return processBatch(ctx, stop, opts, batchOptions{Failures: *failures, Report: *report, Incremental: *incremental}, jobs)
+}
+
+// batchOptions holds the settings of a batch run that are not part of the
+// processing pipeline
+type batchOptions struct {
+	Failures    string
+	Report      string
+	Incremental bool
+}
+
+// processBatch processes every job with o, logging failures and carrying
+// on. It returns errBatchPartial if any input failed. Once stop is closed or
+// ctx is done, the remaining jobs are recorded as failed without being
+// processed, and errInterrupted is returned after writing the manifest.
+func processBatch(ctx context.Context, stop <-chan struct{}, o *processOptions, b batchOptions, jobs []batchJob) error {
+	if len(jobs) == 0 {
+		return fmt.Errorf("at least one input image is required")
+	}
+	if o.OutputFile != "" && len(jobs) > 1 && !(isObjectURI(o.OutputFile) && strings.HasSuffix(o.OutputFile, "/")) {
+		return fmt.Errorf("-output can only be used with a single input or an object storage prefix ending in /; outputs are named after each input")
+	}
+
+	if b.Incremental && o.Fingerprint {
+		return fmt.Errorf("-incremental cannot be combined with -fingerprint, whose output names are only known after processing")
+	}
+
+	manifestPath, err := prepareOutputPath("batch", b.Failures)
+	if err != nil {
+		return err
+	}
+
+	var reportPath string
+	if b.Report != "" {
+		if err := validateReportFormat(b.Report); err != nil {
+			return err
+		}
+		if reportPath, err = prepareOutputPath("batch", b.Report); err != nil {
+			return err
+		}
+	}
+
+	var state *incrementalState
+	if b.Incremental {
+		statePath, err := prepareOutputPath("batch", "incremental.json")
+		if err != nil {
+			return err
+		}
+		if state, err = loadIncrementalState(statePath); err != nil {
+			return err
+		}
+	}
+
+	manifest := batchManifest{Started: time.Now(), Failed: []batchFailure{}}
+	progress := newProgressBar("Processing", "images", len(jobs))
+	var entries []reportEntry
+	interrupted := false
+	for i, job := range jobs {
+		input := job.Input
+		if stopRequested(stop) || ctx.Err() != nil {
+			slog.Warn("Batch interrupted; remaining inputs are recorded for -retry", "remaining", len(jobs)-i)
+			for _, rest := range jobs[i:] {
+				manifest.Failed = append(manifest.Failed, batchFailure{Input: rest.Input, Output: rest.Output, Options: rest.Options, Error: "interrupted before processing"})
+			}
+			interrupted = true
+			break
+		}
+		result, err := processBatchInput(ctx, o, state, job)
+		status := "processed"
+		if errors.Is(err, errUpToDate) {
+			manifest.Skipped++
+			status = "skipped"
+		} else if err != nil {
+			slog.Error("Could not process image", "input", input, "error", err)
+			manifest.Failed = append(manifest.Failed, batchFailure{Input: input, Output: job.Output, Options: job.Options, Error: err.Error()})
+			progress.Add(1)
+			continue
+		} else {
+			manifest.Processed++
+		}
+
+		if reportPath != "" {
+			entry, err := newReportEntry(input, status, result)
+			if err != nil {
+				slog.Warn("Could not describe output for the report", "input", input, "error", err)
+			} else {
+				if strings.EqualFold(filepath.Ext(reportPath), ".html") {
+					entry.Preview = reportPreviewOf(o, input, entry.Output)
+				}
+				entries = append(entries, entry)
+			}
+		}
+		progress.Add(1)
+	}
+	progress.Finish()
+
+	slog.Info("Batch complete", "processed", manifest.Processed, "skipped", manifest.Skipped, "failed", len(manifest.Failed), "duration", time.Since(manifest.Started).Round(time.Millisecond))
+
+	if state != nil {
+		if err := state.save(); err != nil {
+			return err
+		}
+	}
+	if err := writeBatchManifest(manifestPath, manifest); err != nil {
+		return err
+	}
+	if err := saveFingerprints(); err != nil {
+		return err
+	}
+	if reportPath != "" {
+		if err := writeReport(reportPath, entries); err != nil {
+			return err
+		}
+		slog.Info("Report written", "path", reportPath, "entries", len(entries))
+	}
+	if len(manifest.Failed) > 0 {
+		slog.Warn("Failed inputs recorded; rerun them with -retry", "manifest", manifestPath)
+	}
+	if interrupted || ctx.Err() != nil {
+		return fmt.Errorf("batch %w", errInterrupted)
+	}
+	if len(manifest.Failed) > 0 {
+		return errBatchPartial
+	}
+	return nil
+}
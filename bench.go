@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// benchStage accumulates the cost of one pipeline stage over a benchmark run
+type benchStage struct {
+	name     string
+	duration time.Duration
+	allocs   uint64
+	bytes    uint64
+}
+
+// measure runs fn and adds its duration and heap allocations to the stage
+func (s *benchStage) measure(fn func() error) error {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	err := fn()
+	s.duration += time.Since(start)
+	runtime.ReadMemStats(&after)
+	s.allocs += after.Mallocs - before.Mallocs
+	s.bytes += after.TotalAlloc - before.TotalAlloc
+	return err
+}
+
+// benchSample is an input file held in memory so that disk reads are not timed
+type benchSample struct {
+	path   string
+	data   []byte
+	pixels int
+}
+
+// benchImage runs the decode, transform and encode stages once for a sample
+func benchImage(sample benchSample, stages []*benchStage, resizePercent float64, compressLevel int, format string) (int, error) {
+	var img image.Image
+	var inputFormat string
+	err := stages[0].measure(func() (err error) {
+		img, inputFormat, err = decodeImage(bytes.NewReader(sample.data))
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode %s: %w", sample.path, err)
+	}
+
+	outputFormat := format
+	if outputFormat == "" {
+		outputFormat = inputFormat
+	}
+
+	stages[1].measure(func() error {
+		if resizePercent > 0 {
+			width, height := resizedDimensions(img.Bounds(), resizePercent)
+			img = scaleImage(img, width, height)
+		}
+		if !formatSupportsAlpha(outputFormat) {
+			img = flattenAlpha(img, defaultBackground)
+		}
+		return nil
+	})
+
+	counter := &countingWriter{}
+	err = stages[2].measure(func() error {
+		return encodeImage(counter, img, outputFormat, compressLevel)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode %s: %w", sample.path, err)
+	}
+	return counter.n, nil
+}
+
+// countingWriter discards data, counting the bytes written
+type countingWriter struct {
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return io.Discard.Write(p)
+}
+
+// printBenchReport writes the per-stage timings and allocations of a run
+func printBenchReport(w io.Writer, stages []*benchStage, images, megapixels float64, elapsed time.Duration, outputBytes int) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "stage\ttotal\tper image\tshare\tallocs/image\tMB/image\t")
+	var total benchStage
+	for _, s := range stages {
+		total.duration += s.duration
+		total.allocs += s.allocs
+		total.bytes += s.bytes
+	}
+	for _, s := range append(stages, &benchStage{name: "total", duration: total.duration, allocs: total.allocs, bytes: total.bytes}) {
+		fmt.Fprintf(tw, "%s\t%v\t%v\t%.1f%%\t%.0f\t%.2f\t\n",
+			s.name,
+			s.duration.Round(time.Millisecond),
+			(s.duration / time.Duration(images)).Round(time.Microsecond),
+			100*s.duration.Seconds()/total.duration.Seconds(),
+			float64(s.allocs)/images,
+			float64(s.bytes)/images/(1<<20))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nThroughput: %.2f images/s, %.2f megapixels/s\n", images/elapsed.Seconds(), megapixels/elapsed.Seconds())
+	fmt.Fprintf(w, "Average output size: %.1f KB\n", float64(outputBytes)/images/1024)
+}
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	iterations := fs.Int("n", 5, "Number of times to process each sample")
+	resizePercent := new(float64)
+	fs.Var(percentValue{resizePercent}, "resize", "Resize percentage, e.g. 50, 12.5 or 200%. 0 means no resize")
+	compressLevel := fs.Int("compress", 0, "Compression level (1-100). 0 means no compression")
+	format := fs.String("format", "", "Output format to encode to. Defaults to each sample's format")
+	filter := fs.String("filter", "lanczos", "Resampling filter: lanczos, catmullrom, bilinear or area")
+	linear := fs.Bool("linear-resize", true, "Resize in linear light. -linear-resize=false scales the sRGB values directly")
+	effort := fs.Int("effort", -1, "Encoding effort from 0 (fastest) to 9 (smallest files) for PNG and WebP output. -1 keeps each encoder's default")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bench [flags] sample1 sample2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		return fmt.Errorf("at least one sample image is required")
+	}
+	if *iterations < 1 {
+		return fmt.Errorf("n must be at least 1")
+	}
+	if err := validateFlags(&inputs[0], resizePercent, compressLevel, format); err != nil {
+		return err
+	}
+	if f := strings.ToLower(*format); f == "pdf" || f == "dds" {
+		return fmt.Errorf("bench does not support %s output", f)
+	}
+	if err := setScaler(*filter); err != nil {
+		return err
+	}
+	linearResize = *linear
+	if *effort < -1 || *effort > 9 {
+		return fmt.Errorf("effort must be between 0 and 9, or -1 for the encoder's default")
+	}
+	encodeEffort = *effort
+
+	// Load every sample up front and check that it decodes
+	var samples []benchSample
+	for _, path := range inputs {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		config, _, err := decodeConfig(data)
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		samples = append(samples, benchSample{path: path, data: data, pixels: config.Width * config.Height})
+	}
+
+	progress := newProgressBar("Benchmarking", "images", len(samples)**iterations)
+
+	// Keep per-image messages out of the report
+	level := logLevel.Level()
+	logLevel.Set(max(level, slog.LevelWarn))
+	defer logLevel.Set(level)
+
+	stages := []*benchStage{{name: "decode"}, {name: "transform"}, {name: "encode"}}
+	var megapixels float64
+	outputBytes := 0
+	start := time.Now()
+	for i := 0; i < *iterations; i++ {
+		for _, sample := range samples {
+			n, err := benchImage(sample, stages, *resizePercent, *compressLevel, strings.ToLower(*format))
+			if err != nil {
+				return err
+			}
+			outputBytes += n
+			megapixels += float64(sample.pixels) / 1e6
+			progress.Add(1)
+		}
+	}
+	elapsed := time.Since(start)
+	progress.Finish()
+
+	images := float64(len(samples) * *iterations)
+	fmt.Printf("Processed %d sample(s) x %d iteration(s) on %d CPU(s)\n\n", len(samples), *iterations, runtime.GOMAXPROCS(0))
+	printBenchReport(os.Stdout, stages, images, megapixels, elapsed, outputBytes)
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultCache holds processed images for batch runs and the server, or nil
+// when caching is disabled
+var resultCache *diskCache
+
+// diskCache stores results as files named by their key, spread over
+// subdirectories by the key's first two characters. Once the entries exceed
+// maxSize bytes, the least recently used ones are removed.
+type diskCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+// cacheEntry is the size of one cached file, tracked for eviction
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// newDiskCache returns a cache in dir holding at most maxSize bytes, or no
+// limit if maxSize is 0. Entries already in dir are kept, ordered by their
+// modification time, which Get refreshes on every hit.
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	if maxSize < 0 {
+		return nil, errors.New("cache size must not be negative")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	type existing struct {
+		cacheEntry
+		used time.Time
+	}
+	var found []existing
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.Contains(d.Name(), ".tmp") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		found = append(found, existing{cacheEntry{d.Name(), info.Size()}, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	slices.SortFunc(found, func(a, b existing) int { return b.used.Compare(a.used) })
+
+	c := &diskCache{dir: dir, maxSize: maxSize, lru: list.New(), entries: map[string]*list.Element{}}
+	for _, e := range found {
+		c.entries[e.key] = c.lru.PushBack(&e.cacheEntry)
+		c.size += e.size
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	slog.Debug("Opened cache", "dir", dir, "entries", len(found), "bytes", c.size)
+	return c, nil
+}
+
+// path returns the file holding key, which must be at least two characters
+func (c *diskCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// Get returns the cached value for key, or ok == false on a miss
+func (c *diskCache) Get(key string) (data []byte, ok bool, err error) {
+	data, err = os.ReadFile(c.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		metrics.cacheMisses.Add(1)
+		c.mu.Lock()
+		c.remove(key)
+		c.mu.Unlock()
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read cache entry: %w", err)
+	}
+
+	metrics.cacheHits.Add(1)
+
+	// The modification time keeps the recency order across restarts
+	now := time.Now()
+	os.Chtimes(c.path(key), now, now)
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[key] = c.lru.PushFront(&cacheEntry{key, int64(len(data))})
+		c.size += int64(len(data))
+	}
+	c.mu.Unlock()
+	return data, true, nil
+}
+
+// Put stores data under key. The entry is written atomically, so concurrent
+// readers never see a partial entry.
+func (c *diskCache) Put(key string, data []byte) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, int64(len(data))})
+	c.size += int64(len(data))
+	return c.evict()
+}
+
+// remove forgets key. The caller must hold c.mu.
+func (c *diskCache) remove(key string) {
+	if el, ok := c.entries[key]; ok {
+		c.size -= el.Value.(*cacheEntry).size
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// evict deletes the least recently used entries until the cache fits in
+// maxSize. The caller must hold c.mu.
+func (c *diskCache) evict() error {
+	var errs []error
+	for c.maxSize > 0 && c.size > c.maxSize && c.lru.Len() > 0 {
+		e := c.lru.Back().Value.(*cacheEntry)
+		if err := os.Remove(c.path(e.key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("failed to evict cache entry: %w", err))
+		}
+		c.remove(e.key)
+		slog.Debug("Evicted cache entry", "key", e.key, "bytes", e.size)
+	}
+	return errors.Join(errs...)
+}
+
+// signature describes the operations o applies to an input named name, so
+// that equal signatures produce identical output from identical input
+func (o *processOptions) signature(name string) string {
+	// Leave out settings that only affect where the output goes or how fast
+	// it is produced
+	s := *o
+	s.OutputFile, s.MaxPixels, s.MaxInputBytes, s.MaxOutputPixels, s.Threads, s.Timeout = "", 0, 0, 0, 0, 0
+	s.Filter = strings.ToLower(s.Filter)
+	s.backgroundColor, s.ops = nil, nil
+	return fmt.Sprintf("%s %+v", strings.ToLower(filepath.Ext(name)), s)
+}
+
+// cacheVersion is hashed into every cache key. Bump it when the output for
+// the same input and options changes, or the layout of entries does, so that
+// entries written by older builds are missed instead of served.
+const cacheVersion = 1
+
+// cacheKey identifies the result of applying o to data read from name
+func cacheKey(o *processOptions, name string, data []byte) string {
+	return resultKey("data", o, name, data)
+}
+
+// resultKey hashes source, of the given kind, with everything that shapes
+// the result of processing it: o as applied to an input named name, the
+// encoder defaults of the defaults file in effect and cacheVersion. The kind
+// keeps keys of different sources apart in a shared cache.
+func resultKey(kind string, o *processOptions, name string, source []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "v%d %s %d\n", cacheVersion, kind, len(source))
+	h.Write(source)
+	io.WriteString(h, o.signature(name))
+	fmt.Fprintf(h, " %+v", siteDefaults)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// processImageCached is processImage backed by resultCache. Cache entries
+// hold the result as JSON on the first line, then the encoded image.
+func processImageCached(ctx context.Context, o *processOptions, name string, data []byte, outPath string, w io.Writer) (processResult, error) {
+	if resultCache == nil {
+		return processImage(ctx, o, name, data, nil, outPath, w)
+	}
+
+	key := cacheKey(o, name, data)
+	entry, hit, err := resultCache.Get(key)
+	if err != nil {
+		slog.Warn("Could not read cache", "error", err)
+	}
+	if hit {
+		header, encoded, _ := bytes.Cut(entry, []byte("\n"))
+		var result processResult
+		if err := json.Unmarshal(header, &result); err == nil {
+			if _, err := w.Write(encoded); err != nil {
+				return result, fmt.Errorf("failed to write output image: %w", err)
+			}
+			result.Output = outPath
+			slog.Info("Processed image served from cache", "path", outPath)
+			return result, nil
+		}
+		slog.Warn("Ignoring corrupt cache entry", "key", key)
+	}
+
+	var encoded bytes.Buffer
+	result, err := processImage(ctx, o, name, data, nil, outPath, &encoded)
+	if err != nil {
+		return result, err
+	}
+	header, err := json.Marshal(processResult{
+		Format:       result.Format,
+		SourceWidth:  result.SourceWidth,
+		SourceHeight: result.SourceHeight,
+		Width:        result.Width,
+		Height:       result.Height,
+	})
+	if err == nil {
+		err = resultCache.Put(key, slices.Concat(header, []byte("\n"), encoded.Bytes()))
+	}
+	if err != nil {
+		slog.Warn("Could not write cache", "error", err)
+	}
+	if _, err := w.Write(encoded.Bytes()); err != nil {
+		return result, fmt.Errorf("failed to write output image: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestCacheKeyCoversEncoderDefaults(t *testing.T) {
+	defer func(d encoderDefaults) { siteDefaults = d }(siteDefaults)
+	o := &processOptions{Filter: "lanczos"}
+	data := []byte("image")
+	key := cacheKey(o, "a.jpg", data)
+	if again := cacheKey(o, "a.jpg", data); again != key {
+		t.Fatalf("equal inputs gave keys %s and %s", key, again)
+	}
+
+	siteDefaults.JPEGQuality = 80
+	if cacheKey(o, "a.jpg", data) == key {
+		t.Error("changing the default JPEG quality kept the cache key")
+	}
+	siteDefaults.JPEGQuality = 95
+	siteDefaults.StripMetadata = !siteDefaults.StripMetadata
+	if cacheKey(o, "a.jpg", data) == key {
+		t.Error("changing the default metadata stripping kept the cache key")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// checkExtensions are the files the check subcommand looks at in directories
+var checkExtensions = slices.Concat([]string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".tif", ".tiff", ".bmp", ".ico",
+	".qoi", ".pbm", ".pgm", ".ppm", ".pnm", ".dds", ".svg", ".avif", ".heic"}, hdrExtensions, rawExtensions)
+
+// checkLimits are the rules the check subcommand enforces
+type checkLimits struct {
+	MaxBytes   int64
+	MaxWidth   int
+	MaxHeight  int
+	Disallowed []string // format names, as given to -disallow-formats
+	NoMetadata bool
+	NoGPS      bool
+}
+
+// violations returns how the image at path, holding data, breaks the limits
+func (l *checkLimits) violations(path string, data []byte) []string {
+	var found []string
+	if l.MaxBytes > 0 && int64(len(data)) > l.MaxBytes {
+		found = append(found, fmt.Sprintf("%d bytes exceeds max-bytes %d", len(data), l.MaxBytes))
+	}
+
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	config, format, err := decodeConfig(data)
+	if err != nil {
+		format = ext
+		if l.MaxWidth > 0 || l.MaxHeight > 0 {
+			found = append(found, fmt.Sprintf("size cannot be read: %v", err))
+		}
+	} else {
+		if l.MaxWidth > 0 && config.Width > l.MaxWidth {
+			found = append(found, fmt.Sprintf("width %d exceeds max-width %d", config.Width, l.MaxWidth))
+		}
+		if l.MaxHeight > 0 && config.Height > l.MaxHeight {
+			found = append(found, fmt.Sprintf("height %d exceeds max-height %d", config.Height, l.MaxHeight))
+		}
+	}
+	for _, name := range []string{format, ext} {
+		if slices.ContainsFunc(l.Disallowed, func(d string) bool { return formatAlias(d) == formatAlias(name) }) {
+			found = append(found, fmt.Sprintf("format %s is not allowed", name))
+			break
+		}
+	}
+
+	if l.NoMetadata || l.NoGPS {
+		if m, err := readFileMetadata(data); err == nil {
+			if l.NoMetadata && m.Exif != nil {
+				found = append(found, "carries EXIF metadata")
+			}
+			if l.NoMetadata && m.XMP != nil {
+				found = append(found, "carries XMP metadata")
+			}
+			if l.NoGPS && hasExifGPS(m.Exif) {
+				found = append(found, "carries a GPS location")
+			}
+		}
+	}
+	return found
+}
+
+// hasExifGPS reports whether an EXIF payload points to a GPS IFD
+func hasExifGPS(exif []byte) bool {
+	t, err := newTIFFReader(exif)
+	if err != nil {
+		return false
+	}
+	_, found := t.findEntry(t.firstIFD(), exifTagGPSIFD)
+	return found
+}
+
+// applyCheckConfig sets the flags of fs named in a config file, written in
+// the sidecar format, that were not given on the command line
+func applyCheckConfig(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	settings, err := parseSidecar(data)
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		switch {
+		case given[name]:
+		case name == "config" || fs.Lookup(name) == nil:
+			errs = append(errs, fmt.Errorf("invalid config %s: unknown setting %q", path, name))
+		default:
+			if err := fs.Set(name, settings[name]); err != nil {
+				errs = append(errs, fmt.Errorf("invalid config %s: invalid value %q for %s: %w", path, settings[name], name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runCheck implements the check subcommand
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	var limits checkLimits
+	fs.Int64Var(&limits.MaxBytes, "max-bytes", 0, "Largest file size allowed in bytes. 0 means no limit")
+	fs.IntVar(&limits.MaxWidth, "max-width", 0, "Widest image allowed in pixels. 0 means no limit")
+	fs.IntVar(&limits.MaxHeight, "max-height", 0, "Tallest image allowed in pixels. 0 means no limit")
+	fs.Func("disallow-formats", "Comma-separated formats not allowed, e.g. bmp,tiff, by content or file extension", func(value string) error {
+		limits.Disallowed = nil
+		for _, format := range strings.Split(strings.ToLower(value), ",") {
+			if format = strings.TrimPrefix(strings.TrimSpace(format), "."); format != "" {
+				limits.Disallowed = append(limits.Disallowed, format)
+			}
+		}
+		return nil
+	})
+	fs.BoolVar(&limits.NoMetadata, "no-metadata", false, "Fail JPEG and PNG files that carry EXIF or XMP metadata")
+	fs.BoolVar(&limits.NoGPS, "no-gps", false, "Fail JPEG and PNG files whose EXIF records a GPS location")
+	configFile := fs.String("config", "", "File setting these limits by name, in the sidecar format; flags given on the command line take precedence")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check [flags] directory-or-image ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	if *configFile != "" {
+		if err := applyCheckConfig(fs, *configFile); err != nil {
+			return err
+		}
+	}
+	if limits.MaxBytes < 0 || limits.MaxWidth < 0 || limits.MaxHeight < 0 {
+		return errors.New("max-bytes, max-width and max-height must not be negative")
+	}
+	if limits.MaxBytes == 0 && limits.MaxWidth == 0 && limits.MaxHeight == 0 && len(limits.Disallowed) == 0 && !limits.NoMetadata && !limits.NoGPS {
+		return errors.New("check needs a limit: give -max-bytes, -max-width, -max-height, -disallow-formats, -no-metadata, -no-gps or -config")
+	}
+	if fs.NArg() == 0 {
+		return errors.New("at least one directory or image is required")
+	}
+	paths, err := walkImages(fs.Args(), checkExtensions)
+	if err != nil {
+		return err
+	}
+
+	// Violations go to stdout, one per line, for CI logs and scripts
+	images, failed, violations := 0, 0, 0
+	for _, path := range paths {
+		if !slices.Contains(checkExtensions, strings.ToLower(filepath.Ext(path))) {
+			slog.Debug("Skipping file that is not an image", "path", path)
+			continue
+		}
+		images++
+		data, err := readInputFile(path)
+		if err != nil {
+			fmt.Printf("%s: cannot be read: %v\n", path, err)
+			failed++
+			violations++
+			continue
+		}
+		found := limits.violations(path, data)
+		for _, v := range found {
+			fmt.Printf("%s: %s\n", path, v)
+		}
+		if len(found) > 0 {
+			failed++
+			violations += len(found)
+		}
+	}
+	slog.Info("Check complete", "images", images, "failed", failed, "violations", violations)
+	if violations > 0 {
+		return errBatchPartial
+	}
+	return nil
+}
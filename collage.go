@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// collageTemplate is the JSON layout the collage subcommand fills. Paths in
+// the template are relative to the template file.
+type collageTemplate struct {
+	Width           int           `json:"width"`
+	Height          int           `json:"height"`
+	Background      string        `json:"background"`
+	BackgroundImage string        `json:"background_image"`
+	Slots           []collageSlot `json:"slots"`
+	Texts           []collageText `json:"texts"`
+}
+
+// collageSlot is a rectangle of the collage holding one image. Slots without
+// an image of their own take the input images in order.
+type collageSlot struct {
+	X          int    `json:"x"`
+	Y          int    `json:"y"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Fit        string `json:"fit"`
+	Background string `json:"background"`
+	Image      string `json:"image"`
+}
+
+// collageText is a block of text drawn over the collage, wrapped to its
+// width if it has one
+type collageText struct {
+	Text  string  `json:"text"`
+	X     int     `json:"x"`
+	Y     int     `json:"y"`
+	Width int     `json:"width"`
+	Size  float64 `json:"size"`
+	Font  string  `json:"font"`
+	Color string  `json:"color"`
+	Align string  `json:"align"`
+}
+
+// readCollageTemplate reads and checks a template, resolving its paths
+// against the template's directory
+func readCollageTemplate(path string) (*collageTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %w", err)
+	}
+	var t collageTemplate
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return nil, fmt.Errorf("failed to parse template %s: %w", path, err)
+	}
+	if err := t.check(); err != nil {
+		return nil, fmt.Errorf("invalid template %s: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	t.BackgroundImage = resolve(t.BackgroundImage)
+	for i := range t.Slots {
+		t.Slots[i].Image = resolve(t.Slots[i].Image)
+	}
+	return &t, nil
+}
+
+// check returns an error for the first setting of t that cannot be drawn
+func (t *collageTemplate) check() error {
+	if t.Width < 1 || t.Height < 1 || t.Width > maxSizeSide || t.Height > maxSizeSide {
+		return fmt.Errorf("size %dx%d must be between 1 and %d on each side", t.Width, t.Height, maxSizeSide)
+	}
+	colors := []string{t.Background}
+	for i, s := range t.Slots {
+		if s.Width < 1 || s.Height < 1 {
+			return fmt.Errorf("slot %d: width and height must be positive", i+1)
+		}
+		if s.Fit != "" && s.Fit != "cover" && s.Fit != "contain" {
+			return fmt.Errorf("slot %d: invalid fit %q: expected cover or contain", i+1, s.Fit)
+		}
+		colors = append(colors, s.Background)
+	}
+	for i, text := range t.Texts {
+		if text.Width < 0 {
+			return fmt.Errorf("text %d: width cannot be negative", i+1)
+		}
+		if err := checkTextAlign(text.Align); err != nil {
+			return fmt.Errorf("text %d: %w", i+1, err)
+		}
+		if _, err := loadFontFace(text.Font, text.Size); err != nil {
+			return fmt.Errorf("text %d: %w", i+1, err)
+		}
+		colors = append(colors, text.Color)
+	}
+	for _, c := range colors {
+		if c == "" {
+			continue
+		}
+		if _, err := parseHexColor(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openSlots returns the number of slots filled from the input images
+func (t *collageTemplate) openSlots() int {
+	n := 0
+	for _, s := range t.Slots {
+		if s.Image == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// coverImage scales img to fill width x height, keeping its aspect ratio,
+// and crops the overflow evenly from both sides
+func coverImage(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	scale := max(float64(width)/float64(bounds.Dx()), float64(height)/float64(bounds.Dy()))
+	scaledWidth := max(width, int(float64(bounds.Dx())*scale+0.5))
+	scaledHeight := max(height, int(float64(bounds.Dy())*scale+0.5))
+	scaled := scaleImage(img, uint(scaledWidth), uint(scaledHeight))
+	sb := scaled.Bounds()
+	offset := image.Pt((scaledWidth-width)/2, (scaledHeight-height)/2)
+	cropped := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(cropped, cropped.Rect, scaled, sb.Min.Add(offset), draw.Src)
+	return cropped
+}
+
+// placeImage draws img into rect of dst, scaled to cover the rectangle or to
+// fit inside it, centred
+func placeImage(dst draw.Image, rect image.Rectangle, img image.Image, fit string) {
+	if fit == "contain" {
+		img = fitWithin(img, rect.Dx(), rect.Dy())
+	} else {
+		img = coverImage(img, rect.Dx(), rect.Dy())
+	}
+	b := img.Bounds()
+	pt := rect.Min.Add(image.Pt((rect.Dx()-b.Dx())/2, (rect.Dy()-b.Dy())/2))
+	draw.Draw(dst, image.Rectangle{Min: pt, Max: pt.Add(b.Size())}, img, b.Min, draw.Over)
+}
+
+// buildCollage draws the template with inputs in its open slots. Slots left
+// without an image show only their background.
+func buildCollage(t *collageTemplate, inputs []string) (*image.NRGBA, error) {
+	canvas := image.NewNRGBA(image.Rect(0, 0, t.Width, t.Height))
+	fill := func(rect image.Rectangle, hex string) {
+		if hex != "" {
+			c, _ := parseHexColor(hex)
+			draw.Draw(canvas, rect, image.NewUniform(c), image.Point{}, draw.Over)
+		}
+	}
+	fill(canvas.Rect, t.Background)
+	if t.BackgroundImage != "" {
+		img, _, err := loadImage(t.BackgroundImage)
+		if err != nil {
+			return nil, err
+		}
+		placeImage(canvas, canvas.Rect, img, "cover")
+	}
+
+	next := 0
+	for i, s := range t.Slots {
+		rect := image.Rect(s.X, s.Y, s.X+s.Width, s.Y+s.Height)
+		fill(rect, s.Background)
+		path := s.Image
+		if path == "" {
+			if next == len(inputs) {
+				continue
+			}
+			path = inputs[next]
+			next++
+		}
+		img, _, err := loadImage(path)
+		if err != nil {
+			return nil, err
+		}
+		placeImage(canvas, rect, img, s.Fit)
+		slog.Debug("Filled slot", "slot", i+1, "file", path)
+	}
+	if next < t.openSlots() {
+		slog.Warn("Fewer images than slots; the rest are left empty", "images", len(inputs), "slots", t.openSlots())
+	}
+
+	for _, text := range t.Texts {
+		face, err := loadFontFace(text.Font, text.Size)
+		if err != nil {
+			return nil, err
+		}
+		var col color.Color = color.Black
+		if text.Color != "" {
+			col, _ = parseHexColor(text.Color)
+		}
+		drawText(canvas, face, wrapText(face, text.Text, text.Width), text.X, text.Y, text.Width, text.Align, col)
+		face.Close()
+	}
+	return canvas, nil
+}
+
+// runCollage implements the collage subcommand
+func runCollage(args []string) error {
+	fs := flag.NewFlagSet("collage", flag.ExitOnError)
+	templateFile := fs.String("template", "", "JSON layout template with the collage's size, background, image slots and text (required)")
+	outputFile := fs.String("output", "collage.png", "Output image file path")
+	compressLevel := fs.Int("compress", 0, "Compression level (1-100) for the output image. 0 means no compression")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s collage -template layout.json [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	if *templateFile == "" {
+		return fmt.Errorf("template is required. Use -template flag to specify the layout")
+	}
+	t, err := readCollageTemplate(*templateFile)
+	if err != nil {
+		return err
+	}
+	inputs := fs.Args()
+	if len(inputs) > t.openSlots() {
+		return fmt.Errorf("the template has %d slots for input images but %d were given", t.openSlots(), len(inputs))
+	}
+
+	collage, err := buildCollage(t, inputs)
+	if err != nil {
+		return err
+	}
+
+	outPath, err := prepareOutputPath("collage", *outputFile)
+	if err != nil {
+		return err
+	}
+	if err := saveImage(outPath, collage, *compressLevel); err != nil {
+		return err
+	}
+
+	slog.Info("Collage saved", "images", len(inputs), "size", fmt.Sprintf("%dx%d", t.Width, t.Height), "path", outPath)
+	return nil
+}
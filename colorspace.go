@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// supportedColorspaces lists the values accepted by the -colorspace flag
+var supportedColorspaces = []string{"rgb", "gray"}
+
+// adobeCMYKSegment is an APP14 "Adobe" segment declaring untransformed CMYK
+var adobeCMYKSegment = []byte{
+	0xff, 0xee, 0x00, 0x0e,
+	'A', 'd', 'o', 'b', 'e',
+	0x00, 0x64, // version
+	0x00, 0x00, // flags0
+	0x00, 0x00, // flags1
+	0x00, // transform: unknown (CMYK)
+}
+
+// jpegComponentInfo reports the number of colour components of a JPEG and
+// whether it carries an Adobe APP14 segment
+func jpegComponentInfo(data []byte) (components int, hasAdobe bool) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 0, false
+	}
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xff; {
+		marker := data[pos+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		segment := data[pos+4 : pos+2+length]
+		switch {
+		case marker == 0xee && bytes.HasPrefix(segment, []byte("Adobe")):
+			hasAdobe = true
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			// Start of frame: precision, height, width, component count
+			if len(segment) >= 6 {
+				components = int(segment[5])
+			}
+		}
+		pos += 2 + length
+	}
+	return components, hasAdobe
+}
+
+// decodeUnmarkedCMYKJPEG decodes a 4-component JPEG without an Adobe APP14
+// segment. Such files (common from print workflows) store plain, non-inverted
+// CMYK, which the standard decoder refuses to guess at.
+func decodeUnmarkedCMYKJPEG(data []byte) (image.Image, error) {
+	patched := make([]byte, 0, len(data)+len(adobeCMYKSegment))
+	patched = append(patched, data[:2]...)
+	patched = append(patched, adobeCMYKSegment...)
+	patched = append(patched, data[2:]...)
+
+	img, _, err := image.Decode(bytes.NewReader(patched))
+	if err != nil {
+		return nil, err
+	}
+	cmyk, ok := img.(*image.CMYK)
+	if !ok {
+		return img, nil
+	}
+
+	// The decoder assumes Adobe's inverted CMYK convention; undo it
+	for i := range cmyk.Pix {
+		cmyk.Pix[i] = 255 - cmyk.Pix[i]
+	}
+	return cmyk, nil
+}
+
+// decodeImage decodes an image from r, enforcing inputLimits. Besides the
+// registered formats it handles CMYK JPEGs that lack the Adobe marker.
+func decodeImage(r io.Reader) (image.Image, string, error) {
+	return decodeImageContext(context.Background(), r)
+}
+
+// decodeImageContext is decodeImage, stopping when ctx is done
+func decodeImageContext(ctx context.Context, r io.Reader) (image.Image, string, error) {
+	data, err := inputLimits.readInput(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := inputLimits.checkHeader(data); err != nil {
+		return nil, "", err
+	}
+	if isCameraRaw(data) {
+		img, err := decodeCameraRaw(data)
+		return img, "raw", err
+	}
+
+	img, format, err := image.Decode(ctxReader{ctx, bytes.NewReader(data)})
+	if err != nil {
+		if components, hasAdobe := jpegComponentInfo(data); components == 4 && !hasAdobe {
+			img, err = decodeUnmarkedCMYKJPEG(data)
+			return img, "jpeg", err
+		}
+	}
+	return img, format, err
+}
+
+// decodeConfig returns the dimensions and format of the image in data, like
+// image.DecodeConfig but reading camera RAW files before the TIFF decoder
+// can claim them
+func decodeConfig(data []byte) (image.Config, string, error) {
+	if isCameraRaw(data) {
+		config, err := decodeCameraRawConfig(data)
+		return config, "raw", err
+	}
+	return image.DecodeConfig(bytes.NewReader(data))
+}
+
+// isCMYKImage reports whether img stores CMYK pixels
+func isCMYKImage(img image.Image) bool {
+	_, ok := img.(*image.CMYK)
+	return ok
+}
+
+// applyColorspace converts img to the target colour space: "rgb" turns CMYK
+// images into RGB and leaves others unchanged, "gray" converts to greyscale.
+func applyColorspace(img image.Image, target string) (image.Image, error) {
+	switch strings.ToLower(target) {
+	case "", "rgb":
+		if !isCMYKImage(img) {
+			return img, nil
+		}
+		bounds := img.Bounds()
+		rgba := image.NewRGBA(bounds)
+		drawParallel(rgba, bounds, img, bounds.Min)
+		slog.Info("Converted CMYK image to RGB")
+		return rgba, nil
+
+	case "gray":
+		if isGrayImage(img) {
+			return img, nil
+		}
+		bounds := img.Bounds()
+		var gray draw.Image = image.NewGray(bounds)
+		if imageDepth(img) == 16 {
+			gray = image.NewGray16(bounds)
+		}
+		drawParallel(gray, bounds, img, bounds.Min)
+		slog.Info("Converted image to grayscale")
+		return gray, nil
+	}
+
+	return nil, fmt.Errorf("unsupported colorspace %q. Supported colorspaces: %s", target, strings.Join(supportedColorspaces, ", "))
+}
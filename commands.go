@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image/color"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// sharedProcessFlags are the pipeline flags every processing subcommand
+// accepts: limits, performance, resampling, HDR decoding and encoding effort
+var sharedProcessFlags = []string{"filter", "linear-resize", "tone-map", "exposure", "effort", "threads", "max-pixels", "max-input-bytes", "max-memory", "max-output-pixels", "timeout"}
+
+// addCommandFlags registers the pipeline flags named in names, and the
+// shared ones, on fs and returns the options they set. The pipeline's other
+// flags keep their defaults.
+func addCommandFlags(fs *flag.FlagSet, names ...string) *processOptions {
+	all := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	o := addProcessFlags(all)
+	for _, name := range append(names, sharedProcessFlags...) {
+		f := all.Lookup(name)
+		fs.Var(f.Value, name, f.Usage)
+	}
+	return o
+}
+
+// processCommandInputs processes the images given to convert, resize or
+// ico. A single image is processed like the main command's -input, several
+// images, glob patterns and archives like the batch subcommand. Several
+// images converted to PDF become the pages of one document instead.
+func processCommandInputs(o *processOptions, inputs []string) error {
+	if len(inputs) == 0 {
+		return errors.New("at least one input image is required")
+	}
+	if err := o.setup(); err != nil {
+		return err
+	}
+	ctx, stop, release := handleSignals()
+	defer release()
+
+	pages := strings.EqualFold(o.OutputFormat, "pdf") && !slices.ContainsFunc(inputs, func(path string) bool { return isGlobPattern(path) || isArchive(path) })
+	if len(inputs) == 1 && !isGlobPattern(inputs[0]) || pages {
+		_, err := processFile(ctx, o, inputs[0], inputs[1:])
+		if errors.Is(err, context.Canceled) {
+			return fmt.Errorf("%w: no output was written", errInterrupted)
+		}
+		return err
+	}
+	paths, err := collectInputs(inputs, "")
+	if err != nil {
+		return err
+	}
+	return processBatch(ctx, stop, o, batchOptions{Failures: "failures.json"}, inputJobs(o.skipBackups(paths)))
+}
+
+// runConvert implements the convert subcommand
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	opts := addCommandFlags(fs, "format", "formats", "output", "compress", "auto-quality", "optimize", "zopfli", "interlace",
+		"dpi", "page-size", "page", "density", "pdf-renderer", "frame", "depth", "depth-dither", "colorspace", "icc-convert", "icc", "background",
+		"colors", "dither", "alpha-threshold", "dds-format", "mipmaps", "text-width", "keep-exif", "strip-gps", "recipe", "compare-output", "in-place", "backup-dir", "op")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s convert -format format [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	if opts.OutputFormat == "" && len(opts.Formats) == 0 {
+		return errors.New("convert needs an output format: give -format or -formats")
+	}
+	return processCommandInputs(opts, fs.Args())
+}
+
+// runResize implements the resize subcommand
+func runResize(args []string) error {
+	fs := flag.NewFlagSet("resize", flag.ExitOnError)
+	opts := addCommandFlags(fs, "resize", "max-width", "max-height", "size", "output", "format", "compress", "auto-quality",
+		"dct-scaling", "use-exif-thumbnail", "upscale-model", "keep-exif", "strip-gps", "recipe", "compare-output", "in-place", "backup-dir", "op")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s resize -resize percent|-max-width pixels|-max-height pixels|-size WxH [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	if opts.ResizePercent == 0 && opts.MaxWidth == 0 && opts.MaxHeight == 0 && opts.Operations["size"] == "" {
+		return errors.New("resize needs a size: give -resize, -max-width, -max-height or -size")
+	}
+	return processCommandInputs(opts, fs.Args())
+}
+
+// runICO implements the ico subcommand
+func runICO(args []string) error {
+	fs := flag.NewFlagSet("ico", flag.ExitOnError)
+	opts := addCommandFlags(fs, "output", "auto-resize-ico", "page", "density", "pdf-renderer", "frame", "recipe", "op")
+	opts.ConvertToIco = true
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ico [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	return processCommandInputs(opts, fs.Args())
+}
+
+// imageInfo describes an image file for the info subcommand
+type imageInfo struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Color  string `json:"color"`
+	Depth  int    `json:"depth,omitempty"`
+	Frames int    `json:"frames"`
+	DPI    string `json:"dpi,omitempty"`
+	ICC    string `json:"icc,omitempty"`
+	Exif   bool   `json:"exif"`
+	Bytes  int    `json:"bytes"`
+}
+
+// describeColorModel names a color model and its bits per channel, or 0
+// bits if unknown. PNG decoders report truecolor images without alpha as
+// RGBA and those with alpha as NRGBA.
+func describeColorModel(model color.Model) (string, int) {
+	if p, ok := model.(color.Palette); ok {
+		return fmt.Sprintf("paletted, %d colors", len(p)), 8
+	}
+	switch model {
+	case color.RGBAModel:
+		return "RGB", 8
+	case color.RGBA64Model:
+		return "RGB", 16
+	case color.NRGBAModel:
+		return "RGBA", 8
+	case color.NRGBA64Model:
+		return "RGBA", 16
+	case color.GrayModel:
+		return "gray", 8
+	case color.Gray16Model:
+		return "gray", 16
+	case color.YCbCrModel:
+		return "YCbCr", 8
+	case color.NYCbCrAModel:
+		return "YCbCr with alpha", 8
+	case color.CMYKModel:
+		return "CMYK", 8
+	}
+	return "other", 0
+}
+
+// readImageInfo describes the image at path from its header and metadata,
+// without decoding its pixels
+func readImageInfo(path string) (imageInfo, error) {
+	data, err := readInputFile(path)
+	if err != nil {
+		return imageInfo{}, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	config, format, err := decodeConfig(data)
+	if err != nil {
+		return imageInfo{}, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	info := imageInfo{Path: path, Format: format, Width: config.Width, Height: config.Height, Bytes: len(data)}
+	info.Color, info.Depth = describeColorModel(config.ColorModel)
+	// A damaged animation still has its first frame
+	info.Frames, _ = countFrames(data)
+	if density, ok := readImageDensity(data); ok {
+		info.DPI = density.String()
+	}
+	if profile := readEmbeddedICC(data); profile != nil {
+		if info.ICC = profileDescription(profile); info.ICC == "" {
+			info.ICC = "unnamed profile"
+		}
+	}
+	exif := readJPEGExif(data)
+	if exif == nil {
+		_, _, exif, _ = pngChunkBounds(data, "eXIf", func([]byte) bool { return true })
+	}
+	info.Exif = exif != nil
+	return info, nil
+}
+
+// printImageInfo prints info as an indented list of fields under its path
+func printImageInfo(info imageInfo) {
+	fmt.Println(info.Path)
+	fmt.Printf("  format: %s\n", info.Format)
+	fmt.Printf("  size: %dx%d\n", info.Width, info.Height)
+	if info.Depth > 0 {
+		fmt.Printf("  color: %s, %d-bit\n", info.Color, info.Depth)
+	} else {
+		fmt.Printf("  color: %s\n", info.Color)
+	}
+	if info.Frames > 1 {
+		fmt.Printf("  frames: %d\n", info.Frames)
+	}
+	if info.DPI != "" {
+		fmt.Printf("  dpi: %s\n", info.DPI)
+	}
+	if info.ICC != "" {
+		fmt.Printf("  icc: %s\n", info.ICC)
+	}
+	if info.Exif {
+		fmt.Println("  exif: yes")
+	}
+	fmt.Printf("  bytes: %d\n", info.Bytes)
+}
+
+// runInfo implements the info subcommand
+func runInfo(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	fileList := addFileListFlag(fs, "File naming images one per line, or - to read the list from stdin")
+	jsonOutput := fs.Bool("json", false, "Print the details of each image as one JSON object per line")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s info [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(fs.Output(), "Prints the format, size, color model and metadata of each image without decoding it.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	inputs, err := collectInputs(fs.Args(), *fileList)
+	if err != nil {
+		return err
+	}
+	if len(inputs) == 0 {
+		return errors.New("at least one input image is required")
+	}
+	failed := 0
+	for _, path := range inputs {
+		info, err := readImageInfo(path)
+		if err != nil {
+			slog.Error("Could not read image", "path", path, "error", err)
+			failed++
+			continue
+		}
+		if *jsonOutput {
+			line, _ := json.Marshal(info)
+			fmt.Println(string(line))
+		} else {
+			printImageInfo(info)
+		}
+	}
+	if failed > 0 {
+		return errBatchPartial
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+)
+
+// compareModes are the layouts of -compare-output
+var compareModes = []string{"side", "split"}
+
+// compareLineWidth is the width of the line between the two images of a
+// comparison, and compareLine its color
+const compareLineWidth = 2
+
+var compareLine = color.NRGBA{0xff, 0x00, 0xff, 0xff}
+
+// comparePath returns the path of the comparison written next to an output
+func comparePath(outPath string) string {
+	return outPath + ".compare.png"
+}
+
+// compareImage returns a PNG comparing the input data with the encoded
+// output, decoding both so that the output's compression shows. The input
+// is turned upright as its EXIF orientation says and scaled to the output's
+// size. mode is side, for the two next to each other, or split, for the
+// left half of the input and the right half of the output.
+func compareImage(ctx context.Context, mode string, data, encoded []byte) ([]byte, error) {
+	before, _, err := decodeImageContext(ctx, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode input for compare-output: %w", err)
+	}
+	after, _, err := decodeImage(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("compare-output cannot decode the output: %w", err)
+	}
+	before = orientImage(before, exifOrientation(readJPEGExif(data)))
+	width, height := after.Bounds().Dx(), after.Bounds().Dy()
+	if before.Bounds().Dx() != width || before.Bounds().Dy() != height {
+		before = scaleImage(before, uint(width), uint(height))
+	}
+
+	var canvas *image.NRGBA
+	line := &image.Uniform{compareLine}
+	switch mode {
+	case "split":
+		canvas = image.NewNRGBA(image.Rect(0, 0, width, height))
+		half := width / 2
+		draw.Draw(canvas, image.Rect(0, 0, half, height), before, before.Bounds().Min, draw.Src)
+		draw.Draw(canvas, image.Rect(half, 0, width, height), after, after.Bounds().Min.Add(image.Pt(half, 0)), draw.Src)
+		draw.Draw(canvas, image.Rect(half-compareLineWidth/2, 0, half-compareLineWidth/2+compareLineWidth, height), line, image.Point{}, draw.Src)
+	default:
+		canvas = image.NewNRGBA(image.Rect(0, 0, 2*width+compareLineWidth, height))
+		draw.Draw(canvas, image.Rect(0, 0, width, height), before, before.Bounds().Min, draw.Src)
+		draw.Draw(canvas, image.Rect(width, 0, width+compareLineWidth, height), line, image.Point{}, draw.Src)
+		draw.Draw(canvas, image.Rect(width+compareLineWidth, 0, 2*width+compareLineWidth, height), after, after.Bounds().Min, draw.Src)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return nil, fmt.Errorf("failed to encode comparison: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// completeCommand is the hidden subcommand the completion scripts run to
+// list the candidates for the word being completed
+const completeCommand = "__complete"
+
+// completionSummary describes the completion subcommand in the help
+const completionSummary = "Print a shell completion script"
+
+// completionShells are the shells completion scripts are written for
+var completionShells = []string{"bash", "zsh", "fish", "powershell"}
+
+// completionScripts hold the completion script for each shell, with PROGRAM
+// standing for the program's name and FUNCTION for a shell function named
+// after it. Each asks the program for candidates with __complete, passing
+// the words typed so far, and completes file names when it gets none.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for PROGRAM. Load it with
+#   source <(PROGRAM completion bash)
+FUNCTION() {
+	local IFS=$'\n'
+	COMPREPLY=($("${COMP_WORDS[0]}" __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null | cut -f1))
+}
+complete -o default -F FUNCTION PROGRAM
+`,
+	"zsh": `#compdef PROGRAM
+# zsh completion for PROGRAM. Load it with
+#   source <(PROGRAM completion zsh)
+# or save it as _PROGRAM in a directory on $fpath
+FUNCTION() {
+	local -a candidates
+	candidates=(${(f)"$(${words[1]} __complete "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+	if (( ${#candidates} )); then
+		candidates=("${(@)candidates//:/\\:}")
+		candidates=("${(@)candidates//$'\t'/:}")
+		_describe 'PROGRAM' candidates
+	else
+		_files
+	fi
+}
+if [ "$funcstack[1]" = "FUNCTION" ]; then
+	FUNCTION "$@"
+else
+	compdef FUNCTION PROGRAM
+fi
+`,
+	"fish": `# fish completion for PROGRAM. Load it with
+#   PROGRAM completion fish | source
+# or save it as PROGRAM.fish in ~/.config/fish/completions
+function FUNCTION
+	set -l words (commandline -opc)
+	$words[1] __complete $words[2..-1] (commandline -ct | string collect --allow-empty) 2>/dev/null
+end
+complete -c PROGRAM -a '(FUNCTION)'
+`,
+	"powershell": `# PowerShell completion for PROGRAM. Load it with
+#   PROGRAM completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName 'PROGRAM', 'PROGRAM.exe' -ScriptBlock {
+	param($wordToComplete, $commandAst, $cursorPosition)
+	$command, $words = @($commandAst.CommandElements | Where-Object { $_.Extent.StartOffset -lt $cursorPosition } | ForEach-Object { $_.Extent.Text })
+	$words = @($words)
+	if ($wordToComplete) {
+		$words = @($words | Select-Object -SkipLast 1)
+	}
+	# PowerShell before 7.3 drops empty arguments, so an empty word is passed as ""
+	$current = if ($wordToComplete) { $wordToComplete } else { '""' }
+	& $command __complete @words $current 2>$null | ForEach-Object {
+		$name, $description = $_ -split "` + "`" + `t", 2
+		if (-not $description) { $description = $name }
+		[System.Management.Automation.CompletionResult]::new($name, $name, 'ParameterValue', $description)
+	}
+}
+`,
+}
+
+// runCompletion implements the completion subcommand
+func runCompletion(args []string) error {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s completion %s\n", filepath.Base(os.Args[0]), strings.Join(completionShells, "|"))
+		fmt.Fprintln(fs.Output(), "Prints a script completing subcommands and flags in the given shell.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || !slices.Contains(completionShells, fs.Arg(0)) {
+		return fmt.Errorf("expected one shell: %s", strings.Join(completionShells, ", "))
+	}
+
+	program := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	function := "_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, program)
+	fmt.Print(strings.NewReplacer("PROGRAM", program, "FUNCTION", function).Replace(completionScripts[fs.Arg(0)]))
+	return nil
+}
+
+// completion is a candidate for the word being completed
+type completion struct {
+	value       string
+	description string
+}
+
+// runComplete prints the candidates for the last of words, the arguments
+// typed so far, one per line with a tab before its description. Nothing is
+// printed where a file name or a flag's value is expected, so the shell
+// completes file names instead.
+func runComplete(words []string) error {
+	if len(words) == 0 {
+		return nil
+	}
+	current := words[len(words)-1]
+	if current == `""` {
+		current = ""
+	}
+	before := words[:len(words)-1]
+
+	var candidates []completion
+	switch {
+	case len(before) == 0 && !strings.HasPrefix(current, "-"):
+		for _, c := range subcommands {
+			candidates = append(candidates, completion{c.name, c.summary})
+		}
+		candidates = append(candidates, completion{"completion", completionSummary})
+	case len(before) == 1 && before[0] == "completion":
+		for _, shell := range completionShells {
+			candidates = append(candidates, completion{shell, ""})
+		}
+	case strings.HasPrefix(current, "-"):
+		command := ""
+		if len(before) > 0 {
+			if _, ok := findSubcommand(before[0]); ok {
+				command = before[0]
+			}
+		}
+		flags, err := commandFlags(command)
+		if err != nil {
+			return err
+		}
+		dashes := "-"
+		if strings.HasPrefix(current, "--") {
+			dashes = "--"
+		}
+		for _, f := range flags {
+			candidates = append(candidates, completion{dashes + f.value, f.description})
+		}
+	}
+
+	for _, c := range candidates {
+		if strings.HasPrefix(c.value, current) {
+			fmt.Printf("%s\t%s\n", c.value, c.description)
+		}
+	}
+	return nil
+}
+
+// commandFlags returns the flags of a subcommand, or of the main command if
+// command is "", named without the dash. Subcommands declare their flags as
+// they run, so they are read from the help the program prints for -h.
+func commandFlags(command string) ([]completion, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-h"}
+	if command != "" {
+		args = []string{command, "-h"}
+	}
+	// -h exits with status 0 after the help, but a failure still prints it
+	help, _ := exec.Command(self, args...).CombinedOutput()
+
+	var flags []completion
+	for _, line := range strings.Split(string(help), "\n") {
+		if usage, ok := strings.CutPrefix(line, "    \t"); ok {
+			if len(flags) > 0 && flags[len(flags)-1].description == "" {
+				flags[len(flags)-1].description = completionDescription(usage)
+			}
+			continue
+		}
+		rest, ok := strings.CutPrefix(line, "  -")
+		if !ok {
+			continue
+		}
+		// Flags with one-letter names have their usage on the same line
+		name, usage, _ := strings.Cut(rest, "\t")
+		name, _, _ = strings.Cut(name, " ")
+		flags = append(flags, completion{name, completionDescription(usage)})
+	}
+	return flags, nil
+}
+
+// completionDescription shortens a flag's usage to its first sentence
+func completionDescription(usage string) string {
+	for i := 0; ; {
+		j := strings.Index(usage[i:], ". ")
+		if j < 0 {
+			break
+		}
+		if end := usage[:i+j]; !strings.HasSuffix(end, "e.g") && !strings.HasSuffix(end, "i.e") {
+			usage = end
+			break
+		}
+		i += j + 2
+	}
+	usage, _, _ = strings.Cut(usage, " (default ")
+	return strings.TrimSpace(usage)
+}
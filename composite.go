@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// layerSpec describes one image placed on top of the base image
+type layerSpec struct {
+	Path   string
+	X, Y   int
+	Width  int // 0 keeps the layer's own width
+	Height int // 0 keeps the layer's own height
+	Mode   string
+}
+
+// blendFunc blends a source channel onto a backdrop channel, both in [0,1]
+type blendFunc func(backdrop, source float64) float64
+
+var blendModes = map[string]blendFunc{
+	"normal":   func(b, s float64) float64 { return s },
+	"multiply": func(b, s float64) float64 { return b * s },
+	"screen":   func(b, s float64) float64 { return b + s - b*s },
+}
+
+// parseLayerSpec parses a layer of the form file@x,y[,WxH][,mode]
+func parseLayerSpec(spec string) (layerSpec, error) {
+	at := strings.LastIndex(spec, "@")
+	if at <= 0 {
+		return layerSpec{}, fmt.Errorf("invalid layer %q: expected file@x,y[,WxH][,mode]", spec)
+	}
+
+	layer := layerSpec{Path: spec[:at], Mode: "normal"}
+	parts := strings.Split(spec[at+1:], ",")
+	if len(parts) < 2 {
+		return layerSpec{}, fmt.Errorf("invalid layer %q: position must be x,y", spec)
+	}
+
+	var err error
+	if layer.X, err = strconv.Atoi(strings.TrimSpace(parts[0])); err != nil {
+		return layerSpec{}, fmt.Errorf("invalid layer %q: bad x position", spec)
+	}
+	if layer.Y, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+		return layerSpec{}, fmt.Errorf("invalid layer %q: bad y position", spec)
+	}
+
+	for _, part := range parts[2:] {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if _, ok := blendModes[part]; ok {
+			layer.Mode = part
+			continue
+		}
+		if _, err := fmt.Sscanf(part, "%dx%d", &layer.Width, &layer.Height); err != nil || layer.Width < 0 || layer.Height < 0 {
+			return layerSpec{}, fmt.Errorf("invalid layer %q: unknown option %q", spec, part)
+		}
+	}
+
+	return layer, nil
+}
+
+// blendLayer draws src onto dst at pt using the given blend mode
+func blendLayer(dst *image.NRGBA, src image.Image, pt image.Point, blend blendFunc) {
+	srcBounds := src.Bounds()
+	target := image.Rectangle{Min: pt, Max: pt.Add(srcBounds.Size())}.Intersect(dst.Bounds())
+
+	for y := target.Min.Y; y < target.Max.Y; y++ {
+		for x := target.Min.X; x < target.Max.X; x++ {
+			s := color.NRGBAModel.Convert(src.At(srcBounds.Min.X+x-pt.X, srcBounds.Min.Y+y-pt.Y)).(color.NRGBA)
+			if s.A == 0 {
+				continue
+			}
+			i := dst.PixOffset(x, y)
+			d := dst.Pix[i : i+4 : i+4]
+
+			as := float64(s.A) / 255
+			ab := float64(d[3]) / 255
+			ao := as + ab*(1-as)
+
+			sc := [3]uint8{s.R, s.G, s.B}
+			for c := 0; c < 3; c++ {
+				cs := float64(sc[c]) / 255
+				cb := float64(d[c]) / 255
+				// Mix the blended colour with the plain source where the backdrop is transparent
+				mixed := (1-ab)*cs + ab*blend(cb, cs)
+				co := (as*mixed + ab*cb*(1-as)) / ao
+				d[c] = uint8(co*255 + 0.5)
+			}
+			d[3] = uint8(ao*255 + 0.5)
+		}
+	}
+}
+
+// compositeImages overlays each layer onto the base image
+func compositeImages(base image.Image, layers []layerSpec) (*image.NRGBA, error) {
+	bounds := base.Bounds()
+	canvas := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(canvas, canvas.Bounds(), base, bounds.Min, draw.Src)
+
+	for _, layer := range layers {
+		img, _, err := loadImage(layer.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if layer.Width > 0 || layer.Height > 0 {
+			img = scaleImage(img, uint(layer.Width), uint(layer.Height))
+		}
+
+		blendLayer(canvas, img, image.Pt(layer.X, layer.Y), blendModes[layer.Mode])
+		slog.Info("Composited layer", "file", layer.Path, "x", layer.X, "y", layer.Y, "mode", layer.Mode)
+	}
+
+	return canvas, nil
+}
+
+// runComposite implements the composite subcommand
+func runComposite(args []string) error {
+	fs := flag.NewFlagSet("composite", flag.ExitOnError)
+	baseFile := fs.String("base", "", "Base image file path (required)")
+	outputFile := fs.String("output", "", "Output image file path (defaults to <base>_composite.png)")
+	compressLevel := fs.Int("compress", 0, "Compression level (1-100) for the output image. 0 means no compression")
+	var layers stringList
+	fs.Var(&layers, "layer", "Layer to overlay as file@x,y[,WxH][,mode] with mode normal, multiply or screen (repeatable)")
+	setupLogging := addLogFlags(fs)
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	if *baseFile == "" {
+		return fmt.Errorf("base image is required. Use -base flag to specify the base image")
+	}
+	if len(layers) == 0 {
+		return fmt.Errorf("at least one -layer is required")
+	}
+
+	specs := make([]layerSpec, 0, len(layers))
+	for _, l := range layers {
+		spec, err := parseLayerSpec(l)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, spec)
+	}
+
+	base, _, err := loadImage(*baseFile)
+	if err != nil {
+		return err
+	}
+
+	result, err := compositeImages(base, specs)
+	if err != nil {
+		return err
+	}
+
+	filename := *outputFile
+	if filename == "" {
+		name := filepath.Base(*baseFile)
+		filename = strings.TrimSuffix(name, filepath.Ext(name)) + "_composite.png"
+	}
+	outPath, err := prepareOutputPath("composite", filename)
+	if err != nil {
+		return err
+	}
+
+	if err := saveImage(outPath, result, *compressLevel); err != nil {
+		return err
+	}
+
+	slog.Info("Composite image saved", "path", outPath)
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkBlendedEdges fails if a pixel of img lies outside the range between
+// bg and logoColor in any channel, as a dark halo around the logo would
+func checkBlendedEdges(t *testing.T, img image.Image, bg color.NRGBA) {
+	t.Helper()
+	outside := func(v, a, b uint8) bool { return int(v) < int(min(a, b))-2 || int(v) > int(max(a, b))+2 }
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if outside(p.R, bg.R, logoColor.R) || outside(p.G, bg.G, logoColor.G) || outside(p.B, bg.B, logoColor.B) {
+				t.Fatalf("pixel (%d, %d) is %v, want between the background %v and the logo %v", x, y, p, bg, logoColor)
+			}
+		}
+	}
+}
+
+// filledImage returns a size x size image of c
+func filledImage(size int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestBlendLayerHasNoHalo(t *testing.T) {
+	for _, bg := range []color.NRGBA{{255, 255, 255, 255}, {250, 200, 40, 255}, {0, 0, 0, 255}} {
+		canvas := filledImage(64, bg)
+		blendLayer(canvas, transparentLogo(48), image.Pt(8, 8), blendModes["normal"])
+		checkBlendedEdges(t, canvas, bg)
+		if got := canvas.NRGBAAt(32, 32); got != logoColor {
+			t.Errorf("background %v: logo center is %v, want %v", bg, got, logoColor)
+		}
+		if got := canvas.NRGBAAt(2, 2); got != bg {
+			t.Errorf("background %v: corner is %v, want it untouched", bg, got)
+		}
+	}
+}
+
+func TestBlendLayerOntoTransparentCanvas(t *testing.T) {
+	canvas := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	blendLayer(canvas, transparentLogo(48), image.Pt(8, 8), blendModes["normal"])
+	checkEdgeColors(t, canvas)
+}
+
+func TestCompositeScaledLayerHasNoHalo(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logo.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, transparentLogo(256)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bg := color.NRGBA{255, 255, 255, 255}
+	for _, mode := range []string{"normal", "multiply", "screen"} {
+		layer, err := parseLayerSpec(fmt.Sprintf("%s@10,10,48x48,%s", path, mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		canvas, err := compositeImages(filledImage(80, bg), []layerSpec{layer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Over white, multiply gives the logo's color and screen gives white,
+		// so every mode stays between the two
+		checkBlendedEdges(t, canvas, bg)
+	}
+}
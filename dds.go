@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"log/slog"
+)
+
+// DDS header flags, see the DirectDraw Surface documentation
+const (
+	ddsdCaps        = 0x1
+	ddsdHeight      = 0x2
+	ddsdWidth       = 0x4
+	ddsdPitch       = 0x8
+	ddsdPixelFormat = 0x1000
+	ddsdMipmapCount = 0x20000
+	ddsdLinearSize  = 0x80000
+
+	ddpfAlphaPixels = 0x1
+	ddpfFourCC      = 0x4
+	ddpfRGB         = 0x40
+
+	ddsCapsComplex = 0x8
+	ddsCapsTexture = 0x1000
+	ddsCapsMipmap  = 0x400000
+)
+
+// ddsPixelFormat is the DDS_PIXELFORMAT structure
+type ddsPixelFormat struct {
+	Size        uint32
+	Flags       uint32
+	FourCC      [4]byte
+	RGBBitCount uint32
+	RBitMask    uint32
+	GBitMask    uint32
+	BBitMask    uint32
+	ABitMask    uint32
+}
+
+// ddsHeader is the DDS_HEADER structure that follows the "DDS " magic
+type ddsHeader struct {
+	Size              uint32
+	Flags             uint32
+	Height            uint32
+	Width             uint32
+	PitchOrLinearSize uint32
+	Depth             uint32
+	MipMapCount       uint32
+	Reserved1         [11]uint32
+	PixelFormat       ddsPixelFormat
+	Caps              uint32
+	Caps2             uint32
+	Caps3             uint32
+	Caps4             uint32
+	Reserved2         uint32
+}
+
+// downsampleHalf halves an image with a 2x2 box filter on premultiplied pixels
+func downsampleHalf(src *image.RGBA) *image.RGBA {
+	sb := src.Bounds()
+	w := max(1, sb.Dx()/2)
+	h := max(1, sb.Dy()/2)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]int
+			for dy := 0; dy < 2; dy++ {
+				for dx := 0; dx < 2; dx++ {
+					sx := min(2*x+dx, sb.Dx()-1)
+					sy := min(2*y+dy, sb.Dy()-1)
+					i := src.PixOffset(sb.Min.X+sx, sb.Min.Y+sy)
+					for c := 0; c < 4; c++ {
+						sum[c] += int(src.Pix[i+c])
+					}
+				}
+			}
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[i+c] = uint8((sum[c] + 2) / 4)
+			}
+		}
+	}
+	return dst
+}
+
+// to565 packs an 8-bit colour into RGB565
+func to565(c [3]int) uint16 {
+	return uint16((c[0]*31+127)/255)<<11 | uint16((c[1]*63+127)/255)<<5 | uint16((c[2]*31+127)/255)
+}
+
+// from565 expands an RGB565 colour to 8 bits per channel
+func from565(v uint16) [3]int {
+	r := int(v>>11) & 31
+	g := int(v>>5) & 63
+	b := int(v) & 31
+	return [3]int{r<<3 | r>>2, g<<2 | g>>4, b<<3 | b>>2}
+}
+
+func colorDistance(a, b [3]int) int {
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dr*dr + dg*dg + db*db
+}
+
+// ddsBlock holds the 16 straight-alpha pixels of a 4x4 block
+type ddsBlock [16]color.NRGBA
+
+// encodeColorBlock encodes the colour part of a BC1/BC3 block. When
+// punchThrough is set, pixels with alpha < 128 use BC1's transparent index.
+func encodeColorBlock(block *ddsBlock, punchThrough bool) []byte {
+	minC := [3]int{255, 255, 255}
+	maxC := [3]int{0, 0, 0}
+	hasTransparent := false
+	for _, p := range block {
+		if punchThrough && p.A < 128 {
+			hasTransparent = true
+			continue
+		}
+		for c, v := range [3]int{int(p.R), int(p.G), int(p.B)} {
+			minC[c] = min(minC[c], v)
+			maxC[c] = max(maxC[c], v)
+		}
+	}
+	if minC[0] > maxC[0] {
+		// Every pixel is transparent
+		minC, maxC = [3]int{}, [3]int{}
+	}
+
+	// Inset the bounding box slightly to reduce the error of the end points
+	for c := 0; c < 3; c++ {
+		inset := (maxC[c] - minC[c]) / 16
+		minC[c] += inset
+		maxC[c] -= inset
+	}
+
+	c0 := to565(maxC)
+	c1 := to565(minC)
+	var palette [4][3]int
+	if hasTransparent {
+		// Three colour mode requires c0 <= c1
+		if c0 > c1 {
+			c0, c1 = c1, c0
+		}
+		p0, p1 := from565(c0), from565(c1)
+		palette[0], palette[1] = p0, p1
+		for c := 0; c < 3; c++ {
+			palette[2][c] = (p0[c] + p1[c]) / 2
+		}
+	} else {
+		// Four colour mode requires c0 > c1
+		if c0 < c1 {
+			c0, c1 = c1, c0
+		}
+		p0, p1 := from565(c0), from565(c1)
+		palette[0], palette[1] = p0, p1
+		for c := 0; c < 3; c++ {
+			palette[2][c] = (2*p0[c] + p1[c]) / 3
+			palette[3][c] = (p0[c] + 2*p1[c]) / 3
+		}
+	}
+
+	var indices uint32
+	if c0 != c1 || hasTransparent {
+		colors := 4
+		if hasTransparent {
+			colors = 3
+		}
+		for i, p := range block {
+			idx := 0
+			if hasTransparent && p.A < 128 {
+				idx = 3
+			} else {
+				pc := [3]int{int(p.R), int(p.G), int(p.B)}
+				best := colorDistance(pc, palette[0])
+				for j := 1; j < colors; j++ {
+					if d := colorDistance(pc, palette[j]); d < best {
+						best, idx = d, j
+					}
+				}
+			}
+			indices |= uint32(idx) << (2 * i)
+		}
+	}
+
+	out := make([]byte, 8)
+	binary.LittleEndian.PutUint16(out[0:], c0)
+	binary.LittleEndian.PutUint16(out[2:], c1)
+	binary.LittleEndian.PutUint32(out[4:], indices)
+	return out
+}
+
+// encodeAlphaBlock encodes the BC3 interpolated alpha part of a block
+func encodeAlphaBlock(block *ddsBlock) []byte {
+	a0, a1 := 0, 255
+	for _, p := range block {
+		a0 = max(a0, int(p.A))
+		a1 = min(a1, int(p.A))
+	}
+
+	out := make([]byte, 8)
+	out[0], out[1] = uint8(a0), uint8(a1)
+	if a0 == a1 {
+		return out
+	}
+
+	// Eight alpha mode: a0 > a1 with six interpolated values
+	var palette [8]int
+	palette[0], palette[1] = a0, a1
+	for i := 1; i < 7; i++ {
+		palette[i+1] = ((7-i)*a0 + i*a1) / 7
+	}
+
+	var bits uint64
+	for i, p := range block {
+		idx, best := 0, 256
+		for j, v := range palette {
+			if d := abs(int(p.A) - v); d < best {
+				best, idx = d, j
+			}
+		}
+		bits |= uint64(idx) << (3 * i)
+	}
+	for i := 0; i < 6; i++ {
+		out[2+i] = uint8(bits >> (8 * i))
+	}
+	return out
+}
+
+// encodeBlocks compresses an image into BC1 or BC3 blocks
+func encodeBlocks(img *image.RGBA, format string) []byte {
+	b := img.Bounds()
+	var out []byte
+	for by := 0; by < b.Dy(); by += 4 {
+		for bx := 0; bx < b.Dx(); bx += 4 {
+			var block ddsBlock
+			for i := range block {
+				// Clamp to the edge for partial blocks
+				x := min(bx+i%4, b.Dx()-1)
+				y := min(by+i/4, b.Dy()-1)
+				block[i] = color.NRGBAModel.Convert(img.RGBAAt(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			}
+			if format == "bc3" {
+				out = append(out, encodeAlphaBlock(&block)...)
+				out = append(out, encodeColorBlock(&block, false)...)
+			} else {
+				out = append(out, encodeColorBlock(&block, true)...)
+			}
+		}
+	}
+	return out
+}
+
+// encodeUncompressed stores an image as straight-alpha 32-bit RGBA
+func encodeUncompressed(img *image.RGBA) []byte {
+	b := img.Bounds()
+	out := make([]byte, 0, 4*b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.RGBAAt(x, y)).(color.NRGBA)
+			out = append(out, c.R, c.G, c.B, c.A)
+		}
+	}
+	return out
+}
+
+// EncodeDDS writes img to w as a DDS texture. format is "bc1" (DXT1, 1-bit
+// alpha), "bc3" (DXT5, full alpha) or "rgba" (uncompressed). When mipmaps is
+// set the full mip chain down to 1x1 is generated with a box filter.
+func EncodeDDS(w io.Writer, img image.Image, format string, mipmaps bool) error {
+	if format != "bc1" && format != "bc3" && format != "rgba" {
+		return fmt.Errorf("unsupported DDS format %q: use bc1, bc3 or rgba", format)
+	}
+
+	bounds := img.Bounds()
+	level := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(level, level.Bounds(), img, bounds.Min, draw.Src)
+
+	levels := []*image.RGBA{level}
+	for mipmaps && (level.Bounds().Dx() > 1 || level.Bounds().Dy() > 1) {
+		level = downsampleHalf(level)
+		levels = append(levels, level)
+	}
+
+	var data [][]byte
+	for _, l := range levels {
+		if format == "rgba" {
+			data = append(data, encodeUncompressed(l))
+		} else {
+			data = append(data, encodeBlocks(l, format))
+		}
+	}
+
+	header := ddsHeader{
+		Size:              124,
+		Flags:             ddsdCaps | ddsdHeight | ddsdWidth | ddsdPixelFormat,
+		Height:            uint32(bounds.Dy()),
+		Width:             uint32(bounds.Dx()),
+		PitchOrLinearSize: uint32(len(data[0])),
+		MipMapCount:       uint32(len(levels)),
+		PixelFormat:       ddsPixelFormat{Size: 32},
+		Caps:              ddsCapsTexture,
+	}
+	if len(levels) > 1 {
+		header.Flags |= ddsdMipmapCount
+		header.Caps |= ddsCapsComplex | ddsCapsMipmap
+	}
+
+	switch format {
+	case "rgba":
+		header.Flags |= ddsdPitch
+		header.PitchOrLinearSize = uint32(4 * bounds.Dx())
+		header.PixelFormat.Flags = ddpfRGB | ddpfAlphaPixels
+		header.PixelFormat.RGBBitCount = 32
+		header.PixelFormat.RBitMask = 0x000000ff
+		header.PixelFormat.GBitMask = 0x0000ff00
+		header.PixelFormat.BBitMask = 0x00ff0000
+		header.PixelFormat.ABitMask = 0xff000000
+	case "bc1":
+		header.Flags |= ddsdLinearSize
+		header.PixelFormat.Flags = ddpfFourCC
+		header.PixelFormat.FourCC = [4]byte{'D', 'X', 'T', '1'}
+	case "bc3":
+		header.Flags |= ddsdLinearSize
+		header.PixelFormat.Flags = ddpfFourCC
+		header.PixelFormat.FourCC = [4]byte{'D', 'X', 'T', '5'}
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("DDS ")
+	if err := binary.Write(bw, binary.LittleEndian, header); err != nil {
+		return fmt.Errorf("failed to write DDS header: %w", err)
+	}
+	for _, d := range data {
+		bw.Write(d)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write DDS data: %w", err)
+	}
+
+	slog.Info("DDS texture encoded", "format", format, "mip_levels", len(levels))
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/png"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// encoderDefaults are the site-wide encoder settings used where the options
+// of a run do not set them
+type encoderDefaults struct {
+	JPEGQuality    int                  // JPEG quality when -compress is 0
+	PNGCompression png.CompressionLevel // PNG compression when -compress is 0
+	StripMetadata  bool                 // drop EXIF unless -keep-exif is given
+	WebPEffort     int                  // WebP effort from 0 to 6 when -effort and -compress are 0
+}
+
+// siteDefaults are the encoder defaults in effect, replaced at startup by
+// those of the defaults file
+var siteDefaults = encoderDefaults{JPEGQuality: 95, PNGCompression: png.DefaultCompression, StripMetadata: true, WebPEffort: webpDefaultEffort}
+
+// encodeEffort trades encoding speed for smaller output, from 0 (fastest) to
+// 9 (smallest), as set by -effort. -1 leaves each encoder at its default.
+var encodeEffort = -1
+
+// pngCompressionLevel returns the deflate level of PNG output whose level
+// -compress does not set: from -effort, or else from the defaults file
+func pngCompressionLevel() png.CompressionLevel {
+	switch {
+	case encodeEffort < 0:
+		return siteDefaults.PNGCompression
+	case encodeEffort <= 2:
+		return png.BestSpeed
+	case encodeEffort <= 6:
+		return png.DefaultCompression
+	default:
+		return png.BestCompression
+	}
+}
+
+// webpEffort returns the effort, from 0 to 6, of WebP output whose effort
+// -compress does not set: -effort scaled to WebP's range, or else the one
+// from the defaults file
+func webpEffort() int {
+	if encodeEffort < 0 {
+		return siteDefaults.WebPEffort
+	}
+	return (2*encodeEffort + 1) / 3
+}
+
+// pngCompressionLevels are the values accepted for png-compression
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"default": png.DefaultCompression,
+	"best":    png.BestCompression,
+}
+
+// defaultsFile returns the path of the defaults file,
+// go-transform/config.yaml under $XDG_CONFIG_HOME or ~/.config
+func defaultsFile() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "go-transform", "config.yaml")
+}
+
+// loadDefaults replaces siteDefaults with the settings of the defaults file
+// at path, written like a sidecar file:
+//
+//	jpeg-quality: 82
+//	png-compression: best
+//	strip-metadata: true
+//	webp-effort: 6
+//
+// A missing file is not an error, and every invalid setting is reported.
+func loadDefaults(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read defaults file: %w", err)
+	}
+	settings, err := parseSidecar(data)
+	if err != nil {
+		return fmt.Errorf("invalid defaults file %s: %w", path, err)
+	}
+
+	defaults := siteDefaults
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		value := settings[name]
+		switch name {
+		case "jpeg-quality":
+			quality, err := strconv.Atoi(value)
+			if err != nil || quality < 1 || quality > 100 {
+				errs = append(errs, fmt.Errorf("jpeg-quality must be between 1 and 100, got %q", value))
+			}
+			defaults.JPEGQuality = quality
+		case "png-compression":
+			level, ok := pngCompressionLevels[strings.ToLower(value)]
+			if !ok {
+				errs = append(errs, fmt.Errorf("unknown png-compression %q: use none, fast, default or best", value))
+			}
+			defaults.PNGCompression = level
+		case "strip-metadata":
+			strip, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("strip-metadata must be true or false, got %q", value))
+			}
+			defaults.StripMetadata = strip
+		case "webp-effort":
+			effort, err := strconv.Atoi(value)
+			if err != nil || effort < 0 || effort > 6 {
+				errs = append(errs, fmt.Errorf("webp-effort must be between 0 and 6, got %q", value))
+			}
+			defaults.WebPEffort = effort
+		default:
+			errs = append(errs, fmt.Errorf("unknown setting %q: use jpeg-quality, png-compression, webp-effort or strip-metadata", name))
+		}
+	}
+	if len(errs) > 0 {
+		for i, err := range errs {
+			errs[i] = fmt.Errorf("invalid defaults file %s: %w", path, err)
+		}
+		return errors.Join(errs...)
+	}
+	siteDefaults = defaults
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDefaults(t *testing.T) {
+	defer func(d encoderDefaults) { siteDefaults = d }(siteDefaults)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("jpeg-quality: 82\nwebp-effort: 6\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDefaults(path); err != nil {
+		t.Fatal(err)
+	}
+	if siteDefaults.JPEGQuality != 82 || siteDefaults.WebPEffort != 6 {
+		t.Errorf("got %+v, want JPEG quality 82 and WebP effort 6", siteDefaults)
+	}
+
+	if err := os.WriteFile(path, []byte("webp-effort: 7\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDefaults(path); err == nil {
+		t.Error("webp-effort 7 was accepted")
+	}
+	if siteDefaults.WebPEffort != 6 {
+		t.Errorf("an invalid file changed the WebP effort to %d", siteDefaults.WebPEffort)
+	}
+}
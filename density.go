@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+)
+
+const (
+	exifTagXResolution    = 0x011a
+	exifTagYResolution    = 0x011b
+	exifTagResolutionUnit = 0x0128
+
+	// defaultPDFDPI sizes images on PDF pages when -dpi is not given
+	defaultPDFDPI = 300
+
+	// maxDPI is the largest density a JFIF header can hold
+	maxDPI = math.MaxUint16
+)
+
+var jfifHeader = []byte("JFIF\x00")
+
+// imageDensity is the physical resolution of an image in dots per inch
+type imageDensity struct {
+	X, Y float64
+}
+
+// String formats the density as "300" or, when it differs between the axes,
+// "300x600"
+func (d imageDensity) String() string {
+	if d.X == d.Y {
+		return fmt.Sprintf("%g", d.X)
+	}
+	return fmt.Sprintf("%gx%g", d.X, d.Y)
+}
+
+// readImageDensity returns the density recorded in an encoded JPEG or PNG:
+// the JFIF header or pHYs chunk, falling back to the EXIF resolution tags.
+// Densities given only as an aspect ratio do not count.
+func readImageDensity(data []byte) (imageDensity, bool) {
+	var exif []byte
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		if len(data) >= 18 && data[2] == 0xff && data[3] == 0xe0 && bytes.Equal(data[6:11], jfifHeader) {
+			x, y := float64(binary.BigEndian.Uint16(data[14:])), float64(binary.BigEndian.Uint16(data[16:]))
+			switch data[13] {
+			case 1:
+				return imageDensity{x, y}, x > 0 && y > 0
+			case 2:
+				return imageDensity{math.Round(x * 2.54), math.Round(y * 2.54)}, x > 0 && y > 0
+			}
+		}
+		exif = readJPEGExif(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		if _, _, phys, ok := pngChunkBounds(data, "pHYs", func(p []byte) bool { return len(p) == 9 }); ok && phys[8] == 1 {
+			// Pixels per metre
+			x, y := float64(binary.BigEndian.Uint32(phys)), float64(binary.BigEndian.Uint32(phys[4:]))
+			return imageDensity{math.Round(x * 0.0254), math.Round(y * 0.0254)}, x > 0 && y > 0
+		}
+		_, _, exif, _ = pngChunkBounds(data, "eXIf", func([]byte) bool { return true })
+	}
+	return readExifDensity(exif)
+}
+
+// readExifDensity returns the density given by the resolution tags of IFD0
+func readExifDensity(exif []byte) (imageDensity, bool) {
+	t, err := newTIFFReader(exif)
+	if err != nil {
+		return imageDensity{}, false
+	}
+	rational := func(tag uint16) float64 {
+		e, ok := t.findEntry(t.firstIFD(), tag)
+		if !ok {
+			return 0
+		}
+		off, _ := t.u32(e + 8)
+		num, ok1 := t.u32(int(off))
+		den, ok2 := t.u32(int(off) + 4)
+		if typ, _ := t.u16(e + 2); typ != 5 || !ok1 || !ok2 || den == 0 {
+			return 0
+		}
+		return float64(num) / float64(den)
+	}
+	unit := uint16(2) // inches, the TIFF default
+	if e, ok := t.findEntry(t.firstIFD(), exifTagResolutionUnit); ok {
+		unit, _ = t.u16(e + 8)
+	}
+	d := imageDensity{rational(exifTagXResolution), rational(exifTagYResolution)}
+	switch unit {
+	case 2:
+	case 3:
+		d = imageDensity{d.X * 2.54, d.Y * 2.54}
+	default:
+		return imageDensity{}, false
+	}
+	d = imageDensity{math.Round(d.X*100) / 100, math.Round(d.Y*100) / 100}
+	return d, d.X > 0 && d.Y > 0
+}
+
+// setExifDensity updates the resolution tags IFD0 already has to dpi, so
+// that copied EXIF metadata does not contradict the JFIF header or pHYs
+// chunk. Tags that are missing are left out.
+func setExifDensity(exif []byte, dpi float64) []byte {
+	t, err := newTIFFReader(slices.Clone(exif))
+	if err != nil {
+		return exif
+	}
+	ifd := t.firstIFD()
+	for _, tag := range []uint16{exifTagXResolution, exifTagYResolution} {
+		e, ok := t.findEntry(ifd, tag)
+		if !ok {
+			continue
+		}
+		off, _ := t.u32(e + 8)
+		if typ, _ := t.u16(e + 2); typ != 5 || int(off)+8 > len(t.data) {
+			continue
+		}
+		// Two decimal places are plenty for a density
+		t.order.PutUint32(t.data[off:], uint32(math.Round(dpi*100)))
+		t.order.PutUint32(t.data[off+4:], 100)
+	}
+	if e, ok := t.findEntry(ifd, exifTagResolutionUnit); ok {
+		if typ, _ := t.u16(e + 2); typ == 3 {
+			t.order.PutUint16(t.data[e+8:], 2)
+		}
+	}
+	return t.data
+}
+
+// setJPEGDensity records dpi in the JFIF header of an encoded JPEG, adding
+// the header if there is none
+func setJPEGDensity(jpegData []byte, dpi float64) ([]byte, error) {
+	if len(jpegData) < 2 || jpegData[0] != 0xff || jpegData[1] != 0xd8 {
+		return nil, fmt.Errorf("not a JPEG stream")
+	}
+	density := uint16(math.Round(dpi))
+	if len(jpegData) >= 18 && jpegData[2] == 0xff && jpegData[3] == 0xe0 && bytes.Equal(jpegData[6:11], jfifHeader) {
+		out := slices.Clone(jpegData)
+		out[13] = 1
+		binary.BigEndian.PutUint16(out[14:], density)
+		binary.BigEndian.PutUint16(out[16:], density)
+		return out, nil
+	}
+
+	// JFIF 1.01, dots per inch, no thumbnail
+	app0 := slices.Concat([]byte{0xff, 0xe0, 0, 16}, jfifHeader, []byte{1, 1, 1})
+	app0 = binary.BigEndian.AppendUint16(app0, density)
+	app0 = binary.BigEndian.AppendUint16(app0, density)
+	app0 = append(app0, 0, 0)
+	return slices.Concat(jpegData[:2], app0, jpegData[2:]), nil
+}
+
+// setPNGDensity records dpi in the pHYs chunk of an encoded PNG, replacing
+// any there is
+func setPNGDensity(pngData []byte, dpi float64) ([]byte, error) {
+	ppm := uint32(math.Round(dpi / 0.0254))
+	phys := binary.BigEndian.AppendUint32(nil, ppm)
+	phys = binary.BigEndian.AppendUint32(phys, ppm)
+	phys = append(phys, 1) // metres
+	if start, end, _, ok := pngChunkBounds(pngData, "pHYs", func([]byte) bool { return true }); ok {
+		return slices.Concat(pngData[:start], appendPNGChunk(nil, "pHYs", phys), pngData[end:]), nil
+	}
+	return insertPNGChunk(pngData, "pHYs", phys)
+}
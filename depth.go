@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+)
+
+// imageDepth returns the bits per channel of img: 16 for 16-bit image types,
+// 8 for everything else
+func imageDepth(img image.Image) int {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return 16
+	}
+	return 8
+}
+
+// convertDepth converts img to 8 or 16 bits per channel. Greyscale images stay
+// greyscale and plain RGB(A) or grey images that already have the requested
+// depth are returned as-is.
+func convertDepth(img image.Image, depth int) image.Image {
+	if imageDepth(img) == depth && isPlainImage(img) {
+		return img
+	}
+
+	bounds := img.Bounds()
+	var dst draw.Image
+	switch {
+	case depth == 16 && isGrayImage(img):
+		dst = image.NewGray16(bounds)
+	case depth == 16:
+		dst = image.NewNRGBA64(bounds)
+	case isGrayImage(img):
+		dst = image.NewGray(bounds)
+	default:
+		dst = image.NewNRGBA(bounds)
+	}
+	drawParallel(dst, bounds, img, bounds.Min)
+	return dst
+}
+
+// isPlainImage reports whether img is a plain RGB(A) or grey image, as opposed
+// to paletted, CMYK or YCbCr data
+func isPlainImage(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA, *image.NRGBA, *image.RGBA64, *image.NRGBA64, *image.Gray, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// validateDepth checks the value of the -depth flag
+func validateDepth(depth int) error {
+	if depth != 0 && depth != 8 && depth != 16 {
+		return fmt.Errorf("depth must be 8 or 16, or 0 to keep the input's bit depth")
+	}
+	return nil
+}
+
+// formatSupports16Bit reports whether an output format can store 16 bits per channel
+func formatSupports16Bit(format string) bool {
+	switch strings.ToLower(format) {
+	case "png", "tiff", "tif":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"slices"
+	"sync"
+)
+
+// depthDitherNames are the dithering patterns accepted by -depth-dither
+var depthDitherNames = []string{"none", "ordered", "blue-noise"}
+
+// validateDepthDither checks the value of the -depth-dither flag
+func validateDepthDither(name string) error {
+	if !slices.Contains(depthDitherNames, name) {
+		return fmt.Errorf("unknown depth-dither %q: use none, ordered or blue-noise", name)
+	}
+	return nil
+}
+
+// bayerMatrix is the 8x8 Bayer threshold matrix used by ordered dithering
+var bayerMatrix = [8][8]uint8{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// blueNoiseSize is the side of the tiled blue noise threshold texture
+const blueNoiseSize = 64
+
+// blueNoise returns a blueNoiseSize x blueNoiseSize texture ranking every
+// position from 0 to blueNoiseSize²-1. It is generated on first use with
+// Ulichney's void-and-cluster method: each rank goes to the position furthest
+// from those ranked before it, so thresholds of any level are spread evenly
+// without the cross-hatching of a Bayer matrix.
+var blueNoise = sync.OnceValue(func() []uint16 {
+	const n = blueNoiseSize * blueNoiseSize
+	const sigma = 1.5
+
+	// kernel holds the Gaussian weight of every offset on the torus
+	var kernel [n]float64
+	for dy := range blueNoiseSize {
+		for dx := range blueNoiseSize {
+			x := float64(min(dx, blueNoiseSize-dx))
+			y := float64(min(dy, blueNoiseSize-dy))
+			kernel[dy*blueNoiseSize+dx] = math.Exp(-(x*x + y*y) / (2 * sigma * sigma))
+		}
+	}
+	// update adds sign times the kernel centred on position p to energy
+	update := func(energy *[n]float64, p int, sign float64) {
+		px, py := p%blueNoiseSize, p/blueNoiseSize
+		for q := range n {
+			dx := (q%blueNoiseSize - px + blueNoiseSize) % blueNoiseSize
+			dy := (q/blueNoiseSize - py + blueNoiseSize) % blueNoiseSize
+			energy[q] += sign * kernel[dy*blueNoiseSize+dx]
+		}
+	}
+	// extreme returns the set (or unset) position with the highest (or
+	// lowest) energy: the tightest cluster or the largest void
+	extreme := func(energy *[n]float64, set *[n]bool, want, highest bool) int {
+		best := -1
+		for q := range n {
+			if set[q] != want {
+				continue
+			}
+			if best < 0 || highest && energy[q] > energy[best] || !highest && energy[q] < energy[best] {
+				best = q
+			}
+		}
+		return best
+	}
+
+	// Start from a tenth of the positions picked by a fixed pseudo-random
+	// sequence, then move points from clusters into voids until stable
+	var set [n]bool
+	var energy [n]float64
+	seed := uint32(2463534242)
+	for placed := 0; placed < n/10; {
+		seed ^= seed << 13
+		seed ^= seed >> 17
+		seed ^= seed << 5
+		if p := int(seed % n); !set[p] {
+			set[p] = true
+			update(&energy, p, 1)
+			placed++
+		}
+	}
+	for {
+		cluster := extreme(&energy, &set, true, true)
+		set[cluster] = false
+		update(&energy, cluster, -1)
+		void := extreme(&energy, &set, false, false)
+		set[void] = true
+		update(&energy, void, 1)
+		if void == cluster {
+			break
+		}
+	}
+
+	ranks := make([]uint16, n)
+	ones := n / 10
+	// Rank the initial points from the tightest cluster down
+	initialSet, initialEnergy := set, energy
+	for rank := ones - 1; rank >= 0; rank-- {
+		cluster := extreme(&energy, &set, true, true)
+		set[cluster] = false
+		update(&energy, cluster, -1)
+		ranks[cluster] = uint16(rank)
+	}
+	// Rank the remaining positions by filling the largest void each time
+	set, energy = initialSet, initialEnergy
+	for rank := ones; rank < n; rank++ {
+		void := extreme(&energy, &set, false, false)
+		set[void] = true
+		update(&energy, void, 1)
+		ranks[void] = uint16(rank)
+	}
+	return ranks
+})
+
+// ditherThreshold returns the dithering threshold of pattern at (x, y),
+// between 0 and 1 and averaging 0.5: a tiled Bayer matrix for ordered and
+// a tiled blue noise texture for blue-noise
+func ditherThreshold(pattern string, x, y int) float64 {
+	if pattern == "blue-noise" {
+		rank := blueNoise()[(y%blueNoiseSize)*blueNoiseSize+x%blueNoiseSize]
+		return (float64(rank) + 0.5) / (blueNoiseSize * blueNoiseSize)
+	}
+	return (float64(bayerMatrix[y&7][x&7]) + 0.5) / 64
+}
+
+// ditherTo8Bit reduces a 16-bit image to 8 bits per channel, adding pattern's
+// threshold to each channel before rounding down, so that smooth gradients
+// become a fine mix of the neighbouring levels instead of visible bands.
+// Greyscale images stay greyscale.
+func ditherTo8Bit(img image.Image, pattern string) image.Image {
+	bounds := img.Bounds()
+	quantize := func(v uint16, t float64) uint8 {
+		return uint8(min(255, float64(v)*255/65535+t))
+	}
+
+	if isGrayImage(img) {
+		g := convertDepth(img, 16).(*image.Gray16)
+		dst := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		parallelRows(bounds.Dy(), func(y0, y1 int) {
+			for y := y0; y < y1; y++ {
+				for x := 0; x < bounds.Dx(); x++ {
+					c := g.Gray16At(bounds.Min.X+x, bounds.Min.Y+y)
+					dst.Pix[y*dst.Stride+x] = quantize(c.Y, ditherThreshold(pattern, x, y))
+				}
+			}
+		})
+		return dst
+	}
+
+	src, ok := img.(*image.NRGBA64)
+	if !ok {
+		src = image.NewNRGBA64(bounds)
+		drawParallel(src, bounds, img, bounds.Min)
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	parallelRows(bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				c := src.NRGBA64At(bounds.Min.X+x, bounds.Min.Y+y)
+				t := ditherThreshold(pattern, x, y)
+				i := y*dst.Stride + 4*x
+				dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = quantize(c.R, t), quantize(c.G, t), quantize(c.B, t), quantize(c.A, t)
+			}
+		}
+	})
+	return dst
+}
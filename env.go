@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// envPrefix starts the names of the environment variables that set flags,
+// as in GO_TRANSFORM_MAX_PIXELS for -max-pixels
+const envPrefix = "GO_TRANSFORM_"
+
+// dotEnvFile is read at startup for environment variables that are not set
+const dotEnvFile = ".env"
+
+// envName returns the name of the environment variable setting a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// getenvDeprecated returns the value of the environment variable name or,
+// if it is empty, of old, its name before the GO_TRANSFORM_ prefix, warning
+// that old is deprecated
+func getenvDeprecated(name, old string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	value := os.Getenv(old)
+	if value != "" {
+		slog.Warn("Environment variable is deprecated", "name", old, "use", name)
+	}
+	return value
+}
+
+// applyEnv sets the flags of fs that were not given on the command line
+// from their environment variables. Empty variables are ignored, and every
+// invalid value is reported.
+func applyEnv(fs *flag.FlagSet) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		value := os.Getenv(envName(f.Name))
+		if value == "" || given[f.Name] {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// loadDotEnv sets the environment variables assigned in the .env file at
+// path that are not set already, so the real environment takes precedence.
+// Lines hold NAME=value, optionally after export. Values may be quoted, and
+// a # after a space starts a comment outside quotes. A missing file is not
+// an error.
+func loadDotEnv(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("%s line %d: expected NAME=value", path, i+1)
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			value = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1])
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		default:
+			if j := strings.Index(value, " #"); j >= 0 {
+				value = strings.TrimSpace(value[:j])
+			}
+		}
+		if _, set := os.LookupEnv(name); !set {
+			os.Setenv(name, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestGetenvDeprecated(t *testing.T) {
+	t.Setenv(pluginsEnv, "")
+	t.Setenv(oldPluginsEnv, "/opt/old.so")
+	if got := getenvDeprecated(pluginsEnv, oldPluginsEnv); got != "/opt/old.so" {
+		t.Errorf("with only the old name set got %q, want /opt/old.so", got)
+	}
+	t.Setenv(pluginsEnv, "/opt/new.so")
+	if got := getenvDeprecated(pluginsEnv, oldPluginsEnv); got != "/opt/new.so" {
+		t.Errorf("with both names set got %q, want /opt/new.so", got)
+	}
+	if pluginsEnv != "GO_TRANSFORM_PLUGINS" || signingKeyEnv != "GO_TRANSFORM_SIGNING_KEY" {
+		t.Errorf("variables are named %s and %s", pluginsEnv, signingKeyEnv)
+	}
+}
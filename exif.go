@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log/slog"
+	"math"
+	"slices"
+)
+
+// EXIF tags referenced by the metadata helpers
+const (
+	exifTagExifIFD         = 0x8769
+	exifTagGPSIFD          = 0x8825
+	exifTagThumbnailOffset = 0x0201
+	exifTagThumbnailLength = 0x0202
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// tiffTypeSizes maps TIFF field types to their size in bytes
+var tiffTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+}
+
+// readJPEGExif returns the TIFF payload of the first EXIF APP1 segment of a
+// JPEG, or nil if there is none
+func readJPEGExif(data []byte) []byte {
+	_, _, exif, _ := jpegAPP1(data, exifHeader)
+	return exif
+}
+
+// jpegAPP1 finds the first APP1 segment of a JPEG whose payload starts with
+// header, returning the segment's bounds and its payload after the header
+func jpegAPP1(data, header []byte) (start, end int, payload []byte, found bool) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 0, 0, nil, false
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			return 0, 0, nil, false
+		}
+		marker := data[pos+1]
+		if marker == 0xda || marker == 0xd9 {
+			// Start of scan or end of image: no more metadata segments
+			return 0, 0, nil, false
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return 0, 0, nil, false
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, header) {
+			return pos, pos + 2 + length, segment[len(header):], true
+		}
+		pos += 2 + length
+	}
+	return 0, 0, nil, false
+}
+
+// tiffReader gives bounds-checked access to a TIFF structure in either byte order
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTIFFReader(data []byte) (*tiffReader, error) {
+	if len(data) < 8 {
+		return nil, errors.New("EXIF data too short")
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid EXIF byte order")
+	}
+	return &tiffReader{data: data, order: order}, nil
+}
+
+func (t *tiffReader) u16(off int) (uint16, bool) {
+	if off < 0 || off+2 > len(t.data) {
+		return 0, false
+	}
+	return t.order.Uint16(t.data[off:]), true
+}
+
+func (t *tiffReader) u32(off int) (uint32, bool) {
+	if off < 0 || off+4 > len(t.data) {
+		return 0, false
+	}
+	return t.order.Uint32(t.data[off:]), true
+}
+
+// firstIFD returns the offset of IFD0
+func (t *tiffReader) firstIFD() int {
+	off, _ := t.u32(4)
+	return int(off)
+}
+
+// entries returns the offsets of each 12-byte entry in the IFD at off
+func (t *tiffReader) entries(off int) []int {
+	count, ok := t.u16(off)
+	if !ok || off+2+12*int(count)+4 > len(t.data) {
+		return nil
+	}
+	offsets := make([]int, count)
+	for i := range offsets {
+		offsets[i] = off + 2 + 12*i
+	}
+	return offsets
+}
+
+// clearValue zeroes the value of the entry at e, in the entry itself or out
+// of line. The entry keeps its tag, type and count.
+func (t *tiffReader) clearValue(e int) {
+	typ, _ := t.u16(e + 2)
+	count, _ := t.u32(e + 4)
+	size := tiffTypeSizes[typ] * int(count)
+	if size <= 4 {
+		clear(t.data[e+8 : e+12])
+	} else if valueOff, ok := t.u32(e + 8); ok && int(valueOff)+size <= len(t.data) {
+		clear(t.data[valueOff : int(valueOff)+size])
+	}
+}
+
+// clearIFD zeroes an IFD and any out-of-line values it references
+func (t *tiffReader) clearIFD(off int) {
+	for _, e := range t.entries(off) {
+		t.clearValue(e)
+	}
+	if count, ok := t.u16(off); ok {
+		clear(t.data[off : off+2+12*int(count)+4])
+	}
+}
+
+// removeEntry deletes the entry with the given tag from the IFD at off,
+// returning the entry's value field
+func (t *tiffReader) removeEntry(off int, tag uint16) (uint32, bool) {
+	entries := t.entries(off)
+	for _, e := range entries {
+		if entryTag, _ := t.u16(e); entryTag != tag {
+			continue
+		}
+		value, _ := t.u32(e + 8)
+
+		// Shift the following entries and the next-IFD offset up by one slot
+		end := off + 2 + 12*len(entries) + 4
+		copy(t.data[e:end-12], t.data[e+12:end])
+		clear(t.data[end-12 : end])
+		t.order.PutUint16(t.data[off:], uint16(len(entries)-1))
+		return value, true
+	}
+	return 0, false
+}
+
+// stripExifGPS returns a copy of the EXIF payload with the GPS IFD removed.
+// All other tags, including camera and exposure data, are kept.
+func stripExifGPS(exif []byte) ([]byte, error) {
+	stripped := bytes.Clone(exif)
+	t, err := newTIFFReader(stripped)
+	if err != nil {
+		return nil, err
+	}
+
+	gpsOffset, found := t.removeEntry(t.firstIFD(), exifTagGPSIFD)
+	if found {
+		t.clearIFD(int(gpsOffset))
+	}
+	return stripped, nil
+}
+
+// exifTimestampTags lists the date and time tags zeroed by
+// zeroExifTimestamps in IFD0 and the Exif IFD, and in the GPS IFD
+var (
+	exifTimestampTags = []uint16{
+		0x0132,         // DateTime
+		0x9003, 0x9004, // DateTimeOriginal, DateTimeDigitized
+		0x9010, 0x9011, 0x9012, // OffsetTime, OffsetTimeOriginal, OffsetTimeDigitized
+		0x9290, 0x9291, 0x9292, // SubSecTime, SubSecTimeOriginal, SubSecTimeDigitized
+	}
+	exifGPSTimestampTags = []uint16{
+		0x0007, // GPSTimeStamp
+		0x001d, // GPSDateStamp
+	}
+)
+
+// zeroExifTimestamps returns a copy of the EXIF payload with the values of
+// its date and time tags zeroed. The tags themselves are kept, so nothing
+// else in the payload moves.
+func zeroExifTimestamps(exif []byte) ([]byte, error) {
+	zeroed := bytes.Clone(exif)
+	t, err := newTIFFReader(zeroed)
+	if err != nil {
+		return nil, err
+	}
+	clearTags := func(ifd int, tags []uint16) {
+		for _, tag := range tags {
+			if e, ok := t.findEntry(ifd, tag); ok {
+				t.clearValue(e)
+			}
+		}
+	}
+	clearTags(t.firstIFD(), exifTimestampTags)
+	if e, ok := t.findEntry(t.firstIFD(), exifTagExifIFD); ok {
+		off, _ := t.u32(e + 8)
+		clearTags(int(off), exifTimestampTags)
+	}
+	if e, ok := t.findEntry(t.firstIFD(), exifTagGPSIFD); ok {
+		off, _ := t.u32(e + 8)
+		clearTags(int(off), exifGPSTimestampTags)
+	}
+	return zeroed, nil
+}
+
+// jpegHeaderEnd returns the position after the SOI marker and any JFIF APP0
+// segment, where further metadata segments are inserted
+func jpegHeaderEnd(jpegData []byte) (int, error) {
+	if len(jpegData) < 2 || jpegData[0] != 0xff || jpegData[1] != 0xd8 {
+		return 0, errors.New("not a JPEG stream")
+	}
+	if len(jpegData) > 6 && jpegData[2] == 0xff && jpegData[3] == 0xe0 {
+		return 4 + int(binary.BigEndian.Uint16(jpegData[4:])), nil
+	}
+	return 2, nil
+}
+
+// insertJPEGExif inserts an EXIF APP1 segment right after the SOI marker
+// (and any JFIF APP0 segment) of an encoded JPEG
+func insertJPEGExif(jpegData, exif []byte) ([]byte, error) {
+	if len(exif)+len(exifHeader)+2 > 0xffff {
+		return nil, errors.New("EXIF data too large for a JPEG APP1 segment")
+	}
+	insertAt, err := jpegHeaderEnd(jpegData)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Write(jpegData[:insertAt])
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(&out, binary.BigEndian, uint16(len(exif)+len(exifHeader)+2))
+	out.Write(exifHeader)
+	out.Write(exif)
+	out.Write(jpegData[insertAt:])
+	return out.Bytes(), nil
+}
+
+// insertPNGChunk inserts a chunk right after the IHDR chunk of an encoded PNG
+func insertPNGChunk(pngData []byte, typ string, payload []byte) ([]byte, error) {
+	// Signature (8) + IHDR length/type (8) + IHDR data (13) + CRC (4)
+	const ihdrEnd = 33
+	if len(pngData) < ihdrEnd || string(pngData[12:16]) != "IHDR" {
+		return nil, errors.New("not a PNG stream")
+	}
+
+	out := appendPNGChunk(slices.Clip(pngData[:ihdrEnd]), typ, payload)
+	return append(out, pngData[ihdrEnd:]...), nil
+}
+
+// imageMetadata is metadata written into the encoded output file
+type imageMetadata struct {
+	Exif []byte  // TIFF-structured EXIF payload
+	ICC  []byte  // ICC colour profile
+	DPI  float64 // density for the JFIF header or pHYs chunk, 0 to leave it out
+}
+
+// embedMetadata adds metadata to encoded JPEG or PNG data. Other formats are
+// returned unchanged.
+func embedMetadata(encoded []byte, format string, meta imageMetadata) ([]byte, error) {
+	var err error
+	switch format {
+	case "jpeg", "jpg":
+		// The JFIF header leads, and the other segments are inserted after it
+		if meta.DPI > 0 {
+			if encoded, err = setJPEGDensity(encoded, meta.DPI); err != nil {
+				return nil, err
+			}
+		}
+		// Insert the profile first so that the EXIF APP1 segment precedes it
+		if len(meta.ICC) > 0 {
+			if encoded, err = insertJPEGICC(encoded, meta.ICC); err != nil {
+				return nil, err
+			}
+		}
+		if len(meta.Exif) > 0 {
+			if encoded, err = insertJPEGExif(encoded, meta.Exif); err != nil {
+				return nil, err
+			}
+		}
+	case "png":
+		if meta.DPI > 0 {
+			if encoded, err = setPNGDensity(encoded, meta.DPI); err != nil {
+				return nil, err
+			}
+		}
+		if len(meta.ICC) > 0 {
+			if encoded, err = insertPNGICC(encoded, meta.ICC); err != nil {
+				return nil, err
+			}
+		}
+		if len(meta.Exif) > 0 {
+			if encoded, err = insertPNGChunk(encoded, "eXIf", meta.Exif); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return encoded, nil
+}
+
+// readExifThumbnail returns the JPEG thumbnail referenced by IFD1 of an EXIF
+// payload, or nil if there is none
+func readExifThumbnail(exif []byte) []byte {
+	t, err := newTIFFReader(exif)
+	if err != nil {
+		return nil
+	}
+	ifd0 := t.firstIFD()
+	count, ok := t.u16(ifd0)
+	if !ok {
+		return nil
+	}
+	ifd1, ok := t.u32(ifd0 + 2 + 12*int(count))
+	if !ok || ifd1 == 0 {
+		return nil
+	}
+
+	var offset, length uint32
+	for _, e := range t.entries(int(ifd1)) {
+		tag, _ := t.u16(e)
+		switch tag {
+		case exifTagThumbnailOffset:
+			offset, _ = t.u32(e + 8)
+		case exifTagThumbnailLength:
+			length, _ = t.u32(e + 8)
+		}
+	}
+	end := int64(offset) + int64(length)
+	if offset == 0 || length == 0 || end > int64(len(exif)) {
+		return nil
+	}
+	thumb := exif[offset:end]
+	if !bytes.HasPrefix(thumb, []byte{0xff, 0xd8}) {
+		return nil
+	}
+	return thumb
+}
+
+// decodeExifThumbnail decodes the EXIF thumbnail of JPEG data if it can
+// stand in for the full image resized by resizePercent: it must be at least
+// as large as the resized image and have the same aspect ratio, which rules
+// out letterboxed thumbnails. It also returns the full image's dimensions.
+func decodeExifThumbnail(data []byte, resizePercent float64) (thumb image.Image, full image.Config, ok bool) {
+	raw := readExifThumbnail(readJPEGExif(data))
+	if raw == nil || resizePercent <= 0 {
+		return nil, full, false
+	}
+	full, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, full, false
+	}
+	thumbConfig, err := jpeg.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, full, false
+	}
+
+	width, height := resizedDimensions(image.Rect(0, 0, full.Width, full.Height), resizePercent)
+	fullRatio := float64(full.Width) / float64(full.Height)
+	thumbRatio := float64(thumbConfig.Width) / float64(thumbConfig.Height)
+	if thumbConfig.Width < int(width) || thumbConfig.Height < int(height) || math.Abs(thumbRatio-fullRatio) > 0.02*fullRatio {
+		slog.Debug("EXIF thumbnail not usable", "thumbnail", fmt.Sprintf("%dx%d", thumbConfig.Width, thumbConfig.Height), "needed", fmt.Sprintf("%dx%d", width, height))
+		return nil, full, false
+	}
+
+	thumb, err = jpeg.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, full, false
+	}
+	return thumb, full, true
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// exifField is a text tag of IFD0 that the exif subcommand edits, together
+// with the XMP property that mirrors it
+type exifField struct {
+	name string
+	tag  uint16
+	xmp  string // qualified name of the XMP property
+	// container is the RDF container the XMP value is wrapped in: Seq for an
+	// ordered list, Alt for language alternatives, or empty for plain text
+	container string
+}
+
+// exifFields lists the fields the exif subcommand knows, in tag order
+var exifFields = []exifField{
+	{name: "datetime", tag: 0x0132, xmp: "xmp:ModifyDate"},
+	{name: "artist", tag: 0x013b, xmp: "dc:creator", container: "Seq"},
+	{name: "copyright", tag: 0x8298, xmp: "dc:rights", container: "Alt"},
+}
+
+// xmpNamespaces maps the XMP prefixes used by exifFields to their URIs
+var xmpNamespaces = map[string]string{
+	"dc":  "http://purl.org/dc/elements/1.1/",
+	"xmp": "http://ns.adobe.com/xap/1.0/",
+}
+
+var xmpHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+const pngXMPKeyword = "XML:com.adobe.xmp"
+
+// lookupExifField returns the field with the given name
+func lookupExifField(name string) (exifField, error) {
+	for _, f := range exifFields {
+		if strings.EqualFold(f.name, name) {
+			return f, nil
+		}
+	}
+	var names []string
+	for _, f := range exifFields {
+		names = append(names, f.name)
+	}
+	return exifField{}, fmt.Errorf("unknown field %q: use %s", name, strings.Join(names, ", "))
+}
+
+// normalizeExifDateTime converts a date and time to the EXIF form
+// "2006:01:02 15:04:05". It accepts that form, RFC 3339 with or without a
+// time zone, "2006-01-02 15:04:05", a bare date, and "now".
+func normalizeExifDateTime(value string) (string, error) {
+	const exifLayout = "2006:01:02 15:04:05"
+	if strings.EqualFold(value, "now") {
+		return time.Now().Format(exifLayout), nil
+	}
+	for _, layout := range []string{exifLayout, time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Format(exifLayout), nil
+		}
+	}
+	return "", fmt.Errorf("invalid date and time %q: use YYYY-MM-DD HH:MM:SS", value)
+}
+
+// ascii returns the value of an ASCII entry, without its terminating NULs
+func (t *tiffReader) ascii(entry int) (string, bool) {
+	typ, _ := t.u16(entry + 2)
+	count, _ := t.u32(entry + 4)
+	if typ != 2 {
+		return "", false
+	}
+	start := entry + 8
+	if count > 4 {
+		off, _ := t.u32(entry + 8)
+		start = int(off)
+	}
+	if start+int(count) > len(t.data) {
+		return "", false
+	}
+	return strings.TrimRight(string(t.data[start:start+int(count)]), "\x00"), true
+}
+
+// findEntry returns the offset of the entry with the given tag in the IFD at off
+func (t *tiffReader) findEntry(off int, tag uint16) (int, bool) {
+	for _, e := range t.entries(off) {
+		if entryTag, _ := t.u16(e); entryTag == tag {
+			return e, true
+		}
+	}
+	return 0, false
+}
+
+// readExifField returns the value of a field in IFD0 of an EXIF payload
+func readExifField(exif []byte, f exifField) (string, bool) {
+	t, err := newTIFFReader(exif)
+	if err != nil {
+		return "", false
+	}
+	e, ok := t.findEntry(t.firstIFD(), f.tag)
+	if !ok {
+		return "", false
+	}
+	return t.ascii(e)
+}
+
+// setExifField returns a copy of an EXIF payload with a field of IFD0 set to
+// value, creating the payload if exif is nil. Everything else stays where it
+// is, so offsets into the payload, such as those of maker notes, stay valid.
+func setExifField(exif []byte, f exifField, value string) ([]byte, error) {
+	if exif == nil {
+		// An empty little-endian TIFF structure
+		exif = []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	}
+	t, err := newTIFFReader(slices.Clone(exif))
+	if err != nil {
+		return nil, err
+	}
+	ifd := t.firstIFD()
+	entries := t.entries(ifd)
+	if count, _ := t.u16(ifd); entries == nil && count != 0 || ifd < 8 {
+		return nil, errors.New("invalid EXIF IFD0")
+	}
+	value += "\x00"
+
+	// An existing entry is updated in place, its value overwriting the old
+	// one when it fits
+	if e, ok := t.findEntry(ifd, f.tag); ok {
+		typ, _ := t.u16(e + 2)
+		count, _ := t.u32(e + 4)
+		oldOff, _ := t.u32(e + 8)
+		oldSize := tiffTypeSizes[typ] * int(count)
+		outOfLine := oldSize > 4 && int(oldOff)+oldSize <= len(t.data)
+		if outOfLine {
+			clear(t.data[oldOff : int(oldOff)+oldSize])
+		}
+		t.order.PutUint16(t.data[e+2:], 2)
+		t.order.PutUint32(t.data[e+4:], uint32(len(value)))
+		switch {
+		case len(value) <= 4:
+			clear(t.data[e+8 : e+12])
+			copy(t.data[e+8:], value)
+		case outOfLine && len(value) <= oldSize:
+			copy(t.data[oldOff:], value)
+		default:
+			off := t.appendValue([]byte(value))
+			t.order.PutUint32(t.data[e+8:], uint32(off))
+		}
+		return t.data, nil
+	}
+
+	// A new entry needs a larger IFD, which is moved to the end
+	var entry [12]byte
+	t.order.PutUint16(entry[0:], f.tag)
+	t.order.PutUint16(entry[2:], 2)
+	t.order.PutUint32(entry[4:], uint32(len(value)))
+	if len(value) <= 4 {
+		copy(entry[8:], value)
+	} else {
+		t.order.PutUint32(entry[8:], uint32(t.appendValue([]byte(value))))
+	}
+	table := make([][]byte, 0, len(entries)+1)
+	for _, e := range entries {
+		table = append(table, slices.Clone(t.data[e:e+12]))
+	}
+	i, _ := slices.BinarySearchFunc(table, f.tag, func(e []byte, tag uint16) int {
+		return int(t.order.Uint16(e)) - int(tag)
+	})
+	table = slices.Insert(table, i, entry[:])
+	next, _ := t.u32(ifd + 2 + 12*len(entries))
+	clear(t.data[ifd : ifd+2+12*len(entries)+4])
+
+	ifdData := make([]byte, 2+12*len(table)+4)
+	t.order.PutUint16(ifdData, uint16(len(table)))
+	for i, e := range table {
+		copy(ifdData[2+12*i:], e)
+	}
+	t.order.PutUint32(ifdData[2+12*len(table):], next)
+	off := t.appendValue(ifdData)
+	t.order.PutUint32(t.data[4:], uint32(off))
+	return t.data, nil
+}
+
+// appendValue appends data at an even offset and returns that offset
+func (t *tiffReader) appendValue(data []byte) int {
+	if len(t.data)%2 != 0 {
+		t.data = append(t.data, 0)
+	}
+	off := len(t.data)
+	t.data = append(t.data, data...)
+	return off
+}
+
+// deleteExifField returns a copy of an EXIF payload without a field of IFD0
+func deleteExifField(exif []byte, f exifField) []byte {
+	deleted := slices.Clone(exif)
+	t, err := newTIFFReader(deleted)
+	if err != nil {
+		return exif
+	}
+	e, ok := t.findEntry(t.firstIFD(), f.tag)
+	if !ok {
+		return exif
+	}
+	typ, _ := t.u16(e + 2)
+	count, _ := t.u32(e + 4)
+	value, _ := t.removeEntry(t.firstIFD(), f.tag)
+	if size := tiffTypeSizes[typ] * int(count); size > 4 && int(value)+size <= len(deleted) {
+		clear(deleted[value : int(value)+size])
+	}
+	return deleted
+}
+
+// xmpPattern returns a regular expression for a property of f in element
+// form, capturing its content, or in attribute form, capturing its value
+func xmpPattern(f exifField, attribute bool) *regexp.Regexp {
+	name := regexp.QuoteMeta(f.xmp)
+	if attribute {
+		return regexp.MustCompile(`\s` + name + `\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	}
+	return regexp.MustCompile(`(?s)<` + name + `\b[^>]*?(?:/>|>(.*?)</` + name + `\s*>)`)
+}
+
+var xmpListItem = regexp.MustCompile(`(?s)<rdf:li\b[^>]*>(.*?)</rdf:li\s*>`)
+
+// readXMPField returns the value of f's property in an XMP packet. For lists
+// and language alternatives this is the first item.
+func readXMPField(xmp []byte, f exifField) (string, bool) {
+	if m := xmpPattern(f, true).FindSubmatch(xmp); m != nil {
+		return html.UnescapeString(string(m[1]) + string(m[2])), true
+	}
+	m := xmpPattern(f, false).FindSubmatch(xmp)
+	if m == nil {
+		return "", false
+	}
+	content := m[1]
+	if f.container != "" {
+		item := xmpListItem.FindSubmatch(content)
+		if item == nil {
+			return "", false
+		}
+		content = item[1]
+	}
+	return html.UnescapeString(strings.TrimSpace(string(content))), true
+}
+
+// deleteXMPField removes f's property from an XMP packet
+func deleteXMPField(xmp []byte, f exifField) []byte {
+	xmp = xmpPattern(f, true).ReplaceAll(xmp, nil)
+	return xmpPattern(f, false).ReplaceAll(xmp, nil)
+}
+
+var xmpDescription = regexp.MustCompile(`<rdf:Description\b[^>]*?(/?)>`)
+
+// setXMPField replaces f's property in an XMP packet with value, adding it
+// to the first rdf:Description along with its namespace if needed
+func setXMPField(xmp []byte, f exifField, value string) ([]byte, error) {
+	if f.tag == 0x0132 {
+		// EXIF dates become ISO 8601 dates in XMP
+		if t, err := time.Parse("2006:01:02 15:04:05", value); err == nil {
+			value = t.Format("2006-01-02T15:04:05")
+		}
+	}
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(value))
+	element := escaped.String()
+	switch f.container {
+	case "Seq":
+		element = "<rdf:Seq><rdf:li>" + element + "</rdf:li></rdf:Seq>"
+	case "Alt":
+		element = `<rdf:Alt><rdf:li xml:lang="x-default">` + element + "</rdf:li></rdf:Alt>"
+	}
+	element = "<" + f.xmp + ">" + element + "</" + f.xmp + ">"
+
+	xmp = deleteXMPField(xmp, f)
+	loc := xmpDescription.FindSubmatchIndex(xmp)
+	if loc == nil {
+		return nil, errors.New("XMP packet has no rdf:Description")
+	}
+	open := string(xmp[loc[0]:loc[2]])
+	prefix, _, _ := strings.Cut(f.xmp, ":")
+	if !bytes.Contains(xmp, []byte("xmlns:"+prefix+"=")) {
+		open += fmt.Sprintf(` xmlns:%s="%s"`, prefix, xmpNamespaces[prefix])
+	}
+	if loc[3] > loc[2] {
+		// Self-closing description
+		element = open + ">" + element + "</rdf:Description>"
+	} else {
+		element = open + ">" + element
+	}
+	return slices.Concat(xmp[:loc[0]], []byte(element), xmp[loc[1]:]), nil
+}
+
+// jpegAPP1Segment returns an APP1 segment holding header and payload
+func jpegAPP1Segment(header, payload []byte) ([]byte, error) {
+	if len(header)+len(payload)+2 > 0xffff {
+		return nil, errors.New("metadata too large for a JPEG APP1 segment")
+	}
+	segment := binary.BigEndian.AppendUint16([]byte{0xff, 0xe1}, uint16(len(header)+len(payload)+2))
+	return slices.Concat(segment, header, payload), nil
+}
+
+// pngChunkBounds finds the first chunk of a PNG of the given type for which
+// match returns true, returning the chunk's bounds and data
+func pngChunkBounds(data []byte, typ string, match func(payload []byte) bool) (start, end int, payload []byte, found bool) {
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return 0, 0, nil, false
+	}
+	for pos := 8; pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if pos+12+length > len(data) {
+			return 0, 0, nil, false
+		}
+		payload := data[pos+8 : pos+8+length]
+		if string(data[pos+4:pos+8]) == typ && match(payload) {
+			return pos, pos + 12 + length, payload, true
+		}
+		if string(data[pos+4:pos+8]) == "IDAT" {
+			// Metadata editors only look at the chunks before the image data
+			return 0, 0, nil, false
+		}
+		pos += 12 + length
+	}
+	return 0, 0, nil, false
+}
+
+// pngXMP returns the XMP packet of an iTXt chunk payload, if it holds one
+func pngXMP(payload []byte) ([]byte, bool) {
+	keyword, rest, ok := bytes.Cut(payload, []byte{0})
+	if !ok || string(keyword) != pngXMPKeyword || len(rest) < 2 {
+		return nil, false
+	}
+	compressed := rest[0] == 1
+	// Skip the compression fields, language tag and translated keyword
+	parts := bytes.SplitN(rest[2:], []byte{0}, 3)
+	if len(parts) != 3 {
+		return nil, false
+	}
+	if !compressed {
+		return parts[2], true
+	}
+	r, err := zlib.NewReader(bytes.NewReader(parts[2]))
+	if err != nil {
+		return nil, false
+	}
+	xmp, err := io.ReadAll(r)
+	return xmp, err == nil
+}
+
+// fileMetadata is the EXIF payload and XMP packet of a JPEG or PNG file,
+// with the means to write them back
+type fileMetadata struct {
+	Exif, XMP []byte
+	format    string
+	data      []byte
+}
+
+// readFileMetadata locates the EXIF and XMP metadata of a JPEG or PNG file
+func readFileMetadata(data []byte) (*fileMetadata, error) {
+	m := &fileMetadata{data: data}
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		m.format = "jpeg"
+		_, _, m.Exif, _ = jpegAPP1(data, exifHeader)
+		_, _, m.XMP, _ = jpegAPP1(data, xmpHeader)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		m.format = "png"
+		_, _, m.Exif, _ = pngChunkBounds(data, "eXIf", func([]byte) bool { return true })
+		_, _, payload, _ := pngChunkBounds(data, "iTXt", func(p []byte) bool { _, ok := pngXMP(p); return ok })
+		m.XMP, _ = pngXMP(payload)
+	default:
+		return nil, errors.New("metadata can only be edited in JPEG and PNG files")
+	}
+	return m, nil
+}
+
+// encode returns the file with its metadata replaced by m.Exif and m.XMP.
+// Segments and chunks are replaced where they are, so the image data is
+// copied unchanged. A missing EXIF block is added; XMP is only ever updated.
+func (m *fileMetadata) encode() ([]byte, error) {
+	data := m.data
+	replace := func(start, end int, block []byte) {
+		data = slices.Concat(data[:start], block, data[end:])
+	}
+	switch m.format {
+	case "jpeg":
+		if start, end, _, ok := jpegAPP1(data, xmpHeader); ok && m.XMP != nil {
+			segment, err := jpegAPP1Segment(xmpHeader, m.XMP)
+			if err != nil {
+				return nil, err
+			}
+			replace(start, end, segment)
+		}
+		if start, end, _, ok := jpegAPP1(data, exifHeader); ok {
+			segment, err := jpegAPP1Segment(exifHeader, m.Exif)
+			if err != nil {
+				return nil, err
+			}
+			replace(start, end, segment)
+		} else if m.Exif != nil {
+			return insertJPEGExif(data, m.Exif)
+		}
+	case "png":
+		if start, end, payload, ok := pngChunkBounds(data, "iTXt", func(p []byte) bool { _, ok := pngXMP(p); return ok }); ok && m.XMP != nil {
+			header, _, _ := bytes.Cut(payload, []byte{0})
+			chunk := slices.Concat(header, []byte{0, 0, 0, 0, 0}, m.XMP)
+			replace(start, end, appendPNGChunk(nil, "iTXt", chunk))
+		}
+		if start, end, _, ok := pngChunkBounds(data, "eXIf", func([]byte) bool { return true }); ok {
+			replace(start, end, appendPNGChunk(nil, "eXIf", m.Exif))
+		} else if m.Exif != nil {
+			return insertPNGChunk(data, "eXIf", m.Exif)
+		}
+	}
+	return data, nil
+}
+
+// exifEdit is a change requested with -set or -delete
+type exifEdit struct {
+	field exifField
+	value string
+	del   bool
+}
+
+// apply makes the edit to the file's EXIF payload and XMP packet
+func (e exifEdit) apply(m *fileMetadata) error {
+	var err error
+	if e.del {
+		if m.Exif != nil {
+			m.Exif = deleteExifField(m.Exif, e.field)
+		}
+		if m.XMP != nil {
+			m.XMP = deleteXMPField(m.XMP, e.field)
+		}
+		return nil
+	}
+	if m.Exif, err = setExifField(m.Exif, e.field, e.value); err != nil {
+		return fmt.Errorf("failed to update EXIF: %w", err)
+	}
+	if m.XMP != nil {
+		if m.XMP, err = setXMPField(m.XMP, e.field, e.value); err != nil {
+			return fmt.Errorf("failed to update XMP: %w", err)
+		}
+	}
+	return nil
+}
+
+// readExifFields returns the fields set in a file's metadata by name,
+// preferring EXIF over XMP
+func readExifFields(m *fileMetadata) map[string]string {
+	values := map[string]string{}
+	for _, f := range exifFields {
+		if v, ok := readExifField(m.Exif, f); ok {
+			values[f.name] = v
+		} else if v, ok := readXMPField(m.XMP, f); ok {
+			values[f.name] = v
+		}
+	}
+	return values
+}
+
+// editExifFile applies edits to the metadata of the file at path and
+// rewrites it in place, or prints its fields when there are no edits
+func editExifFile(path string, edits []exifEdit, jsonOutput bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	m, err := readFileMetadata(data)
+	if err != nil {
+		return err
+	}
+
+	if len(edits) == 0 {
+		values := readExifFields(m)
+		// The density is shown but not edited; -dpi on the main command sets it
+		if density, ok := readImageDensity(data); ok {
+			values["dpi"] = density.String()
+		}
+		if jsonOutput {
+			line, _ := json.Marshal(map[string]any{"path": path, "fields": values})
+			fmt.Println(string(line))
+			return nil
+		}
+		fmt.Println(path)
+		for _, f := range exifFields {
+			if v, ok := values[f.name]; ok {
+				fmt.Printf("  %s: %s\n", f.name, v)
+			}
+		}
+		if v, ok := values["dpi"]; ok {
+			fmt.Printf("  dpi: %s\n", v)
+		}
+		return nil
+	}
+
+	for _, e := range edits {
+		if err := e.apply(m); err != nil {
+			return err
+		}
+	}
+	encoded, err := m.encode()
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(encoded, data) {
+		slog.Debug("Metadata unchanged", "path", path)
+		return nil
+	}
+	if err := writeFileAtomic(path, encoded); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
+
+// runExif implements the exif subcommand: it prints or edits the artist,
+// copyright and date fields of JPEG and PNG files without re-encoding them
+func runExif(args []string) error {
+	fs := flag.NewFlagSet("exif", flag.ExitOnError)
+	var edits []exifEdit
+	fs.Func("set", "Set a field, e.g. -set 'copyright=© 2026 Jane Doe'. Fields are artist, copyright and datetime. May be repeated", func(s string) error {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok {
+			return errors.New("expected name=value")
+		}
+		f, err := lookupExifField(name)
+		if err != nil {
+			return err
+		}
+		if f.name == "datetime" {
+			if value, err = normalizeExifDateTime(value); err != nil {
+				return err
+			}
+		}
+		edits = append(edits, exifEdit{field: f, value: value})
+		return nil
+	})
+	fs.Func("delete", "Delete a field: artist, copyright or datetime. May be repeated", func(name string) error {
+		f, err := lookupExifField(name)
+		if err != nil {
+			return err
+		}
+		edits = append(edits, exifEdit{field: f, del: true})
+		return nil
+	})
+	fileList := addFileListFlag(fs, "File naming images one per line, or - to read the list from stdin")
+	jsonOutput := fs.Bool("json", false, "Print fields as one JSON object per file")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s exif [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(fs.Output(), "Without -set or -delete, prints the fields of each image.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	inputs, err := collectInputs(fs.Args(), *fileList)
+	if err != nil {
+		return err
+	}
+	if len(inputs) == 0 {
+		return fmt.Errorf("at least one input image is required")
+	}
+
+	_, stop, release := handleSignals()
+	defer release()
+
+	var progress *progressBar
+	if len(edits) > 0 {
+		progress = newProgressBar("Editing metadata", "files", len(inputs))
+		defer progress.Finish()
+	}
+	failed := 0
+	for i, path := range inputs {
+		if stopRequested(stop) {
+			return fmt.Errorf("%w after %d of %d files", errInterrupted, i, len(inputs))
+		}
+		if err := editExifFile(path, edits, *jsonOutput); err != nil {
+			slog.Error("Failed to edit metadata", "path", path, "error", err)
+			failed++
+		} else if progress != nil {
+			progress.Step("Edited metadata", "path", path)
+		}
+	}
+	if failed > 0 {
+		slog.Warn("Some files could not be edited", "failed", failed, "total", len(inputs))
+		return errBatchPartial
+	}
+	if len(edits) > 0 {
+		slog.Info("Metadata updated", "files", len(inputs))
+	}
+	return nil
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"slices"
+	"strings"
+)
+
+// exrMagic starts every OpenEXR file
+var exrMagic = []byte{0x76, 0x2f, 0x31, 0x01}
+
+// OpenEXR version flags of files this decoder cannot read
+const (
+	exrTiled     = 0x200
+	exrDeep      = 0x800
+	exrMultipart = 0x1000
+)
+
+// OpenEXR channel pixel types
+const (
+	exrUint  = 0
+	exrHalf  = 1
+	exrFloat = 2
+)
+
+// exrCompressions names the OpenEXR compression methods by their code, with
+// the number of scanlines in each chunk and, for the methods decoded here,
+// the most bytes of pixels one byte of compressed data can hold
+var exrCompressions = []struct {
+	name  string
+	lines int
+	ratio int
+}{
+	{"none", 1, 1}, {"rle", 1, 64}, {"zips", 1, 1032}, {"zip", 16, 1032}, {"piz", 32, 0},
+	{"pxr24", 16, 0}, {"b44", 32, 0}, {"b44a", 32, 0}, {"dwaa", 32, 0}, {"dwab", 256, 0},
+}
+
+// exrChannel is one entry of an OpenEXR channel list
+type exrChannel struct {
+	name       string
+	pixelType  int32
+	xSampling  int32
+	ySampling  int32
+	bytesPerPx int
+}
+
+// exrHeader holds the attributes of an OpenEXR header needed to read its
+// pixels
+type exrHeader struct {
+	channels    []exrChannel
+	compression int
+	minX, minY  int
+	width       int
+	height      int
+}
+
+// exrReader reads the little-endian values of an OpenEXR header
+type exrReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *exrReader) read(v any) {
+	if e.err == nil {
+		e.err = binary.Read(e.r, binary.LittleEndian, v)
+	}
+}
+
+// string reads a null-terminated string of at most 255 bytes
+func (e *exrReader) string() string {
+	var s []byte
+	for e.err == nil {
+		var b [1]byte
+		if _, e.err = io.ReadFull(e.r, b[:]); e.err != nil || b[0] == 0 {
+			break
+		}
+		if s = append(s, b[0]); len(s) > 255 {
+			e.err = errors.New("OpenEXR name too long")
+		}
+	}
+	return string(s)
+}
+
+// readEXRHeader reads the magic number, version and header of an OpenEXR
+// file, rejecting the tiled, deep and multi-part files it cannot decode
+func readEXRHeader(r io.Reader) (exrHeader, error) {
+	var h exrHeader
+	e := &exrReader{r: r}
+	var magic [4]byte
+	var version uint32
+	e.read(&magic)
+	e.read(&version)
+	if e.err != nil || !bytes.Equal(magic[:], exrMagic) {
+		return h, errors.New("not an OpenEXR file")
+	}
+	switch {
+	case version&exrTiled != 0:
+		return h, errors.New("tiled OpenEXR files are not supported; save scanline images")
+	case version&(exrDeep|exrMultipart) != 0:
+		return h, errors.New("deep and multi-part OpenEXR files are not supported")
+	}
+
+	haveWindow := false
+	for {
+		name := e.string()
+		if e.err != nil || name == "" {
+			break
+		}
+		kind := e.string()
+		var size int32
+		e.read(&size)
+		if e.err != nil {
+			break
+		}
+		if size < 0 || size > 1<<24 {
+			return h, fmt.Errorf("invalid OpenEXR attribute %s", name)
+		}
+		value := make([]byte, size)
+		if _, e.err = io.ReadFull(r, value); e.err != nil {
+			break
+		}
+		switch {
+		case name == "channels" && kind == "chlist":
+			v := &exrReader{r: bytes.NewReader(value)}
+			for {
+				c := exrChannel{name: v.string()}
+				if v.err != nil || c.name == "" {
+					break
+				}
+				var linear [4]byte
+				v.read(&c.pixelType)
+				v.read(&linear)
+				v.read(&c.xSampling)
+				v.read(&c.ySampling)
+				if c.pixelType < exrUint || c.pixelType > exrFloat {
+					return h, fmt.Errorf("invalid OpenEXR pixel type %d", c.pixelType)
+				}
+				c.bytesPerPx = 4
+				if c.pixelType == exrHalf {
+					c.bytesPerPx = 2
+				}
+				h.channels = append(h.channels, c)
+			}
+			if v.err != nil {
+				return h, fmt.Errorf("invalid OpenEXR channel list: %w", v.err)
+			}
+		case name == "compression" && size == 1:
+			h.compression = int(value[0])
+		case name == "dataWindow" && kind == "box2i" && size == 16:
+			var box [4]int32
+			binary.Read(bytes.NewReader(value), binary.LittleEndian, &box)
+			h.minX, h.minY = int(box[0]), int(box[1])
+			h.width, h.height = int(box[2])-int(box[0])+1, int(box[3])-int(box[1])+1
+			haveWindow = true
+		}
+	}
+	if e.err != nil {
+		return h, fmt.Errorf("truncated OpenEXR header: %w", e.err)
+	}
+	if !haveWindow || h.width < 1 || h.height < 1 || len(h.channels) == 0 {
+		return h, errors.New("OpenEXR header lacks a data window or channels")
+	}
+	// Compare without multiplying, which could overflow
+	if h.height > hdrMaxPixels/h.width {
+		return h, fmt.Errorf("invalid OpenEXR size %dx%d", h.width, h.height)
+	}
+	if h.compression >= len(exrCompressions) {
+		return h, fmt.Errorf("unknown OpenEXR compression %d", h.compression)
+	}
+	if name := exrCompressions[h.compression].name; !slices.Contains([]string{"none", "rle", "zips", "zip"}, name) {
+		return h, fmt.Errorf("OpenEXR %s compression is not supported; save with zip, zips, rle or no compression", strings.ToUpper(name))
+	}
+	return h, nil
+}
+
+// unpredictEXR undoes the byte delta predictor and the splitting of even and
+// odd bytes that OpenEXR applies before RLE and ZIP compression
+func unpredictEXR(t []byte) []byte {
+	for i := 1; i < len(t); i++ {
+		t[i] = t[i-1] + t[i] - 128
+	}
+	out := make([]byte, len(t))
+	half := (len(t) + 1) / 2
+	for i := range out {
+		if i%2 == 0 {
+			out[i] = t[i/2]
+		} else {
+			out[i] = t[half+i/2]
+		}
+	}
+	return out
+}
+
+// uncompressEXRChunk returns the size bytes of pixel data in a chunk
+// compressed with h's method. Chunks that compression would not shrink are
+// stored as they are.
+func uncompressEXRChunk(h exrHeader, data []byte, size int) ([]byte, error) {
+	if len(data) == size || h.compression == 0 {
+		if len(data) != size {
+			return nil, errors.New("OpenEXR chunk has the wrong size")
+		}
+		return data, nil
+	}
+	var t []byte
+	switch exrCompressions[h.compression].name {
+	case "rle":
+		for i := 0; i < len(data) && len(t) <= size; {
+			count := int(int8(data[i]))
+			if count < 0 {
+				if i+1-count > len(data) {
+					return nil, errors.New("truncated OpenEXR RLE data")
+				}
+				t = append(t, data[i+1:i+1-count]...)
+				i += 1 - count
+				continue
+			}
+			if i+1 >= len(data) {
+				return nil, errors.New("truncated OpenEXR RLE data")
+			}
+			for n := 0; n <= count; n++ {
+				t = append(t, data[i+1])
+			}
+			i += 2
+		}
+	default:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OpenEXR ZIP data: %w", err)
+		}
+		t, err = io.ReadAll(io.LimitReader(zr, int64(size)+1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OpenEXR ZIP data: %w", err)
+		}
+	}
+	if len(t) != size {
+		return nil, errors.New("OpenEXR chunk has the wrong size")
+	}
+	return unpredictEXR(t), nil
+}
+
+// halfToFloat converts an IEEE 754 half-precision value to a float32
+func halfToFloat(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h) & 0x3ff
+	switch {
+	case exp == 0 && mant == 0:
+		return math.Float32frombits(sign)
+	case exp == 0:
+		// Subnormal: normalise the mantissa
+		for mant&0x400 == 0 {
+			mant <<= 1
+			exp--
+		}
+		exp++
+		mant &= 0x3ff
+	case exp == 0x1f:
+		return math.Float32frombits(sign | 0xff<<23 | mant<<13)
+	}
+	return math.Float32frombits(sign | (exp+112)<<23 | mant<<13)
+}
+
+// decodeEXR decodes a scanline OpenEXR image with no, RLE, ZIPS or ZIP
+// compression and tone-maps it. R, G and B channels are read as color, a Y
+// channel alone as luminance, and A as alpha, which OpenEXR premultiplies.
+func decodeEXR(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	br := bytes.NewReader(data)
+	h, err := readEXRHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the offset in each scanline of the channels used
+	index := map[string]int{}
+	lineBytes := 0
+	offsets := make([]int, len(h.channels))
+	for i, c := range h.channels {
+		if c.xSampling != 1 || c.ySampling != 1 {
+			if slices.Contains([]string{"R", "G", "B", "A", "Y"}, c.name) {
+				return nil, fmt.Errorf("subsampled OpenEXR channel %s is not supported", c.name)
+			}
+			continue
+		}
+		index[c.name] = i
+		offsets[i] = lineBytes * h.width
+		lineBytes += c.bytesPerPx
+	}
+	_, hasR := index["R"]
+	_, hasG := index["G"]
+	_, hasB := index["B"]
+	_, hasY := index["Y"]
+	_, alpha := index["A"]
+	gray := !(hasR && hasG && hasB)
+	if gray && !hasY {
+		names := make([]string, len(h.channels))
+		for i, c := range h.channels {
+			names[i] = c.name
+		}
+		return nil, fmt.Errorf("OpenEXR image has no R, G and B or Y channels, only %s", strings.Join(names, ", "))
+	}
+	sources := []string{"R", "G", "B", "A"}
+	if gray {
+		sources = []string{"Y", "Y", "Y", "A"}
+	}
+
+	// Each chunk has an 8-byte offset, and the rest of the file must hold
+	// the pixels at the compression's best ratio
+	compression := exrCompressions[h.compression]
+	linesPerChunk := compression.lines
+	chunks := (h.height + linesPerChunk - 1) / linesPerChunk
+	if chunks > br.Len()/8 || uint64(h.width)*uint64(h.height)*uint64(lineBytes) > uint64(compression.ratio)*uint64(br.Len()) {
+		return nil, fmt.Errorf("OpenEXR image of %dx%d is larger than its data", h.width, h.height)
+	}
+	table := make([]uint64, chunks)
+	if err := binary.Read(br, binary.LittleEndian, table); err != nil {
+		return nil, fmt.Errorf("truncated OpenEXR offset table: %w", err)
+	}
+
+	pix := make([]float32, 4*h.width*h.height)
+	for i := 3; i < len(pix); i += 4 {
+		pix[i] = 1
+	}
+	for _, offset := range table {
+		if offset > uint64(len(data))-8 {
+			return nil, errors.New("OpenEXR chunk offset out of range")
+		}
+		y := int(int32(binary.LittleEndian.Uint32(data[offset:]))) - h.minY
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		start := int(offset) + 8
+		if y < 0 || y >= h.height || size < 0 || size > len(data)-start {
+			return nil, errors.New("invalid OpenEXR chunk")
+		}
+		lines := min(linesPerChunk, h.height-y)
+		block, err := uncompressEXRChunk(h, data[start:start+size], lines*lineBytes*h.width)
+		if err != nil {
+			return nil, err
+		}
+		for line := 0; line < lines; line++ {
+			row := block[line*lineBytes*h.width:]
+			for c, name := range sources {
+				i, ok := index[name]
+				if !ok {
+					continue
+				}
+				ch := h.channels[i]
+				values := row[offsets[i]:]
+				for x := 0; x < h.width; x++ {
+					var v float32
+					switch ch.pixelType {
+					case exrHalf:
+						v = halfToFloat(binary.LittleEndian.Uint16(values[2*x:]))
+					case exrFloat:
+						v = math.Float32frombits(binary.LittleEndian.Uint32(values[4*x:]))
+					default:
+						v = float32(binary.LittleEndian.Uint32(values[4*x:]))
+					}
+					pix[4*((y+line)*h.width+x)+c] = v
+				}
+			}
+		}
+	}
+
+	// Tone mapping works on straight colors
+	if alpha {
+		for i := 0; i < len(pix); i += 4 {
+			if a := pix[i+3]; a > 0 {
+				pix[i] /= a
+				pix[i+1] /= a
+				pix[i+2] /= a
+			}
+		}
+	}
+	return toneMapImage(h.width, h.height, pix, gray, alpha), nil
+}
+
+func decodeEXRConfig(r io.Reader) (image.Config, error) {
+	h, err := readEXRHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	model := color.NRGBA64Model
+	if !slices.ContainsFunc(h.channels, func(c exrChannel) bool { return c.name == "R" || c.name == "A" }) {
+		model = color.Gray16Model
+	}
+	return image.Config{ColorModel: model, Width: h.width, Height: h.height}, nil
+}
+
+func init() {
+	image.RegisterFormat("exr", string(exrMagic), decodeEXR, decodeEXRConfig)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// exrFile returns an uncompressed OpenEXR file with a float Y channel over
+// the data window from (minX, minY) to (maxX, maxY), one chunk per row of
+// the given values and an offset table of chunks entries
+func exrFile(minX, minY, maxX, maxY int32, chunks int, rows [][]float32) []byte {
+	var b bytes.Buffer
+	le := func(v any) { binary.Write(&b, binary.LittleEndian, v) }
+	attr := func(name, kind string, value []byte) {
+		b.WriteString(name + "\x00" + kind + "\x00")
+		le(int32(len(value)))
+		b.Write(value)
+	}
+	b.Write(exrMagic)
+	le(uint32(2))
+	var chlist bytes.Buffer
+	chlist.WriteString("Y\x00")
+	binary.Write(&chlist, binary.LittleEndian, []int32{exrFloat, 0, 1, 1})
+	chlist.WriteByte(0)
+	attr("channels", "chlist", chlist.Bytes())
+	attr("compression", "compression", []byte{0})
+	var window bytes.Buffer
+	binary.Write(&window, binary.LittleEndian, []int32{minX, minY, maxX, maxY})
+	attr("dataWindow", "box2i", window.Bytes())
+	b.WriteByte(0)
+
+	offset := uint64(b.Len() + 8*chunks)
+	for _, row := range rows {
+		le(offset)
+		offset += uint64(8 + 4*len(row))
+	}
+	for range chunks - len(rows) {
+		le(offset)
+	}
+	for y, row := range rows {
+		le(int32(y) + minY)
+		le(int32(4 * len(row)))
+		for _, v := range row {
+			le(math.Float32bits(v))
+		}
+	}
+	return b.Bytes()
+}
+
+func TestDecodeEXRRejectsBadHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"overflowing dimensions", exrFile(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32, 0, nil)},
+		{"too many pixels", exrFile(0, 0, 59999, 59999, 0, nil)},
+		{"offset table larger than the file", exrFile(0, 0, 0, 99999, 4, nil)},
+		{"pixels larger than the data", exrFile(0, 0, 9999, 9, 10, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeEXR(bytes.NewReader(tt.data)); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestDecodeEXR(t *testing.T) {
+	img, err := decodeEXR(bytes.NewReader(exrFile(10, 20, 11, 21, 2, [][]float32{{0, 1}, {1, 0}})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 2 {
+		t.Fatalf("got %v, want 2x2", b)
+	}
+	for _, p := range [][3]int{{0, 0, 0}, {1, 0, 1}, {0, 1, 1}, {1, 1, 0}} {
+		if y, _, _, _ := img.At(p[0], p[1]).RGBA(); (y != 0) != (p[2] != 0) {
+			t.Errorf("pixel (%d, %d) is %#x", p[0], p[1], y)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	_ "embed"
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/SvnFrs/go-transform/ops"
+	pigo "github.com/esimov/pigo/core"
+)
+
+func init() {
+	ops.RegisterOperation("blur-faces", "Blur every detected face, for privacy. auto scales the blur to each face; a number gives the radius in pixels, e.g. 12", parseBlurFaces)
+}
+
+// facefinderCascade is pigo's frontal face classifier
+//
+//go:embed cascade/facefinder
+var facefinderCascade []byte
+
+const (
+	// faceDetectSize is the longest side images are reduced to before faces
+	// are searched for, which keeps detection fast on large photos
+	faceDetectSize = 1024
+
+	// faceMinQuality is the detection score below which a face is ignored
+	faceMinQuality = 5
+)
+
+// faceClassifier unpacks the embedded cascade the first time a face is
+// searched for
+var faceClassifier = sync.OnceValues(func() (*pigo.Pigo, error) {
+	classifier, err := pigo.NewPigo().Unpack(facefinderCascade)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load face classifier: %w", err)
+	}
+	return classifier, nil
+})
+
+// face is a detected face: a square around it, relative to the image's
+// top-left corner, and the detector's confidence
+type face struct {
+	rect    image.Rectangle
+	quality float32
+}
+
+// detectFaces returns the frontal faces found in img, largest first
+func detectFaces(img image.Image) ([]face, error) {
+	classifier, err := faceClassifier()
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	scale := 1.0
+	if longest := max(width, height); longest > faceDetectSize {
+		scale = float64(longest) / faceDetectSize
+		img = scaleImage(img, uint(math.Round(float64(width)/scale)), uint(math.Round(float64(height)/scale)))
+		bounds = img.Bounds()
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	drawParallel(gray, gray.Rect, img, bounds.Min)
+	params := pigo.CascadeParams{
+		MinSize:     20,
+		MaxSize:     min(bounds.Dx(), bounds.Dy()),
+		ShiftFactor: 0.1,
+		ScaleFactor: 1.1,
+		ImageParams: pigo.ImageParams{Pixels: gray.Pix, Rows: bounds.Dy(), Cols: bounds.Dx(), Dim: gray.Stride},
+	}
+	detections := classifier.ClusterDetections(classifier.RunCascade(params, 0), 0.2)
+
+	var faces []face
+	for _, d := range detections {
+		if d.Q < faceMinQuality {
+			continue
+		}
+		size := float64(d.Scale) * scale
+		x, y := float64(d.Col)*scale-size/2, float64(d.Row)*scale-size/2
+		r := image.Rect(int(math.Round(x)), int(math.Round(y)), int(math.Round(x+size)), int(math.Round(y+size)))
+		faces = append(faces, face{r.Intersect(image.Rect(0, 0, width, height)), d.Q})
+	}
+	slices.SortFunc(faces, func(a, b face) int {
+		return cmp.Or(cmp.Compare(b.rect.Dx()*b.rect.Dy(), a.rect.Dx()*a.rect.Dy()), cmp.Compare(b.quality, a.quality))
+	})
+	slog.Debug("Detected faces", "count", len(faces))
+	return faces, nil
+}
+
+// faceCropOp crops a square around the largest face, for avatars
+type faceCropOp struct{}
+
+// Apply crops a square twice the size of the face, centred on it and moved
+// or shrunk to fit inside the image. Without a face it crops the largest
+// centred square.
+func (faceCropOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	faces, err := detectFaces(img)
+	if err != nil {
+		return nil, err
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	side := min(width, height)
+	center := image.Pt(width/2, height/2)
+	if len(faces) == 0 {
+		slog.Warn("No face found, cropping the center of the image")
+	} else {
+		f := faces[0].rect
+		side = min(side, 2*max(f.Dx(), f.Dy()))
+		center = image.Pt((f.Min.X+f.Max.X)/2, (f.Min.Y+f.Max.Y)/2)
+		slog.Info("Cropping to face", "faces", len(faces), "face", fmt.Sprintf("%dx%d+%d+%d", f.Dx(), f.Dy(), f.Min.X, f.Min.Y))
+	}
+	x := min(max(0, center.X-side/2), width-side)
+	y := min(max(0, center.Y-side/2), height-side)
+	return cropOp{image.Rect(x, y, x+side, y+side)}.Apply(ctx, img)
+}
+
+// blurFacesOp blurs the detected faces
+type blurFacesOp struct {
+	sigma float64 // 0 scales the blur to each face
+}
+
+func parseBlurFaces(value string) (Operation, error) {
+	if value == "auto" {
+		return blurFacesOp{}, nil
+	}
+	sigma, err := strconv.ParseFloat(value, 64)
+	if err != nil || sigma <= 0 || sigma > 1000 {
+		return nil, fmt.Errorf("expected auto or a radius above 0 and up to 1000 pixels")
+	}
+	return blurFacesOp{sigma}, nil
+}
+
+// Apply blurs a margin of a fifth of its size around each face as well, so
+// the edges of the face do not show
+func (op blurFacesOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	faces, err := detectFaces(img)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Blurring faces", "faces", len(faces))
+	for _, f := range faces {
+		margin := f.rect.Dx() / 5
+		sigma := op.sigma
+		if sigma == 0 {
+			sigma = max(2, float64(f.rect.Dx())/6)
+		}
+		region := regionOp{"blur-faces", blurOp{sigma}, f.rect.Inset(-margin)}
+		if img, err = region.Apply(ctx, img); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
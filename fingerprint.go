@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// fingerprintLength is the number of hex digits of the SHA-256 of its
+	// content that -fingerprint puts in an output's name
+	fingerprintLength = 8
+
+	// fingerprintMapName is the file in output/ mapping each output's plain
+	// name to its fingerprinted name
+	fingerprintMapName = "fingerprints.json"
+)
+
+// fingerprints maps the plain name of each output written with -fingerprint
+// in this run to its fingerprinted name
+var fingerprints = map[string]string{}
+
+// fingerprintPath returns outPath with the start of the SHA-256 of data
+// inserted before its extension, as in logo.3fa9c2d1.png, and records the
+// pair for saveFingerprints
+func fingerprintPath(outPath string, data []byte) string {
+	ext := filepath.Ext(outPath)
+	hashed := strings.TrimSuffix(outPath, ext) + "." + sha256Hex(data)[:fingerprintLength] + ext
+	fingerprints[outPath] = hashed
+	slog.Info("Output named by content", "path", hashed)
+	return hashed
+}
+
+// saveFingerprints merges the names recorded by fingerprintPath into
+// output/fingerprints.json, so that separate runs add to the same map
+func saveFingerprints() error {
+	if len(fingerprints) == 0 {
+		return nil
+	}
+	path, err := prepareOutputPath("", fingerprintMapName)
+	if err != nil {
+		return err
+	}
+	merged := map[string]string{}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &merged); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	maps.Copy(merged, fingerprints)
+
+	data, err = json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode fingerprint map: %w", err)
+	}
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write fingerprint map: %w", err)
+	}
+	slog.Info("Fingerprint map written", "path", path, "entries", len(fingerprints))
+	return nil
+}
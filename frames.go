@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/webp"
+)
+
+// Ways a frame is cleared from the canvas before the next one is drawn
+const (
+	disposeNone       = iota // leave the frame in place
+	disposeBackground        // clear its rectangle to transparent
+	disposePrevious          // restore the canvas as it was before the frame
+)
+
+// animationFrame is one frame of an animation, decoded when it is needed
+type animationFrame struct {
+	rect    image.Rectangle // where the frame goes on the canvas
+	blend   bool            // draw over the canvas rather than replace its rectangle
+	dispose int
+	decode  func() (image.Image, error)
+}
+
+// animation is an animated image with frames drawn onto a shared canvas
+type animation struct {
+	format string
+	width  int
+	height int
+	frames []animationFrame
+}
+
+// readAnimation parses an animated GIF, PNG or WebP. It returns nil for
+// still images and other formats.
+func readAnimation(data []byte) (*animation, error) {
+	var a *animation
+	var err error
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		a, err = readGIFAnimation(data)
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		a, err = readAPNG(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		a, err = readWebPAnimation(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if a != nil {
+		for i, f := range a.frames {
+			if !f.rect.In(image.Rect(0, 0, a.width, a.height)) {
+				return nil, fmt.Errorf("frame %d lies outside the %dx%d canvas", i+1, a.width, a.height)
+			}
+		}
+	}
+	return a, nil
+}
+
+// readGIFAnimation returns the frames of a GIF with more than one
+func readGIFAnimation(data []byte) (*animation, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode GIF frames: %w", err)
+	}
+	if len(g.Image) < 2 {
+		return nil, nil
+	}
+	a := &animation{format: "gif", width: g.Config.Width, height: g.Config.Height}
+	for i, frame := range g.Image {
+		f := animationFrame{rect: frame.Rect, blend: true, decode: func() (image.Image, error) { return frame, nil }}
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				f.dispose = disposeBackground
+			case gif.DisposalPrevious:
+				f.dispose = disposePrevious
+			}
+		}
+		a.frames = append(a.frames, f)
+	}
+	return a, nil
+}
+
+// pngSignature starts every PNG file
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// readAPNG returns the frames of an animated PNG. Each frame is decoded by
+// wrapping its data in a PNG of its own, with the ancillary chunks of the
+// file, such as the palette, that apply to every frame.
+func readAPNG(data []byte) (*animation, error) {
+	var ihdr, shared []byte
+	var frames []animationFrame
+	var fdat [][]byte // image data of each frame in frames
+	animated, seenIDAT := false, false
+	for rest := data[len(pngSignature):]; len(rest) >= 12; {
+		length := binary.BigEndian.Uint32(rest)
+		if uint64(length)+12 > uint64(len(rest)) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		kind, body := string(rest[4:8]), rest[8:8+length]
+		chunk := rest[:12+length]
+		rest = rest[12+length:]
+
+		switch kind {
+		case "IHDR":
+			if len(body) != 13 {
+				return nil, errors.New("invalid PNG header")
+			}
+			ihdr = body
+		case "acTL":
+			animated = true
+		case "fcTL":
+			if len(body) != 26 {
+				return nil, errors.New("invalid APNG frame control chunk")
+			}
+			width, height := binary.BigEndian.Uint32(body[4:]), binary.BigEndian.Uint32(body[8:])
+			x, y := binary.BigEndian.Uint32(body[12:]), binary.BigEndian.Uint32(body[16:])
+			if width == 0 || height == 0 || width > maxSizeSide || height > maxSizeSide || x > maxSizeSide || y > maxSizeSide {
+				return nil, errors.New("invalid APNG frame size")
+			}
+			f := animationFrame{
+				rect:  image.Rect(int(x), int(y), int(x+width), int(y+height)),
+				blend: body[25] == 1,
+			}
+			switch body[24] {
+			case 1:
+				f.dispose = disposeBackground
+			case 2:
+				f.dispose = disposePrevious
+			}
+			frames = append(frames, f)
+			fdat = append(fdat, nil)
+		case "IDAT":
+			// The default image is the first frame only if a frame control
+			// chunk comes before it
+			seenIDAT = true
+			if len(frames) == 1 {
+				fdat[0] = append(fdat[0], body...)
+			}
+		case "fdAT":
+			if len(frames) == 0 || len(body) < 4 {
+				return nil, errors.New("APNG frame data without a frame control chunk")
+			}
+			fdat[len(frames)-1] = append(fdat[len(frames)-1], body[4:]...)
+		case "IEND":
+			rest = nil
+		default:
+			// Chunks before the image data, such as PLTE and tRNS, apply to
+			// every frame
+			if len(frames) == 0 && !seenIDAT {
+				shared = append(shared, chunk...)
+			}
+		}
+	}
+	if !animated || len(frames) < 2 || ihdr == nil {
+		return nil, nil
+	}
+
+	width, height := binary.BigEndian.Uint32(ihdr), binary.BigEndian.Uint32(ihdr[4:])
+	a := &animation{format: "png", width: int(width), height: int(height)}
+	for i, f := range frames {
+		if fdat[i] == nil {
+			return nil, fmt.Errorf("APNG frame %d has no image data", i+1)
+		}
+		header := bytes.Clone(ihdr)
+		binary.BigEndian.PutUint32(header, uint32(f.rect.Dx()))
+		binary.BigEndian.PutUint32(header[4:], uint32(f.rect.Dy()))
+		var file bytes.Buffer
+		file.WriteString(pngSignature)
+		writePNGChunk(&file, "IHDR", header)
+		file.Write(shared)
+		writePNGChunk(&file, "IDAT", fdat[i])
+		writePNGChunk(&file, "IEND", nil)
+		f.decode = func() (image.Image, error) { return png.Decode(bytes.NewReader(file.Bytes())) }
+		if i == 0 && f.dispose == disposePrevious {
+			// There is nothing to restore before the first frame
+			f.dispose = disposeBackground
+		}
+		a.frames = append(a.frames, f)
+	}
+	return a, nil
+}
+
+// writePNGChunk writes a PNG chunk with its length and checksum
+func writePNGChunk(w *bytes.Buffer, kind string, body []byte) {
+	binary.Write(w, binary.BigEndian, uint32(len(body)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	crc.Write(body)
+	w.WriteString(kind)
+	w.Write(body)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+// readWebPAnimation returns the frames of an animated WebP. Each frame is
+// decoded by wrapping its bitstream, and alpha if any, in a WebP of its own.
+func readWebPAnimation(data []byte) (*animation, error) {
+	var a *animation
+	for rest := data[12:]; len(rest) >= 8; {
+		kind, length := string(rest[:4]), binary.LittleEndian.Uint32(rest[4:])
+		if uint64(length) > uint64(len(rest)-8) {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		body := rest[8 : 8+length]
+		rest = rest[min(len(rest), 8+int(length)+int(length&1)):]
+
+		switch kind {
+		case "VP8X":
+			if len(body) < 10 {
+				return nil, errors.New("invalid WebP header")
+			}
+			if body[0]&0x02 == 0 {
+				return nil, nil
+			}
+			a = &animation{format: "webp", width: int(uint24(body[4:])) + 1, height: int(uint24(body[7:])) + 1}
+		case "ANMF":
+			if a == nil || len(body) < 16 {
+				return nil, errors.New("invalid WebP animation frame")
+			}
+			x, y := 2*int(uint24(body)), 2*int(uint24(body[3:]))
+			width, height := int(uint24(body[6:]))+1, int(uint24(body[9:]))+1
+			f := animationFrame{rect: image.Rect(x, y, x+width, y+height), blend: body[15]&0x02 == 0}
+			if body[15]&0x01 != 0 {
+				f.dispose = disposeBackground
+			}
+			frameData := body[16:]
+			f.decode = func() (image.Image, error) {
+				return webp.Decode(bytes.NewReader(webpFile(frameData, width, height)))
+			}
+			a.frames = append(a.frames, f)
+		}
+	}
+	if a == nil || len(a.frames) < 2 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// webpFile wraps the chunks of an animation frame in a still WebP file. A
+// frame with an alpha chunk needs an extended header announcing it.
+func webpFile(chunks []byte, width, height int) []byte {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	if bytes.HasPrefix(chunks, []byte("ALPH")) {
+		header := make([]byte, 10)
+		header[0] = 0x10
+		putUint24(header[4:], uint32(width-1))
+		putUint24(header[7:], uint32(height-1))
+		body.WriteString("VP8X")
+		binary.Write(&body, binary.LittleEndian, uint32(len(header)))
+		body.Write(header)
+	}
+	body.Write(chunks)
+
+	var file bytes.Buffer
+	file.WriteString("RIFF")
+	binary.Write(&file, binary.LittleEndian, uint32(body.Len()))
+	file.Write(body.Bytes())
+	return file.Bytes()
+}
+
+// uint24 reads a 24-bit little-endian number, as used in WebP headers
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+// putUint24 writes a 24-bit little-endian number
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// render draws frames 1 to n onto the canvas, clearing each as its disposal
+// says before the next, and returns the canvas as it looks during frame n
+func (a *animation) render(ctx context.Context, n int) (*image.NRGBA, error) {
+	canvas := image.NewNRGBA(image.Rect(0, 0, a.width, a.height))
+	var saved *image.NRGBA
+	for i, f := range a.frames[:n] {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		img, err := f.decode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode frame %d: %w", i+1, err)
+		}
+		if f.dispose == disposePrevious && i < n-1 {
+			saved = image.NewNRGBA(f.rect)
+			draw.Draw(saved, f.rect, canvas, f.rect.Min, draw.Src)
+		}
+		op := draw.Src
+		if f.blend {
+			op = draw.Over
+		}
+		draw.Draw(canvas, f.rect, img, img.Bounds().Min, op)
+		if i == n-1 {
+			break
+		}
+		switch f.dispose {
+		case disposeBackground:
+			draw.Draw(canvas, f.rect, image.Transparent, image.Point{}, draw.Src)
+		case disposePrevious:
+			draw.Draw(canvas, f.rect, saved, f.rect.Min, draw.Src)
+		}
+	}
+	return canvas, nil
+}
+
+// countFrames returns the number of frames of an animated GIF, PNG or WebP,
+// or 1 for any other image
+func countFrames(data []byte) (int, error) {
+	a, err := readAnimation(data)
+	if err != nil || a == nil {
+		return 1, err
+	}
+	return len(a.frames), nil
+}
+
+// decodeFrame decodes frame n, counting from 1, of an animated GIF, PNG or
+// WebP as it is shown, with the frames before it underneath. Other images
+// have only a first frame.
+func decodeFrame(ctx context.Context, data []byte, n int) (image.Image, string, error) {
+	if err := inputLimits.checkHeader(data); err != nil {
+		return nil, "", err
+	}
+	a, err := readAnimation(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if a == nil {
+		if n > 1 {
+			return nil, "", fmt.Errorf("frame %d is out of range: the image is not animated", n)
+		}
+		return decodeImageContext(ctx, bytes.NewReader(data))
+	}
+	if n > len(a.frames) {
+		return nil, "", fmt.Errorf("frame %d is out of range: the animation has %d frames", n, len(a.frames))
+	}
+	img, err := a.render(ctx, n)
+	if err != nil {
+		return nil, "", err
+	}
+	slog.Debug("Decoded animation frame", "frame", n, "frames", len(a.frames))
+	return img, a.format, nil
+}
+
+// extractsFrames reports whether o writes several frames of each input
+func (o *processOptions) extractsFrames() bool {
+	return o.Frames != "" || o.Every > 0
+}
+
+// frameOutputPath returns outPath with the frame number before the
+// extension, padded to digits, e.g. anim_r50_f007.png
+func frameOutputPath(outPath string, frame, digits int) string {
+	ext := filepath.Ext(outPath)
+	return fmt.Sprintf("%s_f%0*d%s", strings.TrimSuffix(outPath, ext), digits, frame, ext)
+}
+
+// processFrames is processFile for -frames and -every. It writes the
+// selected frames of an animated input as still images and describes the
+// first of them.
+func processFrames(ctx context.Context, o *processOptions, inputFile string, data []byte) (processResult, error) {
+	count, err := countFrames(data)
+	if err != nil {
+		return processResult{}, fmt.Errorf("failed to decode image: %w", err)
+	}
+	step := o.Every
+	if o.Frames == "all" {
+		step = 1
+	}
+
+	outPath, err := o.outputPath(inputFile)
+	if err != nil {
+		return processResult{}, fmt.Errorf("failed to generate output path: %w", err)
+	}
+	digits := max(3, len(strconv.Itoa(count)))
+
+	var first processResult
+	for n := 1; n <= count; n += step {
+		frame := *o
+		frame.Frames, frame.Every, frame.Frame = "", 0, n
+		framePath := frameOutputPath(outPath, n, digits)
+
+		var encoded bytes.Buffer
+		result, err := processImageCached(ctx, &frame, inputFile, data, framePath, &encoded)
+		if err != nil {
+			return result, fmt.Errorf("frame %d: %w", n, err)
+		}
+		if err := writeOutputFile(framePath, encoded.Bytes()); err != nil {
+			return result, fmt.Errorf("failed to write output image: %w", err)
+		}
+		if n == 1 {
+			first = result
+			first.InputBytes, first.OutputBytes = int64(len(data)), int64(encoded.Len())
+			first.InputSHA256, first.OutputSHA256 = sha256Hex(data), sha256Hex(encoded.Bytes())
+		}
+	}
+	slog.Info("Extracted frames", "frames", (count+step-1)/step, "of", count, "input", inputFile)
+	return first, nil
+}
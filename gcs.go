@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsScope is the OAuth scope requested for Cloud Storage access
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsCredentials is a Google credentials file, either a service account key
+// or the user credentials written by gcloud auth application-default login
+type gcsCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// gcsToken is an OAuth access token response
+type gcsToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// gcsStore talks to Google Cloud Storage through its JSON API, authenticating
+// with Application Default Credentials
+type gcsStore struct {
+	endpoint string
+	creds    *gcsCredentials // nil when tokens come from the metadata server
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// newGCSStore finds credentials the way Google's client libraries do:
+// GOOGLE_APPLICATION_CREDENTIALS, then gcloud's application default
+// credentials file, then the metadata server available on Cloud Run, GKE and
+// Compute Engine. STORAGE_EMULATOR_HOST selects an emulator without
+// authentication.
+func newGCSStore() (*gcsStore, error) {
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		return &gcsStore{endpoint: strings.TrimSuffix(host, "/"), token: "emulator", expiry: time.Now().AddDate(100, 0, 0)}, nil
+	}
+
+	s := &gcsStore{endpoint: "https://storage.googleapis.com"}
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			if wellKnown := filepath.Join(dir, "gcloud", "application_default_credentials.json"); fileExists(wellKnown) {
+				path = wellKnown
+			}
+		}
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Google credentials: %w", err)
+	}
+	s.creds = &gcsCredentials{}
+	if err := json.Unmarshal(data, s.creds); err != nil {
+		return nil, fmt.Errorf("failed to parse Google credentials %s: %w", path, err)
+	}
+	if s.creds.Type != "service_account" && s.creds.Type != "authorized_user" {
+		return nil, fmt.Errorf("unsupported Google credentials type %q in %s", s.creds.Type, path)
+	}
+	return s, nil
+}
+
+// fileExists reports whether path names an existing file
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// accessToken returns a valid OAuth access token, fetching a new one shortly
+// before the current one expires
+func (s *gcsStore) accessToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Until(s.expiry) > time.Minute {
+		return s.token, nil
+	}
+
+	var token gcsToken
+	var err error
+	switch {
+	case s.creds == nil:
+		token, err = fetchMetadataToken()
+	case s.creds.Type == "service_account":
+		token, err = s.creds.serviceAccountToken()
+	default:
+		token, err = postTokenRequest("https://oauth2.googleapis.com/token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {s.creds.ClientID},
+			"client_secret": {s.creds.ClientSecret},
+			"refresh_token": {s.creds.RefreshToken},
+		})
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get Google access token: %w", err)
+	}
+
+	s.token = token.AccessToken
+	s.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// fetchMetadataToken asks the metadata server for the attached service
+// account's token
+func fetchMetadataToken() (gcsToken, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return gcsToken{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := storageClient.Do(req)
+	if err != nil {
+		return gcsToken{}, fmt.Errorf("no Google credentials found and the metadata server is unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	return decodeTokenResponse(resp)
+}
+
+// serviceAccountToken exchanges a JWT signed with the service account key
+// for an access token
+func (c *gcsCredentials) serviceAccountToken() (gcsToken, error) {
+	block, _ := pem.Decode([]byte(c.PrivateKey))
+	if block == nil {
+		return gcsToken{}, errors.New("invalid service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return gcsToken{}, fmt.Errorf("invalid service account private key: %w", err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return gcsToken{}, errors.New("service account private key is not an RSA key")
+	}
+
+	tokenURI := c.TokenURI
+	if tokenURI == "" {
+		tokenURI = "https://oauth2.googleapis.com/token"
+	}
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   c.ClientEmail,
+		"scope": gcsScope,
+		"aud":   tokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return gcsToken{}, fmt.Errorf("failed to sign token request: %w", err)
+	}
+
+	return postTokenRequest(tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+}
+
+// postTokenRequest sends an OAuth token request form to tokenURI
+func postTokenRequest(tokenURI string, form url.Values) (gcsToken, error) {
+	resp, err := storageClient.PostForm(tokenURI, form)
+	if err != nil {
+		return gcsToken{}, err
+	}
+	defer resp.Body.Close()
+	return decodeTokenResponse(resp)
+}
+
+// decodeTokenResponse parses an OAuth token response
+func decodeTokenResponse(resp *http.Response) (gcsToken, error) {
+	if err := checkStorageResponse(resp); err != nil {
+		return gcsToken{}, err
+	}
+	var token gcsToken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return gcsToken{}, fmt.Errorf("failed to parse token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return gcsToken{}, errors.New("token response has no access token")
+	}
+	return token, nil
+}
+
+// do sends an authenticated request to the storage API
+func (s *gcsStore) do(method, rawURL string, body []byte, contentType string) (*http.Response, error) {
+	token, err := s.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return storageClient.Do(req)
+}
+
+func (s *gcsStore) Get(bucket, key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.endpoint+"/storage/v1/b/"+url.PathEscape(bucket)+"/o/"+url.PathEscape(key)+"?alt=media", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStorageResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *gcsStore) Put(bucket, key string, data []byte, contentType string) error {
+	query := url.Values{"uploadType": {"media"}, "name": {key}}
+	resp, err := s.do(http.MethodPost, s.endpoint+"/upload/storage/v1/b/"+url.PathEscape(bucket)+"/o?"+query.Encode(), data, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStorageResponse(resp)
+}
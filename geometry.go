@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/SvnFrs/go-transform/ops"
+)
+
+func init() {
+	ops.RegisterOperation("crop", "Crop to a region given as WxH+X+Y, e.g. 800x600+100+50, or to a square around the largest face with face. JPEGs are cropped losslessly when the offset is a multiple of 8 or 16 and nothing else re-encodes them", parseCrop)
+	ops.RegisterOperation("flip", "Mirror the image: horizontal or vertical", parseFlip)
+	ops.RegisterOperation("rotate", "Rotate the image clockwise by 90, 180 or 270 degrees", parseRotate)
+	ops.RegisterOperation("size", "Scale to WxH pixels, enlarging or shrinking. A side of 0 keeps the aspect ratio, e.g. 1920x0", parseSize)
+}
+
+// cropOp cuts the image down to a rectangle
+type cropOp struct {
+	rect image.Rectangle
+}
+
+// parseCrop parses a crop geometry of the form WxH+X+Y, where the offset
+// may be omitted, or "face"
+func parseCrop(value string) (Operation, error) {
+	if value == "face" {
+		return faceCropOp{}, nil
+	}
+	var w, h, x, y int
+	n, _ := fmt.Sscanf(value, "%dx%d+%d+%d", &w, &h, &x, &y)
+	if n != 2 && n != 4 || w < 1 || h < 1 || x < 0 || y < 0 {
+		return nil, fmt.Errorf("expected WxH+X+Y, e.g. 800x600+100+50, or face")
+	}
+	return cropOp{image.Rect(x, y, x+w, y+h)}, nil
+}
+
+func (op cropOp) check(width, height int) error {
+	if !op.rect.In(image.Rect(0, 0, width, height)) {
+		return fmt.Errorf("crop region %dx%d+%d+%d is outside the %dx%d image", op.rect.Dx(), op.rect.Dy(), op.rect.Min.X, op.rect.Min.Y, width, height)
+	}
+	return nil
+}
+
+func (op cropOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	bounds := img.Bounds()
+	if err := op.check(bounds.Dx(), bounds.Dy()); err != nil {
+		return nil, err
+	}
+	return remapPixels(img, op.rect.Dx(), op.rect.Dy(), func(x, y int) (int, int) {
+		return x + op.rect.Min.X, y + op.rect.Min.Y
+	}), nil
+}
+
+func (op cropOp) transformDCT(c *jpegCoefficients) error {
+	if err := op.check(c.width, c.height); err != nil {
+		return err
+	}
+	return c.crop(op.rect)
+}
+
+// flipOp mirrors the image horizontally or vertically
+type flipOp struct {
+	horizontal bool
+}
+
+func parseFlip(value string) (Operation, error) {
+	switch strings.ToLower(value) {
+	case "horizontal", "h":
+		return flipOp{horizontal: true}, nil
+	case "vertical", "v":
+		return flipOp{}, nil
+	}
+	return nil, fmt.Errorf("expected horizontal or vertical")
+}
+
+func (op flipOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	return remapPixels(img, width, height, func(x, y int) (int, int) {
+		if op.horizontal {
+			return width - 1 - x, y
+		}
+		return x, height - 1 - y
+	}), nil
+}
+
+func (op flipOp) transformDCT(c *jpegCoefficients) error {
+	if op.horizontal {
+		return c.flipHorizontal()
+	}
+	return c.flipVertical()
+}
+
+// rotateOp turns the image clockwise by a multiple of 90 degrees
+type rotateOp struct {
+	degrees int
+}
+
+func parseRotate(value string) (Operation, error) {
+	switch strings.TrimSuffix(value, "deg") {
+	case "90":
+		return rotateOp{90}, nil
+	case "180":
+		return rotateOp{180}, nil
+	case "270", "-90":
+		return rotateOp{270}, nil
+	}
+	return nil, fmt.Errorf("expected 90, 180 or 270")
+}
+
+func (op rotateOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	switch op.degrees {
+	case 90:
+		return remapPixels(img, height, width, func(x, y int) (int, int) { return y, height - 1 - x }), nil
+	case 180:
+		return remapPixels(img, width, height, func(x, y int) (int, int) { return width - 1 - x, height - 1 - y }), nil
+	default:
+		return remapPixels(img, height, width, func(x, y int) (int, int) { return width - 1 - y, x }), nil
+	}
+}
+
+func (op rotateOp) transformDCT(c *jpegCoefficients) error {
+	switch op.degrees {
+	case 90:
+		c.transpose()
+		return c.flipHorizontal()
+	case 180:
+		if err := c.flipHorizontal(); err != nil {
+			return err
+		}
+		return c.flipVertical()
+	default:
+		c.transpose()
+		return c.flipVertical()
+	}
+}
+
+// maxSizeSide is the largest side -size scales an image to
+const maxSizeSide = 1 << 16
+
+// sizeOp scales the image to a size in pixels
+type sizeOp struct {
+	width, height int // 0 follows the other side's aspect ratio
+}
+
+func parseSize(value string) (Operation, error) {
+	var op sizeOp
+	if n, _ := fmt.Sscanf(value, "%dx%d", &op.width, &op.height); n != 2 || op.width < 0 || op.height < 0 || op.width == 0 && op.height == 0 {
+		return nil, fmt.Errorf("expected WxH, e.g. 1920x1080 or 1920x0")
+	}
+	if op.width > maxSizeSide || op.height > maxSizeSide {
+		return nil, fmt.Errorf("sides can be at most %d pixels", maxSizeSide)
+	}
+	return op, nil
+}
+
+// isSizeOp reports whether op is a -size operation, possibly limited to a region
+func isSizeOp(op Operation) bool {
+	if r, ok := op.(regionOp); ok {
+		op = r.op
+	}
+	_, ok := op.(sizeOp)
+	return ok
+}
+
+// outputSize returns the size an image of size is scaled to
+func (op sizeOp) outputSize(size image.Point) image.Point {
+	if size.X <= 0 || size.Y <= 0 {
+		return size
+	}
+	width, height := op.width, op.height
+	if width == 0 {
+		width = max(1, int(math.Round(float64(size.X)*float64(height)/float64(size.Y))))
+	}
+	if height == 0 {
+		height = max(1, int(math.Round(float64(size.Y)*float64(width)/float64(size.X))))
+	}
+	return image.Pt(width, height)
+}
+
+// Apply enlarges through the upscale model, if one is loaded, when either
+// side grows
+func (op sizeOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return img, nil
+	}
+	size := op.outputSize(bounds.Size())
+	width, height := size.X, size.Y
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return img, nil
+	}
+	if width > bounds.Dx() || height > bounds.Dy() {
+		return enlargeImage(ctx, img, uint(width), uint(height))
+	}
+	return scaleImage(img, uint(width), uint(height)), nil
+}
+
+// orientImage turns img upright according to a TIFF or EXIF orientation,
+// from 1 (already upright) to 8
+func orientImage(img image.Image, orientation int) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	switch orientation {
+	case 2:
+		return remapPixels(img, w, h, func(x, y int) (int, int) { return w - 1 - x, y })
+	case 3:
+		return remapPixels(img, w, h, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y })
+	case 4:
+		return remapPixels(img, w, h, func(x, y int) (int, int) { return x, h - 1 - y })
+	case 5:
+		return remapPixels(img, h, w, func(x, y int) (int, int) { return y, x })
+	case 6:
+		return remapPixels(img, h, w, func(x, y int) (int, int) { return y, h - 1 - x })
+	case 7:
+		return remapPixels(img, h, w, func(x, y int) (int, int) { return w - 1 - y, h - 1 - x })
+	case 8:
+		return remapPixels(img, h, w, func(x, y int) (int, int) { return w - 1 - y, x })
+	}
+	return img
+}
+
+// remapPixels returns a width×height copy of img in which each pixel (x, y)
+// comes from the pixel of img at src(x, y), relative to its top-left corner.
+// The copy keeps img's depth and whether it is grey.
+func remapPixels(img image.Image, width, height int, src func(x, y int) (int, int)) image.Image {
+	img = convertDepth(img, imageDepth(img))
+	r := image.Rect(0, 0, width, height)
+	var dst image.Image
+	var pix, dstPix []uint8
+	var stride, dstStride, bpp int
+	switch m := img.(type) {
+	case *image.RGBA:
+		d := image.NewRGBA(r)
+		dst, pix, dstPix, stride, dstStride, bpp = d, m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], d.Pix, m.Stride, d.Stride, 4
+	case *image.NRGBA:
+		d := image.NewNRGBA(r)
+		dst, pix, dstPix, stride, dstStride, bpp = d, m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], d.Pix, m.Stride, d.Stride, 4
+	case *image.RGBA64:
+		d := image.NewRGBA64(r)
+		dst, pix, dstPix, stride, dstStride, bpp = d, m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], d.Pix, m.Stride, d.Stride, 8
+	case *image.NRGBA64:
+		d := image.NewNRGBA64(r)
+		dst, pix, dstPix, stride, dstStride, bpp = d, m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], d.Pix, m.Stride, d.Stride, 8
+	case *image.Gray:
+		d := image.NewGray(r)
+		dst, pix, dstPix, stride, dstStride, bpp = d, m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], d.Pix, m.Stride, d.Stride, 1
+	case *image.Gray16:
+		d := image.NewGray16(r)
+		dst, pix, dstPix, stride, dstStride, bpp = d, m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], d.Pix, m.Stride, d.Stride, 2
+	}
+
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := dstPix[y*dstStride:]
+			for x := range width {
+				sx, sy := src(x, y)
+				copy(row[x*bpp:(x+1)*bpp], pix[sy*stride+sx*bpp:])
+			}
+		}
+	})
+	return dst
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"log/slog"
+	"math"
+	"slices"
+)
+
+// gifDitherNames are the dithering algorithms accepted by -dither
+var gifDitherNames = []string{"none", "floyd-steinberg", "ordered", "blue-noise"}
+
+// gifOptions control how an image is reduced to a GIF palette
+type gifOptions struct {
+	Colors         int    // palette size, 2 to 256, including the transparent entry
+	Dither         string // one of gifDitherNames
+	AlphaThreshold int    // pixels with lower alpha (0-255) become transparent
+}
+
+// defaultGIFOptions are used where no GIF flags are available, such as the
+// composite and montage subcommands
+var defaultGIFOptions = gifOptions{Colors: 256, Dither: "floyd-steinberg", AlphaThreshold: 128}
+
+// validate checks the options' ranges and names
+func (g gifOptions) validate() error {
+	if g.Colors < 2 || g.Colors > 256 {
+		return fmt.Errorf("colors must be between 2 and 256")
+	}
+	if !slices.Contains(gifDitherNames, g.Dither) {
+		return fmt.Errorf("unknown dither %q: use none, floyd-steinberg, ordered or blue-noise", g.Dither)
+	}
+	if g.AlphaThreshold < 0 || g.AlphaThreshold > 255 {
+		return fmt.Errorf("alpha-threshold must be between 0 and 255")
+	}
+	return nil
+}
+
+// encodeGIF writes img as a single-frame GIF with a palette built for it.
+// Pixels less opaque than the alpha threshold share one transparent palette
+// entry; the rest are flattened onto white before quantizing.
+func encodeGIF(out io.Writer, img image.Image, g gifOptions) error {
+	bounds := img.Bounds()
+	transparent := make([]bool, bounds.Dx()*bounds.Dy())
+	anyTransparent := false
+	if !isOpaqueImage(img) {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				_, _, _, a := img.At(x, y).RGBA()
+				if int(a>>8) < g.AlphaThreshold {
+					transparent[(y-bounds.Min.Y)*bounds.Dx()+x-bounds.Min.X] = true
+					anyTransparent = true
+				}
+			}
+		}
+	}
+	opaque := flattenAlpha(img, defaultBackground)
+
+	colors := g.Colors
+	if anyTransparent {
+		colors--
+	}
+	palette := quantizeMedianCut(opaque, transparent, colors)
+	paletted := image.NewPaletted(bounds, palette)
+	switch g.Dither {
+	case "floyd-steinberg":
+		draw.FloydSteinberg.Draw(paletted, bounds, opaque, bounds.Min)
+	case "ordered", "blue-noise":
+		// Spread the threshold over about one step between palette levels
+		spread := 255 / math.Cbrt(float64(len(palette)))
+		ditherOrdered(paletted, opaque, g.Dither, spread)
+	default:
+		ditherOrdered(paletted, opaque, "", 0)
+	}
+
+	if anyTransparent {
+		paletted.Palette = append(paletted.Palette, color.NRGBA{})
+		index := uint8(len(paletted.Palette) - 1)
+		for i, t := range transparent {
+			if t {
+				paletted.Pix[(i/bounds.Dx())*paletted.Stride+i%bounds.Dx()] = index
+			}
+		}
+	}
+	slog.Info("Quantized image", "colors", len(paletted.Palette), "dither", g.Dither, "transparent", anyTransparent)
+
+	if err := gif.Encode(out, paletted, &gif.Options{NumColors: len(paletted.Palette)}); err != nil {
+		return fmt.Errorf("failed to encode GIF: %w", err)
+	}
+	return nil
+}
+
+// ditherOrdered maps each pixel of src to the nearest palette entry of dst
+// after offsetting it by the threshold of pattern, ordered or blue-noise,
+// scaled to spread. A spread of 0 maps pixels without dithering.
+func ditherOrdered(dst *image.Paletted, src image.Image, pattern string, spread float64) {
+	b := dst.Bounds()
+	cache := map[color.RGBA]uint8{}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := src.At(x, y).RGBA()
+			offset := 0.0
+			if spread > 0 {
+				offset = (ditherThreshold(pattern, x-b.Min.X, y-b.Min.Y) - 0.5) * spread
+			}
+			c := color.RGBA{ditherChannel(r, offset), ditherChannel(g, offset), ditherChannel(bl, offset), 0xff}
+			index, ok := cache[c]
+			if !ok {
+				index = uint8(dst.Palette.Index(c))
+				cache[c] = index
+			}
+			dst.Pix[(y-b.Min.Y)*dst.Stride+x-b.Min.X] = index
+		}
+	}
+}
+
+// ditherChannel returns the 8-bit value of a 16-bit channel moved by offset
+func ditherChannel(v uint32, offset float64) uint8 {
+	return uint8(min(255, max(0, math.Round(float64(v>>8)+offset))))
+}
+
+// quantizeMedianCut returns a palette of at most n colors for the pixels of
+// img not marked in skip. Images with few enough colors keep them exactly.
+// Otherwise the colors, reduced to 5 bits per channel, are split by median
+// cut and the resulting palette is refined with a few k-means passes.
+func quantizeMedianCut(img image.Image, skip []bool, n int) color.Palette {
+	b := img.Bounds()
+	const bins = 1 << 15
+	var count [bins]int
+	var sum [bins][3]int
+	exact := map[color.RGBA]bool{}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if skip[(y-b.Min.Y)*b.Dx()+x-b.Min.X] {
+				continue
+			}
+			r, g, bl, _ := img.At(x, y).RGBA()
+			r, g, bl = r>>8, g>>8, bl>>8
+			if len(exact) <= n {
+				exact[color.RGBA{uint8(r), uint8(g), uint8(bl), 0xff}] = true
+			}
+			i := int(r>>3)<<10 | int(g>>3)<<5 | int(bl>>3)
+			count[i]++
+			sum[i][0] += int(r)
+			sum[i][1] += int(g)
+			sum[i][2] += int(bl)
+		}
+	}
+	if len(exact) <= n {
+		var palette color.Palette
+		for c := range exact {
+			palette = append(palette, c)
+		}
+		if len(palette) == 0 {
+			palette = append(palette, color.RGBA{0, 0, 0, 0xff})
+		}
+		slices.SortFunc(palette, func(a, b color.Color) int {
+			return cmp.Compare(colorKey(a), colorKey(b))
+		})
+		return palette
+	}
+
+	// Each occupied bin is a point at its mean color, weighted by its count
+	type point struct {
+		c     [3]float64
+		count int
+	}
+	var points []point
+	for i := range count {
+		if count[i] > 0 {
+			w := float64(count[i])
+			points = append(points, point{[3]float64{float64(sum[i][0]) / w, float64(sum[i][1]) / w, float64(sum[i][2]) / w}, count[i]})
+		}
+	}
+
+	// Median cut: repeatedly split the box whose population times longest
+	// side is largest, at the weighted median of that side
+	boxes := [][]point{points}
+	for len(boxes) < n {
+		best, bestScore, bestAxis := -1, 0.0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			lo, hi := box[0].c, box[0].c
+			population := 0
+			for _, p := range box {
+				for a := range 3 {
+					lo[a], hi[a] = min(lo[a], p.c[a]), max(hi[a], p.c[a])
+				}
+				population += p.count
+			}
+			axis := 0
+			for a := 1; a < 3; a++ {
+				if hi[a]-lo[a] > hi[axis]-lo[axis] {
+					axis = a
+				}
+			}
+			if score := float64(population) * (hi[axis] - lo[axis]); score > bestScore {
+				best, bestScore, bestAxis = i, score, axis
+			}
+		}
+		if best < 0 {
+			break
+		}
+		box := boxes[best]
+		slices.SortFunc(box, func(p, q point) int { return cmp.Compare(p.c[bestAxis], q.c[bestAxis]) })
+		total := 0
+		for _, p := range box {
+			total += p.count
+		}
+		cut, seen := 1, box[0].count
+		for cut < len(box)-1 && seen+box[cut].count <= total/2 {
+			seen += box[cut].count
+			cut++
+		}
+		boxes[best] = box[:cut]
+		boxes = append(boxes, box[cut:])
+	}
+
+	centers := make([][3]float64, len(boxes))
+	for i, box := range boxes {
+		var total float64
+		for _, p := range box {
+			for a := range 3 {
+				centers[i][a] += p.c[a] * float64(p.count)
+			}
+			total += float64(p.count)
+		}
+		for a := range 3 {
+			centers[i][a] /= total
+		}
+	}
+
+	// k-means passes move each entry to the mean of the points nearest it
+	for range 3 {
+		sums := make([][4]float64, len(centers))
+		for _, p := range points {
+			nearest, nearestDist := 0, math.Inf(1)
+			for i, c := range centers {
+				d := (p.c[0]-c[0])*(p.c[0]-c[0]) + (p.c[1]-c[1])*(p.c[1]-c[1]) + (p.c[2]-c[2])*(p.c[2]-c[2])
+				if d < nearestDist {
+					nearest, nearestDist = i, d
+				}
+			}
+			w := float64(p.count)
+			sums[nearest][0] += p.c[0] * w
+			sums[nearest][1] += p.c[1] * w
+			sums[nearest][2] += p.c[2] * w
+			sums[nearest][3] += w
+		}
+		for i, s := range sums {
+			if s[3] > 0 {
+				centers[i] = [3]float64{s[0] / s[3], s[1] / s[3], s[2] / s[3]}
+			}
+		}
+	}
+
+	palette := make(color.Palette, len(centers))
+	for i, c := range centers {
+		palette[i] = color.RGBA{uint8(math.Round(c[0])), uint8(math.Round(c[1])), uint8(math.Round(c[2])), 0xff}
+	}
+	return palette
+}
+
+// colorKey orders opaque palette colors by their RGB value
+func colorKey(c color.Color) uint32 {
+	r, g, b, _ := c.RGBA()
+	return r>>8<<16 | g>>8<<8 | b>>8
+}
@@ -2,8 +2,13 @@ module github.com/SvnFrs/go-transform
 
 go 1.24.2
 
+require (
+	github.com/esimov/pigo v1.4.6
+	github.com/yalue/onnxruntime_go v1.36.0
+	golang.org/x/image v0.27.0
+)
+
 require (
 	github.com/mat/besticon v3.12.0+incompatible // indirect
-	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
-	golang.org/x/image v0.27.0 // indirect
+	golang.org/x/text v0.25.0 // indirect
 )
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes used by the server
+const (
+	grpcOK                = 0
+	grpcCanceled          = 1
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+)
+
+// grpcChunkSize is the size of the image chunks sent by TransformStream
+const grpcChunkSize = 1 << 20
+
+// grpcError is an error carrying a gRPC status code
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+// transformRequest is a decoded TransformRequest message
+type transformRequest struct {
+	Image    []byte
+	Filename string
+	Options  map[string]string
+}
+
+// transformResponse is a TransformResponse message
+type transformResponse struct {
+	Image  []byte
+	Format string
+	Width  int
+	Height int
+}
+
+// readProtoField reads the next field of a protobuf message, returning its
+// number, wire type, and value: the varint for type 0, the payload for
+// type 2, and nothing for the fixed-size types, which are skipped
+func readProtoField(data []byte) (field int, wireType int, varint uint64, payload, rest []byte, err error) {
+	tag, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, 0, 0, nil, nil, errors.New("invalid field tag")
+	}
+	data = data[n:]
+	field, wireType = int(tag>>3), int(tag&7)
+
+	switch wireType {
+	case 0:
+		if varint, n = binary.Uvarint(data); n <= 0 {
+			return 0, 0, 0, nil, nil, errors.New("invalid varint")
+		}
+		return field, wireType, varint, nil, data[n:], nil
+	case 1, 5:
+		size := 8
+		if wireType == 5 {
+			size = 4
+		}
+		if len(data) < size {
+			return 0, 0, 0, nil, nil, errors.New("truncated field")
+		}
+		return field, wireType, 0, nil, data[size:], nil
+	case 2:
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return 0, 0, 0, nil, nil, errors.New("invalid field length")
+		}
+		data = data[n:]
+		return field, wireType, 0, data[:length], data[length:], nil
+	default:
+		return 0, 0, 0, nil, nil, fmt.Errorf("unsupported wire type %d", wireType)
+	}
+}
+
+// decodeTransformRequest parses a TransformRequest message
+func decodeTransformRequest(data []byte) (transformRequest, error) {
+	req := transformRequest{Options: map[string]string{}}
+	for len(data) > 0 {
+		field, wireType, _, payload, rest, err := readProtoField(data)
+		if err != nil {
+			return req, err
+		}
+		data = rest
+		if wireType != 2 {
+			continue
+		}
+
+		switch field {
+		case 1:
+			req.Image = payload
+		case 2:
+			req.Filename = string(payload)
+		case 3:
+			var key, value string
+			for len(payload) > 0 {
+				entryField, entryType, _, entryPayload, entryRest, err := readProtoField(payload)
+				if err != nil {
+					return req, err
+				}
+				payload = entryRest
+				if entryType == 2 && entryField == 1 {
+					key = string(entryPayload)
+				} else if entryType == 2 && entryField == 2 {
+					value = string(entryPayload)
+				}
+			}
+			req.Options[key] = value
+		}
+	}
+	return req, nil
+}
+
+// appendProtoBytes appends a length-delimited field
+func appendProtoBytes(buf []byte, field int, value []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field)<<3|2)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// appendProtoVarint appends a varint field
+func appendProtoVarint(buf []byte, field int, value uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field)<<3)
+	return binary.AppendUvarint(buf, value)
+}
+
+// encode serializes the response, leaving out empty fields as proto3 does
+func (r transformResponse) encode() []byte {
+	var buf []byte
+	if len(r.Image) > 0 {
+		buf = appendProtoBytes(buf, 1, r.Image)
+	}
+	if r.Format != "" {
+		buf = appendProtoBytes(buf, 2, []byte(r.Format))
+	}
+	if r.Width != 0 {
+		buf = appendProtoVarint(buf, 3, uint64(r.Width))
+	}
+	if r.Height != 0 {
+		buf = appendProtoVarint(buf, 4, uint64(r.Height))
+	}
+	return buf
+}
+
+// readGRPCMessage reads one length-prefixed gRPC message of at most maxSize
+// bytes. It returns io.EOF when the stream ends between messages.
+func readGRPCMessage(r io.Reader, maxSize int64) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, &grpcError{grpcInternal, "truncated message"}
+		}
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	length := int64(binary.BigEndian.Uint32(header[1:]))
+	if length > maxSize {
+		return nil, &grpcError{grpcResourceExhausted, fmt.Sprintf("message of %d bytes exceeds the limit of %d bytes", length, maxSize)}
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, &grpcError{grpcInternal, "truncated message"}
+	}
+	return msg, nil
+}
+
+// writeGRPCMessage writes one length-prefixed gRPC message and flushes it
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	http.NewResponseController(w).Flush()
+	return nil
+}
+
+// grpcHandler serves the Transformer service defined in transformer.proto
+// over HTTP/2
+type grpcHandler struct {
+	base       processOptions
+	maxMessage int64
+	limits     *serverLimits
+}
+
+func (h *grpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+
+	var err error
+	switch r.URL.Path {
+	case "/gotransform.v1.Transformer/Transform":
+		err = h.transform(w, r, false)
+	case "/gotransform.v1.Transformer/TransformStream":
+		err = h.transform(w, r, true)
+	default:
+		err = &grpcError{grpcUnimplemented, "unknown method " + r.URL.Path}
+	}
+
+	code, msg := grpcOK, ""
+	if err != nil {
+		var gerr *grpcError
+		if errors.As(err, &gerr) {
+			code, msg = gerr.code, gerr.msg
+		} else {
+			code, msg = grpcInternal, err.Error()
+		}
+		slog.Warn("gRPC request failed", "method", r.URL.Path, "code", code, "error", msg)
+	}
+	metrics.request("grpc", code)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEscape(msg))
+}
+
+// transform handles both RPCs: a single request and response, or a stream of
+// request chunks answered by a stream of response chunks
+func (h *grpcHandler) transform(w http.ResponseWriter, r *http.Request, stream bool) error {
+	// Wait for a slot before reading the image, so that queued requests
+	// don't hold their images in memory
+	if !h.limits.allow(r) {
+		return &grpcError{grpcResourceExhausted, errRateLimited.Error()}
+	}
+	release, err := h.limits.acquire(r.Context())
+	if errors.Is(err, errOverloaded) {
+		return &grpcError{grpcUnavailable, err.Error()}
+	}
+	if err != nil {
+		return &grpcError{grpcCanceled, err.Error()}
+	}
+	defer release()
+
+	var req transformRequest
+	for i := 0; ; i++ {
+		msg, err := readGRPCMessage(r.Body, h.maxMessage)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		part, err := decodeTransformRequest(msg)
+		if err != nil {
+			return &grpcError{grpcInvalidArgument, "invalid request: " + err.Error()}
+		}
+
+		if i == 0 {
+			req = part
+			continue
+		}
+		if !stream {
+			return &grpcError{grpcInvalidArgument, "Transform takes a single request message"}
+		}
+		if int64(len(req.Image)+len(part.Image)) > h.maxMessage {
+			return &grpcError{grpcResourceExhausted, fmt.Sprintf("image exceeds the limit of %d bytes", h.maxMessage)}
+		}
+		req.Image = append(req.Image, part.Image...)
+	}
+	if len(req.Image) == 0 {
+		return &grpcError{grpcInvalidArgument, "request has no image"}
+	}
+
+	opts, err := parseRequestOptions(h.base, req.Options)
+	if err != nil {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	// The request's context ends when the client cancels or disconnects
+	ctx, cancel := opts.jobContext(r.Context())
+	defer cancel()
+
+	metrics.bytesIn.Add(int64(len(req.Image)))
+	done := metrics.startTransform()
+	var encoded bytes.Buffer
+	result, err := processImageCached(ctx, opts, req.Filename, req.Image, "grpc response", &encoded)
+	done(result.Format, err)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &grpcError{grpcDeadlineExceeded, err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &grpcError{grpcCanceled, err.Error()}
+	case err != nil:
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	metrics.bytesOut.Add(int64(encoded.Len()))
+	resp := transformResponse{Format: result.Format, Width: result.Width, Height: result.Height}
+	if !stream {
+		resp.Image = encoded.Bytes()
+		return writeGRPCMessage(w, resp.encode())
+	}
+	for data := encoded.Bytes(); ; {
+		resp.Image = data[:min(len(data), grpcChunkSize)]
+		if err := writeGRPCMessage(w, resp.encode()); err != nil {
+			return err
+		}
+		data = data[len(resp.Image):]
+		if len(data) == 0 {
+			return nil
+		}
+		resp = transformResponse{}
+	}
+}
+
+// grpcEscape percent-encodes a status message as the gRPC protocol requires
+func grpcEscape(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
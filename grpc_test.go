@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// grpcFrame prefixes msg with the gRPC message header
+func grpcFrame(msg []byte) []byte {
+	frame := []byte{0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// encodeTransformRequest serializes a TransformRequest as a client would
+func encodeTransformRequest(img []byte, filename string, options map[string]string) []byte {
+	var buf []byte
+	if len(img) > 0 {
+		buf = appendProtoBytes(buf, 1, img)
+	}
+	if filename != "" {
+		buf = appendProtoBytes(buf, 2, []byte(filename))
+	}
+	for key, value := range options {
+		entry := appendProtoBytes(appendProtoBytes(nil, 1, []byte(key)), 2, []byte(value))
+		buf = appendProtoBytes(buf, 3, entry)
+	}
+	return buf
+}
+
+// decodeTransformResponse parses a TransformResponse message
+func decodeTransformResponse(t *testing.T, data []byte) transformResponse {
+	t.Helper()
+	var resp transformResponse
+	for len(data) > 0 {
+		field, _, varint, payload, rest, err := readProtoField(data)
+		if err != nil {
+			t.Fatalf("invalid response: %v", err)
+		}
+		data = rest
+		switch field {
+		case 1:
+			resp.Image = payload
+		case 2:
+			resp.Format = string(payload)
+		case 3:
+			resp.Width = int(varint)
+		case 4:
+			resp.Height = int(varint)
+		}
+	}
+	return resp
+}
+
+func TestDecodeTransformRequest(t *testing.T) {
+	msg := encodeTransformRequest([]byte("image"), "a.png", map[string]string{"resize": "50"})
+	// Unknown fields of every wire type are skipped
+	msg = appendProtoVarint(msg, 9, 300)
+	msg = append(msg, 10<<3|1, 1, 2, 3, 4, 5, 6, 7, 8)
+	msg = append(msg, 11<<3|5, 1, 2, 3, 4)
+	msg = appendProtoBytes(msg, 12, []byte("unknown"))
+	// A map entry without a value maps its key to the empty string
+	msg = appendProtoBytes(msg, 3, appendProtoBytes(nil, 1, []byte("optimize")))
+
+	req, err := decodeTransformRequest(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(req.Image) != "image" || req.Filename != "a.png" {
+		t.Errorf("got image %q and filename %q", req.Image, req.Filename)
+	}
+	if len(req.Options) != 2 || req.Options["resize"] != "50" || req.Options["optimize"] != "" {
+		t.Errorf("got options %v", req.Options)
+	}
+
+	for _, bad := range [][]byte{
+		{0x80},                 // tag without its last byte
+		{1<<3 | 0, 0x80},       // truncated varint
+		{1<<3 | 1, 1, 2},       // truncated fixed64
+		{1<<3 | 2, 5, 'a'},     // length past the end
+		{1<<3 | 3},             // group wire type
+		{3<<3 | 2, 2, 0x80, 0}, // bad map entry
+	} {
+		if _, err := decodeTransformRequest(bad); err == nil {
+			t.Errorf("%x decoded without an error", bad)
+		}
+	}
+}
+
+func TestTransformResponseEncode(t *testing.T) {
+	got := transformResponse{Image: []byte{1, 2}, Format: "png", Width: 300, Height: 1}.encode()
+	want := []byte{1<<3 | 2, 2, 1, 2, 2<<3 | 2, 3, 'p', 'n', 'g', 3 << 3, 0xac, 0x02, 4 << 3, 1}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	if got := (transformResponse{}).encode(); len(got) != 0 {
+		t.Errorf("empty response encoded as %x", got)
+	}
+}
+
+func TestReadGRPCMessage(t *testing.T) {
+	r := bytes.NewReader(append(grpcFrame([]byte("first")), grpcFrame(nil)...))
+	for _, want := range []string{"first", ""} {
+		msg, err := readGRPCMessage(r, 16)
+		if err != nil || string(msg) != want {
+			t.Fatalf("got %q, %v, want %q", msg, err, want)
+		}
+	}
+	if _, err := readGRPCMessage(r, 16); err != io.EOF {
+		t.Fatalf("at the end of the stream got %v, want io.EOF", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		code int
+	}{
+		{"truncated header", []byte{0, 0, 0}, grpcInternal},
+		{"truncated message", grpcFrame([]byte("message"))[:8], grpcInternal},
+		{"compressed", append([]byte{1}, grpcFrame([]byte("x"))[1:]...), grpcUnimplemented},
+		{"too large", grpcFrame(make([]byte, 17)), grpcResourceExhausted},
+	}
+	for _, tt := range tests {
+		_, err := readGRPCMessage(bytes.NewReader(tt.data), 16)
+		var gerr *grpcError
+		if !errors.As(err, &gerr) || gerr.code != tt.code {
+			t.Errorf("%s: got %v, want code %d", tt.name, err, tt.code)
+		}
+	}
+}
+
+func TestGRPCEscape(t *testing.T) {
+	if got, want := grpcEscape("bad 100% \"größe\"\n"), "bad 100%25 \"gr%C3%B6%C3%9Fe\"%0A"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// callGRPC posts the framed messages to method and returns the decoded
+// response messages and the status code from the trailers
+func callGRPC(t *testing.T, h http.Handler, method string, msgs ...[]byte) ([]transformResponse, string) {
+	t.Helper()
+	var body []byte
+	for _, msg := range msgs {
+		body = append(body, grpcFrame(msg)...)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/gotransform.v1.Transformer/"+method, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/grpc")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	res := rec.Result()
+	var resps []transformResponse
+	for {
+		msg, err := readGRPCMessage(res.Body, 1<<30)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resps = append(resps, decodeTransformResponse(t, msg))
+	}
+	return resps, res.Trailer.Get("Grpc-Status")
+}
+
+func TestGRPCTransform(t *testing.T) {
+	var src bytes.Buffer
+	if err := png.Encode(&src, image.NewGray(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatal(err)
+	}
+	h := &grpcHandler{base: processOptions{Filter: "lanczos"}, maxMessage: 1 << 20}
+	options := map[string]string{"resize": "50", "format": "png"}
+
+	resps, status := callGRPC(t, h, "Transform", encodeTransformRequest(src.Bytes(), "a.png", options))
+	if status != "0" || len(resps) != 1 {
+		t.Fatalf("Transform gave status %q and %d messages, want 0 and 1", status, len(resps))
+	}
+	checkResponse := func(resp transformResponse, data []byte) {
+		t.Helper()
+		if resp.Format != "png" || resp.Width != 20 || resp.Height != 10 {
+			t.Errorf("got %s %dx%d, want png 20x10", resp.Format, resp.Width, resp.Height)
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size != image.Pt(20, 10) {
+			t.Errorf("image is %v, want 20x10", size)
+		}
+	}
+	checkResponse(resps[0], resps[0].Image)
+
+	// The stream concatenates the image chunks of every request message
+	data := src.Bytes()
+	resps, status = callGRPC(t, h, "TransformStream",
+		encodeTransformRequest(data[:10], "a.png", options),
+		encodeTransformRequest(data[10:], "", nil))
+	if status != "0" || len(resps) == 0 {
+		t.Fatalf("TransformStream gave status %q and %d messages", status, len(resps))
+	}
+	var output []byte
+	for _, resp := range resps {
+		output = append(output, resp.Image...)
+	}
+	checkResponse(resps[0], output)
+
+	// Transform takes one message, and chunks may not add up past the limit
+	_, status = callGRPC(t, h, "Transform", encodeTransformRequest(data[:10], "a.png", nil), encodeTransformRequest(data[10:], "", nil))
+	if status != "3" {
+		t.Errorf("Transform with two messages gave status %q, want 3", status)
+	}
+	small := &grpcHandler{base: h.base, maxMessage: int64(len(data)) - 1}
+	_, status = callGRPC(t, small, "TransformStream", encodeTransformRequest(data[:10], "a.png", nil), encodeTransformRequest(data[10:], "", nil))
+	if status != "8" {
+		t.Errorf("TransformStream past the size limit gave status %q, want 8", status)
+	}
+	_, status = callGRPC(t, h, "Transform", encodeTransformRequest(data, "a.png", map[string]string{"nope": "1"}))
+	if status != "3" {
+		t.Errorf("an unknown option gave status %q, want 3", status)
+	}
+	_, status = callGRPC(t, h, "Resize")
+	if status != "12" {
+		t.Errorf("an unknown method gave status %q, want 12", status)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// HDR input, in OpenEXR or Radiance files, holds linear light without an
+// upper bound. It is tone-mapped to 16-bit sRGB as it is decoded, so the
+// rest of the pipeline sees an ordinary image.
+
+// toneMapOperators are the operators accepted by -tone-map
+var toneMapOperators = []string{"reinhard", "aces"}
+
+// hdrToneMap and hdrExposure are the tone mapping operator and the exposure
+// adjustment in stops applied to HDR input
+var (
+	hdrToneMap  = "reinhard"
+	hdrExposure = 0.0
+)
+
+// hdrExtensions are the extensions of HDR inputs, which are written as PNG
+// unless another format is requested
+var hdrExtensions = []string{".exr", ".hdr", ".pic"}
+
+// toneMap maps a linear HDR color to linear values between 0 and 1 with the
+// active operator. reinhard compresses luminance with L/(1+L), keeping hues;
+// aces applies Narkowicz's fit of the ACES filmic curve to each channel,
+// which rolls off highlights towards white.
+func toneMap(r, g, b float64) (float64, float64, float64) {
+	scale := math.Exp2(hdrExposure)
+	r, g, b = finite(r)*scale, finite(g)*scale, finite(b)*scale
+	switch hdrToneMap {
+	case "aces":
+		aces := func(x float64) float64 {
+			x *= 0.6
+			return x * (2.51*x + 0.03) / (x*(2.43*x+0.59) + 0.14)
+		}
+		return aces(r), aces(g), aces(b)
+	default:
+		l := 0.2126*r + 0.7152*g + 0.0722*b
+		s := 1 / (1 + l)
+		return r * s, g * s, b * s
+	}
+}
+
+// finite returns v, or 0 for negative, infinite and NaN values
+func finite(v float64) float64 {
+	if !(v > 0) || math.IsInf(v, 1) {
+		return 0
+	}
+	return v
+}
+
+// toneMapImage turns linear HDR pixels, four straight RGBA values per pixel,
+// into a 16-bit sRGB image. Images without color or alpha become Gray16.
+func toneMapImage(width, height int, pix []float32, gray, alpha bool) image.Image {
+	encode := func(v float64) uint16 {
+		return uint16(srgbCurve{}.encode(clamp01(v))*65535 + 0.5)
+	}
+	if gray && !alpha {
+		img := image.NewGray16(image.Rect(0, 0, width, height))
+		parallelRows(height, func(y0, y1 int) {
+			for i := y0 * width; i < y1*width; i++ {
+				v, _, _ := toneMap(float64(pix[4*i]), float64(pix[4*i]), float64(pix[4*i]))
+				img.Pix[2*i], img.Pix[2*i+1] = uint8(encode(v)>>8), uint8(encode(v))
+			}
+		})
+		return img
+	}
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	parallelRows(height, func(y0, y1 int) {
+		for i := y0 * width; i < y1*width; i++ {
+			p := pix[4*i : 4*i+4]
+			r, g, b := toneMap(float64(p[0]), float64(p[1]), float64(p[2]))
+			a := uint16(clamp01(float64(p[3]))*65535 + 0.5)
+			if !alpha {
+				a = 0xffff
+			}
+			for c, v := range [4]uint16{encode(r), encode(g), encode(b), a} {
+				img.Pix[8*i+2*c], img.Pix[8*i+2*c+1] = uint8(v>>8), uint8(v)
+			}
+		}
+	})
+	return img
+}
+
+// hdrMaxPixels guards against absurd Radiance and OpenEXR headers before
+// their pixels are allocated
+const hdrMaxPixels = 400_000_000
+
+// radianceHeader is the part of a Radiance header needed to read its pixels
+type radianceHeader struct {
+	width, height int
+	bottomUp      bool
+	exposure      float64 // product of the EXPOSURE lines, by which pixels were scaled
+}
+
+// readRadianceHeader reads the header of a Radiance RGBE file up to and
+// including its resolution line
+func readRadianceHeader(br *bufio.Reader) (radianceHeader, error) {
+	h := radianceHeader{exposure: 1}
+	first := true
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return h, fmt.Errorf("truncated Radiance header: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if first {
+			if line != "#?RADIANCE" && line != "#?RGBE" {
+				return h, errors.New("not a Radiance file")
+			}
+			first = false
+			continue
+		}
+		if line == "" {
+			break
+		}
+		if format, ok := strings.CutPrefix(line, "FORMAT="); ok && format != "32-bit_rle_rgbe" {
+			return h, fmt.Errorf("unsupported Radiance pixel format %q: only 32-bit_rle_rgbe is supported", format)
+		}
+		if value, ok := strings.CutPrefix(line, "EXPOSURE="); ok {
+			if e, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && e > 0 {
+				h.exposure *= e
+			}
+		}
+	}
+
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return h, fmt.Errorf("missing Radiance resolution: %w", err)
+	}
+	var yAxis, xAxis string
+	if _, err := fmt.Sscanf(line, "%s %d %s %d", &yAxis, &h.height, &xAxis, &h.width); err != nil || xAxis != "+X" || yAxis != "-Y" && yAxis != "+Y" {
+		return h, fmt.Errorf("unsupported Radiance resolution %q: expected -Y height +X width", strings.TrimSpace(line))
+	}
+	// Compare without multiplying, which could overflow
+	if h.width < 1 || h.height < 1 || h.height > hdrMaxPixels/h.width {
+		return h, fmt.Errorf("invalid Radiance size %dx%d", h.width, h.height)
+	}
+	h.bottomUp = yAxis == "+Y"
+	return h, nil
+}
+
+// readRadianceScanline reads one scanline of RGBE pixels into line, which
+// holds four bytes per pixel. Scanlines are stored flat, with the old run
+// length encoding of repeated pixels, or with each channel run length
+// encoded separately.
+func readRadianceScanline(br *bufio.Reader, line []byte) error {
+	width := len(line) / 4
+	var start [4]byte
+	if _, err := io.ReadFull(br, start[:]); err != nil {
+		return err
+	}
+	if width < 8 || width > 0x7fff || start[0] != 2 || start[1] != 2 || start[2]&0x80 != 0 {
+		// Flat pixels, where 1,1,1,n repeats the previous pixel
+		copy(line, start[:])
+		shift := 0
+		for i := 4; i < len(line); {
+			if _, err := io.ReadFull(br, line[i:i+4]); err != nil {
+				return err
+			}
+			if line[i] == 1 && line[i+1] == 1 && line[i+2] == 1 {
+				count := int(line[i+3]) << shift
+				if i+4*count > len(line) {
+					return errors.New("Radiance run overflows the scanline")
+				}
+				for n := 0; n < count; n++ {
+					copy(line[i+4*n:i+4*n+4], line[i-4:i])
+				}
+				i += 4 * count
+				shift += 8
+				continue
+			}
+			shift = 0
+			i += 4
+		}
+		return nil
+	}
+	if int(start[2])<<8|int(start[3]) != width {
+		return errors.New("Radiance scanline width mismatch")
+	}
+	for c := 0; c < 4; c++ {
+		for x := 0; x < width; {
+			count, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			if count > 128 {
+				n := int(count - 128)
+				v, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if x+n > width {
+					return errors.New("Radiance run overflows the scanline")
+				}
+				for ; n > 0; n-- {
+					line[4*x+c] = v
+					x++
+				}
+				continue
+			}
+			if count == 0 || x+int(count) > width {
+				return errors.New("invalid Radiance run length")
+			}
+			for n := int(count); n > 0; n-- {
+				v, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				line[4*x+c] = v
+				x++
+			}
+		}
+	}
+	return nil
+}
+
+// decodeRadiance decodes a Radiance RGBE (.hdr) image and tone-maps it
+func decodeRadiance(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readRadianceHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	// Pixels are grown as scanlines are read, as run length encoding leaves
+	// the size of the data unknown until then
+	var pix []float32
+	line := make([]byte, 4*h.width)
+	for y := 0; y < h.height; y++ {
+		if err := readRadianceScanline(br, line); err != nil {
+			return nil, fmt.Errorf("failed to read Radiance scanline %d: %w", y, err)
+		}
+		pix = slices.Grow(pix, 4*h.width)[:len(pix)+4*h.width]
+		row := pix[len(pix)-4*h.width:]
+		for x := 0; x < h.width; x++ {
+			rgbe := line[4*x : 4*x+4]
+			p := row[4*x : 4*x+4]
+			clear(p)
+			p[3] = 1
+			if rgbe[3] == 0 {
+				continue
+			}
+			f := math.Ldexp(1, int(rgbe[3])-136) / h.exposure
+			p[0], p[1], p[2] = float32((float64(rgbe[0])+0.5)*f), float32((float64(rgbe[1])+0.5)*f), float32((float64(rgbe[2])+0.5)*f)
+		}
+	}
+	if h.bottomUp {
+		for top, bottom := 0, h.height-1; top < bottom; top, bottom = top+1, bottom-1 {
+			a, b := pix[4*top*h.width:4*(top+1)*h.width], pix[4*bottom*h.width:4*(bottom+1)*h.width]
+			for i := range a {
+				a[i], b[i] = b[i], a[i]
+			}
+		}
+	}
+	return toneMapImage(h.width, h.height, pix, false, false), nil
+}
+
+func decodeRadianceConfig(r io.Reader) (image.Config, error) {
+	h, err := readRadianceHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBA64Model, Width: h.width, Height: h.height}, nil
+}
+
+// errAVIF explains that AVIF input, HDR or not, cannot be decoded
+var errAVIF = errors.New("AVIF input is not supported, as no AV1 decoder is available; convert it to EXR, PNG or JPEG first")
+
+func init() {
+	image.RegisterFormat("hdr", "#?RADIANCE", decodeRadiance, decodeRadianceConfig)
+	image.RegisterFormat("hdr", "#?RGBE", decodeRadiance, decodeRadianceConfig)
+	for _, brand := range []string{"avif", "avis"} {
+		image.RegisterFormat("avif", "????ftyp"+brand,
+			func(io.Reader) (image.Image, error) { return nil, errAVIF },
+			func(io.Reader) (image.Config, error) { return image.Config{}, errAVIF })
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeRadianceRejectsBadHeaders(t *testing.T) {
+	const header = "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n"
+	tests := []struct {
+		name, data string
+	}{
+		{"too many pixels", header + "-Y 60000 +X 60000\n"},
+		{"overflowing dimensions", header + "-Y 70368744177664 +X 65536\n"},
+		{"truncated data", header + "-Y 20000 +X 20000\n\x80\x80\x80\x81"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeRadiance(strings.NewReader(tt.data)); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestDecodeRadiance(t *testing.T) {
+	// Two flat scanlines, stored bottom up: black, then a repeated gray
+	data := "#?RADIANCE\n\n+Y 2 +X 2\n\x00\x00\x00\x00\x00\x00\x00\x00\x80\x80\x80\x81\x01\x01\x01\x01"
+	img, err := decodeRadiance(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 2 {
+		t.Fatalf("got %v, want 2x2", b)
+	}
+	for x := range 2 {
+		if r, _, _, _ := img.At(x, 0).RGBA(); r == 0 {
+			t.Errorf("top pixel %d is black, want gray", x)
+		}
+		if r, _, _, _ := img.At(x, 1).RGBA(); r != 0 {
+			t.Errorf("bottom pixel %d is %#x, want black", x, r)
+		}
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ICC colour management for matrix/TRC RGB profiles (sRGB, Adobe RGB,
+// ProPhoto, Display P3, ...). LUT-based profiles are not supported.
+
+var iccJPEGMarker = []byte("ICC_PROFILE\x00")
+
+// srgbD50 holds the sRGB primaries adapted to the D50 profile connection space
+var srgbD50 = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// toneCurve converts between encoded and linear channel values in [0,1]
+type toneCurve interface {
+	linearize(v float64) float64
+	encode(v float64) float64
+}
+
+// gammaCurve is a pure power curve
+type gammaCurve float64
+
+func (g gammaCurve) linearize(v float64) float64 { return math.Pow(v, float64(g)) }
+func (g gammaCurve) encode(v float64) float64    { return math.Pow(v, 1/float64(g)) }
+
+// srgbCurve is the sRGB transfer function
+type srgbCurve struct{}
+
+func (srgbCurve) linearize(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func (srgbCurve) encode(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// sampledCurve is a tone curve defined by samples over [0,1]
+type sampledCurve []float64
+
+func (s sampledCurve) linearize(v float64) float64 {
+	pos := clamp01(v) * float64(len(s)-1)
+	i := int(pos)
+	if i >= len(s)-1 {
+		return s[len(s)-1]
+	}
+	frac := pos - float64(i)
+	return s[i]*(1-frac) + s[i+1]*frac
+}
+
+func (s sampledCurve) encode(v float64) float64 {
+	// The curve is monotonic, so invert it by searching the samples
+	i := sort.SearchFloat64s(s, v)
+	if i == 0 {
+		return 0
+	}
+	if i >= len(s) {
+		return 1
+	}
+	lo, hi := s[i-1], s[i]
+	frac := 0.0
+	if hi > lo {
+		frac = (v - lo) / (hi - lo)
+	}
+	return (float64(i-1) + frac) / float64(len(s)-1)
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// iccProfile is a parsed matrix/TRC RGB profile
+type iccProfile struct {
+	matrix [3][3]float64 // linear RGB to PCS XYZ (D50)
+	curves [3]toneCurve
+	raw    []byte
+}
+
+// readICCTags returns the tag table of an ICC profile
+func readICCTags(data []byte) (map[string][]byte, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("not an ICC profile")
+	}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	if 132+12*count > len(data) {
+		return nil, errors.New("truncated ICC tag table")
+	}
+
+	tags := make(map[string][]byte, count)
+	for i := 0; i < count; i++ {
+		entry := data[132+12*i:]
+		sig := string(entry[:4])
+		off := int(binary.BigEndian.Uint32(entry[4:]))
+		size := int(binary.BigEndian.Uint32(entry[8:]))
+		if off < 0 || size < 0 || off+size > len(data) {
+			return nil, fmt.Errorf("ICC tag %q out of range", sig)
+		}
+		tags[sig] = data[off : off+size]
+	}
+	return tags, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseICCCurve parses a curv or para tag
+func parseICCCurve(tag []byte) (toneCurve, error) {
+	if len(tag) < 12 {
+		return nil, errors.New("truncated ICC curve")
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case count == 0:
+			return gammaCurve(1), nil
+		case count == 1 && len(tag) >= 14:
+			return gammaCurve(float64(binary.BigEndian.Uint16(tag[12:])) / 256), nil
+		case len(tag) >= 12+2*count:
+			samples := make(sampledCurve, count)
+			for i := range samples {
+				samples[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+			}
+			return samples, nil
+		}
+
+	case "para":
+		fn := binary.BigEndian.Uint16(tag[8:])
+		nParams := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}[fn]
+		if nParams == 0 || len(tag) < 12+4*nParams {
+			return nil, fmt.Errorf("unsupported ICC parametric curve type %d", fn)
+		}
+		// g, a, b, c, d, e, f as defined by ICC.1:2010 table 65
+		p := [7]float64{1, 1, 0, 0, 0, 0, 0}
+		for i := 0; i < nParams; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		eval := func(x float64) float64 {
+			switch fn {
+			case 0:
+				return math.Pow(x, g)
+			case 1:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			case 2:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			case 3:
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			default:
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			}
+		}
+		samples := make(sampledCurve, 4096)
+		for i := range samples {
+			samples[i] = clamp01(eval(float64(i) / 4095))
+		}
+		return samples, nil
+	}
+
+	return nil, fmt.Errorf("unsupported ICC curve type %q", tag[:4])
+}
+
+// parseICCProfile parses a matrix/TRC RGB ICC profile
+func parseICCProfile(data []byte) (*iccProfile, error) {
+	tags, err := readICCTags(data)
+	if err != nil {
+		return nil, err
+	}
+	if string(data[16:20]) != "RGB " {
+		return nil, fmt.Errorf("unsupported ICC color space %q: only RGB profiles can be converted", data[16:20])
+	}
+
+	p := &iccProfile{raw: data}
+	for col, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag := tags[sig]
+		if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+			return nil, errors.New("ICC profile has no RGB matrix (LUT-based profiles are not supported)")
+		}
+		for row := 0; row < 3; row++ {
+			p.matrix[row][col] = s15Fixed16(tag[8+4*row:])
+		}
+	}
+	for i, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		tag, ok := tags[sig]
+		if !ok {
+			return nil, fmt.Errorf("ICC profile is missing %s", sig)
+		}
+		if p.curves[i], err = parseICCCurve(tag); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// profileDescription returns the ASCII description of a profile, if any
+func profileDescription(data []byte) string {
+	tags, err := readICCTags(data)
+	if err != nil {
+		return ""
+	}
+	desc := tags["desc"]
+	switch {
+	case len(desc) > 12 && string(desc[:4]) == "desc":
+		n := int(binary.BigEndian.Uint32(desc[8:]))
+		if 12+n <= len(desc) {
+			return string(bytes.TrimRight(desc[12:12+n], "\x00"))
+		}
+	case len(desc) > 28 && string(desc[:4]) == "mluc":
+		// Use the first record, stored as UTF-16BE
+		size := int(binary.BigEndian.Uint32(desc[20:]))
+		off := int(binary.BigEndian.Uint32(desc[24:]))
+		if off+size <= len(desc) {
+			var runes []rune
+			for i := off; i+1 < off+size; i += 2 {
+				runes = append(runes, rune(binary.BigEndian.Uint16(desc[i:])))
+			}
+			return string(runes)
+		}
+	}
+	return ""
+}
+
+func invert3x3(m [3][3]float64) ([3][3]float64, error) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < 1e-12 {
+		return m, errors.New("ICC matrix is not invertible")
+	}
+	var inv [3][3]float64
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			// Cofactor of (c, r) for the adjugate
+			r1, r2 := (c+1)%3, (c+2)%3
+			c1, c2 := (r+1)%3, (r+2)%3
+			inv[r][c] = (m[r1][c1]*m[r2][c2] - m[r1][c2]*m[r2][c1]) / det
+		}
+	}
+	return inv, nil
+}
+
+func mul3x3(a, b [3][3]float64) [3][3]float64 {
+	var out [3][3]float64
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			for k := 0; k < 3; k++ {
+				out[r][c] += a[r][k] * b[k][c]
+			}
+		}
+	}
+	return out
+}
+
+// convertICC converts img from the src profile to the dst profile. 16-bit
+// images are converted at full precision.
+func convertICC(img image.Image, src, dst *iccProfile) (image.Image, error) {
+	toDst, err := invert3x3(dst.matrix)
+	if err != nil {
+		return nil, err
+	}
+	m := mul3x3(toDst, src.matrix)
+
+	// Cache the source linearisation per input level
+	levels := 256
+	if imageDepth(img) == 16 {
+		levels = 65536
+	}
+	var lin [3][]float64
+	for c := 0; c < 3; c++ {
+		lin[c] = make([]float64, levels)
+		for v := range lin[c] {
+			lin[c][v] = src.curves[c].linearize(float64(v) / float64(levels-1))
+		}
+	}
+
+	bounds := img.Bounds()
+	out := image.NewNRGBA64(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	shift := 8
+	if levels == 65536 {
+		shift = 0
+	}
+	parallelRows(bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				c := color.NRGBA64Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA64)
+				l := [3]float64{lin[0][c.R>>shift], lin[1][c.G>>shift], lin[2][c.B>>shift]}
+				var rgb [3]uint16
+				for i := 0; i < 3; i++ {
+					v := m[i][0]*l[0] + m[i][1]*l[1] + m[i][2]*l[2]
+					rgb[i] = uint16(clamp01(dst.curves[i].encode(clamp01(v)))*65535 + 0.5)
+				}
+				out.SetNRGBA64(x, y, color.NRGBA64{rgb[0], rgb[1], rgb[2], c.A})
+			}
+		}
+	})
+
+	if levels == 256 {
+		return convertDepth(out, 8), nil
+	}
+	return out, nil
+}
+
+// buildSRGBProfile returns a minimal ICC v2 sRGB display profile
+func buildSRGBProfile() []byte {
+	xyzTag := func(x, y, z float64) []byte {
+		b := make([]byte, 20)
+		copy(b, "XYZ ")
+		for i, v := range []float64{x, y, z} {
+			binary.BigEndian.PutUint32(b[8+4*i:], uint32(int32(math.Round(v*65536))))
+		}
+		return b
+	}
+
+	desc := "sRGB IEC61966-2.1"
+	descTag := make([]byte, 12+len(desc)+1+8+3+67)
+	copy(descTag, "desc")
+	binary.BigEndian.PutUint32(descTag[8:], uint32(len(desc)+1))
+	copy(descTag[12:], desc)
+
+	cprt := append([]byte("text\x00\x00\x00\x00"), "No copyright, use freely\x00"...)
+
+	trc := make([]byte, 12+2*1024)
+	copy(trc, "curv")
+	binary.BigEndian.PutUint32(trc[8:], 1024)
+	for i := 0; i < 1024; i++ {
+		v := srgbCurve{}.linearize(float64(i) / 1023)
+		binary.BigEndian.PutUint16(trc[12+2*i:], uint16(math.Round(v*65535)))
+	}
+
+	type tag struct {
+		sig  string
+		data []byte
+	}
+	tags := []tag{
+		{"desc", descTag},
+		{"cprt", cprt},
+		{"wtpt", xyzTag(0.9642, 1.0, 0.8249)},
+		{"rXYZ", xyzTag(srgbD50[0][0], srgbD50[1][0], srgbD50[2][0])},
+		{"gXYZ", xyzTag(srgbD50[0][1], srgbD50[1][1], srgbD50[2][1])},
+		{"bXYZ", xyzTag(srgbD50[0][2], srgbD50[1][2], srgbD50[2][2])},
+		{"rTRC", trc},
+		{"gTRC", trc},
+		{"bTRC", trc},
+	}
+
+	var body bytes.Buffer
+	table := make([]byte, 4+12*len(tags))
+	binary.BigEndian.PutUint32(table, uint32(len(tags)))
+	dataStart := 128 + len(table)
+	trcOffset := 0
+	for i, t := range tags {
+		off := trcOffset
+		// The three channels share a single curve
+		if t.sig != "gTRC" && t.sig != "bTRC" {
+			off = dataStart + body.Len()
+			body.Write(t.data)
+			for body.Len()%4 != 0 {
+				body.WriteByte(0)
+			}
+			if t.sig == "rTRC" {
+				trcOffset = off
+			}
+		}
+		entry := table[4+12*i:]
+		copy(entry, t.sig)
+		binary.BigEndian.PutUint32(entry[4:], uint32(off))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(t.data)))
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[0:], uint32(128+len(table)+body.Len()))
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	for i, v := range []float64{0.9642, 1.0, 0.8249} {
+		binary.BigEndian.PutUint32(header[68+4*i:], uint32(int32(math.Round(v*65536))))
+	}
+
+	return append(append(header, table...), body.Bytes()...)
+}
+
+// srgbProfile returns the built-in sRGB profile
+func srgbProfile() *iccProfile {
+	return &iccProfile{
+		matrix: srgbD50,
+		curves: [3]toneCurve{srgbCurve{}, srgbCurve{}, srgbCurve{}},
+		raw:    buildSRGBProfile(),
+	}
+}
+
+// readJPEGICC reassembles an ICC profile split across JPEG APP2 segments
+func readJPEGICC(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+
+	chunks := map[int][]byte{}
+	total := 0
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xff; {
+		marker := data[pos+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xe2 && bytes.HasPrefix(segment, iccJPEGMarker) && len(segment) > len(iccJPEGMarker)+2 {
+			seq := int(segment[len(iccJPEGMarker)])
+			total = int(segment[len(iccJPEGMarker)+1])
+			chunks[seq] = segment[len(iccJPEGMarker)+2:]
+		}
+		pos += 2 + length
+	}
+
+	var profile []byte
+	for i := 1; i <= total; i++ {
+		chunk, ok := chunks[i]
+		if !ok {
+			return nil
+		}
+		profile = append(profile, chunk...)
+	}
+	return profile
+}
+
+// readPNGICC returns the decompressed profile of a PNG iCCP chunk
+func readPNGICC(data []byte) []byte {
+	if len(data) < 8 || string(data[1:4]) != "PNG" {
+		return nil
+	}
+	for pos := 8; pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		if pos+12+length > len(data) || typ == "IDAT" {
+			return nil
+		}
+		if typ == "iCCP" {
+			chunk := data[pos+8 : pos+8+length]
+			// Profile name, NUL, compression method, then zlib data
+			nul := bytes.IndexByte(chunk, 0)
+			if nul < 0 || nul+2 > len(chunk) {
+				return nil
+			}
+			r, err := zlib.NewReader(bytes.NewReader(chunk[nul+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := io.ReadAll(r)
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+		pos += 12 + length
+	}
+	return nil
+}
+
+// readEmbeddedICC returns the embedded ICC profile of JPEG or PNG data, or nil
+func readEmbeddedICC(data []byte) []byte {
+	if profile := readJPEGICC(data); profile != nil {
+		return profile
+	}
+	return readPNGICC(data)
+}
+
+// insertJPEGICC embeds a profile in APP2 segments after the JPEG's leading segments
+func insertJPEGICC(jpegData, profile []byte) ([]byte, error) {
+	insertAt, err := jpegHeaderEnd(jpegData)
+	if err != nil {
+		return nil, err
+	}
+
+	const maxChunk = 0xffff - 2 - 14
+	count := (len(profile) + maxChunk - 1) / maxChunk
+	if count > 255 {
+		return nil, errors.New("ICC profile too large to embed in JPEG")
+	}
+
+	var out bytes.Buffer
+	out.Write(jpegData[:insertAt])
+	for i := 0; i < count; i++ {
+		chunk := profile[i*maxChunk : min((i+1)*maxChunk, len(profile))]
+		out.Write([]byte{0xff, 0xe2})
+		binary.Write(&out, binary.BigEndian, uint16(2+len(iccJPEGMarker)+2+len(chunk)))
+		out.Write(iccJPEGMarker)
+		out.Write([]byte{byte(i + 1), byte(count)})
+		out.Write(chunk)
+	}
+	out.Write(jpegData[insertAt:])
+	return out.Bytes(), nil
+}
+
+// insertPNGICC embeds a profile as an iCCP chunk after the IHDR chunk
+func insertPNGICC(pngData, profile []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(profile)
+	zw.Close()
+
+	// Profile name, NUL separator, compression method 0, then the zlib stream
+	payload := append([]byte("ICC profile"), 0, 0)
+	payload = append(payload, compressed.Bytes()...)
+	return insertPNGChunk(pngData, "iCCP", payload)
+}
+
+// applyICCConversion converts img to the target colour space. convertTo names
+// a built-in target ("srgb") and targetPath an ICC profile file; exactly one
+// should be set. The source profile is read from input, the encoded image
+// img was decoded from; images without one are assumed to be sRGB.
+// It returns the converted image and the target profile to embed in the output.
+func applyICCConversion(img image.Image, input []byte, convertTo, targetPath string) (image.Image, []byte, error) {
+	var dst *iccProfile
+	switch {
+	case convertTo != "" && targetPath != "":
+		return nil, nil, errors.New("use either -icc-convert or -icc, not both")
+	case targetPath != "":
+		data, err := os.ReadFile(targetPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read ICC profile: %w", err)
+		}
+		if dst, err = parseICCProfile(data); err != nil {
+			return nil, nil, fmt.Errorf("invalid target profile %s: %w", targetPath, err)
+		}
+	case strings.EqualFold(convertTo, "srgb"):
+		dst = srgbProfile()
+	default:
+		return nil, nil, fmt.Errorf("unsupported -icc-convert target %q: only srgb is built in, use -icc for other profiles", convertTo)
+	}
+
+	var err error
+	srcData := readEmbeddedICC(input)
+
+	var src *iccProfile
+	if srcData == nil {
+		slog.Info("No embedded color profile, assuming sRGB")
+		if targetPath == "" {
+			// Already in the target space, just tag it
+			return img, dst.raw, nil
+		}
+		src = srgbProfile()
+	} else if src, err = parseICCProfile(srcData); err != nil {
+		return nil, nil, fmt.Errorf("cannot convert embedded color profile: %w", err)
+	}
+
+	converted, err := convertICC(img, src, dst)
+	if err != nil {
+		return nil, nil, err
+	}
+	slog.Info("Converted colors", "from", profileDescription(src.raw), "to", profileDescription(dst.raw))
+	return converted, dst.raw, nil
+}
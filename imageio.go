@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stringList is a flag.Value that collects repeated string flags
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// loadImage opens and decodes the image at path
+func loadImage(path string) (image.Image, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	img, format, err := decodeImage(file)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return img, format, nil
+}
+
+// formatFromExt returns the output format implied by a file extension
+func formatFromExt(path string) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	if ext == "" {
+		return "png"
+	}
+	return ext
+}
+
+// outputRoot is the directory every local output is written under
+const outputRoot = "output"
+
+// prepareOutputPath returns the path of filename inside output/<category>,
+// creating the directory if needed
+func prepareOutputPath(category, filename string) (string, error) {
+	outputDir := filepath.Join(outputRoot, category)
+	if err := ensureOutputDir(outputDir); err != nil {
+		return "", fmt.Errorf("error creating output directory: %w", err)
+	}
+	path := filepath.Join(outputDir, filepath.Base(filename))
+	if err := checkOutputPath(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// checkOutputPath returns an error unless path is a file inside outputRoot
+// once symlinks are resolved, and is not itself a symlink. Output names are
+// reduced to their base name, but a directory along the way could still be
+// a symlink to elsewhere, or be placed between the check and the write; the
+// check is repeated right before writing to narrow that window.
+func checkOutputPath(path string) error {
+	root, err := filepath.EvalSymlinks(outputRoot)
+	if err == nil {
+		root, err = filepath.Abs(root)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve output directory: %w", err)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err == nil {
+		dir, err = filepath.Abs(dir)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve output directory: %w", err)
+	}
+	if rel, err := filepath.Rel(root, dir); err != nil || !filepath.IsLocal(rel) && rel != "." {
+		return fmt.Errorf("refusing to write %s outside %s/", path, outputRoot)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			return fmt.Errorf("refusing to replace symlink %s", path)
+		case info.IsDir():
+			return fmt.Errorf("output path %s is a directory", path)
+		}
+	}
+	return nil
+}
+
+// saveImage encodes img to path, picking the format from the file extension
+func saveImage(path string, img image.Image, compressLevel int) error {
+	out, err := createAtomic(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+
+	if err := encodeImage(out, img, formatFromExt(path), compressLevel); err != nil {
+		out.Abort()
+		return err
+	}
+	return out.Commit()
+}
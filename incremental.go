@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// incrementalEntry records the source an output was produced from
+type incrementalEntry struct {
+	Input  string `json:"input"`
+	SHA256 string `json:"sha256"`
+}
+
+// incrementalState maps output paths to the content hash of the source they
+// were last produced from, so that unchanged inputs can be skipped even when
+// their modification times are no longer reliable (e.g. after a fresh copy)
+type incrementalState struct {
+	path    string
+	Outputs map[string]incrementalEntry `json:"outputs"`
+}
+
+// loadIncrementalState reads the state file at path, starting empty if it
+// does not exist yet
+func loadIncrementalState(path string) (*incrementalState, error) {
+	state := &incrementalState{path: path, Outputs: map[string]incrementalEntry{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read incremental state: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse incremental state %s: %w", path, err)
+	}
+	if state.Outputs == nil {
+		state.Outputs = map[string]incrementalEntry{}
+	}
+	return state, nil
+}
+
+// upToDate reports whether outPath already holds the result for inputFile:
+// the output exists and is newer than the input, or was produced from input
+// with the same content. The input's hash is returned when it was computed.
+func (s *incrementalState) upToDate(inputFile, outPath string) (bool, string, error) {
+	outInfo, err := os.Stat(outPath)
+	if err != nil {
+		return false, "", nil
+	}
+	inInfo, err := os.Stat(inputFile)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to stat input: %w", err)
+	}
+	if outInfo.ModTime().After(inInfo.ModTime()) {
+		return true, "", nil
+	}
+
+	entry, ok := s.Outputs[outPath]
+	if !ok {
+		return false, "", nil
+	}
+	hash, err := hashFile(inputFile)
+	if err != nil {
+		return false, "", err
+	}
+	return entry.SHA256 == hash, hash, nil
+}
+
+// newerThan reports whether path was modified after outPath, or outPath
+// cannot be read
+func newerThan(path, outPath string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return true
+	}
+	outInfo, err := os.Stat(outPath)
+	return err != nil || info.ModTime().After(outInfo.ModTime())
+}
+
+// record stores the hash of the input outPath was produced from. hash may be
+// empty, in which case it is computed.
+func (s *incrementalState) record(inputFile, outPath, hash string) error {
+	if hash == "" {
+		var err error
+		if hash, err = hashFile(inputFile); err != nil {
+			return err
+		}
+	}
+	s.Outputs[outPath] = incrementalEntry{Input: inputFile, SHA256: hash}
+	return nil
+}
+
+// save writes the state back to its file
+func (s *incrementalState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode incremental state: %w", err)
+	}
+	if err := writeFileAtomic(s.path, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write incremental state: %w", err)
+	}
+	return nil
+}
+
+// hashFile returns the hex SHA-256 digest of the file at path
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
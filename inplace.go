@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// backupSuffix is appended to the name of an image to name its backup when
+// -backup-dir is not given
+const backupSuffix = ".orig"
+
+// backupPath returns where the original of an image replaced by -in-place
+// is kept: next to it with .orig appended, or under dir at the image's path
+// relative to the current directory
+func backupPath(path, dir string) (string, error) {
+	if dir == "" {
+		return path + backupSuffix, nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s is outside the current directory, so it has no place under backup-dir", path)
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+// isBackup reports whether path is a backup made by -in-place, which is
+// never processed in place itself
+func isBackup(path, dir string) bool {
+	if dir == "" {
+		return strings.HasSuffix(path, backupSuffix)
+	}
+	abs, err1 := filepath.Abs(path)
+	absDir, err2 := filepath.Abs(dir)
+	rel, err3 := filepath.Rel(absDir, abs)
+	return err1 == nil && err2 == nil && err3 == nil && filepath.IsLocal(rel)
+}
+
+// checkInPlace returns an error if inputFile cannot be replaced by its
+// output: the output must keep the input's format, and the input must be a
+// local file that is neither a symlink nor a backup
+func (o *processOptions) checkInPlace(inputFile string) error {
+	if isObjectURI(inputFile) {
+		return errors.New("in-place cannot be used with object storage input: give the object's URI as -output instead")
+	}
+	if isBackup(inputFile, o.BackupDir) {
+		return fmt.Errorf("%s is an in-place backup", inputFile)
+	}
+	if _, err := backupPath(inputFile, o.BackupDir); err != nil {
+		return err
+	}
+	if format := o.outputFormat(inputFile); format != "" && formatAlias(strings.ToLower(format)) != formatAlias(formatFromExt(inputFile)) {
+		return fmt.Errorf("in-place output must keep the input's format, not %s", format)
+	}
+	info, err := os.Lstat(inputFile)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to replace symlink %s", inputFile)
+	}
+	return nil
+}
+
+// skipBackups drops the backups made by -in-place from inputs, which
+// patterns such as assets/**/* match on later runs
+func (o *processOptions) skipBackups(inputs []string) []string {
+	if !o.InPlace {
+		return inputs
+	}
+	return slices.DeleteFunc(inputs, func(path string) bool { return isBackup(path, o.BackupDir) })
+}
+
+// formatAlias returns the short name of a format with two names
+func formatAlias(format string) string {
+	switch format {
+	case "jpeg":
+		return "jpg"
+	case "tiff":
+		return "tif"
+	}
+	return format
+}
+
+// writeInPlace replaces inputFile with data, keeping its permissions. The
+// original is backed up first, unless a backup from an earlier run exists:
+// that one is kept, so that restore always returns the file as it was before
+// it was first processed in place.
+func (o *processOptions) writeInPlace(inputFile string, original, data []byte) error {
+	info, err := os.Stat(inputFile)
+	if err != nil {
+		return err
+	}
+	backup, err := backupPath(inputFile, o.BackupDir)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(backup); err == nil {
+		slog.Debug("Keeping earlier backup", "path", backup)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to check backup: %w", err)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+			return fmt.Errorf("failed to create backup directory: %w", err)
+		}
+		if err := writeFileAtomic(backup, original); err != nil {
+			return fmt.Errorf("failed to write backup: %w", err)
+		}
+		if err := os.Chmod(backup, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to write backup: %w", err)
+		}
+		slog.Debug("Backed up original", "path", backup)
+	}
+	return replaceFile(inputFile, data, info.Mode())
+}
+
+// replaceFile atomically replaces the file at path with data, giving it
+// mode's permissions
+func replaceFile(path string, data []byte, mode fs.FileMode) error {
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode.Perm())
+}
+
+// errNoBackup is returned by restoreOriginal for an image without a backup
+var errNoBackup = errors.New("no backup")
+
+// restoreOriginal moves the backup of path made by -in-place back over it
+func restoreOriginal(path, dir string) error {
+	backup, err := backupPath(path, dir)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(backup); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w of %s at %s", errNoBackup, path, backup)
+	}
+	if err := os.Rename(backup, path); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+	slog.Info("Restored original", "path", path, "backup", backup)
+	return nil
+}
+
+// runRestore implements the restore subcommand
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	backupDir := fs.String("backup-dir", "", "Directory the originals were backed up to by -in-place -backup-dir. By default each image's backup is next to it with .orig appended")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s restore [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("at least one image to restore is required")
+	}
+	// Images matched by a pattern may not all have been processed in
+	// place, but an image named on its own must have a backup
+	var errs []error
+	restored := 0
+	for _, arg := range fs.Args() {
+		paths, err := collectInputs([]string{arg}, "")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, path := range paths {
+			if isBackup(path, *backupDir) {
+				continue
+			}
+			err := restoreOriginal(path, *backupDir)
+			switch {
+			case err == nil:
+				restored++
+			case !errors.Is(err, errNoBackup) || !isGlobPattern(arg):
+				errs = append(errs, err)
+			}
+		}
+	}
+	slog.Info("Restore complete", "restored", restored, "failed", len(errs))
+	return errors.Join(errs...)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isGlobPattern reports whether path should be expanded as a glob: it has
+// glob metacharacters and does not name an existing file or object
+func isGlobPattern(path string) bool {
+	if isObjectURI(path) || !strings.ContainsAny(path, "*?[") {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err != nil
+}
+
+// expandGlob returns the files matching pattern in lexical order. Besides the
+// filepath.Match syntax, a "**" path element matches any number of
+// directories, e.g. photos/**/*.jpg.
+func expandGlob(pattern string) ([]string, error) {
+	pattern = filepath.Clean(pattern)
+	if !strings.Contains(pattern, "**") {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		return regularFiles(matches), nil
+	}
+
+	// Walk from the deepest directory without metacharacters
+	parts := strings.Split(pattern, string(filepath.Separator))
+	rootParts := 0
+	for rootParts < len(parts)-1 && !strings.ContainsAny(parts[rootParts], "*?[") {
+		rootParts++
+	}
+	root := strings.Join(parts[:rootParts], string(filepath.Separator))
+	if root == "" {
+		root = "."
+		if filepath.IsAbs(pattern) {
+			root = string(filepath.Separator)
+		}
+	}
+
+	var matches []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		ok, err := matchGlobParts(parts[rootParts:], strings.Split(rel, string(filepath.Separator)))
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		if ok {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand %q: %w", pattern, err)
+	}
+	return matches, nil
+}
+
+// matchGlobParts matches path elements against pattern elements, where "**"
+// stands for zero or more elements
+func matchGlobParts(pattern, path []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(path); i++ {
+				if ok, err := matchGlobParts(pattern[1:], path[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(path) == 0 {
+			return false, nil
+		}
+		ok, err := filepath.Match(pattern[0], path[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0, nil
+}
+
+// regularFiles returns the paths that are not directories
+func regularFiles(paths []string) []string {
+	files := paths[:0]
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// addFileListFlag registers -file-list on flags with usage, and -files as a
+// shorter name for it, and returns the list named by either
+func addFileListFlag(flags *flag.FlagSet, usage string) *string {
+	fileList := flags.String("file-list", "", usage)
+	flags.StringVar(fileList, "files", "", "Same as -file-list, e.g. -files - to read the list from stdin")
+	return fileList
+}
+
+// readFileList reads input paths, one per line, from the file at name or
+// from stdin when name is "-". Blank lines and lines starting with # are
+// ignored.
+func readFileList(name string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file list: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read file list: %w", err)
+	}
+	return paths, nil
+}
+
+// collectInputs expands glob patterns and appends the entries of fileList,
+// if set, dropping duplicates. Paths that are not patterns are kept as-is so
+// that missing files are reported when they are processed.
+func collectInputs(patterns []string, fileList string) ([]string, error) {
+	paths := []string{}
+	for _, pattern := range patterns {
+		if !isGlobPattern(pattern) {
+			paths = append(paths, pattern)
+			continue
+		}
+		matches, err := expandGlob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", pattern)
+		}
+		paths = append(paths, matches...)
+	}
+
+	if fileList != "" {
+		listed, err := readFileList(fileList)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, listed...)
+	}
+
+	inputs := paths[:0]
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if !seen[path] {
+			seen[path] = true
+			inputs = append(inputs, path)
+		}
+	}
+	return inputs, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// inventoryEntry describes one image found by the report subcommand
+type inventoryEntry struct {
+	Path         string `json:"path"`
+	Format       string `json:"format"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	Bytes        int64  `json:"bytes"`
+	SavingsBytes int64  `json:"savings_bytes"`
+	LFSPointer   bool   `json:"lfs_pointer"`
+	Oversized    bool   `json:"oversized"`
+	Unoptimized  bool   `json:"unoptimized"`
+	Error        string `json:"error,omitempty"`
+}
+
+// inventoryColumns are the CSV header names, in the order of inventoryEntry.row
+var inventoryColumns = []string{"path", "format", "width", "height", "bytes", "savings_bytes", "lfs_pointer", "oversized", "unoptimized", "error"}
+
+// row returns the entry's fields as CSV cells
+func (e inventoryEntry) row() []string {
+	return []string{
+		e.Path, e.Format, strconv.Itoa(e.Width), strconv.Itoa(e.Height),
+		strconv.FormatInt(e.Bytes, 10), strconv.FormatInt(e.SavingsBytes, 10),
+		strconv.FormatBool(e.LFSPointer), strconv.FormatBool(e.Oversized), strconv.FormatBool(e.Unoptimized), e.Error,
+	}
+}
+
+// inventoryOptions are the thresholds of the report subcommand
+type inventoryOptions struct {
+	MaxBytes   int64
+	MaxWidth   int
+	MaxHeight  int
+	MinSavings float64 // percent of the file optimize must save to flag it
+	Savings    bool
+}
+
+// lfsPointerHeader starts a Git LFS pointer file, which stands in for a
+// file whose content has not been fetched
+const lfsPointerHeader = "version https://git-lfs.github.com/spec/v1\n"
+
+// lfsPointerSize returns the size of the file a Git LFS pointer stands for
+func lfsPointerSize(data []byte) (int64, bool) {
+	if len(data) > 1024 || !bytes.HasPrefix(data, []byte(lfsPointerHeader)) {
+		return 0, false
+	}
+	for line := range strings.Lines(string(data)) {
+		if size, ok := strings.CutPrefix(strings.TrimSpace(line), "size "); ok {
+			n, err := strconv.ParseInt(size, 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// describe returns the inventory entry of the image at path, holding data
+func (o *inventoryOptions) describe(ctx context.Context, path string, data []byte) inventoryEntry {
+	entry := inventoryEntry{Path: path, Bytes: int64(len(data))}
+	ext := strings.ToLower(filepath.Ext(path))
+	if size, ok := lfsPointerSize(data); ok {
+		// Only the size is known until the content is fetched
+		entry.Format, entry.Bytes, entry.LFSPointer = strings.TrimPrefix(ext, "."), size, true
+		entry.Oversized = o.MaxBytes > 0 && size > o.MaxBytes
+		return entry
+	}
+
+	config, format, err := decodeConfig(data)
+	if err != nil {
+		entry.Format, entry.Error = strings.TrimPrefix(ext, "."), err.Error()
+	} else {
+		entry.Format, entry.Width, entry.Height = format, config.Width, config.Height
+	}
+	entry.Oversized = o.MaxBytes > 0 && entry.Bytes > o.MaxBytes || o.MaxWidth > 0 && entry.Width > o.MaxWidth || o.MaxHeight > 0 && entry.Height > o.MaxHeight
+
+	if o.Savings && err == nil && slices.Contains(optimizeExtensions, ext) {
+		optimized, err := optimizeData(ctx, ext, data, false)
+		switch {
+		case err == nil:
+			entry.SavingsBytes = entry.Bytes - int64(len(optimized))
+		case !errors.Is(err, errNotSmaller) && !errors.Is(err, errCannotOptimize):
+			entry.Error = err.Error()
+		}
+		entry.Unoptimized = entry.SavingsBytes > 0 && float64(entry.SavingsBytes) >= o.MinSavings/100*float64(entry.Bytes)
+	}
+	return entry
+}
+
+// inventorySummary totals the entries of an inventory
+type inventorySummary struct {
+	Images       int
+	Bytes        int64
+	SavingsBytes int64
+	Oversized    int
+	Unoptimized  int
+	LFSPointers  int
+}
+
+func summarizeInventory(entries []inventoryEntry) inventorySummary {
+	var s inventorySummary
+	for _, e := range entries {
+		s.Images++
+		s.Bytes += e.Bytes
+		s.SavingsBytes += e.SavingsBytes
+		if e.Oversized {
+			s.Oversized++
+		}
+		if e.Unoptimized {
+			s.Unoptimized++
+		}
+		if e.LFSPointer {
+			s.LFSPointers++
+		}
+	}
+	return s
+}
+
+// formatBytes returns n in the largest unit that keeps it at least 1
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// inventoryPage is the HTML report, a self-contained page with one table row
+// per image, highlighting oversized and unoptimized ones
+var inventoryPage = template.Must(template.New("inventory").Funcs(template.FuncMap{"bytes": formatBytes}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Image inventory</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; font-size: 14px; }
+th, td { padding: 4px 10px; border-bottom: 1px solid #ddd; text-align: left; }
+td.n { text-align: right; font-variant-numeric: tabular-nums; }
+tr.oversized { background: #fde2e1; }
+tr.unoptimized { background: #fff4d6; }
+tr.oversized.unoptimized { background: #fbd3c4; }
+.tag { font-size: 12px; padding: 1px 6px; border-radius: 3px; margin-right: 4px; color: #fff; }
+.tag.oversized { background: #c0392b; }
+.tag.unoptimized { background: #b7791f; }
+.tag.lfs { background: #2c5282; }
+</style>
+</head>
+<body>
+<h1>Image inventory</h1>
+<p>{{.Summary.Images}} images, {{bytes .Summary.Bytes}} in total.
+{{.Summary.Oversized}} oversized, {{.Summary.Unoptimized}} unoptimized, with {{bytes .Summary.SavingsBytes}} to save by running <code>optimize</code>.
+{{if .Summary.LFSPointers}}{{.Summary.LFSPointers}} Git LFS pointers were not fetched.{{end}}</p>
+<table>
+<thead><tr><th>Path</th><th>Format</th><th>Dimensions</th><th>Size</th><th>Savings</th><th></th></tr></thead>
+<tbody>
+{{range .Entries}}<tr class="{{if .Oversized}}oversized{{end}} {{if .Unoptimized}}unoptimized{{end}}">
+<td>{{.Path}}</td><td>{{.Format}}</td><td class="n">{{if .Width}}{{.Width}}×{{.Height}}{{end}}</td>
+<td class="n">{{bytes .Bytes}}</td><td class="n">{{if .SavingsBytes}}{{bytes .SavingsBytes}}{{end}}</td>
+<td>{{if .Oversized}}<span class="tag oversized">oversized</span>{{end}}{{if .Unoptimized}}<span class="tag unoptimized">unoptimized</span>{{end}}{{if .LFSPointer}}<span class="tag lfs">LFS pointer</span>{{end}}{{.Error}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+</body>
+</html>
+`))
+
+// writeInventory writes entries to path as JSON, CSV or HTML, depending on
+// its extension
+func writeInventory(path string, entries []inventoryEntry) error {
+	f, err := createAtomic(path)
+	if err != nil {
+		return fmt.Errorf("failed to create report: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		w := csv.NewWriter(f)
+		w.Write(inventoryColumns)
+		for _, e := range entries {
+			w.Write(e.row())
+		}
+		w.Flush()
+		err = w.Error()
+	case ".html":
+		err = inventoryPage.Execute(f, struct {
+			Summary inventorySummary
+			Entries []inventoryEntry
+		}{summarizeInventory(entries), entries})
+	default:
+		if entries == nil {
+			entries = []inventoryEntry{}
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(entries)
+	}
+	if err != nil {
+		f.Abort()
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return f.Commit()
+}
+
+// runReport implements the report subcommand
+func runReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	var o inventoryOptions
+	output := fs.String("output", "inventory.json", "Name of the report written to output/report. The extension selects JSON (.json), CSV (.csv) or an HTML page (.html)")
+	fs.Int64Var(&o.MaxBytes, "max-bytes", 1000000, "Flag images larger than this many bytes as oversized. 0 means no limit")
+	fs.IntVar(&o.MaxWidth, "max-width", 0, "Flag images wider than this many pixels as oversized. 0 means no limit")
+	fs.IntVar(&o.MaxHeight, "max-height", 0, "Flag images taller than this many pixels as oversized. 0 means no limit")
+	fs.BoolVar(&o.Savings, "savings", true, "Estimate what the optimize subcommand would save on each PNG, JPEG and GIF. -savings=false only reads the headers, which is much faster")
+	fs.Float64Var(&o.MinSavings, "min-savings", 5, "Flag images that optimize would shrink by at least this percentage as unoptimized")
+	effort := fs.Int("effort", 2, "Encoding effort from 0 to 9 of the savings estimate, as for optimize. Higher efforts find more savings, more slowly")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s report [flags] directory-or-image ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(*output)) {
+	case ".json", ".csv", ".html":
+	default:
+		return fmt.Errorf("unsupported report format %q: use a .json, .csv or .html file name", *output)
+	}
+	if o.MaxBytes < 0 || o.MaxWidth < 0 || o.MaxHeight < 0 || o.MinSavings < 0 {
+		return errors.New("max-bytes, max-width, max-height and min-savings must not be negative")
+	}
+	if *effort < 0 || *effort > 9 {
+		return errors.New("effort must be between 0 and 9")
+	}
+	encodeEffort = *effort
+	if fs.NArg() == 0 {
+		return errors.New("at least one directory or image is required")
+	}
+	paths, err := walkImages(fs.Args(), checkExtensions)
+	if err != nil {
+		return err
+	}
+	reportPath, err := prepareOutputPath("report", *output)
+	if err != nil {
+		return err
+	}
+	ctx, _, release := handleSignals()
+	defer release()
+
+	var entries []inventoryEntry
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: no report was written", errInterrupted)
+		}
+		if !slices.Contains(checkExtensions, strings.ToLower(filepath.Ext(path))) {
+			slog.Debug("Skipping file that is not an image", "path", path)
+			continue
+		}
+		data, err := readInputFile(path)
+		if err != nil {
+			entries = append(entries, inventoryEntry{Path: path, Error: err.Error()})
+			continue
+		}
+		entries = append(entries, o.describe(ctx, path, data))
+	}
+	// Largest first, as those are the ones worth acting on
+	slices.SortStableFunc(entries, func(a, b inventoryEntry) int { return cmp.Compare(b.Bytes, a.Bytes) })
+
+	if err := writeInventory(reportPath, entries); err != nil {
+		return err
+	}
+	s := summarizeInventory(entries)
+	slog.Info("Report written", "path", reportPath, "images", s.Images, "bytes", s.Bytes, "oversized", s.Oversized,
+		"unoptimized", s.Unoptimized, "savings_bytes", s.SavingsBytes, "lfs_pointers", s.LFSPointers)
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// batchJob is one input of a batch run, with the output name and options
+// that apply to it alone. Inputs given on the command line have neither.
+type batchJob struct {
+	Input   string
+	Output  string
+	Options map[string]string
+}
+
+// inputJobs returns a job for each of inputs
+func inputJobs(inputs []string) []batchJob {
+	jobs := make([]batchJob, 0, len(inputs))
+	for _, input := range inputs {
+		jobs = append(jobs, batchJob{Input: input})
+	}
+	return jobs
+}
+
+// readJobs reads a job file: a JSON array of objects with an input, an
+// optional output and an optional object of options, or a CSV table with a
+// header row naming the input and output columns and one column per option.
+// The extension selects the format. Options are named like the flags without
+// the dash, and empty CSV cells leave an option unset.
+func readJobs(path string) ([]batchJob, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job file: %w", err)
+	}
+	// Spreadsheets often start their exports with a byte order mark
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+
+	var jobs []batchJob
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		jobs, err = parseJSONJobs(data)
+	case ".csv":
+		jobs, err = parseCSVJobs(data)
+	default:
+		return nil, fmt.Errorf("unsupported job file extension %q: use .json or .csv", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid job file %s: %w", path, err)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("job file %s lists no jobs", path)
+	}
+	return jobs, nil
+}
+
+// parseJSONJobs parses a JSON job file. Option values may be strings,
+// numbers or booleans.
+func parseJSONJobs(data []byte) ([]batchJob, error) {
+	var entries []struct {
+		Input   string                     `json:"input"`
+		Output  string                     `json:"output"`
+		Options map[string]json.RawMessage `json:"options"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	jobs := make([]batchJob, 0, len(entries))
+	for i, e := range entries {
+		if e.Input == "" {
+			return nil, fmt.Errorf("job %d has no input", i+1)
+		}
+		job := batchJob{Input: e.Input, Output: e.Output, Options: map[string]string{}}
+		for name, raw := range e.Options {
+			var value any
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return nil, fmt.Errorf("job %d: %w", i+1, err)
+			}
+			switch v := value.(type) {
+			case string:
+				job.Options[name] = v
+			case float64, bool:
+				// Keep numbers as written, e.g. 1000000 rather than 1e+06
+				job.Options[name] = string(raw)
+			default:
+				return nil, fmt.Errorf("job %d: option %s must be a string, number or boolean", i+1, name)
+			}
+		}
+		if err := checkOptionNames(job.Options); err != nil {
+			return nil, fmt.Errorf("job %d: %w", i+1, err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// parseCSVJobs parses a CSV job file
+func parseCSVJobs(data []byte) ([]batchJob, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	header, err := r.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	if !slices.Contains(header, "input") {
+		return nil, errors.New("the header row has no input column")
+	}
+
+	var jobs []batchJob
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return jobs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := r.FieldPos(0)
+		job := batchJob{Options: map[string]string{}}
+		for i, name := range header {
+			value := strings.TrimSpace(record[i])
+			switch {
+			case value == "":
+			case name == "input":
+				job.Input = value
+			case name == "output":
+				job.Output = value
+			default:
+				job.Options[name] = value
+			}
+		}
+		if job.Input == "" {
+			return nil, fmt.Errorf("line %d has no input", line)
+		}
+		// A misspelt option stops the run before anything is written
+		if err := checkOptionNames(job.Options); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		jobs = append(jobs, job)
+	}
+}
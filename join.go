@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// joinImages stacks images top to bottom, or left to right if horizontal,
+// gap pixels apart. Narrower images are placed across the strip by align:
+// start, center or end. A negative gap overlaps each image with the one
+// before, drawing it on top.
+func joinImages(images []image.Image, horizontal bool, align string, gap int, background color.Color) (*image.NRGBA, error) {
+	// Lay the images out along the strip as if it were vertical, so that
+	// length runs along it and breadth across it
+	length, breadth := 0, 0
+	for i, img := range images {
+		size := img.Bounds().Size()
+		if horizontal {
+			size.X, size.Y = size.Y, size.X
+		}
+		if i > 0 {
+			length += gap
+		}
+		length += size.Y
+		breadth = max(breadth, size.X)
+	}
+	if length < 1 {
+		return nil, fmt.Errorf("a gap of %d overlaps the images entirely", gap)
+	}
+	if length > maxSizeSide || breadth > maxSizeSide {
+		return nil, fmt.Errorf("the joined image would be %d pixels long, more than %d", max(length, breadth), maxSizeSide)
+	}
+
+	r := image.Rect(0, 0, breadth, length)
+	if horizontal {
+		r = image.Rect(0, 0, length, breadth)
+	}
+	strip := image.NewNRGBA(r)
+	draw.Draw(strip, strip.Rect, image.NewUniform(background), image.Point{}, draw.Src)
+
+	along := 0
+	for _, img := range images {
+		b := img.Bounds()
+		size := b.Size()
+		if horizontal {
+			size.X, size.Y = size.Y, size.X
+		}
+		across := 0
+		switch align {
+		case "center":
+			across = (breadth - size.X) / 2
+		case "end":
+			across = breadth - size.X
+		}
+		pt := image.Pt(across, along)
+		if horizontal {
+			pt = image.Pt(along, across)
+		}
+		draw.Draw(strip, image.Rectangle{Min: pt, Max: pt.Add(b.Size())}, img, b.Min, draw.Over)
+		along += size.Y + gap
+	}
+	return strip, nil
+}
+
+// runJoin implements the join subcommand
+func runJoin(args []string) error {
+	fs := flag.NewFlagSet("join", flag.ExitOnError)
+	outputFile := fs.String("output", "joined.png", "Output image file path")
+	direction := fs.String("direction", "vertical", "Direction to join in: vertical (top to bottom) or horizontal (left to right)")
+	align := fs.String("align", "center", "Placement of narrower images across the strip: start, center or end (left or right when vertical, top or bottom when horizontal)")
+	gap := fs.Int("gap", 0, "Space between images in pixels. A negative gap overlaps them, e.g. -50 to undo split -overlap 50")
+	backgroundHex := fs.String("background", "#ffffff", "Color of gaps and of the space beside narrower images, as #rrggbb or #rrggbbaa")
+	compressLevel := fs.Int("compress", 0, "Compression level (1-100) for the output image. 0 means no compression")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s join [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		return fmt.Errorf("at least one input image is required")
+	}
+	if *direction != "vertical" && *direction != "horizontal" {
+		return fmt.Errorf("invalid direction %q: expected vertical or horizontal", *direction)
+	}
+	switch *align {
+	case "left", "top":
+		*align = "start"
+	case "right", "bottom":
+		*align = "end"
+	case "start", "center", "end":
+	default:
+		return fmt.Errorf("invalid alignment %q: expected start, center or end", *align)
+	}
+	background, err := parseHexColor(*backgroundHex)
+	if err != nil {
+		return err
+	}
+
+	images := make([]image.Image, len(inputs))
+	progress := newProgressBar("Loading images", "images", len(inputs))
+	for i, path := range inputs {
+		if images[i], _, err = loadImage(path); err != nil {
+			progress.Finish()
+			return err
+		}
+		progress.Step("Loaded image", "file", path, "index", i+1, "total", len(inputs))
+	}
+	progress.Finish()
+
+	strip, err := joinImages(images, *direction == "horizontal", *align, *gap, background)
+	if err != nil {
+		return err
+	}
+
+	outPath, err := prepareOutputPath("join", *outputFile)
+	if err != nil {
+		return err
+	}
+	if err := saveImage(outPath, strip, *compressLevel); err != nil {
+		return err
+	}
+
+	slog.Info("Joined images", "images", len(inputs), "size", fmt.Sprintf("%dx%d", strip.Rect.Dx(), strip.Rect.Dy()), "path", outPath)
+	return nil
+}
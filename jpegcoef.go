@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"slices"
+)
+
+// jpegCoefficients holds the quantized DCT blocks of a baseline JPEG. They
+// can be rearranged and written back without decoding the image, so nothing
+// is lost to another round of quantization.
+type jpegCoefficients struct {
+	width, height int
+	quant         [4][64]int32 // natural order
+	planes        []jpegPlane  // frame order
+}
+
+// jpegPlane is the grid of blocks of one component. Interleaved components
+// cover whole MCUs, so the grid may extend past the image's right and
+// bottom edges.
+type jpegPlane struct {
+	id, quant        uint8
+	h, v             int
+	blocksW, blocksH int
+	blocks           [][64]int16 // natural order
+}
+
+// readJPEGCoefficients entropy-decodes a baseline JPEG into its quantized
+// DCT blocks. Unsupported JPEGs fail with errUnsupportedJPEG.
+func readJPEGCoefficients(ctx context.Context, data []byte) (*jpegCoefficients, error) {
+	f, err := parseBaselineJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+	c := &jpegCoefficients{width: f.width, height: f.height, quant: f.quant}
+	for _, comp := range f.comps {
+		p := jpegPlane{id: comp.id, quant: comp.quant, h: comp.h, v: comp.v, blocksW: f.mcusX * comp.h, blocksH: f.mcusY * comp.v}
+		p.blocks = make([][64]int16, p.blocksW*p.blocksH)
+		c.planes = append(c.planes, p)
+	}
+	err = f.decodeBlocks(ctx, func(comp *jpegComponent, bx, by int, coef *[64]int32) {
+		p := &c.planes[comp.index]
+		block := &p.blocks[by*p.blocksW+bx]
+		for k, v := range coef {
+			block[k] = int16(v)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// mcuSize returns the width and height in pixels of a minimum coded unit
+func (c *jpegCoefficients) mcuSize() (int, int) {
+	return 8 * c.planes[0].h, 8 * c.planes[0].v
+}
+
+// jpegCategory returns the number of bits needed for the magnitude of v
+func jpegCategory(v int32) uint8 {
+	if v < 0 {
+		v = -v
+	}
+	n := uint8(0)
+	for ; v > 0; v >>= 1 {
+		n++
+	}
+	return n
+}
+
+// eachSymbol walks the blocks of every MCU in scan order, calling fn with
+// the plane and each DC (ac false) and AC Huffman symbol, plus the extra
+// bits that follow it
+func (c *jpegCoefficients) eachSymbol(fn func(plane int, ac bool, symbol uint8, bits uint32, size uint8)) {
+	mcusX, mcusY := c.planes[0].blocksW/c.planes[0].h, c.planes[0].blocksH/c.planes[0].v
+	preds := make([]int32, len(c.planes))
+	for my := range mcusY {
+		for mx := range mcusX {
+			for i := range c.planes {
+				p := &c.planes[i]
+				for by := range p.v {
+					for bx := range p.h {
+						block := &p.blocks[(my*p.v+by)*p.blocksW+mx*p.h+bx]
+						diff := int32(block[0]) - preds[i]
+						preds[i] = int32(block[0])
+						size := jpegCategory(diff)
+						fn(i, false, size, jpegExtraBits(diff, size), size)
+
+						run := uint8(0)
+						for k := 1; k < 64; k++ {
+							v := int32(block[jpegZigzag[k]])
+							if v == 0 {
+								run++
+								continue
+							}
+							for ; run >= 16; run -= 16 {
+								fn(i, true, 0xf0, 0, 0)
+							}
+							size := jpegCategory(v)
+							fn(i, true, run<<4|size, jpegExtraBits(v, size), size)
+							run = 0
+						}
+						if run > 0 {
+							fn(i, true, 0x00, 0, 0)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// jpegExtraBits returns the size-bit representation of v that follows its
+// Huffman symbol, where negative values are stored as v-1
+func jpegExtraBits(v int32, size uint8) uint32 {
+	if v < 0 {
+		v--
+	}
+	return uint32(v) & (1<<size - 1)
+}
+
+// jpegHuffmanCode is the code of one symbol in a table built by buildJPEGHuffman
+type jpegHuffmanCode struct {
+	code uint16
+	size uint8
+}
+
+// buildJPEGHuffman derives an optimal table, limited to 16-bit codes, from
+// symbol frequencies following Annex K.2 of the JPEG standard. It returns
+// the DHT code counts and symbols and the code of each symbol.
+func buildJPEGHuffman(freq [256]int) (counts [16]uint8, symbols []uint8, codes [256]jpegHuffmanCode) {
+	// A reserved symbol 256 keeps any code from being all ones
+	var f [257]int
+	copy(f[:], freq[:])
+	f[256] = 1
+	var codeSize [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+	for {
+		v1, v2 := -1, -1
+		for i, n := range f {
+			if n == 0 {
+				continue
+			}
+			if v1 < 0 || n <= f[v1] {
+				v1, v2 = i, v1
+			} else if v2 < 0 || n <= f[v2] {
+				v2 = i
+			}
+		}
+		if v2 < 0 {
+			break
+		}
+		f[v1] += f[v2]
+		f[v2] = 0
+		for codeSize[v1]++; others[v1] >= 0; codeSize[v1]++ {
+			v1 = others[v1]
+		}
+		others[v1] = v2
+		for codeSize[v2]++; others[v2] >= 0; codeSize[v2]++ {
+			v2 = others[v2]
+		}
+	}
+
+	var bits [33]int
+	for _, size := range codeSize {
+		if size > 0 {
+			bits[size]++
+		}
+	}
+	for i := 32; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	for i := 16; i > 0; i-- {
+		if bits[i] > 0 {
+			bits[i]--
+			break
+		}
+	}
+
+	for size := 1; size <= 32; size++ {
+		for sym := range 256 {
+			if codeSize[sym] == size {
+				symbols = append(symbols, uint8(sym))
+			}
+		}
+	}
+	code, k := uint16(0), 0
+	for l := 1; l <= 16; l++ {
+		counts[l-1] = uint8(bits[l])
+		for range bits[l] {
+			codes[symbols[k]] = jpegHuffmanCode{code, uint8(l)}
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return counts, symbols, codes
+}
+
+// jpegBitWriter writes entropy-coded data, stuffing a zero after every 0xFF
+type jpegBitWriter struct {
+	w   *bufio.Writer
+	acc uint32
+	n   uint
+}
+
+func (b *jpegBitWriter) emit(bits uint32, size uint8) {
+	b.acc = b.acc<<size | bits&(1<<size-1)
+	b.n += uint(size)
+	for b.n >= 8 {
+		c := byte(b.acc >> (b.n - 8))
+		b.w.WriteByte(c)
+		if c == 0xff {
+			b.w.WriteByte(0)
+		}
+		b.n -= 8
+	}
+}
+
+// flush pads the last byte with one bits
+func (b *jpegBitWriter) flush() {
+	if b.n > 0 {
+		b.emit(1<<(8-b.n)-1, uint8(8-b.n))
+	}
+}
+
+// writeJPEGSegment writes a marker segment with its length
+func writeJPEGSegment(w *bufio.Writer, marker byte, payload []byte) {
+	w.Write([]byte{0xff, marker})
+	binary.Write(w, binary.BigEndian, uint16(len(payload)+2))
+	w.Write(payload)
+}
+
+// writeFrameHeader writes the start of image, the quantization tables in use
+// and the frame header, which is extended sequential if a table needs 16-bit
+// entries
+func (c *jpegCoefficients) writeFrameHeader(w *bufio.Writer, progressive bool) {
+	w.Write([]byte{0xff, 0xd8})
+
+	// Quantization tables, in zigzag order and 16-bit only where needed
+	var extended bool
+	var used []uint8
+	for _, p := range c.planes {
+		if !slices.Contains(used, p.quant) {
+			used = append(used, p.quant)
+		}
+	}
+	for _, id := range used {
+		table := c.quant[id]
+		precision := uint8(0)
+		if slices.Max(table[:]) > 255 {
+			precision, extended = 1, true
+		}
+		dqt := []byte{precision<<4 | id}
+		for k := range 64 {
+			v := table[jpegZigzag[k]]
+			if precision == 0 {
+				dqt = append(dqt, uint8(v))
+			} else {
+				dqt = binary.BigEndian.AppendUint16(dqt, uint16(v))
+			}
+		}
+		writeJPEGSegment(w, 0xdb, dqt)
+	}
+
+	sof := []byte{8}
+	sof = binary.BigEndian.AppendUint16(sof, uint16(c.height))
+	sof = binary.BigEndian.AppendUint16(sof, uint16(c.width))
+	sof = append(sof, uint8(len(c.planes)))
+	for _, p := range c.planes {
+		sof = append(sof, p.id, uint8(p.h<<4|p.v), p.quant)
+	}
+	marker := byte(0xc0)
+	switch {
+	case progressive:
+		marker = 0xc2
+	case extended:
+		marker = 0xc1
+	}
+	writeJPEGSegment(w, marker, sof)
+}
+
+// encode writes the coefficients as a baseline JPEG with Huffman tables
+// optimized for them. The luma or grey plane uses the first pair of tables
+// and the chroma planes share the second.
+func (c *jpegCoefficients) encode(out io.Writer) error {
+	tableOf := func(plane int) int { return min(plane, 1) }
+	var dcFreq, acFreq [2][256]int
+	c.eachSymbol(func(plane int, ac bool, symbol uint8, _ uint32, _ uint8) {
+		if ac {
+			acFreq[tableOf(plane)][symbol]++
+		} else {
+			dcFreq[tableOf(plane)][symbol]++
+		}
+	})
+
+	w := bufio.NewWriter(out)
+	c.writeFrameHeader(w, false)
+
+	var dcCodes, acCodes [2][256]jpegHuffmanCode
+	for t := range min(len(c.planes), 2) {
+		for class, freq := range [][256]int{dcFreq[t], acFreq[t]} {
+			counts, symbols, codes := buildJPEGHuffman(freq)
+			writeJPEGSegment(w, 0xc4, append(append([]byte{uint8(class<<4 | t)}, counts[:]...), symbols...))
+			if class == 0 {
+				dcCodes[t] = codes
+			} else {
+				acCodes[t] = codes
+			}
+		}
+	}
+
+	sos := []byte{uint8(len(c.planes))}
+	for i, p := range c.planes {
+		t := uint8(tableOf(i))
+		sos = append(sos, p.id, t<<4|t)
+	}
+	writeJPEGSegment(w, 0xda, append(sos, 0, 63, 0))
+
+	bw := jpegBitWriter{w: w}
+	c.eachSymbol(func(plane int, ac bool, symbol uint8, bits uint32, size uint8) {
+		code := dcCodes[tableOf(plane)][symbol]
+		if ac {
+			code = acCodes[tableOf(plane)][symbol]
+		}
+		bw.emit(uint32(code.code), code.size)
+		bw.emit(bits, size)
+	})
+	bw.flush()
+	w.Write([]byte{0xff, 0xd9})
+	return w.Flush()
+}
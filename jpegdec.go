@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// errUnsupportedJPEG marks JPEGs that the DCT-domain code leaves to the
+// standard decoder and encoder
+var errUnsupportedJPEG = errors.New("JPEG variant not supported in the DCT domain")
+
+// jpegZigzag maps the zigzag order of coefficients in the file to their
+// natural, row-major position in a block
+var jpegZigzag = [64]uint8{
+	0, 1, 8, 16, 9, 2, 3, 10, 17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34, 27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36, 29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46, 53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegHuffmanLookupBits is the code length resolved with a single table lookup
+const jpegHuffmanLookupBits = 9
+
+// jpegHuffman is a Huffman table from a DHT segment
+type jpegHuffman struct {
+	lookup  [1 << jpegHuffmanLookupBits]uint16 // length<<8 | symbol for short codes, 0 otherwise
+	minCode [17]int32
+	maxCode [17]int32 // -1 when there are no codes of that length
+	valPtr  [17]int32
+	symbols []uint8
+}
+
+// newJPEGHuffman builds a table from the code counts per length and the symbols
+func newJPEGHuffman(counts [16]uint8, symbols []uint8) *jpegHuffman {
+	h := &jpegHuffman{symbols: symbols}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		h.valPtr[l], h.minCode[l], h.maxCode[l] = k, code, -1
+		if n > 0 {
+			h.maxCode[l] = code + n - 1
+		}
+		if l <= jpegHuffmanLookupBits {
+			for i := range n {
+				if code+i >= 1<<l {
+					break
+				}
+				shift := jpegHuffmanLookupBits - l
+				first := (code + i) << shift
+				for j := range int32(1) << shift {
+					h.lookup[first+j] = uint16(l)<<8 | uint16(symbols[k+i])
+				}
+			}
+		}
+		code, k = (code+n)<<1, k+n
+	}
+	return h
+}
+
+// jpegBits reads the entropy-coded data of a scan, removing stuffed zero
+// bytes. At a marker or the end of data it supplies zero bits.
+type jpegBits struct {
+	data      []byte
+	pos       int
+	acc       uint64 // pending bits, most significant first
+	n         uint
+	marker    bool
+	truncated bool
+}
+
+// fill tops up the pending bits to more than 56
+func (b *jpegBits) fill() {
+	for b.n <= 56 {
+		var c byte
+		switch {
+		case b.marker:
+		case b.pos >= len(b.data):
+			b.truncated = true
+		case b.data[b.pos] != 0xff:
+			c = b.data[b.pos]
+			b.pos++
+		case b.pos+1 < len(b.data) && b.data[b.pos+1] == 0:
+			c = 0xff
+			b.pos += 2
+		default:
+			b.marker = true
+		}
+		b.acc |= uint64(c) << (56 - b.n)
+		b.n += 8
+	}
+}
+
+// decodeHuffman reads one symbol coded with h
+func (b *jpegBits) decodeHuffman(h *jpegHuffman) (uint8, error) {
+	b.fill()
+	if e := h.lookup[b.acc>>(64-jpegHuffmanLookupBits)]; e != 0 {
+		b.acc <<= e >> 8
+		b.n -= uint(e >> 8)
+		return uint8(e), nil
+	}
+	code := int32(0)
+	for l := 1; l <= 16; l++ {
+		code = code<<1 | int32(b.acc>>63)
+		b.acc <<= 1
+		b.n--
+		if code <= h.maxCode[l] {
+			return h.symbols[h.valPtr[l]+code-h.minCode[l]], nil
+		}
+	}
+	return 0, errors.New("invalid Huffman code")
+}
+
+// receiveExtend reads an s-bit coefficient value and sign-extends it
+func (b *jpegBits) receiveExtend(s uint8) int32 {
+	if s == 0 {
+		return 0
+	}
+	b.fill()
+	v := int32(b.acc >> (64 - s))
+	b.acc <<= s
+	b.n -= uint(s)
+	if v < 1<<(s-1) {
+		v -= 1<<s - 1
+	}
+	return v
+}
+
+// restart skips the RSTn marker ending a restart interval
+func (b *jpegBits) restart() error {
+	b.acc, b.n, b.marker = 0, 0, false
+	for b.pos < len(b.data) && b.data[b.pos] == 0xff {
+		b.pos++
+	}
+	if b.pos >= len(b.data) || b.data[b.pos] < 0xd0 || b.data[b.pos] > 0xd7 {
+		return errors.New("missing restart marker")
+	}
+	b.pos++
+	return nil
+}
+
+// jpegComponent is a colour component of a JPEG frame
+type jpegComponent struct {
+	index  int // position in the frame header
+	id     uint8
+	h, v   int
+	quant  uint8
+	dc, ac *jpegHuffman
+	pred   int32
+}
+
+// jpegFrame is a baseline JPEG with one scan holding every component, as
+// written by cameras and most encoders. Components are grayscale or YCbCr
+// with only the luma subsampled less than the chroma.
+type jpegFrame struct {
+	width, height int
+	comps         []*jpegComponent // in frame order
+	scanComps     []*jpegComponent // in scan order
+	quant         [4][64]int32     // natural order
+	restartEvery  int
+	mcusX, mcusY  int
+	scan          []byte
+}
+
+// parseBaselineJPEG reads the headers of a JPEG up to its first scan.
+// Progressive, arithmetic-coded, 12-bit, RGB and CMYK JPEGs, and those with
+// unusual sampling factors, fail with errUnsupportedJPEG.
+func parseBaselineJPEG(data []byte) (*jpegFrame, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errors.New("not a JPEG")
+	}
+
+	f := &jpegFrame{}
+	var dcTables, acTables [4]*jpegHuffman
+	var adobeRGB bool
+	pos := 2
+	for {
+		for pos < len(data) && data[pos] != 0xff {
+			pos++
+		}
+		for pos < len(data) && data[pos] == 0xff {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		marker := data[pos]
+		pos++
+		if marker >= 0xd0 && marker <= 0xd7 || marker == 0x01 {
+			continue
+		}
+		if marker == 0xd9 {
+			return nil, errors.New("no image data")
+		}
+		if pos+2 > len(data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		if length < 2 || pos+length > len(data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		segment := data[pos+2 : pos+length]
+		pos += length
+
+		switch {
+		case marker == 0xc0 || marker == 0xc1:
+			// Baseline or extended sequential, Huffman coded
+			if len(segment) < 6 || segment[0] != 8 {
+				return nil, errUnsupportedJPEG
+			}
+			f.height, f.width = int(binary.BigEndian.Uint16(segment[1:])), int(binary.BigEndian.Uint16(segment[3:]))
+			n := int(segment[5])
+			if f.width == 0 || f.height == 0 || n != 1 && n != 3 || len(segment) < 6+3*n {
+				return nil, errUnsupportedJPEG
+			}
+			f.comps = nil
+			for i := range n {
+				c := segment[6+3*i:]
+				if c[2] > 3 {
+					return nil, errors.New("invalid quantization table")
+				}
+				f.comps = append(f.comps, &jpegComponent{index: i, id: c[0], h: int(c[1] >> 4), v: int(c[1] & 15), quant: c[2]})
+			}
+
+		case marker >= 0xc2 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			return nil, errUnsupportedJPEG
+
+		case marker == 0xc4:
+			for len(segment) >= 17 {
+				class, id := segment[0]>>4, segment[0]&15
+				var counts [16]uint8
+				copy(counts[:], segment[1:17])
+				total := 0
+				for _, c := range counts {
+					total += int(c)
+				}
+				if class > 1 || id > 3 || len(segment) < 17+total {
+					return nil, errors.New("invalid Huffman table")
+				}
+				table := newJPEGHuffman(counts, segment[17:17+total])
+				if class == 0 {
+					dcTables[id] = table
+				} else {
+					acTables[id] = table
+				}
+				segment = segment[17+total:]
+			}
+
+		case marker == 0xdb:
+			for len(segment) >= 1 {
+				precision, id := segment[0]>>4, segment[0]&15
+				size := 64 << precision
+				if precision > 1 || id > 3 || len(segment) < 1+size {
+					return nil, errors.New("invalid quantization table")
+				}
+				for k := range 64 {
+					if precision == 0 {
+						f.quant[id][jpegZigzag[k]] = int32(segment[1+k])
+					} else {
+						f.quant[id][jpegZigzag[k]] = int32(binary.BigEndian.Uint16(segment[1+2*k:]))
+					}
+				}
+				segment = segment[1+size:]
+			}
+
+		case marker == 0xdd:
+			if len(segment) < 2 {
+				return nil, errors.New("invalid restart interval")
+			}
+			f.restartEvery = int(binary.BigEndian.Uint16(segment))
+
+		case marker == 0xee && len(segment) >= 12 && string(segment[:5]) == "Adobe":
+			adobeRGB = segment[11] == 0
+
+		case marker == 0xda:
+			if f.comps == nil {
+				return nil, errors.New("scan before frame header")
+			}
+			if err := f.checkLayout(adobeRGB); err != nil {
+				return nil, err
+			}
+			// Only a single scan holding every component is supported
+			n := len(f.comps)
+			if len(segment) < 4+2*n || int(segment[0]) != n {
+				return nil, errUnsupportedJPEG
+			}
+			f.scanComps = make([]*jpegComponent, n)
+			for i := range n {
+				sel := segment[1+2*i:]
+				for _, c := range f.comps {
+					if c.id == sel[0] {
+						f.scanComps[i] = c
+					}
+				}
+				dc, ac := dcTables[sel[1]>>4&3], acTables[sel[1]&3]
+				if f.scanComps[i] == nil || dc == nil || ac == nil {
+					return nil, errors.New("invalid scan header")
+				}
+				f.scanComps[i].dc, f.scanComps[i].ac = dc, ac
+			}
+			if spectral := segment[1+2*n:]; spectral[0] != 0 || spectral[1] != 63 || spectral[2] != 0 {
+				return nil, errUnsupportedJPEG
+			}
+			f.scan = data[pos:]
+			return f, nil
+		}
+	}
+}
+
+// checkLayout rejects colour models and sampling factors other than
+// grayscale and YCbCr with 1x1 chroma, and sets the MCU grid. A single
+// component is stored block by block whatever its sampling factors.
+func (f *jpegFrame) checkLayout(adobeRGB bool) error {
+	if len(f.comps) == 1 {
+		f.comps[0].h, f.comps[0].v = 1, 1
+	} else {
+		if adobeRGB || f.comps[0].id == 'R' && f.comps[1].id == 'G' && f.comps[2].id == 'B' {
+			return errUnsupportedJPEG
+		}
+		if _, ok := jpegSubsampleRatios[[2]int{f.comps[0].h, f.comps[0].v}]; !ok {
+			return errUnsupportedJPEG
+		}
+		for _, c := range f.comps[1:] {
+			if c.h != 1 || c.v != 1 {
+				return errUnsupportedJPEG
+			}
+		}
+	}
+	hmax, vmax := f.comps[0].h, f.comps[0].v
+	f.mcusX, f.mcusY = (f.width+8*hmax-1)/(8*hmax), (f.height+8*vmax-1)/(8*vmax)
+	return nil
+}
+
+// decodeBlocks entropy-decodes the scan, calling fn with the quantized
+// coefficients of every block in natural order. bx and by locate the block
+// in the component's grid of mcusX*h by mcusY*v blocks.
+func (f *jpegFrame) decodeBlocks(ctx context.Context, fn func(c *jpegComponent, bx, by int, coef *[64]int32)) error {
+	bits := jpegBits{data: f.scan}
+	left := f.restartEvery
+	var coef [64]int32
+	for my := range f.mcusY {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for mx := range f.mcusX {
+			if f.restartEvery > 0 {
+				if left == 0 {
+					if err := bits.restart(); err != nil {
+						return err
+					}
+					for _, c := range f.scanComps {
+						c.pred = 0
+					}
+					left = f.restartEvery
+				}
+				left--
+			}
+			for _, c := range f.scanComps {
+				for by := range c.v {
+					for bx := range c.h {
+						coef = [64]int32{}
+						t, err := bits.decodeHuffman(c.dc)
+						if err != nil {
+							return err
+						}
+						c.pred += bits.receiveExtend(t)
+						coef[0] = c.pred
+						for k := 1; k < 64; k++ {
+							rs, err := bits.decodeHuffman(c.ac)
+							if err != nil {
+								return err
+							}
+							r, s := int(rs>>4), rs&15
+							if s == 0 {
+								if r != 15 {
+									break
+								}
+								k += 15
+								continue
+							}
+							if k += r; k > 63 {
+								return errors.New("invalid AC coefficient run")
+							}
+							coef[jpegZigzag[k]] = bits.receiveExtend(s)
+						}
+						fn(c, mx*c.h+bx, my*c.v+by, &coef)
+					}
+				}
+			}
+		}
+		if bits.truncated {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
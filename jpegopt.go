@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/bits"
+	"sync"
+)
+
+// jpegScan is one scan of a progressive JPEG: the planes it codes, the
+// spectral band ss..se in zigzag order, and the successive approximation
+// bit positions ah (previous) and al (current)
+type jpegScan struct {
+	planes         []int
+	ss, se, ah, al int
+}
+
+// jpegProgressiveScripts returns the scan scripts tried by encodeOptimized
+// for an image with ncomps planes. The first is libjpeg's default
+// progression with successive approximation, the second sends each band at
+// full precision, which wins on small or flat images.
+func jpegProgressiveScripts(ncomps int) [][]jpegScan {
+	if ncomps == 1 {
+		y := []int{0}
+		return [][]jpegScan{
+			{
+				{y, 0, 0, 0, 1}, {y, 1, 5, 0, 2}, {y, 6, 63, 0, 2},
+				{y, 1, 63, 2, 1}, {y, 0, 0, 1, 0}, {y, 1, 63, 1, 0},
+			},
+			{{y, 0, 0, 0, 0}, {y, 1, 8, 0, 0}, {y, 9, 63, 0, 0}},
+		}
+	}
+	all, y, cb, cr := []int{0, 1, 2}, []int{0}, []int{1}, []int{2}
+	return [][]jpegScan{
+		{
+			{all, 0, 0, 0, 1}, {y, 1, 5, 0, 2}, {cr, 1, 63, 0, 1}, {cb, 1, 63, 0, 1},
+			{y, 6, 63, 0, 2}, {y, 1, 63, 2, 1}, {all, 0, 0, 1, 0},
+			{cr, 1, 63, 1, 0}, {cb, 1, 63, 1, 0}, {y, 1, 63, 1, 0},
+		},
+		{{all, 0, 0, 0, 0}, {y, 1, 8, 0, 0}, {y, 9, 63, 0, 0}, {cb, 1, 63, 0, 0}, {cr, 1, 63, 0, 0}},
+	}
+}
+
+// eachScanBlock calls fn with the blocks of a scan in coding order: whole
+// MCUs when it interleaves several planes, otherwise only the blocks of its
+// plane that overlap the image, row by row
+func (c *jpegCoefficients) eachScanBlock(planes []int, fn func(plane int, block *[64]int16)) {
+	if len(planes) == 1 {
+		p := &c.planes[planes[0]]
+		hmax, vmax := 1, 1
+		for _, q := range c.planes {
+			hmax, vmax = max(hmax, q.h), max(vmax, q.v)
+		}
+		blocksW := ((c.width*p.h+hmax-1)/hmax + 7) / 8
+		blocksH := ((c.height*p.v+vmax-1)/vmax + 7) / 8
+		for by := range blocksH {
+			for bx := range blocksW {
+				fn(planes[0], &p.blocks[by*p.blocksW+bx])
+			}
+		}
+		return
+	}
+	mcusX, mcusY := c.planes[0].blocksW/c.planes[0].h, c.planes[0].blocksH/c.planes[0].v
+	for my := range mcusY {
+		for mx := range mcusX {
+			for _, i := range planes {
+				p := &c.planes[i]
+				for by := range p.v {
+					for bx := range p.h {
+						fn(i, &p.blocks[(my*p.v+by)*p.blocksW+mx*p.h+bx])
+					}
+				}
+			}
+		}
+	}
+}
+
+// encodeScan produces the entropy-coded data of a progressive scan as calls
+// to symbol, for each Huffman symbol, and raw for the bits between them.
+// It follows the encoder in libjpeg's jcphuff.c, including the end-of-band
+// runs that let one symbol cover many blocks.
+func (c *jpegCoefficients) encodeScan(s jpegScan, symbol func(plane int, sym uint8), raw func(v uint32, n uint8)) {
+	preds := make([]int32, len(c.planes))
+	var eobRun int
+	var runPlane int
+	var pending, correction []uint8 // correction bits held back with an end-of-band run or a zero run
+	flushEOBRun := func() {
+		if eobRun == 0 {
+			return
+		}
+		n := uint8(bits.Len(uint(eobRun)) - 1)
+		symbol(runPlane, n<<4)
+		raw(uint32(eobRun), n)
+		eobRun = 0
+		for _, b := range pending {
+			raw(uint32(b), 1)
+		}
+		pending = pending[:0]
+	}
+
+	c.eachScanBlock(s.planes, func(plane int, block *[64]int16) {
+		switch {
+		case s.ss == 0 && s.ah == 0:
+			v := int32(block[0]) >> s.al
+			diff := v - preds[plane]
+			preds[plane] = v
+			size := jpegCategory(diff)
+			symbol(plane, size)
+			raw(jpegExtraBits(diff, size), size)
+
+		case s.ss == 0:
+			raw(uint32(block[0]>>s.al)&1, 1)
+
+		case s.ah == 0:
+			runPlane = plane
+			run := 0
+			for k := s.ss; k <= s.se; k++ {
+				v := int32(block[jpegZigzag[k]])
+				sign := int32(1)
+				if v < 0 {
+					v, sign = -v, -1
+				}
+				v >>= s.al
+				if v == 0 {
+					run++
+					continue
+				}
+				flushEOBRun()
+				for ; run > 15; run -= 16 {
+					symbol(plane, 0xf0)
+				}
+				size := jpegCategory(v)
+				symbol(plane, uint8(run)<<4|size)
+				raw(jpegExtraBits(sign*v, size), size)
+				run = 0
+			}
+			if run > 0 {
+				if eobRun++; eobRun == 0x7fff {
+					flushEOBRun()
+				}
+			}
+
+		default:
+			runPlane = plane
+			var abs [64]int32
+			eob := 0
+			for k := s.ss; k <= s.se; k++ {
+				v := int32(block[jpegZigzag[k]])
+				abs[k] = max(v, -v) >> s.al
+				if abs[k] == 1 {
+					eob = k
+				}
+			}
+			run := 0
+			correction = correction[:0]
+			for k := s.ss; k <= s.se; k++ {
+				if abs[k] == 0 {
+					run++
+					continue
+				}
+				// Zero runs are only coded when a newly nonzero
+				// coefficient follows; otherwise they join the EOB run
+				for ; run > 15 && k <= eob; run -= 16 {
+					flushEOBRun()
+					symbol(plane, 0xf0)
+					for _, b := range correction {
+						raw(uint32(b), 1)
+					}
+					correction = correction[:0]
+				}
+				if abs[k] > 1 {
+					correction = append(correction, uint8(abs[k]&1))
+					continue
+				}
+				flushEOBRun()
+				symbol(plane, uint8(run)<<4|1)
+				sign := uint32(1)
+				if block[jpegZigzag[k]] < 0 {
+					sign = 0
+				}
+				raw(sign, 1)
+				for _, b := range correction {
+					raw(uint32(b), 1)
+				}
+				correction = correction[:0]
+				run = 0
+			}
+			if run > 0 || len(correction) > 0 {
+				eobRun++
+				pending = append(pending, correction...)
+				if eobRun == 0x7fff || len(pending) > 937 {
+					flushEOBRun()
+				}
+			}
+		}
+	})
+	flushEOBRun()
+}
+
+// encodeProgressive writes the coefficients as a progressive JPEG following
+// script, with Huffman tables optimized for each scan
+func (c *jpegCoefficients) encodeProgressive(out io.Writer, script []jpegScan) error {
+	w := bufio.NewWriter(out)
+	c.writeFrameHeader(w, true)
+	for _, s := range script {
+		// DC scans code luma and chroma with separate tables, AC scans
+		// hold a single plane
+		dc := s.ss == 0
+		tableOf := func(plane int) int {
+			if dc {
+				return min(plane, 1)
+			}
+			return 0
+		}
+
+		var codes [2][256]jpegHuffmanCode
+		if !dc || s.ah == 0 {
+			var freq [2][256]int
+			c.encodeScan(s, func(plane int, sym uint8) { freq[tableOf(plane)][sym]++ }, func(uint32, uint8) {})
+			class := 0
+			if !dc {
+				class = 1
+			}
+			for t := range freq {
+				if freq[t] == [256]int{} {
+					continue
+				}
+				counts, symbols, tableCodes := buildJPEGHuffman(freq[t])
+				writeJPEGSegment(w, 0xc4, append(append([]byte{uint8(class<<4 | t)}, counts[:]...), symbols...))
+				codes[t] = tableCodes
+			}
+		}
+
+		sos := []byte{uint8(len(s.planes))}
+		for _, i := range s.planes {
+			t := uint8(tableOf(i))
+			if dc {
+				sos = append(sos, c.planes[i].id, t<<4)
+			} else {
+				sos = append(sos, c.planes[i].id, t)
+			}
+		}
+		writeJPEGSegment(w, 0xda, append(sos, uint8(s.ss), uint8(s.se), uint8(s.ah<<4|s.al)))
+
+		bw := jpegBitWriter{w: w}
+		c.encodeScan(s, func(plane int, sym uint8) {
+			code := codes[tableOf(plane)][sym]
+			bw.emit(uint32(code.code), code.size)
+		}, bw.emit)
+		bw.flush()
+	}
+	w.Write([]byte{0xff, 0xd9})
+	return w.Flush()
+}
+
+// encodeOptimized writes the coefficients as the smallest of a baseline JPEG
+// and the progressive scripts of jpegProgressiveScripts, all with optimized
+// Huffman tables. The candidates are encoded concurrently.
+func (c *jpegCoefficients) encodeOptimized(out io.Writer) error {
+	scripts := jpegProgressiveScripts(len(c.planes))
+	if encodeEffort >= 0 && encodeEffort <= 2 {
+		scripts = nil
+	}
+	candidates := make([]bytes.Buffer, len(scripts)+1)
+	errs := make([]error, len(candidates))
+	var wg sync.WaitGroup
+	for i := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i == 0 {
+				errs[i] = c.encode(&candidates[i])
+			} else {
+				errs[i] = c.encodeProgressive(&candidates[i], scripts[i-1])
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	best := 0
+	for i := range candidates {
+		if candidates[i].Len() < candidates[best].Len() {
+			best = i
+		}
+	}
+	mode := "progressive"
+	if best == 0 {
+		mode = "baseline"
+	}
+	slog.Debug("Chose JPEG encoding", "mode", mode, "bytes", candidates[best].Len())
+	_, err := out.Write(candidates[best].Bytes())
+	return err
+}
+
+// optimizeJPEG rewrites an encoded JPEG with encodeOptimized, leaving the
+// coefficients and so the pixels untouched. JPEGs the coefficient reader
+// does not support are returned as they are.
+func optimizeJPEG(ctx context.Context, data []byte) ([]byte, error) {
+	c, err := readJPEGCoefficients(ctx, data)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		slog.Debug("Cannot optimize JPEG", "reason", err)
+		return data, nil
+	}
+	var optimized bytes.Buffer
+	if err := c.encodeOptimized(&optimized); err != nil {
+		return nil, err
+	}
+	if optimized.Len() >= len(data) {
+		return data, nil
+	}
+	slog.Info("Optimized JPEG", "before", len(data), "after", optimized.Len())
+	return optimized.Bytes(), nil
+}
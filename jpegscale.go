@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log/slog"
+	"math"
+)
+
+// jpegIDCTCos holds, for block sizes 2 and 4, the basis of the reduced
+// inverse DCT: 1/2·C(u)·cos((2x+1)uπ/2n). Keeping the 8-point normalization
+// makes each output pixel approximate the mean of the pixels it replaces.
+var jpegIDCTCos = func() (t [5][4][4]float32) {
+	for _, n := range []int{2, 4} {
+		for x := range n {
+			for u := range n {
+				c := 0.5 * math.Cos(float64(2*x+1)*float64(u)*math.Pi/float64(2*n))
+				if u == 0 {
+					c *= math.Sqrt2 / 2
+				}
+				t[n][x][u] = float32(c)
+			}
+		}
+	}
+	return t
+}()
+
+// jpegSubsampleRatios maps the sampling factors of the luma component to
+// the chroma subsampling it implies
+var jpegSubsampleRatios = map[[2]int]image.YCbCrSubsampleRatio{
+	{1, 1}: image.YCbCrSubsampleRatio444, {2, 1}: image.YCbCrSubsampleRatio422,
+	{2, 2}: image.YCbCrSubsampleRatio420, {1, 2}: image.YCbCrSubsampleRatio440,
+	{4, 1}: image.YCbCrSubsampleRatio411, {4, 2}: image.YCbCrSubsampleRatio410,
+}
+
+// decodeScaledJPEG decodes a baseline JPEG at 1/scale of its size, where
+// scale is 2, 4 or 8, by running a reduced inverse DCT on the low-frequency
+// coefficients of each block. This skips most of the IDCT work and never
+// allocates the full-size frame.
+func decodeScaledJPEG(ctx context.Context, data []byte, scale int) (image.Image, error) {
+	f, err := parseBaselineJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+
+	n := 8 / scale
+	planes := make([][]uint8, len(f.comps))
+	strides := make([]int, len(f.comps))
+	for i, c := range f.comps {
+		strides[i] = f.mcusX * c.h * n
+		planes[i] = make([]uint8, strides[i]*f.mcusY*c.v*n)
+	}
+	err = f.decodeBlocks(ctx, func(c *jpegComponent, bx, by int, coef *[64]int32) {
+		stride := strides[c.index]
+		idctScaled(planes[c.index][by*n*stride+bx*n:], stride, n, coef, &f.quant[c.quant])
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := image.Rect(0, 0, (f.width+scale-1)/scale, (f.height+scale-1)/scale)
+	if len(f.comps) == 1 {
+		return &image.Gray{Pix: planes[0], Stride: strides[0], Rect: bounds}, nil
+	}
+	return &image.YCbCr{
+		Y: planes[0], Cb: planes[1], Cr: planes[2],
+		YStride: strides[0], CStride: strides[1],
+		SubsampleRatio: jpegSubsampleRatios[[2]int{f.comps[0].h, f.comps[0].v}], Rect: bounds,
+	}, nil
+}
+
+// idctScaled writes the n×n pixels reconstructed from the top-left n×n
+// coefficients of coef, quantized with quant, to dst
+func idctScaled(dst []uint8, stride, n int, coef, quant *[64]int32) {
+	if n == 1 {
+		dst[0] = clampUint8((coef[0]*quant[0]+4)>>3 + 128)
+		return
+	}
+	cos := &jpegIDCTCos[n]
+	var rows [4][4]float32
+	for v := range n {
+		for x := range n {
+			var sum float32
+			for u := range n {
+				sum += cos[x][u] * float32(coef[v*8+u]*quant[v*8+u])
+			}
+			rows[v][x] = sum
+		}
+	}
+	for y := range n {
+		for x := range n {
+			var sum float32
+			for v := range n {
+				sum += cos[y][v] * rows[v][x]
+			}
+			dst[y*stride+x] = clampUint8(int32(math.Round(float64(sum))) + 128)
+		}
+	}
+}
+
+// clampUint8 limits v to the range of a uint8
+func clampUint8(v int32) uint8 {
+	return uint8(min(max(v, 0), 255))
+}
+
+// decodeJPEGReduced decodes a JPEG at the smallest DCT scale (1/2, 1/4 or
+// 1/8) that still covers the image resized by resizePercent, and returns the
+// full image's dimensions alongside. ok is false if no reduction applies or
+// the JPEG needs the standard decoder.
+func decodeJPEGReduced(ctx context.Context, data []byte, resizePercent float64) (img image.Image, full image.Config, ok bool) {
+	if resizePercent <= 0 || !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return nil, full, false
+	}
+	full, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, full, false
+	}
+
+	width, height := resizedDimensions(image.Rect(0, 0, full.Width, full.Height), resizePercent)
+	scale := 1
+	for s := 2; s <= 8; s *= 2 {
+		if (full.Width+s-1)/s < int(width) || (full.Height+s-1)/s < int(height) {
+			break
+		}
+		scale = s
+	}
+	if scale == 1 {
+		return nil, full, false
+	}
+
+	img, err = decodeScaledJPEG(ctx, data, scale)
+	if err != nil {
+		slog.Debug("Decoding JPEG at full scale", "reason", err)
+		return nil, full, false
+	}
+	slog.Info("Decoded JPEG with DCT scaling", "scale", fmt.Sprintf("1/%d", scale))
+	return img, full, true
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"slices"
+	"strings"
+)
+
+// dctTransform is implemented by operations that can also be carried out
+// by rearranging the DCT blocks of a JPEG, as jpegtran does, so that the
+// image is not decoded and quantized again
+type dctTransform interface {
+	transformDCT(c *jpegCoefficients) error
+}
+
+// flipHorizontal mirrors the blocks left to right. The right edge must fall
+// on an MCU boundary, or the partial MCU would end up on the left.
+func (c *jpegCoefficients) flipHorizontal() error {
+	mcuWidth, _ := c.mcuSize()
+	if c.width%mcuWidth != 0 {
+		return fmt.Errorf("width %d is not a multiple of the %d-pixel JPEG block size", c.width, mcuWidth)
+	}
+	for i := range c.planes {
+		p := &c.planes[i]
+		for by := range p.blocksH {
+			row := p.blocks[by*p.blocksW : (by+1)*p.blocksW]
+			slices.Reverse(row)
+			for b := range row {
+				// Odd horizontal frequencies change sign
+				for k := 1; k < 64; k += 2 {
+					row[b][k] = -row[b][k]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// flipVertical mirrors the blocks top to bottom. The bottom edge must fall
+// on an MCU boundary.
+func (c *jpegCoefficients) flipVertical() error {
+	_, mcuHeight := c.mcuSize()
+	if c.height%mcuHeight != 0 {
+		return fmt.Errorf("height %d is not a multiple of the %d-pixel JPEG block size", c.height, mcuHeight)
+	}
+	for i := range c.planes {
+		p := &c.planes[i]
+		for top, bottom := 0, p.blocksH-1; top < bottom; top, bottom = top+1, bottom-1 {
+			for bx := range p.blocksW {
+				a, b := &p.blocks[top*p.blocksW+bx], &p.blocks[bottom*p.blocksW+bx]
+				*a, *b = *b, *a
+			}
+		}
+		for b := range p.blocks {
+			// Odd vertical frequencies change sign
+			for k := 8; k < 64; k += 16 {
+				for u := range 8 {
+					p.blocks[b][k+u] = -p.blocks[b][k+u]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// transpose swaps rows and columns, including the sampling factors and
+// quantization tables. Partial MCUs stay on the right and bottom edges, so
+// it always applies.
+func (c *jpegCoefficients) transpose() {
+	c.width, c.height = c.height, c.width
+	for i := range c.quant {
+		c.quant[i] = transposeBlock(c.quant[i])
+	}
+	for i := range c.planes {
+		p := &c.planes[i]
+		blocks := make([][64]int16, len(p.blocks))
+		for by := range p.blocksH {
+			for bx := range p.blocksW {
+				blocks[bx*p.blocksH+by] = transposeBlock(p.blocks[by*p.blocksW+bx])
+			}
+		}
+		p.blocks = blocks
+		p.blocksW, p.blocksH = p.blocksH, p.blocksW
+		p.h, p.v = p.v, p.h
+	}
+}
+
+// transposeBlock swaps the horizontal and vertical frequencies of a block
+func transposeBlock[T int16 | int32](block [64]T) (t [64]T) {
+	for v := range 8 {
+		for u := range 8 {
+			t[u*8+v] = block[v*8+u]
+		}
+	}
+	return t
+}
+
+// crop keeps the blocks inside r. Its top-left corner must fall on an MCU
+// boundary; the right and bottom edges may cut through blocks, whose extra
+// pixels the decoder drops.
+func (c *jpegCoefficients) crop(r image.Rectangle) error {
+	mcuWidth, mcuHeight := c.mcuSize()
+	if r.Min.X%mcuWidth != 0 || r.Min.Y%mcuHeight != 0 {
+		return fmt.Errorf("crop offset %d,%d is not a multiple of the %dx%d JPEG block size", r.Min.X, r.Min.Y, mcuWidth, mcuHeight)
+	}
+	mcusX, mcusY := (r.Dx()+mcuWidth-1)/mcuWidth, (r.Dy()+mcuHeight-1)/mcuHeight
+	for i := range c.planes {
+		p := &c.planes[i]
+		x0, y0 := r.Min.X/mcuWidth*p.h, r.Min.Y/mcuHeight*p.v
+		width, height := mcusX*p.h, mcusY*p.v
+		blocks := make([][64]int16, 0, width*height)
+		for by := y0; by < y0+height; by++ {
+			blocks = append(blocks, p.blocks[by*p.blocksW+x0:by*p.blocksW+x0+width]...)
+		}
+		p.blocks, p.blocksW, p.blocksH = blocks, width, height
+	}
+	c.width, c.height = r.Dx(), r.Dy()
+	return nil
+}
+
+// losslessJPEGTransforms returns the operations to apply to a JPEG input in
+// the DCT domain, or nil unless the output is a JPEG and every requested
+// change is one of those operations. With -optimize alone the list is empty
+// but not nil, and the JPEG is only re-encoded losslessly.
+func (o *processOptions) losslessJPEGTransforms(name string, data []byte) []dctTransform {
+	if len(o.ops) == 0 && !o.Optimize || len(o.Formats) > 0 || !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return nil
+	}
+	if o.ResizePercent != 0 || o.MaxWidth != 0 || o.MaxHeight != 0 || o.CompressLevel != 0 || o.AutoQuality != 0 || o.ConvertToIco || o.Depth == 16 ||
+		o.ICCConvert != "" || o.ICCTarget != "" || !strings.EqualFold(o.Colorspace, "rgb") && o.Colorspace != "" {
+		return nil
+	}
+	if format := strings.ToLower(o.outputFormat(name)); format != "" && format != "jpeg" && format != "jpg" {
+		return nil
+	}
+	transforms := []dctTransform{}
+	for _, op := range o.ops {
+		t, ok := op.(dctTransform)
+		if !ok {
+			return nil
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms
+}
+
+// transformJPEGLossless reads the DCT blocks of a JPEG and applies
+// transforms to them. It fails if the JPEG is not a supported baseline JPEG
+// or its edges do not allow a transform, and also returns the size of the
+// source image.
+func transformJPEGLossless(ctx context.Context, data []byte, transforms []dctTransform) (c *jpegCoefficients, width, height int, err error) {
+	c, err = readJPEGCoefficients(ctx, data)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	width, height = c.width, c.height
+	for _, t := range transforms {
+		if err := t.transformDCT(c); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	return c, width, height, nil
+}
+
+// writeLosslessJPEG encodes transformed DCT blocks to w with the metadata
+// processImage would keep
+func writeLosslessJPEG(o *processOptions, data []byte, c *jpegCoefficients, w io.Writer) error {
+	metadata, err := o.outputMetadata(data)
+	if err != nil {
+		return err
+	}
+	var encoded bytes.Buffer
+	encode := c.encode
+	if o.Optimize {
+		encode = c.encodeOptimized
+	}
+	if err := encode(&encoded); err != nil {
+		return fmt.Errorf("failed to encode output image: %w", err)
+	}
+	encodedData, err := embedMetadata(encoded.Bytes(), "jpeg", metadata)
+	if err != nil {
+		return fmt.Errorf("failed to embed metadata: %w", err)
+	}
+	if _, err := w.Write(encodedData); err != nil {
+		return fmt.Errorf("failed to write output image: %w", err)
+	}
+	return nil
+}
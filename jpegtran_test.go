@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"slices"
+	"testing"
+)
+
+// testJPEG encodes a width x height image whose left half is dark and right
+// half is light, with a gradient and colored stripes so every block and
+// chroma plane holds something, as a 4:2:0 JPEG with 16x16 MCUs
+func testJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			v := uint8(40 + 40*x/width + 30*y/height)
+			if x >= width/2 {
+				v += 120
+			}
+			img.Set(x, y, color.RGBA{v, uint8(int(v) * (y % 7) / 7), uint8(255 - int(v)*(x%5)/5), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// encodeCoefficients writes c as a JPEG and reads its blocks back
+func encodeCoefficients(t *testing.T, c *jpegCoefficients) (*jpegCoefficients, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := c.encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	again, err := readJPEGCoefficients(context.Background(), buf.Bytes())
+	if err != nil {
+		t.Fatalf("reading the transformed JPEG: %v", err)
+	}
+	return again, buf.Bytes()
+}
+
+// sameCoefficients reports whether a and b hold identical blocks and tables
+func sameCoefficients(a, b *jpegCoefficients) bool {
+	if a.width != b.width || a.height != b.height || a.quant != b.quant || len(a.planes) != len(b.planes) {
+		return false
+	}
+	for i := range a.planes {
+		p, q := a.planes[i], b.planes[i]
+		if p.h != q.h || p.v != q.v || p.blocksW != q.blocksW || p.blocksH != q.blocksH || !slices.Equal(p.blocks, q.blocks) {
+			return false
+		}
+	}
+	return true
+}
+
+// meanDifference returns the mean absolute difference of the channels of a
+// and b, which must be the same size
+func meanDifference(a, b image.Image) float64 {
+	var sum, n float64
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x-bounds.Min.X+b.Bounds().Min.X, y-bounds.Min.Y+b.Bounds().Min.Y).RGBA()
+			for _, d := range [...]int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8)} {
+				sum += float64(max(d, -d))
+				n++
+			}
+		}
+	}
+	return sum / n
+}
+
+func TestLosslessJPEGTransformsRoundTrip(t *testing.T) {
+	data := testJPEG(t, 64, 48)
+	original, err := readJPEGCoefficients(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		op, undo Operation
+	}{
+		{"rotate 90", rotateOp{90}, rotateOp{270}},
+		{"rotate 180", rotateOp{180}, rotateOp{180}},
+		{"rotate 270", rotateOp{270}, rotateOp{90}},
+		{"flip horizontal", flipOp{horizontal: true}, flipOp{horizontal: true}},
+		{"flip vertical", flipOp{}, flipOp{}},
+	} {
+		c, _, _, err := transformJPEGLossless(context.Background(), data, []dctTransform{tc.op.(dctTransform)})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		transformed, encoded := encodeCoefficients(t, c)
+
+		// The pixels must match the same operation on the decoded image, up to
+		// the rounding of the IDCT and chroma upsampling
+		got, err := jpeg.Decode(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		want, err := tc.op.Apply(context.Background(), decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Bounds().Size() != want.Bounds().Size() {
+			t.Fatalf("%s: got %v, want %v", tc.name, got.Bounds().Size(), want.Bounds().Size())
+		}
+		if d := meanDifference(got, want); d > 2 {
+			t.Errorf("%s: pixels differ by %.2f on average from transforming the decoded image", tc.name, d)
+		}
+
+		// Undoing the transform on the written JPEG must give back the exact
+		// blocks, so nothing was quantized again
+		if err := tc.undo.(dctTransform).transformDCT(transformed); err != nil {
+			t.Fatalf("%s: undoing: %v", tc.name, err)
+		}
+		if !sameCoefficients(transformed, original) {
+			t.Errorf("%s: undoing the transform did not restore the original DCT blocks", tc.name)
+		}
+	}
+}
+
+func TestLosslessJPEGTransformNeedsWholeMCUs(t *testing.T) {
+	data := testJPEG(t, 60, 44)
+	for _, op := range []dctTransform{rotateOp{90}, rotateOp{180}, rotateOp{270}, flipOp{horizontal: true}, flipOp{}} {
+		if _, _, _, err := transformJPEGLossless(context.Background(), data, []dctTransform{op}); err == nil {
+			t.Errorf("%v on a 60x44 JPEG with 16x16 MCUs succeeded, want an error", op)
+		}
+	}
+	// A crop only needs its top-left corner on an MCU boundary
+	if _, _, _, err := transformJPEGLossless(context.Background(), data, []dctTransform{cropOp{image.Rect(16, 16, 50, 40)}}); err != nil {
+		t.Errorf("cropping from an MCU boundary: %v", err)
+	}
+}
+
+func TestLosslessJPEGFallsBackToReencoding(t *testing.T) {
+	data := testJPEG(t, 60, 44)
+	o := &processOptions{Filter: "lanczos", ops: []Operation{flipOp{horizontal: true}}}
+	if o.losslessJPEGTransforms("in.jpg", data) == nil {
+		t.Fatal("a lone flip of a JPEG is not tried losslessly")
+	}
+
+	var buf bytes.Buffer
+	result, err := processImage(context.Background(), o, "in.jpg", data, nil, "out.jpg", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Width != 60 || result.Height != 44 {
+		t.Errorf("result is %dx%d, want 60x44", result.Width, result.Height)
+	}
+	img, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatalf("output is not a JPEG: %v", err)
+	}
+	if img.Bounds().Dx() != 60 || img.Bounds().Dy() != 44 {
+		t.Fatalf("output is %v, want 60x44", img.Bounds().Size())
+	}
+	// The light half of the image is now on the left
+	left, _, _, _ := img.At(5, 22).RGBA()
+	right, _, _, _ := img.At(54, 22).RGBA()
+	if left <= right {
+		t.Errorf("left red %d is not lighter than right red %d after flipping", left>>8, right>>8)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// decodeLimits bounds the size of images accepted for decoding so that
+// crafted or oversized uploads are rejected before any pixel memory is
+// allocated. Zero disables a limit.
+type decodeLimits struct {
+	MaxPixels     int64
+	MaxInputBytes int64
+}
+
+// inputLimits holds the limits applied by decodeImage and decodePDFPage
+var inputLimits decodeLimits
+
+// readInput reads all of r, failing as soon as it exceeds the byte limit
+func (l decodeLimits) readInput(r io.Reader) ([]byte, error) {
+	if l.MaxInputBytes <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, l.MaxInputBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > l.MaxInputBytes {
+		return nil, fmt.Errorf("input exceeds the limit of %d bytes", l.MaxInputBytes)
+	}
+	return data, nil
+}
+
+// checkDimensions rejects images whose pixel count exceeds the limit
+func (l decodeLimits) checkDimensions(width, height int) error {
+	if l.MaxPixels <= 0 {
+		return nil
+	}
+	// Compare without multiplying, which could overflow
+	if width > 0 && int64(height) > l.MaxPixels/int64(width) {
+		return fmt.Errorf("image is %dx%d, exceeding the limit of %d pixels", width, height, l.MaxPixels)
+	}
+	return nil
+}
+
+// checkOutputSize rejects an output of width x height with more pixels than
+// maxPixels before it is allocated. Zero disables the limit, and a side of 0,
+// not known yet, passes.
+func checkOutputSize(width, height int, maxPixels int64) error {
+	if maxPixels > 0 && width > 0 && int64(height) > maxPixels/int64(width) {
+		return fmt.Errorf("the output would be %dx%d, more than the limit of %d pixels", width, height, maxPixels)
+	}
+	return nil
+}
+
+// checkHeader reads the image dimensions from the header of data and checks
+// them against the pixel limit. PDFs are checked per page by decodePDFPage, and
+// data whose header cannot be read is left for the decoder to reject.
+func (l decodeLimits) checkHeader(data []byte) error {
+	if l.MaxPixels <= 0 || bytes.HasPrefix(data, []byte("%PDF-")) {
+		return nil
+	}
+	config, _, err := decodeConfig(data)
+	if err != nil {
+		return nil
+	}
+	slog.Log(context.Background(), levelTrace, "Checked image header", "width", config.Width, "height", config.Height)
+	return l.checkDimensions(config.Width, config.Height)
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestCheckDimensions(t *testing.T) {
+	l := decodeLimits{MaxPixels: 1000000}
+	tests := []struct {
+		width, height int
+		ok            bool
+	}{
+		{1000, 1000, true},
+		{1000000, 1, true},
+		{1001, 1000, false},
+		{1000000, 2, false},
+		// The product wraps around to 0 in 64 bits
+		{4294967296, 4294967296, false},
+		{1 << 62, 4, false},
+	}
+	for _, tt := range tests {
+		if err := l.checkDimensions(tt.width, tt.height); (err == nil) != tt.ok {
+			t.Errorf("checkDimensions(%d, %d) = %v, want ok %v", tt.width, tt.height, err, tt.ok)
+		}
+	}
+	if err := (decodeLimits{}).checkDimensions(4294967296, 4294967296); err != nil {
+		t.Errorf("no limit: %v", err)
+	}
+}
+
+func TestCheckOutputSize(t *testing.T) {
+	if err := checkOutputSize(65536, 65536, 100_000_000); err == nil {
+		t.Error("65536x65536 passed a limit of 100000000 pixels")
+	}
+	for _, size := range [][2]int{{10000, 10000}, {65536, 0}, {0, 65536}} {
+		if err := checkOutputSize(size[0], size[1], 100_000_000); err != nil {
+			t.Errorf("%dx%d: %v", size[0], size[1], err)
+		}
+	}
+	if err := checkOutputSize(65536, 65536, 0); err != nil {
+		t.Errorf("no limit: %v", err)
+	}
+}
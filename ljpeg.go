@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Lossless JPEG (SOF3) is the compression of most DNG raw data. Each sample
+// is predicted from its decoded neighbours and only the Huffman-coded
+// difference is stored.
+
+// losslessJPEG is a decoded lossless JPEG: width×height pixels of components
+// interleaved samples
+type losslessJPEG struct {
+	width, height, components int
+	samples                   []uint16
+}
+
+// ljpegHuffman is a Huffman table with a lookup table for codes of up to
+// ljpegLookupBits bits
+type ljpegHuffman struct {
+	lookup  [1 << ljpegLookupBits]uint16 // code length << 8 | value, 0 for longer codes
+	maxCode [17]int32
+	minCode [17]int32
+	valPtr  [17]int32
+	values  []uint8
+}
+
+const ljpegLookupBits = 9
+
+// newLJPEGHuffman builds a table from the code counts per length and the
+// values of a DHT segment
+func newLJPEGHuffman(counts [16]uint8, values []uint8) *ljpegHuffman {
+	h := &ljpegHuffman{values: values}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		h.valPtr[l], h.minCode[l], h.maxCode[l] = k, code, -1
+		for n := 0; n < int(counts[l-1]); n++ {
+			if l <= ljpegLookupBits {
+				shift := ljpegLookupBits - l
+				for i := code << shift; i < (code+1)<<shift; i++ {
+					h.lookup[i] = uint16(l)<<8 | uint16(values[k])
+				}
+			}
+			code++
+			k++
+		}
+		if counts[l-1] > 0 {
+			h.maxCode[l] = code - 1
+		}
+		code <<= 1
+	}
+	return h
+}
+
+// ljpegBits reads the entropy-coded data of a scan, removing stuffed zero
+// bytes and feeding zeros once a marker is reached
+type ljpegBits struct {
+	data   []byte
+	pos    int
+	acc    uint64
+	n      uint
+	marker bool
+}
+
+func (b *ljpegBits) fill() {
+	for b.n <= 56 {
+		var c byte
+		if !b.marker && b.pos < len(b.data) {
+			c = b.data[b.pos]
+			if c == 0xff && b.pos+1 < len(b.data) && b.data[b.pos+1] != 0 {
+				b.marker, c = true, 0
+			} else if c == 0xff {
+				b.pos += 2
+			} else {
+				b.pos++
+			}
+		}
+		b.acc |= uint64(c) << (56 - b.n)
+		b.n += 8
+	}
+}
+
+func (b *ljpegBits) take(n uint) uint32 {
+	v := uint32(b.acc >> (64 - n))
+	b.acc <<= n
+	b.n -= n
+	return v
+}
+
+// restart skips past the next restart marker and starts reading afresh
+func (b *ljpegBits) restart() error {
+	for b.pos+1 < len(b.data) && !(b.data[b.pos] == 0xff && b.data[b.pos+1] >= 0xd0 && b.data[b.pos+1] <= 0xd7) {
+		b.pos++
+	}
+	if b.pos+1 >= len(b.data) {
+		return errors.New("missing lossless JPEG restart marker")
+	}
+	b.pos += 2
+	b.acc, b.n, b.marker = 0, 0, false
+	return nil
+}
+
+// diff decodes the next difference coded with h
+func (b *ljpegBits) diff(h *ljpegHuffman) (int, error) {
+	b.fill()
+	var size uint8
+	if e := h.lookup[b.acc>>(64-ljpegLookupBits)]; e != 0 {
+		b.take(uint(e >> 8))
+		size = uint8(e)
+	} else {
+		l := ljpegLookupBits + 1
+		for ; l <= 16; l++ {
+			if code := int32(b.acc >> (64 - l)); code <= h.maxCode[l] {
+				b.take(uint(l))
+				size = h.values[h.valPtr[l]+code-h.minCode[l]]
+				break
+			}
+		}
+		if l > 16 {
+			return 0, errors.New("invalid lossless JPEG Huffman code")
+		}
+	}
+	switch {
+	case size == 0:
+		return 0, nil
+	case size == 16:
+		return 32768, nil
+	case size > 16:
+		return 0, fmt.Errorf("invalid lossless JPEG difference size %d", size)
+	}
+	b.fill()
+	v := int(b.take(uint(size)))
+	if v < 1<<(size-1) {
+		v -= 1<<size - 1
+	}
+	return v, nil
+}
+
+// decodeLosslessJPEG decodes a lossless JPEG with one scan holding every
+// component, as written by DNG converters and cameras
+func decodeLosslessJPEG(data []byte) (*losslessJPEG, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errors.New("not a JPEG")
+	}
+	var tables [4]*ljpegHuffman
+	var precision, restartInterval int
+	var ids []uint8
+	img := &losslessJPEG{}
+	pos := 2
+	for {
+		for pos+1 < len(data) && data[pos] == 0xff && data[pos+1] == 0xff {
+			pos++
+		}
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return nil, errors.New("truncated lossless JPEG")
+		}
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, errors.New("truncated lossless JPEG segment")
+		}
+		seg := data[pos+4 : pos+2+length]
+		pos += 2 + length
+
+		switch {
+		case marker == 0xc4:
+			for len(seg) >= 17 {
+				class, id := seg[0]>>4, seg[0]&15
+				var counts [16]uint8
+				total := 0
+				for i := range counts {
+					counts[i] = seg[1+i]
+					total += int(counts[i])
+				}
+				if id > 3 || len(seg) < 17+total {
+					return nil, errors.New("invalid lossless JPEG Huffman table")
+				}
+				if class == 0 {
+					tables[id] = newLJPEGHuffman(counts, seg[17:17+total])
+				}
+				seg = seg[17+total:]
+			}
+		case marker == 0xc3:
+			if len(seg) < 6 {
+				return nil, errors.New("invalid lossless JPEG frame header")
+			}
+			precision = int(seg[0])
+			img.height = int(binary.BigEndian.Uint16(seg[1:]))
+			img.width = int(binary.BigEndian.Uint16(seg[3:]))
+			img.components = int(seg[5])
+			if precision < 2 || precision > 16 || img.width < 1 || img.height < 1 || img.components < 1 || len(seg) < 6+3*img.components {
+				return nil, errors.New("invalid lossless JPEG frame header")
+			}
+			for c := 0; c < img.components; c++ {
+				if seg[7+3*c] != 0x11 {
+					return nil, errors.New("subsampled lossless JPEG is not supported")
+				}
+				ids = append(ids, seg[6+3*c])
+			}
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			return nil, fmt.Errorf("not a lossless JPEG (SOF%d)", marker-0xc0)
+		case marker == 0xdd:
+			if len(seg) < 2 {
+				return nil, errors.New("invalid lossless JPEG restart interval")
+			}
+			restartInterval = int(binary.BigEndian.Uint16(seg))
+		case marker == 0xda:
+			if ids == nil {
+				return nil, errors.New("lossless JPEG scan before its frame header")
+			}
+			if len(seg) < 1 || int(seg[0]) != img.components || len(seg) < 4+2*img.components {
+				return nil, errors.New("lossless JPEG scans must hold every component")
+			}
+			huffman := make([]*ljpegHuffman, img.components)
+			for c := range huffman {
+				if seg[1+2*c] != ids[c] || tables[seg[2+2*c]>>4&3] == nil {
+					return nil, errors.New("invalid lossless JPEG scan header")
+				}
+				huffman[c] = tables[seg[2+2*c]>>4&3]
+			}
+			predictor := int(seg[1+2*img.components])
+			transform := uint(seg[3+2*img.components] & 15)
+			if predictor < 1 || predictor > 7 {
+				return nil, fmt.Errorf("invalid lossless JPEG predictor %d", predictor)
+			}
+			if restartInterval > 0 && restartInterval%img.width != 0 {
+				return nil, errors.New("lossless JPEG restart intervals within a row are not supported")
+			}
+			// Every sample takes at least a one-bit code
+			if uint64(img.width)*uint64(img.height)*uint64(img.components) > 8*uint64(len(data)-pos) {
+				return nil, fmt.Errorf("lossless JPEG of %dx%d is larger than its data", img.width, img.height)
+			}
+			err := img.decodeScan(&ljpegBits{data: data[pos:]}, huffman, predictor, 1<<(precision-int(transform)-1), restartInterval/img.width)
+			if err != nil {
+				return nil, err
+			}
+			if transform > 0 {
+				for i := range img.samples {
+					img.samples[i] <<= transform
+				}
+			}
+			return img, nil
+		}
+	}
+}
+
+// decodeScan decodes every sample of the scan. The first row of the image,
+// and of each restart interval of restartRows rows, is predicted from the
+// left, starting from initial; the first column is predicted from above.
+func (img *losslessJPEG) decodeScan(bits *ljpegBits, huffman []*ljpegHuffman, predictor, initial, restartRows int) error {
+	width, nc := img.width, img.components
+	img.samples = make([]uint16, width*img.height*nc)
+	s := img.samples
+	for y := 0; y < img.height; y++ {
+		first := y == 0
+		if restartRows > 0 && y > 0 && y%restartRows == 0 {
+			if err := bits.restart(); err != nil {
+				return err
+			}
+			first = true
+		}
+		for x := 0; x < width; x++ {
+			for c := 0; c < nc; c++ {
+				i := (y*width+x)*nc + c
+				var pred int
+				switch {
+				case first && x == 0:
+					pred = initial
+				case first:
+					pred = int(s[i-nc])
+				case x == 0:
+					pred = int(s[i-width*nc])
+				default:
+					ra, rb, rc := int(s[i-nc]), int(s[i-width*nc]), int(s[i-width*nc-nc])
+					switch predictor {
+					case 1:
+						pred = ra
+					case 2:
+						pred = rb
+					case 3:
+						pred = rc
+					case 4:
+						pred = ra + rb - rc
+					case 5:
+						pred = ra + (rb-rc)>>1
+					case 6:
+						pred = rb + (ra-rc)>>1
+					default:
+						pred = (ra + rb) >> 1
+					}
+				}
+				diff, err := bits.diff(huffman[c])
+				if err != nil {
+					return fmt.Errorf("failed to decode lossless JPEG row %d: %w", y, err)
+				}
+				s[i] = uint16(pred + diff)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// ljpegTable is a Huffman table for difference sizes 0-16 given as the
+// number of codes of each length, with the sizes in increasing order
+type ljpegTable [16]uint8
+
+var (
+	// ljpegShortCodes codes every size in 5 bits
+	ljpegShortCodes = ljpegTable{4: 17}
+	// ljpegLongCodes gives size n a code of n+1 bits, past the lookup table
+	ljpegLongCodes = ljpegTable{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 2}
+)
+
+// codes returns the canonical code and length of each size
+func (t ljpegTable) codes() (codes [17]uint32, lengths [17]uint) {
+	code, k := uint32(0), 0
+	for l := 1; l <= 16; l++ {
+		for range t[l-1] {
+			codes[k], lengths[k] = code, uint(l)
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return codes, lengths
+}
+
+// ljpegWriter collects entropy-coded bits, stuffing a zero after every 0xFF
+type ljpegWriter struct {
+	out []byte
+	acc uint32
+	n   uint
+}
+
+func (w *ljpegWriter) emit(v uint32, n uint) {
+	for n > 0 {
+		n--
+		w.acc = w.acc<<1 | v>>n&1
+		if w.n++; w.n == 8 {
+			w.out = append(w.out, byte(w.acc))
+			if byte(w.acc) == 0xff {
+				w.out = append(w.out, 0)
+			}
+			w.acc, w.n = 0, 0
+		}
+	}
+}
+
+// flush pads the last byte with one bits
+func (w *ljpegWriter) flush() {
+	if w.n > 0 {
+		w.emit(1<<(8-w.n)-1, 8-w.n)
+	}
+}
+
+// ljpegOptions are the coding choices of encodeLosslessJPEG
+type ljpegOptions struct {
+	precision, predictor, transform, restartRows int
+	table                                        ljpegTable
+}
+
+// encodeLosslessJPEG writes width×height pixels of interleaved samples as a
+// lossless JPEG, dropping the low transform bits of each sample
+func encodeLosslessJPEG(samples []uint16, width, height, components int, o ljpegOptions) []byte {
+	out := []byte{0xff, 0xd8}
+	segment := func(marker byte, payload ...byte) {
+		out = append(out, 0xff, marker)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+		out = append(out, payload...)
+	}
+	symbols := []byte{0x00}
+	symbols = append(symbols, o.table[:]...)
+	for size := range 17 {
+		symbols = append(symbols, byte(size))
+	}
+	segment(0xc4, symbols...)
+	frame := []byte{byte(o.precision), byte(height >> 8), byte(height), byte(width >> 8), byte(width), byte(components)}
+	scan := []byte{byte(components)}
+	for c := range components {
+		frame = append(frame, byte(c+1), 0x11, 0)
+		scan = append(scan, byte(c+1), 0x00)
+	}
+	segment(0xc3, frame...)
+	if o.restartRows > 0 {
+		segment(0xdd, byte(o.restartRows*width>>8), byte(o.restartRows*width))
+	}
+	segment(0xda, append(scan, byte(o.predictor), 0, byte(o.transform))...)
+
+	codes, lengths := o.table.codes()
+	s := make([]int, len(samples))
+	for i, v := range samples {
+		s[i] = int(v) >> o.transform
+	}
+	var w ljpegWriter
+	for y := range height {
+		first := y == 0
+		if o.restartRows > 0 && y > 0 && y%o.restartRows == 0 {
+			w.flush()
+			w.out = append(w.out, 0xff, byte(0xd0+(y/o.restartRows-1)%8))
+			first = true
+		}
+		for x := range width {
+			for c := range components {
+				i, nc := (y*width+x)*components+c, components
+				var pred int
+				switch {
+				case first && x == 0:
+					pred = 1 << (o.precision - o.transform - 1)
+				case first:
+					pred = s[i-nc]
+				case x == 0:
+					pred = s[i-width*nc]
+				default:
+					ra, rb, rc := s[i-nc], s[i-width*nc], s[i-width*nc-nc]
+					pred = [...]int{ra, rb, rc, ra + rb - rc, ra + (rb-rc)>>1, rb + (ra-rc)>>1, (ra + rb) >> 1}[o.predictor-1]
+				}
+				diff := (s[i] - pred) & 0xffff
+				if diff > 32768 {
+					diff -= 65536
+				}
+				size := bits.Len(uint(max(diff, -diff)))
+				w.emit(codes[size], lengths[size])
+				switch {
+				case size == 16:
+				case diff > 0:
+					w.emit(uint32(diff), uint(size))
+				case diff < 0:
+					w.emit(uint32(diff+1<<size-1), uint(size))
+				}
+			}
+		}
+	}
+	w.flush()
+	out = append(out, w.out...)
+	return append(out, 0xff, 0xd9)
+}
+
+// ljpegSamples returns smooth samples of the given precision with noise
+// and, at every seventh pixel, a jump across the whole range
+func ljpegSamples(width, height, components, precision int) []uint16 {
+	samples := make([]uint16, width*height*components)
+	mask := 1<<precision - 1
+	for i := range samples {
+		x, y := i/components%width, i/components/width
+		v := x*53 + y*31 + i%components*400 + (i*7919)%23
+		if i/components%7 == 3 {
+			v += mask / 2
+		}
+		samples[i] = uint16(v & mask)
+	}
+	return samples
+}
+
+func TestDecodeLosslessJPEG(t *testing.T) {
+	tests := []struct {
+		name                      string
+		width, height, components int
+		o                         ljpegOptions
+	}{
+		{"predictor 1", 17, 9, 1, ljpegOptions{precision: 12, predictor: 1, table: ljpegShortCodes}},
+		{"predictor 2", 17, 9, 1, ljpegOptions{precision: 12, predictor: 2, table: ljpegShortCodes}},
+		{"predictor 3", 17, 9, 1, ljpegOptions{precision: 12, predictor: 3, table: ljpegShortCodes}},
+		{"predictor 4", 17, 9, 2, ljpegOptions{precision: 14, predictor: 4, table: ljpegShortCodes}},
+		{"predictor 5", 17, 9, 2, ljpegOptions{precision: 14, predictor: 5, table: ljpegShortCodes}},
+		{"predictor 6", 17, 9, 3, ljpegOptions{precision: 16, predictor: 6, table: ljpegShortCodes}},
+		{"predictor 7", 17, 9, 3, ljpegOptions{precision: 16, predictor: 7, table: ljpegShortCodes}},
+		{"long codes", 33, 5, 2, ljpegOptions{precision: 16, predictor: 1, table: ljpegLongCodes}},
+		{"restart intervals", 16, 11, 2, ljpegOptions{precision: 12, predictor: 6, restartRows: 2, table: ljpegLongCodes}},
+		{"point transform", 16, 8, 1, ljpegOptions{precision: 14, predictor: 4, transform: 2, table: ljpegShortCodes}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := ljpegSamples(tt.width, tt.height, tt.components, tt.o.precision)
+			img, err := decodeLosslessJPEG(encodeLosslessJPEG(samples, tt.width, tt.height, tt.components, tt.o))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.width != tt.width || img.height != tt.height || img.components != tt.components {
+				t.Fatalf("got %dx%d with %d components, want %dx%d with %d", img.width, img.height, img.components, tt.width, tt.height, tt.components)
+			}
+			for i := range samples {
+				samples[i] = samples[i] >> tt.o.transform << tt.o.transform
+			}
+			if !slices.Equal(img.samples, samples) {
+				t.Error("decoded samples differ from the encoded ones")
+			}
+		})
+	}
+
+	// Alternating samples 0 and 32768 differ by the 16-bit size, which has
+	// no extra bits
+	samples := []uint16{0, 32768, 0, 32768}
+	img, err := decodeLosslessJPEG(encodeLosslessJPEG(samples, 4, 1, 1, ljpegOptions{precision: 16, predictor: 1, table: ljpegShortCodes}))
+	if err != nil || !slices.Equal(img.samples, samples) {
+		t.Errorf("got %v, %v, want %v", img, err, samples)
+	}
+}
+
+func TestDecodeLosslessJPEGRejectsBadData(t *testing.T) {
+	valid := encodeLosslessJPEG(ljpegSamples(16, 8, 1, 12), 16, 8, 1, ljpegOptions{precision: 12, predictor: 1, table: ljpegShortCodes})
+	restarts := encodeLosslessJPEG(ljpegSamples(16, 8, 1, 12), 16, 8, 1, ljpegOptions{precision: 12, predictor: 1, restartRows: 4, table: ljpegShortCodes})
+	sof := strings.Index(string(valid), "\xff\xc3")
+	sos := strings.Index(string(valid), "\xff\xda")
+	patch := func(data []byte, at int, b ...byte) []byte {
+		data = slices.Clone(data)
+		copy(data[at:], b)
+		return data
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n")},
+		{"baseline", patch(valid, sof+1, 0xc0)},
+		{"truncated header", valid[:sof+6]},
+		{"subsampled", patch(valid, sof+4+7, 0x21)},
+		{"oversized", patch(valid, sof+4+1, 0xff, 0xff, 0xff, 0xff)},
+		{"predictor 0", patch(valid, sos+4+3, 0)},
+		{"predictor 8", patch(valid, sos+4+3, 8)},
+		{"restart within a row", patch(restarts, strings.Index(string(restarts), "\xff\xdd")+4, 0, 24)},
+		{"missing restart marker", patch(restarts, strings.Index(string(restarts), "\xff\xd0"), 0xaa, 0xaa)},
+		{"invalid code", append(valid[:sos+10:sos+10], slices.Repeat([]byte{0xff, 0}, 32)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeLosslessJPEG(tt.data); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// levelTrace is enabled by -vv and sits below slog.LevelDebug
+const levelTrace = slog.LevelDebug - 4
+
+// logLevel is the minimum level of messages that are logged
+var logLevel = new(slog.LevelVar)
+
+// addLogFlags registers the logging flags on fs and returns a function to
+// call once fs has been parsed. It sets the flags that were not given from
+// their GO_TRANSFORM_* environment variables, then configures the default
+// logger.
+func addLogFlags(fs *flag.FlagSet) func() error {
+	verbose := fs.Bool("v", false, "Verbose output: also log debug messages")
+	veryVerbose := fs.Bool("vv", false, "Very verbose output: also log trace messages")
+	format := fs.String("log-format", "text", "Log format: text or json")
+	fs.BoolVar(&quiet, "quiet", false, "Only log warnings and errors, and do not show progress bars")
+
+	return func() error {
+		if err := applyEnv(fs); err != nil {
+			return err
+		}
+		switch {
+		case quiet:
+			logLevel.Set(slog.LevelWarn)
+		case *veryVerbose:
+			logLevel.Set(levelTrace)
+		case *verbose:
+			logLevel.Set(slog.LevelDebug)
+		default:
+			logLevel.Set(slog.LevelInfo)
+		}
+
+		var handler slog.Handler
+		switch strings.ToLower(*format) {
+		case "text":
+			handler = newTextHandler(os.Stderr, logLevel)
+		case "json":
+			jsonLogs = true
+			handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+				Level: logLevel,
+				ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+					if a.Key == slog.LevelKey && a.Value.Any() == levelTrace {
+						a.Value = slog.StringValue("TRACE")
+					}
+					return a
+				},
+			})
+		default:
+			return fmt.Errorf("unsupported log format %q: use text or json", *format)
+		}
+		slog.SetDefault(slog.New(handler))
+		return nil
+	}
+}
+
+// Exit codes: 0 on success, exitPartialFailure when a batch run completed but
+// some inputs failed, exitFatal when the run could not be completed, and
+// exitInterrupted when it was stopped by SIGINT or SIGTERM
+const (
+	exitPartialFailure = 1
+	exitFatal          = 2
+	exitInterrupted    = 130
+)
+
+// fatal logs msg with err at error level and exits with exitFatal. Each of
+// the problems in a joined error is logged on its own line.
+func fatal(msg string, err error) {
+	for _, e := range splitErrors(err) {
+		slog.Error(msg, "error", e)
+	}
+	os.Exit(exitFatal)
+}
+
+// splitErrors returns the errors joined into err, flattening nested joins,
+// or err alone if it is not a joined error
+func splitErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	var errs []error
+	for _, e := range joined.Unwrap() {
+		errs = append(errs, splitErrors(e)...)
+	}
+	return errs
+}
+
+// textHandler writes human-readable log lines: the message followed by its
+// attributes as key=value pairs. Informational messages carry no prefix so
+// that everyday output stays uncluttered.
+type textHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level slog.Leveler
+	attrs string
+}
+
+func newTextHandler(w io.Writer, level slog.Leveler) *textHandler {
+	return &textHandler{mu: &sync.Mutex{}, w: w, level: level}
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	switch {
+	case r.Level >= slog.LevelError:
+		b.WriteString("Error: ")
+	case r.Level >= slog.LevelWarn:
+		b.WriteString("Warning: ")
+	case r.Level < slog.LevelDebug:
+		b.WriteString("trace: ")
+	case r.Level < slog.LevelInfo:
+		b.WriteString("debug: ")
+	}
+	b.WriteString(r.Message)
+	b.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		b.WriteString(formatAttr("", a))
+		return true
+	})
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	for _, a := range attrs {
+		clone.attrs += formatAttr("", a)
+	}
+	return &clone
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	// Groups are rarely used here; their attributes are simply flattened
+	return h
+}
+
+// formatAttr renders an attribute as " key=value", quoting values with spaces
+func formatAttr(prefix string, a slog.Attr) string {
+	if a.Value.Kind() == slog.KindGroup {
+		var b strings.Builder
+		for _, ga := range a.Value.Group() {
+			b.WriteString(formatAttr(prefix+a.Key+".", ga))
+		}
+		return b.String()
+	}
+	value := a.Value.Resolve().String()
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		value = strconv.Quote(value)
+	}
+	return " " + prefix + a.Key + "=" + value
+}
+
+func init() {
+	// Log in the text format until the flags have been parsed
+	slog.SetDefault(slog.New(newTextHandler(os.Stderr, logLevel)))
+}
@@ -2,19 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
-	"image/draw"
 	"image/jpeg"
 	"image/png"
-	"log"
+	"io"
+	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
-	"github.com/nfnt/resize"
+	"golang.org/x/image/tiff"
 )
 
 // ICO file format structures
@@ -35,16 +40,18 @@ type icondirEntry struct {
 	Offset       uint32
 }
 
-// convertToRGBA ensures the image is in RGBA format
-func convertToRGBA(src image.Image) *image.RGBA {
-	if rgba, ok := src.(*image.RGBA); ok {
-		return rgba
+// convertToNRGBA ensures the image is in NRGBA format. PNG stores colors
+// without premultiplied alpha, so converting through RGBA would lose the
+// colors of nearly transparent edge pixels.
+func convertToNRGBA(src image.Image) *image.NRGBA {
+	if nrgba, ok := src.(*image.NRGBA); ok {
+		return nrgba
 	}
 
 	bounds := src.Bounds()
-	rgba := image.NewRGBA(bounds)
-	draw.Draw(rgba, bounds, src, bounds.Min, draw.Src)
-	return rgba
+	nrgba := image.NewNRGBA(bounds)
+	drawParallel(nrgba, bounds, src, bounds.Min)
+	return nrgba
 }
 
 // resizeForICO resizes image for ICO format if needed
@@ -76,20 +83,20 @@ func resizeForICO(img image.Image, maxSize int) image.Image {
 		newHeight = 1
 	}
 
-	resized := resize.Resize(newWidth, newHeight, img, resize.Lanczos3)
-	fmt.Printf("Image resized for ICO format: %dx%d -> %dx%d\n", width, height, newWidth, newHeight)
+	resized := scaleImage(img, newWidth, newHeight)
+	slog.Info("Image resized for ICO format", "from", fmt.Sprintf("%dx%d", width, height), "to", fmt.Sprintf("%dx%d", newWidth, newHeight))
 	return resized
 }
 
 // EncodeICO converts an image to ICO format and writes it to w
-func EncodeICO(w *os.File, img image.Image, autoResize bool) error {
+func EncodeICO(w io.Writer, img image.Image, autoResize bool) error {
 	// Auto-resize if requested and image is too large
 	if autoResize {
 		img = resizeForICO(img, 256)
 	}
 
-	// Ensure the image is in RGBA format
-	rgbaImg := convertToRGBA(img)
+	// Ensure the image is in NRGBA format
+	nrgbaImg := convertToNRGBA(img)
 
 	// Create PNG encoder with best compression for smaller ICO files
 	pngBuffer := new(bytes.Buffer)
@@ -97,7 +104,7 @@ func EncodeICO(w *os.File, img image.Image, autoResize bool) error {
 		CompressionLevel: png.BestCompression,
 	}
 
-	err := encoder.Encode(pngBuffer, rgbaImg)
+	err := encoder.Encode(pngBuffer, nrgbaImg)
 	if err != nil {
 		return fmt.Errorf("failed to encode PNG for ICO: %w", err)
 	}
@@ -116,7 +123,7 @@ func EncodeICO(w *os.File, img image.Image, autoResize bool) error {
 		return fmt.Errorf("failed to write ICO header: %w", err)
 	}
 
-	bounds := rgbaImg.Bounds()
+	bounds := nrgbaImg.Bounds()
 	width := bounds.Dx()
 	height := bounds.Dy()
 
@@ -158,8 +165,8 @@ func EncodeICO(w *os.File, img image.Image, autoResize bool) error {
 }
 
 // determineOutputCategory determines which output folder to use based on operations
-func determineOutputCategory(resizePercent int, compressLevel int, convertToIco bool) string {
-	if convertToIco {
+func determineOutputCategory(resizePercent float64, compressLevel int, convertFormat bool) string {
+	if convertFormat {
 		return "transform"
 	}
 	if resizePercent > 0 {
@@ -176,37 +183,55 @@ func ensureOutputDir(dir string) error {
 	return os.MkdirAll(dir, 0755)
 }
 
-// validateFlags validates command line arguments
-func validateFlags(inputFile *string, resizePercent *int, compressLevel *int) error {
-	if *inputFile == "" {
-		return fmt.Errorf("input file is required. Use -input flag to specify the input image")
-	}
+// supportedOutputFormats lists the values accepted by the -format flag
+var supportedOutputFormats = []string{"jpeg", "jpg", "png", "gif", "pdf", "qoi", "webp", "pnm", "ppm", "pgm", "pbm", "dds", "tiff", "tif", "ascii", "ansi"}
 
-	if *resizePercent < 0 || *resizePercent > 99 {
-		return fmt.Errorf("resize percentage must be between 1 and 99, or 0 for no resizing")
-	}
+// validateFlags validates command line arguments
+func validateFlags(inputFile *string, resizePercent *float64, compressLevel *int, outputFormat *string) error {
+	return errors.Join(validateInput(*inputFile), validateOptions(*resizePercent, *compressLevel, *outputFormat))
+}
 
-	if *compressLevel < 0 || *compressLevel > 100 {
-		return fmt.Errorf("compression level must be between 1 and 100, or 0 for no compression")
+// validateInput checks that the input file is given and exists
+func validateInput(inputFile string) error {
+	if inputFile == "" {
+		return fmt.Errorf("input file is required. Use -input flag to specify the input image")
 	}
 
 	// Check if input file exists
-	if _, err := os.Stat(*inputFile); os.IsNotExist(err) {
-		return fmt.Errorf("input file does not exist: %s", *inputFile)
+	if _, err := os.Stat(inputFile); os.IsNotExist(err) && !isObjectURI(inputFile) {
+		return fmt.Errorf("input file does not exist: %s", inputFile)
 	}
 
 	return nil
 }
 
-// resizeImage resizes the image if needed
-func resizeImage(img image.Image, resizePercent int) (image.Image, error) {
-	if resizePercent <= 0 {
-		return img, nil
+// maxResizePercent is the largest enlargement -resize accepts
+const maxResizePercent = 800
+
+// validateOptions validates the resize, compression and format settings,
+// joining the problems found into one error
+func validateOptions(resizePercent float64, compressLevel int, outputFormat string) error {
+	var errs []error
+	if !(resizePercent >= 0 && resizePercent <= maxResizePercent) {
+		errs = append(errs, fmt.Errorf("resize percentage must be above 0 and at most %d, or 0 for no resizing", maxResizePercent))
 	}
 
-	bounds := img.Bounds()
-	width := uint(float64(bounds.Dx()) * float64(resizePercent) / 100.0)
-	height := uint(float64(bounds.Dy()) * float64(resizePercent) / 100.0)
+	if compressLevel < 0 || compressLevel > 100 {
+		errs = append(errs, fmt.Errorf("compression level must be between 1 and 100, or 0 for no compression"))
+	}
+
+	if outputFormat != "" && !slices.Contains(supportedOutputFormats, strings.ToLower(outputFormat)) {
+		errs = append(errs, fmt.Errorf("unsupported output format %q. Supported formats: %s", outputFormat, strings.Join(supportedOutputFormats, ", ")))
+	}
+
+	return errors.Join(errs...)
+}
+
+// resizedDimensions returns the size of bounds scaled by resizePercent,
+// at least 1x1
+func resizedDimensions(bounds image.Rectangle, resizePercent float64) (uint, uint) {
+	width := uint(float64(bounds.Dx()) * resizePercent / 100.0)
+	height := uint(float64(bounds.Dy()) * resizePercent / 100.0)
 
 	// Ensure minimum dimensions of 1 pixel
 	if width < 1 {
@@ -215,78 +240,132 @@ func resizeImage(img image.Image, resizePercent int) (image.Image, error) {
 	if height < 1 {
 		height = 1
 	}
+	return width, height
+}
+
+// resizeImage resizes the image if needed
+func resizeImage(img image.Image, resizePercent float64) (image.Image, error) {
+	if resizePercent <= 0 {
+		return img, nil
+	}
+
+	width, height := resizedDimensions(img.Bounds(), resizePercent)
 
-	resized := resize.Resize(width, height, img, resize.Lanczos3)
-	fmt.Printf("Image resized to %d%% (%dx%d pixels)\n", resizePercent, width, height)
+	resized := scaleImage(img, width, height)
+	slog.Info("Image resized", "percent", resizePercent, "size", fmt.Sprintf("%dx%d", width, height))
 	return resized, nil
 }
 
-// generateOutputPath generates the output file path
-func generateOutputPath(inputFile, outputFile string, resizePercent, compressLevel int, convertToIco bool) (string, error) {
-	var outPath string
+// constrainImage shrinks img to fit within maxWidth x maxHeight, keeping its
+// aspect ratio. A bound of 0 is no limit, and images that fit are returned
+// untouched.
+func constrainImage(img image.Image, maxWidth, maxHeight int) image.Image {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		scale = min(scale, float64(maxHeight)/float64(height))
+	}
+	if scale == 1 {
+		return img
+	}
+	fit := func(side, limit int) int {
+		side = max(1, int(math.Round(float64(side)*scale)))
+		if limit > 0 {
+			side = min(side, limit)
+		}
+		return side
+	}
+	newWidth, newHeight := fit(width, maxWidth), fit(height, maxHeight)
+	slog.Info("Image constrained", "from", fmt.Sprintf("%dx%d", width, height), "size", fmt.Sprintf("%dx%d", newWidth, newHeight))
+	return scaleImage(img, uint(newWidth), uint(newHeight))
+}
+
+// outputExtension returns the file extension for the requested output format,
+// or "" to keep the input file's extension
+func outputExtension(convertToIco bool, format string) string {
+	if convertToIco {
+		return ".ico"
+	}
+	switch strings.ToLower(format) {
+	case "":
+		return ""
+	case "jpeg":
+		return ".jpg"
+	case "ascii":
+		return ".txt"
+	case "ansi":
+		return ".ans"
+	default:
+		return "." + strings.ToLower(format)
+	}
+}
 
-	if outputFile != "" {
-		// If output file is specified, use it as-is but ensure it goes to the right folder
-		category := determineOutputCategory(resizePercent, compressLevel, convertToIco)
-		outputDir := filepath.Join("output", category)
+// generateOutputPath generates the output file path. outputExt forces the
+// extension of the output file; "" keeps the input's extension.
+func generateOutputPath(inputFile, outputFile string, resizePercent float64, compressLevel int, outputExt string) (string, error) {
+	// Determine output category and directory
+	category := determineOutputCategory(resizePercent, compressLevel, outputExt != "")
+	outputDir := filepath.Join(outputRoot, category)
 
-		// Ensure output directory exists
-		if err := ensureOutputDir(outputDir); err != nil {
-			return "", fmt.Errorf("error creating output directory: %w", err)
-		}
+	// Ensure output directory exists
+	if err := ensureOutputDir(outputDir); err != nil {
+		return "", fmt.Errorf("error creating output directory: %w", err)
+	}
 
+	// Generate output filename automatically
+	path := filepath.Join(outputDir, outputFilename(inputFile, resizePercent, compressLevel, outputExt))
+	if outputFile != "" {
+		// If output file is specified, use it as-is but ensure it goes to the right folder
 		filename := filepath.Base(outputFile)
-		if convertToIco && !strings.HasSuffix(strings.ToLower(filename), ".ico") {
-			// Add .ico extension if converting to ICO
-			filename += ".ico"
-		}
-		outPath = filepath.Join(outputDir, filename)
-	} else {
-		// Generate output filename automatically
-		inputBasename := filepath.Base(inputFile)
-		ext := filepath.Ext(inputBasename)
-		basename := strings.TrimSuffix(inputBasename, ext)
-
-		suffix := ""
-		if resizePercent > 0 {
-			suffix += fmt.Sprintf("_r%d", resizePercent)
+		if filename == "." || filename == ".." || filename == string(filepath.Separator) {
+			return "", fmt.Errorf("invalid output file name %q", outputFile)
 		}
-		if compressLevel > 0 {
-			suffix += fmt.Sprintf("_c%d", compressLevel)
-		}
-
-		// Determine output category and directory
-		category := determineOutputCategory(resizePercent, compressLevel, convertToIco)
-		outputDir := filepath.Join("output", category)
-
-		// Ensure output directory exists
-		if err := ensureOutputDir(outputDir); err != nil {
-			return "", fmt.Errorf("error creating output directory: %w", err)
+		if outputExt != "" && !strings.HasSuffix(strings.ToLower(filename), outputExt) {
+			// Add the target format's extension if converting
+			filename += outputExt
 		}
+		path = filepath.Join(outputDir, filename)
+	}
+	if err := checkOutputPath(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
 
-		// Change extension if converting to ICO
-		var filename string
-		if convertToIco {
-			filename = basename + suffix + ".ico"
-		} else {
-			filename = basename + suffix + ext
-		}
+// outputFilename returns the base name of the output for inputFile, with
+// suffixes describing the resize and compression applied
+func outputFilename(inputFile string, resizePercent float64, compressLevel int, outputExt string) string {
+	inputBasename := filepath.Base(inputFile)
+	ext := filepath.Ext(inputBasename)
+	basename := strings.TrimSuffix(inputBasename, ext)
 
-		outPath = filepath.Join(outputDir, filename)
+	suffix := ""
+	if resizePercent > 0 {
+		suffix += "_r" + strconv.FormatFloat(resizePercent, 'f', -1, 64)
+	}
+	if compressLevel > 0 {
+		suffix += fmt.Sprintf("_c%d", compressLevel)
 	}
 
-	return outPath, nil
+	// Change extension if converting to another format
+	if outputExt != "" {
+		return basename + suffix + outputExt
+	}
+	return basename + suffix + ext
 }
 
 // encodeImage handles encoding the image in the appropriate format
-func encodeImage(out *os.File, img image.Image, format string, compressLevel int) error {
+func encodeImage(out io.Writer, img image.Image, format string, compressLevel int) error {
 	switch strings.ToLower(format) {
 	case "jpeg", "jpg":
 		var opts jpeg.Options
 		if compressLevel > 0 {
 			opts.Quality = compressLevel
 		} else {
-			opts.Quality = 95 // default quality
+			opts.Quality = siteDefaults.JPEGQuality
 		}
 
 		if err := jpeg.Encode(out, img, &opts); err != nil {
@@ -294,23 +373,55 @@ func encodeImage(out *os.File, img image.Image, format string, compressLevel int
 		}
 
 		if compressLevel > 0 {
-			fmt.Printf("Image compressed with quality level %d\n", compressLevel)
+			slog.Info("Image compressed", "quality", compressLevel)
 		}
 
 	case "png":
-		encoder := png.Encoder{}
+		encoder := png.Encoder{CompressionLevel: pngCompressionLevel()}
 		if compressLevel > 0 {
 			// For PNG, higher compression level means more compression (opposite of JPEG)
 			// Convert our 1-100 scale (where 1 is max compression) to PNG's 0-9 scale (where 9 is max compression)
 			level := png.CompressionLevel(9 - int(float64(compressLevel)/100.0*9.0))
 			encoder.CompressionLevel = level
-			fmt.Printf("Image compressed with PNG compression level %v\n", level)
+			slog.Info("Image compressed", "png_level", int(level))
 		}
 
 		if err := encoder.Encode(out, img); err != nil {
 			return fmt.Errorf("failed to encode PNG: %w", err)
 		}
 
+	case "gif":
+		if err := encodeGIF(out, img, defaultGIFOptions); err != nil {
+			return err
+		}
+
+	case "qoi":
+		if err := EncodeQOI(out, img); err != nil {
+			return fmt.Errorf("failed to encode QOI: %w", err)
+		}
+
+	case "webp":
+		effort := webpEffort()
+		if compressLevel > 0 {
+			// WebP output is lossless, so the level sets the effort, as it
+			// sets PNG's deflate level: 1 gives the smallest file
+			effort = 6 - compressLevel*6/100
+			slog.Info("Image compressed", "webp_effort", effort)
+		}
+		if err := EncodeWebP(out, img, effort); err != nil {
+			return fmt.Errorf("failed to encode WebP: %w", err)
+		}
+
+	case "tiff", "tif":
+		if err := tiff.Encode(out, img, &tiff.Options{Compression: tiff.Deflate, Predictor: true}); err != nil {
+			return fmt.Errorf("failed to encode TIFF: %w", err)
+		}
+
+	case "pnm", "ppm", "pgm", "pbm":
+		if err := EncodePNM(out, img, strings.ToLower(format)); err != nil {
+			return fmt.Errorf("failed to encode %s: %w", strings.ToUpper(format), err)
+		}
+
 	default:
 		// For other formats, just encode as PNG
 		if err := png.Encode(out, img); err != nil {
@@ -321,79 +432,191 @@ func encodeImage(out *os.File, img image.Image, format string, compressLevel int
 	return nil
 }
 
-func main() {
-	// Define command line flags
-	inputFile := flag.String("input", "", "Input image file path (required)")
-	outputFile := flag.String("output", "", "Output image file path (if not specified, will use input filename with suffix)")
-	resizePercent := flag.Int("resize", 0, "Resize percentage (1-99). 0 means no resize")
-	compressLevel := flag.Int("compress", 0, "Compression level (1-100, where 1 is max compression, 100 is best quality). 0 means no compression")
-	convertToIco := flag.Bool("to-ico", false, "Convert the image to ICO format")
-	autoResizeICO := flag.Bool("auto-resize-ico", true, "Automatically resize images larger than 256x256 when converting to ICO")
+// subcommand is a command named by the first argument on the command line
+type subcommand struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
 
-	flag.Parse()
+// subcommands are the subcommands, in the order they are listed in the help
+var subcommands = []subcommand{
+	{"convert", "Convert images to another format", runConvert},
+	{"resize", "Resize images", runResize},
+	{"ico", "Convert images to ICO icons", runICO},
+	{"info", "Show the format, size and metadata of images", runInfo},
+	{"batch", "Process many images", runBatch},
+	{"replay", "Re-apply a saved recipe to new images", runReplay},
+	{"restore", "Restore originals replaced by -in-place", runRestore},
+	{"optimize", "Shrink PNG, JPEG and GIF files in place losslessly", runOptimize},
+	{"check", "Check images against size, format and metadata limits", runCheck},
+	{"report", "Write a size, dimension and format inventory of an image tree", runReport},
+	{"serve", "Run the gRPC transform server", runServe},
+	{"exif", "Show or edit metadata", runExif},
+	{"composite", "Overlay one image on another", runComposite},
+	{"montage", "Lay images out in a contact sheet", runMontage},
+	{"collage", "Fill a layout template with images", runCollage},
+	{"og-image", "Make an Open Graph social card", runOGImage},
+	{"qr", "Make a QR code", runQR},
+	{"barcode", "Make a Code 128 or EAN barcode", runBarcode},
+	{"split", "Slice tall images into chunks", runSplit},
+	{"join", "Stitch images into a strip", runJoin},
+	{"stitch", "Blend overlapping images into one", runStitch},
+	{"stack", "Average or median-stack exposures of one scene", runStack},
+	{"sprite", "Pack images into a sprite atlas", runSprite},
+	{"tiles", "Cut an image into a Deep Zoom or XYZ tile pyramid", runTiles},
+	{"preview", "Show images in the terminal", runPreview},
+	{"tui", "Tune a preset interactively", runTUI},
+	{"bench", "Time each stage of processing sample images", runBench},
+}
 
-	// Validate inputs
-	if err := validateFlags(inputFile, resizePercent, compressLevel); err != nil {
-		log.Fatal(err)
+// runSubcommand dispatches to a subcommand if one is named on the command line.
+// It reports whether a subcommand was run.
+func runSubcommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
 	}
 
-	// Open the input file
-	file, err := os.Open(*inputFile)
-	if err != nil {
-		log.Fatalf("Error opening input file: %v", err)
+	// These read the list of subcommands, so they cannot be in it
+	switch args[0] {
+	case "completion":
+		return true, runCompletion(args[1:])
+	case completeCommand:
+		return true, runComplete(args[1:])
+	}
+	if c, ok := findSubcommand(args[0]); ok {
+		return true, c.run(args[1:])
 	}
-	defer file.Close()
+	return false, nil
+}
 
-	// Decode the image
-	img, format, err := image.Decode(file)
-	if err != nil {
-		log.Fatalf("Error decoding image: %v", err)
+// findSubcommand returns the subcommand with the given name
+func findSubcommand(name string) (subcommand, bool) {
+	i := slices.IndexFunc(subcommands, func(c subcommand) bool { return c.name == name })
+	if i < 0 {
+		return subcommand{}, false
 	}
+	return subcommands[i], true
+}
 
-	fmt.Printf("Loaded %s image: %dx%d\n", format, img.Bounds().Dx(), img.Bounds().Dy())
+// jsMain replaces the command line interface when built for the browser,
+// see wasm.go
+var jsMain func()
 
-	// Process the image - resize if requested
-	img, err = resizeImage(img, *resizePercent)
-	if err != nil {
-		log.Fatalf("Error resizing image: %v", err)
+func main() {
+	if jsMain != nil {
+		jsMain()
+		return
 	}
 
-	// Generate output path
-	outPath, err := generateOutputPath(*inputFile, *outputFile, *resizePercent, *compressLevel, *convertToIco)
-	if err != nil {
-		log.Fatalf("Error generating output path: %v", err)
+	// The .env file may name plugins and set flags, so it is read first
+	if err := loadDotEnv(dotEnvFile); err != nil {
+		fatal("Could not load environment", err)
+	}
+	// The defaults file sets flag defaults, so it is read before flags are added
+	if err := loadDefaults(defaultsFile()); err != nil {
+		fatal("Could not load defaults", err)
+	}
+	// Plugins add flags, so they are loaded before any flags are parsed
+	if err := loadPluginsFromEnv(); err != nil {
+		fatal("Could not load plugins", err)
 	}
 
-	// Create output file
-	out, err := os.Create(outPath)
-	if err != nil {
-		log.Fatalf("Error creating output file: %v", err)
+	if ran, err := runSubcommand(os.Args[1:]); ran {
+		if errors.Is(err, errBatchPartial) {
+			os.Exit(exitPartialFailure)
+		}
+		if errors.Is(err, errInterrupted) {
+			slog.Warn("Stopped before completing", "error", err)
+			os.Exit(exitInterrupted)
+		}
+		if err != nil {
+			fatal("Command failed", err)
+		}
+		return
 	}
-	defer func() {
-		if closeErr := out.Close(); closeErr != nil {
-			log.Printf("Warning: Error closing output file: %v", closeErr)
+
+	// Define command line flags
+	inputFile := flag.String("input", "", "Input image file path, or a glob pattern such as 'photos/**/*.jpg' to process many images (required)")
+	fileList := addFileListFlag(flag.CommandLine, "File naming input images one per line, or - to read the list from stdin")
+	preview := flag.Bool("preview", false, "Show the output in the terminal once it is written, as the preview subcommand does")
+	presetFile := flag.String("preset", "", "Preset file setting options by name, as written by the tui subcommand; flags given on the command line take precedence")
+	opts := addProcessFlags(flag.CommandLine)
+	setupLogging := addLogFlags(flag.CommandLine)
+	flag.Usage = func() {
+		out, name := flag.CommandLine.Output(), filepath.Base(os.Args[0])
+		fmt.Fprintf(out, "Usage: %s -input image [flags]\n       %s <command> [flags] ...\n\nCommands:\n", name, name)
+		for _, c := range subcommands {
+			fmt.Fprintf(out, "  %-11s%s\n", c.name, c.summary)
 		}
-	}()
-
-	// Handle ICO conversion specifically
-	if *convertToIco {
-		// Show warning for large images if auto-resize is disabled
-		bounds := img.Bounds()
-		if (bounds.Dx() > 256 || bounds.Dy() > 256) && !*autoResizeICO {
-			log.Printf("Warning: Large image dimensions (%dx%d) may not display properly in all ICO viewers. Consider using -auto-resize-ico=true", bounds.Dx(), bounds.Dy())
+		fmt.Fprintf(out, "  %-11s%s\n", "completion", completionSummary)
+		fmt.Fprintf(out, "\nRun %s <command> -h for the flags of a command. Without a command, every flag of the pipeline is available:\n", name)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if err := setupLogging(); err != nil {
+		fatal("Invalid arguments", err)
+	}
+	if *presetFile != "" {
+		if err := applyPreset(flag.CommandLine, *presetFile); err != nil {
+			fatal("Invalid arguments", err)
 		}
+	}
+
+	// A first Ctrl-C lets the image in progress finish; a second one abandons
+	// it without writing a partial output
+	ctx, stop, release := handleSignals()
+	defer release()
 
-		if err := EncodeICO(out, img, *autoResizeICO); err != nil {
-			log.Fatalf("Error encoding to ICO format: %v", err)
+	// Patterns, file lists and archives are processed like the batch subcommand
+	if *fileList != "" || isGlobPattern(*inputFile) || isArchive(*inputFile) {
+		var patterns []string
+		if *inputFile != "" {
+			patterns = append(patterns, *inputFile)
+		}
+		inputs, err := collectInputs(patterns, *fileList)
+		if err := errors.Join(err, opts.setup()); err != nil {
+			fatal("Invalid arguments", err)
+		}
+		err = processBatch(ctx, stop, opts, batchOptions{Failures: "failures.json"}, inputJobs(opts.skipBackups(inputs)))
+		if errors.Is(err, errBatchPartial) {
+			os.Exit(exitPartialFailure)
+		}
+		if errors.Is(err, errInterrupted) {
+			slog.Warn("Stopped before completing", "error", err)
+			os.Exit(exitInterrupted)
+		}
+		if err != nil {
+			fatal("Batch failed", err)
 		}
-		fmt.Printf("Image converted to ICO format (RGBA) and saved to %s\n", outPath)
 		return
 	}
 
-	// Save the processed image with compression if applicable
-	if err := encodeImage(out, img, format, *compressLevel); err != nil {
-		log.Fatalf("Error encoding output image: %v", err)
+	// Validate the input and every option before processing anything
+	if err := errors.Join(validateInput(*inputFile), opts.setup()); err != nil {
+		fatal("Invalid arguments", err)
+	}
+
+	if flag.NArg() > 0 && strings.ToLower(opts.OutputFormat) != "pdf" {
+		slog.Warn("Ignoring extra arguments; additional input images are only used with -format pdf", "args", strings.Join(flag.Args(), " "))
 	}
 
-	fmt.Printf("Processed image saved to %s\n", outPath)
+	result, err := processFile(ctx, opts, *inputFile, flag.Args())
+	if errors.Is(err, context.Canceled) {
+		slog.Warn("Aborted; no output was written", "input", *inputFile)
+		os.Exit(exitInterrupted)
+	}
+	if err != nil {
+		fatal("Could not process image", err)
+	}
+	if *preview {
+		if err := previewFile(result.Output, "auto", defaultPreviewSize); err != nil {
+			slog.Warn("Could not preview output", "error", err)
+		}
+	}
+	if err := saveFingerprints(); err != nil {
+		fatal("Could not save fingerprints", err)
+	}
 }
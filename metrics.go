@@ -0,0 +1,163 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the transformation
+// latency histogram
+var durationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metrics counts the work done by the server, exposed at /metrics in the
+// Prometheus text format
+var metrics = &serverMetrics{requests: map[requestLabels]int64{}, durations: map[string]*histogram{}}
+
+// serverMetrics holds the server's counters
+type serverMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestLabels]int64
+	durations map[string]*histogram // by output format
+
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	inFlight    atomic.Int64
+	queued      atomic.Int64
+}
+
+// requestLabels identifies a request counter
+type requestLabels struct {
+	api    string
+	status string
+}
+
+// histogram counts observations per bucket of durationBuckets, with a final
+// bucket for larger values
+type histogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+// request counts one request of api answered with status
+func (m *serverMetrics) request(api string, status int) {
+	m.mu.Lock()
+	m.requests[requestLabels{api, strconv.Itoa(status)}]++
+	m.mu.Unlock()
+}
+
+// startTransform marks a transformation as in flight. The returned function
+// ends it, recording its duration under the output format, or "error" if it
+// failed.
+func (m *serverMetrics) startTransform() func(format string, err error) {
+	start := time.Now()
+	m.inFlight.Add(1)
+	return func(format string, err error) {
+		m.inFlight.Add(-1)
+		if err != nil || format == "" {
+			format = "error"
+		}
+		seconds := time.Since(start).Seconds()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		h, ok := m.durations[format]
+		if !ok {
+			h = &histogram{counts: make([]int64, len(durationBuckets)+1)}
+			m.durations[format] = h
+		}
+		i, _ := slices.BinarySearch(durationBuckets, seconds)
+		h.counts[i]++
+		h.sum += seconds
+		h.count++
+	}
+}
+
+// writeMetric writes the HELP and TYPE lines of a metric
+func writeMetric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// formatFloat formats a sample value as Prometheus expects
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *serverMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeMetric(w, "img_processor_requests_total", "counter", "Requests handled, by API and status (HTTP status for the proxy, gRPC status code for gRPC).")
+	labels := make([]requestLabels, 0, len(m.requests))
+	for l := range m.requests {
+		labels = append(labels, l)
+	}
+	slices.SortFunc(labels, func(a, b requestLabels) int {
+		return cmp.Or(cmp.Compare(a.api, b.api), cmp.Compare(a.status, b.status))
+	})
+	for _, l := range labels {
+		fmt.Fprintf(w, "img_processor_requests_total{api=%q,status=%q} %d\n", l.api, l.status, m.requests[l])
+	}
+
+	writeMetric(w, "img_processor_transform_duration_seconds", "histogram", "Time taken to transform an image, by output format.")
+	formats := make([]string, 0, len(m.durations))
+	for format := range m.durations {
+		formats = append(formats, format)
+	}
+	slices.Sort(formats)
+	for _, format := range formats {
+		h := m.durations[format]
+		var cumulative int64
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "img_processor_transform_duration_seconds_bucket{format=%q,le=%q} %d\n", format, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "img_processor_transform_duration_seconds_bucket{format=%q,le=\"+Inf\"} %d\n", format, h.count)
+		fmt.Fprintf(w, "img_processor_transform_duration_seconds_sum{format=%q} %s\n", format, formatFloat(h.sum))
+		fmt.Fprintf(w, "img_processor_transform_duration_seconds_count{format=%q} %d\n", format, h.count)
+	}
+
+	writeMetric(w, "img_processor_transforms_in_flight", "gauge", "Transformations currently running.")
+	fmt.Fprintf(w, "img_processor_transforms_in_flight %d\n", m.inFlight.Load())
+	writeMetric(w, "img_processor_transforms_queued", "gauge", "Requests waiting for a transformation slot.")
+	fmt.Fprintf(w, "img_processor_transforms_queued %d\n", m.queued.Load())
+	writeMetric(w, "img_processor_cache_hits_total", "counter", "Lookups answered from the result cache.")
+	fmt.Fprintf(w, "img_processor_cache_hits_total %d\n", m.cacheHits.Load())
+	writeMetric(w, "img_processor_cache_misses_total", "counter", "Lookups not found in the result cache.")
+	fmt.Fprintf(w, "img_processor_cache_misses_total %d\n", m.cacheMisses.Load())
+	writeMetric(w, "img_processor_input_bytes_total", "counter", "Bytes of source images received or fetched from the origin.")
+	fmt.Fprintf(w, "img_processor_input_bytes_total %d\n", m.bytesIn.Load())
+	writeMetric(w, "img_processor_output_bytes_total", "counter", "Bytes of transformed images sent to clients.")
+	fmt.Fprintf(w, "img_processor_output_bytes_total %d\n", m.bytesOut.Load())
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// countRequests wraps an HTTP handler to count its requests under api
+func countRequests(api string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		metrics.request(api, rec.status)
+	})
+}
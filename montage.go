@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// labelHeight is the vertical space reserved under each cell for its label
+const labelHeight = 18
+
+// parseHexColor parses a colour in #rgb, #rrggbb or #rrggbbaa form
+func parseHexColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q: expected #rrggbb", s)
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q: %w", s, err)
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+// fitWithin scales img down or up so it fits inside maxWidth x maxHeight,
+// maintaining aspect ratio
+func fitWithin(img image.Image, maxWidth, maxHeight int) image.Image {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	if width == maxWidth && height <= maxHeight || height == maxHeight && width <= maxWidth {
+		return img
+	}
+
+	scale := float64(maxWidth) / float64(width)
+	if s := float64(maxHeight) / float64(height); s < scale {
+		scale = s
+	}
+
+	newWidth := uint(float64(width)*scale + 0.5)
+	newHeight := uint(float64(height)*scale + 0.5)
+	if newWidth < 1 {
+		newWidth = 1
+	}
+	if newHeight < 1 {
+		newHeight = 1
+	}
+	return scaleImage(img, newWidth, newHeight)
+}
+
+// fitLabel trims text a character at a time until drawer measures it at most
+// width pixels wide, never cutting a multi-byte character in half
+func fitLabel(drawer *font.Drawer, text string, width int) string {
+	for text != "" && drawer.MeasureString(text).Ceil() > width {
+		_, size := utf8.DecodeLastRuneInString(text)
+		text = text[:len(text)-size]
+	}
+	return text
+}
+
+// drawLabel draws text centred horizontally within width, with its baseline at y
+func drawLabel(dst draw.Image, text string, x, width, y int, col color.Color) {
+	face := basicfont.Face7x13
+	drawer := &font.Drawer{Dst: dst, Src: image.NewUniform(col), Face: face}
+
+	text = fitLabel(drawer, text, width)
+	offset := (width - drawer.MeasureString(text).Ceil()) / 2
+	drawer.Dot = fixed.P(x+offset, y)
+	drawer.DrawString(text)
+}
+
+// buildMontage tiles images into a grid contact sheet
+func buildMontage(paths []string, columns, cellWidth, cellHeight, spacing int, labels bool, background, labelColor color.Color) (*image.RGBA, error) {
+	rows := (len(paths) + columns - 1) / columns
+	if len(paths) < columns {
+		columns = len(paths)
+	}
+
+	rowHeight := cellHeight
+	if labels {
+		rowHeight += labelHeight
+	}
+
+	sheetWidth := columns*cellWidth + (columns+1)*spacing
+	sheetHeight := rows*rowHeight + (rows+1)*spacing
+	sheet := image.NewRGBA(image.Rect(0, 0, sheetWidth, sheetHeight))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+
+	progress := newProgressBar("Building montage", "images", len(paths))
+	defer progress.Finish()
+	for i, path := range paths {
+		img, _, err := loadImage(path)
+		if err != nil {
+			return nil, err
+		}
+
+		col := i % columns
+		row := i / columns
+		cellX := spacing + col*(cellWidth+spacing)
+		cellY := spacing + row*(rowHeight+spacing)
+
+		thumb := fitWithin(img, cellWidth, cellHeight)
+		tb := thumb.Bounds()
+		pt := image.Pt(cellX+(cellWidth-tb.Dx())/2, cellY+(cellHeight-tb.Dy())/2)
+		draw.Draw(sheet, image.Rectangle{Min: pt, Max: pt.Add(tb.Size())}, thumb, tb.Min, draw.Over)
+
+		if labels {
+			drawLabel(sheet, filepath.Base(path), cellX, cellWidth, cellY+cellHeight+labelHeight-5, labelColor)
+		}
+
+		progress.Step("Added image to montage", "file", path, "index", i+1, "total", len(paths))
+	}
+
+	return sheet, nil
+}
+
+// runMontage implements the montage subcommand
+func runMontage(args []string) error {
+	fs := flag.NewFlagSet("montage", flag.ExitOnError)
+	outputFile := fs.String("output", "montage.png", "Output image file path")
+	columns := fs.Int("columns", 4, "Number of columns in the grid")
+	cellSize := fs.String("cell", "200x200", "Size of each grid cell as WxH")
+	spacing := fs.Int("spacing", 10, "Spacing between cells in pixels")
+	labels := fs.Bool("labels", true, "Draw the file name under each image")
+	backgroundHex := fs.String("background", "#ffffff", "Background color as #rrggbb")
+	labelHex := fs.String("label-color", "#000000", "Label text color as #rrggbb")
+	compressLevel := fs.Int("compress", 0, "Compression level (1-100) for the output image. 0 means no compression")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s montage [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		return fmt.Errorf("at least one input image is required")
+	}
+	if *columns < 1 {
+		return fmt.Errorf("columns must be at least 1")
+	}
+	if *spacing < 0 {
+		return fmt.Errorf("spacing cannot be negative")
+	}
+
+	var cellWidth, cellHeight int
+	if _, err := fmt.Sscanf(*cellSize, "%dx%d", &cellWidth, &cellHeight); err != nil || cellWidth < 1 || cellHeight < 1 {
+		return fmt.Errorf("invalid cell size %q: expected WxH", *cellSize)
+	}
+
+	background, err := parseHexColor(*backgroundHex)
+	if err != nil {
+		return err
+	}
+	labelColor, err := parseHexColor(*labelHex)
+	if err != nil {
+		return err
+	}
+
+	sheet, err := buildMontage(inputs, *columns, cellWidth, cellHeight, *spacing, *labels, background, labelColor)
+	if err != nil {
+		return err
+	}
+
+	outPath, err := prepareOutputPath("montage", *outputFile)
+	if err != nil {
+		return err
+	}
+	if err := saveImage(outPath, sheet, *compressLevel); err != nil {
+		return err
+	}
+
+	slog.Info("Montage saved", "images", len(inputs), "size", fmt.Sprintf("%dx%d", sheet.Bounds().Dx(), sheet.Bounds().Dy()), "path", outPath)
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+)
+
+func TestFitLabelKeepsWholeCharacters(t *testing.T) {
+	drawer := &font.Drawer{Face: basicfont.Face7x13}
+	for _, text := range []string{"写真_2026_夏休み.jpg", "Ünïcödé-bïld.png", "plain-name.jpg"} {
+		for width := 0; width <= 120; width += 7 {
+			fitted := fitLabel(drawer, text, width)
+			if !utf8.ValidString(fitted) {
+				t.Fatalf("%q at %d pixels: trimmed to invalid UTF-8 %q", text, width, fitted)
+			}
+			if w := drawer.MeasureString(fitted).Ceil(); w > width {
+				t.Errorf("%q at %d pixels: %q is %d pixels wide", text, width, fitted, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+)
+
+// ogCard holds the settings of a social card
+type ogCard struct {
+	Width, Height   int
+	Background      color.NRGBA
+	BackgroundImage string
+	Gradient        *color.NRGBA // nil draws no gradient
+	Logo            string
+	LogoHeight      int
+	LogoPosition    string
+	Title           string
+	TitleSize       float64
+	TitleColor      color.NRGBA
+	MaxLines        int
+	Subtitle        string
+	SubtitleSize    float64
+	Font            string
+	Padding         int
+}
+
+// fitTitle returns the lines of title in the largest face, from size down to
+// half of it, that wraps it to at most maxLines lines of width pixels. If
+// even the smallest needs more, the text is cut short with an ellipsis.
+func fitTitle(fontName, title string, size float64, width, maxLines int) (font.Face, []string, error) {
+	for s := size; ; s -= 2 {
+		face, err := loadFontFace(fontName, s)
+		if err != nil {
+			return nil, nil, err
+		}
+		lines := wrapText(face, title, width)
+		if len(lines) <= maxLines {
+			return face, lines, nil
+		}
+		if s-2 >= size/2 {
+			face.Close()
+			continue
+		}
+
+		lines = lines[:maxLines]
+		last := strings.Fields(lines[maxLines-1])
+		for len(last) > 1 && font.MeasureString(face, strings.Join(last, " ")+"…").Ceil() > width {
+			last = last[:len(last)-1]
+		}
+		lines[maxLines-1] = strings.TrimRight(strings.Join(last, " "), ",.;:") + "…"
+		return face, lines, nil
+	}
+}
+
+// drawGradient darkens dst towards col from transparent at the top to col's
+// full opacity at the bottom
+func drawGradient(dst *image.NRGBA, col color.NRGBA) {
+	height := dst.Rect.Dy()
+	for y := range height {
+		c := col
+		c.A = uint8(float64(col.A)*float64(y)/float64(max(1, height-1)) + 0.5)
+		row := image.Rect(dst.Rect.Min.X, dst.Rect.Min.Y+y, dst.Rect.Max.X, dst.Rect.Min.Y+y+1)
+		draw.Draw(dst, row, image.NewUniform(c), image.Point{}, draw.Over)
+	}
+}
+
+// buildOGImage draws a card: the background, the gradient, the logo in a
+// corner and the title with its subtitle at the bottom left
+func buildOGImage(c *ogCard) (*image.NRGBA, error) {
+	canvas := image.NewNRGBA(image.Rect(0, 0, c.Width, c.Height))
+	draw.Draw(canvas, canvas.Rect, image.NewUniform(c.Background), image.Point{}, draw.Src)
+	if c.BackgroundImage != "" {
+		img, _, err := loadImage(c.BackgroundImage)
+		if err != nil {
+			return nil, err
+		}
+		placeImage(canvas, canvas.Rect, img, "cover")
+	}
+	if c.Gradient != nil {
+		drawGradient(canvas, *c.Gradient)
+	}
+
+	textWidth := c.Width - 2*c.Padding
+	if c.Logo != "" {
+		logo, _, err := loadImage(c.Logo)
+		if err != nil {
+			return nil, err
+		}
+		logo = fitWithin(logo, textWidth, c.LogoHeight)
+		b := logo.Bounds()
+		pt := image.Pt(c.Padding, c.Padding)
+		if strings.HasSuffix(c.LogoPosition, "right") {
+			pt.X = c.Width - c.Padding - b.Dx()
+		}
+		if strings.HasPrefix(c.LogoPosition, "bottom") {
+			pt.Y = c.Height - c.Padding - b.Dy()
+		}
+		draw.Draw(canvas, image.Rectangle{Min: pt, Max: pt.Add(b.Size())}, logo, b.Min, draw.Over)
+	}
+
+	// Stack the text up from the bottom edge
+	bottom := c.Height - c.Padding
+	if c.Subtitle != "" {
+		face, err := loadFontFace("regular", c.SubtitleSize)
+		if err != nil {
+			return nil, err
+		}
+		lines := wrapText(face, c.Subtitle, textWidth)
+		bottom -= len(lines) * face.Metrics().Height.Ceil()
+		drawText(canvas, face, lines, c.Padding, bottom, textWidth, "left", c.TitleColor)
+		bottom -= face.Metrics().Height.Ceil() / 2
+		face.Close()
+	}
+	if c.Title != "" {
+		face, lines, err := fitTitle(c.Font, c.Title, c.TitleSize, textWidth, c.MaxLines)
+		if err != nil {
+			return nil, err
+		}
+		bottom -= len(lines) * face.Metrics().Height.Ceil()
+		drawText(canvas, face, lines, c.Padding, bottom, textWidth, "left", c.TitleColor)
+		face.Close()
+	}
+	return canvas, nil
+}
+
+// applyOGTemplate sets the flags of fs named in a JSON template file that
+// were not given on the command line, so that flags override the template
+func applyOGTemplate(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read template: %w", err)
+	}
+	var values map[string]any
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("failed to parse template %s: %w", path, err)
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for name, value := range values {
+		if name == "template" || fs.Lookup(name) == nil {
+			return fmt.Errorf("invalid template %s: unknown setting %q", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("invalid template %s: %s must be a string or number", path, name)
+		}
+		if err := fs.Set(name, s); err != nil {
+			return fmt.Errorf("invalid template %s: invalid value %q for %s: %w", path, s, name, err)
+		}
+	}
+	return nil
+}
+
+// runOGImage implements the og-image subcommand
+func runOGImage(args []string) error {
+	fs := flag.NewFlagSet("og-image", flag.ExitOnError)
+	templateFile := fs.String("template", "", "JSON file setting any of the other flags by name; flags given on the command line take precedence")
+	outputFile := fs.String("output", "og-image.png", "Output image file path")
+	compressLevel := fs.Int("compress", 0, "Compression level (1-100) for the output image. 0 means no compression")
+	size := fs.String("size", "1200x630", "Size of the card as WxH")
+	backgroundHex := fs.String("background", "#1e293b", "Background color as #rrggbb")
+	backgroundImage := fs.String("background-image", "", "Image scaled to cover the card")
+	gradientHex := fs.String("gradient", "#000000b3", "Color the card is shaded towards at the bottom, as #rrggbbaa, so the title stays legible over a busy image. Empty for none")
+	logo := fs.String("logo", "", "Logo image drawn in a corner")
+	logoHeight := fs.Int("logo-height", 72, "Maximum height of the logo in pixels")
+	logoPosition := fs.String("logo-position", "top-left", "Corner for the logo: top-left, top-right, bottom-left or bottom-right")
+	title := fs.String("title", "", "Title text, wrapped to the width of the card")
+	titleSize := fs.Float64("title-size", 72, "Title size in pixels; long titles are set smaller, down to half of it")
+	titleHex := fs.String("color", "#ffffff", "Text color as #rrggbb")
+	maxLines := fs.Int("max-lines", 3, "Maximum number of title lines; longer titles are cut short with an ellipsis")
+	subtitle := fs.String("subtitle", "", "Smaller text under the title, such as the site name or a date")
+	subtitleSize := fs.Float64("subtitle-size", 32, "Subtitle size in pixels")
+	fontName := fs.String("font", "bold", "Title font: regular, bold, italic or mono")
+	padding := fs.Int("padding", 64, "Margin around the logo and text in pixels")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s og-image -title text [flags]\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	if *templateFile != "" {
+		if err := applyOGTemplate(fs, *templateFile); err != nil {
+			return err
+		}
+	}
+
+	c := &ogCard{
+		BackgroundImage: *backgroundImage,
+		Logo:            *logo,
+		LogoHeight:      *logoHeight,
+		LogoPosition:    *logoPosition,
+		Title:           *title,
+		TitleSize:       *titleSize,
+		MaxLines:        *maxLines,
+		Subtitle:        *subtitle,
+		SubtitleSize:    *subtitleSize,
+		Font:            *fontName,
+		Padding:         *padding,
+	}
+	if _, err := fmt.Sscanf(*size, "%dx%d", &c.Width, &c.Height); err != nil || c.Width < 1 || c.Height < 1 || c.Width > maxSizeSide || c.Height > maxSizeSide {
+		return fmt.Errorf("invalid size %q: expected WxH", *size)
+	}
+	if c.Title == "" && c.Subtitle == "" {
+		return fmt.Errorf("title is required. Use -title flag to specify the card's title")
+	}
+	switch c.LogoPosition {
+	case "top-left", "top-right", "bottom-left", "bottom-right":
+	default:
+		return fmt.Errorf("invalid logo position %q: expected top-left, top-right, bottom-left or bottom-right", c.LogoPosition)
+	}
+	if c.LogoHeight < 1 {
+		return fmt.Errorf("logo height must be at least 1")
+	}
+	if c.MaxLines < 1 {
+		return fmt.Errorf("max lines must be at least 1")
+	}
+	if c.Padding < 0 || 2*c.Padding >= min(c.Width, c.Height) {
+		return fmt.Errorf("padding must be at least 0 and leave room inside the card")
+	}
+	var err error
+	if c.Background, err = parseHexColor(*backgroundHex); err != nil {
+		return err
+	}
+	if c.TitleColor, err = parseHexColor(*titleHex); err != nil {
+		return err
+	}
+	if *gradientHex != "" {
+		gradient, err := parseHexColor(*gradientHex)
+		if err != nil {
+			return err
+		}
+		c.Gradient = &gradient
+	}
+
+	card, err := buildOGImage(c)
+	if err != nil {
+		return err
+	}
+
+	outPath, err := prepareOutputPath("og-image", *outputFile)
+	if err != nil {
+		return err
+	}
+	if err := saveImage(outPath, card, *compressLevel); err != nil {
+		return err
+	}
+
+	slog.Info("Social card saved", "size", fmt.Sprintf("%dx%d", c.Width, c.Height), "path", outPath)
+	return nil
+}
@@ -0,0 +1,151 @@
+//go:build onnx
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// Super-resolution models run through ONNX Runtime, which is loaded as a
+// shared library at startup. Building with -tags onnx needs cgo.
+
+// onnxRuntimeEnv names the environment variable giving the path of the ONNX
+// Runtime shared library, if it is not on the default library path, and
+// oldONNXRuntimeEnv its deprecated name
+const (
+	onnxRuntimeEnv    = envPrefix + "ONNXRUNTIME"
+	oldONNXRuntimeEnv = "IMG_PROCESSOR_ONNXRUNTIME"
+)
+
+const (
+	// onnxTileSize is the size of the tiles images are upscaled in by models
+	// that accept any size, which bounds the memory a run needs
+	onnxTileSize = 256
+
+	// onnxTileOverlap is the margin of neighbouring pixels each tile is run
+	// with and then cropped to, which hides the seams between tiles
+	onnxTileOverlap = 16
+)
+
+func init() {
+	loadUpscaler = loadONNXUpscaler
+}
+
+// onnxUpscaler runs a model with one float32 NCHW RGB input with values
+// from 0 to 1 and one output of the same layout, an integer factor larger
+type onnxUpscaler struct {
+	session    *ort.DynamicAdvancedSession
+	tileWidth  int // the model's fixed input size, or onnxTileSize
+	tileHeight int
+}
+
+func loadONNXUpscaler(modelPath string) (upscaler, error) {
+	if lib := getenvDeprecated(onnxRuntimeEnv, oldONNXRuntimeEnv); lib != "" {
+		ort.SetSharedLibraryPath(lib)
+	}
+	if !ort.IsInitialized() {
+		if err := ort.InitializeEnvironment(); err != nil {
+			return nil, fmt.Errorf("failed to load ONNX Runtime (set %s to its library path): %w", onnxRuntimeEnv, err)
+		}
+	}
+	inputs, outputs, err := ort.GetInputOutputInfo(modelPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(inputs) != 1 || len(outputs) != 1 || inputs[0].DataType != ort.TensorElementDataTypeFloat || len(inputs[0].Dimensions) != 4 || inputs[0].Dimensions[1] != 3 {
+		return nil, errors.New("expected a model with one float32 input of shape [1, 3, height, width] and one output")
+	}
+	u := &onnxUpscaler{tileWidth: onnxTileSize, tileHeight: onnxTileSize}
+	if h, w := inputs[0].Dimensions[2], inputs[0].Dimensions[3]; h > 0 && w > 0 {
+		if h <= 2*onnxTileOverlap || w <= 2*onnxTileOverlap {
+			return nil, fmt.Errorf("the model's %dx%d input is too small to upscale in tiles", w, h)
+		}
+		u.tileWidth, u.tileHeight = int(w), int(h)
+	}
+	u.session, err = ort.NewDynamicAdvancedSession(modelPath, []string{inputs[0].Name}, []string{outputs[0].Name}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// upscale runs the model over overlapping tiles of img, repeating the edge
+// pixels to fill tiles that reach past it. Transparency is resampled with
+// the active scaler, since models only see color.
+func (u *onnxUpscaler) upscale(ctx context.Context, img image.Image) (image.Image, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	src := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	drawParallel(src, src.Rect, img, bounds.Min)
+
+	stepX, stepY := u.tileWidth-2*onnxTileOverlap, u.tileHeight-2*onnxTileOverlap
+	var dst *image.NRGBA64
+	scale := 0
+	input := make([]float32, 3*u.tileWidth*u.tileHeight)
+	plane := u.tileWidth * u.tileHeight
+	for ty := 0; ty < height; ty += stepY {
+		for tx := 0; tx < width; tx += stepX {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			x0, y0 := tx-onnxTileOverlap, ty-onnxTileOverlap
+			for y := range u.tileHeight {
+				for x := range u.tileWidth {
+					c := src.NRGBA64At(min(width-1, max(0, x0+x)), min(height-1, max(0, y0+y)))
+					i := y*u.tileWidth + x
+					input[i], input[plane+i], input[2*plane+i] = float32(c.R)/0xffff, float32(c.G)/0xffff, float32(c.B)/0xffff
+				}
+			}
+			tensor, err := ort.NewTensor(ort.NewShape(1, 3, int64(u.tileHeight), int64(u.tileWidth)), input)
+			if err != nil {
+				return nil, err
+			}
+			outputs := []ort.Value{nil}
+			err = u.session.Run([]ort.Value{tensor}, outputs)
+			tensor.Destroy()
+			if err != nil {
+				return nil, fmt.Errorf("failed to run model: %w", err)
+			}
+			out, ok := outputs[0].(*ort.Tensor[float32])
+			if !ok {
+				outputs[0].Destroy()
+				return nil, errors.New("the model's output is not a float32 tensor")
+			}
+			shape := out.GetShape()
+			if dst == nil {
+				if len(shape) == 4 && shape[1] == 3 && shape[3]%int64(u.tileWidth) == 0 && shape[3] > 0 {
+					scale = int(shape[3]) / u.tileWidth
+				}
+				if scale == 0 || shape[2] != int64(u.tileHeight*scale) {
+					out.Destroy()
+					return nil, fmt.Errorf("the model's output shape %v is not a whole multiple of its input", shape)
+				}
+				dst = image.NewNRGBA64(image.Rect(0, 0, width*scale, height*scale))
+			}
+
+			// Keep the part of the tile inside its step
+			data, outWidth, outPlane := out.GetData(), u.tileWidth*scale, u.tileWidth*u.tileHeight*scale*scale
+			sample := func(v float32) uint16 { return uint16(min(1, max(0, v))*0xffff + 0.5) }
+			for y := ty * scale; y < min(height, ty+stepY)*scale; y++ {
+				for x := tx * scale; x < min(width, tx+stepX)*scale; x++ {
+					i := (y-y0*scale)*outWidth + x - x0*scale
+					dst.SetNRGBA64(x, y, color.NRGBA64{sample(data[i]), sample(data[outPlane+i]), sample(data[2*outPlane+i]), 0xffff})
+				}
+			}
+			out.Destroy()
+		}
+	}
+
+	if !isOpaqueImage(img) {
+		alpha := scaleImage(img, uint(width*scale), uint(height*scale))
+		draw.DrawMask(dst, dst.Rect, dst, image.Point{}, alpha, alpha.Bounds().Min, draw.Src)
+	}
+	return dst, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/SvnFrs/go-transform/ops"
+)
+
+// Operation is a step of the processing pipeline that transforms an image.
+// The registry of operations lives in the ops package, so that operations
+// written outside the program can register themselves too.
+type Operation = ops.Operation
+
+// operationFlag is the flag.Value of an operation's flag
+type operationFlag struct {
+	spec   ops.Spec
+	values map[string]string
+}
+
+func (f operationFlag) String() string { return "" }
+
+func (f operationFlag) Set(value string) error {
+	f.values[f.spec.Name] = value
+	return nil
+}
+
+// IsBoolFlag lets the flag package accept optional operations' flags
+// without a value
+func (f operationFlag) IsBoolFlag() bool { return f.spec.Optional }
+
+// isOperation reports whether name is a registered operation
+func isOperation(name string) bool {
+	_, ok := ops.Lookup(name)
+	return ok
+}
+
+// addOperationFlags registers a flag on fs for every registered operation,
+// storing the values given in values
+func addOperationFlags(fs *flag.FlagSet, values map[string]string) {
+	for _, spec := range ops.Registered() {
+		fs.Var(operationFlag{spec, values}, spec.Name, spec.Usage)
+	}
+}
+
+// parseOperations builds the operations enabled in values, in registration
+// order
+func parseOperations(values map[string]string) ([]Operation, error) {
+	var enabled []Operation
+	var errs []error
+	for _, spec := range ops.Registered() {
+		value, ok := values[spec.Name]
+		if !ok {
+			continue
+		}
+		op, err := spec.Parse(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for -%s: %w", value, spec.Name, err))
+			continue
+		}
+		enabled = append(enabled, op)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return enabled, nil
+}
+
+// regionPattern matches the @rect(x,y,width,height) suffix of an -op value
+var regionPattern = regexp.MustCompile(`@rect\(\s*(\d+)\s*,\s*(\d+)\s*,\s*(\d+)\s*,\s*(\d+)\s*\)$`)
+
+// parseOperationSpec builds the operation given by an -op value of the form
+// name=value, where name is a registered operation and optional ones may
+// leave out =value. A value ending in @rect(x,y,width,height) limits the
+// operation to that rectangle.
+func parseOperationSpec(spec string) (Operation, error) {
+	var region image.Rectangle
+	if m := regionPattern.FindStringSubmatch(spec); m != nil {
+		var n [4]int
+		for i := range n {
+			n[i], _ = strconv.Atoi(m[i+1])
+		}
+		if n[2] < 1 || n[3] < 1 {
+			return nil, fmt.Errorf("invalid -op %q: the region must be at least 1x1", spec)
+		}
+		region = image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3])
+		spec = strings.TrimSuffix(spec, m[0])
+	}
+
+	name, value, hasValue := strings.Cut(spec, "=")
+	registered, ok := ops.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("invalid -op %q: unknown operation %q", spec, name)
+	}
+	if !hasValue && registered.Optional {
+		value = "true"
+	}
+	op, err := registered.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q for -op %s: %w", value, name, err)
+	}
+	if region.Empty() {
+		return op, nil
+	}
+	return regionOp{name, op, region}, nil
+}
+
+// regionOp runs an operation on a rectangle of the image, leaving the rest
+// untouched. The operation must keep the size of what it is given.
+type regionOp struct {
+	name string
+	op   Operation
+	rect image.Rectangle // relative to the image's top-left corner
+}
+
+func (op regionOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	r := op.rect.Intersect(image.Rect(0, 0, width, height))
+	if r.Empty() {
+		return nil, fmt.Errorf("region %dx%d+%d+%d is outside the %dx%d image", op.rect.Dx(), op.rect.Dy(), op.rect.Min.X, op.rect.Min.Y, width, height)
+	}
+
+	// Work on a copy at the origin, so the region needs no translating
+	full := newSampleBuffer(img).img.(draw.Image)
+	sub := full.(interface {
+		SubImage(image.Rectangle) image.Image
+	}).SubImage(r)
+	out, err := op.op.Apply(ctx, sub)
+	if err != nil {
+		return nil, err
+	}
+	if out.Bounds().Size() != r.Size() {
+		return nil, fmt.Errorf("%s changes the size of the image, so it cannot be limited to a region", op.name)
+	}
+	draw.Draw(full, r, out, out.Bounds().Min, draw.Src)
+	return full, nil
+}
+
+// resizingOperation is implemented by operations that change the size of the
+// image, so that the size they make can be checked before they allocate it
+type resizingOperation interface {
+	outputSize(size image.Point) image.Point
+}
+
+// applyOperations runs ops on img in order, failing before an operation would
+// make an image of more than maxOutputPixels pixels. 0 means no limit.
+func applyOperations(ctx context.Context, img image.Image, ops []Operation, maxOutputPixels int64) (image.Image, error) {
+	for _, op := range ops {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if r, ok := op.(resizingOperation); ok {
+			size := r.outputSize(img.Bounds().Size())
+			if err := checkOutputSize(size.X, size.Y, maxOutputPixels); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		if img, err = op.Apply(ctx, img); err != nil {
+			return nil, err
+		}
+		slog.Debug("Applied operation", "operation", fmt.Sprintf("%T", op), "size", fmt.Sprintf("%dx%d", img.Bounds().Dx(), img.Bounds().Dy()))
+	}
+	return img, nil
+}
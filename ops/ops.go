@@ -0,0 +1,62 @@
+// Package ops is the registry of image operations that go-transform runs
+// after resizing. Packages outside the program register their operations
+// from init functions, and are built in by a blank import in package main.
+package ops
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"slices"
+)
+
+// Operation is a step of the processing pipeline that transforms an image.
+// Operations run after resizing, in the order they were registered.
+type Operation interface {
+	Apply(ctx context.Context, img image.Image) (image.Image, error)
+}
+
+// Spec describes a registered operation and the flag enabling it
+type Spec struct {
+	Name     string
+	Usage    string
+	Parse    func(value string) (Operation, error)
+	Optional bool // the flag may be given without a value
+}
+
+// registered lists the registered operations in registration order
+var registered []Spec
+
+// RegisterOperation adds an operation enabled by the flag -name, which is
+// accepted by the main command, the batch subcommand and as a serve request
+// option. parse builds the operation from the flag's value, or fails if the
+// value is invalid. It is meant to be called from an init function, and
+// panics if name is already registered.
+func RegisterOperation(name, usage string, parse func(value string) (Operation, error)) {
+	if _, ok := Lookup(name); ok {
+		panic(fmt.Sprintf("operation %q registered twice", name))
+	}
+	registered = append(registered, Spec{name, usage, parse, false})
+}
+
+// RegisterOptionalOperation is RegisterOperation for an operation whose flag
+// works without a value: -name passes "true" to parse. Other values must be
+// attached with =, as in -name=value, like those of boolean flags.
+func RegisterOptionalOperation(name, usage string, parse func(value string) (Operation, error)) {
+	RegisterOperation(name, usage, parse)
+	registered[len(registered)-1].Optional = true
+}
+
+// Registered returns the registered operations in registration order
+func Registered() []Spec {
+	return slices.Clone(registered)
+}
+
+// Lookup returns the registered operation called name
+func Lookup(name string) (Spec, bool) {
+	i := slices.IndexFunc(registered, func(s Spec) bool { return s.Name == name })
+	if i < 0 {
+		return Spec{}, false
+	}
+	return registered[i], true
+}
@@ -0,0 +1,40 @@
+package ops
+
+import (
+	"context"
+	"image"
+	"testing"
+)
+
+type identity struct{}
+
+func (identity) Apply(ctx context.Context, img image.Image) (image.Image, error) { return img, nil }
+
+func parseIdentity(string) (Operation, error) { return identity{}, nil }
+
+func TestRegisterOperation(t *testing.T) {
+	defer func(r []Spec) { registered = r }(registered)
+	RegisterOperation("first", "", parseIdentity)
+	RegisterOptionalOperation("second", "", parseIdentity)
+
+	specs := Registered()
+	if len(specs) != 2 || specs[0].Name != "first" || specs[1].Name != "second" {
+		t.Fatalf("registered %+v, want first and second in order", specs)
+	}
+	if spec, ok := Lookup("second"); !ok || !spec.Optional {
+		t.Errorf("second: got %+v, %v, want an optional operation", spec, ok)
+	}
+	if spec, ok := Lookup("first"); !ok || spec.Optional {
+		t.Errorf("first: got %+v, %v, want an operation taking a value", spec, ok)
+	}
+	if _, ok := Lookup("third"); ok {
+		t.Error("an unregistered operation was found")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering first twice did not panic")
+		}
+	}()
+	RegisterOperation("first", "", parseIdentity)
+}
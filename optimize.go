@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"image/gif"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// optimizeExtensions are the files the optimize subcommand recompresses
+var optimizeExtensions = []string{".png", ".jpg", ".jpeg", ".gif"}
+
+// errNotSmaller is returned by optimizeData when it finds no smaller
+// encoding, and errCannotOptimize when it cannot rewrite the file losslessly
+var (
+	errNotSmaller     = errors.New("already optimal")
+	errCannotOptimize = errors.New("cannot be optimized losslessly")
+)
+
+// optimizeData losslessly recompresses a PNG, JPEG or GIF file without its
+// metadata, keeping only what changes how the image looks: the ICC profile,
+// and the orientation of a JPEG's EXIF
+func optimizeData(ctx context.Context, ext string, data []byte, zopfli bool) ([]byte, error) {
+	var optimized []byte
+	switch ext {
+	case ".png":
+		// The PNG decoder only reads the first frame of an animated PNG
+		if _, _, _, animated := pngChunkBounds(data, "acTL", func([]byte) bool { return true }); animated {
+			return nil, fmt.Errorf("%w: animated PNG", errCannotOptimize)
+		}
+		out, err := optimizePNG(ctx, data, zopfli, false)
+		if err != nil {
+			return nil, err
+		}
+		if optimized, err = embedMetadata(out, "png", imageMetadata{ICC: readPNGICC(data)}); err != nil {
+			return nil, err
+		}
+	case ".jpg", ".jpeg":
+		c, err := readJPEGCoefficients(ctx, data)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("%w: %w", errCannotOptimize, err)
+		}
+		var out bytes.Buffer
+		if err := c.encodeOptimized(&out); err != nil {
+			return nil, err
+		}
+		meta := imageMetadata{ICC: readJPEGICC(data)}
+		if orientation := exifOrientation(readJPEGExif(data)); orientation != 1 {
+			meta.Exif = orientationExif(orientation)
+		}
+		if optimized, err = embedMetadata(out.Bytes(), "jpeg", meta); err != nil {
+			return nil, err
+		}
+	case ".gif":
+		// Re-encoding keeps every frame's pixels, palette, delay and disposal
+		// and the loop count, but drops comments and application extensions
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode GIF: %w", err)
+		}
+		var out bytes.Buffer
+		if err := gif.EncodeAll(&out, g); err != nil {
+			return nil, err
+		}
+		optimized = out.Bytes()
+	}
+	if len(optimized) >= len(data) {
+		return nil, errNotSmaller
+	}
+	return optimized, nil
+}
+
+// orientationExif returns an EXIF payload holding only an orientation
+func orientationExif(orientation int) []byte {
+	exif := []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 1, 0}
+	exif = binary.LittleEndian.AppendUint16(exif, tagOrientation)
+	exif = binary.LittleEndian.AppendUint16(exif, 3) // SHORT
+	exif = binary.LittleEndian.AppendUint32(exif, 1)
+	exif = binary.LittleEndian.AppendUint32(exif, uint32(orientation))
+	return binary.LittleEndian.AppendUint32(exif, 0)
+}
+
+// walkImages returns the files the optimize and check subcommands work on:
+// files and glob matches as given, and the files with one of extensions
+// under directories, skipping hidden directories such as .git and symlinks
+func walkImages(args, extensions []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		if isGlobPattern(arg) {
+			matches, err := expandGlob(arg)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, matches...)
+			continue
+		}
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			switch {
+			case err != nil:
+				return err
+			case d.IsDir() && path != arg && strings.HasPrefix(d.Name(), "."):
+				return filepath.SkipDir
+			case d.Type().IsRegular() && slices.Contains(extensions, strings.ToLower(filepath.Ext(path))):
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk %s: %w", arg, err)
+		}
+	}
+	return paths, nil
+}
+
+// runOptimize implements the optimize subcommand
+func runOptimize(args []string) error {
+	fs := flag.NewFlagSet("optimize", flag.ExitOnError)
+	zopfli := fs.Bool("zopfli", false, "Compress PNGs with a zopfli-style deflate encoder. Typically 3-8% smaller, but many times slower")
+	effort := fs.Int("effort", -1, "Encoding effort from 0 (fastest) to 9 (smallest files): how many PNG encodings are tried. 9 also turns on -zopfli. -1 tries them all")
+	dryRun := fs.Bool("dry-run", false, "Report the savings without changing any file")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s optimize [flags] directory-or-image ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("at least one directory or image is required")
+	}
+	if *effort < -1 || *effort > 9 {
+		return errors.New("effort must be between 0 and 9, or -1 for each encoder's default")
+	}
+	encodeEffort = *effort
+	paths, err := walkImages(fs.Args(), optimizeExtensions)
+	if err != nil {
+		return err
+	}
+	ctx, _, release := handleSignals()
+	defer release()
+
+	var errs []error
+	var images, optimized int
+	var before, saved int64
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w after optimizing %d images", errInterrupted, optimized)
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if !slices.Contains(optimizeExtensions, ext) {
+			slog.Debug("Skipping file that is not a PNG, JPEG or GIF", "path", path)
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			slog.Debug("Skipping symlink", "path", path)
+			continue
+		}
+		images++
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		before += int64(len(data))
+		out, err := optimizeData(ctx, ext, data, *zopfli || encodeEffort == 9)
+		switch {
+		case errors.Is(err, errNotSmaller):
+			slog.Debug("Already optimal", "path", path)
+			continue
+		case errors.Is(err, errCannotOptimize):
+			slog.Warn("Skipping image", "path", path, "reason", err)
+			continue
+		case err != nil:
+			errs = append(errs, fmt.Errorf("failed to optimize %s: %w", path, err))
+			continue
+		}
+		if !*dryRun {
+			if err := replaceFile(path, out, info.Mode()); err != nil {
+				errs = append(errs, fmt.Errorf("failed to write %s: %w", path, err))
+				continue
+			}
+		}
+		optimized++
+		saved += int64(len(data) - len(out))
+		message := "Optimized image"
+		if *dryRun {
+			message = "Image can be optimized"
+		}
+		slog.Info(message, "path", path, "before", len(data), "after", len(out),
+			"saved", fmt.Sprintf("%.1f%%", 100*float64(len(data)-len(out))/float64(len(data))))
+	}
+
+	percent := 0.0
+	if before > 0 {
+		percent = 100 * float64(saved) / float64(before)
+	}
+	slog.Info("Optimization complete", "images", images, "optimized", optimized, "failed", len(errs),
+		"saved_bytes", saved, "saved", fmt.Sprintf("%.1f%%", percent), "dry_run", *dryRun)
+	return errors.Join(errs...)
+}
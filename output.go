@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quiet is set by -quiet to hide progress bars and informational messages
+var quiet bool
+
+// jsonLogs is set when logging in JSON, where progress bars would corrupt
+// the log stream
+var jsonLogs bool
+
+// progressBarWidth is the number of characters in the bar itself
+const progressBarWidth = 30
+
+// progressBar draws a progress bar with counts, throughput and ETA on stderr.
+// It is only shown on a terminal with text logs when quiet is not set, and is
+// safe for concurrent use.
+type progressBar struct {
+	mu      sync.Mutex
+	w       io.Writer
+	label   string
+	unit    string
+	total   int
+	done    int
+	start   time.Time
+	drawn   time.Time
+	enabled bool
+}
+
+// newProgressBar returns a progress bar for total units of work
+func newProgressBar(label, unit string, total int) *progressBar {
+	return &progressBar{
+		w:       os.Stderr,
+		label:   label,
+		unit:    unit,
+		total:   total,
+		start:   time.Now(),
+		enabled: !quiet && !jsonLogs && total > 1 && isTerminal(os.Stderr),
+	}
+}
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Add records n more finished units, redrawing at most ten times a second
+func (p *progressBar) Add(n int) {
+	if !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	if time.Since(p.drawn) >= 100*time.Millisecond || p.done >= p.total {
+		p.draw()
+	}
+}
+
+// Step records one finished unit. When no bar is shown, for example because
+// stderr is redirected to a log, msg is logged instead.
+func (p *progressBar) Step(msg string, args ...any) {
+	if !p.enabled {
+		slog.Info(msg, args...)
+		return
+	}
+	p.Add(1)
+}
+
+// Finish draws the final state and moves to a new line
+func (p *progressBar) Finish() {
+	if !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.draw()
+	fmt.Fprintln(p.w)
+}
+
+func (p *progressBar) draw() {
+	p.drawn = time.Now()
+	elapsed := time.Since(p.start)
+	filled := progressBarWidth * min(p.done, p.total) / p.total
+
+	line := fmt.Sprintf("%s [%s%s] %d/%d %s", p.label,
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), p.done, p.total, p.unit)
+	if p.done > 0 && elapsed > 0 {
+		rate := float64(p.done) / elapsed.Seconds()
+		remaining := time.Duration(float64(p.total-p.done) / rate * float64(time.Second))
+		line += fmt.Sprintf("  %.1f %s/s  ETA %s", rate, p.unit, remaining.Round(time.Second))
+	}
+	// Pad to clear leftovers of a longer previous line
+	fmt.Fprintf(p.w, "\r%-90s", line)
+}
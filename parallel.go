@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/draw"
+	"log/slog"
+	"runtime"
+	"sync"
+)
+
+// minBandRows keeps bands large enough that goroutine overhead stays negligible
+const minBandRows = 16
+
+// parallelRows splits the rows [0, height) into horizontal bands and calls fn
+// for each band concurrently, using one goroutine per available CPU. A panic
+// in a band is raised again on the caller's goroutine once all bands are done,
+// so that callers such as processSafely can recover from it.
+func parallelRows(height int, fn func(y0, y1 int)) {
+	bands := min(runtime.GOMAXPROCS(0), (height+minBandRows-1)/minBandRows)
+	if bands <= 1 {
+		fn(0, height)
+		return
+	}
+
+	slog.Log(context.Background(), levelTrace, "Split work into bands", "rows", height, "bands", bands)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var panicked any
+	for i := 0; i < bands; i++ {
+		y0 := height * i / bands
+		y1 := height * (i + 1) / bands
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					once.Do(func() { panicked = r })
+				}
+			}()
+			fn(y0, y1)
+		}()
+	}
+	wg.Wait()
+	if panicked != nil {
+		panic(panicked)
+	}
+}
+
+// drawParallel is draw.Draw with draw.Src, split into bands drawn concurrently
+func drawParallel(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	parallelRows(r.Dy(), func(y0, y1 int) {
+		band := image.Rect(r.Min.X, r.Min.Y+y0, r.Max.X, r.Min.Y+y1)
+		draw.Draw(dst, band, src, sp.Add(image.Pt(0, y0)), draw.Src)
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParallelRowsCoversAllRows(t *testing.T) {
+	const height = 1000
+	var rows [height]atomic.Int32
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			rows[y].Add(1)
+		}
+	})
+	for y := range rows {
+		if n := rows[y].Load(); n != 1 {
+			t.Fatalf("row %d was visited %d times", y, n)
+		}
+	}
+}
+
+func TestParallelRowsRaisesPanicOnCaller(t *testing.T) {
+	// Run several bands even on a single CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	defer func() {
+		if r := recover(); r != "bad band" {
+			t.Fatalf("recovered %v, want the band's panic", r)
+		}
+	}()
+	parallelRows(1000, func(y0, y1 int) {
+		if y0 > 0 {
+			panic("bad band")
+		}
+	})
+	t.Fatal("parallelRows returned without panicking")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"strings"
+)
+
+// pdfPageSizes maps page size names to their dimensions in points (1/72 inch)
+var pdfPageSizes = map[string][2]float64{
+	"a4":     {595.28, 841.89},
+	"a3":     {841.89, 1190.55},
+	"a5":     {419.53, 595.28},
+	"letter": {612, 792},
+	"legal":  {612, 1008},
+}
+
+// pdfWriter writes numbered PDF objects and records their offsets for the xref table
+type pdfWriter struct {
+	buf     bytes.Buffer
+	offsets []int
+}
+
+// addObject writes an object body and returns its object number
+func (p *pdfWriter) addObject(body string, stream []byte) int {
+	p.offsets = append(p.offsets, p.buf.Len())
+	num := len(p.offsets)
+	fmt.Fprintf(&p.buf, "%d 0 obj\n%s\n", num, body)
+	if stream != nil {
+		p.buf.WriteString("stream\n")
+		p.buf.Write(stream)
+		p.buf.WriteString("\nendstream\n")
+	}
+	p.buf.WriteString("endobj\n")
+	return num
+}
+
+// reserveObject allocates an object number to be written later with setObject
+func (p *pdfWriter) reserveObject() int {
+	p.offsets = append(p.offsets, -1)
+	return len(p.offsets)
+}
+
+// setObject writes the body of a previously reserved object
+func (p *pdfWriter) setObject(num int, body string) {
+	p.offsets[num-1] = p.buf.Len()
+	fmt.Fprintf(&p.buf, "%d 0 obj\n%s\nendobj\n", num, body)
+}
+
+// pdfImageStream encodes img for embedding as a PDF image XObject. JPEG sources
+// (or lossy output) use DCTDecode, everything else is stored losslessly with FlateDecode.
+func pdfImageStream(img image.Image, lossy bool, quality int) (filter string, data []byte, err error) {
+	bounds := img.Bounds()
+
+	// PDF image XObjects have no alpha here, so flatten transparency onto white
+	rgb := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			a := uint32(c.A)
+			rgb.SetRGBA(x, y, color.RGBA{
+				R: uint8((uint32(c.R)*a + 255*(255-a)) / 255),
+				G: uint8((uint32(c.G)*a + 255*(255-a)) / 255),
+				B: uint8((uint32(c.B)*a + 255*(255-a)) / 255),
+				A: 255,
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	if lossy {
+		if err := jpeg.Encode(&buf, rgb, &jpeg.Options{Quality: quality}); err != nil {
+			return "", nil, fmt.Errorf("failed to encode PDF page as JPEG: %w", err)
+		}
+		return "/DCTDecode", buf.Bytes(), nil
+	}
+
+	zw, _ := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	row := make([]byte, 3*bounds.Dx())
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			i := rgb.PixOffset(x, y)
+			copy(row[3*x:3*x+3], rgb.Pix[i:i+3])
+		}
+		if _, err := zw.Write(row); err != nil {
+			return "", nil, fmt.Errorf("failed to compress PDF page: %w", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", nil, fmt.Errorf("failed to compress PDF page: %w", err)
+	}
+	return "/FlateDecode", buf.Bytes(), nil
+}
+
+// EncodePDF writes the images to w as a PDF document, one image per page.
+// pageSize is a named size (a4, letter, ...) or "fit" to size each page to its
+// image at the given DPI. Images larger than a named page are scaled down to fit.
+func EncodePDF(w io.Writer, images []image.Image, pageSize string, dpi float64, lossy bool, quality int) error {
+	pageSize = strings.ToLower(pageSize)
+	named, isNamed := pdfPageSizes[pageSize]
+	if !isNamed && pageSize != "fit" {
+		return fmt.Errorf("unsupported page size %q", pageSize)
+	}
+	if dpi <= 0 {
+		return fmt.Errorf("DPI must be positive")
+	}
+
+	p := &pdfWriter{}
+	p.buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	catalog := p.reserveObject()
+	pages := p.reserveObject()
+
+	var kids []string
+	for i, img := range images {
+		bounds := img.Bounds()
+		// Natural size of the image in points at the requested density
+		imgW := float64(bounds.Dx()) * 72 / dpi
+		imgH := float64(bounds.Dy()) * 72 / dpi
+
+		pageW, pageH := imgW, imgH
+		if isNamed {
+			pageW, pageH = named[0], named[1]
+			if imgW > imgH && pageW < pageH {
+				// Use landscape orientation for wide images
+				pageW, pageH = pageH, pageW
+			}
+			if scale := min(pageW/imgW, pageH/imgH); scale < 1 {
+				imgW *= scale
+				imgH *= scale
+			}
+		}
+
+		filter, data, err := pdfImageStream(img, lossy, quality)
+		if err != nil {
+			return err
+		}
+
+		xobj := p.addObject(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter %s /Length %d >>",
+			bounds.Dx(), bounds.Dy(), filter, len(data)), data)
+
+		content := fmt.Sprintf("q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q", imgW, imgH, (pageW-imgW)/2, (pageH-imgH)/2, i)
+		contents := p.addObject(fmt.Sprintf("<< /Length %d >>", len(content)), []byte(content))
+
+		page := p.addObject(fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im%d %d 0 R >> >> /Contents %d 0 R >>",
+			pages, pageW, pageH, i, xobj, contents), nil)
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+	}
+
+	p.setObject(pages, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	p.setObject(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages))
+
+	xref := p.buf.Len()
+	fmt.Fprintf(&p.buf, "xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, off := range p.offsets {
+		fmt.Fprintf(&p.buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&p.buf, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.offsets)+1, catalog, xref)
+
+	if _, err := w.Write(p.buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write PDF: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,796 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// PDF input support. Without an external renderer (see pdfrender.go), only
+// pages that carry an embedded raster image (scans, image-to-PDF exports, ...)
+// can be read: the largest image on the page is extracted and returned.
+// Vector content is not rendered.
+
+// PDF object types produced by pdfParser
+type (
+	pdfName   string
+	pdfDict   map[string]any
+	pdfRef    struct{ Num, Gen int }
+	pdfStream struct {
+		Dict pdfDict
+		Data []byte
+	}
+)
+
+// pdfParser parses PDF objects from a byte slice
+type pdfParser struct {
+	data []byte
+	pos  int
+}
+
+var errPDFSyntax = errors.New("malformed PDF object")
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return isPDFSpace(c) || bytes.IndexByte([]byte("()<>[]{}/%"), c) >= 0
+}
+
+// skipSpace skips whitespace and comments
+func (p *pdfParser) skipSpace() {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if c == '%' {
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' && p.data[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		p.pos++
+	}
+}
+
+// token reads a run of regular characters
+func (p *pdfParser) token() string {
+	start := p.pos
+	for p.pos < len(p.data) && !isPDFDelimiter(p.data[p.pos]) {
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+// parseValue parses the next object, including a trailing stream body for dictionaries
+func (p *pdfParser) parseValue() (any, error) {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	switch c := p.data[p.pos]; {
+	case c == '<' && p.pos+1 < len(p.data) && p.data[p.pos+1] == '<':
+		p.pos += 2
+		dict := pdfDict{}
+		for {
+			p.skipSpace()
+			if p.pos+1 < len(p.data) && p.data[p.pos] == '>' && p.data[p.pos+1] == '>' {
+				p.pos += 2
+				break
+			}
+			key, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(pdfName)
+			if !ok {
+				return nil, errPDFSyntax
+			}
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			dict[string(name)] = value
+		}
+		return p.parseStream(dict), nil
+
+	case c == '<':
+		p.pos++
+		end := bytes.IndexByte(p.data[p.pos:], '>')
+		if end < 0 {
+			return nil, errPDFSyntax
+		}
+		var hex []byte
+		for _, h := range p.data[p.pos : p.pos+end] {
+			if !isPDFSpace(h) {
+				hex = append(hex, h)
+			}
+		}
+		if len(hex)%2 == 1 {
+			hex = append(hex, '0')
+		}
+		p.pos += end + 1
+		out := make([]byte, len(hex)/2)
+		for i := range out {
+			v, err := strconv.ParseUint(string(hex[2*i:2*i+2]), 16, 8)
+			if err != nil {
+				return nil, errPDFSyntax
+			}
+			out[i] = byte(v)
+		}
+		return string(out), nil
+
+	case c == '(':
+		return p.parseLiteralString()
+
+	case c == '/':
+		p.pos++
+		return pdfName(p.token()), nil
+
+	case c == '[':
+		p.pos++
+		var arr []any
+		for {
+			p.skipSpace()
+			if p.pos < len(p.data) && p.data[p.pos] == ']' {
+				p.pos++
+				return arr, nil
+			}
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+
+	case c == '+' || c == '-' || c == '.' || c >= '0' && c <= '9':
+		tok := p.token()
+		num, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, errPDFSyntax
+		}
+		// Look ahead for an indirect reference "num gen R"
+		save := p.pos
+		p.skipSpace()
+		gen := p.token()
+		p.skipSpace()
+		if g, err := strconv.Atoi(gen); err == nil && p.pos < len(p.data) && p.data[p.pos] == 'R' &&
+			(p.pos+1 == len(p.data) || isPDFDelimiter(p.data[p.pos+1])) {
+			p.pos++
+			return pdfRef{Num: int(num), Gen: g}, nil
+		}
+		p.pos = save
+		return num, nil
+
+	default:
+		switch tok := p.token(); tok {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		default:
+			return nil, errPDFSyntax
+		}
+	}
+}
+
+// parseLiteralString parses a (...) string with nested parentheses and escapes
+func (p *pdfParser) parseLiteralString() (any, error) {
+	p.pos++
+	var out []byte
+	depth := 1
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return string(out), nil
+			}
+		case '\\':
+			if p.pos >= len(p.data) {
+				return nil, errPDFSyntax
+			}
+			e := p.data[p.pos]
+			p.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r', '\n':
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for i := 0; i < 2 && p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '7'; i++ {
+						v = v*8 + int(p.data[p.pos]-'0')
+						p.pos++
+					}
+					c = byte(v)
+				} else {
+					c = e
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return nil, errPDFSyntax
+}
+
+// parseStream attaches the stream body following a dictionary, if there is one
+func (p *pdfParser) parseStream(dict pdfDict) any {
+	save := p.pos
+	p.skipSpace()
+	if !bytes.HasPrefix(p.data[p.pos:], []byte("stream")) {
+		p.pos = save
+		return dict
+	}
+	p.pos += len("stream")
+	if p.pos < len(p.data) && p.data[p.pos] == '\r' {
+		p.pos++
+	}
+	if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+		p.pos++
+	}
+
+	start := p.pos
+	// Trust a direct /Length when it lands on endstream, otherwise search for it
+	if length, ok := dict["Length"].(float64); ok {
+		end := start + int(length)
+		if end <= len(p.data) {
+			rest := bytes.TrimLeft(p.data[end:min(end+16, len(p.data))], "\r\n ")
+			if bytes.HasPrefix(rest, []byte("endstream")) {
+				p.pos = end
+				return &pdfStream{Dict: dict, Data: p.data[start:end]}
+			}
+		}
+	}
+
+	end := bytes.Index(p.data[start:], []byte("endstream"))
+	if end < 0 {
+		end = len(p.data) - start
+	}
+	p.pos = start + end
+	data := bytes.TrimRight(p.data[start:start+end], "\r\n")
+	return &pdfStream{Dict: dict, Data: data}
+}
+
+// pdfDocument holds every object found in a PDF file
+type pdfDocument struct {
+	objects map[int]any
+}
+
+var pdfObjectHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+// parsePDF scans the file for objects. The xref table is not needed: objects
+// are located directly, and later definitions override earlier ones as they
+// would with incremental updates.
+func parsePDF(data []byte) (*pdfDocument, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return nil, fmt.Errorf("not a PDF file")
+	}
+
+	doc := &pdfDocument{objects: map[int]any{}}
+	next := 0
+	for _, m := range pdfObjectHeader.FindAllSubmatchIndex(data, -1) {
+		if m[0] < next {
+			// Inside the previous object's stream data
+			continue
+		}
+		num, _ := strconv.Atoi(string(data[m[2]:m[3]]))
+		p := &pdfParser{data: data, pos: m[1]}
+		value, err := p.parseValue()
+		if err != nil {
+			continue
+		}
+		doc.objects[num] = value
+		next = p.pos
+	}
+
+	// Unpack compressed object streams
+	for _, obj := range doc.objects {
+		s, ok := obj.(*pdfStream)
+		if !ok || s.Dict["Type"] != pdfName("ObjStm") {
+			continue
+		}
+		doc.unpackObjectStream(s)
+	}
+
+	if len(doc.objects) == 0 {
+		return nil, fmt.Errorf("no objects found in PDF")
+	}
+	return doc, nil
+}
+
+// unpackObjectStream adds the objects stored in an /ObjStm stream
+func (d *pdfDocument) unpackObjectStream(s *pdfStream) {
+	data, filter, err := d.decodeStream(s)
+	if err != nil || filter != "" {
+		return
+	}
+	n, _ := d.resolve(s.Dict["N"]).(float64)
+	first, _ := d.resolve(s.Dict["First"]).(float64)
+
+	header := &pdfParser{data: data}
+	for i := 0; i < int(n); i++ {
+		num, err1 := header.parseValue()
+		off, err2 := header.parseValue()
+		if err1 != nil || err2 != nil {
+			return
+		}
+		objNum, _ := num.(float64)
+		offset, _ := off.(float64)
+		if _, exists := d.objects[int(objNum)]; exists {
+			continue
+		}
+		p := &pdfParser{data: data, pos: int(first) + int(offset)}
+		if value, err := p.parseValue(); err == nil {
+			d.objects[int(objNum)] = value
+		}
+	}
+}
+
+// resolve follows indirect references
+func (d *pdfDocument) resolve(v any) any {
+	for i := 0; i < 32; i++ {
+		ref, ok := v.(pdfRef)
+		if !ok {
+			return v
+		}
+		v = d.objects[ref.Num]
+	}
+	return nil
+}
+
+// dict resolves v and returns it as a dictionary (including a stream's dictionary)
+func (d *pdfDocument) dict(v any) pdfDict {
+	switch v := d.resolve(v).(type) {
+	case pdfDict:
+		return v
+	case *pdfStream:
+		return v.Dict
+	}
+	return nil
+}
+
+// decodeStream applies the stream's filters. Image codecs (DCTDecode, JPXDecode)
+// are left in place and returned as the remaining filter.
+func (d *pdfDocument) decodeStream(s *pdfStream) ([]byte, string, error) {
+	var filters []any
+	switch f := d.resolve(s.Dict["Filter"]).(type) {
+	case pdfName:
+		filters = []any{f}
+	case []any:
+		filters = f
+	}
+	var params []any
+	switch dp := d.resolve(s.Dict["DecodeParms"]).(type) {
+	case pdfDict:
+		params = []any{dp}
+	case []any:
+		params = dp
+	}
+
+	data := s.Data
+	for i, f := range filters {
+		name, _ := d.resolve(f).(pdfName)
+		var parms pdfDict
+		if i < len(params) {
+			parms = d.dict(params[i])
+		}
+
+		switch name {
+		case "FlateDecode", "Fl":
+			r, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to inflate PDF stream: %w", err)
+			}
+			inflated, err := io.ReadAll(r)
+			if err != nil && len(inflated) == 0 {
+				return nil, "", fmt.Errorf("failed to inflate PDF stream: %w", err)
+			}
+			data, err = d.unpredict(inflated, parms)
+			if err != nil {
+				return nil, "", err
+			}
+		case "DCTDecode", "DCT", "JPXDecode":
+			if i != len(filters)-1 {
+				return nil, "", fmt.Errorf("unsupported PDF filter chain")
+			}
+			return data, string(name), nil
+		default:
+			return nil, "", fmt.Errorf("unsupported PDF stream filter %s", name)
+		}
+	}
+	return data, "", nil
+}
+
+// unpredict reverses PNG predictors applied before Flate compression
+func (d *pdfDocument) unpredict(data []byte, parms pdfDict) ([]byte, error) {
+	predictor, _ := d.resolve(parms["Predictor"]).(float64)
+	if predictor < 10 {
+		return data, nil
+	}
+	colors, bpc, columns := 1.0, 8.0, 1.0
+	if v, ok := d.resolve(parms["Colors"]).(float64); ok {
+		colors = v
+	}
+	if v, ok := d.resolve(parms["BitsPerComponent"]).(float64); ok {
+		bpc = v
+	}
+	if v, ok := d.resolve(parms["Columns"]).(float64); ok {
+		columns = v
+	}
+
+	bpp := max(1, int(colors*bpc)/8)
+	rowLen := int(colors*bpc*columns+7) / 8
+	var out []byte
+	prev := make([]byte, rowLen)
+	for off := 0; off+rowLen+1 <= len(data); off += rowLen + 1 {
+		filter := data[off]
+		row := make([]byte, rowLen)
+		copy(row, data[off+1:off+1+rowLen])
+		for i := range row {
+			var left, upLeft byte
+			if i >= bpp {
+				left = row[i-bpp]
+				upLeft = prev[i-bpp]
+			}
+			up := prev[i]
+			switch filter {
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// pages returns the page dictionaries in document order, with inheritable
+// attributes (Resources, MediaBox) copied down from the page tree
+func (d *pdfDocument) pages() []pdfDict {
+	var root pdfDict
+	for _, obj := range d.objects {
+		if dict := d.dict(obj); dict != nil && dict["Type"] == pdfName("Catalog") {
+			root = d.dict(dict["Pages"])
+			break
+		}
+	}
+
+	var pages []pdfDict
+	var walk func(node pdfDict, inherited pdfDict, depth int)
+	walk = func(node pdfDict, inherited pdfDict, depth int) {
+		if node == nil || depth > 64 {
+			return
+		}
+		attrs := pdfDict{}
+		for k, v := range inherited {
+			attrs[k] = v
+		}
+		for _, k := range []string{"Resources", "MediaBox"} {
+			if v, ok := node[k]; ok {
+				attrs[k] = v
+			}
+		}
+
+		if node["Type"] == pdfName("Page") {
+			page := pdfDict{}
+			for k, v := range node {
+				page[k] = v
+			}
+			for k, v := range attrs {
+				page[k] = v
+			}
+			pages = append(pages, page)
+			return
+		}
+		kids, _ := d.resolve(node["Kids"]).([]any)
+		for _, kid := range kids {
+			walk(d.dict(kid), attrs, depth+1)
+		}
+	}
+	walk(root, nil, 0)
+	return pages
+}
+
+// largestImage finds the biggest image XObject reachable from a resources dictionary
+func (d *pdfDocument) largestImage(resources pdfDict, depth int) *pdfStream {
+	if resources == nil || depth > 4 {
+		return nil
+	}
+
+	var best *pdfStream
+	bestArea := 0.0
+	for _, v := range d.dict(resources["XObject"]) {
+		s, ok := d.resolve(v).(*pdfStream)
+		if !ok {
+			continue
+		}
+		candidate := s
+		if s.Dict["Subtype"] == pdfName("Form") {
+			candidate = d.largestImage(d.dict(s.Dict["Resources"]), depth+1)
+		} else if s.Dict["Subtype"] != pdfName("Image") || s.Dict["ImageMask"] == true {
+			continue
+		}
+		if candidate == nil {
+			continue
+		}
+		w, _ := d.resolve(candidate.Dict["Width"]).(float64)
+		h, _ := d.resolve(candidate.Dict["Height"]).(float64)
+		if w*h > bestArea {
+			best, bestArea = candidate, w*h
+		}
+	}
+	return best
+}
+
+// colorComponents describes a PDF colour space: its component count and, for
+// /Indexed spaces, the base component count and palette
+func (d *pdfDocument) colorComponents(cs any) (components int, palette []byte, paletteComponents int, err error) {
+	switch v := d.resolve(cs).(type) {
+	case pdfName:
+		switch v {
+		case "DeviceGray", "CalGray", "G":
+			return 1, nil, 0, nil
+		case "DeviceRGB", "CalRGB", "RGB":
+			return 3, nil, 0, nil
+		case "DeviceCMYK", "CMYK":
+			return 4, nil, 0, nil
+		}
+	case []any:
+		if len(v) == 0 {
+			break
+		}
+		switch d.resolve(v[0]) {
+		case pdfName("ICCBased"):
+			if len(v) > 1 {
+				if n, ok := d.resolve(d.dict(v[1])["N"]).(float64); ok {
+					return int(n), nil, 0, nil
+				}
+			}
+		case pdfName("CalRGB"), pdfName("Lab"):
+			return 3, nil, 0, nil
+		case pdfName("CalGray"):
+			return 1, nil, 0, nil
+		case pdfName("Indexed"), pdfName("I"):
+			if len(v) < 4 {
+				break
+			}
+			base, _, _, err := d.colorComponents(v[1])
+			if err != nil {
+				return 0, nil, 0, err
+			}
+			switch lookup := d.resolve(v[3]).(type) {
+			case string:
+				palette = []byte(lookup)
+			case *pdfStream:
+				palette, _, err = d.decodeStream(lookup)
+				if err != nil {
+					return 0, nil, 0, err
+				}
+			}
+			return 1, palette, base, nil
+		}
+	}
+	return 0, nil, 0, fmt.Errorf("unsupported PDF color space %v", cs)
+}
+
+// decodeImage turns an image XObject into an image.Image
+func (d *pdfDocument) decodeImage(s *pdfStream) (image.Image, error) {
+	data, filter, err := d.decodeStream(s)
+	if err != nil {
+		return nil, err
+	}
+	switch filter {
+	case "DCTDecode", "DCT":
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode embedded JPEG: %w", err)
+		}
+		return img, nil
+	case "JPXDecode":
+		return nil, fmt.Errorf("JPEG 2000 images in PDFs are not supported")
+	}
+
+	width, _ := d.resolve(s.Dict["Width"]).(float64)
+	height, _ := d.resolve(s.Dict["Height"]).(float64)
+	bpc, _ := d.resolve(s.Dict["BitsPerComponent"]).(float64)
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("embedded image has invalid dimensions")
+	}
+	if bpc != 1 && bpc != 2 && bpc != 4 && bpc != 8 {
+		return nil, fmt.Errorf("unsupported bit depth %v in embedded image", bpc)
+	}
+
+	comps, palette, paletteComps, err := d.colorComponents(s.Dict["ColorSpace"])
+	if err != nil {
+		return nil, err
+	}
+
+	w, h, bits := int(width), int(height), int(bpc)
+	rowLen := (w*comps*bits + 7) / 8
+	if len(data) < rowLen*h {
+		return nil, fmt.Errorf("embedded image data is truncated")
+	}
+
+	maxVal := (1 << bits) - 1
+	sample := func(row []byte, i int) int {
+		if bits == 8 {
+			return int(row[i])
+		}
+		bit := i * bits
+		return int(row[bit/8]>>(8-bits-bit%8)) & maxVal
+	}
+	scale := func(v int) uint8 { return uint8(v * 255 / maxVal) }
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		row := data[y*rowLen : (y+1)*rowLen]
+		for x := 0; x < w; x++ {
+			var c color.NRGBA
+			switch {
+			case palette != nil:
+				idx := sample(row, x) * paletteComps
+				if idx+paletteComps > len(palette) {
+					continue
+				}
+				entry := palette[idx : idx+paletteComps]
+				switch paletteComps {
+				case 1:
+					c = color.NRGBA{entry[0], entry[0], entry[0], 255}
+				case 3:
+					c = color.NRGBA{entry[0], entry[1], entry[2], 255}
+				case 4:
+					r, g, b := color.CMYKToRGB(entry[0], entry[1], entry[2], entry[3])
+					c = color.NRGBA{r, g, b, 255}
+				}
+			case comps == 1:
+				v := scale(sample(row, x))
+				c = color.NRGBA{v, v, v, 255}
+			case comps == 3:
+				c = color.NRGBA{scale(sample(row, 3*x)), scale(sample(row, 3*x+1)), scale(sample(row, 3*x+2)), 255}
+			case comps == 4:
+				r, g, b := color.CMYKToRGB(scale(sample(row, 4*x)), scale(sample(row, 4*x+1)), scale(sample(row, 4*x+2)), scale(sample(row, 4*x+3)))
+				c = color.NRGBA{r, g, b, 255}
+			default:
+				return nil, fmt.Errorf("unsupported component count %d in embedded image", comps)
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img, nil
+}
+
+// mediaBox returns the width and height of page in points, if it has a
+// MediaBox
+func (d *pdfDocument) mediaBox(page pdfDict) (width, height float64, ok bool) {
+	box, _ := d.resolve(page["MediaBox"]).([]any)
+	if len(box) != 4 {
+		return 0, 0, false
+	}
+	var coords [4]float64
+	for i, v := range box {
+		coords[i], _ = d.resolve(v).(float64)
+	}
+	return coords[2] - coords[0], coords[3] - coords[1], true
+}
+
+// decodePDFPage extracts the raster image of a 1-based page number. When
+// density is positive the image is resampled to fit the page's size at that
+// many dots per inch; otherwise it is returned at its native resolution.
+func decodePDFPage(r io.Reader, pageNum int, density float64) (image.Image, error) {
+	data, err := inputLimits.readInput(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF: %w", err)
+	}
+	doc, err := parsePDF(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := doc.pages()
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no pages found in PDF")
+	}
+	if pageNum < 1 || pageNum > len(pages) {
+		return nil, fmt.Errorf("page %d out of range: PDF has %d pages", pageNum, len(pages))
+	}
+	page := pages[pageNum-1]
+
+	stream := doc.largestImage(doc.dict(page["Resources"]), 0)
+	if stream == nil {
+		return nil, fmt.Errorf("page %d has no embedded raster image; install pdftoppm, mutool or gs to render vector PDF content", pageNum)
+	}
+	width, _ := doc.resolve(stream.Dict["Width"]).(float64)
+	height, _ := doc.resolve(stream.Dict["Height"]).(float64)
+	if err := inputLimits.checkDimensions(int(width), int(height)); err != nil {
+		return nil, err
+	}
+	img, err := doc.decodeImage(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	if density > 0 {
+		if pageWidth, pageHeight, ok := doc.mediaBox(page); ok {
+			// Fit the image to the page at the requested density, keeping its aspect ratio
+			bounds := img.Bounds()
+			scale := min(pageWidth*density/72/float64(bounds.Dx()), pageHeight*density/72/float64(bounds.Dy()))
+			width := uint(float64(bounds.Dx())*scale + 0.5)
+			height := uint(float64(bounds.Dy())*scale + 0.5)
+			if err := inputLimits.checkDimensions(int(width), int(height)); err != nil {
+				return nil, err
+			}
+			if width > 0 && height > 0 {
+				img = scaleImage(img, width, height)
+			}
+		}
+	}
+
+	return img, nil
+}
+
+func decodePDF(r io.Reader) (image.Image, error) {
+	return decodePDFPage(r, 1, 0)
+}
+
+func decodePDFConfig(r io.Reader) (image.Config, error) {
+	img, err := decodePDF(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: img.ColorModel(), Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}, nil
+}
+
+func init() {
+	image.RegisterFormat("pdf", "%PDF-", decodePDF, decodePDFConfig)
+}
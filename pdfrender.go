@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// pdfRenderers are the programs that can render PDF pages, vector content
+// and text included, in the order -pdf-renderer auto tries them
+var pdfRenderers = []string{"pdftoppm", "mutool", "gs"}
+
+// pdfRenderDPI is the density pages are rendered at when -density is not given
+const pdfRenderDPI = 150
+
+// findPDFRenderer returns the renderer program -pdf-renderer names: a path to
+// or name of one of pdfRenderers, or auto for the first of them found in the
+// PATH. It returns "" for none, or for auto when no renderer is installed, in
+// which case the page's embedded raster image is extracted instead.
+func findPDFRenderer(renderer string) (string, error) {
+	switch renderer {
+	case "", "none":
+		return "", nil
+	case "auto":
+		for _, name := range pdfRenderers {
+			if path, err := exec.LookPath(name); err == nil {
+				return path, nil
+			}
+		}
+		return "", nil
+	}
+	if pdfRendererKind(renderer) == "" {
+		return "", fmt.Errorf("unknown pdf-renderer %q: use auto, none or a path to %s", renderer, strings.Join(pdfRenderers, ", "))
+	}
+	return renderer, nil
+}
+
+// pdfRendererKind returns which of pdfRenderers the program at path is, from
+// its file name, or "" if it is none of them
+func pdfRendererKind(path string) string {
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(path)), ".exe")
+	switch {
+	case name == "pdftoppm", name == "mutool":
+		return name
+	case name == "gs", strings.HasPrefix(name, "gswin"):
+		return "gs"
+	}
+	return ""
+}
+
+// checkRenderSize checks the size of the page rendered at density against
+// inputLimits before a renderer allocates it. PDFs whose pages cannot be
+// read here are left to the renderer, and its output is checked as it is
+// decoded.
+func checkRenderSize(data []byte, pageNum int, density float64) error {
+	doc, err := parsePDF(data)
+	if err != nil {
+		return nil
+	}
+	pages := doc.pages()
+	if len(pages) == 0 {
+		return nil
+	}
+	if pageNum < 1 || pageNum > len(pages) {
+		return fmt.Errorf("page %d out of range: PDF has %d pages", pageNum, len(pages))
+	}
+	width, height, ok := doc.mediaBox(pages[pageNum-1])
+	if !ok {
+		return nil
+	}
+	return inputLimits.checkDimensions(int(width*density/72+0.5), int(height*density/72+0.5))
+}
+
+// renderPDFPage runs renderer to draw the 1-based page of the PDF in data at
+// density dots per inch, and returns the page as a PNG. The PDF is written
+// to a temporary file, as not every renderer reads standard input.
+func renderPDFPage(ctx context.Context, renderer string, data []byte, page int, density float64) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "go-transform-pdf")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "input.pdf"), filepath.Join(dir, "page.png")
+	if err := os.WriteFile(in, data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write temporary PDF: %w", err)
+	}
+
+	p, dpi := strconv.Itoa(page), strconv.FormatFloat(density, 'f', -1, 64)
+	var args []string
+	switch pdfRendererKind(renderer) {
+	case "pdftoppm":
+		// pdftoppm adds .png to the output name
+		args = []string{"-f", p, "-l", p, "-r", dpi, "-png", "-singlefile", in, strings.TrimSuffix(out, ".png")}
+	case "mutool":
+		args = []string{"draw", "-q", "-r", dpi, "-F", "png", "-o", out, in, p}
+	default:
+		args = []string{"-q", "-dSAFER", "-dBATCH", "-dNOPAUSE", "-sDEVICE=png16m", "-r" + dpi,
+			"-dFirstPage=" + p, "-dLastPage=" + p, "-dTextAlphaBits=4", "-dGraphicsAlphaBits=4", "-sOutputFile=" + out, in}
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, renderer, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("pdf-renderer %s was not found: install it, give its path or use -pdf-renderer none", renderer)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("%s failed: %w", filepath.Base(renderer), err)
+	}
+	png, err := os.ReadFile(out)
+	if err != nil || len(png) == 0 {
+		return nil, fmt.Errorf("%s rendered no page %d: the PDF may have fewer pages", filepath.Base(renderer), page)
+	}
+	slog.Info("Rendered PDF page", "page", page, "dpi", density, "renderer", filepath.Base(renderer))
+	return png, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFindPDFRenderer(t *testing.T) {
+	for _, name := range []string{"", "none"} {
+		if r, err := findPDFRenderer(name); r != "" || err != nil {
+			t.Errorf("%q: got %q, %v, want extraction", name, r, err)
+		}
+	}
+	for _, name := range []string{"pdftoppm", "/usr/bin/mutool", "gswin64c.exe"} {
+		if r, err := findPDFRenderer(name); r != name || err != nil {
+			t.Errorf("%q: got %q, %v", name, r, err)
+		}
+	}
+	if _, err := findPDFRenderer("convert"); err == nil {
+		t.Error("convert was accepted as a PDF renderer")
+	}
+}
+
+func TestRenderPDFPage(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake renderer is a shell script")
+	}
+	dir := t.TempDir()
+	var page bytes.Buffer
+	if err := png.Encode(&page, image.NewGray(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "page.png"), page.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// The fake pdftoppm records its arguments and writes the page where
+	// its last argument, the output name without .png, says
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\nfor a; do out=$a; done\ncp " + filepath.Join(dir, "page.png") + " \"$out.png\"\n"
+	renderer := filepath.Join(dir, "pdftoppm")
+	if err := os.WriteFile(renderer, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := renderPDFPage(context.Background(), renderer, []byte("%PDF-1.4"), 2, 72)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, page.Bytes()) {
+		t.Error("the rendered page differs from what the renderer wrote")
+	}
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(args), "-f 2 -l 2 -r 72 -png -singlefile ") {
+		t.Errorf("pdftoppm was run with %q", args)
+	}
+
+	if _, err := renderPDFPage(context.Background(), filepath.Join(dir, "missing", "gs"), []byte("%PDF-1.4"), 1, 72); err == nil {
+		t.Error("a missing renderer rendered a page")
+	}
+}
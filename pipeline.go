@@ -0,0 +1,963 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// processOptions holds the settings of the image processing pipeline, shared
+// by the main command and the batch subcommand
+type processOptions struct {
+	OutputFile       string
+	ResizePercent    float64
+	MaxWidth         int
+	MaxHeight        int
+	CompressLevel    int
+	AutoQuality      float64
+	ConvertToIco     bool
+	AutoResizeICO    bool
+	OutputFormat     string
+	Formats          []string
+	Fingerprint      bool
+	Recipe           bool
+	CompareOutput    string
+	InPlace          bool
+	BackupDir        string
+	PageSize         string
+	DPI              float64
+	PDFPage          int
+	Frame            int
+	Frames           string
+	Every            int
+	PosterTime       time.Duration
+	FFmpeg           string
+	Density          float64
+	PDFRenderer      string
+	DDSFormat        string
+	TextWidth        int
+	Mipmaps          bool
+	KeepExif         bool
+	StripGPS         bool
+	Reproducible     bool
+	ICCConvert       string
+	ICCTarget        string
+	Colorspace       string
+	Depth            int
+	DepthDither      string
+	MaxPixels        int64
+	MaxInputBytes    int64
+	MaxMemory        int64
+	MaxOutputPixels  int64
+	Filter           string
+	LinearResize     bool
+	ToneMap          string
+	Exposure         float64
+	Threads          int
+	Background       string
+	RemoveBackground bool
+	BGColor          string
+	BGTolerance      float64
+	Timeout          time.Duration
+	UpscaleModel     string
+	UseExifThumbnail bool
+	DCTScaling       bool
+	Optimize         bool
+	Zopfli           bool
+	Effort           int
+	Interlace        bool
+	Colors           int
+	Dither           string
+	AlphaThreshold   int
+	Operations       map[string]string // values of registered operation flags by name
+	OperationSpecs   []string          // values of -op, in the order given
+
+	backgroundColor color.Color
+	ops             []Operation
+	pdfRenderer     string // program rendering PDF pages, "" to extract their images
+}
+
+// percentValue is a float flag that also accepts a trailing %, as in 200%
+type percentValue struct {
+	p *float64
+}
+
+func (v percentValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatFloat(*v.p, 'f', -1, 64)
+}
+
+func (v percentValue) Set(s string) error {
+	n, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil {
+		return errors.New("expected a percentage such as 50, 12.5 or 200%")
+	}
+	*v.p = n
+	return nil
+}
+
+// addProcessFlags registers the pipeline flags on fs
+func addProcessFlags(fs *flag.FlagSet) *processOptions {
+	o := &processOptions{}
+	fs.StringVar(&o.OutputFile, "output", "", "Output image file path (if not specified, will use input filename with suffix)")
+	fs.Var(percentValue{&o.ResizePercent}, "resize", "Resize percentage: below 100 to shrink, e.g. 12.5 for 1/8 scale, or above 100 (up to 800) to enlarge, e.g. 200%. 0 means no resize")
+	fs.IntVar(&o.MaxWidth, "max-width", 0, "Shrink images wider than this many pixels to fit, keeping the aspect ratio. Smaller images are left as they are. 0 means no limit")
+	fs.IntVar(&o.MaxHeight, "max-height", 0, "Shrink images taller than this many pixels to fit, keeping the aspect ratio. Smaller images are left as they are. 0 means no limit")
+	fs.IntVar(&o.CompressLevel, "compress", 0, "Compression level (1-100, where 1 is max compression, 100 is best quality). 0 means no compression")
+	fs.Float64Var(&o.AutoQuality, "auto-quality", 0, "Encode JPEG output at the lowest quality whose SSIM to the uncompressed image reaches this target, e.g. 0.98, chosen per image. 0 uses -compress")
+	fs.BoolVar(&o.ConvertToIco, "to-ico", false, "Convert the image to ICO format")
+	fs.BoolVar(&o.AutoResizeICO, "auto-resize-ico", true, "Automatically resize images larger than 256x256 when converting to ICO")
+	fs.StringVar(&o.OutputFormat, "format", "", "Output format (jpeg, png, gif, tiff, pdf, qoi, ppm, pgm, pbm, pnm, dds). Defaults to the input image's format")
+	fs.Func("formats", "Comma-separated output formats to write the same result in, e.g. png,jpeg, decoding and processing the input once. Replaces -format", func(value string) error {
+		o.Formats = strings.Split(strings.ToLower(value), ",")
+		return nil
+	})
+	fs.BoolVar(&o.Fingerprint, "fingerprint", false, "Put the start of each output's SHA-256 in its file name, e.g. logo.3fa9c2d1.png, and record the names in output/fingerprints.json")
+	fs.BoolVar(&o.Recipe, "recipe", false, "Save the options used next to each output as <output>.recipe.json, for the replay subcommand to make it again from a new input")
+	fs.StringVar(&o.CompareOutput, "compare-output", "", "Also write a PNG comparing each input with its output as <output>.compare.png, for checking quality settings: side for the two side by side, or split for the input's left half and the output's right half, divided by a line")
+	fs.BoolVar(&o.InPlace, "in-place", false, "Replace each input with its output, in the same format, after backing up the original as <input>.orig for the restore subcommand. An existing backup is kept")
+	fs.StringVar(&o.BackupDir, "backup-dir", "", "With -in-place, back up originals under this directory at their path relative to the current one, e.g. .go-transform/backups, instead of next to them")
+	fs.StringVar(&o.PageSize, "page-size", "fit", "PDF page size (a3, a4, a5, letter, legal, or fit to size pages to their image)")
+	fs.Float64Var(&o.DPI, "dpi", 0, "Image density in dots per inch, recorded in JPEG and PNG output and used to size images on PDF pages (300 if not set)")
+	fs.IntVar(&o.PDFPage, "page", 1, "Page number to read when the input is a PDF")
+	fs.IntVar(&o.Frame, "frame", 0, "Frame number to extract as a still image when the input is an animated GIF, PNG or WebP, drawn as it is shown over the frames before it. 0 reads the input as usual")
+	fs.StringVar(&o.Frames, "frames", "", "Extract frames of animated input as separate still images: all. Outputs are numbered, e.g. anim_f007.png")
+	fs.IntVar(&o.Every, "every", 0, "Extract every Nth frame of animated input as separate still images, starting with the first, e.g. 10 for frames 1, 11, 21 and so on")
+	fs.DurationVar(&o.PosterTime, "poster-time", 0, "Time into a video input (MP4, MOV, MKV, WebM or AVI) of the frame to use as its poster, e.g. 2.5s or 1m30s")
+	fs.StringVar(&o.FFmpeg, "ffmpeg", "ffmpeg", "ffmpeg executable used to read video input")
+	fs.Float64Var(&o.Density, "density", 0, "Resolution in DPI to rasterize PDF input pages at. 0 renders at 150 DPI, or keeps the embedded image's resolution when it is extracted")
+	fs.StringVar(&o.PDFRenderer, "pdf-renderer", "auto", "Program that renders PDF input pages, vector content and text included: pdftoppm, mutool or gs, or a path to one. auto uses the first installed; none, or no renderer installed, extracts the page's embedded raster image instead")
+	fs.StringVar(&o.DDSFormat, "dds-format", "bc3", "DDS texture compression: bc1 (DXT1), bc3 (DXT5) or rgba (uncompressed)")
+	fs.IntVar(&o.TextWidth, "text-width", 0, "Width in characters of ascii and ansi output. 0 uses the terminal's width, or 80 if it is unknown")
+	fs.BoolVar(&o.Mipmaps, "mipmaps", true, "Generate a full mipmap chain for DDS output")
+	fs.BoolVar(&o.KeepExif, "keep-exif", !siteDefaults.StripMetadata, "Copy EXIF metadata from JPEG input to JPEG or PNG output")
+	fs.BoolVar(&o.StripGPS, "strip-gps", false, "Remove GPS location tags from the copied EXIF metadata, keeping camera and exposure data (implies -keep-exif)")
+	fs.BoolVar(&o.Reproducible, "reproducible", false, "Make the output depend only on the input and options: zero the timestamps in EXIF copied with -keep-exif and give archive entries a fixed date")
+	fs.StringVar(&o.ICCConvert, "icc-convert", "", "Convert colors from the embedded ICC profile to a built-in color space (srgb) and embed it")
+	fs.StringVar(&o.ICCTarget, "icc", "", "Convert colors from the embedded ICC profile to the given ICC profile file and embed it")
+	fs.StringVar(&o.Colorspace, "colorspace", "rgb", "Target color space: rgb (CMYK input is converted to RGB) or gray")
+	fs.IntVar(&o.Depth, "depth", 0, "Output bit depth per channel (8 or 16). 0 keeps the input's bit depth")
+	fs.StringVar(&o.DepthDither, "depth-dither", "none", "Dithering when 16-bit images are reduced to 8 bits, against banding in smooth gradients: none, ordered or blue-noise")
+	fs.Int64Var(&o.MaxPixels, "max-pixels", 0, "Reject input images with more pixels than this before decoding. 0 means no limit")
+	fs.Int64Var(&o.MaxInputBytes, "max-input-bytes", 0, "Reject input files larger than this many bytes. 0 means no limit")
+	fs.Int64Var(&o.MaxMemory, "max-memory", 0, "Memory budget in MB for the full-resolution frame. Larger images are downscaled in strips. 0 means no limit")
+	fs.Int64Var(&o.MaxOutputPixels, "max-output-pixels", 0, "Reject images that -resize, -size or -resize-seam would make larger than this many pixels, before allocating them. 0 means no limit")
+	fs.StringVar(&o.Filter, "filter", "lanczos", "Resampling filter used for resizing: lanczos, catmullrom, bilinear or area")
+	fs.StringVar(&o.ToneMap, "tone-map", "reinhard", "Tone mapping operator bringing HDR input (OpenEXR and Radiance .hdr) into range: reinhard or aces")
+	fs.Float64Var(&o.Exposure, "exposure", 0, "Exposure adjustment in stops applied to HDR input before tone mapping, e.g. 1.5 or -2")
+	fs.BoolVar(&o.LinearResize, "linear-resize", true, "Resize in linear light so that fine detail keeps its brightness and edges get no gray fringes. -linear-resize=false scales the sRGB values directly")
+	fs.IntVar(&o.Threads, "threads", 0, "Number of CPU cores used for resizing and color conversion. 0 uses all cores")
+	fs.StringVar(&o.Background, "background", "", "Color to flatten transparency onto, e.g. #ffffff. JPEG output is flattened onto white by default")
+	fs.BoolVar(&o.RemoveBackground, "remove-background", false, "Make the background around the subject transparent, for product photos. JPEG input is written as PNG unless -format is given")
+	fs.StringVar(&o.BGColor, "bg-color", "", "Background color removed by -remove-background, e.g. #ffffff. Defaults to the most common color along the edges")
+	fs.Float64Var(&o.BGTolerance, "bg-tolerance", 10, "How far colors may be from -bg-color and still be removed, in percent of the distance from black to white")
+	fs.BoolVar(&o.UseExifThumbnail, "use-exif-thumbnail", false, "When resizing a JPEG, decode its embedded EXIF thumbnail instead of the full image if the thumbnail is at least as large as the output")
+	fs.BoolVar(&o.DCTScaling, "dct-scaling", false, "When resizing a JPEG to half its size or less, decode it at 1/2, 1/4 or 1/8 scale before the final resize. Much faster and lighter on memory, at a small cost in sharpness")
+	fs.BoolVar(&o.Optimize, "optimize", false, "Shrink JPEG and PNG output without changing its pixels. JPEGs get Huffman tables optimized for the image and progressive scans where they are smaller, and JPEG input is optimized losslessly when nothing else changes it. PNGs get the smallest color type and filters and lose ancillary chunks")
+	fs.IntVar(&o.Colors, "colors", 256, "Number of palette colors for GIF output (2-256), including the transparent one")
+	fs.StringVar(&o.Dither, "dither", "floyd-steinberg", "Dithering for GIF output: none, floyd-steinberg, ordered or blue-noise")
+	fs.IntVar(&o.AlphaThreshold, "alpha-threshold", 128, "GIF output: pixels with alpha below this (0-255) become transparent, the rest are flattened onto white. 0 makes every pixel opaque")
+	fs.BoolVar(&o.Interlace, "interlace", false, "Write PNG output Adam7 interlaced, so that viewers can show a coarse image before it has fully loaded. Usually makes files larger")
+	fs.BoolVar(&o.Zopfli, "zopfli", false, "With -optimize, compress PNG output with a zopfli-style deflate encoder. Typically 3-8% smaller, but many times slower")
+	fs.IntVar(&o.Effort, "effort", -1, "Encoding effort from 0 (fastest) to 9 (smallest files): the deflate level of PNG output and the search effort of WebP output without -compress, and how many encodings -optimize tries. 9 also turns on -zopfli. -1 keeps each encoder's default")
+	fs.StringVar(&o.UpscaleModel, "upscale-model", "", "ONNX super-resolution model (e.g. a 2x or 4x Real-ESRGAN export) to enlarge images with before resampling to the -resize or -size size. Needs a build with -tags onnx")
+	fs.DurationVar(&o.Timeout, "timeout", 0, "Maximum time to spend on one image, e.g. 30s. 0 means no limit")
+	o.Operations = map[string]string{}
+	addOperationFlags(fs, o.Operations)
+	fs.Func("op", "Run an operation given as name=value, e.g. pixelate=20, after those enabled by their own flags. Append @rect(x,y,width,height) to limit it to a region. May be repeated", func(value string) error {
+		o.OperationSpecs = append(o.OperationSpecs, value)
+		return nil
+	})
+	return o
+}
+
+// setup validates the options and applies the process-wide settings they
+// control: input limits, the resampling filter and the number of threads.
+// All problems found are reported together.
+func (o *processOptions) setup() error {
+	errs := []error{o.prepare()}
+	if o.MaxPixels < 0 || o.MaxInputBytes < 0 || o.MaxOutputPixels < 0 {
+		errs = append(errs, errors.New("max-pixels, max-input-bytes and max-output-pixels must not be negative"))
+	}
+	if o.Threads < 0 {
+		errs = append(errs, errors.New("threads must not be negative"))
+	}
+	if _, ok := scalers[strings.ToLower(o.Filter)]; !ok {
+		errs = append(errs, setScaler(o.Filter))
+	}
+	if o.Effort < -1 || o.Effort > 9 {
+		errs = append(errs, errors.New("effort must be between 0 and 9, or -1 for each encoder's default"))
+	}
+	if !slices.Contains(toneMapOperators, strings.ToLower(o.ToneMap)) {
+		errs = append(errs, fmt.Errorf("unknown tone-map %q: use reinhard or aces", o.ToneMap))
+	}
+	if math.IsNaN(o.Exposure) || math.IsInf(o.Exposure, 0) {
+		errs = append(errs, errors.New("exposure must be a finite number of stops"))
+	}
+	if errs[0] == nil && o.UpscaleModel != "" && o.ResizePercent <= 100 && !slices.ContainsFunc(o.ops, isSizeOp) {
+		errs = append(errs, errors.New("upscale-model only applies when enlarging with -resize above 100 or -size"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	inputLimits = decodeLimits{MaxPixels: o.MaxPixels, MaxInputBytes: o.MaxInputBytes}
+	if err := setScaler(o.Filter); err != nil {
+		return err
+	}
+	linearResize = o.LinearResize
+	encodeEffort = o.Effort
+	hdrToneMap, hdrExposure = strings.ToLower(o.ToneMap), o.Exposure
+	if err := setUpscaler(o.UpscaleModel); err != nil {
+		return err
+	}
+	if o.Threads > 0 {
+		runtime.GOMAXPROCS(o.Threads)
+	}
+	slog.Debug("Processing settings", "filter", o.Filter, "linear", o.LinearResize, "effort", o.Effort, "threads", runtime.GOMAXPROCS(0))
+	return nil
+}
+
+// prepare validates the per-image options without touching process-wide
+// settings, so that it can be used for concurrent server requests. It
+// checks every option and joins the problems found into one error.
+func (o *processOptions) prepare() error {
+	errs := []error{validateOptions(o.ResizePercent, o.CompressLevel, o.OutputFormat)}
+	if o.AutoQuality != 0 && !(o.AutoQuality > 0 && o.AutoQuality < 1) {
+		errs = append(errs, errors.New("auto-quality must be an SSIM target between 0 and 1, e.g. 0.98"))
+	}
+	if o.AutoQuality != 0 && o.CompressLevel != 0 {
+		errs = append(errs, errors.New("auto-quality and compress cannot be combined"))
+	}
+	if o.ConvertToIco && (o.CompressLevel != 0 || o.AutoQuality != 0 || o.OutputFormat != "") {
+		errs = append(errs, errors.New("to-ico writes lossless ICO files and cannot be combined with compress, auto-quality or format"))
+	}
+	if o.MaxWidth < 0 || o.MaxHeight < 0 {
+		errs = append(errs, errors.New("max-width and max-height must not be negative"))
+	}
+	if len(o.Formats) > 0 {
+		if o.OutputFormat != "" || o.ConvertToIco {
+			errs = append(errs, errors.New("formats cannot be combined with format or to-ico"))
+		}
+		for i, format := range o.Formats {
+			if err := validateOptions(0, 0, format); err != nil || format == "" {
+				errs = append(errs, fmt.Errorf("unsupported output format %q in formats. Supported formats: %s", format, strings.Join(supportedOutputFormats, ", ")))
+			} else if slices.Contains(o.Formats[:i], format) {
+				errs = append(errs, fmt.Errorf("format %q is listed twice in formats", format))
+			}
+		}
+	}
+	if o.InPlace && (o.OutputFile != "" || len(o.Formats) > 0 || o.Fingerprint || o.Recipe || o.CompareOutput != "" || o.ConvertToIco) {
+		errs = append(errs, errors.New("in-place replaces each input and cannot be combined with output, formats, fingerprint, recipe, compare-output or to-ico"))
+	}
+	if o.CompareOutput != "" && !slices.Contains(compareModes, o.CompareOutput) {
+		errs = append(errs, fmt.Errorf("unknown compare-output %q: use side or split", o.CompareOutput))
+	}
+	if o.BackupDir != "" && !o.InPlace {
+		errs = append(errs, errors.New("backup-dir only applies with in-place"))
+	}
+	if o.TextWidth < 0 {
+		errs = append(errs, errors.New("text-width must not be negative"))
+	}
+	if o.Frame < 0 || o.Every < 0 {
+		errs = append(errs, errors.New("frame and every must not be negative"))
+	}
+	if o.PosterTime < 0 {
+		errs = append(errs, errors.New("poster-time must not be negative"))
+	}
+	if o.Frames != "" && o.Frames != "all" {
+		errs = append(errs, fmt.Errorf("invalid frames %q: expected all, or -every to pick frames", o.Frames))
+	}
+	if o.Frame > 0 && o.extractsFrames() || o.Frames != "" && o.Every > 0 {
+		errs = append(errs, errors.New("frame, frames and every cannot be combined"))
+	}
+	errs = append(errs, validateDepth(o.Depth), validateDepthDither(strings.ToLower(o.DepthDither)), o.gifOptions().validate())
+	if o.Density < 0 || o.Density > maxDPI {
+		errs = append(errs, fmt.Errorf("density must be between 1 and %d, or 0 for the default", maxDPI))
+	}
+	pdfRenderer, err := findPDFRenderer(o.PDFRenderer)
+	errs = append(errs, err)
+	if o.DPI < 0 || o.DPI > maxDPI {
+		errs = append(errs, fmt.Errorf("dpi must be between 1 and %d, or 0 to leave the density unset", maxDPI))
+	}
+
+	ops, err := parseOperations(o.Operations)
+	errs = append(errs, err)
+	for _, spec := range o.OperationSpecs {
+		op, err := parseOperationSpec(spec)
+		errs = append(errs, err)
+		ops = append(ops, op)
+	}
+	// Sizes given in full are checked now, the rest once the input's is known
+	for _, op := range ops {
+		switch op := op.(type) {
+		case sizeOp:
+			errs = append(errs, checkOutputSize(op.width, op.height, o.MaxOutputPixels))
+		case seamCarveOp:
+			errs = append(errs, checkOutputSize(op.width, op.height, o.MaxOutputPixels))
+		}
+	}
+	if o.RemoveBackground {
+		op := removeBackgroundOp{tolerance: o.BGTolerance}
+		if o.BGTolerance < 0 || o.BGTolerance > 100 {
+			errs = append(errs, errors.New("bg-tolerance must be between 0 and 100"))
+		}
+		if o.BGColor != "" {
+			c, err := parseHexColor(o.BGColor)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid bg-color: %w", err))
+			}
+			op.key = &c
+		}
+		// The background goes before any other operation changes the edges
+		ops = append([]Operation{op}, ops...)
+	}
+
+	var background color.Color
+	if o.Background != "" {
+		c, err := parseHexColor(o.Background)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid background color: %w", err))
+		}
+		background = c
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	o.ops = ops
+	o.backgroundColor = background
+	o.pdfRenderer = pdfRenderer
+	return nil
+}
+
+// gifOptions returns the settings for GIF output
+func (o *processOptions) gifOptions() gifOptions {
+	return gifOptions{Colors: o.Colors, Dither: strings.ToLower(o.Dither), AlphaThreshold: o.AlphaThreshold}
+}
+
+// outputFormat returns the format requested for inputFile's output, or "" to
+// keep the input's format
+func (o *processOptions) outputFormat(inputFile string) string {
+	// PDF pages are written out as PNG unless another format is requested
+	if o.OutputFormat == "" && strings.EqualFold(filepath.Ext(inputFile), ".pdf") {
+		return "png"
+	}
+	// Frames of animations are written as PNG, and so is HDR input, which
+	// cannot be written
+	ext := strings.ToLower(filepath.Ext(inputFile))
+	if o.OutputFormat == "" && (slices.Contains(hdrExtensions, ext) || (ext == ".gif" || ext == ".webp") && (o.Frame > 0 || o.extractsFrames())) {
+		return "png"
+	}
+	// So does input without transparency that has its background removed
+	if o.OutputFormat == "" && o.RemoveBackground && !formatSupportsAlpha(strings.TrimPrefix(filepath.Ext(inputFile), ".")) {
+		return "png"
+	}
+	// Video posters and camera RAW files are written as JPEG, like photos
+	if o.OutputFormat == "" && (isVideo(inputFile) || slices.Contains(rawExtensions, ext)) {
+		return "jpeg"
+	}
+	return o.OutputFormat
+}
+
+// outputPath returns the path processFile writes inputFile's output to, or
+// its output in the first format with -formats
+func (o *processOptions) outputPath(inputFile string) (string, error) {
+	if o.InPlace {
+		return inputFile, nil
+	}
+	if len(o.Formats) > 0 {
+		return o.formatOutputPath(inputFile, o.Formats[0])
+	}
+	// Object storage outputs go to the given key, or under it when it ends in /
+	if isObjectURI(o.OutputFile) {
+		if !strings.HasSuffix(o.OutputFile, "/") {
+			return o.OutputFile, nil
+		}
+		if isArchive(inputFile) {
+			return o.OutputFile + outputFilename(archiveName(inputFile), o.ResizePercent, o.CompressLevel, ""), nil
+		}
+		return o.OutputFile + outputFilename(inputFile, o.ResizePercent, o.CompressLevel, outputExtension(o.ConvertToIco, o.outputFormat(inputFile))), nil
+	}
+	if isArchive(inputFile) {
+		return o.archiveOutputPath(inputFile)
+	}
+	return generateOutputPath(inputFile, o.OutputFile, o.ResizePercent, o.CompressLevel, outputExtension(o.ConvertToIco, o.outputFormat(inputFile)))
+}
+
+// formatOutputPath returns the path processFile writes inputFile's output in
+// one of the formats of -formats to. A name given by -output has its
+// extension replaced by the format's.
+func (o *processOptions) formatOutputPath(inputFile, format string) (string, error) {
+	single := *o
+	single.Formats, single.OutputFormat = nil, format
+	if !strings.HasSuffix(o.OutputFile, "/") {
+		single.OutputFile = strings.TrimSuffix(o.OutputFile, filepath.Ext(o.OutputFile))
+	}
+	outPath, err := single.outputPath(inputFile)
+	if err != nil {
+		return "", err
+	}
+	if ext := outputExtension(false, format); !strings.HasSuffix(outPath, ext) {
+		outPath += ext
+	}
+	return outPath, nil
+}
+
+// processResult describes the output processFile produced for an input
+type processResult struct {
+	Output       string
+	Format       string
+	SourceWidth  int
+	SourceHeight int
+	Width        int
+	Height       int
+	InputBytes   int64
+	OutputBytes  int64
+	InputSHA256  string
+	OutputSHA256 string
+}
+
+// processFile runs the pipeline on one input image or archive and describes
+// the output it wrote. With PDF output, extraPages are added as further
+// pages. Nothing is written if processing fails.
+func processFile(ctx context.Context, o *processOptions, inputFile string, extraPages []string) (processResult, error) {
+	if isArchive(inputFile) {
+		if len(o.Formats) > 0 || o.Fingerprint || o.Recipe || o.InPlace || o.CompareOutput != "" {
+			return processResult{}, errors.New("formats, fingerprint, recipe, in-place and compare-output cannot be used with archive input")
+		}
+		return processArchive(ctx, o, inputFile)
+	}
+	if o.extractsFrames() && (len(o.Formats) > 0 || o.Fingerprint || o.Recipe || o.InPlace || o.CompareOutput != "") {
+		return processResult{}, errors.New("formats, fingerprint, recipe, in-place and compare-output cannot be used with frames or every")
+	}
+	if o.InPlace {
+		if err := o.checkInPlace(inputFile); err != nil {
+			return processResult{}, err
+		}
+	}
+	ctx, cancel := o.jobContext(ctx)
+	defer cancel()
+
+	var data []byte
+	var err error
+	if isVideo(inputFile) {
+		// The poster frame goes through the pipeline in place of the video
+		if data, err = extractVideoFrame(ctx, o.FFmpeg, inputFile, o.PosterTime); err != nil {
+			return processResult{}, fmt.Errorf("failed to read video: %w", err)
+		}
+	} else if data, err = readInputFile(inputFile); err != nil {
+		return processResult{}, fmt.Errorf("failed to read input file: %w", err)
+	}
+	if o.extractsFrames() {
+		return processFrames(ctx, o, inputFile, data)
+	}
+	if len(o.Formats) > 0 {
+		return processFileFormats(ctx, o, inputFile, data, extraPages)
+	}
+
+	outPath, err := o.outputPath(inputFile)
+	if err != nil {
+		return processResult{}, fmt.Errorf("failed to generate output path: %w", err)
+	}
+
+	var encoded bytes.Buffer
+	var result processResult
+	if len(extraPages) == 0 {
+		result, err = processImageCached(ctx, o, inputFile, data, outPath, &encoded)
+	} else {
+		result, err = processImage(ctx, o, inputFile, data, extraPages, outPath, &encoded)
+	}
+	if err != nil {
+		return result, err
+	}
+	if o.Fingerprint {
+		outPath = fingerprintPath(outPath, encoded.Bytes())
+		result.Output = outPath
+	}
+	var comparison []byte
+	if o.CompareOutput != "" {
+		if comparison, err = compareImage(ctx, o.CompareOutput, data, encoded.Bytes()); err != nil {
+			return result, err
+		}
+	}
+	if o.InPlace {
+		err = o.writeInPlace(inputFile, data, encoded.Bytes())
+	} else {
+		err = writeOutputFile(outPath, encoded.Bytes())
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to write output image: %w", err)
+	}
+	if o.Recipe {
+		if err := o.saveRecipe(inputFile, outPath, result.Format); err != nil {
+			return result, err
+		}
+	}
+	if comparison != nil {
+		if err := writeOutputFile(comparePath(outPath), comparison); err != nil {
+			return result, fmt.Errorf("failed to write comparison: %w", err)
+		}
+	}
+	// Show text art right away when run in a terminal, e.g. over SSH
+	if (result.Format == "ascii" || result.Format == "ansi") && isTerminal(os.Stdout) {
+		os.Stdout.Write(encoded.Bytes())
+	}
+
+	result.InputBytes, result.OutputBytes = int64(len(data)), int64(encoded.Len())
+	result.InputSHA256, result.OutputSHA256 = sha256Hex(data), sha256Hex(encoded.Bytes())
+	return result, nil
+}
+
+// processFileFormats is processFile for -formats. It writes an output in
+// each format and describes the first.
+func processFileFormats(ctx context.Context, o *processOptions, inputFile string, data []byte, extraPages []string) (processResult, error) {
+	outputs := make([]imageOutput, len(o.Formats))
+	encoded := make([]bytes.Buffer, len(o.Formats))
+	for i, format := range o.Formats {
+		outPath, err := o.formatOutputPath(inputFile, format)
+		if err != nil {
+			return processResult{}, fmt.Errorf("failed to generate output path: %w", err)
+		}
+		outputs[i] = imageOutput{format, outPath, &encoded[i]}
+	}
+	results, err := processImageOutputs(ctx, o, inputFile, data, extraPages, outputs)
+	if err != nil {
+		return processResult{}, err
+	}
+	comparisons := make([][]byte, len(outputs))
+	if o.CompareOutput != "" {
+		for i := range outputs {
+			if comparisons[i], err = compareImage(ctx, o.CompareOutput, data, encoded[i].Bytes()); err != nil {
+				return processResult{}, err
+			}
+		}
+	}
+	for i, out := range outputs {
+		if o.Fingerprint {
+			out.path = fingerprintPath(out.path, encoded[i].Bytes())
+			results[i].Output = out.path
+		}
+		if err := writeOutputFile(out.path, encoded[i].Bytes()); err != nil {
+			return processResult{}, fmt.Errorf("failed to write output image: %w", err)
+		}
+		if o.Recipe {
+			if err := o.saveRecipe(inputFile, out.path, out.format); err != nil {
+				return processResult{}, err
+			}
+		}
+		if comparisons[i] != nil {
+			if err := writeOutputFile(comparePath(out.path), comparisons[i]); err != nil {
+				return processResult{}, fmt.Errorf("failed to write comparison: %w", err)
+			}
+		}
+	}
+
+	result := results[0]
+	result.InputBytes, result.OutputBytes = int64(len(data)), int64(encoded[0].Len())
+	result.InputSHA256, result.OutputSHA256 = sha256Hex(data), sha256Hex(encoded[0].Bytes())
+	return result, nil
+}
+
+// outputMetadata reads the metadata of the input data to carry over to the output
+func (o *processOptions) outputMetadata(data []byte) (imageMetadata, error) {
+	var metadata imageMetadata
+	if o.KeepExif || o.StripGPS {
+		metadata.Exif = readJPEGExif(data)
+		if metadata.Exif != nil && o.StripGPS {
+			var err error
+			if metadata.Exif, err = stripExifGPS(metadata.Exif); err != nil {
+				return metadata, fmt.Errorf("failed to remove GPS metadata: %w", err)
+			}
+			slog.Info("GPS location removed from EXIF metadata")
+		}
+		if metadata.Exif != nil && o.Reproducible {
+			var err error
+			if metadata.Exif, err = zeroExifTimestamps(metadata.Exif); err != nil {
+				return metadata, fmt.Errorf("failed to zero EXIF timestamps: %w", err)
+			}
+		}
+	}
+	if o.DPI > 0 {
+		metadata.DPI = o.DPI
+		if metadata.Exif != nil {
+			metadata.Exif = setExifDensity(metadata.Exif, o.DPI)
+		}
+	}
+	return metadata, nil
+}
+
+// processImage runs the pipeline on the encoded image data read from name
+// and writes the result to w. outPath names the output in messages and in
+// the result. It stops with an error wrapping ctx's error once ctx is done.
+func processImage(ctx context.Context, o *processOptions, name string, data []byte, extraPages []string, outPath string, w io.Writer) (processResult, error) {
+	results, err := processImageOutputs(ctx, o, name, data, extraPages, []imageOutput{{o.outputFormat(name), outPath, w}})
+	if err != nil {
+		return processResult{Output: outPath}, err
+	}
+	return results[0], nil
+}
+
+// imageOutput is one encoding of the pipeline's result: its format, or "" to
+// keep the input's, the path naming it in messages and where it is written
+type imageOutput struct {
+	format string
+	path   string
+	w      io.Writer
+}
+
+// processImageOutputs is processImage for several outputs of the same
+// pixels, such as one per format given to -formats. The image is decoded and
+// transformed once, then encoded for each output.
+func processImageOutputs(ctx context.Context, o *processOptions, name string, data []byte, extraPages []string, outputs []imageOutput) (results []processResult, err error) {
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("processing interrupted: %w", ctx.Err())
+		}
+	}()
+	var result processResult
+
+	// Rotate, flip or crop a JPEG by rearranging its DCT blocks when nothing
+	// else changes the pixels, which avoids another generation of JPEG loss
+	if transforms := o.losslessJPEGTransforms(name, data); transforms != nil && len(outputs) == 1 {
+		c, width, height, err := transformJPEGLossless(ctx, data, transforms)
+		if err == nil {
+			result.Output, result.SourceWidth, result.SourceHeight = outputs[0].path, width, height
+			result.Width, result.Height, result.Format = c.width, c.height, "jpeg"
+			if err := writeLosslessJPEG(o, data, c, ctxWriter{ctx, outputs[0].w}); err != nil {
+				return nil, err
+			}
+			if len(transforms) > 0 {
+				slog.Info("Transformed JPEG losslessly", "size", fmt.Sprintf("%dx%d", c.width, c.height))
+			} else {
+				slog.Info("Optimized JPEG losslessly")
+			}
+			slog.Info("Processed image saved", "path", outputs[0].path)
+			return []processResult{result}, nil
+		}
+		slog.Info("Cannot transform JPEG losslessly; re-encoding it", "reason", err)
+	}
+
+	// Decode the image. When resizing, a JPEG may be decoded smaller than
+	// the source, from its EXIF thumbnail or with DCT scaling, as long as the
+	// result still covers the output.
+	var img image.Image
+	var format string
+	var reduced bool
+	var full image.Config
+	if o.UseExifThumbnail {
+		if img, full, reduced = decodeExifThumbnail(data, o.ResizePercent); reduced {
+			slog.Info("Using EXIF thumbnail", "size", fmt.Sprintf("%dx%d", img.Bounds().Dx(), img.Bounds().Dy()))
+		}
+	}
+	if o.DCTScaling && !reduced {
+		img, full, reduced = decodeJPEGReduced(ctx, data, o.ResizePercent)
+	}
+	if reduced {
+		format = "jpeg"
+		err = inputLimits.checkDimensions(full.Width, full.Height)
+	}
+	switch {
+	case reduced:
+	case strings.EqualFold(filepath.Ext(name), ".pdf") && o.pdfRenderer != "":
+		density := o.Density
+		if density == 0 {
+			density = pdfRenderDPI
+		}
+		var page []byte
+		if err = checkRenderSize(data, o.PDFPage, density); err == nil {
+			page, err = renderPDFPage(ctx, o.pdfRenderer, data, o.PDFPage, density)
+		}
+		if err == nil {
+			img, _, err = decodeImageContext(ctx, bytes.NewReader(page))
+		}
+		format = "pdf"
+	case strings.EqualFold(filepath.Ext(name), ".pdf"):
+		img, err = decodePDFPage(ctxReader{ctx, bytes.NewReader(data)}, o.PDFPage, o.Density)
+		format = "pdf"
+	case o.Frame > 0:
+		img, format, err = decodeFrame(ctx, data, o.Frame)
+	default:
+		img, format, err = decodeImageContext(ctx, bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Keep the specific Netpbm variant (PBM, PGM or PPM) of the input
+	if format == "pnm" {
+		format = formatFromExt(name)
+	}
+
+	if !reduced {
+		full.Width, full.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	}
+	loaded := []any{"format", format, "size", fmt.Sprintf("%dx%d", full.Width, full.Height)}
+	if density, ok := readImageDensity(data); ok {
+		loaded = append(loaded, "dpi", density)
+	}
+	slog.Info("Loaded image", loaded...)
+	result.SourceWidth, result.SourceHeight = full.Width, full.Height
+	slog.Debug("Decoded image", "type", fmt.Sprintf("%T", img), "depth", imageDepth(img))
+
+	// Keep the input's precision unless a depth is requested
+	targetDepth := o.Depth
+	if targetDepth == 0 {
+		targetDepth = imageDepth(img)
+	}
+
+	// Downscale huge images in strips before anything materializes a full RGBA frame
+	tiled := !reduced && o.MaxMemory > 0 && o.ResizePercent > 0 && o.ResizePercent < 100 && frameBytes(img) > o.MaxMemory<<20
+	if tiled {
+		img = resizeImageTiled(img, o.ResizePercent)
+	}
+
+	// Convert to the target color space (e.g. CMYK print files to RGB)
+	img, err = applyColorspace(img, o.Colorspace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert color space: %w", err)
+	}
+
+	// Read metadata to carry over to the output
+	metadata, err := o.outputMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert to the target color profile if requested
+	if o.ICCConvert != "" || o.ICCTarget != "" {
+		img, metadata.ICC, err = applyICCConversion(img, data, o.ICCConvert, o.ICCTarget)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert color profile: %w", err)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Process the image - resize if requested. A reduced decode is scaled to
+	// the size the full image would have been resized to.
+	if reduced {
+		width, height := resizedDimensions(image.Rect(0, 0, full.Width, full.Height), o.ResizePercent)
+		img = scaleImage(img, width, height)
+		slog.Info("Image resized", "percent", o.ResizePercent, "size", fmt.Sprintf("%dx%d", width, height))
+	} else if o.ResizePercent > 100 {
+		width, height := resizedDimensions(img.Bounds(), o.ResizePercent)
+		if err := checkOutputSize(int(width), int(height), o.MaxOutputPixels); err != nil {
+			return nil, err
+		}
+		img, err = enlargeImage(ctx, img, width, height)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Image resized", "percent", o.ResizePercent, "size", fmt.Sprintf("%dx%d", width, height))
+	} else if !tiled {
+		img, err = resizeImage(img, o.ResizePercent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resize image: %w", err)
+		}
+	}
+	img = constrainImage(img, o.MaxWidth, o.MaxHeight)
+
+	// Run the registered operations enabled by flags
+	img, err = applyOperations(ctx, img, o.ops, o.MaxOutputPixels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply operation: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if o.backgroundColor != nil {
+		img = flattenAlpha(img, o.backgroundColor)
+		slog.Info("Flattened transparency", "background", o.Background)
+	}
+
+	for _, out := range outputs {
+		result.Output = out.path
+		r, err := o.encodeOutput(ctx, img, format, targetDepth, metadata, extraPages, out, result)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// encodeOutput writes img to out and completes result, which describes the
+// source, with the output. format is the input's format and depth the bit
+// depth to keep.
+func (o *processOptions) encodeOutput(ctx context.Context, img image.Image, format string, targetDepth int, metadata imageMetadata, extraPages []string, out imageOutput, result processResult) (processResult, error) {
+	outPath, outputFormat, w := out.path, out.format, ctxWriter{ctx, out.w}
+	var err error
+
+	// Handle ICO conversion specifically
+	if o.ConvertToIco {
+		// Show warning for large images if auto-resize is disabled
+		bounds := img.Bounds()
+		if (bounds.Dx() > 256 || bounds.Dy() > 256) && !o.AutoResizeICO {
+			slog.Warn("Large image dimensions may not display properly in all ICO viewers. Consider using -auto-resize-ico=true", "size", fmt.Sprintf("%dx%d", bounds.Dx(), bounds.Dy()))
+		}
+		if o.AutoResizeICO {
+			img = resizeForICO(img, 256)
+		}
+		result.Width, result.Height = img.Bounds().Dx(), img.Bounds().Dy()
+		result.Format = "ico"
+
+		if err := EncodeICO(w, img, o.AutoResizeICO); err != nil {
+			return result, fmt.Errorf("failed to encode to ICO format: %w", err)
+		}
+		slog.Info("Image converted to ICO format (RGBA) and saved", "path", outPath)
+		return result, nil
+	}
+
+	result.Width, result.Height = img.Bounds().Dx(), img.Bounds().Dy()
+
+	// Handle PDF output, where any extra arguments become additional pages
+	if strings.ToLower(outputFormat) == "pdf" {
+		pages := []image.Image{img}
+		for _, path := range extraPages {
+			page, pageFormat, err := loadImage(path)
+			if err != nil {
+				return result, fmt.Errorf("failed to load PDF page: %w", err)
+			}
+			slog.Info("Loaded image", "format", pageFormat, "size", fmt.Sprintf("%dx%d", page.Bounds().Dx(), page.Bounds().Dy()))
+			if o.ResizePercent > 100 {
+				width, height := resizedDimensions(page.Bounds(), o.ResizePercent)
+				if err := checkOutputSize(int(width), int(height), o.MaxOutputPixels); err != nil {
+					return result, err
+				}
+			}
+
+			page, err = resizeImage(page, o.ResizePercent)
+			if err != nil {
+				return result, fmt.Errorf("failed to resize image: %w", err)
+			}
+			pages = append(pages, constrainImage(page, o.MaxWidth, o.MaxHeight))
+		}
+
+		// Keep JPEG sources lossy; everything else is embedded losslessly unless compression is requested
+		quality := siteDefaults.JPEGQuality
+		if o.CompressLevel > 0 {
+			quality = o.CompressLevel
+		}
+		lossy := format == "jpeg" || o.CompressLevel > 0
+
+		dpi := o.DPI
+		if dpi == 0 {
+			dpi = defaultPDFDPI
+		}
+		result.Format = "pdf"
+		if err := EncodePDF(w, pages, o.PageSize, dpi, lossy, quality); err != nil {
+			return result, fmt.Errorf("failed to encode to PDF format: %w", err)
+		}
+		slog.Info("Images converted to PDF and saved", "pages", len(pages), "path", outPath)
+		return result, nil
+	}
+
+	// Handle DDS textures, which carry their own compression settings
+	if strings.ToLower(outputFormat) == "dds" {
+		result.Format = "dds"
+		if err := EncodeDDS(w, img, strings.ToLower(o.DDSFormat), o.Mipmaps); err != nil {
+			return result, fmt.Errorf("failed to encode to DDS format: %w", err)
+		}
+		slog.Info("Image converted to DDS texture and saved", "path", outPath)
+		return result, nil
+	}
+
+	if outputFormat != "" {
+		format = outputFormat
+	}
+	result.Format = strings.ToLower(format)
+
+	// Handle text art, which has neither pixels nor metadata to keep
+	if result.Format == "ascii" || result.Format == "ansi" {
+		img = flattenAlpha(img, defaultBackground)
+		if err := encodeTextArt(w, img, result.Format, textArtWidth(o.TextWidth)); err != nil {
+			return result, fmt.Errorf("failed to render text art: %w", err)
+		}
+		slog.Info("Image rendered as text and saved", "path", outPath)
+		return result, nil
+	}
+
+	// Formats without an alpha channel would otherwise turn transparent areas black
+	if !formatSupportsAlpha(format) {
+		img = flattenAlpha(img, defaultBackground)
+	}
+
+	if dither := strings.ToLower(o.DepthDither); dither != "none" && imageDepth(img) == 16 && (targetDepth == 8 || !formatSupports16Bit(format)) {
+		img = ditherTo8Bit(img, dither)
+		slog.Debug("Dithered to 8 bits per channel", "dither", dither)
+	}
+	img = convertDepth(img, targetDepth)
+	if targetDepth == 16 && !formatSupports16Bit(format) {
+		slog.Warn("Output format only supports 8 bits per channel; precision will be reduced", "format", format)
+	}
+
+	// Save the processed image with compression if applicable
+	compressLevel := o.CompressLevel
+	if o.AutoQuality > 0 && (result.Format == "jpeg" || result.Format == "jpg") {
+		if compressLevel, err = autoJPEGQuality(ctx, img, o.AutoQuality); err != nil {
+			return result, fmt.Errorf("failed to choose JPEG quality: %w", err)
+		}
+	} else if o.AutoQuality > 0 && result.Format == "webp" {
+		slog.Debug("WebP output is lossless, so its SSIM is always 1 and -auto-quality has nothing to choose")
+	}
+	var encoded bytes.Buffer
+	if result.Format == "gif" {
+		err = encodeGIF(ctxWriter{ctx, &encoded}, img, o.gifOptions())
+	} else {
+		err = encodeImage(ctxWriter{ctx, &encoded}, img, format, compressLevel)
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to encode output image: %w", err)
+	}
+	encodedData := encoded.Bytes()
+	if o.Interlace && result.Format == "png" {
+		if encodedData, err = interlacePNG(ctx, encodedData); err != nil {
+			return result, fmt.Errorf("failed to interlace output image: %w", err)
+		}
+	}
+	if o.Optimize {
+		switch result.Format {
+		case "jpeg", "jpg":
+			encodedData, err = optimizeJPEG(ctx, encodedData)
+		case "png":
+			encodedData, err = optimizePNG(ctx, encodedData, o.Zopfli, o.Interlace)
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to optimize output image: %w", err)
+		}
+	}
+
+	encodedData, err = embedMetadata(encodedData, strings.ToLower(format), metadata)
+	if err != nil {
+		return result, fmt.Errorf("failed to embed metadata: %w", err)
+	}
+	if _, err := w.Write(encodedData); err != nil {
+		return result, fmt.Errorf("failed to write output image: %w", err)
+	}
+	slog.Debug("Encoded output", "format", format, "bytes", len(encodedData))
+
+	slog.Info("Processed image saved", "path", outPath)
+	return result, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"plugin"
+	"strings"
+
+	"github.com/SvnFrs/go-transform/ops"
+)
+
+// pluginsEnv names the environment variable listing plugin files to load,
+// separated like PATH, and oldPluginsEnv its deprecated name
+const (
+	pluginsEnv    = envPrefix + "PLUGINS"
+	oldPluginsEnv = "IMG_PROCESSOR_PLUGINS"
+)
+
+// pluginPrefix is stripped from executable plugin names
+const pluginPrefix = "img-processor-"
+
+// loadPlugins registers an operation for each plugin file in paths. Go
+// plugins (.so) must export
+//
+//	func Apply(ctx context.Context, img image.Image, value string) (image.Image, error)
+//
+// and may export a Usage string. Any other file is run as an executable
+// plugin. Operations are named after the file, without its extension or
+// the img-processor- prefix.
+func loadPlugins(paths []string) error {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		name := strings.TrimPrefix(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), pluginPrefix)
+		if isOperation(name) {
+			return fmt.Errorf("failed to load plugin %s: operation %q is already registered", path, name)
+		}
+		var err error
+		if filepath.Ext(path) == ".so" {
+			err = loadGoPlugin(name, path)
+		} else {
+			err = loadExecPlugin(name, path)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load plugin %s: %w", path, err)
+		}
+		slog.Debug("Loaded plugin", "operation", name, "path", path)
+	}
+	return nil
+}
+
+// goPluginOp is an operation implemented by a Go plugin
+type goPluginOp struct {
+	apply func(context.Context, image.Image, string) (image.Image, error)
+	value string
+}
+
+func (op goPluginOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	return op.apply(ctx, img, op.value)
+}
+
+// loadGoPlugin registers the operation exported by the Go plugin at path
+func loadGoPlugin(name, path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	sym, err := p.Lookup("Apply")
+	if err != nil {
+		return err
+	}
+	apply, ok := sym.(func(context.Context, image.Image, string) (image.Image, error))
+	if !ok {
+		return fmt.Errorf("Apply has type %T, expected func(context.Context, image.Image, string) (image.Image, error)", sym)
+	}
+
+	usage := fmt.Sprintf("Apply the %s plugin with the given value", name)
+	if sym, err := p.Lookup("Usage"); err == nil {
+		if s, ok := sym.(*string); ok {
+			usage = *s
+		}
+	}
+	ops.RegisterOperation(name, usage, func(value string) (Operation, error) {
+		return goPluginOp{apply, value}, nil
+	})
+	return nil
+}
+
+// execPluginOp is an operation implemented by an executable, which is run
+// with the flag's value as its only argument, reads a PNG image on stdin and
+// writes the result as an image on stdout. A non-zero exit status fails the
+// operation with the program's stderr as the message.
+type execPluginOp struct {
+	path  string
+	value string
+}
+
+func (op execPluginOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	var in bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := enc.Encode(&in, img); err != nil {
+		return nil, fmt.Errorf("failed to encode image for %s: %w", op.path, err)
+	}
+
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, op.path, op.value)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = &in, &out, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("plugin %s failed: %w", op.path, err)
+	}
+
+	result, _, err := decodeImageContext(ctx, &out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode output of %s: %w", op.path, err)
+	}
+	return result, nil
+}
+
+// loadExecPlugin registers the executable at path as an operation
+func loadExecPlugin(name, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return errors.New("not an executable file or .so Go plugin")
+	}
+	ops.RegisterOperation(name, fmt.Sprintf("Run the %s plugin with the given value as its argument", path), func(value string) (Operation, error) {
+		return execPluginOp{path, value}, nil
+	})
+	return nil
+}
+
+// loadPluginsFromEnv loads the plugins listed in GO_TRANSFORM_PLUGINS
+func loadPluginsFromEnv() error {
+	return loadPlugins(filepath.SplitList(getenvDeprecated(pluginsEnv, oldPluginsEnv)))
+}
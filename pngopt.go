@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"slices"
+)
+
+// pngFilterNames names the filter strategies of filterPNG: the five PNG
+// filters applied to every row, and the per-row choice libpng makes
+var pngFilterNames = []string{"none", "sub", "up", "average", "paeth", "adaptive"}
+
+const pngFilterAdaptive = 5
+
+// pngLayout is a PNG color type and bit depth the pixels of an image can be
+// stored in without loss
+type pngLayout struct {
+	colorType, depth uint8
+	palette          []color.NRGBA64 // for color type 3
+}
+
+// String names the layout in log messages
+func (l pngLayout) String() string {
+	name := map[uint8]string{0: "gray", 2: "rgb", 3: "palette", 4: "gray+alpha", 6: "rgba"}[l.colorType]
+	return fmt.Sprintf("%s %d-bit", name, l.depth)
+}
+
+// channels returns the number of samples per pixel
+func (l pngLayout) channels() int {
+	return map[uint8]int{0: 1, 2: 3, 3: 1, 4: 2, 6: 4}[l.colorType]
+}
+
+// bpp returns the number of whole bytes per pixel that filterPNG works with,
+// at least 1
+func (l pngLayout) bpp() int {
+	return max(1, l.channels()*int(l.depth)/8)
+}
+
+// pngPixels returns the pixels of img as non-premultiplied 16-bit colors,
+// row by row. The colors of the image types the PNG decoder returns convert
+// exactly, even where they are transparent.
+func pngPixels(img image.Image) []color.NRGBA64 {
+	b := img.Bounds()
+	pix := make([]color.NRGBA64, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			pix = append(pix, pngColor(img.At(x, y)))
+		}
+	}
+	return pix
+}
+
+// pngColor converts c to a non-premultiplied 16-bit color
+func pngColor(c color.Color) color.NRGBA64 {
+	if c, ok := c.(color.NRGBA); ok {
+		return color.NRGBA64{uint16(c.R) * 0x101, uint16(c.G) * 0x101, uint16(c.B) * 0x101, uint16(c.A) * 0x101}
+	}
+	return color.NRGBA64Model.Convert(c).(color.NRGBA64)
+}
+
+// pngLayouts returns the layouts worth trying for pix: the smallest gray or
+// truecolor one, and a palette when there are at most 256 colors
+func pngLayouts(pix []color.NRGBA64) []pngLayout {
+	opaque, gray, eightBit := true, true, true
+	counts := map[color.NRGBA64]int{}
+	for _, c := range pix {
+		opaque = opaque && c.A == 0xffff
+		gray = gray && c.R == c.G && c.G == c.B
+		eightBit = eightBit && c.R%0x101 == 0 && c.G%0x101 == 0 && c.B%0x101 == 0 && c.A%0x101 == 0
+		if len(counts) <= 256 {
+			counts[c]++
+		}
+	}
+
+	l := pngLayout{depth: 16}
+	switch {
+	case gray && opaque:
+		l.colorType = 0
+	case gray:
+		l.colorType = 4
+	case opaque:
+		l.colorType = 2
+	default:
+		l.colorType = 6
+	}
+	if eightBit {
+		l.depth = 8
+	}
+	// Opaque gray levels that are all multiples of 255/3, say, fit 2 bits
+	if l.colorType == 0 && eightBit {
+		for _, depth := range []uint8{1, 2, 4} {
+			step := 0xffff / (1<<depth - 1)
+			if !slices.ContainsFunc(pix, func(c color.NRGBA64) bool { return int(c.R)%step != 0 }) {
+				l.depth = depth
+				break
+			}
+		}
+	}
+	layouts := []pngLayout{l}
+
+	if eightBit && len(counts) <= 256 && l.depth >= 8 {
+		p := pngLayout{colorType: 3, depth: 8}
+		for c := range counts {
+			p.palette = append(p.palette, c)
+		}
+		// Translucent entries first keep the tRNS chunk short, then the most
+		// common colors
+		slices.SortFunc(p.palette, func(a, b color.NRGBA64) int {
+			return cmp.Or(cmp.Compare(a.A, b.A), cmp.Compare(counts[b], counts[a]),
+				cmp.Compare(a.R, b.R), cmp.Compare(a.G, b.G), cmp.Compare(a.B, b.B))
+		})
+		for _, depth := range []uint8{1, 2, 4} {
+			if len(p.palette) <= 1<<depth {
+				p.depth = depth
+				break
+			}
+		}
+		layouts = append(layouts, p)
+	}
+	return layouts
+}
+
+// pngScanlines packs pix into the unfiltered rows of layout l
+func pngScanlines(pix []color.NRGBA64, width, height int, l pngLayout) [][]byte {
+	index := map[color.NRGBA64]int{}
+	for i, c := range l.palette {
+		index[c] = i
+	}
+	rowBytes := (width*l.channels()*int(l.depth) + 7) / 8
+	rows := make([][]byte, height)
+	for y := range rows {
+		row := make([]byte, rowBytes)
+		bit := 0
+		put := func(v uint16) {
+			switch l.depth {
+			case 16:
+				binary.BigEndian.PutUint16(row[bit/8:], v)
+			case 8:
+				row[bit/8] = uint8(v >> 8)
+			default:
+				// Scale to the low bit depth and pack the most significant
+				// pixel first
+				v = v / (0xffff / (1<<l.depth - 1))
+				row[bit/8] |= uint8(v) << (8 - int(l.depth) - bit%8)
+			}
+			bit += int(l.depth)
+		}
+		for _, c := range pix[y*width : (y+1)*width] {
+			switch l.colorType {
+			case 0:
+				put(c.R)
+			case 2:
+				put(c.R)
+				put(c.G)
+				put(c.B)
+			case 3:
+				// put scales samples, so pass the index as a high byte
+				if l.depth == 8 {
+					put(uint16(index[c]) << 8)
+				} else {
+					put(uint16(index[c]) * (0xffff / (1<<l.depth - 1)))
+				}
+			case 4:
+				put(c.R)
+				put(c.A)
+			case 6:
+				put(c.R)
+				put(c.G)
+				put(c.B)
+				put(c.A)
+			}
+		}
+		rows[y] = row
+	}
+	return rows
+}
+
+// filterPNG returns the filtered image data of rows, each preceded by its
+// filter type, using one of the strategies named in pngFilterNames. bpp is
+// the number of whole bytes per pixel, at least 1.
+func filterPNG(rows [][]byte, bpp, strategy int) []byte {
+	var out []byte
+	var candidates [5][]byte
+	prev := make([]byte, len(rows[0]))
+	for _, row := range rows {
+		if strategy != pngFilterAdaptive {
+			out = append(out, uint8(strategy))
+			out = appendPNGFilter(out, row, prev, bpp, uint8(strategy))
+		} else {
+			// Pick the filter with the smallest sum of absolute values, as
+			// libpng does
+			best, bestSum := 0, -1
+			for f := range candidates {
+				candidates[f] = appendPNGFilter(candidates[f][:0], row, prev, bpp, uint8(f))
+				sum := 0
+				for _, b := range candidates[f] {
+					sum += min(int(b), 256-int(b))
+				}
+				if bestSum < 0 || sum < bestSum {
+					best, bestSum = f, sum
+				}
+			}
+			out = append(out, uint8(best))
+			out = append(out, candidates[best]...)
+		}
+		prev = row
+	}
+	return out
+}
+
+// appendPNGFilter appends row filtered with filter type f against the
+// previous row prev
+func appendPNGFilter(out, row, prev []byte, bpp int, f uint8) []byte {
+	for i, x := range row {
+		var a, c byte
+		if i >= bpp {
+			a, c = row[i-bpp], prev[i-bpp]
+		}
+		b := prev[i]
+		switch f {
+		case 1:
+			x -= a
+		case 2:
+			x -= b
+		case 3:
+			x -= uint8((int(a) + int(b)) / 2)
+		case 4:
+			x -= paeth(a, b, c)
+		}
+		out = append(out, x)
+	}
+	return out
+}
+
+// appendPNGChunk appends a chunk with its length and CRC to out
+func appendPNGChunk(out []byte, typ string, payload []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(payload)))
+	start := len(out)
+	out = append(append(out, typ...), payload...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+}
+
+// zlibCompress returns data compressed by compress/zlib at level
+func zlibCompress(data []byte, level int) []byte {
+	var b bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&b, level)
+	zw.Write(data)
+	zw.Close()
+	return b.Bytes()
+}
+
+// pngPasses packs pix into the unfiltered rows of layout l: a single pass,
+// or the seven Adam7 passes when interlaced
+func pngPasses(pix []color.NRGBA64, width, height int, l pngLayout, interlace bool) [][][]byte {
+	if !interlace {
+		return [][][]byte{pngScanlines(pix, width, height, l)}
+	}
+	var passes [][][]byte
+	for _, pass := range adam7Passes {
+		sub, w, h := pass.pixels(pix, width, height)
+		// Passes without pixels have no rows at all, not even a filter byte
+		if w > 0 && h > 0 {
+			passes = append(passes, pngScanlines(sub, w, h, l))
+		}
+	}
+	return passes
+}
+
+// filterPNGPasses returns the image data of passes filtered by filterPNG,
+// one pass after the other
+func filterPNGPasses(passes [][][]byte, bpp, strategy int) []byte {
+	var out []byte
+	for _, rows := range passes {
+		out = append(out, filterPNG(rows, bpp, strategy)...)
+	}
+	return out
+}
+
+// encodePNGChunks returns a complete PNG holding only the critical chunks,
+// transparency for a palette, and the compressed image data idat
+func encodePNGChunks(width, height int, l pngLayout, interlace bool, idat []byte) []byte {
+	out := []byte("\x89PNG\r\n\x1a\n")
+	ihdr := binary.BigEndian.AppendUint32(nil, uint32(width))
+	ihdr = binary.BigEndian.AppendUint32(ihdr, uint32(height))
+	method := uint8(0)
+	if interlace {
+		method = 1
+	}
+	out = appendPNGChunk(out, "IHDR", append(ihdr, l.depth, l.colorType, 0, 0, method))
+	if l.colorType == 3 {
+		var plte, trns []byte
+		for _, c := range l.palette {
+			plte = append(plte, uint8(c.R>>8), uint8(c.G>>8), uint8(c.B>>8))
+			trns = append(trns, uint8(c.A>>8))
+		}
+		// tRNS may stop at the last translucent entry
+		for len(trns) > 0 && trns[len(trns)-1] == 0xff {
+			trns = trns[:len(trns)-1]
+		}
+		out = appendPNGChunk(out, "PLTE", plte)
+		if len(trns) > 0 {
+			out = appendPNGChunk(out, "tRNS", trns)
+		}
+	}
+	out = appendPNGChunk(out, "IDAT", idat)
+	return appendPNGChunk(out, "IEND", nil)
+}
+
+// optimizePNG rewrites an encoded PNG losslessly in the smallest form it
+// finds. It tries each layout from pngLayouts with each filter strategy,
+// compressed at zlib's best level, and keeps only the image header, palette,
+// transparency and data chunks. With zopfli, the winning data is compressed
+// again with zopfliZlib. With interlace, the output is Adam7 interlaced.
+func optimizePNG(ctx context.Context, data []byte, zopfli, interlace bool) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode PNG: %w", err)
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	pix := pngPixels(img)
+
+	var best struct {
+		layout   pngLayout
+		filter   int
+		filtered []byte
+		idat     []byte
+	}
+	// Lower efforts try fewer filters: only the adaptive one, or that and none
+	filters := []int{0, 1, 2, 3, 4, pngFilterAdaptive}
+	switch {
+	case encodeEffort >= 0 && encodeEffort <= 2:
+		filters = []int{pngFilterAdaptive}
+	case encodeEffort >= 3 && encodeEffort <= 5:
+		filters = []int{0, pngFilterAdaptive}
+	}
+	for _, l := range pngLayouts(pix) {
+		passes := pngPasses(pix, width, height, l, interlace)
+		for _, filter := range filters {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			filtered := filterPNGPasses(passes, l.bpp(), filter)
+			idat := zlibCompress(filtered, zlib.BestCompression)
+			if best.idat == nil || len(idat) < len(best.idat) {
+				best.layout, best.filter, best.filtered, best.idat = l, filter, filtered, idat
+			}
+		}
+	}
+	if zopfli || encodeEffort == 9 {
+		idat, err := zopfliZlib(ctx, best.filtered)
+		if err != nil {
+			return nil, err
+		}
+		if len(idat) < len(best.idat) {
+			best.idat = idat
+		}
+	}
+
+	out := encodePNGChunks(width, height, best.layout, interlace, best.idat)
+	if len(out) >= len(data) {
+		return data, nil
+	}
+	slog.Info("Optimized PNG", "before", len(data), "after", len(out), "layout", best.layout, "filter", pngFilterNames[best.filter])
+	return out, nil
+}
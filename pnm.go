@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+)
+
+// Netpbm formats: PBM (P1/P4), PGM (P2/P5) and PPM (P3/P6)
+
+// pnmMaxPixels guards against absurd headers before allocating the samples
+const pnmMaxPixels = 400_000_000
+
+// pnmHeader describes a Netpbm image
+type pnmHeader struct {
+	Magic  string
+	Width  int
+	Height int
+	MaxVal int
+}
+
+// pnmReader reads whitespace-separated header tokens, skipping # comments
+type pnmReader struct {
+	*bufio.Reader
+}
+
+func (r pnmReader) token() (string, error) {
+	var tok []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(tok) > 0 {
+				return string(tok), nil
+			}
+			return "", err
+		}
+		switch {
+		case c == '#':
+			if _, err := r.ReadString('\n'); err != nil {
+				return "", err
+			}
+			if len(tok) > 0 {
+				return string(tok), nil
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f':
+			if len(tok) > 0 {
+				return string(tok), nil
+			}
+		default:
+			tok = append(tok, c)
+		}
+	}
+}
+
+func (r pnmReader) int() (int, error) {
+	tok, err := r.token()
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(tok)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid PNM value %q", tok)
+	}
+	return v, nil
+}
+
+func readPNMHeader(r pnmReader) (pnmHeader, error) {
+	var h pnmHeader
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return h, fmt.Errorf("failed to read PNM header: %w", err)
+	}
+	h.Magic = string(magic)
+	if magic[0] != 'P' || magic[1] < '1' || magic[1] > '6' {
+		return h, errors.New("not a PNM image")
+	}
+
+	var err error
+	if h.Width, err = r.int(); err != nil {
+		return h, err
+	}
+	if h.Height, err = r.int(); err != nil {
+		return h, err
+	}
+	h.MaxVal = 1
+	if h.Magic != "P1" && h.Magic != "P4" {
+		if h.MaxVal, err = r.int(); err != nil {
+			return h, err
+		}
+	}
+
+	if h.Width == 0 || h.Height == 0 || h.MaxVal < 1 || h.MaxVal > 65535 {
+		return h, fmt.Errorf("invalid PNM header %dx%d maxval %d", h.Width, h.Height, h.MaxVal)
+	}
+	// Compare without multiplying, which could overflow
+	if h.Height > pnmMaxPixels/h.Width {
+		return h, fmt.Errorf("invalid PNM dimensions %dx%d", h.Width, h.Height)
+	}
+	return h, nil
+}
+
+// DecodePNM reads a PBM, PGM or PPM image (plain or raw) from r
+func DecodePNM(r io.Reader) (image.Image, error) {
+	pr := pnmReader{bufio.NewReader(r)}
+	h, err := readPNMHeader(pr)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := 1
+	if h.Magic == "P3" || h.Magic == "P6" {
+		channels = 3
+	}
+	plain := h.Magic[1] <= '3'
+	wide := h.MaxVal > 255
+
+	// Read all samples scaled to 16 bits. The header is not trusted: the
+	// samples are only allocated once the data holding them has been read.
+	n := h.Width * h.Height * channels
+	var samples []uint16
+	switch {
+	case h.Magic == "P4":
+		rowLen := (h.Width + 7) / 8
+		data, err := readPNMData(pr, rowLen*h.Height)
+		if err != nil {
+			return nil, fmt.Errorf("truncated PBM data: %w", err)
+		}
+		samples = make([]uint16, n)
+		for y := 0; y < h.Height; y++ {
+			row := data[y*rowLen:]
+			for x := 0; x < h.Width; x++ {
+				// In PBM 1 is black
+				if row[x/8]&(0x80>>(x%8)) == 0 {
+					samples[y*h.Width+x] = 0xffff
+				}
+			}
+		}
+	case plain:
+		// Plain samples are grown as they are read, as their text has no
+		// fixed length
+		samples = make([]uint16, 0, min(n, 1<<16))
+		for range n {
+			v, err := pr.int()
+			if err != nil {
+				return nil, fmt.Errorf("truncated PNM data: %w", err)
+			}
+			if h.Magic == "P1" {
+				samples = append(samples, uint16((1-min(v, 1))*0xffff))
+			} else {
+				samples = append(samples, uint16(min(v, h.MaxVal)*0xffff/h.MaxVal))
+			}
+		}
+	default:
+		bytesPerSample := 1
+		if wide {
+			bytesPerSample = 2
+		}
+		buf, err := readPNMData(pr, n*bytesPerSample)
+		if err != nil {
+			return nil, fmt.Errorf("truncated PNM data: %w", err)
+		}
+		samples = make([]uint16, n)
+		for i := range samples {
+			v := int(buf[i])
+			if wide {
+				v = int(buf[2*i])<<8 | int(buf[2*i+1])
+			}
+			samples[i] = uint16(min(v, h.MaxVal) * 0xffff / h.MaxVal)
+		}
+	}
+
+	rect := image.Rect(0, 0, h.Width, h.Height)
+	switch {
+	case channels == 1 && wide:
+		img := image.NewGray16(rect)
+		for i, v := range samples {
+			img.SetGray16(i%h.Width, i/h.Width, color.Gray16{v})
+		}
+		return img, nil
+	case channels == 1:
+		img := image.NewGray(rect)
+		for i, v := range samples {
+			img.Pix[i] = uint8(v >> 8)
+		}
+		return img, nil
+	case wide:
+		img := image.NewRGBA64(rect)
+		for i := 0; i < h.Width*h.Height; i++ {
+			img.SetRGBA64(i%h.Width, i/h.Width, color.RGBA64{samples[3*i], samples[3*i+1], samples[3*i+2], 0xffff})
+		}
+		return img, nil
+	default:
+		img := image.NewRGBA(rect)
+		for i := 0; i < h.Width*h.Height; i++ {
+			img.Pix[4*i] = uint8(samples[3*i] >> 8)
+			img.Pix[4*i+1] = uint8(samples[3*i+1] >> 8)
+			img.Pix[4*i+2] = uint8(samples[3*i+2] >> 8)
+			img.Pix[4*i+3] = 255
+		}
+		return img, nil
+	}
+}
+
+// readPNMData reads the n bytes of raw image data that follow the header.
+// The buffer grows with the data read, so a header claiming more data than
+// the file holds fails without allocating it all.
+func readPNMData(r io.Reader, n int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < n {
+		return nil, fmt.Errorf("%d of %d bytes: %w", len(data), n, io.ErrUnexpectedEOF)
+	}
+	return data, nil
+}
+
+func decodePNMConfig(r io.Reader) (image.Config, error) {
+	h, err := readPNMHeader(pnmReader{bufio.NewReader(r)})
+	if err != nil {
+		return image.Config{}, err
+	}
+	isColor := h.Magic == "P3" || h.Magic == "P6"
+	model := color.GrayModel
+	switch {
+	case isColor && h.MaxVal > 255:
+		model = color.RGBA64Model
+	case isColor:
+		model = color.RGBAModel
+	case h.MaxVal > 255:
+		model = color.Gray16Model
+	}
+	return image.Config{ColorModel: model, Width: h.Width, Height: h.Height}, nil
+}
+
+// isGrayImage reports whether img stores only grey levels
+func isGrayImage(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// EncodePNM writes img to w as raw Netpbm. variant selects the format: "pbm"
+// (1-bit, thresholded at 50%), "pgm" (greyscale), "ppm" (colour) or "pnm" to
+// pick PGM for greyscale images and PPM otherwise. Transparency is discarded.
+func EncodePNM(w io.Writer, img image.Image, variant string) error {
+	if variant == "pnm" {
+		variant = "ppm"
+		if isGrayImage(img) {
+			variant = "pgm"
+		}
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	bw := bufio.NewWriter(w)
+
+	switch variant {
+	case "pbm":
+		fmt.Fprintf(bw, "P4\n%d %d\n", width, height)
+		row := make([]byte, (width+7)/8)
+		for y := 0; y < height; y++ {
+			clear(row)
+			for x := 0; x < width; x++ {
+				g := color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray)
+				if g.Y < 128 {
+					row[x/8] |= 0x80 >> (x % 8)
+				}
+			}
+			bw.Write(row)
+		}
+	case "pgm":
+		fmt.Fprintf(bw, "P5\n%d %d\n255\n", width, height)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				bw.WriteByte(color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y)
+			}
+		}
+	case "ppm":
+		fmt.Fprintf(bw, "P6\n%d %d\n255\n", width, height)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+				bw.Write([]byte{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)})
+			}
+		}
+	default:
+		return fmt.Errorf("unknown Netpbm variant %q", variant)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s data: %w", variant, err)
+	}
+	return nil
+}
+
+func init() {
+	for _, magic := range []string{"P1", "P2", "P3", "P4", "P5", "P6"} {
+		image.RegisterFormat("pnm", magic, DecodePNM, decodePNMConfig)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodePNMRejectsBadHeaders(t *testing.T) {
+	tests := []struct {
+		name, data string
+	}{
+		{"overflowing dimensions", "P5 3037000500 3037000500 255\n"},
+		{"too many pixels", "P6 100000 100000 255\n"},
+		{"truncated raw data", "P6 20000 20000 255\n\x00\x00\x00"},
+		{"truncated wide data", "P5 4 4 65535\n\x00\x01"},
+		{"truncated packed data", "P4 16 16\n\xff"},
+		{"truncated plain data", "P2 10000 10000 255\n1 2 3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodePNM(strings.NewReader(tt.data)); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestDecodePNM(t *testing.T) {
+	for _, data := range []string{
+		"P1 2 2\n1 0\n0 1\n",
+		"P4 2 2\n\x80\x40",
+		"P2 2 2 255\n0 255\n255 0\n",
+		"P5 2 2 255\n\x00\xff\xff\x00",
+	} {
+		img, err := DecodePNM(strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("%q: %v", data, err)
+		}
+		if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 2 {
+			t.Fatalf("%q: got %v, want 2x2", data, b)
+		}
+		for _, p := range [][3]int{{0, 0, 0}, {1, 0, 0xffff}, {0, 1, 0xffff}, {1, 1, 0}} {
+			if r, _, _, _ := img.At(p[0], p[1]).RGBA(); int(r) != p[2] {
+				t.Errorf("%q: pixel (%d, %d) is %#x, want %#x", data, p[0], p[1], r, p[2])
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// previewProtocols are the terminal graphics protocols accepted by -protocol
+var previewProtocols = []string{"auto", "kitty", "iterm", "sixel", "ansi"}
+
+// defaultPreviewSize is the largest width or height in pixels an image is
+// previewed at, which keeps previews quick over slow SSH connections
+const defaultPreviewSize = 800
+
+// detectPreviewProtocol guesses the graphics protocol of the terminal from
+// the environment. Terminals that support none get half-block text art.
+func detectPreviewProtocol() string {
+	term, program := os.Getenv("TERM"), os.Getenv("TERM_PROGRAM")
+	switch {
+	case os.Getenv("KITTY_WINDOW_ID") != "" || term == "xterm-kitty" || program == "ghostty":
+		return "kitty"
+	// iTerm2 sets LC_TERMINAL, which ssh passes on to the remote shell
+	case program == "iTerm.app" || program == "WezTerm" || os.Getenv("LC_TERMINAL") == "iTerm2":
+		return "iterm"
+	case strings.Contains(term, "sixel") || term == "foot" || term == "mlterm" || strings.HasPrefix(term, "foot-"):
+		return "sixel"
+	}
+	return "ansi"
+}
+
+// writePreview draws img inline in the terminal with a graphics protocol,
+// scaled down to fit maxSize pixels
+func writePreview(w io.Writer, img image.Image, protocol string, maxSize int) error {
+	if b := img.Bounds(); b.Dx() > maxSize || b.Dy() > maxSize {
+		img = fitWithin(img, maxSize, maxSize)
+	}
+	if protocol == "ansi" {
+		return encodeTextArt(w, flattenAlpha(img, defaultBackground), "ansi", textArtWidth(0))
+	}
+	if protocol == "sixel" {
+		return writeSixel(w, img)
+	}
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		return fmt.Errorf("failed to encode preview: %w", err)
+	}
+	data := base64.StdEncoding.EncodeToString(encoded.Bytes())
+	out := bufio.NewWriter(w)
+	if protocol == "iterm" {
+		fmt.Fprintf(out, "\x1b]1337;File=inline=1;size=%d;preserveAspectRatio=1:%s\a\n", encoded.Len(), data)
+		return out.Flush()
+	}
+
+	// Kitty takes the image in chunks of at most 4096 bytes of base64
+	for i := 0; i < len(data); i += 4096 {
+		chunk := data[i:min(i+4096, len(data))]
+		more := 0
+		if i+4096 < len(data) {
+			more = 1
+		}
+		if i == 0 {
+			fmt.Fprintf(out, "\x1b_Ga=T,f=100,m=%d;%s\x1b\\", more, chunk)
+		} else {
+			fmt.Fprintf(out, "\x1b_Gm=%d;%s\x1b\\", more, chunk)
+		}
+	}
+	out.WriteByte('\n')
+	return out.Flush()
+}
+
+// writeSixel draws img as sixels: a palette of up to 255 colors, then bands
+// six pixels high, drawn once per color in them. Mostly transparent pixels
+// are left undrawn, showing the terminal's background.
+func writeSixel(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	transparent := make([]bool, width*height)
+	if !isOpaqueImage(img) {
+		for y := range height {
+			for x := range width {
+				_, _, _, a := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+				transparent[y*width+x] = a < 0x8000
+			}
+		}
+	}
+	opaque := flattenAlpha(img, defaultBackground)
+	paletted := image.NewPaletted(image.Rect(0, 0, width, height), quantizeMedianCut(opaque, transparent, 255))
+	draw.FloydSteinberg.Draw(paletted, paletted.Rect, opaque, bounds.Min)
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "\x1bP0;1q\"1;1;%d;%d", width, height)
+	for i, c := range paletted.Palette {
+		r, g, b, _ := c.RGBA()
+		fmt.Fprintf(out, "#%d;2;%d;%d;%d", i, r*100/0xffff, g*100/0xffff, b*100/0xffff)
+	}
+
+	row := make([]byte, width)
+	for top := 0; top < height; top += 6 {
+		var used []uint8
+		for y := top; y < min(top+6, height); y++ {
+			for x := range width {
+				if i := paletted.Pix[y*paletted.Stride+x]; !transparent[y*width+x] && !slices.Contains(used, i) {
+					used = append(used, i)
+				}
+			}
+		}
+		for _, c := range used {
+			for x := range width {
+				bits := byte(0)
+				for k := range min(6, height-top) {
+					y := top + k
+					if paletted.Pix[y*paletted.Stride+x] == c && !transparent[y*width+x] {
+						bits |= 1 << k
+					}
+				}
+				row[x] = '?' + bits
+			}
+			fmt.Fprintf(out, "#%d", c)
+			writeSixelRuns(out, row)
+			out.WriteByte('$')
+		}
+		out.WriteByte('-')
+	}
+	out.WriteString("\x1b\\\n")
+	return out.Flush()
+}
+
+// writeSixelRuns writes a row of sixels, with runs of four or more of the
+// same one shortened to a repeat count
+func writeSixelRuns(out *bufio.Writer, row []byte) {
+	for i := 0; i < len(row); {
+		n := 1
+		for i+n < len(row) && row[i+n] == row[i] {
+			n++
+		}
+		if n >= 4 {
+			fmt.Fprintf(out, "!%d%c", n, row[i])
+		} else {
+			out.Write(row[i : i+n])
+		}
+		i += n
+	}
+}
+
+// previewFile shows the image at path in the terminal
+func previewFile(path, protocol string, maxSize int) error {
+	img, _, err := loadImage(path)
+	if err != nil {
+		return err
+	}
+	if protocol == "auto" {
+		protocol = detectPreviewProtocol()
+	}
+	slog.Debug("Previewing image", "path", path, "protocol", protocol)
+	return writePreview(os.Stdout, img, protocol, maxSize)
+}
+
+// runPreview implements the preview subcommand
+func runPreview(args []string) error {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	protocol := fs.String("protocol", "auto", "Terminal graphics protocol: auto, kitty, iterm, sixel or ansi (colored text for terminals without graphics)")
+	maxSize := fs.Int("max-size", defaultPreviewSize, "Largest width or height in pixels to show images at; larger ones are scaled down")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s preview [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		return fmt.Errorf("at least one input image is required")
+	}
+	if !slices.Contains(previewProtocols, *protocol) {
+		return fmt.Errorf("invalid protocol %q: expected %s", *protocol, strings.Join(previewProtocols, ", "))
+	}
+	if *maxSize < 1 {
+		return fmt.Errorf("max size must be at least 1")
+	}
+
+	for _, path := range inputs {
+		if len(inputs) > 1 {
+			fmt.Println(path)
+		}
+		if err := previewFile(path, *protocol, *maxSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyClient fetches source images from the origin
+var proxyClient = &http.Client{Timeout: 30 * time.Second}
+
+// proxyHandler serves transformed origin images. A request path has the
+// form /{options}/{origin path}, where options are name:value pairs
+// separated by commas, or _ for none, e.g.
+// /resize:50,format:jpeg/images/photo.png. Query parameters with the same
+// names override options in the path. With a secret, the path is prefixed
+// by its signature, see verifyProxySignature.
+type proxyHandler struct {
+	base   processOptions
+	origin *url.URL
+	maxAge time.Duration
+	secret []byte
+	limits *serverLimits
+}
+
+// signingKeyEnv names the environment variable holding the secret that
+// proxy URLs are signed with, and oldSigningKeyEnv its deprecated name
+const (
+	signingKeyEnv    = envPrefix + "SIGNING_KEY"
+	oldSigningKeyEnv = "IMG_PROCESSOR_SIGNING_KEY"
+)
+
+// signProxyPath returns the signature of a proxy path and query: the
+// unpadded base64url encoding of their HMAC-SHA256 under secret
+func signProxyPath(secret []byte, path string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(path))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyProxySignature checks a signed request of the form
+// /{signature}/{options}/{origin path}[?query] and returns the path with
+// the signature removed
+func verifyProxySignature(secret []byte, r *http.Request) (string, error) {
+	signature, rest, ok := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	if !ok {
+		return "", errors.New("expected /{signature}/{options}/{origin path}")
+	}
+	signed := "/" + rest
+	if r.URL.RawQuery != "" {
+		signed += "?" + r.URL.RawQuery
+	}
+	if !hmac.Equal([]byte(signature), []byte(signProxyPath(secret, signed))) {
+		return "", errors.New("invalid signature")
+	}
+	path, err := url.PathUnescape(signed[:len("/"+rest)])
+	if err != nil {
+		return "", fmt.Errorf("invalid path: %w", err)
+	}
+	return path, nil
+}
+
+// parseProxyPath splits a request path into its options and origin path,
+// taking further options from query
+func parseProxyPath(path string, query url.Values) (map[string]string, string, error) {
+	spec, originPath, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok || originPath == "" {
+		return nil, "", errors.New("expected /{options}/{origin path}")
+	}
+	if slices.Contains(strings.Split(originPath, "/"), "..") {
+		return nil, "", errors.New("origin path must not contain ..")
+	}
+
+	options := map[string]string{}
+	if spec != "_" {
+		for _, pair := range strings.Split(spec, ",") {
+			name, value, ok := strings.Cut(pair, ":")
+			if !ok {
+				return nil, "", fmt.Errorf("invalid option %q: expected name:value", pair)
+			}
+			options[name] = value
+		}
+	}
+	for name, values := range query {
+		options[name] = values[len(values)-1]
+	}
+	return options, originPath, nil
+}
+
+// proxyCacheKey identifies the result of applying o to the image at the
+// source URL, named name on the origin. Keying by URL lets hits skip fetching
+// the origin, so an origin image changed in place is served from the cache
+// until its entry is evicted.
+func proxyCacheKey(o *processOptions, source, name string) string {
+	return resultKey("url", o, name, []byte(source))
+}
+
+// contentTypeFor returns the MIME type of an output format
+func contentTypeFor(format string) string {
+	switch format {
+	case "ico":
+		return "image/x-icon"
+	case "tiff", "tif":
+		return "image/tiff"
+	case "qoi":
+		return "image/qoi"
+	case "dds":
+		return "image/vnd-ms.dds"
+	case "pbm":
+		return "image/x-portable-bitmap"
+	case "pgm":
+		return "image/x-portable-graymap"
+	case "ppm":
+		return "image/x-portable-pixmap"
+	case "pnm":
+		return "image/x-portable-anymap"
+	}
+	if t := mime.TypeByExtension("." + format); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func (h *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Path
+	if h.secret != nil {
+		var err error
+		if path, err = verifyProxySignature(h.secret, r); err != nil {
+			slog.Warn("Rejected unsigned proxy request", "path", r.URL.Path, "error", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if !h.limits.allow(r) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, errRateLimited.Error(), http.StatusTooManyRequests)
+		return
+	}
+	options, originPath, err := parseProxyPath(path, r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := parseRequestOptions(h.base, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Results are cached by URL so that hits don't fetch the origin. Entries
+	// hold the output format on the first line, then the image.
+	key := proxyCacheKey(opts, h.origin.JoinPath(originPath).String(), originPath)
+	var entry []byte
+	var hit bool
+	if resultCache != nil {
+		if entry, hit, err = resultCache.Get(key); err != nil {
+			slog.Warn("Could not read cache", "error", err)
+		}
+	}
+	if !hit {
+		var status int
+		if entry, status, err = h.transform(r.Context(), opts, originPath); err != nil {
+			if status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "1")
+			}
+			slog.Warn("Proxy request failed", "path", r.URL.Path, "status", status, "error", err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if resultCache != nil {
+			if err := resultCache.Put(key, entry); err != nil {
+				slog.Warn("Could not write cache", "error", err)
+			}
+		}
+	}
+	format, data, _ := bytes.Cut(entry, []byte("\n"))
+	slog.Debug("Proxy request", "path", r.URL.Path, "cached", hit, "bytes", len(data))
+
+	etag := `"` + key[:32] + `"`
+	w.Header().Set("Content-Type", contentTypeFor(string(format)))
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(h.maxAge.Seconds())))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.Write(data)
+		metrics.bytesOut.Add(int64(len(data)))
+	}
+}
+
+// transform fetches the origin image and processes it, returning a cache
+// entry, or an error with the HTTP status to answer with
+func (h *proxyHandler) transform(ctx context.Context, opts *processOptions, originPath string) ([]byte, int, error) {
+	release, err := h.limits.acquire(ctx)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	defer release()
+
+	// -timeout covers fetching the origin image as well as processing it
+	ctx, cancel := opts.jobContext(ctx)
+	defer cancel()
+
+	source := h.origin.JoinPath(originPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.String(), nil)
+	if err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("failed to fetch origin image: %w", err)
+	}
+	resp, err := proxyClient.Do(req)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, http.StatusGatewayTimeout, fmt.Errorf("failed to fetch origin image: %w", err)
+	}
+	if err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("failed to fetch origin image: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		status := http.StatusBadGateway
+		if resp.StatusCode == http.StatusNotFound {
+			status = http.StatusNotFound
+		}
+		return nil, status, fmt.Errorf("origin returned %s", resp.Status)
+	}
+
+	data, err := inputLimits.readInput(resp.Body)
+	if err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("failed to fetch origin image: %w", err)
+	}
+
+	metrics.bytesIn.Add(int64(len(data)))
+	done := metrics.startTransform()
+	var encoded bytes.Buffer
+	result, err := processImage(ctx, opts, originPath, data, nil, source.String(), &encoded)
+	done(result.Format, err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, http.StatusGatewayTimeout, err
+	}
+	if err != nil {
+		return nil, http.StatusUnprocessableEntity, err
+	}
+	return append([]byte(result.Format+"\n"), encoded.Bytes()...), http.StatusOK, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestProxyCacheKeyCoversServerSettings(t *testing.T) {
+	defer func(d encoderDefaults) { siteDefaults = d }(siteDefaults)
+	base := *addProcessFlags(flag.NewFlagSet("serve", flag.ContinueOnError))
+	options := map[string]string{"resize": "50", "format": "png"}
+	key := func(base processOptions) string {
+		t.Helper()
+		opts, err := parseRequestOptions(base, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proxyCacheKey(opts, "https://assets.example.com/a.png", "a.png")
+	}
+
+	want := key(base)
+	if got := key(base); got != want {
+		t.Fatalf("equal requests gave keys %s and %s", want, got)
+	}
+	changes := map[string]func(o *processOptions){
+		"filter":        func(o *processOptions) { o.Filter = "bilinear" },
+		"linear-resize": func(o *processOptions) { o.LinearResize = false },
+		"effort":        func(o *processOptions) { o.Effort = 9 },
+		"tone-map":      func(o *processOptions) { o.ToneMap = "aces" },
+		"exposure":      func(o *processOptions) { o.Exposure = 1 },
+		"pdf-renderer":  func(o *processOptions) { o.PDFRenderer = "none" },
+	}
+	for name, change := range changes {
+		changed := base
+		change(&changed)
+		if key(changed) == want {
+			t.Errorf("changing the server's -%s kept the proxy cache key", name)
+		}
+	}
+	siteDefaults.JPEGQuality--
+	if key(base) == want {
+		t.Error("changing the encoder defaults kept the proxy cache key")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// QOI ("Quite OK Image") format, see https://qoiformat.org/qoi-specification.pdf
+
+const (
+	qoiOpIndex = 0x00 // 00xxxxxx
+	qoiOpDiff  = 0x40 // 01xxxxxx
+	qoiOpLuma  = 0x80 // 10xxxxxx
+	qoiOpRun   = 0xc0 // 11xxxxxx
+	qoiOpRGB   = 0xfe
+	qoiOpRGBA  = 0xff
+	qoiMask2   = 0xc0
+
+	qoiHeaderSize = 14
+	// Guard against absurd headers before allocating the pixel buffer
+	qoiMaxPixels = 400_000_000
+)
+
+var qoiPadding = []byte{0, 0, 0, 0, 0, 0, 0, 1}
+
+// qoiHeader is the 14-byte QOI file header
+type qoiHeader struct {
+	Magic      [4]byte
+	Width      uint32
+	Height     uint32
+	Channels   uint8
+	Colorspace uint8
+}
+
+func qoiHash(c color.NRGBA) int {
+	return (int(c.R)*3 + int(c.G)*5 + int(c.B)*7 + int(c.A)*11) % 64
+}
+
+// EncodeQOI writes img to w in QOI format
+func EncodeQOI(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	opaque := true
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			nrgba.SetNRGBA(x, y, c)
+			if c.A != 255 {
+				opaque = false
+			}
+		}
+	}
+
+	channels := uint8(4)
+	if opaque {
+		channels = 3
+	}
+
+	bw := bufio.NewWriter(w)
+	header := qoiHeader{
+		Magic:    [4]byte{'q', 'o', 'i', 'f'},
+		Width:    uint32(bounds.Dx()),
+		Height:   uint32(bounds.Dy()),
+		Channels: channels,
+	}
+	if err := binary.Write(bw, binary.BigEndian, header); err != nil {
+		return fmt.Errorf("failed to write QOI header: %w", err)
+	}
+
+	var index [64]color.NRGBA
+	prev := color.NRGBA{A: 255}
+	run := 0
+	pix := nrgba.Pix
+	for i := 0; i < len(pix); i += 4 {
+		px := color.NRGBA{pix[i], pix[i+1], pix[i+2], pix[i+3]}
+
+		if px == prev {
+			run++
+			if run == 62 || i+4 == len(pix) {
+				bw.WriteByte(qoiOpRun | byte(run-1))
+				run = 0
+			}
+			continue
+		}
+		if run > 0 {
+			bw.WriteByte(qoiOpRun | byte(run-1))
+			run = 0
+		}
+
+		h := qoiHash(px)
+		switch {
+		case index[h] == px:
+			bw.WriteByte(qoiOpIndex | byte(h))
+		case px.A == prev.A:
+			dr := int8(px.R - prev.R)
+			dg := int8(px.G - prev.G)
+			db := int8(px.B - prev.B)
+			drdg := dr - dg
+			dbdg := db - dg
+			switch {
+			case dr >= -2 && dr <= 1 && dg >= -2 && dg <= 1 && db >= -2 && db <= 1:
+				bw.WriteByte(qoiOpDiff | byte(dr+2)<<4 | byte(dg+2)<<2 | byte(db+2))
+			case dg >= -32 && dg <= 31 && drdg >= -8 && drdg <= 7 && dbdg >= -8 && dbdg <= 7:
+				bw.WriteByte(qoiOpLuma | byte(dg+32))
+				bw.WriteByte(byte(drdg+8)<<4 | byte(dbdg+8))
+			default:
+				bw.Write([]byte{qoiOpRGB, px.R, px.G, px.B})
+			}
+		default:
+			bw.Write([]byte{qoiOpRGBA, px.R, px.G, px.B, px.A})
+		}
+		index[h] = px
+		prev = px
+	}
+
+	bw.Write(qoiPadding)
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write QOI data: %w", err)
+	}
+	return nil
+}
+
+func readQOIHeader(r io.Reader) (qoiHeader, error) {
+	var header qoiHeader
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return header, fmt.Errorf("failed to read QOI header: %w", err)
+	}
+	if string(header.Magic[:]) != "qoif" {
+		return header, errors.New("not a QOI image")
+	}
+	if header.Width == 0 || header.Height == 0 || uint64(header.Width)*uint64(header.Height) > qoiMaxPixels {
+		return header, fmt.Errorf("invalid QOI dimensions %dx%d", header.Width, header.Height)
+	}
+	return header, nil
+}
+
+// DecodeQOI reads a QOI image from r
+func DecodeQOI(r io.Reader) (image.Image, error) {
+	header, err := readQOIHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	img := image.NewNRGBA(image.Rect(0, 0, int(header.Width), int(header.Height)))
+	var index [64]color.NRGBA
+	px := color.NRGBA{A: 255}
+	run := 0
+
+	pix := img.Pix
+	for i := 0; i < len(pix); i += 4 {
+		if run > 0 {
+			run--
+		} else {
+			b1, err := br.ReadByte()
+			if err != nil {
+				return nil, fmt.Errorf("truncated QOI data: %w", err)
+			}
+
+			switch {
+			case b1 == qoiOpRGB:
+				var rgb [3]byte
+				if _, err := io.ReadFull(br, rgb[:]); err != nil {
+					return nil, fmt.Errorf("truncated QOI data: %w", err)
+				}
+				px.R, px.G, px.B = rgb[0], rgb[1], rgb[2]
+			case b1 == qoiOpRGBA:
+				var rgba [4]byte
+				if _, err := io.ReadFull(br, rgba[:]); err != nil {
+					return nil, fmt.Errorf("truncated QOI data: %w", err)
+				}
+				px = color.NRGBA{rgba[0], rgba[1], rgba[2], rgba[3]}
+			case b1&qoiMask2 == qoiOpIndex:
+				px = index[b1]
+			case b1&qoiMask2 == qoiOpDiff:
+				px.R += (b1>>4)&0x03 - 2
+				px.G += (b1>>2)&0x03 - 2
+				px.B += b1&0x03 - 2
+			case b1&qoiMask2 == qoiOpLuma:
+				b2, err := br.ReadByte()
+				if err != nil {
+					return nil, fmt.Errorf("truncated QOI data: %w", err)
+				}
+				dg := b1&0x3f - 32
+				px.R += dg - 8 + (b2>>4)&0x0f
+				px.G += dg
+				px.B += dg - 8 + b2&0x0f
+			case b1&qoiMask2 == qoiOpRun:
+				run = int(b1 & 0x3f)
+			}
+			index[qoiHash(px)] = px
+		}
+
+		pix[i], pix[i+1], pix[i+2], pix[i+3] = px.R, px.G, px.B, px.A
+	}
+
+	return img, nil
+}
+
+func decodeQOIConfig(r io.Reader) (image.Config, error) {
+	header, err := readQOIHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: int(header.Width), Height: int(header.Height)}, nil
+}
+
+func init() {
+	image.RegisterFormat("qoi", "qoif", DecodeQOI, decodeQOIConfig)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// qoiFile returns a QOI file of the given size with data as its chunks
+func qoiFile(width, height uint32, channels uint8, data ...byte) []byte {
+	b := []byte{'q', 'o', 'i', 'f', byte(width >> 24), byte(width >> 16), byte(width >> 8), byte(width),
+		byte(height >> 24), byte(height >> 16), byte(height >> 8), byte(height), channels, 0}
+	b = append(b, data...)
+	return append(b, qoiPadding...)
+}
+
+func TestDecodeQOIRejectsBadHeaders(t *testing.T) {
+	tests := []struct {
+		name, data string
+	}{
+		{"short header", "qoif\x00\x00"},
+		{"bad magic", "qoix" + string(qoiFile(1, 1, 4, qoiOpRGB, 1, 2, 3))[4:]},
+		{"zero width", string(qoiFile(0, 1, 4))},
+		{"too many pixels", string(qoiFile(100000, 100000, 4))},
+		{"truncated data", string(qoiFile(16, 16, 4, qoiOpRGBA, 1, 2, 3, 4))[:20]},
+		{"truncated chunk", string(qoiFile(2, 1, 3, qoiOpRGB, 1, 2, 3))[:18]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeQOI(strings.NewReader(tt.data)); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestDecodeQOI(t *testing.T) {
+	// One chunk of each kind: a color, a small and a luma difference, a
+	// lookup of the first color and a run of two
+	data := qoiFile(6, 1, 4,
+		qoiOpRGB, 10, 20, 30,
+		qoiOpDiff|3<<4|1<<2|2,
+		qoiOpLuma|42, 5<<4|13,
+		qoiOpIndex|9,
+		qoiOpRun|1,
+	)
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []color.NRGBA{{10, 20, 30, 255}, {11, 19, 30, 255}, {18, 29, 45, 255}, {10, 20, 30, 255}, {10, 20, 30, 255}, {10, 20, 30, 255}}
+	if b := img.Bounds(); b.Dx() != len(want) || b.Dy() != 1 {
+		t.Fatalf("got %v, want %dx1", b, len(want))
+	}
+	for x, w := range want {
+		if got := color.NRGBAModel.Convert(img.At(x, 0)); got != w {
+			t.Errorf("pixel %d is %v, want %v", x, got, w)
+		}
+	}
+}
+
+func TestEncodeQOIRoundTrip(t *testing.T) {
+	// Long runs, repeated colors, small and large steps and changing alpha
+	// between them use every chunk type
+	img := image.NewNRGBA(image.Rect(0, 0, 97, 53))
+	for y := range 53 {
+		for x := range 97 {
+			var c color.NRGBA
+			switch {
+			case y < 10:
+				c = color.NRGBA{200, 100, 50, 255}
+			case y < 20:
+				c = color.NRGBA{uint8(x), uint8(x + y), uint8(y), 255}
+			case y < 30:
+				c = color.NRGBA{uint8(x * 37), uint8(y * 91), uint8(x * y), 255}
+			case y < 40:
+				c = []color.NRGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}}[x%3]
+			default:
+				c = color.NRGBA{uint8(x * 5), 80, uint8(y * 3), uint8(x * 11)}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	opaque := image.NewNRGBA(image.Rect(10, 10, 110, 50))
+	for i := range opaque.Pix {
+		opaque.Pix[i] = 255
+	}
+
+	for _, tc := range []struct {
+		name     string
+		img      *image.NRGBA
+		channels byte
+	}{
+		{"translucent", img, 4},
+		{"opaque", opaque, 3},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeQOI(&buf, tc.img); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		data := buf.Bytes()
+		if data[12] != tc.channels {
+			t.Errorf("%s: header has %d channels, want %d", tc.name, data[12], tc.channels)
+		}
+		if !bytes.HasSuffix(data, qoiPadding) {
+			t.Errorf("%s: data does not end with the QOI padding", tc.name)
+		}
+		got, err := DecodeQOI(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		b := tc.img.Bounds()
+		if got.Bounds() != image.Rect(0, 0, b.Dx(), b.Dy()) {
+			t.Fatalf("%s: decoded bounds %v, want %dx%d", tc.name, got.Bounds(), b.Dx(), b.Dy())
+		}
+		if !bytes.Equal(got.(*image.NRGBA).Pix, tc.img.SubImage(b).(*image.NRGBA).Pix) {
+			t.Errorf("%s: decoded pixels differ from the encoded ones", tc.name)
+		}
+	}
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A QR code encoder following ISO/IEC 18004, for byte mode data at any
+// version and error correction level. The version is the smallest that
+// holds the data, and the mask the one scoring the lowest penalty.
+
+// qrLevel is an error correction level, by the share of the symbol that may
+// be damaged and still read: L 7%, M 15%, Q 25% or H 30%
+type qrLevel int
+
+const (
+	qrLow qrLevel = iota
+	qrMedium
+	qrQuartile
+	qrHigh
+)
+
+// qrLevels maps the names of the error correction levels to their values
+var qrLevels = map[string]qrLevel{"L": qrLow, "M": qrMedium, "Q": qrQuartile, "H": qrHigh}
+
+// qrQuietZone is the width in modules of the light border a reader needs
+// around the symbol
+const qrQuietZone = 4
+
+// qrFormatBits are the bits identifying each level in the format information
+var qrFormatBits = [4]int{1, 0, 3, 2}
+
+// qrECCPerBlock is the number of error correction codewords in each block,
+// by level and version
+var qrECCPerBlock = [4][41]int{
+	{0, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{0, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{0, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+// qrBlocks is the number of blocks the codewords are split into, by level
+// and version
+var qrBlocks = [4][41]int{
+	{0, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{0, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{0, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+// qrCode is an encoded symbol, without its quiet zone
+type qrCode struct {
+	size     int
+	modules  []bool // row by row, true for dark
+	function []bool // modules of the fixed patterns, which are not masked
+}
+
+// qrRawModules returns the number of modules of a version that hold
+// codewords, once the fixed patterns are left out
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+// qrDataCodewords returns the number of data codewords of a version and level
+func qrDataCodewords(version int, level qrLevel) int {
+	return qrRawModules(version)/8 - qrECCPerBlock[level][version]*qrBlocks[level][version]
+}
+
+// encodeQR encodes data in byte mode in the smallest version that holds it
+func encodeQR(data []byte, level qrLevel) (*qrCode, error) {
+	version := 0
+	for v := 1; v <= 40; v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*qrDataCodewords(v, level) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%d bytes is too long for a QR code at this error correction level", len(data))
+	}
+
+	// Mode, length and data, then a terminator and padding to fill the
+	// capacity
+	var bits []bool
+	appendBits := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, v>>i&1 == 1)
+		}
+	}
+	appendBits(0b0100, 4)
+	if version >= 10 {
+		appendBits(len(data), 16)
+	} else {
+		appendBits(len(data), 8)
+	}
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	capacity := qrDataCodewords(version, level)
+	appendBits(0, min(4, 8*capacity-len(bits)))
+	appendBits(0, -len(bits)&7)
+	codewords := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for _, bit := range bits[i : i+8] {
+			b <<= 1
+			if bit {
+				b |= 1
+			}
+		}
+		codewords = append(codewords, b)
+	}
+	for pad := byte(0xec); len(codewords) < capacity; pad ^= 0xec ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+
+	q := &qrCode{size: 4*version + 17}
+	q.modules = make([]bool, q.size*q.size)
+	q.function = make([]bool, q.size*q.size)
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrInterleave(codewords, version, level))
+
+	// Keep the mask with the lowest penalty
+	best, bestPenalty := 0, -1
+	for mask := range 8 {
+		q.applyMask(mask)
+		q.drawFormatBits(level, mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(level, best)
+	return q, nil
+}
+
+// qrInterleave splits the data codewords into blocks, appends each block's
+// error correction codewords and interleaves the blocks
+func qrInterleave(data []byte, version int, level qrLevel) []byte {
+	numBlocks, ecc := qrBlocks[level][version], qrECCPerBlock[level][version]
+	raw := qrRawModules(version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+
+	// Short blocks get a placeholder after their data so that every block
+	// has the same length; it is skipped when interleaving
+	blocks := make([][]byte, numBlocks)
+	for i := range blocks {
+		n := shortLen - ecc
+		if i >= numShort {
+			n++
+		}
+		block := slices.Clone(data[:n])
+		data = data[n:]
+		parity := qrReedSolomon(block, ecc)
+		if i < numShort {
+			block = append(block, 0)
+		}
+		blocks[i] = append(block, parity...)
+	}
+
+	result := make([]byte, 0, raw)
+	for i := range shortLen + 1 {
+		for j, block := range blocks {
+			if i != shortLen-ecc || j >= numShort {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+// qrReedSolomon returns the degree error correction codewords of data
+func qrReedSolomon(data []byte, degree int) []byte {
+	// The generator polynomial's coefficients, highest power first and
+	// without the leading 1, of the product of (x - 2^i) for i below degree
+	generator := make([]byte, degree)
+	generator[degree-1] = 1
+	root := byte(1)
+	for range degree {
+		for j := range generator {
+			generator[j] = gfMultiply(generator[j], root)
+			if j+1 < degree {
+				generator[j] ^= generator[j+1]
+			}
+		}
+		root = gfMultiply(root, 2)
+	}
+
+	remainder := make([]byte, degree)
+	for _, b := range data {
+		factor := b ^ remainder[0]
+		copy(remainder, remainder[1:])
+		remainder[degree-1] = 0
+		for i, g := range generator {
+			remainder[i] ^= gfMultiply(g, factor)
+		}
+	}
+	return remainder
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11d
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+// set sets a module, marking it as part of the fixed patterns if function
+func (q *qrCode) set(x, y int, dark, function bool) {
+	q.modules[y*q.size+x] = dark
+	q.function[y*q.size+x] = function
+}
+
+// dark reports whether the module at x, y is dark
+func (q *qrCode) dark(x, y int) bool {
+	return q.modules[y*q.size+x]
+}
+
+// drawFunctionPatterns draws the finder, timing and alignment patterns and
+// the version information, and reserves the format information's modules
+func (q *qrCode) drawFunctionPatterns(version int) {
+	n := q.size
+	for i := range n {
+		q.set(6, i, i%2 == 0, true)
+		q.set(i, 6, i%2 == 0, true)
+	}
+
+	// Finder patterns with their separators
+	for _, c := range []image.Point{{3, 3}, {n - 4, 3}, {3, n - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c.X+dx, c.Y+dy
+				if x >= 0 && x < n && y >= 0 && y < n {
+					d := max(abs(dx), abs(dy))
+					q.set(x, y, d != 2 && d != 4, true)
+				}
+			}
+		}
+	}
+
+	// Alignment patterns on a grid, except where they meet finder patterns
+	if version > 1 {
+		count := version/7 + 2
+		step := 26
+		if version != 32 {
+			step = (version*4 + count*2 + 1) / (count*2 - 2) * 2
+		}
+		positions := []int{6}
+		for pos := n - 7; len(positions) < count; pos -= step {
+			positions = slices.Insert(positions, 1, pos)
+		}
+		for i, y := range positions {
+			for j, x := range positions {
+				if i == 0 && j == 0 || i == 0 && j == count-1 || i == count-1 && j == 0 {
+					continue
+				}
+				for dy := -2; dy <= 2; dy++ {
+					for dx := -2; dx <= 2; dx++ {
+						q.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1, true)
+					}
+				}
+			}
+		}
+	}
+
+	// Reserve the format information, drawn once the mask is known
+	q.drawFormatBits(qrLow, 0)
+
+	if version >= 7 {
+		rem := version
+		for range 12 {
+			rem = rem<<1 ^ (rem>>11)*0x1f25
+		}
+		bits := version<<12 | rem
+		for i := range 18 {
+			dark := bits>>i&1 == 1
+			a, b := n-11+i%3, i/3
+			q.set(a, b, dark, true)
+			q.set(b, a, dark, true)
+		}
+	}
+}
+
+// drawFormatBits draws both copies of the format information for a level
+// and mask, and the dark module beside them
+func (q *qrCode) drawFormatBits(level qrLevel, mask int) {
+	data := qrFormatBits[level]<<3 | mask
+	rem := data
+	for range 10 {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	n := q.size
+	for i := range 6 {
+		q.set(8, i, bit(i), true)
+	}
+	q.set(8, 7, bit(6), true)
+	q.set(8, 8, bit(7), true)
+	q.set(7, 8, bit(8), true)
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i), true)
+	}
+	for i := range 8 {
+		q.set(n-1-i, 8, bit(i), true)
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, n-15+i, bit(i), true)
+	}
+	q.set(8, n-8, true, true)
+}
+
+// drawCodewords fills the modules outside the fixed patterns with data, in
+// two module wide columns zigzagging up and down from the right
+func (q *qrCode) drawCodewords(data []byte) {
+	n := q.size
+	i := 0
+	for right := n - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// Skip the vertical timing pattern
+			right = 5
+		}
+		for vert := range n {
+			for j := range 2 {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = n - 1 - vert
+				}
+				if !q.function[y*n+x] && i < len(data)*8 {
+					q.modules[y*n+x] = data[i>>3]>>(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by a mask pattern. Applying
+// the same mask again undoes it.
+func (q *qrCode) applyMask(mask int) {
+	n := q.size
+	for y := range n {
+		for x := range n {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y*n+x] {
+				q.modules[y*n+x] = !q.modules[y*n+x]
+			}
+		}
+	}
+}
+
+// qrFinderLike are the runs that look like part of a finder pattern, which
+// the penalty discourages
+var qrFinderLike = [2][11]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+// penalty scores how hard the symbol is to read: long runs of one color, 2x2
+// blocks, runs resembling finder patterns and an uneven share of dark
+// modules all add to it
+func (q *qrCode) penalty() int {
+	n := q.size
+	p := 0
+	for a := range n {
+		for _, at := range []func(b int) bool{
+			func(b int) bool { return q.dark(b, a) },
+			func(b int) bool { return q.dark(a, b) },
+		} {
+			run := 1
+			for b := 1; b <= n; b++ {
+				if b < n && at(b) == at(b-1) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += run - 2
+				}
+				run = 1
+			}
+			for b := 0; b+11 <= n; b++ {
+				for _, pattern := range qrFinderLike {
+					if matchesRun(at, b, pattern[:]) {
+						p += 40
+					}
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := range n {
+		for x := range n {
+			if q.dark(x, y) {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := q.dark(x, y)
+				if q.dark(x+1, y) == c && q.dark(x, y+1) == c && q.dark(x+1, y+1) == c {
+					p += 3
+				}
+			}
+		}
+	}
+	p += abs(dark*100/(n*n)-50) / 5 * 10
+	return p
+}
+
+// matchesRun reports whether the modules from start match pattern
+func matchesRun(at func(int) bool, start int, pattern []bool) bool {
+	for i, v := range pattern {
+		if at(start+i) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// image draws the symbol with scale pixels per module and a quiet zone of
+// margin modules
+func (q *qrCode) image(scale, margin int, fg, bg color.Color) *image.NRGBA {
+	side := (q.size + 2*margin) * scale
+	img := image.NewNRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(img, img.Rect, image.NewUniform(bg), image.Point{}, draw.Src)
+	ink := image.NewUniform(fg)
+	for y := range q.size {
+		for x := range q.size {
+			if q.dark(x, y) {
+				r := image.Rect(x+margin, y+margin, x+margin+1, y+margin+1)
+				draw.Draw(img, image.Rectangle{Min: r.Min.Mul(scale), Max: r.Max.Mul(scale)}, ink, image.Point{}, draw.Src)
+			}
+		}
+	}
+	return img
+}
+
+// svg returns the symbol as an SVG document size pixels wide, with a quiet
+// zone of margin modules. Each row's runs of dark modules are one rectangle
+// of the path.
+func (q *qrCode) svg(size, margin int, fg, bg color.NRGBA) []byte {
+	var b strings.Builder
+	side := q.size + 2*margin
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n", size, size, side, side)
+	if bg.A > 0 {
+		fmt.Fprintf(&b, `<rect width="%d" height="%d" %s/>`+"\n", side, side, svgFill(bg))
+	}
+	b.WriteString(`<path d="`)
+	for y := range q.size {
+		for x := 0; x < q.size; x++ {
+			if !q.dark(x, y) {
+				continue
+			}
+			run := 1
+			for x+run < q.size && q.dark(x+run, y) {
+				run++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", x+margin, y+margin, run, run)
+			x += run
+		}
+	}
+	fmt.Fprintf(&b, `" %s/>`+"\n</svg>\n", svgFill(fg))
+	return []byte(b.String())
+}
+
+// svgFill returns the fill attributes for c
+func svgFill(c color.NRGBA) string {
+	fill := fmt.Sprintf(`fill="#%02x%02x%02x"`, c.R, c.G, c.B)
+	if c.A < 0xff {
+		fill += fmt.Sprintf(` fill-opacity="%.3g"`, float64(c.A)/0xff)
+	}
+	return fill
+}
+
+// runQR implements the qr subcommand
+func runQR(args []string) error {
+	fs := flag.NewFlagSet("qr", flag.ExitOnError)
+	outputFile := fs.String("output", "qr.png", "Output file path; the extension selects the format, e.g. .png or .svg")
+	size := fs.Int("size", 512, "Width and height of the image in pixels, including the quiet zone")
+	levelName := fs.String("level", "M", "Error correction level: L (7%), M (15%), Q (25%) or H (30%) of the code may be damaged and still read")
+	margin := fs.Int("margin", qrQuietZone, "Width of the light border around the code in modules. Readers need 4")
+	foregroundHex := fs.String("foreground", "#000000", "Color of the dark modules as #rrggbb")
+	backgroundHex := fs.String("background", "#ffffff", "Background color as #rrggbb, or #rrggbbaa for transparency")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s qr [flags] text\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected the text or URL to encode as the only argument")
+	}
+	level, ok := qrLevels[strings.ToUpper(*levelName)]
+	if !ok {
+		return fmt.Errorf("invalid error correction level %q: expected L, M, Q or H", *levelName)
+	}
+	if *margin < 0 {
+		return fmt.Errorf("margin cannot be negative")
+	}
+	if *size < 1 || *size > maxSizeSide {
+		return fmt.Errorf("size must be between 1 and %d", maxSizeSide)
+	}
+	foreground, err := parseHexColor(*foregroundHex)
+	if err != nil {
+		return err
+	}
+	background, err := parseHexColor(*backgroundHex)
+	if err != nil {
+		return err
+	}
+
+	q, err := encodeQR([]byte(fs.Arg(0)), level)
+	if err != nil {
+		return err
+	}
+	outPath, err := prepareOutputPath("qr", *outputFile)
+	if err != nil {
+		return err
+	}
+	if formatFromExt(outPath) == "svg" {
+		if err := writeFileAtomic(outPath, q.svg(*size, *margin, foreground, background)); err != nil {
+			return fmt.Errorf("failed to write %s: %w", outPath, err)
+		}
+	} else {
+		// Whole pixels per module keep the edges sharp; the rest of the size
+		// is background
+		scale := *size / (q.size + 2**margin)
+		if scale < 1 {
+			return fmt.Errorf("size %d is too small for the %dx%d module code and its margin", *size, q.size, q.size)
+		}
+		img := image.NewNRGBA(image.Rect(0, 0, *size, *size))
+		draw.Draw(img, img.Rect, image.NewUniform(background), image.Point{}, draw.Src)
+		code := q.image(scale, *margin, foreground, background)
+		offset := (*size - code.Rect.Dx()) / 2
+		draw.Draw(img, code.Rect.Add(image.Pt(offset, offset)), code, image.Point{}, draw.Src)
+		if err := saveImage(outPath, img, 0); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("QR code saved", "modules", q.size, "path", outPath)
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log/slog"
+)
+
+const (
+	// ssimWindow is the size of the square windows SSIM compares, and
+	// ssimStep the distance between neighbouring windows
+	ssimWindow = 8
+	ssimStep   = 4
+
+	// autoQualityMin and autoQualityMax bound the JPEG quality -auto-quality
+	// chooses from. The maximum is the quality used without -compress.
+	autoQualityMin = 10
+	autoQualityMax = 95
+)
+
+// ssim returns the mean structural similarity of two luminance planes from 0
+// to 1, as returned by grayLevels, over windows of ssimWindow pixels. 1 means
+// the planes are identical.
+func ssim(a, b []float64, width, height int) float64 {
+	// SSIM's stabilizing constants, for a dynamic range of 1
+	const c1, c2 = 0.01 * 0.01, 0.03 * 0.03
+	win := min(ssimWindow, width, height)
+	if win == 0 {
+		return 1
+	}
+	rows, cols := (height-win)/ssimStep+1, (width-win)/ssimStep+1
+	sums := make([]float64, rows)
+	parallelRows(rows, func(r0, r1 int) {
+		for r := r0; r < r1; r++ {
+			for c := range cols {
+				var sa, sb, saa, sbb, sab float64
+				for y := r * ssimStep; y < r*ssimStep+win; y++ {
+					for x := c * ssimStep; x < c*ssimStep+win; x++ {
+						va, vb := a[y*width+x], b[y*width+x]
+						sa += va
+						sb += vb
+						saa += va * va
+						sbb += vb * vb
+						sab += va * vb
+					}
+				}
+				n := float64(win * win)
+				ma, mb := sa/n, sb/n
+				va, vb, cov := saa/n-ma*ma, sbb/n-mb*mb, sab/n-ma*mb
+				sums[r] += (2*ma*mb + c1) * (2*cov + c2) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			}
+		}
+	})
+	var total float64
+	for _, s := range sums {
+		total += s
+	}
+	return total / float64(rows*cols)
+}
+
+// autoJPEGQuality returns the lowest JPEG quality at which img, once encoded
+// and decoded, has at least the target SSIM to img, found by binary search.
+// Images that miss the target even at autoQualityMax get that quality.
+func autoJPEGQuality(ctx context.Context, img image.Image, target float64) (int, error) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	reference := grayLevels(img)
+	var buf bytes.Buffer
+	measure := func(quality int) (float64, error) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		buf.Reset()
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return 0, fmt.Errorf("failed to encode JPEG: %w", err)
+		}
+		decoded, err := jpeg.Decode(&buf)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode JPEG: %w", err)
+		}
+		return ssim(reference, grayLevels(decoded), width, height), nil
+	}
+
+	lo, hi := autoQualityMin, autoQualityMax
+	score, err := measure(hi)
+	if err != nil {
+		return 0, err
+	}
+	if score < target {
+		slog.Warn("Image does not reach the SSIM target at the highest quality", "ssim", fmt.Sprintf("%.4f", score), "quality", hi)
+		return hi, nil
+	}
+	for lo < hi {
+		mid := (lo + hi) / 2
+		s, err := measure(mid)
+		if err != nil {
+			return 0, err
+		}
+		if s >= target {
+			hi, score = mid, s
+		} else {
+			lo = mid + 1
+		}
+	}
+	slog.Info("Chose JPEG quality", "quality", hi, "ssim", fmt.Sprintf("%.4f", score))
+	return hi, nil
+}
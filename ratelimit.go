@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errRateLimited is returned for requests from a client over its rate limit
+var errRateLimited = errors.New("rate limit exceeded, try again later")
+
+// errOverloaded is returned when every transformation slot is busy and the
+// queue of waiting requests is full
+var errOverloaded = errors.New("server is overloaded, try again later")
+
+// serverLimits bounds the load clients can put on the server: the number of
+// transformations running at once, the number of requests waiting for one,
+// and the rate of requests per client. A nil *serverLimits has no limits.
+type serverLimits struct {
+	slots    chan struct{}
+	maxQueue int64
+	waiting  atomic.Int64
+
+	rate    float64 // requests per second per client, 0 for no limit
+	burst   float64
+	mu      sync.Mutex
+	clients map[string]*tokenBucket
+}
+
+// tokenBucket holds the requests a client may still make right away
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newServerLimits returns limits allowing maxConcurrent transformations with
+// up to maxQueue more waiting, and rate requests per second per client with
+// bursts of up to burst requests
+func newServerLimits(maxConcurrent, maxQueue int, rate float64, burst int) (*serverLimits, error) {
+	if maxConcurrent <= 0 {
+		return nil, errors.New("max-concurrent must be positive")
+	}
+	if maxQueue < 0 || rate < 0 || burst < 1 {
+		return nil, errors.New("max-queue and rate-limit must not be negative, and rate-burst must be at least 1")
+	}
+	return &serverLimits{
+		slots:    make(chan struct{}, maxConcurrent),
+		maxQueue: int64(maxQueue),
+		rate:     rate,
+		burst:    float64(burst),
+		clients:  map[string]*tokenBucket{},
+	}, nil
+}
+
+// clientAddr identifies the client of r by its IP address
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allow reports whether r's client is within its rate limit, taking one
+// request from its bucket if so
+func (l *serverLimits) allow(r *http.Request) bool {
+	if l == nil || l.rate == 0 {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Buckets that have refilled are the same as new ones, so drop them now
+	// and then to keep the map from growing with every client ever seen
+	if len(l.clients) > 10000 {
+		for addr, b := range l.clients {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.clients, addr)
+			}
+		}
+	}
+
+	addr := clientAddr(r)
+	b, ok := l.clients[addr]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[addr] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// acquire waits for a transformation slot, failing with errOverloaded if
+// the queue is full. The returned function releases the slot.
+func (l *serverLimits) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+
+	if l.waiting.Add(1) > l.maxQueue {
+		l.waiting.Add(-1)
+		return nil, errOverloaded
+	}
+	metrics.queued.Add(1)
+	defer func() {
+		l.waiting.Add(-1)
+		metrics.queued.Add(-1)
+	}()
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire
+func (l *serverLimits) release() {
+	<-l.slots
+}
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log/slog"
+	"math"
+	"slices"
+)
+
+// Camera RAW files are TIFF containers (Fujifilm's RAF aside) holding the
+// sensor data next to JPEG previews. DNG raw data is decoded and developed:
+// linearized, white balanced, demosaiced and converted to sRGB. The sensor
+// data of proprietary formats is not documented, so CR2, NEF and the others
+// are read from the largest JPEG the camera embedded, which is full size on
+// most recent models.
+
+// rawExtensions are the extensions of camera RAW inputs, which are written as
+// JPEG unless another format is requested
+var rawExtensions = []string{".dng", ".cr2", ".nef", ".nrw", ".arw", ".pef", ".rw2", ".raf"}
+
+// TIFF and DNG tags read from camera files
+const (
+	tagNewSubfileType         = 0x00fe
+	tagImageWidth             = 0x0100
+	tagImageLength            = 0x0101
+	tagBitsPerSample          = 0x0102
+	tagCompression            = 0x0103
+	tagPhotometric            = 0x0106
+	tagStripOffsets           = 0x0111
+	tagOrientation            = 0x0112
+	tagSamplesPerPixel        = 0x0115
+	tagRowsPerStrip           = 0x0116
+	tagStripByteCounts        = 0x0117
+	tagTileWidth              = 0x0142
+	tagTileLength             = 0x0143
+	tagTileOffsets            = 0x0144
+	tagTileByteCounts         = 0x0145
+	tagSubIFDs                = 0x014a
+	tagPanasonicJPEG          = 0x002e
+	tagCFARepeatPatternDim    = 0x828d
+	tagCFAPattern             = 0x828e
+	tagDNGVersion             = 0xc612
+	tagLinearizationTable     = 0xc618
+	tagBlackLevelRepeatDim    = 0xc619
+	tagBlackLevel             = 0xc61a
+	tagWhiteLevel             = 0xc61d
+	tagDefaultCropOrigin      = 0xc61f
+	tagDefaultCropSize        = 0xc620
+	tagColorMatrix1           = 0xc621
+	tagColorMatrix2           = 0xc622
+	tagAsShotNeutral          = 0xc628
+	tagBaselineExposure       = 0xc62a
+	tagCalibrationIlluminant1 = 0xc65a
+	tagActiveArea             = 0xc68d
+)
+
+// Photometric interpretations of DNG raw data
+const (
+	photometricCFA       = 32803
+	photometricLinearRaw = 34892
+)
+
+// rafMagic starts Fujifilm RAF files
+var rafMagic = []byte("FUJIFILMCCD-RAW")
+
+// rawIFD holds the entries of one IFD of a camera file by tag
+type rawIFD map[uint16]rawEntry
+
+// rawEntry locates the value of an IFD entry
+type rawEntry struct {
+	typ   uint16
+	count int
+	off   int // offset of the value, in the entry or out of line
+}
+
+// rawFile is a TIFF-based camera file with all its IFDs read
+type rawFile struct {
+	*tiffReader
+	ifds []rawIFD // IFD0 first, each IFD followed by its SubIFDs
+}
+
+// parseRawFile reads the IFD chain of a TIFF-based camera file and the
+// SubIFDs of each IFD. Panasonic files use their own magic number in place
+// of TIFF's 42.
+func parseRawFile(data []byte) (*rawFile, error) {
+	t, err := newTIFFReader(data)
+	if err != nil {
+		return nil, errors.New("not a TIFF-based camera file")
+	}
+	if magic, _ := t.u16(2); magic != 42 && magic != 0x55 {
+		return nil, errors.New("not a TIFF-based camera file")
+	}
+	f := &rawFile{tiffReader: t}
+	f.walk(t.firstIFD(), 0, map[int]bool{})
+	if len(f.ifds) == 0 {
+		return nil, errors.New("camera file has no IFD")
+	}
+	return f, nil
+}
+
+// walk reads the chain of IFDs starting at off, descending into SubIFDs
+func (f *rawFile) walk(off, depth int, seen map[int]bool) {
+	for n := 0; off > 0 && n < 16 && !seen[off]; n++ {
+		seen[off] = true
+		entries := f.entries(off)
+		if entries == nil {
+			return
+		}
+		ifd := rawIFD{}
+		for _, e := range entries {
+			tag, _ := f.u16(e)
+			typ, _ := f.u16(e + 2)
+			count, _ := f.u32(e + 4)
+			size := int64(tiffTypeSizes[typ]) * int64(count)
+			if size == 0 {
+				continue
+			}
+			valueOff := int64(e + 8)
+			if size > 4 {
+				o, _ := f.u32(e + 8)
+				valueOff = int64(o)
+			}
+			if valueOff+size > int64(len(f.data)) {
+				continue
+			}
+			ifd[tag] = rawEntry{typ: typ, count: int(count), off: int(valueOff)}
+		}
+		f.ifds = append(f.ifds, ifd)
+		if depth < 3 {
+			for _, sub := range f.ints(ifd, tagSubIFDs) {
+				f.walk(int(sub), depth+1, seen)
+			}
+		}
+		next, _ := f.u32(off + 2 + 12*len(entries))
+		off = int(next)
+	}
+}
+
+// floats returns the values of tag in ifd, whatever their numeric type
+func (f *rawFile) floats(ifd rawIFD, tag uint16) []float64 {
+	e, ok := ifd[tag]
+	if !ok {
+		return nil
+	}
+	values := make([]float64, e.count)
+	for i := range values {
+		p := f.data[e.off+i*tiffTypeSizes[e.typ]:]
+		switch e.typ {
+		case 1, 2, 7:
+			values[i] = float64(p[0])
+		case 6:
+			values[i] = float64(int8(p[0]))
+		case 3:
+			values[i] = float64(f.order.Uint16(p))
+		case 8:
+			values[i] = float64(int16(f.order.Uint16(p)))
+		case 4, 13:
+			values[i] = float64(f.order.Uint32(p))
+		case 9:
+			values[i] = float64(int32(f.order.Uint32(p)))
+		case 5:
+			if den := f.order.Uint32(p[4:]); den != 0 {
+				values[i] = float64(f.order.Uint32(p)) / float64(den)
+			}
+		case 10:
+			if den := int32(f.order.Uint32(p[4:])); den != 0 {
+				values[i] = float64(int32(f.order.Uint32(p))) / float64(den)
+			}
+		case 11:
+			values[i] = float64(math.Float32frombits(f.order.Uint32(p)))
+		case 12:
+			values[i] = math.Float64frombits(f.order.Uint64(p))
+		}
+	}
+	return values
+}
+
+// ints returns the values of tag in ifd as integers
+func (f *rawFile) ints(ifd rawIFD, tag uint16) []int64 {
+	floats := f.floats(ifd, tag)
+	values := make([]int64, len(floats))
+	for i, v := range floats {
+		values[i] = int64(v)
+	}
+	return values
+}
+
+// value returns the first value of tag in ifd, or def if it is missing
+func (f *rawFile) value(ifd rawIFD, tag uint16, def int64) int64 {
+	if values := f.ints(ifd, tag); len(values) > 0 {
+		return values[0]
+	}
+	return def
+}
+
+// slice returns length bytes of the file at off, or nil if they are out of
+// bounds
+func (f *rawFile) slice(off, length int64) []byte {
+	if off < 0 || length <= 0 || off+length > int64(len(f.data)) {
+		return nil
+	}
+	return f.data[off : off+length]
+}
+
+// isCameraRaw reports whether data is a camera RAW file: a RAF, a Panasonic
+// RW2, a CR2, a DNG, or a TIFF holding colour filter array data like NEF,
+// ARW and PEF files. It is checked before decoding, as the TIFF decoder
+// would otherwise claim these files.
+func isCameraRaw(data []byte) bool {
+	if bytes.HasPrefix(data, rafMagic) {
+		return true
+	}
+	if len(data) >= 10 && (string(data[:2]) == "II" || string(data[:2]) == "MM") && string(data[8:10]) == "CR" {
+		return true
+	}
+	f, err := parseRawFile(data)
+	if err != nil {
+		return false
+	}
+	if magic, _ := f.u16(2); magic == 0x55 {
+		return true
+	}
+	for _, ifd := range f.ifds {
+		if _, ok := ifd[tagDNGVersion]; ok {
+			return true
+		}
+		if p := f.value(ifd, tagPhotometric, 0); p == photometricCFA || p == photometricLinearRaw {
+			return true
+		}
+	}
+	return false
+}
+
+// cameraRaw is a camera file ready to be decoded from its DNG raw data or
+// from its largest embedded JPEG
+type cameraRaw struct {
+	dng         *dngRaw // nil unless the file holds DNG raw data that can be decoded
+	dngErr      error   // why DNG raw data cannot be decoded
+	preview     []byte
+	orientation int
+}
+
+// parseCameraRaw finds what can be decoded in a camera file
+func parseCameraRaw(data []byte) (*cameraRaw, error) {
+	if bytes.HasPrefix(data, rafMagic) {
+		return parseRAF(data)
+	}
+	f, err := parseRawFile(data)
+	if err != nil {
+		return nil, err
+	}
+	c := &cameraRaw{preview: f.embeddedJPEG(), orientation: int(f.value(f.ifds[0], tagOrientation, 1))}
+	if _, ok := f.ifds[0][tagDNGVersion]; ok {
+		c.dng, c.dngErr = f.dngRaw()
+	}
+	if c.dng == nil && c.preview == nil {
+		if c.dngErr != nil {
+			return nil, c.dngErr
+		}
+		return nil, errors.New("camera RAW file has no embedded JPEG to decode; only the raw data of DNG files can be decoded")
+	}
+	return c, nil
+}
+
+// parseRAF finds the JPEG preview of a Fujifilm RAF file, whose offset and
+// length follow the header. Its orientation is read from the preview's EXIF.
+func parseRAF(data []byte) (*cameraRaw, error) {
+	if len(data) < 92 {
+		return nil, errors.New("truncated RAF header")
+	}
+	off, length := int64(binary.BigEndian.Uint32(data[84:])), int64(binary.BigEndian.Uint32(data[88:]))
+	if off+length > int64(len(data)) || !bytes.HasPrefix(data[off:], []byte{0xff, 0xd8}) {
+		return nil, errors.New("RAF file has no embedded JPEG to decode")
+	}
+	preview := data[off : off+length]
+	return &cameraRaw{preview: preview, orientation: exifOrientation(readJPEGExif(preview))}, nil
+}
+
+// exifOrientation returns the orientation in IFD0 of an EXIF payload, or 1
+// if it has none
+func exifOrientation(exif []byte) int {
+	t, err := newTIFFReader(exif)
+	if err != nil {
+		return 1
+	}
+	for _, e := range t.entries(t.firstIFD()) {
+		if tag, _ := t.u16(e); tag == tagOrientation {
+			v, _ := t.u16(e + 8)
+			return int(v)
+		}
+	}
+	return 1
+}
+
+// embeddedJPEG returns the largest baseline or progressive JPEG in the file:
+// thumbnails referenced by any IFD, JPEG-compressed single strips and
+// Panasonic's JpgFromRaw. Lossless JPEG raw data is skipped.
+func (f *rawFile) embeddedJPEG() []byte {
+	var best []byte
+	bestPixels := 0
+	for _, ifd := range f.ifds {
+		candidates := [][]byte{f.slice(f.value(ifd, exifTagThumbnailOffset, 0), f.value(ifd, exifTagThumbnailLength, 0))}
+		if c := f.value(ifd, tagCompression, 1); c == 6 || c == 7 {
+			offsets, lengths := f.ints(ifd, tagStripOffsets), f.ints(ifd, tagStripByteCounts)
+			if len(offsets) == 1 && len(lengths) == 1 {
+				candidates = append(candidates, f.slice(offsets[0], lengths[0]))
+			}
+		}
+		if e, ok := ifd[tagPanasonicJPEG]; ok {
+			candidates = append(candidates, f.slice(int64(e.off), int64(e.count*tiffTypeSizes[e.typ])))
+		}
+		for _, candidate := range candidates {
+			if !bytes.HasPrefix(candidate, []byte{0xff, 0xd8}) {
+				continue
+			}
+			config, err := jpeg.DecodeConfig(bytes.NewReader(candidate))
+			if err != nil {
+				continue
+			}
+			if pixels := config.Width * config.Height; pixels > bestPixels {
+				best, bestPixels = candidate, pixels
+			}
+		}
+	}
+	return best
+}
+
+// decode decodes the camera file and turns it upright. DNG files whose raw
+// data fails to decode fall back to their preview.
+func (c *cameraRaw) decode() (image.Image, error) {
+	if c.dng != nil {
+		img, err := c.dng.decode()
+		if err == nil {
+			return orientImage(img, c.orientation), nil
+		}
+		if c.preview == nil {
+			return nil, err
+		}
+		slog.Warn("Failed to decode DNG raw data, using its embedded JPEG", "error", err)
+	} else if c.dngErr != nil {
+		slog.Warn("Cannot decode DNG raw data, using its embedded JPEG", "error", c.dngErr)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(c.preview))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode embedded JPEG: %w", err)
+	}
+	slog.Info("Using embedded JPEG of camera RAW file", "size", fmt.Sprintf("%dx%d", img.Bounds().Dx(), img.Bounds().Dy()))
+	return orientImage(img, c.orientation), nil
+}
+
+// config returns the dimensions decode will return
+func (c *cameraRaw) config() (image.Config, error) {
+	var config image.Config
+	if c.dng != nil {
+		config = image.Config{ColorModel: color.NRGBA64Model, Width: c.dng.crop.Dx(), Height: c.dng.crop.Dy()}
+	} else {
+		var err error
+		if config, err = jpeg.DecodeConfig(bytes.NewReader(c.preview)); err != nil {
+			return config, fmt.Errorf("failed to decode embedded JPEG: %w", err)
+		}
+	}
+	if c.orientation >= 5 && c.orientation <= 8 {
+		config.Width, config.Height = config.Height, config.Width
+	}
+	return config, nil
+}
+
+// decodeCameraRaw decodes a camera RAW file
+func decodeCameraRaw(data []byte) (image.Image, error) {
+	c, err := parseCameraRaw(data)
+	if err != nil {
+		return nil, err
+	}
+	return c.decode()
+}
+
+// decodeCameraRawConfig returns the dimensions of a decoded camera RAW file
+func decodeCameraRawConfig(data []byte) (image.Config, error) {
+	c, err := parseCameraRaw(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return c.config()
+}
+
+// dngRaw is the full-resolution raw image of a DNG file
+type dngRaw struct {
+	f                            *rawFile
+	ifd                          rawIFD
+	width, height, samples, bits int
+	compression                  int64
+	cfa                          [4]int          // colour (0 red, 1 green, 2 blue) of each position of a 2x2 Bayer pattern
+	active                       image.Rectangle // area of the sensor holding image data
+	crop                         image.Rectangle // area kept in the output, relative to active
+}
+
+// dngRaw finds and checks the raw image of a DNG: a colour filter array
+// with a 2x2 Bayer pattern, or linear RGB data, uncompressed or lossless JPEG
+func (f *rawFile) dngRaw() (*dngRaw, error) {
+	var ifd rawIFD
+	for _, candidate := range f.ifds {
+		p := f.value(candidate, tagPhotometric, 0)
+		if f.value(candidate, tagNewSubfileType, 0) == 0 && (p == photometricCFA || p == photometricLinearRaw) {
+			ifd = candidate
+			break
+		}
+	}
+	if ifd == nil {
+		return nil, errors.New("DNG has no full-resolution raw image")
+	}
+	d := &dngRaw{
+		f:           f,
+		ifd:         ifd,
+		width:       int(f.value(ifd, tagImageWidth, 0)),
+		height:      int(f.value(ifd, tagImageLength, 0)),
+		samples:     int(f.value(ifd, tagSamplesPerPixel, 1)),
+		bits:        int(f.value(ifd, tagBitsPerSample, 1)),
+		compression: f.value(ifd, tagCompression, 1),
+	}
+	if d.width < 1 || d.height < 1 || d.width > 1<<16 || d.height > 1<<16 {
+		return nil, fmt.Errorf("invalid DNG raw size %dx%d", d.width, d.height)
+	}
+	if d.compression != 1 && d.compression != 7 {
+		return nil, fmt.Errorf("unsupported DNG compression %d: only uncompressed and lossless JPEG raw data is supported", d.compression)
+	}
+	if d.bits < 1 || d.bits > 16 {
+		return nil, fmt.Errorf("unsupported DNG bit depth %d", d.bits)
+	}
+	if f.value(ifd, tagPhotometric, 0) == photometricCFA {
+		pattern := f.ints(ifd, tagCFAPattern)
+		if d.samples != 1 || !slices.Equal(f.ints(ifd, tagCFARepeatPatternDim), []int64{2, 2}) || len(pattern) != 4 {
+			return nil, errors.New("unsupported DNG colour filter array: only 2x2 Bayer patterns are supported")
+		}
+		for i, c := range pattern {
+			if c < 0 || c > 2 {
+				return nil, errors.New("unsupported DNG colour filter array: only red, green and blue filters are supported")
+			}
+			d.cfa[i] = int(c)
+		}
+	} else if d.samples != 3 {
+		return nil, fmt.Errorf("unsupported linear DNG with %d samples per pixel", d.samples)
+	}
+
+	d.active = image.Rect(0, 0, d.width, d.height)
+	if a := f.ints(ifd, tagActiveArea); len(a) == 4 {
+		if r := image.Rect(int(a[1]), int(a[0]), int(a[3]), int(a[2])).Intersect(d.active); !r.Empty() {
+			d.active = r
+		}
+	}
+	d.crop = image.Rect(0, 0, d.active.Dx(), d.active.Dy())
+	origin, size := f.floats(ifd, tagDefaultCropOrigin), f.floats(ifd, tagDefaultCropSize)
+	if len(origin) == 2 && len(size) == 2 {
+		x, y := int(math.Round(origin[0])), int(math.Round(origin[1]))
+		if r := image.Rect(x, y, x+int(math.Round(size[0])), y+int(math.Round(size[1]))).Intersect(d.crop); !r.Empty() {
+			d.crop = r
+		}
+	}
+	return d, nil
+}
+
+// readSamples reads every strip or tile into one slice of width×height
+// pixels of interleaved samples
+func (d *dngRaw) readSamples() ([]uint16, error) {
+	f, ifd := d.f, d.ifd
+	segWidth, segHeight := d.width, int(f.value(ifd, tagRowsPerStrip, int64(d.height)))
+	offsets, lengths := f.ints(ifd, tagStripOffsets), f.ints(ifd, tagStripByteCounts)
+	if _, tiled := ifd[tagTileOffsets]; tiled {
+		segWidth, segHeight = int(f.value(ifd, tagTileWidth, 0)), int(f.value(ifd, tagTileLength, 0))
+		offsets, lengths = f.ints(ifd, tagTileOffsets), f.ints(ifd, tagTileByteCounts)
+	}
+	if segWidth < 1 || segHeight < 1 {
+		return nil, errors.New("invalid DNG strip or tile size")
+	}
+	across, down := (d.width+segWidth-1)/segWidth, (d.height+segHeight-1)/segHeight
+	if len(offsets) < across*down || len(lengths) < across*down {
+		return nil, errors.New("DNG is missing strips or tiles")
+	}
+
+	out := make([]uint16, d.width*d.height*d.samples)
+	rowLen := segWidth * d.samples
+	for i := 0; i < across*down; i++ {
+		x0, y0 := (i%across)*segWidth, (i/across)*segHeight
+		rows := min(segHeight, d.height-y0)
+		data := f.slice(offsets[i], lengths[i])
+		if data == nil {
+			return nil, fmt.Errorf("DNG strip or tile %d is out of bounds", i)
+		}
+		var values []uint16
+		if d.compression == 7 {
+			lj, err := decodeLosslessJPEG(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode DNG strip or tile %d: %w", i, err)
+			}
+			values = lj.samples
+		} else {
+			var err error
+			if values, err = unpackSamples(data, rowLen, rows, d.bits, f.order); err != nil {
+				return nil, fmt.Errorf("failed to read DNG strip or tile %d: %w", i, err)
+			}
+		}
+		if len(values) < rowLen*rows {
+			return nil, fmt.Errorf("DNG strip or tile %d holds too few samples", i)
+		}
+		for y := 0; y < rows; y++ {
+			n := min(segWidth, d.width-x0) * d.samples
+			copy(out[((y0+y)*d.width+x0)*d.samples:][:n], values[y*rowLen:])
+		}
+	}
+	return out, nil
+}
+
+// unpackSamples reads rows of n samples of the given bit depth, each row
+// starting on a byte boundary. 16-bit samples are in the file's byte order
+// and other depths are packed most significant bit first.
+func unpackSamples(data []byte, n, rows, bits int, order binary.ByteOrder) ([]uint16, error) {
+	rowBytes := (n*bits + 7) / 8
+	if len(data) < rowBytes*rows {
+		return nil, errors.New("truncated raw data")
+	}
+	out := make([]uint16, 0, n*rows)
+	for r := 0; r < rows; r++ {
+		row := data[r*rowBytes : (r+1)*rowBytes]
+		switch bits {
+		case 16:
+			for i := 0; i < n; i++ {
+				out = append(out, order.Uint16(row[2*i:]))
+			}
+		case 8:
+			for _, b := range row {
+				out = append(out, uint16(b))
+			}
+		default:
+			var acc uint32
+			have := 0
+			for _, b := range row {
+				acc = acc<<8 | uint32(b)
+				for have += 8; have >= bits && len(out) < (r+1)*n; {
+					have -= bits
+					out = append(out, uint16(acc>>have&(1<<bits-1)))
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// decode develops the raw image: samples are linearized and scaled between
+// the black and white levels, white balanced with the as-shot neutral,
+// demosaiced bilinearly, converted from camera colours to sRGB with the DNG
+// colour matrix, and cropped to the default crop
+func (d *dngRaw) decode() (image.Image, error) {
+	raw, err := d.readSamples()
+	if err != nil {
+		return nil, err
+	}
+	f, ifd0, spp := d.f, d.f.ifds[0], d.samples
+
+	table := f.ints(d.ifd, tagLinearizationTable)
+	blackRows, blackCols := 1, 1
+	if dim := f.ints(d.ifd, tagBlackLevelRepeatDim); len(dim) == 2 && dim[0] > 0 && dim[1] > 0 {
+		blackRows, blackCols = int(dim[0]), int(dim[1])
+	}
+	black := f.floats(d.ifd, tagBlackLevel)
+	if len(black) != blackRows*blackCols*spp {
+		level := 0.0
+		if len(black) > 0 {
+			level = black[0]
+		}
+		blackRows, blackCols, black = 1, 1, slices.Repeat([]float64{level}, spp)
+	}
+	white := f.floats(d.ifd, tagWhiteLevel)
+	if len(white) == 0 {
+		white = []float64{float64(int(1)<<d.bits - 1)}
+	}
+	for c := range white {
+		if white[c] <= black[c%len(black)] {
+			return nil, fmt.Errorf("invalid DNG white level %g", white[c])
+		}
+	}
+	balance := d.whiteBalance()
+
+	// Scale every sample of the active area to 0-1 and white balance it
+	aw, ah := d.active.Dx(), d.active.Dy()
+	values := make([]float32, aw*ah*spp)
+	parallelRows(ah, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < aw; x++ {
+				for c := 0; c < spp; c++ {
+					v := float64(raw[((d.active.Min.Y+y)*d.width+d.active.Min.X+x)*spp+c])
+					if len(table) > 0 {
+						v = float64(table[min(int(v), len(table)-1)])
+					}
+					b := black[((y%blackRows)*blackCols+x%blackCols)*spp+c]
+					w := white[min(c, len(white)-1)]
+					color := c
+					if spp == 1 {
+						color = d.cfa[(y%2)*2+x%2]
+					}
+					values[(y*aw+x)*spp+c] = float32(min(1, clamp01((v-b)/(w-b))*balance[color]))
+				}
+			}
+		}
+	})
+
+	toSRGB := d.cameraToSRGB()
+	gain := 1.0
+	if exposure := f.floats(ifd0, tagBaselineExposure); len(exposure) > 0 {
+		gain = math.Exp2(exposure[0])
+	}
+	encode := linearToSRGB()
+	img := image.NewNRGBA64(image.Rect(0, 0, d.crop.Dx(), d.crop.Dy()))
+	parallelRows(d.crop.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < d.crop.Dx(); x++ {
+				cam := d.pixel(values, d.crop.Min.X+x, d.crop.Min.Y+y)
+				i := y*img.Stride + 8*x
+				for c := 0; c < 3; c++ {
+					v := clamp01((toSRGB[c][0]*cam[0] + toSRGB[c][1]*cam[1] + toSRGB[c][2]*cam[2]) * gain)
+					s := uint16(encode[int(v*65535+0.5)]*65535 + 0.5)
+					img.Pix[i+2*c], img.Pix[i+2*c+1] = uint8(s>>8), uint8(s)
+				}
+				img.Pix[i+6], img.Pix[i+7] = 0xff, 0xff
+			}
+		}
+	})
+	return img, nil
+}
+
+// pixel returns the camera colour at (x, y) of the active area. For a colour
+// filter array, the colours the photosite lacks are averaged from its
+// neighbours with those filters.
+func (d *dngRaw) pixel(values []float32, x, y int) [3]float64 {
+	aw, ah := d.active.Dx(), d.active.Dy()
+	if d.samples == 3 {
+		i := 3 * (y*aw + x)
+		return [3]float64{float64(values[i]), float64(values[i+1]), float64(values[i+2])}
+	}
+	var sum, count [3]float64
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			nx, ny := x+dx, y+dy
+			if nx < 0 || ny < 0 || nx >= aw || ny >= ah {
+				continue
+			}
+			c := d.cfa[(ny%2)*2+nx%2]
+			sum[c] += float64(values[ny*aw+nx])
+			count[c]++
+		}
+	}
+	var cam [3]float64
+	for c := range cam {
+		if count[c] > 0 {
+			cam[c] = sum[c] / count[c]
+		}
+	}
+	cam[d.cfa[(y%2)*2+x%2]] = float64(values[y*aw+x])
+	return cam
+}
+
+// whiteBalance returns the multiplier of each camera channel, from the
+// as-shot neutral, normalized so that the smallest is 1
+func (d *dngRaw) whiteBalance() [3]float64 {
+	neutral := d.f.floats(d.f.ifds[0], tagAsShotNeutral)
+	if len(neutral) != 3 || slices.Min(neutral) <= 0 {
+		return [3]float64{1, 1, 1}
+	}
+	largest := slices.Max(neutral)
+	return [3]float64{largest / neutral[0], largest / neutral[1], largest / neutral[2]}
+}
+
+// cameraToSRGB returns the matrix from white-balanced camera colours to
+// linear sRGB. The DNG colour matrix, preferably the one calibrated for D65,
+// maps XYZ to camera colours; combined with the sRGB primaries and with its
+// rows normalized so that white stays white, its inverse develops the image.
+// Files without a colour matrix keep their camera colours.
+func (d *dngRaw) cameraToSRGB() [3][3]float64 {
+	identity := [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	f, ifd0 := d.f, d.f.ifds[0]
+	tag := uint16(tagColorMatrix1)
+	if _, ok := ifd0[tagColorMatrix2]; ok && f.value(ifd0, tagCalibrationIlluminant1, 0) != 21 {
+		tag = tagColorMatrix2
+	}
+	m := f.floats(ifd0, tag)
+	if len(m) != 9 {
+		return identity
+	}
+	camXYZ := [3][3]float64{{m[0], m[1], m[2]}, {m[3], m[4], m[5]}, {m[6], m[7], m[8]}}
+	camRGB := mul3x3(camXYZ, srgbD50)
+	for r := range camRGB {
+		sum := camRGB[r][0] + camRGB[r][1] + camRGB[r][2]
+		if sum == 0 {
+			return identity
+		}
+		for c := range camRGB[r] {
+			camRGB[r][c] /= sum
+		}
+	}
+	inv, err := invert3x3(camRGB)
+	if err != nil {
+		return identity
+	}
+	return inv
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"slices"
+	"testing"
+)
+
+// tiffField is an IFD entry of BYTE (1), SHORT (3) or LONG (4) values
+type tiffField struct {
+	tag, typ uint16
+	values   []uint32
+}
+
+// dngFile returns a little-endian DNG whose only IFD holds a width×height
+// Bayer raw image stored as one strip of data, plus the extra fields
+func dngFile(width, height, compression int, data []byte, extra ...tiffField) []byte {
+	fields := append([]tiffField{
+		{tagNewSubfileType, 4, []uint32{0}},
+		{tagImageWidth, 4, []uint32{uint32(width)}},
+		{tagImageLength, 4, []uint32{uint32(height)}},
+		{tagBitsPerSample, 3, []uint32{16}},
+		{tagCompression, 3, []uint32{uint32(compression)}},
+		{tagPhotometric, 3, []uint32{photometricCFA}},
+		{tagStripOffsets, 4, []uint32{8}},
+		{tagSamplesPerPixel, 3, []uint32{1}},
+		{tagRowsPerStrip, 4, []uint32{uint32(height)}},
+		{tagStripByteCounts, 4, []uint32{uint32(len(data))}},
+		{tagCFARepeatPatternDim, 3, []uint32{2, 2}},
+		{tagCFAPattern, 1, []uint32{0, 1, 1, 2}},
+		{tagDNGVersion, 1, []uint32{1, 4, 0, 0}},
+		{tagWhiteLevel, 3, []uint32{4095}},
+	}, extra...)
+	slices.SortFunc(fields, func(a, b tiffField) int { return int(a.tag) - int(b.tag) })
+
+	le := binary.LittleEndian
+	ifd := 8 + len(data) + len(data)%2
+	out := le.AppendUint32([]byte("II*\x00"), uint32(ifd))
+	out = append(out, data...)
+	out = append(out, make([]byte, ifd-len(out))...)
+	out = le.AppendUint16(out, uint16(len(fields)))
+	var values []byte
+	valuesOff := ifd + 2 + 12*len(fields) + 4
+	for _, f := range fields {
+		var v []byte
+		for _, x := range f.values {
+			switch f.typ {
+			case 1:
+				v = append(v, byte(x))
+			case 3:
+				v = le.AppendUint16(v, uint16(x))
+			default:
+				v = le.AppendUint32(v, x)
+			}
+		}
+		out = le.AppendUint16(le.AppendUint16(out, f.tag), f.typ)
+		out = le.AppendUint32(out, uint32(len(f.values)))
+		if len(v) > 4 {
+			out = le.AppendUint32(out, uint32(valuesOff+len(values)))
+			values = append(values, v...)
+		} else {
+			out = append(out, append(v, make([]byte, 4-len(v))...)...)
+		}
+	}
+	out = le.AppendUint32(out, 0)
+	return append(out, values...)
+}
+
+// uncompressedSamples stores samples as little-endian 16-bit values
+func uncompressedSamples(samples []uint16) []byte {
+	var data []byte
+	for _, s := range samples {
+		data = binary.LittleEndian.AppendUint16(data, s)
+	}
+	return data
+}
+
+func TestDecodeDNG(t *testing.T) {
+	samples := ljpegSamples(8, 6, 1, 12)
+	o := ljpegOptions{precision: 12, predictor: 1, table: ljpegShortCodes}
+	files := map[string][]byte{
+		"uncompressed":  dngFile(8, 6, 1, uncompressedSamples(samples)),
+		"lossless JPEG": dngFile(8, 6, 7, encodeLosslessJPEG(samples, 8, 6, 1, o)),
+		// Converters often code two columns as the components of one pixel
+		"two-component lossless JPEG": dngFile(8, 6, 7, encodeLosslessJPEG(samples, 4, 6, 2, o)),
+	}
+
+	var want []byte
+	for _, name := range []string{"uncompressed", "lossless JPEG", "two-component lossless JPEG"} {
+		data := files[name]
+		if !isCameraRaw(data) {
+			t.Fatalf("%s: not recognized as camera RAW", name)
+		}
+		img, err := decodeCameraRaw(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if size := img.Bounds().Size(); size != image.Pt(8, 6) {
+			t.Fatalf("%s: got %v, want 8x6", name, size)
+		}
+		pix := img.(*image.NRGBA64).Pix
+		if want == nil {
+			want = pix
+		} else if !bytes.Equal(pix, want) {
+			t.Errorf("%s: developed image differs from the uncompressed one", name)
+		}
+	}
+}
+
+func TestDecodeDNGGrey(t *testing.T) {
+	// An even exposure without a colour matrix or white balance develops to
+	// the same grey everywhere, and the default crop is applied
+	samples := slices.Repeat([]uint16{2048}, 8*6)
+	data := dngFile(8, 6, 7, encodeLosslessJPEG(samples, 8, 6, 1, ljpegOptions{precision: 12, predictor: 6, table: ljpegLongCodes}),
+		tiffField{tagDefaultCropOrigin, 3, []uint32{1, 1}},
+		tiffField{tagDefaultCropSize, 3, []uint32{6, 4}})
+
+	config, err := decodeCameraRawConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 6 || config.Height != 4 {
+		t.Errorf("config is %dx%d, want 6x4", config.Width, config.Height)
+	}
+	img, err := decodeCameraRaw(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(6, 4) {
+		t.Fatalf("got %v, want 6x4", size)
+	}
+	first := img.At(0, 0)
+	r, g, b, _ := first.RGBA()
+	if r != g || g != b || r < 0x8000 || r > 0xffff {
+		t.Errorf("pixel is %v, want a light grey", first)
+	}
+	for y := range 4 {
+		for x := range 6 {
+			if c := img.At(x, y); c != first {
+				t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, c, first)
+			}
+		}
+	}
+}
+
+func TestDecodeDNGRejectsBadRawData(t *testing.T) {
+	samples := ljpegSamples(8, 6, 1, 12)
+	lj := encodeLosslessJPEG(samples, 8, 6, 1, ljpegOptions{precision: 12, predictor: 1, table: ljpegShortCodes})
+	for name, data := range map[string][]byte{
+		"truncated strip":     dngFile(8, 6, 1, uncompressedSamples(samples)[:50]),
+		"corrupt JPEG":        dngFile(8, 6, 7, append(lj[:20:20], lj[40:]...)),
+		"small JPEG":          dngFile(8, 6, 7, encodeLosslessJPEG(samples[:8*3], 8, 3, 1, ljpegOptions{precision: 12, predictor: 1, table: ljpegShortCodes})),
+		"unsupported codec":   dngFile(8, 6, 8, lj),
+		"huge raw image size": dngFile(1<<17, 6, 7, lj),
+	} {
+		if _, err := decodeCameraRaw(data); err == nil {
+			t.Errorf("%s: decoded without an error", name)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// recipeVersion is the version of the recipe format written by -recipe.
+// replay reads recipes of this version and older.
+const recipeVersion = 1
+
+// recipe records how an output was made, so that the replay subcommand can
+// make it again from a new input
+type recipe struct {
+	Version int               `json:"version"`
+	Source  string            `json:"source"`
+	Options map[string]string `json:"options"`
+	Op      []string          `json:"op,omitempty"`
+	Encoder recipeEncoder     `json:"encoder"`
+}
+
+// recipeEncoder holds the defaults file settings in effect, which the
+// options of a run do not show
+type recipeEncoder struct {
+	JPEGQuality    int    `json:"jpeg-quality"`
+	PNGCompression string `json:"png-compression"`
+	StripMetadata  bool   `json:"strip-metadata"`
+}
+
+// recipeSkipped are the flags not recorded in recipes: where outputs go and
+// the limits of a run, which replay takes from its own command line
+var recipeSkipped = []string{"output", "formats", "fingerprint", "recipe", "compare-output", "in-place", "backup-dir", "frames", "every", "ffmpeg", "pdf-renderer", "op",
+	"threads", "max-pixels", "max-input-bytes", "max-memory", "max-output-pixels", "timeout"}
+
+// recipePath returns the path of the recipe saved next to an output
+func recipePath(outPath string) string {
+	return outPath + ".recipe.json"
+}
+
+// newRecipe records the options of o that differ from their defaults, and
+// the operations it runs, for an output of inputFile written in format
+func (o *processOptions) newRecipe(inputFile, format string) recipe {
+	// Bind a flag set to a copy of o to read its options back as flag values
+	fs := flag.NewFlagSet("recipe", flag.ContinueOnError)
+	opts := addProcessFlags(fs)
+	*opts = *o
+	options := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if !slices.Contains(recipeSkipped, f.Name) && !isOperation(f.Name) && f.Value.String() != f.DefValue {
+			options[f.Name] = f.Value.String()
+		}
+	})
+	maps.Copy(options, o.Operations)
+	if !o.ConvertToIco {
+		options["format"] = format
+	}
+
+	encoder := recipeEncoder{JPEGQuality: siteDefaults.JPEGQuality, StripMetadata: siteDefaults.StripMetadata}
+	for name, level := range pngCompressionLevels {
+		if level == siteDefaults.PNGCompression {
+			encoder.PNGCompression = name
+		}
+	}
+	return recipe{Version: recipeVersion, Source: filepath.Base(inputFile), Options: options, Op: o.OperationSpecs, Encoder: encoder}
+}
+
+// saveRecipe writes the recipe of an output of inputFile next to outPath
+func (o *processOptions) saveRecipe(inputFile, outPath, format string) error {
+	data, err := json.MarshalIndent(o.newRecipe(inputFile, format), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode recipe: %w", err)
+	}
+	if err := writeOutputFile(recipePath(outPath), append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write recipe: %w", err)
+	}
+	return nil
+}
+
+// loadRecipe reads a recipe file written by -recipe
+func loadRecipe(path string) (*recipe, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recipe: %w", err)
+	}
+	var r recipe
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid recipe %s: %w", path, err)
+	}
+	switch {
+	case r.Version < 1:
+		return nil, fmt.Errorf("invalid recipe %s: missing version", path)
+	case r.Version > recipeVersion:
+		return nil, fmt.Errorf("recipe %s has version %d, but this build reads up to version %d: update go-transform", path, r.Version, recipeVersion)
+	}
+	return &r, nil
+}
+
+// apply sets the encoder defaults and the options of the recipe on o,
+// except those given on the command line
+func (r *recipe) apply(o *processOptions, given map[string]bool) error {
+	var errs []error
+	if r.Encoder.JPEGQuality < 1 || r.Encoder.JPEGQuality > 100 {
+		errs = append(errs, fmt.Errorf("encoder jpeg-quality must be between 1 and 100, got %d", r.Encoder.JPEGQuality))
+	}
+	level, ok := pngCompressionLevels[strings.ToLower(r.Encoder.PNGCompression)]
+	if !ok {
+		errs = append(errs, fmt.Errorf("unknown encoder png-compression %q: use none, fast, default or best", r.Encoder.PNGCompression))
+	}
+	siteDefaults = encoderDefaults{JPEGQuality: r.Encoder.JPEGQuality, PNGCompression: level, StripMetadata: r.Encoder.StripMetadata}
+
+	// The recipe leaves out -keep-exif when it matches the defaults file
+	fs := flag.NewFlagSet("recipe", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	opts := addProcessFlags(fs)
+	values := opts.Operations
+	*opts = *o
+	opts.KeepExif = !siteDefaults.StripMetadata
+	for _, name := range slices.Sorted(maps.Keys(r.Options)) {
+		if given[name] {
+			continue
+		}
+		if slices.Contains(recipeSkipped, name) {
+			errs = append(errs, fmt.Errorf("unsupported option %q", name))
+		} else if err := fs.Set(name, r.Options[name]); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %w", r.Options[name], name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	opts.Operations = values
+	opts.OperationSpecs = slices.Clone(r.Op)
+	*o = *opts
+	return nil
+}
+
+// runReplay implements the replay subcommand
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	opts := addCommandFlags(fs, "output", "fingerprint")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] recipe.json image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("replay needs a recipe file written by -recipe")
+	}
+	r, err := loadRecipe(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if err := r.apply(opts, given); err != nil {
+		errs := splitErrors(err)
+		for i, err := range errs {
+			errs[i] = fmt.Errorf("invalid recipe %s: %w", fs.Arg(0), err)
+		}
+		return errors.Join(errs...)
+	}
+	return processCommandInputs(opts, fs.Args()[1:])
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// reportEntry describes one output of a batch run for the -report file
+type reportEntry struct {
+	Input        string `json:"input"`
+	Output       string `json:"output"`
+	Status       string `json:"status"`
+	SourceWidth  int    `json:"source_width,omitempty"`
+	SourceHeight int    `json:"source_height,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	InputBytes   int64  `json:"input_bytes"`
+	OutputBytes  int64  `json:"output_bytes"`
+	SavedBytes   int64  `json:"saved_bytes"`
+	InputSHA256  string `json:"input_sha256"`
+	OutputSHA256 string `json:"output_sha256"`
+
+	// Preview is only made for HTML reports
+	Preview *reportPreview `json:"-"`
+}
+
+// reportPreview holds the before and after thumbnails of an HTML report row,
+// and the SSIM of the output to its input
+type reportPreview struct {
+	Before, After template.URL // data: URLs
+	SSIM          float64
+}
+
+// previewSize is the longest side of the thumbnails of an HTML report
+const previewSize = 240
+
+// reportColumns are the CSV header names, in the order of reportEntry.row
+var reportColumns = []string{
+	"input", "output", "status",
+	"source_width", "source_height", "width", "height",
+	"input_bytes", "output_bytes", "saved_bytes",
+	"input_sha256", "output_sha256",
+}
+
+// row returns the entry's fields as CSV cells
+func (e reportEntry) row() []string {
+	return []string{
+		e.Input, e.Output, e.Status,
+		strconv.Itoa(e.SourceWidth), strconv.Itoa(e.SourceHeight), strconv.Itoa(e.Width), strconv.Itoa(e.Height),
+		strconv.FormatInt(e.InputBytes, 10), strconv.FormatInt(e.OutputBytes, 10), strconv.FormatInt(e.SavedBytes, 10),
+		e.InputSHA256, e.OutputSHA256,
+	}
+}
+
+// newReportEntry describes the output of input. Dimensions are only known
+// for processed images.
+func newReportEntry(input, status string, result processResult) (reportEntry, error) {
+	entry := reportEntry{
+		Input:        input,
+		Output:       result.Output,
+		Status:       status,
+		SourceWidth:  result.SourceWidth,
+		SourceHeight: result.SourceHeight,
+		Width:        result.Width,
+		Height:       result.Height,
+	}
+
+	// Archives and skipped inputs are described from the files on disk; sizes
+	// and checksums of archives in object storage are left out
+	if result.InputSHA256 == "" {
+		var err error
+		if result.InputBytes, result.InputSHA256, err = describeLocalFile(input); err != nil {
+			return entry, err
+		}
+		if result.OutputBytes, result.OutputSHA256, err = describeLocalFile(result.Output); err != nil {
+			return entry, err
+		}
+	}
+
+	entry.InputBytes = result.InputBytes
+	entry.OutputBytes = result.OutputBytes
+	entry.SavedBytes = entry.InputBytes - entry.OutputBytes
+	entry.InputSHA256 = result.InputSHA256
+	entry.OutputSHA256 = result.OutputSHA256
+	return entry, nil
+}
+
+// describeLocalFile returns the size and checksum of a local file, or zero
+// values for objects in object storage
+func describeLocalFile(path string) (int64, string, error) {
+	if isObjectURI(path) {
+		return 0, "", nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	hash, err := hashFile(path)
+	return info.Size(), hash, err
+}
+
+// reportPreviewOf returns the preview of the output of input made with o,
+// comparing it to the backup of an image processed in place, or nil if there
+// is no local image to preview
+func reportPreviewOf(o *processOptions, input, output string) *reportPreview {
+	if isObjectURI(input) || isObjectURI(output) {
+		return nil
+	}
+	before := input
+	if o.InPlace {
+		if backup, err := backupPath(input, o.BackupDir); err == nil {
+			before = backup
+		}
+	}
+	p, err := newReportPreview(before, output)
+	if err != nil {
+		slog.Warn("Could not preview output for the report", "input", input, "error", err)
+		return nil
+	}
+	return p
+}
+
+// newReportPreview decodes the images before and after, turning each upright
+// as its EXIF orientation says, and returns their thumbnails and their SSIM,
+// comparing before scaled to the size of after
+func newReportPreview(before, after string) (*reportPreview, error) {
+	a, err := loadUprightImage(before)
+	if err != nil {
+		return nil, err
+	}
+	b, err := loadUprightImage(after)
+	if err != nil {
+		return nil, err
+	}
+	width, height := b.Bounds().Dx(), b.Bounds().Dy()
+	if a.Bounds().Dx() != width || a.Bounds().Dy() != height {
+		a = scaleImage(a, uint(width), uint(height))
+	}
+	p := &reportPreview{SSIM: ssim(grayLevels(a), grayLevels(b), width, height)}
+	if p.Before, err = thumbnailURL(a); err != nil {
+		return nil, err
+	}
+	if p.After, err = thumbnailURL(b); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// loadUprightImage decodes the image at path, applying its EXIF orientation
+func loadUprightImage(path string) (image.Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return orientImage(img, exifOrientation(readJPEGExif(data))), nil
+}
+
+// thumbnailURL returns a data: URL of img scaled to fit previewSize, as a
+// JPEG, or a PNG if it has transparency
+func thumbnailURL(img image.Image) (template.URL, error) {
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w > previewSize || h > previewSize {
+		if w >= h {
+			img = scaleImage(img, previewSize, 0)
+		} else {
+			img = scaleImage(img, 0, previewSize)
+		}
+	}
+	var buf bytes.Buffer
+	mime := "image/jpeg"
+	if o, ok := img.(interface{ Opaque() bool }); ok && !o.Opaque() {
+		mime = "image/png"
+		if err := png.Encode(&buf, img); err != nil {
+			return "", err
+		}
+	} else if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		return "", err
+	}
+	return template.URL("data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// reportPage is the HTML report of a batch run, a self-contained page for
+// reviewing a preset change with a row of thumbnails per output
+var reportPage = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"percent": func(part, whole int64) string {
+		if whole == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%.1f%%", 100*float64(part)/float64(whole))
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Batch report</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; font-size: 14px; }
+th, td { padding: 6px 10px; border-bottom: 1px solid #ddd; text-align: left; vertical-align: top; }
+td.n { text-align: right; font-variant-numeric: tabular-nums; }
+img { max-width: 240px; max-height: 240px; background: repeating-conic-gradient(#ddd 0 25%, #fff 0 50%) 0 0 / 16px 16px; }
+.low { color: #c0392b; font-weight: bold; }
+.path { font-size: 12px; color: #555; word-break: break-all; max-width: 240px; }
+</style>
+</head>
+<body>
+<h1>Batch report</h1>
+<p>{{len .Entries}} outputs, {{bytes .InputBytes}} before and {{bytes .OutputBytes}} after, saving {{percent .SavedBytes .InputBytes}}.</p>
+<table>
+<thead><tr><th>Before</th><th>After</th><th>Size</th><th>Dimensions</th><th>SSIM</th></tr></thead>
+<tbody>
+{{range .Entries}}<tr>
+<td>{{with .Preview}}<img src="{{.Before}}" alt="">{{end}}<div class="path">{{.Input}}</div></td>
+<td>{{with .Preview}}<img src="{{.After}}" alt="">{{end}}<div class="path">{{.Output}}</div></td>
+<td class="n">{{bytes .InputBytes}} → {{bytes .OutputBytes}}<br>{{percent .SavedBytes .InputBytes}} saved{{if eq .Status "skipped"}}<br>up to date{{end}}</td>
+<td class="n">{{if .Width}}{{.SourceWidth}}×{{.SourceHeight}} → {{.Width}}×{{.Height}}{{end}}</td>
+<td class="n">{{with .Preview}}<span{{if lt .SSIM 0.95}} class="low"{{end}}>{{printf "%.4f" .SSIM}}</span>{{end}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+</body>
+</html>
+`))
+
+// validateReportFormat checks that the report name ends in .json, .csv or .html
+func validateReportFormat(name string) error {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".csv", ".html":
+		return nil
+	default:
+		return fmt.Errorf("unsupported report format %q: use a .json, .csv or .html file name", name)
+	}
+}
+
+// writeReport writes entries to path as JSON, CSV or HTML, depending on its
+// extension
+func writeReport(path string, entries []reportEntry) error {
+	f, err := createAtomic(path)
+	if err != nil {
+		return fmt.Errorf("failed to create report: %w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".html") {
+		page := struct {
+			Entries                             []reportEntry
+			InputBytes, OutputBytes, SavedBytes int64
+		}{Entries: entries}
+		for _, e := range entries {
+			page.InputBytes += e.InputBytes
+			page.OutputBytes += e.OutputBytes
+			page.SavedBytes += e.SavedBytes
+		}
+		if err := reportPage.Execute(f, page); err != nil {
+			f.Abort()
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+		return f.Commit()
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		w := csv.NewWriter(f)
+		w.Write(reportColumns)
+		for _, e := range entries {
+			w.Write(e.row())
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			f.Abort()
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+		return f.Commit()
+	}
+
+	if entries == nil {
+		entries = []reportEntry{}
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(entries); err != nil {
+		f.Abort()
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return f.Commit()
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Credentials are the AWS keys used to sign requests
+type s3Credentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"Token"`
+}
+
+// s3Store talks to Amazon S3, or an S3-compatible service, with requests
+// signed by AWS Signature Version 4
+type s3Store struct {
+	creds    s3Credentials
+	region   string
+	endpoint *url.URL // set for S3-compatible services, which use path-style URLs
+}
+
+// newS3Store loads credentials and the region from the standard AWS
+// environment variables, the shared config files, or the ECS container
+// credentials endpoint
+func newS3Store() (*s3Store, error) {
+	creds, err := loadS3Credentials()
+	if err != nil {
+		return nil, err
+	}
+	s := &s3Store{creds: creds, region: awsRegion()}
+
+	if raw := cmp.Or(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")); raw != "" {
+		if s.endpoint, err = url.Parse(raw); err != nil {
+			return nil, fmt.Errorf("invalid S3 endpoint %q: %w", raw, err)
+		}
+	}
+	return s, nil
+}
+
+// awsProfile returns the name of the selected shared config profile
+func awsProfile() string {
+	return cmp.Or(os.Getenv("AWS_PROFILE"), "default")
+}
+
+// awsRegion returns the region from the environment or the shared config
+// file, defaulting to us-east-1
+func awsRegion() string {
+	if region := cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")); region != "" {
+		return region
+	}
+	section := "profile " + awsProfile()
+	if awsProfile() == "default" {
+		section = "default"
+	}
+	if region := readINISection(awsConfigPath("AWS_CONFIG_FILE", "config"), section)["region"]; region != "" {
+		return region
+	}
+	return "us-east-1"
+}
+
+// awsConfigPath returns the shared AWS file named by env or ~/.aws/name
+func awsConfigPath(env, name string) string {
+	if path := os.Getenv(env); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".aws", name)
+}
+
+// loadS3Credentials looks for credentials in the environment, the shared
+// credentials file and the ECS container credentials endpoint, in that order
+func loadS3Credentials() (s3Credentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return s3Credentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	profile := readINISection(awsConfigPath("AWS_SHARED_CREDENTIALS_FILE", "credentials"), awsProfile())
+	if id := profile["aws_access_key_id"]; id != "" {
+		return s3Credentials{
+			AccessKeyID:     id,
+			SecretAccessKey: profile["aws_secret_access_key"],
+			SessionToken:    profile["aws_session_token"],
+		}, nil
+	}
+
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		endpoint = "http://169.254.170.2" + rel
+	}
+	if endpoint != "" {
+		return fetchContainerCredentials(endpoint)
+	}
+
+	return s3Credentials{}, errors.New("no AWS credentials found: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or configure ~/.aws/credentials")
+}
+
+// fetchContainerCredentials reads temporary credentials from the ECS
+// container credentials endpoint
+func fetchContainerCredentials(endpoint string) (s3Credentials, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("invalid container credentials endpoint: %w", err)
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := storageClient.Do(req)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to fetch container credentials: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkStorageResponse(resp); err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to fetch container credentials: %w", err)
+	}
+
+	var creds s3Credentials
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to parse container credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// readINISection returns the key/value pairs of one [section] of an INI file
+// such as ~/.aws/credentials. A missing file yields no values.
+func readINISection(path, section string) map[string]string {
+	values := map[string]string{}
+	f, err := os.Open(path)
+	if err != nil {
+		return values
+	}
+	defer f.Close()
+
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			current = strings.TrimSpace(line[1 : len(line)-1])
+		case current == section:
+			if key, value, ok := strings.Cut(line, "="); ok {
+				values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	return values
+}
+
+// objectURL returns the URL of an object, virtual-hosted on AWS and
+// path-style on custom endpoints
+func (s *s3Store) objectURL(bucket, key string) *url.URL {
+	if s.endpoint != nil {
+		return &url.URL{
+			Scheme:  s.endpoint.Scheme,
+			Host:    s.endpoint.Host,
+			Path:    "/" + bucket + "/" + key,
+			RawPath: "/" + s3EscapePath(bucket) + "/" + s3EscapePath(key),
+		}
+	}
+	return &url.URL{
+		Scheme:  "https",
+		Host:    bucket + ".s3." + s.region + ".amazonaws.com",
+		Path:    "/" + key,
+		RawPath: "/" + s3EscapePath(key),
+	}
+}
+
+// s3EscapePath percent-encodes everything in path except unreserved
+// characters and slashes, as the SigV4 canonical URI requires
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// do sends a signed request for an object
+func (s *s3Store) do(method, bucket, key string, body []byte, contentType string) (*http.Response, error) {
+	u := s.objectURL(bucket, key)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, u, body, time.Now().UTC())
+	return storageClient.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to req
+func (s *s3Store) sign(req *http.Request, u *url.URL, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": u.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		u.EscapedPath(),
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.creds.SecretAccessKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (s *s3Store) Get(bucket, key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, bucket, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStorageResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) Put(bucket, key string, data []byte, contentType string) error {
+	resp, err := s.do(http.MethodPut, bucket, key, data, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStorageResponse(resp)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Scaler resamples an image to a new size
+type Scaler interface {
+	Scale(src image.Image, width, height int) image.Image
+}
+
+// lanczos3 is the Lanczos kernel with a support of three lobes
+var lanczos3 = &xdraw.Kernel{
+	Support: 3,
+	At: func(t float64) float64 {
+		if t == 0 {
+			return 1
+		}
+		x := math.Pi * t
+		return 3 * math.Sin(x) * math.Sin(x/3) / (x * x)
+	},
+}
+
+// scalers lists the resampling filters selectable with -filter
+var scalers = map[string]Scaler{
+	"lanczos":    kernelScaler{lanczos3},
+	"catmullrom": kernelScaler{xdraw.CatmullRom},
+	"bilinear":   kernelScaler{xdraw.BiLinear},
+	"area":       areaScaler{},
+}
+
+// activeScaler is the scaler used for every resize
+var activeScaler = scalers["lanczos"]
+
+// linearResize makes every resize filter in linear light instead of on the
+// gamma-encoded sRGB values, which darkens fine detail and leaves gray
+// fringes around high-contrast edges
+var linearResize = true
+
+// srgbToLinear maps 16-bit sRGB levels to linear light in the 0-1 range
+var srgbToLinear = sync.OnceValue(func() []float32 {
+	t := make([]float32, 65536)
+	for i := range t {
+		t[i] = float32(srgbCurve{}.linearize(float64(i) / 65535))
+	}
+	return t
+})
+
+// linearToSRGB maps linear light quantised to 16 bits back to sRGB levels in
+// the 0-1 range
+var linearToSRGB = sync.OnceValue(func() []float32 {
+	t := make([]float32, 65536)
+	for i := range t {
+		t[i] = float32(srgbCurve{}.encode(float64(i) / 65535))
+	}
+	return t
+})
+
+// convertPremultipliedRow converts the color channels of premultiplied 0-1
+// values through table, unpremultiplying them first so that translucent
+// pixels are converted like opaque ones
+func convertPremultipliedRow(values, table []float32) {
+	for i := 0; i < len(values); i += 4 {
+		a := values[i+3]
+		if a <= 0 {
+			continue
+		}
+		for c := i; c < i+3; c++ {
+			values[c] = table[int(min(values[c]/a, 1)*65535+0.5)] * a
+		}
+	}
+}
+
+// setScaler selects the scaler used for every resize by name
+func setScaler(name string) error {
+	s, ok := scalers[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(scalers))
+		for n := range scalers {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("unsupported filter %q. Supported filters: %s", name, strings.Join(names, ", "))
+	}
+	activeScaler = s
+	return nil
+}
+
+// scaleImage resizes img to width x height with the active scaler. If either
+// dimension is 0 it is calculated from the other, keeping the aspect ratio.
+func scaleImage(img image.Image, width, height uint) image.Image {
+	bounds := img.Bounds()
+	if bounds.Empty() || width == 0 && height == 0 {
+		return img
+	}
+	if width == 0 {
+		width = max(1, uint(math.Round(float64(bounds.Dx())*float64(height)/float64(bounds.Dy()))))
+	}
+	if height == 0 {
+		height = max(1, uint(math.Round(float64(bounds.Dy())*float64(width)/float64(bounds.Dx()))))
+	}
+	return activeScaler.Scale(img, int(width), int(height))
+}
+
+// kernelScaler resamples with an x/image/draw filter kernel, widened when
+// downscaling so that every source pixel contributes
+type kernelScaler struct {
+	kernel *xdraw.Kernel
+}
+
+func (s kernelScaler) Scale(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	return resample(src, newKernelWeights(bounds.Dx(), width, s.kernel), newKernelWeights(bounds.Dy(), height, s.kernel))
+}
+
+// areaScaler averages the source pixels covered by each destination pixel
+type areaScaler struct{}
+
+func (areaScaler) Scale(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	return resample(src, newAreaWeights(bounds.Dx(), width), newAreaWeights(bounds.Dy(), height))
+}
+
+// resampleWeights lists, for each destination pixel along one axis, the first
+// contributing source pixel and the weights of it and its successors
+type resampleWeights struct {
+	start   []int
+	weights [][]float32
+}
+
+// newKernelWeights computes the weights of kernel k mapping srcSize pixels
+// onto dstSize pixels. Weights are normalised so that edges stay bright.
+func newKernelWeights(srcSize, dstSize int, k *xdraw.Kernel) resampleWeights {
+	scale := float64(srcSize) / float64(dstSize)
+	filterScale := max(scale, 1)
+	support := k.Support * filterScale
+
+	w := resampleWeights{start: make([]int, dstSize), weights: make([][]float32, dstSize)}
+	for d := 0; d < dstSize; d++ {
+		center := (float64(d) + 0.5) * scale
+		first := max(0, int(math.Floor(center-support)))
+		last := min(srcSize-1, int(math.Ceil(center+support)))
+
+		weights := make([]float64, 0, last-first+1)
+		sum := 0.0
+		for s := first; s <= last; s++ {
+			t := math.Abs(float64(s)+0.5-center) / filterScale
+			v := 0.0
+			if t < k.Support {
+				v = k.At(t)
+			}
+			weights = append(weights, v)
+			sum += v
+		}
+		if sum != 0 {
+			for i := range weights {
+				weights[i] /= sum
+			}
+		}
+		w.start[d] = first
+		w.weights[d] = make([]float32, len(weights))
+		for i, v := range weights {
+			w.weights[d][i] = float32(v)
+		}
+	}
+	return w
+}
+
+// newAreaWeights computes the coverage of srcSize pixels mapped onto dstSize
+// pixels
+func newAreaWeights(srcSize, dstSize int) resampleWeights {
+	scale := float64(srcSize) / float64(dstSize)
+	w := resampleWeights{start: make([]int, dstSize), weights: make([][]float32, dstSize)}
+	for d := 0; d < dstSize; d++ {
+		lo := float64(d) * scale
+		hi := min(float64(d+1)*scale, float64(srcSize))
+		first := int(lo)
+		w.start[d] = first
+		for s := first; float64(s) < hi; s++ {
+			overlap := min(hi, float64(s+1)) - max(lo, float64(s))
+			w.weights[d] = append(w.weights[d], float32(overlap/scale))
+		}
+	}
+	return w
+}
+
+// unit8 maps 8-bit channel values to the 0-1 range
+var unit8 = func() (t [256]float32) {
+	for i := range t {
+		t[i] = float32(i) / 255
+	}
+	return t
+}()
+
+// rowReader converts one source row at a time into premultiplied RGBA values,
+// in linear light when linearResize is set
+type rowReader struct {
+	src    image.Image
+	buf8   *image.RGBA
+	buf16  *image.RGBA64
+	values []float32
+}
+
+func newRowReader(src image.Image) *rowReader {
+	width := src.Bounds().Dx()
+	r := &rowReader{src: src, values: make([]float32, 4*width)}
+	if imageDepth(src) == 16 {
+		r.buf16 = image.NewRGBA64(image.Rect(0, 0, width, 1))
+	} else {
+		r.buf8 = image.NewRGBA(image.Rect(0, 0, width, 1))
+	}
+	return r
+}
+
+// read returns the premultiplied channel values of source row y, scaled to 0-1.
+// 8-bit NRGBA rows are premultiplied in floating point, keeping the colors of
+// nearly transparent pixels that 8-bit premultiplied values would round away.
+func (r *rowReader) read(y int) []float32 {
+	sp := image.Pt(r.src.Bounds().Min.X, r.src.Bounds().Min.Y+y)
+	if m, ok := r.src.(*image.NRGBA); ok {
+		pix := m.Pix[m.PixOffset(sp.X, sp.Y):][:len(r.values)]
+		for i := 0; i < len(pix); i += 4 {
+			a := unit8[pix[i+3]]
+			r.values[i], r.values[i+1], r.values[i+2], r.values[i+3] = unit8[pix[i]]*a, unit8[pix[i+1]]*a, unit8[pix[i+2]]*a, a
+		}
+	} else if r.buf16 != nil {
+		draw.Draw(r.buf16, r.buf16.Bounds(), r.src, sp, draw.Src)
+		for i := range r.values {
+			r.values[i] = float32(uint16(r.buf16.Pix[2*i])<<8|uint16(r.buf16.Pix[2*i+1])) / 65535
+		}
+	} else {
+		draw.Draw(r.buf8, r.buf8.Bounds(), r.src, sp, draw.Src)
+		for i, v := range r.buf8.Pix {
+			r.values[i] = unit8[v]
+		}
+	}
+	if linearResize {
+		convertPremultipliedRow(r.values, srgbToLinear())
+	}
+	return r.values
+}
+
+// progressMinPixels is the source size from which resizing shows progress
+const progressMinPixels = 40_000_000
+
+// resample scales src with separable weights. Source rows are converted and
+// filtered horizontally one at a time, and only the rows still needed by the
+// vertical filter are kept, so the full-resolution frame is never copied.
+// Bands of output rows are processed in parallel.
+func resample(src image.Image, xw, yw resampleWeights) image.Image {
+	width, height := len(xw.start), len(yw.start)
+	var dst draw.Image
+	// Translucent results are stored unpremultiplied, like PNG stores them,
+	// so that faint edge pixels keep their color
+	opaque := isOpaqueImage(src)
+	switch r := image.Rect(0, 0, width, height); {
+	case imageDepth(src) == 16 && opaque:
+		dst = image.NewRGBA64(r)
+	case imageDepth(src) == 16:
+		dst = image.NewNRGBA64(r)
+	case opaque:
+		dst = image.NewRGBA(r)
+	default:
+		dst = image.NewNRGBA(r)
+	}
+
+	// Show progress for images large enough to take a noticeable time
+	progress := newProgressBar("Resizing", "rows", 0)
+	if int64(src.Bounds().Dx())*int64(src.Bounds().Dy()) >= progressMinPixels {
+		progress = newProgressBar("Resizing", "rows", height)
+	}
+	defer progress.Finish()
+
+	parallelRows(height, func(y0, y1 int) {
+		reader := newRowReader(src)
+		rows := map[int][]float32{}
+		var spare [][]float32
+
+		// filtered returns source row sy filtered horizontally
+		filtered := func(sy int) []float32 {
+			if row, ok := rows[sy]; ok {
+				return row
+			}
+			var row []float32
+			if n := len(spare); n > 0 {
+				row, spare = spare[n-1], spare[:n-1]
+			} else {
+				row = make([]float32, 4*width)
+			}
+			in := reader.read(sy)
+			for dx := 0; dx < width; dx++ {
+				var r, g, b, a float32
+				s := 4 * xw.start[dx]
+				for _, wx := range xw.weights[dx] {
+					r += in[s] * wx
+					g += in[s+1] * wx
+					b += in[s+2] * wx
+					a += in[s+3] * wx
+					s += 4
+				}
+				row[4*dx], row[4*dx+1], row[4*dx+2], row[4*dx+3] = r, g, b, a
+			}
+			rows[sy] = row
+			return row
+		}
+
+		acc := make([]float32, 4*width)
+		for dy := y0; dy < y1; dy++ {
+			// Recycle rows the remaining output rows no longer need
+			for sy, row := range rows {
+				if sy < yw.start[dy] {
+					spare = append(spare, row)
+					delete(rows, sy)
+				}
+			}
+
+			clear(acc)
+			for i, wy := range yw.weights[dy] {
+				row := filtered(yw.start[dy] + i)
+				for j, v := range row {
+					acc[j] += v * wy
+				}
+			}
+			writePremultipliedRow(dst, dy, acc)
+			progress.Add(1)
+		}
+	})
+
+	if isGrayImage(src) {
+		var gray draw.Image = image.NewGray(dst.Bounds())
+		if imageDepth(src) == 16 {
+			gray = image.NewGray16(dst.Bounds())
+		}
+		drawParallel(gray, gray.Bounds(), dst, image.Point{})
+		return gray
+	}
+	return dst
+}
+
+// writePremultipliedRow stores premultiplied 0-1 values into row y of an RGBA,
+// RGBA64, NRGBA or NRGBA64 image, clamping the overshoot of sharpening
+// filters and encoding linear light back to sRGB when linearResize is set
+func writePremultipliedRow(dst draw.Image, y int, values []float32) {
+	for i := 0; i < len(values); i += 4 {
+		a := min(max(values[i+3], 0), 1)
+		for c := 0; c < 3; c++ {
+			values[i+c] = min(max(values[i+c], 0), a)
+		}
+		values[i+3] = a
+	}
+	if linearResize {
+		convertPremultipliedRow(values, linearToSRGB())
+	}
+
+	switch d := dst.(type) {
+	case *image.RGBA:
+		row := d.Pix[y*d.Stride : y*d.Stride+len(values)]
+		for i, v := range values {
+			row[i] = uint8(v*255 + 0.5)
+		}
+	case *image.RGBA64:
+		row := d.Pix[y*d.Stride : y*d.Stride+2*len(values)]
+		for i, v := range values {
+			c := uint16(v*65535 + 0.5)
+			row[2*i], row[2*i+1] = uint8(c>>8), uint8(c)
+		}
+	case *image.NRGBA:
+		unpremultiply(values)
+		row := d.Pix[y*d.Stride : y*d.Stride+len(values)]
+		for i, v := range values {
+			row[i] = uint8(v*255 + 0.5)
+		}
+	case *image.NRGBA64:
+		unpremultiply(values)
+		row := d.Pix[y*d.Stride : y*d.Stride+2*len(values)]
+		for i, v := range values {
+			c := uint16(v*65535 + 0.5)
+			row[2*i], row[2*i+1] = uint8(c>>8), uint8(c)
+		}
+	}
+}
+
+// unpremultiply divides the color channels of premultiplied 0-1 values by
+// their alpha
+func unpremultiply(values []float32) {
+	for i := 0; i < len(values); i += 4 {
+		if a := values[i+3]; a > 0 {
+			values[i] /= a
+			values[i+1] /= a
+			values[i+2] /= a
+		}
+	}
+}
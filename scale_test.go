@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// logoColor is the color of the logo drawn by transparentLogo
+var logoColor = color.NRGBA{30, 144, 255, 255}
+
+// transparentLogo returns a size x size disc of logoColor with a soft edge,
+// on a transparent border whose pixels are black
+func transparentLogo(size int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	c, r := float64(size)/2, float64(size)*3/8
+	for y := range size {
+		for x := range size {
+			dx, dy := float64(x)+0.5-c, float64(y)+0.5-c
+			// Fade out over the last two pixels of the radius
+			a := min(max((r-math.Hypot(dx, dy))/2, 0), 1)
+			if a > 0 {
+				img.SetNRGBA(x, y, color.NRGBA{logoColor.R, logoColor.G, logoColor.B, uint8(a*255 + 0.5)})
+			}
+		}
+	}
+	return img
+}
+
+// checkEdgeColors fails if a visible pixel of img is darker than logoColor,
+// as it would be if the black of the transparent border bled into the edge,
+// or lighter by more than the ringing of sharpening filters
+func checkEdgeColors(t *testing.T, img image.Image) {
+	t.Helper()
+	diff := func(a, b uint8) bool { return int(a) < int(b)-2 || int(a) > int(b)+12 }
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if p.A == 0 {
+				continue
+			}
+			if diff(p.R, logoColor.R) || diff(p.G, logoColor.G) || diff(p.B, logoColor.B) {
+				t.Fatalf("pixel (%d, %d) with alpha %d is %v, want the logo's %v", x, y, p.A, p, logoColor)
+			}
+		}
+	}
+}
+
+func TestScaleKeepsTransparentEdgeColors(t *testing.T) {
+	for _, linear := range []bool{true, false} {
+		defer func(l bool) { linearResize = l }(linearResize)
+		linearResize = linear
+		logo := transparentLogo(256)
+		small := scaleImage(logo, 48, 48)
+		if _, ok := small.(*image.NRGBA); !ok {
+			t.Fatalf("linear %v: scaling translucent NRGBA gave %T, want *image.NRGBA", linear, small)
+		}
+		checkEdgeColors(t, small)
+	}
+}
+
+func TestTranslucentOutputIsNRGBA(t *testing.T) {
+	small := scaleImage(transparentLogo(256), 64, 64)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, small); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.(*image.NRGBA); !ok {
+		t.Errorf("PNG output decodes as %T, want *image.NRGBA", img)
+	}
+	checkEdgeColors(t, img)
+
+	buf.Reset()
+	if err := EncodeICO(&buf, transparentLogo(512), true); err != nil {
+		t.Fatal(err)
+	}
+	// The icon's PNG follows the 6-byte header and the 16-byte entry
+	img, err = png.Decode(bytes.NewReader(buf.Bytes()[22:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.(*image.NRGBA); !ok {
+		t.Errorf("ICO output decodes as %T, want *image.NRGBA", img)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(256, 256) {
+		t.Errorf("ICO is %v, want 256x256", size)
+	}
+	checkEdgeColors(t, img)
+}
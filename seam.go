@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"math"
+	"slices"
+
+	"github.com/SvnFrs/go-transform/ops"
+)
+
+func init() {
+	ops.RegisterOperation("resize-seam", "Resize to WxH by seam carving, removing or duplicating the least noticeable paths of pixels so the subject keeps its shape, e.g. 1200x400", parseResizeSeam)
+}
+
+// seamCarveOp retargets the image to a new size by seam carving
+type seamCarveOp struct {
+	width, height int
+}
+
+func parseResizeSeam(value string) (Operation, error) {
+	var op seamCarveOp
+	if n, _ := fmt.Sscanf(value, "%dx%d", &op.width, &op.height); n != 2 || op.width < 1 || op.height < 1 {
+		return nil, fmt.Errorf("expected WxH, e.g. 1200x400")
+	}
+	return op, nil
+}
+
+// seamGrid holds the premultiplied pixels of an image row by row, with the
+// energy of each pixel. Rows shrink as seams are removed.
+type seamGrid struct {
+	pix    [][]color.RGBA64
+	energy [][]float64
+	cost   []float64 // reused by findSeam
+}
+
+// newSeamGrid copies img into a grid, transposed if transpose is set so that
+// carving its columns carves the image's rows
+func newSeamGrid(img image.Image, transpose bool) *seamGrid {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if transpose {
+		width, height = height, width
+	}
+	g := &seamGrid{pix: make([][]color.RGBA64, height), energy: make([][]float64, height)}
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			g.pix[y] = make([]color.RGBA64, width)
+			for x := range width {
+				sx, sy := x, y
+				if transpose {
+					sx, sy = y, x
+				}
+				g.pix[y][x] = color.RGBA64Model.Convert(img.At(b.Min.X+sx, b.Min.Y+sy)).(color.RGBA64)
+			}
+		}
+	})
+	for y := range g.pix {
+		g.energy[y] = make([]float64, width)
+		for x := range width {
+			g.updateEnergy(x, y)
+		}
+	}
+	return g
+}
+
+// updateEnergy sets the energy of pixel (x, y) to the sum of the absolute
+// differences between its left and right neighbours and between those above
+// and below it, over all channels. Neighbours beyond the edges repeat the
+// edge pixels.
+func (g *seamGrid) updateEnergy(x, y int) {
+	row := g.pix[y]
+	if x < 0 || x >= len(row) {
+		return
+	}
+	at := func(x, y int) color.RGBA64 {
+		y = min(len(g.pix)-1, max(0, y))
+		return g.pix[y][min(len(g.pix[y])-1, max(0, x))]
+	}
+	diff := func(a, b color.RGBA64) float64 {
+		abs := func(a, b uint16) float64 { return math.Abs(float64(a) - float64(b)) }
+		return abs(a.R, b.R) + abs(a.G, b.G) + abs(a.B, b.B) + abs(a.A, b.A)
+	}
+	g.energy[y][x] = diff(at(x-1, y), at(x+1, y)) + diff(at(x, y-1), at(x, y+1))
+}
+
+// findSeam returns the column of each row of the connected top-to-bottom
+// path with the lowest total energy
+func (g *seamGrid) findSeam() []int {
+	width, height := len(g.pix[0]), len(g.pix)
+	if cap(g.cost) < width*height {
+		g.cost = make([]float64, width*height)
+	}
+	cost := g.cost[:width*height]
+	copy(cost, g.energy[0])
+	for y := 1; y < height; y++ {
+		prev, cur := cost[(y-1)*width:y*width], cost[y*width:(y+1)*width]
+		for x := range width {
+			best := prev[x]
+			if x > 0 {
+				best = min(best, prev[x-1])
+			}
+			if x < width-1 {
+				best = min(best, prev[x+1])
+			}
+			cur[x] = g.energy[y][x] + best
+		}
+	}
+
+	seam := make([]int, height)
+	last := cost[(height-1)*width:]
+	seam[height-1] = slices.Index(last, slices.Min(last))
+	for y := height - 2; y >= 0; y-- {
+		row, x := cost[y*width:(y+1)*width], seam[y+1]
+		best := x
+		for _, nx := range []int{x - 1, x + 1} {
+			if nx >= 0 && nx < width && row[nx] < row[best] {
+				best = nx
+			}
+		}
+		seam[y] = best
+	}
+	return seam
+}
+
+// removeSeam deletes the seam's pixel from every row and updates the
+// energy of the pixels whose neighbours changed
+func (g *seamGrid) removeSeam(seam []int) {
+	for y, x := range seam {
+		g.pix[y] = slices.Delete(g.pix[y], x, x+1)
+		g.energy[y] = slices.Delete(g.energy[y], x, x+1)
+	}
+	// Seams move at most one column per row, so only pixels within two
+	// columns of the seam have new neighbours
+	for y, x := range seam {
+		for nx := x - 2; nx <= x+1; nx++ {
+			g.updateEnergy(nx, y)
+		}
+	}
+}
+
+// carve removes or duplicates seams until the grid is width columns wide.
+// To widen it, the seams that would be removed next are found on a copy,
+// then each is duplicated in place, blended with its right neighbour. At
+// most half the current width is added at a time, so that the same seam is
+// not duplicated over and over.
+func (g *seamGrid) carve(ctx context.Context, width int) error {
+	for len(g.pix[0]) > width {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		g.removeSeam(g.findSeam())
+	}
+	for len(g.pix[0]) < width {
+		current := len(g.pix[0])
+		n := min(width-current, max(1, current/2))
+
+		// Track which original column each pixel of the copy came from
+		work := &seamGrid{pix: make([][]color.RGBA64, len(g.pix)), energy: make([][]float64, len(g.pix))}
+		columns := make([][]int, len(g.pix))
+		for y := range g.pix {
+			work.pix[y] = slices.Clone(g.pix[y])
+			work.energy[y] = slices.Clone(g.energy[y])
+			columns[y] = make([]int, current)
+			for x := range columns[y] {
+				columns[y][x] = x
+			}
+		}
+		duplicate := make([][]bool, len(g.pix))
+		for y := range duplicate {
+			duplicate[y] = make([]bool, current)
+		}
+		for range n {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			seam := work.findSeam()
+			for y, x := range seam {
+				duplicate[y][columns[y][x]] = true
+				columns[y] = slices.Delete(columns[y], x, x+1)
+			}
+			work.removeSeam(seam)
+		}
+
+		for y, row := range g.pix {
+			wide := make([]color.RGBA64, 0, current+n)
+			for x, p := range row {
+				wide = append(wide, p)
+				if duplicate[y][x] {
+					q := row[min(current-1, x+1)]
+					wide = append(wide, color.RGBA64{
+						uint16((uint32(p.R) + uint32(q.R) + 1) / 2), uint16((uint32(p.G) + uint32(q.G) + 1) / 2),
+						uint16((uint32(p.B) + uint32(q.B) + 1) / 2), uint16((uint32(p.A) + uint32(q.A) + 1) / 2),
+					})
+				}
+			}
+			g.pix[y] = wide
+		}
+		for y := range g.pix {
+			g.energy[y] = make([]float64, len(g.pix[y]))
+			for x := range g.pix[y] {
+				g.updateEnergy(x, y)
+			}
+		}
+	}
+	return nil
+}
+
+// image returns the grid as an image, transposed back if transpose is set,
+// of the same kind as like: grey or color, at 8 or 16 bits
+func (g *seamGrid) image(like image.Image, transpose bool) image.Image {
+	width, height := len(g.pix[0]), len(g.pix)
+	if transpose {
+		width, height = height, width
+	}
+	r := image.Rect(0, 0, width, height)
+	out := image.NewRGBA64(r)
+	for y, row := range g.pix {
+		for x, p := range row {
+			if transpose {
+				out.SetRGBA64(y, x, p)
+			} else {
+				out.SetRGBA64(x, y, p)
+			}
+		}
+	}
+	var dst draw.Image
+	switch {
+	case isGrayImage(like) && imageDepth(like) == 16:
+		dst = image.NewGray16(r)
+	case isGrayImage(like):
+		dst = image.NewGray(r)
+	case imageDepth(like) == 16:
+		return out
+	default:
+		dst = image.NewRGBA(r)
+	}
+	drawParallel(dst, r, out, image.Point{})
+	return dst
+}
+
+// outputSize returns the size the image is carved to. Empty images are left
+// as they are.
+func (op seamCarveOp) outputSize(size image.Point) image.Point {
+	if size.X <= 0 || size.Y <= 0 {
+		return size
+	}
+	return image.Pt(op.width, op.height)
+}
+
+// Apply carves the columns first and then the rows
+func (op seamCarveOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	bounds := img.Bounds()
+	if bounds.Empty() || bounds.Dx() == op.width && bounds.Dy() == op.height {
+		return img, nil
+	}
+	if op.width > 4*bounds.Dx() || op.height > 4*bounds.Dy() {
+		return nil, fmt.Errorf("seam carving can enlarge an image at most 4 times, not from %dx%d to %dx%d", bounds.Dx(), bounds.Dy(), op.width, op.height)
+	}
+
+	out := img
+	if op.width != bounds.Dx() {
+		g := newSeamGrid(out, false)
+		if err := g.carve(ctx, op.width); err != nil {
+			return nil, err
+		}
+		out = g.image(img, false)
+	}
+	if op.height != bounds.Dy() {
+		g := newSeamGrid(out, true)
+		if err := g.carve(ctx, op.height); err != nil {
+			return nil, err
+		}
+		out = g.image(img, true)
+	}
+	slog.Info("Carved seams", "from", fmt.Sprintf("%dx%d", bounds.Dx(), bounds.Dy()), "to", fmt.Sprintf("%dx%d", op.width, op.height))
+	return out, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"time"
+)
+
+// requestOptions are the processing flags a client may set per request, and
+// a sidecar file per input. Settings that affect the whole server or read server files are left out.
+var requestOptions = []string{
+	"resize", "max-width", "max-height", "compress", "auto-quality", "format", "to-ico", "auto-resize-ico", "page-size", "dpi", "page", "frame", "density",
+	"dds-format", "mipmaps", "keep-exif", "strip-gps", "reproducible", "icc-convert", "colorspace", "depth", "depth-dither", "background", "remove-background", "bg-color", "bg-tolerance", "use-exif-thumbnail", "dct-scaling", "optimize", "interlace", "colors", "dither", "alpha-threshold", "op",
+}
+
+// parseRequestOptions applies a request's options on top of the server's base
+// options, accepting the flags listed in requestOptions and registered
+// operations
+func parseRequestOptions(base processOptions, options map[string]string) (*processOptions, error) {
+	fs := flag.NewFlagSet("request", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	opts := addProcessFlags(fs)
+	opts.MaxMemory, opts.MaxOutputPixels, opts.Filter, opts.Timeout = base.MaxMemory, base.MaxOutputPixels, base.Filter, base.Timeout
+	// Process-wide settings are copied too, so that cache keys cover them
+	opts.LinearResize, opts.ToneMap, opts.Exposure, opts.Effort, opts.PDFRenderer = base.LinearResize, base.ToneMap, base.Exposure, base.Effort, base.PDFRenderer
+
+	for name, value := range options {
+		if !slices.Contains(requestOptions, name) && !isOperation(name) {
+			return nil, fmt.Errorf("unsupported option %q", name)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for option %s: %w", value, name, err)
+		}
+	}
+	if err := opts.prepare(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "Address to listen on")
+	maxPixels := fs.Int64("max-pixels", 100_000_000, "Reject images with more pixels than this before decoding. 0 means no limit")
+	maxOutputPixels := fs.Int64("max-output-pixels", 100_000_000, "Reject requests that would resize images to more pixels than this. 0 means no limit")
+	maxInputBytes := fs.Int64("max-input-bytes", 64<<20, "Reject images larger than this many bytes")
+	maxMemory := fs.Int64("max-memory", 0, "Memory budget in MB for the full-resolution frame. Larger images are downscaled in strips. 0 means no limit")
+	filter := fs.String("filter", "lanczos", "Resampling filter used for resizing: lanczos, catmullrom, bilinear or area")
+	linear := fs.Bool("linear-resize", true, "Resize in linear light. -linear-resize=false scales the sRGB values directly")
+	toneMap := fs.String("tone-map", "reinhard", "Tone mapping operator for HDR input: reinhard or aces")
+	exposure := fs.Float64("exposure", 0, "Exposure adjustment in stops applied to HDR input before tone mapping")
+	effort := fs.Int("effort", -1, "Encoding effort from 0 (fastest) to 9 (smallest files) for PNG and WebP output and -optimize. -1 keeps each encoder's default")
+	threads := fs.Int("threads", 0, "Number of CPU cores used for resizing and color conversion. 0 uses all cores")
+	pdfRenderer := fs.String("pdf-renderer", "auto", "Program that renders PDF pages: pdftoppm, mutool or gs, or a path to one. auto uses the first installed; none extracts the page's embedded raster image")
+	proxy := fs.Bool("proxy", false, "Serve transformed origin images at /{options}/{origin path}")
+	origin := fs.String("origin", "", "Base URL of the origin server that -proxy fetches source images from")
+	cacheDir := fs.String("cache-dir", "output/cache", "Directory where transformed images are cached. Empty disables the cache")
+	cacheSize := fs.Int64("cache-size", 1024, "Maximum size of the cache in MB; least recently used images are removed beyond it. 0 means no limit")
+	unsigned := fs.Bool("unsigned", false, "Accept -proxy URLs without a signature when no signing secret is set, e.g. for local development")
+	maxAge := fs.Duration("max-age", 7*24*time.Hour, "Cache-Control max-age of -proxy responses")
+	timeout := fs.Duration("timeout", time.Minute, "Maximum time to spend on one request's image, including fetching it from the origin. 0 means no limit")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 30*time.Second, "Time allowed for requests in progress to finish after SIGINT or SIGTERM")
+	maxConcurrent := fs.Int("max-concurrent", runtime.NumCPU(), "Maximum number of images transformed at once")
+	maxQueue := fs.Int("max-queue", 100, "Maximum number of requests waiting for a transformation; further requests fail as overloaded")
+	rateLimit := fs.Float64("rate-limit", 0, "Requests per second allowed per client IP address. 0 means no limit")
+	rateBurst := fs.Int("rate-burst", 10, "Requests a client may make at once before -rate-limit applies")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve [flags]\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	if *maxInputBytes <= 0 {
+		return fmt.Errorf("max-input-bytes must be positive")
+	}
+	// Requests start from the pipeline's defaults, with the server's limits
+	base := *addProcessFlags(flag.NewFlagSet("serve", flag.ContinueOnError))
+	base.MaxPixels, base.MaxInputBytes, base.MaxMemory, base.MaxOutputPixels = *maxPixels, *maxInputBytes, *maxMemory, *maxOutputPixels
+	base.Filter, base.LinearResize, base.Threads, base.Timeout = *filter, *linear, *threads, *timeout
+	base.ToneMap, base.Exposure, base.Effort, base.PDFRenderer = *toneMap, *exposure, *effort, *pdfRenderer
+	if err := base.setup(); err != nil {
+		return err
+	}
+
+	if *cacheDir != "" {
+		cache, err := newDiskCache(*cacheDir, *cacheSize<<20)
+		if err != nil {
+			return err
+		}
+		resultCache = cache
+		slog.Info("Caching transformed images", "dir", *cacheDir, "max_mb", *cacheSize)
+	}
+
+	limits, err := newServerLimits(*maxConcurrent, *maxQueue, *rateLimit, *rateBurst)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/gotransform.v1.Transformer/", &grpcHandler{base: base, maxMessage: *maxInputBytes, limits: limits})
+	mux.Handle("GET /metrics", metrics)
+
+	if *proxy {
+		if *origin == "" {
+			return fmt.Errorf("-proxy requires -origin")
+		}
+		originURL, err := url.Parse(*origin)
+		if err != nil || (originURL.Scheme != "http" && originURL.Scheme != "https") {
+			return fmt.Errorf("invalid origin %q: expected an http or https URL", *origin)
+		}
+		handler := &proxyHandler{base: base, origin: originURL, maxAge: *maxAge, limits: limits}
+		if secret := getenvDeprecated(signingKeyEnv, oldSigningKeyEnv); secret != "" {
+			handler.secret = []byte(secret)
+		} else if !*unsigned {
+			return fmt.Errorf("-proxy requires a signing secret in %s, or -unsigned to accept any URL", signingKeyEnv)
+		}
+		mux.Handle("/", countRequests("proxy", handler))
+		slog.Info("Proxying origin images", "origin", *origin, "signed", handler.secret != nil)
+	}
+
+	// gRPC needs HTTP/2, which clients speak without TLS inside a private network
+	server := &http.Server{Addr: *addr, Handler: mux, Protocols: &http.Protocols{}}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+
+	// On a signal, stop accepting connections and let requests in progress
+	// finish, until -shutdown-timeout or a second signal
+	ctx, stop, release := handleSignals()
+	defer release()
+	shutdown := make(chan error, 1)
+	go func() {
+		<-stop
+		slog.Info("Shutting down; waiting for requests in progress", "timeout", *shutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(ctx, *shutdownTimeout)
+		defer cancel()
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Warn("Abandoning requests in progress", "error", err)
+			err = server.Close()
+		}
+		shutdown <- err
+	}()
+
+	slog.Info("Listening", "addr", *addr, "grpc", "gotransform.v1.Transformer")
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	if err := <-shutdown; err != nil {
+		return fmt.Errorf("failed to shut down: %w", err)
+	}
+	slog.Info("Server stopped")
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"image"
+	"testing"
+)
+
+func TestRequestOutputLimit(t *testing.T) {
+	base := processOptions{Filter: "lanczos", MaxOutputPixels: 1_000_000}
+	for _, options := range []map[string]string{
+		{"size": "65536x65536"},
+		{"resize-seam": "2000x2000"},
+	} {
+		if _, err := parseRequestOptions(base, options); err == nil {
+			t.Errorf("%v passed an output limit of %d pixels", options, base.MaxOutputPixels)
+		}
+	}
+
+	// Sizes that depend on the input are checked when the operation runs
+	opts, err := parseRequestOptions(base, map[string]string{"size": "2000x0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewGray(image.Rect(0, 0, 100, 100))
+	if _, err := applyOperations(context.Background(), img, opts.ops, opts.MaxOutputPixels); err == nil {
+		t.Error("scaling 100x100 to 2000x2000 passed an output limit of 1000000 pixels")
+	}
+	img = image.NewGray(image.Rect(0, 0, 100, 10))
+	out, err := applyOperations(context.Background(), img, opts.ops, opts.MaxOutputPixels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := out.Bounds().Size(); size != image.Pt(2000, 200) {
+		t.Errorf("got %v, want 2000x200", size)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// errInterrupted is returned by runs stopped early by SIGINT or SIGTERM
+var errInterrupted = errors.New("interrupted")
+
+// handleSignals returns a context and a channel for a run that can be
+// interrupted. The first SIGINT or SIGTERM closes stop, asking the run to
+// finish the images in progress and start no new ones. A second one cancels
+// ctx, abandoning those images too. release stops handling signals.
+func handleSignals() (ctx context.Context, stop <-chan struct{}, release func()) {
+	ctx, abort := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Warn("Finishing images in progress; interrupt again to abort them", "signal", sig.String())
+			close(stopped)
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case sig := <-signals:
+			slog.Warn("Aborting images in progress", "signal", sig.String())
+			abort()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, stopped, func() {
+		signal.Stop(signals)
+		abort()
+	}
+}
+
+// stopRequested reports whether stop has been closed
+func stopRequested(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// sidecarSuffix is appended to an input's path to find its sidecar file
+const sidecarSuffix = ".transform.yaml"
+
+// parseSidecar parses the options of a sidecar file: YAML holding a flat
+// mapping of option names to scalar values, such as
+//
+//	crop: 3000x2000+120+0
+//	rotate: 90
+//	compress: 85
+//
+// Comments, blank lines and quoted values are accepted; nested mappings and
+// lists are not.
+func parseSidecar(data []byte) (map[string]string, error) {
+	options := map[string]string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || name != strings.TrimSpace(name) || name == "" {
+			return nil, fmt.Errorf("line %d: expected name: value", i+1)
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case value == "":
+			return nil, fmt.Errorf("line %d: %s has no value; nested mappings and lists are not supported", i+1, name)
+		case len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0]:
+			value = value[1 : len(value)-1]
+		default:
+			// A comment needs a space before it, as in YAML, so that
+			// colors such as #ffffff survive
+			if j := strings.Index(value, " #"); j >= 0 {
+				value = strings.TrimSpace(value[:j])
+			}
+		}
+		if _, dup := options[name]; dup {
+			return nil, fmt.Errorf("line %d: %s is set twice", i+1, name)
+		}
+		options[name] = value
+	}
+	return options, nil
+}
+
+// withSidecar returns o with the options of inputFile's sidecar file applied
+// on top, and the sidecar's path, or o and "" if the input has none
+func (o *processOptions) withSidecar(inputFile string) (*processOptions, string, error) {
+	if isObjectURI(inputFile) {
+		return o, "", nil
+	}
+	path := inputFile + sidecarSuffix
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read sidecar: %w", err)
+	}
+	options, err := parseSidecar(data)
+	if err == nil {
+		o, err = o.withOptions(options)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid sidecar %s: %w", path, err)
+	}
+	slog.Info("Applying sidecar", "path", path, "options", len(options))
+	return o, path, nil
+}
+
+// withOptions returns a copy of o with options applied on top, named like
+// the flags without the dash. Only the options a serve request may set are
+// accepted.
+func (o *processOptions) withOptions(options map[string]string) (*processOptions, error) {
+	if len(options) == 0 {
+		return o, nil
+	}
+	if err := checkOptionNames(options); err != nil {
+		return nil, err
+	}
+
+	// Bind a new flag set to a copy of o, so that only the given options
+	// change
+	fs := flag.NewFlagSet("options", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	opts := addProcessFlags(fs)
+	values := opts.Operations
+	*opts = *o
+	maps.Copy(values, o.Operations)
+	opts.Operations = values
+	opts.OperationSpecs = slices.Clone(o.OperationSpecs)
+	for name, value := range options {
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+		}
+	}
+	if err := opts.prepare(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// checkOptionNames returns an error if options sets one that withOptions
+// does not accept
+func checkOptionNames(options map[string]string) error {
+	for name := range options {
+		if !slices.Contains(requestOptions, name) && !isOperation(name) {
+			return fmt.Errorf("unsupported option %q", name)
+		}
+	}
+	return nil
+}
+
+// applyPreset sets the flags of fs named in a preset file, written in the
+// sidecar format, that were not given on the command line, so that flags
+// override the preset
+func applyPreset(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read preset: %w", err)
+	}
+	options, err := parseSidecar(data)
+	if err == nil {
+		err = checkOptionNames(options)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid preset %s: %w", path, err)
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(options)) {
+		if given[name] {
+			continue
+		}
+		if err := fs.Set(name, options[name]); err != nil {
+			errs = append(errs, fmt.Errorf("invalid preset %s: invalid value %q for %s: %w", path, options[name], name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	slog.Debug("Applied preset", "path", path, "options", len(options))
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// splitRanges returns the rows [start, end) of each chunk of an image of the
+// given height, height rows each apart from the last, with consecutive chunks
+// sharing overlap rows
+func splitRanges(total, height, overlap int) [][2]int {
+	var ranges [][2]int
+	for start := 0; ; start += height - overlap {
+		end := min(start+height, total)
+		ranges = append(ranges, [2]int{start, end})
+		if end == total {
+			return ranges
+		}
+	}
+}
+
+// splitImage writes the chunks of the image at path to output/split/ as
+// name_01.ext, name_02.ext and so on, returning how many it wrote
+func splitImage(ctx context.Context, path string, height, overlap int, ext string, compressLevel int) (int, error) {
+	img, _, err := loadImage(path)
+	if err != nil {
+		return 0, err
+	}
+	bounds := img.Bounds()
+	ranges := splitRanges(bounds.Dy(), height, overlap)
+
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if ext == "" {
+		ext = filepath.Ext(path)
+	}
+	digits := max(2, len(strconv.Itoa(len(ranges))))
+	for i, r := range ranges {
+		chunk, err := cropOp{image.Rect(0, r[0], bounds.Dx(), r[1])}.Apply(ctx, img)
+		if err != nil {
+			return i, err
+		}
+		outPath, err := prepareOutputPath("split", fmt.Sprintf("%s_%0*d%s", base, digits, i+1, ext))
+		if err != nil {
+			return i, err
+		}
+		if err := saveImage(outPath, chunk, compressLevel); err != nil {
+			return i, err
+		}
+		slog.Debug("Saved chunk", "rows", fmt.Sprintf("%d-%d", r[0], r[1]), "path", outPath)
+	}
+	return len(ranges), nil
+}
+
+// runSplit implements the split subcommand
+func runSplit(args []string) error {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	height := fs.Int("split-height", 2000, "Height of each chunk in pixels; the last one holds what is left")
+	overlap := fs.Int("overlap", 0, "Rows repeated at the top of each chunk from the bottom of the one before, so no line of text is cut in half on both")
+	format := fs.String("format", "", "Output format extension, e.g. jpg. Empty keeps the input's")
+	compressLevel := fs.Int("compress", 0, "Compression level (1-100) for the output images. 0 means no compression")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s split [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		return fmt.Errorf("at least one input image is required")
+	}
+	if *height < 1 {
+		return fmt.Errorf("split height must be at least 1")
+	}
+	if *overlap < 0 || *overlap >= *height {
+		return fmt.Errorf("overlap must be at least 0 and less than the split height")
+	}
+	ext := ""
+	if *format != "" {
+		ext = "." + strings.TrimPrefix(strings.ToLower(*format), ".")
+	}
+
+	progress := newProgressBar("Splitting", "images", len(inputs))
+	defer progress.Finish()
+	for _, path := range inputs {
+		chunks, err := splitImage(context.Background(), path, *height, *overlap, ext, *compressLevel)
+		if err != nil {
+			return err
+		}
+		progress.Step("Split image", "file", path, "chunks", chunks)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// spriteFrame is the position of one packed image inside the atlas
+type spriteFrame struct {
+	Name   string `json:"name"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"w"`
+	Height int    `json:"h"`
+
+	img   image.Image
+	index int
+}
+
+// spriteAtlas is the JSON map written next to the atlas image
+type spriteAtlas struct {
+	Image  string        `json:"image"`
+	Width  int           `json:"width"`
+	Height int           `json:"height"`
+	Frames []spriteFrame `json:"frames"`
+}
+
+// nextPowerOfTwo returns the smallest power of two >= n
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// packShelves places frames left to right in rows ("shelves") of the given
+// width, tallest first, and returns the resulting atlas height
+func packShelves(frames []spriteFrame, width, padding int) int {
+	sort.SliceStable(frames, func(i, j int) bool {
+		return frames[i].Height > frames[j].Height
+	})
+
+	x, y, shelfHeight := padding, padding, 0
+	for i := range frames {
+		f := &frames[i]
+		if x+f.Width+padding > width && x > padding {
+			// Start a new shelf
+			y += shelfHeight + padding
+			x = padding
+			shelfHeight = 0
+		}
+		f.X = x
+		f.Y = y
+		x += f.Width + padding
+		if f.Height > shelfHeight {
+			shelfHeight = f.Height
+		}
+	}
+	return y + shelfHeight + padding
+}
+
+// packSprites loads the images and packs them into a single atlas
+func packSprites(paths []string, padding, maxWidth int, powerOfTwo bool) (*image.NRGBA, []spriteFrame, error) {
+	frames := make([]spriteFrame, 0, len(paths))
+	area, widest := 0, 0
+	progress := newProgressBar("Loading sprites", "images", len(paths))
+	defer progress.Finish()
+	for i, path := range paths {
+		img, _, err := loadImage(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		progress.Add(1)
+		b := img.Bounds()
+		name := filepath.Base(path)
+		frames = append(frames, spriteFrame{
+			Name:   strings.TrimSuffix(name, filepath.Ext(name)),
+			Width:  b.Dx(),
+			Height: b.Dy(),
+			img:    img,
+			index:  i,
+		})
+		area += (b.Dx() + padding) * (b.Dy() + padding)
+		if b.Dx() > widest {
+			widest = b.Dx()
+		}
+	}
+
+	uniqueFrameNames(frames)
+	if maxWidth > 0 && widest+2*padding > maxWidth {
+		return nil, nil, fmt.Errorf("the widest image is %d pixels with padding, more than -max-width %d", widest+2*padding, maxWidth)
+	}
+
+	// Aim for a roughly square atlas unless a maximum width is given
+	width := int(math.Ceil(math.Sqrt(float64(area))))
+	if maxWidth > 0 && width > maxWidth {
+		width = maxWidth
+	}
+	if width < widest+2*padding {
+		width = widest + 2*padding
+	}
+	if powerOfTwo {
+		width = nextPowerOfTwo(width)
+		if maxWidth > 0 && width > maxWidth {
+			// The largest power of two within the limit, which the
+			// widest image must fit
+			width /= 2
+			if width < widest+2*padding {
+				return nil, nil, fmt.Errorf("the widest image is %d pixels with padding, more than %d, the largest power of two within -max-width %d", widest+2*padding, width, maxWidth)
+			}
+		}
+	}
+
+	height := packShelves(frames, width, padding)
+	if powerOfTwo {
+		height = nextPowerOfTwo(height)
+	}
+
+	atlas := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for _, f := range frames {
+		b := f.img.Bounds()
+		draw.Draw(atlas, image.Rect(f.X, f.Y, f.X+f.Width, f.Y+f.Height), f.img, b.Min, draw.Src)
+	}
+
+	return atlas, frames, nil
+}
+
+// uniqueName returns name, or name with the first of -2, -3 and so on that
+// makes it unused, and marks the result used
+func uniqueName(name string, used map[string]bool) string {
+	unique := name
+	for n := 2; used[unique]; n++ {
+		unique = fmt.Sprintf("%s-%d", name, n)
+	}
+	used[unique] = true
+	return unique
+}
+
+// uniqueFrameNames numbers the names of frames whose inputs share a base
+// name, in input order, so that each can be told apart in the map
+func uniqueFrameNames(frames []spriteFrame) {
+	used := make(map[string]bool, len(frames))
+	for i := range frames {
+		frames[i].Name = uniqueName(frames[i].Name, used)
+	}
+}
+
+// cssClassName turns a sprite name into a safe CSS class name
+func cssClassName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
+
+// writeSpriteCSS writes a stylesheet with one class per frame
+func writeSpriteCSS(path, imageName string, frames []spriteFrame) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, ".sprite {\n  background-image: url(%q);\n  background-repeat: no-repeat;\n  display: inline-block;\n}\n", imageName)
+	// Names that differ only in case or punctuation are numbered too
+	used := make(map[string]bool, len(frames))
+	for _, f := range frames {
+		fmt.Fprintf(&b, "\n.sprite-%s {\n  background-position: -%dpx -%dpx;\n  width: %dpx;\n  height: %dpx;\n}\n",
+			uniqueName(cssClassName(f.Name), used), f.X, f.Y, f.Width, f.Height)
+	}
+	return writeFileAtomic(path, []byte(b.String()))
+}
+
+// writeSpriteJSON writes the atlas coordinate map as JSON
+func writeSpriteJSON(path string, atlas spriteAtlas) error {
+	data, err := json.MarshalIndent(atlas, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sprite map: %w", err)
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// runSprite implements the sprite subcommand
+func runSprite(args []string) error {
+	fs := flag.NewFlagSet("sprite", flag.ExitOnError)
+	outputFile := fs.String("output", "sprite.png", "Output atlas image file path")
+	mapFormat := fs.String("map", "json", "Coordinate map format: json or css")
+	padding := fs.Int("padding", 1, "Padding between packed images in pixels")
+	maxWidth := fs.Int("max-width", 0, "Maximum atlas width in pixels. 0 picks a roughly square atlas")
+	powerOfTwo := fs.Bool("pot", false, "Round atlas dimensions up to powers of two")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s sprite [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		return fmt.Errorf("at least one input image is required")
+	}
+	if *padding < 0 {
+		return fmt.Errorf("padding cannot be negative")
+	}
+	if *mapFormat != "json" && *mapFormat != "css" {
+		return fmt.Errorf("unsupported map format %q: use json or css", *mapFormat)
+	}
+
+	outPath, err := prepareOutputPath("sprite", *outputFile)
+	if err != nil {
+		return err
+	}
+	mapPath := strings.TrimSuffix(outPath, filepath.Ext(outPath)) + "." + *mapFormat
+	if strings.EqualFold(mapPath, outPath) {
+		return fmt.Errorf("the %s map would overwrite the atlas %s: give -output an image extension such as .png", *mapFormat, outPath)
+	}
+
+	atlas, frames, err := packSprites(inputs, *padding, *maxWidth, *powerOfTwo)
+	if err != nil {
+		return err
+	}
+	if err := saveImage(outPath, atlas, 0); err != nil {
+		return err
+	}
+
+	// Keep the map in input order so it is stable across runs
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i].index < frames[j].index
+	})
+
+	imageName := filepath.Base(outPath)
+	if *mapFormat == "css" {
+		err = writeSpriteCSS(mapPath, imageName, frames)
+	} else {
+		err = writeSpriteJSON(mapPath, spriteAtlas{
+			Image:  imageName,
+			Width:  atlas.Bounds().Dx(),
+			Height: atlas.Bounds().Dy(),
+			Frames: frames,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write sprite map: %w", err)
+	}
+
+	slog.Info("Sprite atlas saved", "images", len(frames), "size", fmt.Sprintf("%dx%d", atlas.Bounds().Dx(), atlas.Bounds().Dy()), "path", outPath, "map", mapPath)
+	return nil
+}
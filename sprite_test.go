@@ -0,0 +1,106 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSpriteInput writes a transparent PNG of the given size to path
+func writeSpriteInput(t *testing.T, path string, width, height int) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, image.NewNRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPackSpritesPowerOfTwoWithinMaxWidth(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a", "b", "c", "d"} {
+		path := filepath.Join(dir, name+".png")
+		writeSpriteInput(t, path, 30, 10)
+		paths = append(paths, path)
+	}
+
+	atlas, _, err := packSprites(paths, 1, 50, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width := atlas.Bounds().Dx(); width != 32 {
+		t.Errorf("atlas is %d wide, want 32, the largest power of two within -max-width 50", width)
+	}
+
+	writeSpriteInput(t, filepath.Join(dir, "wide.png"), 40, 10)
+	if _, _, err := packSprites(append(paths, filepath.Join(dir, "wide.png")), 1, 50, true); err == nil {
+		t.Error("an image wider than the power-of-two width was packed")
+	}
+	if _, _, err := packSprites(append(paths, filepath.Join(dir, "wide.png")), 1, 40, false); err == nil {
+		t.Error("an image wider than -max-width was packed")
+	}
+}
+
+func TestSpriteNamesAreUnique(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a/icon.png", "b/icon.png", "icon-2.png", "Icon.png"} {
+		path := filepath.Join(dir, name)
+		writeSpriteInput(t, path, 4, 4)
+		paths = append(paths, path)
+	}
+	_, frames, err := packSprites(paths, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, f := range frames {
+		if names[f.Name] {
+			t.Errorf("frame name %q is used twice", f.Name)
+		}
+		names[f.Name] = true
+	}
+
+	css := filepath.Join(dir, "sprite.css")
+	if err := writeSpriteCSS(css, "sprite.png", frames); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(css)
+	if err != nil {
+		t.Fatal(err)
+	}
+	classes := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if class, ok := strings.CutSuffix(line, " {"); ok {
+			if classes[class] {
+				t.Errorf("CSS class %s is defined twice", class)
+			}
+			classes[class] = true
+		}
+	}
+	if len(classes) != len(frames)+1 {
+		t.Errorf("got %d CSS classes, want %d", len(classes), len(frames)+1)
+	}
+}
+
+func TestSpriteRejectsMapOverwritingAtlas(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	writeSpriteInput(t, filepath.Join(dir, "a.png"), 4, 4)
+	if err := runSprite([]string{"-quiet", "-output", "sprite.json", filepath.Join(dir, "a.png")}); err == nil {
+		t.Error("an atlas named like its JSON map was written")
+	}
+	if _, err := os.Stat(filepath.Join(outputRoot, "sprite", "sprite.json")); err == nil {
+		t.Error("the atlas was written before the error")
+	}
+}
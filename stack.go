@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// alignMinSide is the smallest side of the coarsest level alignShift searches
+const alignMinSide = 32
+
+// halveLevels averages each 2x2 block of a luminance plane into one value
+func halveLevels(levels []float64, width, height int) ([]float64, int, int) {
+	w, h := width/2, height/2
+	out := make([]float64, w*h)
+	for y := range h {
+		for x := range w {
+			i := 2*y*width + 2*x
+			out[y*w+x] = (levels[i] + levels[i+1] + levels[i+width] + levels[i+width+1]) / 4
+		}
+	}
+	return out, w, h
+}
+
+// shiftCost returns the mean absolute difference between ref and img moved
+// by (dx, dy), so that ref's pixel (x, y) is compared with img's pixel
+// (x+dx, y+dy). Unlike squared differences, it is not thrown off by objects
+// that moved between frames. Shifts that overlap less than a quarter of the
+// planes cost +Inf, so that a small overlap cannot match by chance.
+func shiftCost(ref, img []float64, width, height, dx, dy int) float64 {
+	x0, x1 := max(0, -dx), min(width, width-dx)
+	y0, y1 := max(0, -dy), min(height, height-dy)
+	if (x1-x0)*(y1-y0)*4 < width*height {
+		return math.Inf(1)
+	}
+	var sum float64
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			sum += math.Abs(ref[y*width+x] - img[(y+dy)*width+x+dx])
+		}
+	}
+	return sum / float64((x1-x0)*(y1-y0))
+}
+
+// alignShift returns the translation of at most maxShift pixels that best
+// lines img up with ref, both luminance planes of width x height. The shift
+// is searched in full on a reduced copy of the planes, then refined at each
+// size up to the full one.
+func alignShift(ref, img []float64, width, height, maxShift int) (dx, dy int) {
+	refs, imgs := [][]float64{ref}, [][]float64{img}
+	sizes := []image.Point{{width, height}}
+	for maxShift>>(len(sizes)-1) > 4 && min(sizes[len(sizes)-1].X, sizes[len(sizes)-1].Y) >= 2*alignMinSide {
+		s := sizes[len(sizes)-1]
+		r, w, h := halveLevels(refs[len(refs)-1], s.X, s.Y)
+		m, _, _ := halveLevels(imgs[len(imgs)-1], s.X, s.Y)
+		refs, imgs, sizes = append(refs, r), append(imgs, m), append(sizes, image.Pt(w, h))
+	}
+
+	search := func(level, cx, cy, radius, limit int) (int, int) {
+		best, bx, by := math.Inf(1), cx, cy
+		for y := max(cy-radius, -limit); y <= min(cy+radius, limit); y++ {
+			for x := max(cx-radius, -limit); x <= min(cx+radius, limit); x++ {
+				// Prefer the smallest shift among equal costs
+				if c := shiftCost(refs[level], imgs[level], sizes[level].X, sizes[level].Y, x, y); c < best || c == best && abs(x)+abs(y) < abs(bx)+abs(by) {
+					best, bx, by = c, x, y
+				}
+			}
+		}
+		return bx, by
+	}
+	top := len(sizes) - 1
+	limit := (maxShift + 1<<top - 1) >> top
+	dx, dy = search(top, 0, 0, limit, limit)
+	for level := top - 1; level >= 0; level-- {
+		dx, dy = search(level, 2*dx, 2*dy, 1, (maxShift+1<<level-1)>>level)
+	}
+	return dx, dy
+}
+
+// stackFrames combines frames of the same size into one image, pixel by
+// pixel, taking the mean or the median of each channel. Each frame is read
+// moved by its shift, and frames moved off a pixel leave it out.
+func stackFrames(frames []*image.RGBA64, shifts []image.Point, median bool) *image.RGBA64 {
+	bounds := frames[0].Rect
+	width, height := bounds.Dx(), bounds.Dy()
+	out := image.NewRGBA64(image.Rect(0, 0, width, height))
+	parallelRows(height, func(y0, y1 int) {
+		values := make([]uint16, 0, len(frames))
+		for y := y0; y < y1; y++ {
+			for x := range width {
+				for c := range 4 {
+					values = values[:0]
+					for i, f := range frames {
+						sx, sy := x+shifts[i].X, y+shifts[i].Y
+						if sx < 0 || sy < 0 || sx >= width || sy >= height {
+							continue
+						}
+						p := f.Pix[sy*f.Stride+sx*8+c*2:]
+						values = append(values, uint16(p[0])<<8|uint16(p[1]))
+					}
+					var v uint32
+					switch {
+					case len(values) == 0:
+					case median:
+						slices.Sort(values)
+						n := len(values)
+						v = (uint32(values[(n-1)/2]) + uint32(values[n/2]) + 1) / 2
+					default:
+						var sum uint64
+						for _, value := range values {
+							sum += uint64(value)
+						}
+						v = uint32((sum + uint64(len(values))/2) / uint64(len(values)))
+					}
+					i := y*out.Stride + x*8 + c*2
+					out.Pix[i], out.Pix[i+1] = uint8(v>>8), uint8(v)
+				}
+			}
+		}
+	})
+	return out
+}
+
+// runStack implements the stack subcommand
+func runStack(args []string) error {
+	fs := flag.NewFlagSet("stack", flag.ExitOnError)
+	outputFile := fs.String("output", "stacked.png", "Output image file path")
+	method := fs.String("method", "mean", "How frames are combined: mean, which lowers noise the most, or median, which also removes what appears in only a few frames, such as passers-by")
+	align := fs.Bool("align", false, "Line each frame up with the first before stacking, for handheld or drifting shots. Only shifts are corrected, not rotation")
+	maxShift := fs.Int("max-shift", 64, "With -align, the largest shift in pixels searched for")
+	compressLevel := fs.Int("compress", 0, "Compression level (1-100) for the output image. 0 means no compression")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s stack [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	inputs, err := collectInputs(fs.Args(), "")
+	if err != nil {
+		return err
+	}
+	if len(inputs) < 2 {
+		return errors.New("at least two input images are required")
+	}
+	if *method != "mean" && *method != "median" {
+		return fmt.Errorf("invalid method %q: expected mean or median", *method)
+	}
+	if *maxShift < 0 {
+		return errors.New("max-shift must not be negative")
+	}
+
+	frames := make([]*image.RGBA64, len(inputs))
+	progress := newProgressBar("Loading images", "images", len(inputs))
+	for i, path := range inputs {
+		img, _, err := loadImage(path)
+		if err != nil {
+			progress.Finish()
+			return err
+		}
+		if i > 0 && img.Bounds().Size() != frames[0].Rect.Size() {
+			progress.Finish()
+			return fmt.Errorf("%s is %dx%d, but %s is %dx%d: frames must all be the same size", path,
+				img.Bounds().Dx(), img.Bounds().Dy(), inputs[0], frames[0].Rect.Dx(), frames[0].Rect.Dy())
+		}
+		frames[i] = image.NewRGBA64(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		draw.Draw(frames[i], frames[i].Rect, img, img.Bounds().Min, draw.Src)
+		progress.Step("Loaded image", "file", path, "index", i+1, "total", len(inputs))
+	}
+	progress.Finish()
+
+	shifts := make([]image.Point, len(frames))
+	if *align {
+		width, height := frames[0].Rect.Dx(), frames[0].Rect.Dy()
+		ref := grayLevels(frames[0])
+		for i := 1; i < len(frames); i++ {
+			dx, dy := alignShift(ref, grayLevels(frames[i]), width, height, *maxShift)
+			shifts[i] = image.Pt(dx, dy)
+			slog.Info("Aligned frame", "file", inputs[i], "dx", dx, "dy", dy)
+		}
+	}
+
+	stacked := stackFrames(frames, shifts, *method == "median")
+	outPath, err := prepareOutputPath("stack", *outputFile)
+	if err != nil {
+		return err
+	}
+	if err := saveImage(outPath, stacked, *compressLevel); err != nil {
+		return err
+	}
+
+	slog.Info("Stacked images", "images", len(frames), "method", *method, "size", fmt.Sprintf("%dx%d", stacked.Rect.Dx(), stacked.Rect.Dy()), "path", outPath)
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// stitchImages places images left to right, or top to bottom if vertical,
+// each overlapping the one before by overlap pixels. Across the overlap the
+// new image fades in linearly over the one before, so that differences in
+// exposure between scanner passes leave no seam. The images must be the
+// same size across the strip.
+func stitchImages(images []image.Image, vertical bool, overlap int) (*image.RGBA64, error) {
+	// Lay the images out along the strip as if it were horizontal, so that
+	// length runs along it and breadth across it
+	size := func(img image.Image) (length, breadth int) {
+		if vertical {
+			return img.Bounds().Dy(), img.Bounds().Dx()
+		}
+		return img.Bounds().Dx(), img.Bounds().Dy()
+	}
+	total, breadth := 0, 0
+	for i, img := range images {
+		l, b := size(img)
+		if i == 0 {
+			breadth = b
+		} else if b != breadth {
+			across := "height"
+			if vertical {
+				across = "width"
+			}
+			return nil, fmt.Errorf("image %d has a %s of %d, but the first has %d: stitched images must match across the strip", i+1, across, b, breadth)
+		}
+		if l <= overlap {
+			return nil, fmt.Errorf("image %d is %d pixels long, no longer than the overlap of %d", i+1, l, overlap)
+		}
+		total += l
+	}
+	total -= overlap * (len(images) - 1)
+	if total > maxSizeSide || breadth > maxSizeSide {
+		return nil, fmt.Errorf("the stitched image would be %d pixels long, more than %d", max(total, breadth), maxSizeSide)
+	}
+
+	r := image.Rect(0, 0, total, breadth)
+	if vertical {
+		r = image.Rect(0, 0, breadth, total)
+	}
+	strip := image.NewRGBA64(r)
+	along := 0
+	for i, img := range images {
+		length, _ := size(img)
+		part := image.Rect(along, 0, along+length, breadth)
+		if vertical {
+			part = image.Rect(0, along, breadth, along+length)
+		}
+		src := image.NewRGBA64(part)
+		draw.Draw(src, part, img, img.Bounds().Min, draw.Src)
+
+		fade := overlap
+		if i == 0 {
+			fade = 0
+		}
+		parallelRows(part.Dy(), func(y0, y1 int) {
+			for y := part.Min.Y + y0; y < part.Min.Y+y1; y++ {
+				for x := part.Min.X; x < part.Max.X; x++ {
+					t := x - part.Min.X
+					if vertical {
+						t = y - part.Min.Y
+					}
+					s, d := src.PixOffset(x, y), strip.PixOffset(x, y)
+					if t >= fade {
+						copy(strip.Pix[d:d+8], src.Pix[s:s+8])
+						continue
+					}
+					// Weigh the new image from nearly 0 to nearly 1 across the overlap
+					w := (float64(t) + 0.5) / float64(fade)
+					for c := 0; c < 8; c += 2 {
+						a := float64(uint16(strip.Pix[d+c])<<8 | uint16(strip.Pix[d+c+1]))
+						b := float64(uint16(src.Pix[s+c])<<8 | uint16(src.Pix[s+c+1]))
+						v := uint16(a + (b-a)*w + 0.5)
+						strip.Pix[d+c], strip.Pix[d+c+1] = uint8(v>>8), uint8(v)
+					}
+				}
+			}
+		})
+		along += length - overlap
+	}
+	return strip, nil
+}
+
+// runStitch implements the stitch subcommand
+func runStitch(args []string) error {
+	fs := flag.NewFlagSet("stitch", flag.ExitOnError)
+	outputFile := fs.String("output", "stitched.png", "Output image file path")
+	overlap := fs.Int("overlap", 0, "Number of pixels each image overlaps the one before, blended across")
+	direction := fs.String("direction", "horizontal", "Direction to stitch in: horizontal (left to right) or vertical (top to bottom)")
+	compressLevel := fs.Int("compress", 0, "Compression level (1-100) for the output image. 0 means no compression")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s stitch -overlap pixels [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	inputs := fs.Args()
+	if len(inputs) < 2 {
+		return errors.New("at least two input images are required")
+	}
+	if *overlap < 1 {
+		return errors.New("stitch needs -overlap: the number of pixels the images overlap. Use join for images that do not overlap")
+	}
+	if *direction != "vertical" && *direction != "horizontal" {
+		return fmt.Errorf("invalid direction %q: expected horizontal or vertical", *direction)
+	}
+
+	images := make([]image.Image, len(inputs))
+	progress := newProgressBar("Loading images", "images", len(inputs))
+	for i, path := range inputs {
+		var err error
+		if images[i], _, err = loadImage(path); err != nil {
+			progress.Finish()
+			return err
+		}
+		progress.Step("Loaded image", "file", path, "index", i+1, "total", len(inputs))
+	}
+	progress.Finish()
+
+	strip, err := stitchImages(images, *direction == "vertical", *overlap)
+	if err != nil {
+		return err
+	}
+
+	outPath, err := prepareOutputPath("stitch", *outputFile)
+	if err != nil {
+		return err
+	}
+	if err := saveImage(outPath, strip, *compressLevel); err != nil {
+		return err
+	}
+
+	slog.Info("Stitched images", "images", len(inputs), "size", fmt.Sprintf("%dx%d", strip.Rect.Dx(), strip.Rect.Dy()), "path", outPath)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// objectStore reads and writes objects in a cloud storage bucket
+type objectStore interface {
+	Get(bucket, key string) (io.ReadCloser, error)
+	Put(bucket, key string, data []byte, contentType string) error
+}
+
+// storageClient is the HTTP client used to talk to object storage
+var storageClient = &http.Client{Timeout: 5 * time.Minute}
+
+var (
+	objectStoresMu sync.Mutex
+	objectStores   = map[string]objectStore{}
+)
+
+// isObjectURI reports whether path is an s3:// or gs:// object URI
+func isObjectURI(path string) bool {
+	return strings.HasPrefix(path, "s3://") || strings.HasPrefix(path, "gs://")
+}
+
+// parseObjectURI splits an s3:// or gs:// URI into its scheme, bucket and key
+func parseObjectURI(uri string) (scheme, bucket, key string, err error) {
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok || (scheme != "s3" && scheme != "gs") {
+		return "", "", "", fmt.Errorf("invalid object URI %q: expected s3://bucket/key or gs://bucket/key", uri)
+	}
+	bucket, key, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", "", fmt.Errorf("invalid object URI %q: missing bucket", uri)
+	}
+	return scheme, bucket, key, nil
+}
+
+// storeFor returns the object store for scheme, loading its credentials on
+// first use
+func storeFor(scheme string) (objectStore, error) {
+	objectStoresMu.Lock()
+	defer objectStoresMu.Unlock()
+
+	if store, ok := objectStores[scheme]; ok {
+		return store, nil
+	}
+	var store objectStore
+	var err error
+	if scheme == "s3" {
+		store, err = newS3Store()
+	} else {
+		store, err = newGCSStore()
+	}
+	if err != nil {
+		return nil, err
+	}
+	objectStores[scheme] = store
+	return store, nil
+}
+
+// readObject downloads the object at uri, enforcing inputLimits
+func readObject(uri string) ([]byte, error) {
+	scheme, bucket, key, err := parseObjectURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, fmt.Errorf("invalid object URI %q: missing key", uri)
+	}
+	store, err := storeFor(scheme)
+	if err != nil {
+		return nil, err
+	}
+	body, err := store.Get(bucket, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", uri, err)
+	}
+	defer body.Close()
+
+	data, err := inputLimits.readInput(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", uri, err)
+	}
+	return data, nil
+}
+
+// writeObject uploads data to the object at uri
+func writeObject(uri string, data []byte) error {
+	scheme, bucket, key, err := parseObjectURI(uri)
+	if err != nil {
+		return err
+	}
+	if key == "" || strings.HasSuffix(key, "/") {
+		return fmt.Errorf("invalid object URI %q: missing key", uri)
+	}
+	store, err := storeFor(scheme)
+	if err != nil {
+		return err
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if err := store.Put(bucket, key, data, contentType); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", uri, err)
+	}
+	return nil
+}
+
+// readInputFile reads an input from the local disk or object storage,
+// enforcing inputLimits
+func readInputFile(path string) ([]byte, error) {
+	if isObjectURI(path) {
+		return readObject(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return inputLimits.readInput(file)
+}
+
+// writeOutputFile writes an output to the local disk or object storage
+func writeOutputFile(path string, data []byte) error {
+	if isObjectURI(path) {
+		return writeObject(path, data)
+	}
+	if err := checkOutputPath(path); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// checkStorageResponse turns an unsuccessful response into an error carrying
+// the start of the service's error message
+func checkStorageResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,924 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/SvnFrs/go-transform/ops"
+)
+
+func init() {
+	ops.RegisterOptionalOperation("auto-wb", "Remove color casts: gray-world (the default) balances the average color to grey, white-patch makes the brightest highlights white", parseAutoWB)
+	ops.RegisterOptionalOperation("auto-contrast", "Stretch the levels so the darkest and lightest pixels become black and white, ignoring the given percentage at each end (default 0.5)", parseAutoContrast)
+	ops.RegisterOptionalOperation("equalize", "Spread the luminance evenly over the whole range by histogram equalization", parseEqualize)
+	ops.RegisterOptionalOperation("clahe", "Equalize the luminance of each tile of an NxN grid with limited contrast (CLAHE), given as tiles,clip-limit (default 8,2)", parseCLAHE)
+	ops.RegisterOperation("levels", "Map the black point and white point to 0 and 255, with an optional midtone gamma, e.g. 12,240,1.2", parseLevels)
+	ops.RegisterOperation("curves", "Apply a tone curve through control points given as in,out pairs from 0 to 255, e.g. \"0,0 64,52 192,210 255,255\". Prefix with r:, g: or b: and separate with ; for per-channel curves", parseCurves)
+	ops.RegisterOperation("blur", "Apply a Gaussian blur with the given radius (standard deviation) in pixels, e.g. 8", parseBlur)
+	ops.RegisterOperation("duotone", "Recolor the image through a ramp from a dark to a light color, e.g. #1e3264,#f037a5. A trailing number sets the contrast, e.g. #1e3264,#f037a5,1.4", parseDuotone)
+	ops.RegisterOperation("gradient-map", "Recolor the image through a ramp of two or more colors from shadows to highlights, e.g. #000000,#7b1fa2,#ffd54f. A trailing number sets the contrast", parseGradientMap)
+	ops.RegisterOperation("posterize", "Reduce each color channel to the given number of evenly spaced levels, from 2 to 256, e.g. 4", parsePosterize)
+	ops.RegisterOperation("solarize", "Invert the channel values above a threshold from 0 to 255, like an overexposed print, e.g. 128", parseSolarize)
+	ops.RegisterOperation("vignette", "Darken the edges and corners by a strength from 0 to 1, e.g. 0.4", parseVignette)
+	ops.RegisterOperation("noise", "Add film grain with the given standard deviation in 8-bit levels, e.g. 12", parseNoise)
+	ops.RegisterOperation("pixelate", "Replace each square block of the given size in pixels with its average color, e.g. 16", parsePixelate)
+}
+
+// sampleBuffer gives access to the samples of a premultiplied copy made by
+// newSampleBuffer, scaled to 16 bits
+type sampleBuffer struct {
+	img      image.Image
+	pix      []uint8
+	stride   int
+	channels int  // 1 for grey, 4 for RGBA with alpha last
+	wide     bool // 16-bit samples
+}
+
+// newSampleBuffer copies img into a grey or premultiplied RGBA image of the
+// same depth, at the origin
+func newSampleBuffer(img image.Image) sampleBuffer {
+	return newSampleBufferGray(img, isGrayImage(img))
+}
+
+// newSampleBufferGray is newSampleBuffer choosing between grey and RGBA with
+// gray rather than by img's type
+func newSampleBufferGray(img image.Image, gray bool) sampleBuffer {
+	r := image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy())
+	var dst draw.Image
+	var s sampleBuffer
+	switch {
+	case gray && imageDepth(img) == 16:
+		d := image.NewGray16(r)
+		dst, s = d, sampleBuffer{pix: d.Pix, stride: d.Stride, channels: 1, wide: true}
+	case gray:
+		d := image.NewGray(r)
+		dst, s = d, sampleBuffer{pix: d.Pix, stride: d.Stride, channels: 1}
+	case imageDepth(img) == 16:
+		d := image.NewRGBA64(r)
+		dst, s = d, sampleBuffer{pix: d.Pix, stride: d.Stride, channels: 4, wide: true}
+	default:
+		d := image.NewRGBA(r)
+		dst, s = d, sampleBuffer{pix: d.Pix, stride: d.Stride, channels: 4}
+	}
+	drawParallel(dst, r, img, img.Bounds().Min)
+	s.img = dst
+	return s
+}
+
+// offset returns the position in pix of channel c of pixel (x, y)
+func (s sampleBuffer) offset(x, y, c int) int {
+	if s.wide {
+		return y*s.stride + (x*s.channels+c)*2
+	}
+	return y*s.stride + x*s.channels + c
+}
+
+func (s sampleBuffer) get(x, y, c int) uint32 {
+	i := s.offset(x, y, c)
+	if s.wide {
+		return uint32(s.pix[i])<<8 | uint32(s.pix[i+1])
+	}
+	return uint32(s.pix[i]) * 0x101
+}
+
+func (s sampleBuffer) set(x, y, c int, v uint32) {
+	i := s.offset(x, y, c)
+	if s.wide {
+		s.pix[i], s.pix[i+1] = uint8(v>>8), uint8(v)
+	} else {
+		s.pix[i] = uint8((v*0xff + 0x7fff) / 0xffff)
+	}
+}
+
+// colorChannels returns the number of channels that hold color rather than
+// alpha
+func (s sampleBuffer) colorChannels() int {
+	return min(s.channels, 3)
+}
+
+// alpha returns the alpha of pixel (x, y), which bounds its premultiplied
+// color samples
+func (s sampleBuffer) alpha(x, y int) uint32 {
+	if s.channels == 1 {
+		return 0xffff
+	}
+	return s.get(x, y, 3)
+}
+
+// toneOp maps each color channel through a lookup table of 16-bit values
+type toneOp struct {
+	luts [3][]uint16 // red, green and blue
+}
+
+// perChannel reports whether the channels have different tables, which
+// turns greyscale images into color
+func (op toneOp) perChannel() bool {
+	return !slices.Equal(op.luts[0], op.luts[1]) || !slices.Equal(op.luts[0], op.luts[2])
+}
+
+// Apply maps the unpremultiplied samples, keeping transparency
+func (op toneOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	s := newSampleBufferGray(img, isGrayImage(img) && !op.perChannel())
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := range width {
+				a := s.alpha(x, y)
+				if a == 0 {
+					continue
+				}
+				for c := range s.colorChannels() {
+					v := min(0xffff, (s.get(x, y, c)*0xffff+a/2)/a)
+					s.set(x, y, c, (uint32(op.luts[c][v])*a+0x7fff)/0xffff)
+				}
+			}
+		}
+	})
+	return s.img, nil
+}
+
+// newToneLUT tabulates fn, which maps levels from 0 to 1, at 16 bits
+func newToneLUT(fn func(v float64) float64) []uint16 {
+	lut := make([]uint16, 0x10000)
+	for i := range lut {
+		lut[i] = uint16(math.Round(min(1, max(0, fn(float64(i)/0xffff))) * 0xffff))
+	}
+	return lut
+}
+
+// forEachSample calls fn with the unpremultiplied 16-bit color samples of
+// every pixel of s that is not fully transparent. Grey samples are repeated
+// for red, green and blue.
+func (s sampleBuffer) forEachSample(fn func(rgb [3]uint32)) {
+	b := s.img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			a := s.alpha(x, y)
+			if a == 0 {
+				continue
+			}
+			var rgb [3]uint32
+			for c := range 3 {
+				rgb[c] = min(0xffff, (s.get(x, y, min(c, s.channels-1))*0xffff+a/2)/a)
+			}
+			fn(rgb)
+		}
+	}
+}
+
+// percentile returns the lowest value of a histogram with at least fraction
+// p of the counts at or below it
+func percentile(hist []int, total int, p float64) int {
+	target, seen := int(math.Ceil(p*float64(total))), 0
+	for v, n := range hist {
+		if seen += n; seen >= max(1, target) {
+			return v
+		}
+	}
+	return len(hist) - 1
+}
+
+// autoWBOp scales the color channels to neutralize a color cast
+type autoWBOp struct {
+	whitePatch bool
+}
+
+func parseAutoWB(value string) (Operation, error) {
+	switch strings.ToLower(value) {
+	case "true", "gray-world":
+		return autoWBOp{}, nil
+	case "white-patch":
+		return autoWBOp{whitePatch: true}, nil
+	}
+	return nil, fmt.Errorf("expected gray-world or white-patch")
+}
+
+// Apply measures each channel and scales it by a gain of 0.5 to 2. Gray
+// world makes the channel means equal, leaving out clipped pixels and those
+// near black. White patch matches the 99.5th percentiles of the channels to
+// the highest of them, so that specular highlights are not decisive.
+func (op autoWBOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	if isGrayImage(img) {
+		return img, nil
+	}
+	s := newSampleBuffer(img)
+	var level [3]float64
+	if op.whitePatch {
+		var hist [3][]int
+		for c := range hist {
+			hist[c] = make([]int, 0x10000)
+		}
+		total := 0
+		s.forEachSample(func(rgb [3]uint32) {
+			for c, v := range rgb {
+				hist[c][v]++
+			}
+			total++
+		})
+		for c := range level {
+			level[c] = float64(percentile(hist[c], total, 0.995))
+		}
+	} else {
+		var sum [3]float64
+		s.forEachSample(func(rgb [3]uint32) {
+			if mx, mn := max(rgb[0], rgb[1], rgb[2]), min(rgb[0], rgb[1], rgb[2]); mx >= 0xfa00 || mn < 0x0500 {
+				return
+			}
+			for c, v := range rgb {
+				sum[c] += float64(v)
+			}
+		})
+		level = sum
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if level[0] == 0 || level[1] == 0 || level[2] == 0 {
+		slog.Info("Skipped white balance, too few usable pixels")
+		return img, nil
+	}
+
+	method, target := "gray-world", (level[0]+level[1]+level[2])/3
+	if op.whitePatch {
+		method, target = "white-patch", max(level[0], level[1], level[2])
+	}
+	var tone toneOp
+	var gains [3]string
+	for c := range level {
+		gain := min(2, max(0.5, target/level[c]))
+		tone.luts[c] = newToneLUT(func(v float64) float64 { return v * gain })
+		gains[c] = strconv.FormatFloat(gain, 'f', 3, 64)
+	}
+	slog.Info("Balanced white", "method", method, "gains", strings.Join(gains[:], ","))
+	return tone.Apply(ctx, img)
+}
+
+// autoContrastOp stretches the luminance range to black and white
+type autoContrastOp struct {
+	clip float64 // percent of pixels allowed to clip at each end
+}
+
+func parseAutoContrast(value string) (Operation, error) {
+	if value == "true" {
+		return autoContrastOp{0.5}, nil
+	}
+	clip, err := strconv.ParseFloat(value, 64)
+	if err != nil || clip < 0 || clip >= 50 {
+		return nil, fmt.Errorf("expected a percentage of pixels to clip at each end from 0 to below 50, e.g. 0.5")
+	}
+	return autoContrastOp{clip}, nil
+}
+
+// Apply finds the luminance below and above which the clip percentage of
+// pixels lie, and maps those levels to black and white in every channel
+// alike, so that hues do not shift
+func (op autoContrastOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	hist := make([]int, 0x10000)
+	total := 0
+	newSampleBuffer(img).forEachSample(func(rgb [3]uint32) {
+		hist[(299*rgb[0]+587*rgb[1]+114*rgb[2]+500)/1000]++
+		total++
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	black := float64(percentile(hist, total, op.clip/100)) / 0xffff
+	white := float64(percentile(hist, total, 1-op.clip/100)) / 0xffff
+	if total == 0 || white <= black {
+		slog.Info("Skipped contrast stretch, the image has a single tone")
+		return img, nil
+	}
+	lut := newToneLUT(func(v float64) float64 { return (v - black) / (white - black) })
+	slog.Info("Stretched contrast", "black", math.Round(black*2550)/10, "white", math.Round(white*2550)/10)
+	return toneOp{[3][]uint16{lut, lut, lut}}.Apply(ctx, img)
+}
+
+// luminance returns the luminance from 0 to 1 of every pixel of s, row by
+// row, or -1 for fully transparent pixels
+func (s sampleBuffer) luminance() []float32 {
+	width, height := s.img.Bounds().Dx(), s.img.Bounds().Dy()
+	lum := make([]float32, width*height)
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := range width {
+				a := s.alpha(x, y)
+				if a == 0 {
+					lum[y*width+x] = -1
+					continue
+				}
+				l := float64(s.get(x, y, 0))
+				if s.channels > 1 {
+					l = 0.299*float64(s.get(x, y, 0)) + 0.587*float64(s.get(x, y, 1)) + 0.114*float64(s.get(x, y, 2))
+				}
+				lum[y*width+x] = float32(min(1, l/float64(a)))
+			}
+		}
+	})
+	return lum
+}
+
+// mapLuminance changes the luminance of every pixel of s to fn(i, l), where
+// i is its index in lum and l its luminance from lum. The change is added to
+// every color channel, which keeps the chroma as in YCbCr.
+func (s sampleBuffer) mapLuminance(lum []float32, fn func(i int, l float64) float64) {
+	width, height := s.img.Bounds().Dx(), s.img.Bounds().Dy()
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := range width {
+				i := y*width + x
+				if lum[i] < 0 {
+					continue
+				}
+				a := float64(s.alpha(x, y))
+				delta := (fn(i, float64(lum[i])) - float64(lum[i])) * a
+				for c := range s.colorChannels() {
+					s.set(x, y, c, uint32(min(a, max(0, math.Round(float64(s.get(x, y, c))+delta)))))
+				}
+			}
+		}
+	})
+}
+
+// equalizeBins is the number of histogram bins equalization works with
+const equalizeBins = 256
+
+// equalizeLUT returns the cumulative distribution of hist scaled to 0-1 at
+// the upper edge of each bin, starting from the first occupied bin
+func equalizeLUT(hist []float64) []float64 {
+	var total, first float64
+	for _, n := range hist {
+		if first == 0 {
+			first = n
+		}
+		total += n
+	}
+	lut := make([]float64, len(hist))
+	var seen float64
+	for i, n := range hist {
+		seen += n
+		if total > first {
+			lut[i] = max(0, (seen-first)/(total-first))
+		}
+	}
+	return lut
+}
+
+// lookupEqualized interpolates lut, from equalizeLUT, at luminance l
+func lookupEqualized(lut []float64, l float64) float64 {
+	p := l*float64(len(lut)) - 1
+	i := int(math.Floor(p))
+	if i < 0 {
+		return lut[0] * (p + 1)
+	}
+	if i >= len(lut)-1 {
+		return lut[len(lut)-1]
+	}
+	return lut[i] + (lut[i+1]-lut[i])*(p-float64(i))
+}
+
+// equalizeOp equalizes the histogram of the whole image's luminance
+type equalizeOp struct{}
+
+func parseEqualize(value string) (Operation, error) {
+	if value != "true" {
+		return nil, fmt.Errorf("takes no value")
+	}
+	return equalizeOp{}, nil
+}
+
+func (equalizeOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	s := newSampleBuffer(img)
+	lum := s.luminance()
+	hist := make([]float64, equalizeBins)
+	for _, l := range lum {
+		if l >= 0 {
+			hist[min(equalizeBins-1, int(l*equalizeBins))]++
+		}
+	}
+	lut := equalizeLUT(hist)
+	s.mapLuminance(lum, func(_ int, l float64) float64 { return lookupEqualized(lut, l) })
+	return s.img, nil
+}
+
+// claheOp equalizes the luminance of each tile of a grid, clipping the
+// tiles' histograms to limit the contrast, and blends between neighbouring
+// tiles
+type claheOp struct {
+	tiles int     // tiles across and down
+	clip  float64 // maximum bin count as a multiple of the mean
+}
+
+func parseCLAHE(value string) (Operation, error) {
+	op := claheOp{8, 2}
+	if value == "true" {
+		return op, nil
+	}
+	tiles, clip, hasClip := strings.Cut(value, ",")
+	var err error
+	if op.tiles, err = strconv.Atoi(tiles); err != nil || op.tiles < 1 || op.tiles > 64 {
+		return nil, fmt.Errorf("expected a number of tiles from 1 to 64 and an optional clip limit, e.g. 8,2")
+	}
+	if hasClip {
+		if op.clip, err = strconv.ParseFloat(clip, 64); err != nil || op.clip < 1 {
+			return nil, fmt.Errorf("expected a clip limit of at least 1, e.g. 8,2")
+		}
+	}
+	return op, nil
+}
+
+// Apply builds a clipped equalization table for every tile, spreading the
+// clipped counts over all bins, and maps each pixel by interpolating the
+// tables of the four tiles whose centres surround it
+func (op claheOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	s := newSampleBuffer(img)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	tilesX, tilesY := min(op.tiles, width), min(op.tiles, height)
+	lum := s.luminance()
+
+	luts := make([][]float64, tilesX*tilesY)
+	parallelRows(tilesY, func(t0, t1 int) {
+		for ty := t0; ty < t1; ty++ {
+			for tx := range tilesX {
+				hist := make([]float64, equalizeBins)
+				var total float64
+				for y := ty * height / tilesY; y < (ty+1)*height/tilesY; y++ {
+					for x := tx * width / tilesX; x < (tx+1)*width/tilesX; x++ {
+						if l := lum[y*width+x]; l >= 0 {
+							hist[min(equalizeBins-1, int(l*equalizeBins))]++
+							total++
+						}
+					}
+				}
+				limit := max(1, op.clip*total/equalizeBins)
+				var excess float64
+				for i, n := range hist {
+					if n > limit {
+						excess += n - limit
+						hist[i] = limit
+					}
+				}
+				for i := range hist {
+					hist[i] += excess / equalizeBins
+				}
+				// Clipped tables are not stretched to black and white, which
+				// keeps flat tiles flat
+				lut := make([]float64, equalizeBins)
+				var seen float64
+				for i, n := range hist {
+					seen += n
+					if total > 0 {
+						lut[i] = seen / total
+					}
+				}
+				luts[ty*tilesX+tx] = lut
+			}
+		}
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Tile centres sit at (t+0.5)*size/tiles
+	s.mapLuminance(lum, func(i int, l float64) float64 {
+		fx := (float64(i%width)+0.5)*float64(tilesX)/float64(width) - 0.5
+		fy := (float64(i/width)+0.5)*float64(tilesY)/float64(height) - 0.5
+		x0, y0 := int(math.Floor(fx)), int(math.Floor(fy))
+		wx, wy := fx-float64(x0), fy-float64(y0)
+		at := func(tx, ty int) float64 {
+			tx, ty = min(tilesX-1, max(0, tx)), min(tilesY-1, max(0, ty))
+			return lookupEqualized(luts[ty*tilesX+tx], l)
+		}
+		top := at(x0, y0)*(1-wx) + at(x0+1, y0)*wx
+		bottom := at(x0, y0+1)*(1-wx) + at(x0+1, y0+1)*wx
+		return top*(1-wy) + bottom*wy
+	})
+	return s.img, nil
+}
+
+func parseLevels(value string) (Operation, error) {
+	parts := strings.Split(value, ",")
+	nums := []float64{0, 0, 1}
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || i >= len(nums) {
+			nums = nil
+			break
+		}
+		nums[i] = v
+	}
+	if len(parts) < 2 || nums == nil {
+		return nil, fmt.Errorf("expected a black point, a white point and an optional gamma, e.g. 12,240,1.2")
+	}
+	black, white, gamma := nums[0], nums[1], nums[2]
+	if black < 0 || white > 255 || black >= white || gamma <= 0 || gamma > 10 {
+		return nil, fmt.Errorf("expected 0 <= black point < white point <= 255 and a gamma above 0 and up to 10")
+	}
+	lut := newToneLUT(func(v float64) float64 {
+		// Gamma above 1 brightens the midtones, as in most editors
+		return math.Pow(max(0, v*255-black)/(white-black), 1/gamma)
+	})
+	return toneOp{[3][]uint16{lut, lut, lut}}, nil
+}
+
+func parseCurves(value string) (Operation, error) {
+	var op toneOp
+	for _, spec := range strings.Split(value, ";") {
+		channels, points := "rgb", spec
+		if name, rest, ok := strings.Cut(spec, ":"); ok {
+			channels, points = strings.ToLower(strings.TrimSpace(name)), rest
+		}
+		curve, err := parseCurvePoints(points)
+		if err != nil {
+			return nil, err
+		}
+		lut := newToneLUT(curve)
+		switch channels {
+		case "rgb":
+			op.luts = [3][]uint16{lut, lut, lut}
+		case "r", "red":
+			op.luts[0] = lut
+		case "g", "green":
+			op.luts[1] = lut
+		case "b", "blue":
+			op.luts[2] = lut
+		default:
+			return nil, fmt.Errorf("unknown channel %q: use rgb, r, g or b", channels)
+		}
+	}
+	for c := range op.luts {
+		if op.luts[c] == nil {
+			op.luts[c] = newToneLUT(func(v float64) float64 { return v })
+		}
+	}
+	return op, nil
+}
+
+// parseCurvePoints parses space-separated in,out control points from 0 to
+// 255 and returns the monotone cubic curve through them, which does not
+// overshoot between points. Levels beyond the first and last points keep
+// their outputs.
+func parseCurvePoints(spec string) (func(v float64) float64, error) {
+	var xs, ys []float64
+	for _, field := range strings.Fields(spec) {
+		in, out, _ := strings.Cut(field, ",")
+		x, err1 := strconv.ParseFloat(in, 64)
+		y, err2 := strconv.ParseFloat(out, 64)
+		if err1 != nil || err2 != nil || x < 0 || x > 255 || y < 0 || y > 255 {
+			return nil, fmt.Errorf("invalid control point %q: expected in,out from 0 to 255", field)
+		}
+		if len(xs) > 0 && x/255 <= xs[len(xs)-1] {
+			return nil, fmt.Errorf("control points must be in increasing order of input level")
+		}
+		xs, ys = append(xs, x/255), append(ys, y/255)
+	}
+	if len(xs) < 2 {
+		return nil, fmt.Errorf("expected at least two control points, e.g. \"0,0 128,150 255,255\"")
+	}
+
+	// Fritsch-Carlson tangents
+	n := len(xs)
+	slopes := make([]float64, n-1)
+	for i := range slopes {
+		slopes[i] = (ys[i+1] - ys[i]) / (xs[i+1] - xs[i])
+	}
+	tangents := make([]float64, n)
+	tangents[0], tangents[n-1] = slopes[0], slopes[n-2]
+	for i := 1; i < n-1; i++ {
+		if slopes[i-1]*slopes[i] > 0 {
+			tangents[i] = (slopes[i-1] + slopes[i]) / 2
+		}
+	}
+	for i, m := range slopes {
+		if m == 0 {
+			tangents[i], tangents[i+1] = 0, 0
+			continue
+		}
+		a, b := tangents[i]/m, tangents[i+1]/m
+		if h := math.Hypot(a, b); h > 3 {
+			tangents[i], tangents[i+1] = 3*a/h*m, 3*b/h*m
+		}
+	}
+
+	return func(v float64) float64 {
+		if v <= xs[0] {
+			return ys[0]
+		}
+		if v >= xs[n-1] {
+			return ys[n-1]
+		}
+		i, _ := slices.BinarySearch(xs, v)
+		i = max(0, i-1)
+		h := xs[i+1] - xs[i]
+		t := (v - xs[i]) / h
+		// Cubic Hermite basis
+		return (2*t*t*t-3*t*t+1)*ys[i] + (t*t*t-2*t*t+t)*h*tangents[i] + (-2*t*t*t+3*t*t)*ys[i+1] + (t*t*t-t*t)*h*tangents[i+1]
+	}, nil
+}
+
+// blurOp applies a Gaussian blur
+type blurOp struct {
+	sigma float64
+}
+
+func parseBlur(value string) (Operation, error) {
+	sigma, err := strconv.ParseFloat(value, 64)
+	if err != nil || sigma <= 0 || sigma > 1000 {
+		return nil, fmt.Errorf("expected a radius above 0 and up to 1000 pixels")
+	}
+	return blurOp{sigma}, nil
+}
+
+// gaussianKernel returns the normalized weights of a Gaussian with standard
+// deviation sigma, from -3 sigma to 3 sigma
+func gaussianKernel(sigma float64) []float64 {
+	radius := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// Apply blurs the rows and then the columns of the premultiplied samples,
+// repeating the edge pixels beyond the image
+func (op blurOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	s := newSampleBuffer(img)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	kernel := gaussianKernel(op.sigma)
+	radius := len(kernel) / 2
+	rows := make([]float32, width*height*s.channels)
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := range width {
+				for c := range s.channels {
+					var v float64
+					for k, w := range kernel {
+						v += w * float64(s.get(min(width-1, max(0, x+k-radius)), y, c))
+					}
+					rows[(y*width+x)*s.channels+c] = float32(v)
+				}
+			}
+		}
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := range width {
+				for c := range s.channels {
+					var v float64
+					for k, w := range kernel {
+						v += w * float64(rows[(min(height-1, max(0, y+k-radius))*width+x)*s.channels+c])
+					}
+					s.set(x, y, c, uint32(min(0xffff, math.Round(v))))
+				}
+			}
+		}
+	})
+	return s.img, nil
+}
+
+// gradientMapOp replaces each pixel's color with the color at its luminance
+// on a ramp through evenly spaced stops
+type gradientMapOp struct {
+	stops    []color.NRGBA // from shadows to highlights
+	contrast float64       // 1 maps luminance as it is
+}
+
+func parseDuotone(value string) (Operation, error) {
+	op, err := parseColorRamp(value)
+	if err != nil || len(op.stops) != 2 {
+		return nil, fmt.Errorf("expected a dark and a light color and an optional contrast, e.g. #1e3264,#f037a5,1.4")
+	}
+	return op, nil
+}
+
+func parseGradientMap(value string) (Operation, error) {
+	op, err := parseColorRamp(value)
+	if err != nil || len(op.stops) < 2 {
+		return nil, fmt.Errorf("expected two or more colors and an optional contrast, e.g. #000000,#7b1fa2,#ffd54f,1.2")
+	}
+	return op, nil
+}
+
+// parseColorRamp parses comma-separated #rrggbb colors optionally followed
+// by a contrast between 0 and 10
+func parseColorRamp(value string) (gradientMapOp, error) {
+	op := gradientMapOp{contrast: 1}
+	parts := strings.Split(value, ",")
+	if last := strings.TrimSpace(parts[len(parts)-1]); !strings.HasPrefix(last, "#") {
+		contrast, err := strconv.ParseFloat(last, 64)
+		if err != nil || contrast < 0 || contrast > 10 {
+			return op, fmt.Errorf("invalid contrast %q", last)
+		}
+		op.contrast = contrast
+		parts = parts[:len(parts)-1]
+	}
+	for _, part := range parts {
+		c, err := parseHexColor(part)
+		if err != nil {
+			return op, err
+		}
+		op.stops = append(op.stops, c)
+	}
+	return op, nil
+}
+
+// Apply looks the luminance of each pixel up in a table of the ramp's
+// colors, after stretching it about mid grey by the contrast. Transparency
+// is kept.
+func (op gradientMapOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	ramp := make([][3]float64, 0x10000)
+	segments := float64(len(op.stops) - 1)
+	for l := range ramp {
+		t := min(1, max(0, (float64(l)/0xffff-0.5)*op.contrast+0.5)) * segments
+		i := min(int(t), len(op.stops)-2)
+		f := t - float64(i)
+		a, b := op.stops[i], op.stops[i+1]
+		ramp[l] = [3]float64{
+			(float64(a.R) + (float64(b.R)-float64(a.R))*f) * 0x101,
+			(float64(a.G) + (float64(b.G)-float64(a.G))*f) * 0x101,
+			(float64(a.B) + (float64(b.B)-float64(a.B))*f) * 0x101,
+		}
+	}
+
+	s := newSampleBufferGray(img, false)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := range width {
+				a := s.alpha(x, y)
+				if a == 0 {
+					continue
+				}
+				// Luminance weights of color.GrayModel, on unpremultiplied samples
+				lum := (0.299*float64(s.get(x, y, 0)) + 0.587*float64(s.get(x, y, 1)) + 0.114*float64(s.get(x, y, 2))) * 0xffff / float64(a)
+				c := ramp[min(0xffff, int(math.Round(lum)))]
+				for i := range 3 {
+					s.set(x, y, i, uint32(math.Round(c[i]*float64(a)/0xffff)))
+				}
+			}
+		}
+	})
+	return s.img, nil
+}
+
+func parsePosterize(value string) (Operation, error) {
+	levels, err := strconv.Atoi(value)
+	if err != nil || levels < 2 || levels > 256 {
+		return nil, fmt.Errorf("expected a number of levels from 2 to 256")
+	}
+	steps := float64(levels - 1)
+	lut := newToneLUT(func(v float64) float64 { return math.Round(v*steps) / steps })
+	return toneOp{[3][]uint16{lut, lut, lut}}, nil
+}
+
+func parseSolarize(value string) (Operation, error) {
+	threshold, err := strconv.ParseFloat(value, 64)
+	if err != nil || threshold < 0 || threshold > 255 {
+		return nil, fmt.Errorf("expected a threshold from 0 to 255")
+	}
+	lut := newToneLUT(func(v float64) float64 {
+		if v*255 > threshold {
+			return 1 - v
+		}
+		return v
+	})
+	return toneOp{[3][]uint16{lut, lut, lut}}, nil
+}
+
+// vignetteOp darkens the image towards its edges
+type vignetteOp struct {
+	strength float64
+}
+
+func parseVignette(value string) (Operation, error) {
+	strength, err := strconv.ParseFloat(value, 64)
+	if err != nil || strength < 0 || strength > 1 {
+		return nil, fmt.Errorf("expected a strength from 0 to 1")
+	}
+	return vignetteOp{strength}, nil
+}
+
+// Apply scales the colors by a factor that stays 1 in the middle of the
+// image and falls smoothly to 1-strength in the corners
+func (op vignetteOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	s := newSampleBuffer(img)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	cx, cy := float64(width)/2, float64(height)/2
+	radius := math.Hypot(cx, cy)
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := range width {
+				d := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy) / radius
+				// Smoothstep from a quarter of the way out to the corners
+				t := min(1, max(0, (d-0.25)/0.75))
+				factor := 1 - op.strength*t*t*(3-2*t)
+				for c := range s.colorChannels() {
+					s.set(x, y, c, uint32(math.Round(float64(s.get(x, y, c))*factor)))
+				}
+			}
+		}
+	})
+	return s.img, nil
+}
+
+// noiseOp adds Gaussian noise of the same amount to every color channel of
+// a pixel, like film grain
+type noiseOp struct {
+	sigma float64
+}
+
+func parseNoise(value string) (Operation, error) {
+	sigma, err := strconv.ParseFloat(value, 64)
+	if err != nil || sigma <= 0 || sigma > 255 {
+		return nil, fmt.Errorf("expected a standard deviation above 0 and up to 255")
+	}
+	return noiseOp{sigma}, nil
+}
+
+// Apply adds the noise. Each row has its own fixed seed, so the same image
+// always gets the same grain however the rows are split between CPUs.
+func (op noiseOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	s := newSampleBuffer(img)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			rng := rand.New(rand.NewPCG(uint64(y), 0x6e6f697365))
+			for x := range width {
+				a := float64(s.alpha(x, y))
+				// Premultiplied noise fades out with the pixel
+				n := rng.NormFloat64() * op.sigma * 0x101 * a / 0xffff
+				for c := range s.colorChannels() {
+					s.set(x, y, c, uint32(min(a, max(0, math.Round(float64(s.get(x, y, c))+n)))))
+				}
+			}
+		}
+	})
+	return s.img, nil
+}
+
+// pixelateOp replaces square blocks of the image with their average color
+type pixelateOp struct {
+	size int
+}
+
+func parsePixelate(value string) (Operation, error) {
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 1 {
+		return nil, fmt.Errorf("expected a block size of at least 1 pixel")
+	}
+	return pixelateOp{size}, nil
+}
+
+// Apply averages the premultiplied samples of each block, so transparent
+// pixels do not darken their neighbours. Blocks start at the top-left
+// corner; those on the right and bottom edges may be smaller.
+func (op pixelateOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	if op.size == 1 {
+		return img, nil
+	}
+	s := newSampleBuffer(img)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	blockRows := (height + op.size - 1) / op.size
+	parallelRows(blockRows, func(b0, b1 int) {
+		for by := b0; by < b1; by++ {
+			y0, y1 := by*op.size, min(height, (by+1)*op.size)
+			for x0 := 0; x0 < width; x0 += op.size {
+				x1 := min(width, x0+op.size)
+				n := uint64((x1 - x0) * (y1 - y0))
+				for c := range s.channels {
+					var sum uint64
+					for y := y0; y < y1; y++ {
+						for x := x0; x < x1; x++ {
+							sum += uint64(s.get(x, y, c))
+						}
+					}
+					avg := uint32((sum + n/2) / n)
+					for y := y0; y < y1; y++ {
+						for x := x0; x < x1; x++ {
+							s.set(x, y, c, avg)
+						}
+					}
+				}
+			}
+		}
+	})
+	return s.img, nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// terminalSize returns zero: the terminal's size is only read on Linux and
+// macOS, and $COLUMNS is used elsewhere
+func terminalSize(f *os.File) termSize {
+	return termSize{}
+}
+
+// makeRaw returns an error: raw mode is only supported on Linux and macOS
+func makeRaw(f *os.File) (restore func(), err error) {
+	return nil, errors.New("interactive mode is only supported on Linux and macOS")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// fontFiles are the typefaces text can be drawn in, from the Go font family
+// so that no fonts need to be installed
+var fontFiles = map[string][]byte{
+	"regular": goregular.TTF,
+	"bold":    gobold.TTF,
+	"italic":  goitalic.TTF,
+	"mono":    gomono.TTF,
+}
+
+// loadFontFace returns the named typeface at size pixels
+func loadFontFace(name string, size float64) (font.Face, error) {
+	if name == "" {
+		name = "regular"
+	}
+	data, ok := fontFiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown font %q: expected regular, bold, italic or mono", name)
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("font size must be positive")
+	}
+	f, err := opentype.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse font: %w", err)
+	}
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
+
+// wrapText splits text into lines no wider than width when drawn in face,
+// breaking at spaces and at the newlines in text. A word wider than width
+// gets a line of its own. A width of 0 only breaks at newlines.
+func wrapText(face font.Face, text string, width int) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if line != "" && width > 0 && font.MeasureString(face, candidate).Ceil() > width {
+				lines = append(lines, line)
+				candidate = word
+			}
+			line = candidate
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// drawText draws lines in face with the top of the first line at y, aligned
+// left, center or right within the span of width pixels from x. It returns
+// the height of the text.
+func drawText(dst draw.Image, face font.Face, lines []string, x, y, width int, align string, col color.Color) int {
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	drawer := &font.Drawer{Dst: dst, Src: image.NewUniform(col), Face: face}
+	for i, line := range lines {
+		offset := 0
+		switch align {
+		case "center":
+			offset = (width - drawer.MeasureString(line).Ceil()) / 2
+		case "right":
+			offset = width - drawer.MeasureString(line).Ceil()
+		}
+		drawer.Dot = fixed.Point26_6{X: fixed.I(x + offset), Y: fixed.I(y+i*lineHeight) + metrics.Ascent}
+		drawer.DrawString(line)
+	}
+	return len(lines) * lineHeight
+}
+
+// checkTextAlign returns an error unless align is empty or a value drawText
+// accepts
+func checkTextAlign(align string) error {
+	switch align {
+	case "", "left", "center", "right":
+		return nil
+	}
+	return fmt.Errorf("invalid text alignment %q: expected left, center or right", align)
+}
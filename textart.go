@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"strconv"
+)
+
+// asciiRamp holds characters from the least to the most ink, so that bright
+// pixels draw dense characters on a dark terminal
+const asciiRamp = " .:-=+*#%@"
+
+// defaultTextWidth is the width of text art when it is not written to a
+// terminal whose width is known
+const defaultTextWidth = 80
+
+// termSize is the size of a terminal in characters and, when the terminal
+// reports it, in pixels
+type termSize struct{ columns, rows, width, height int }
+
+// textArtWidth returns the number of columns to render text art in: width
+// if given, else the terminal's width, from the terminal or $COLUMNS
+func textArtWidth(width int) int {
+	if width > 0 {
+		return width
+	}
+	if w := terminalSize(os.Stdout).columns; w > 0 {
+		return w
+	}
+	if w, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && w > 0 {
+		return w
+	}
+	return defaultTextWidth
+}
+
+// encodeTextArt renders img as text in width columns: as ascii, characters
+// by brightness, or as ansi, upper half blocks colored with 24-bit escape
+// codes, each showing two pixels one above the other. Terminal characters
+// are about twice as tall as they are wide, so a row of text covers two rows
+// of pixels per column of width.
+func encodeTextArt(w io.Writer, img image.Image, format string, width int) error {
+	bounds := img.Bounds()
+	columns := min(width, bounds.Dx())
+	rows := max(1, int(float64(bounds.Dy())*float64(columns)/float64(bounds.Dx())/2+0.5))
+	pixelRows := rows
+	if format == "ansi" {
+		pixelRows *= 2
+	}
+	small := scaleImage(img, uint(columns), uint(pixelRows))
+	sb := small.Bounds()
+
+	out := bufio.NewWriter(w)
+	rgb := func(x, y int) color.NRGBA {
+		return color.NRGBAModel.Convert(small.At(sb.Min.X+x, sb.Min.Y+y)).(color.NRGBA)
+	}
+	for row := range rows {
+		for x := range columns {
+			if format == "ansi" {
+				top, bottom := rgb(x, 2*row), rgb(x, 2*row+1)
+				fmt.Fprintf(out, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀", top.R, top.G, top.B, bottom.R, bottom.G, bottom.B)
+				continue
+			}
+			c := rgb(x, row)
+			luma := (299*int(c.R) + 587*int(c.G) + 114*int(c.B)) / 1000
+			out.WriteByte(asciiRamp[luma*len(asciiRamp)/256])
+		}
+		if format == "ansi" {
+			out.WriteString("\x1b[0m")
+		}
+		out.WriteByte('\n')
+	}
+	return out.Flush()
+}
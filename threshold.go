@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"strconv"
+
+	"github.com/SvnFrs/go-transform/ops"
+)
+
+func init() {
+	ops.RegisterOperation("edges", "Replace the image with its edges, white on black: sobel for the gradient strength or canny for thin one-pixel lines", parseEdges)
+	ops.RegisterOperation("threshold", "Turn the image black and white at a luminance from 0 to 255, or at one chosen by otsu", parseThreshold)
+}
+
+// grayLevels returns the luminance from 0 to 1 of every pixel of img, row
+// by row, as if flattened onto white
+func grayLevels(img image.Image) []float64 {
+	s := newSampleBuffer(img)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	levels := make([]float64, width*height)
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := range width {
+				l := float64(s.get(x, y, 0))
+				if s.channels > 1 {
+					l = 0.299*float64(s.get(x, y, 0)) + 0.587*float64(s.get(x, y, 1)) + 0.114*float64(s.get(x, y, 2))
+				}
+				levels[y*width+x] = (l + float64(0xffff-s.alpha(x, y))) / 0xffff
+			}
+		}
+	})
+	return levels
+}
+
+// otsuThreshold returns the level from 0 to 1 that best separates values,
+// which range from 0 to 1, into two classes by Otsu's method
+func otsuThreshold(values []float64) float64 {
+	var hist [256]float64
+	for _, v := range values {
+		hist[min(255, int(v*256))]++
+	}
+	var total, sum float64
+	for i, n := range hist {
+		total += n
+		sum += float64(i) * n
+	}
+	var below, sumBelow, best float64
+	threshold := 0
+	for i, n := range hist {
+		below += n
+		if below == 0 || below == total {
+			continue
+		}
+		sumBelow += float64(i) * n
+		above := total - below
+		// Between-class variance, scaled by total squared
+		d := sumBelow/below - (sum-sumBelow)/above
+		if v := below * above * d * d; v > best {
+			best, threshold = v, i+1
+		}
+	}
+	return float64(threshold) / 256
+}
+
+// thresholdOp turns the image black and white
+type thresholdOp struct {
+	level float64 // from 0 to 1, or below 0 for Otsu's method
+}
+
+func parseThreshold(value string) (Operation, error) {
+	if value == "otsu" {
+		return thresholdOp{-1}, nil
+	}
+	level, err := strconv.ParseFloat(value, 64)
+	if err != nil || level < 0 || level > 255 {
+		return nil, fmt.Errorf("expected a luminance from 0 to 255 or otsu")
+	}
+	return thresholdOp{level / 255}, nil
+}
+
+// Apply makes pixels at or above the threshold white and the rest black.
+// Transparent pixels count as white.
+func (op thresholdOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	levels := grayLevels(img)
+	level := op.level
+	if level < 0 {
+		level = otsuThreshold(levels)
+		slog.Info("Chose threshold", "level", math.Round(level*255))
+	}
+	dst := image.NewGray(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	for i, l := range levels {
+		if l >= level {
+			dst.Pix[i] = 0xff
+		}
+	}
+	return dst, nil
+}
+
+// edgesOp replaces the image with its edges
+type edgesOp struct {
+	canny bool
+}
+
+func parseEdges(value string) (Operation, error) {
+	switch value {
+	case "sobel":
+		return edgesOp{}, nil
+	case "canny":
+		return edgesOp{canny: true}, nil
+	}
+	return nil, fmt.Errorf("expected sobel or canny")
+}
+
+// sobel returns the gradient of levels at every pixel, repeating the edge
+// pixels beyond the image. A step from black to white has a magnitude of 1.
+func sobel(levels []float64, width, height int) (gx, gy []float64) {
+	gx, gy = make([]float64, len(levels)), make([]float64, len(levels))
+	at := func(x, y int) float64 {
+		return levels[min(height-1, max(0, y))*width+min(width-1, max(0, x))]
+	}
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := range width {
+				i := y*width + x
+				gx[i] = (at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)) / 4
+				gy[i] = (at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)) / 4
+			}
+		}
+	})
+	return gx, gy
+}
+
+// Apply computes the Sobel gradient magnitude of the luminance. Canny
+// smooths the luminance first, keeps only the local maxima across each edge
+// and then keeps weak edges only where they connect to strong ones. The
+// strong threshold is chosen by Otsu's method over the gradient magnitudes,
+// and the weak one is half of it.
+func (op edgesOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	dst := image.NewGray(image.Rect(0, 0, width, height))
+	if width == 0 || height == 0 {
+		return dst, nil
+	}
+	levels := grayLevels(img)
+	if op.canny {
+		blurred, err := blurOp{1.4}.Apply(ctx, grayImageOf(levels, width, height))
+		if err != nil {
+			return nil, err
+		}
+		levels = grayLevels(blurred)
+	}
+	gx, gy := sobel(levels, width, height)
+	magnitude := make([]float64, len(levels))
+	for i := range magnitude {
+		magnitude[i] = min(1, math.Hypot(gx[i], gy[i]))
+	}
+	if !op.canny {
+		for i, m := range magnitude {
+			dst.Pix[i] = uint8(math.Round(m * 0xff))
+		}
+		return dst, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Non-maximum suppression along the gradient, quantized to 45 degrees
+	thin := make([]float64, len(magnitude))
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := range width {
+				i := y*width + x
+				m := magnitude[i]
+				if m == 0 {
+					continue
+				}
+				angle := math.Mod(math.Atan2(gy[i], gx[i])+math.Pi, math.Pi)
+				dx, dy := 1, 0
+				switch {
+				case angle >= math.Pi/8 && angle < 3*math.Pi/8:
+					dx, dy = 1, 1
+				case angle >= 3*math.Pi/8 && angle < 5*math.Pi/8:
+					dx, dy = 0, 1
+				case angle >= 5*math.Pi/8 && angle < 7*math.Pi/8:
+					dx, dy = -1, 1
+				}
+				neighbour := func(x, y int) float64 {
+					if x < 0 || y < 0 || x >= width || y >= height {
+						return 0
+					}
+					return magnitude[y*width+x]
+				}
+				if m >= neighbour(x+dx, y+dy) && m > neighbour(x-dx, y-dy) {
+					thin[i] = m
+				}
+			}
+		}
+	})
+
+	var nonzero []float64
+	for _, m := range thin {
+		if m > 0 {
+			nonzero = append(nonzero, m)
+		}
+	}
+	if len(nonzero) == 0 {
+		return dst, nil
+	}
+	high := max(otsuThreshold(nonzero), 1.0/256)
+	low := high / 2
+
+	// Hysteresis: follow weak edges outwards from strong ones
+	var stack []int
+	for i, m := range thin {
+		if m >= high {
+			dst.Pix[i] = 0xff
+			stack = append(stack, i)
+		}
+	}
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		x, y := i%width, i/width
+		for ny := max(0, y-1); ny <= min(height-1, y+1); ny++ {
+			for nx := max(0, x-1); nx <= min(width-1, x+1); nx++ {
+				if j := ny*width + nx; dst.Pix[j] == 0 && thin[j] >= low {
+					dst.Pix[j] = 0xff
+					stack = append(stack, j)
+				}
+			}
+		}
+	}
+	slog.Debug("Detected edges", "high", high, "low", low)
+	return dst, nil
+}
+
+// grayImageOf returns levels from 0 to 1 as a 16-bit grey image
+func grayImageOf(levels []float64, width, height int) *image.Gray16 {
+	img := image.NewGray16(image.Rect(0, 0, width, height))
+	for i, l := range levels {
+		v := uint16(math.Round(l * 0xffff))
+		img.Pix[i*2], img.Pix[i*2+1] = uint8(v>>8), uint8(v)
+	}
+	return img
+}
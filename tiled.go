@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log/slog"
+)
+
+// Tiled processing keeps memory bounded for very large inputs. The decoders
+// still hold the image in its native (for JPEG, subsampled YCbCr) form, but
+// it is downscaled straight away, converting the source one strip of rows at
+// a time, before any later stage materializes a full-resolution RGBA frame.
+
+// frameBytes estimates the memory needed to hold img as an RGBA frame
+func frameBytes(img image.Image) int64 {
+	bytesPerPixel := int64(4)
+	if imageDepth(img) == 16 {
+		bytesPerPixel = 8
+	}
+	return int64(img.Bounds().Dx()) * int64(img.Bounds().Dy()) * bytesPerPixel
+}
+
+// resizeImageTiled downscales img by resizePercent in strips
+func resizeImageTiled(img image.Image, resizePercent float64) image.Image {
+	width, height := resizedDimensions(img.Bounds(), resizePercent)
+	resized := scaleImage(img, width, height)
+	slog.Info("Image resized using tiled processing", "percent", resizePercent, "size", fmt.Sprintf("%dx%d", width, height))
+	return resized
+}
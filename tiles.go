@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// tileJob is one tile of a pyramid level: the part of the level it shows,
+// the size of the tile image, and where it is written
+type tileJob struct {
+	src  image.Rectangle
+	size image.Point
+	path string
+}
+
+// pyramidSizes returns the sizes of the levels of a tile pyramid for an
+// image of width x height, from the full size down, each half the one
+// before rounded up, until the level fits in smallest pixels on each side
+func pyramidSizes(width, height, smallest int) []image.Point {
+	sizes := []image.Point{{width, height}}
+	for s := sizes[0]; max(s.X, s.Y) > smallest; {
+		s = image.Pt((s.X+1)/2, (s.Y+1)/2)
+		sizes = append(sizes, s)
+	}
+	return sizes
+}
+
+// tileOptions are the settings of the tiles subcommand
+type tileOptions struct {
+	Layout   string // dzi or xyz
+	TileSize int
+	Overlap  int
+	Format   string // jpg or png
+	Quality  int
+}
+
+// levelTiles returns the tiles of a level of size, under dir. DZI tiles are
+// named col_row in the level's directory, and those on the right and bottom
+// edges are cut short. XYZ tiles are named x/y in the zoom's directory and
+// always have the full tile size, the part beyond the image left empty.
+func (o *tileOptions) levelTiles(size image.Point, dir string) []tileJob {
+	ts, ext := o.TileSize, "."+o.Format
+	var jobs []tileJob
+	for row := 0; row*ts < size.Y; row++ {
+		for col := 0; col*ts < size.X; col++ {
+			r := image.Rect(col*ts, row*ts, (col+1)*ts, (row+1)*ts)
+			if o.Layout == "xyz" {
+				jobs = append(jobs, tileJob{r.Intersect(image.Rectangle{Max: size}), image.Pt(ts, ts), filepath.Join(dir, fmt.Sprint(col), fmt.Sprint(row)+ext)})
+				continue
+			}
+			// DZI tiles reach overlap pixels into their neighbours
+			r = image.Rect(r.Min.X-o.Overlap, r.Min.Y-o.Overlap, r.Max.X+o.Overlap, r.Max.Y+o.Overlap).Intersect(image.Rectangle{Max: size})
+			jobs = append(jobs, tileJob{r, r.Size(), filepath.Join(dir, fmt.Sprintf("%d_%d%s", col, row, ext))})
+		}
+	}
+	return jobs
+}
+
+// writeTile encodes the part of level a tile shows and writes it. JPEG
+// tiles are flattened onto white.
+func (o *tileOptions) writeTile(level image.Image, job tileJob) error {
+	tile := image.NewNRGBA(image.Rectangle{Max: job.size})
+	op := draw.Src
+	if o.Format == "jpg" {
+		draw.Draw(tile, tile.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+		op = draw.Over
+	}
+	draw.Draw(tile, image.Rectangle{Max: job.src.Size()}, level, job.src.Min, op)
+
+	var buf bytes.Buffer
+	var err error
+	if o.Format == "jpg" {
+		err = jpeg.Encode(&buf, tile, &jpeg.Options{Quality: o.Quality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: pngCompressionLevel()}).Encode(&buf, tile)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode tile %s: %w", job.path, err)
+	}
+	return writeOutputFile(job.path, buf.Bytes())
+}
+
+// writeTiles writes jobs concurrently, one goroutine per available CPU, and
+// returns the first error
+func (o *tileOptions) writeTiles(level image.Image, jobs []tileJob) error {
+	for _, job := range jobs {
+		if err := ensureOutputDir(filepath.Dir(job.path)); err != nil {
+			return fmt.Errorf("error creating output directory: %w", err)
+		}
+	}
+	next := make(chan tileJob)
+	errs := make([]error, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range next {
+				if errs[i] == nil {
+					errs[i] = o.writeTile(level, job)
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		next <- job
+	}
+	close(next)
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// dziDescriptor returns the .dzi file describing a Deep Zoom pyramid of an
+// image of size
+func (o *tileOptions) dziDescriptor(size image.Point) []byte {
+	return fmt.Appendf(nil, `<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="%s" Overlap="%d" TileSize="%d">
+  <Size Width="%d" Height="%d"/>
+</Image>
+`, o.Format, o.Overlap, o.TileSize, size.X, size.Y)
+}
+
+// makePyramid cuts img into a tile pyramid named name in output/tiles,
+// resizing each level from the one above, and returns the number of levels
+// and tiles written. DZI levels run from 1x1 pixel up to the full size, and
+// XYZ zoom levels from the whole image in one tile up to the full size.
+func (o *tileOptions) makePyramid(img image.Image, name string) (levels, tiles int, err error) {
+	root := filepath.Join(outputRoot, "tiles")
+	if err := ensureOutputDir(root); err != nil {
+		return 0, 0, fmt.Errorf("error creating output directory: %w", err)
+	}
+	smallest, dir := 1, filepath.Join(root, name+"_files")
+	if o.Layout == "xyz" {
+		smallest, dir = o.TileSize, filepath.Join(root, name)
+	}
+	sizes := pyramidSizes(img.Bounds().Dx(), img.Bounds().Dy(), smallest)
+
+	level := img
+	for i, size := range sizes {
+		if i > 0 {
+			level = scaleImage(level, uint(size.X), uint(size.Y))
+		}
+		jobs := o.levelTiles(size, filepath.Join(dir, fmt.Sprint(len(sizes)-1-i)))
+		if err := o.writeTiles(level, jobs); err != nil {
+			return i, tiles, err
+		}
+		tiles += len(jobs)
+		slog.Debug("Wrote pyramid level", "level", len(sizes)-1-i, "size", fmt.Sprintf("%dx%d", size.X, size.Y), "tiles", len(jobs))
+	}
+
+	if o.Layout == "dzi" {
+		path, err := prepareOutputPath("tiles", name+".dzi")
+		if err != nil {
+			return len(sizes), tiles, err
+		}
+		if err := writeOutputFile(path, o.dziDescriptor(sizes[0])); err != nil {
+			return len(sizes), tiles, fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	return len(sizes), tiles, nil
+}
+
+// runTiles implements the tiles subcommand
+func runTiles(args []string) error {
+	fs := flag.NewFlagSet("tiles", flag.ExitOnError)
+	var o tileOptions
+	fs.StringVar(&o.Layout, "layout", "dzi", "Pyramid layout: dzi (Deep Zoom, for OpenSeadragon) or xyz (zoom/x/y, for Leaflet and OpenLayers)")
+	fs.IntVar(&o.TileSize, "tile-size", 256, "Width and height of the tiles in pixels")
+	fs.IntVar(&o.Overlap, "overlap", 0, "Pixels each DZI tile reaches into its neighbours, which hides seams when viewers scale tiles, e.g. 1")
+	fs.StringVar(&o.Format, "format", "jpg", "Tile format: jpg, or png to keep transparency")
+	compressLevel := fs.Int("compress", 0, "JPEG tile quality (1-100). 0 uses the default quality")
+	filter := fs.String("filter", "lanczos", "Resampling filter used to make each level from the one above: lanczos, catmullrom, bilinear or area")
+	outputName := fs.String("output", "", "Name of the pyramid in output/tiles. Defaults to the input's name")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s tiles [flags] image1 image2 ...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	inputs, err := collectInputs(fs.Args(), "")
+	if err != nil {
+		return err
+	}
+	if len(inputs) == 0 {
+		return errors.New("at least one input image is required")
+	}
+	if *outputName != "" && len(inputs) > 1 {
+		return errors.New("-output can only be used with a single input; pyramids are named after each input")
+	}
+	o.Format = strings.TrimPrefix(strings.ToLower(o.Format), ".")
+	if o.Format == "jpeg" {
+		o.Format = "jpg"
+	}
+	var errs []error
+	if o.Layout != "dzi" && o.Layout != "xyz" {
+		errs = append(errs, fmt.Errorf("invalid layout %q: expected dzi or xyz", o.Layout))
+	}
+	if o.TileSize < 16 || o.TileSize > 4096 {
+		errs = append(errs, errors.New("tile-size must be between 16 and 4096"))
+	}
+	if o.Overlap < 0 || o.Overlap >= o.TileSize/2 {
+		errs = append(errs, errors.New("overlap must be at least 0 and less than half the tile size"))
+	}
+	if o.Overlap > 0 && o.Layout == "xyz" {
+		errs = append(errs, errors.New("overlap only applies to the dzi layout"))
+	}
+	if o.Format != "jpg" && o.Format != "png" {
+		errs = append(errs, fmt.Errorf("invalid format %q: expected jpg or png", o.Format))
+	}
+	if *compressLevel < 0 || *compressLevel > 100 {
+		errs = append(errs, errors.New("compress must be between 1 and 100, or 0 for the default quality"))
+	}
+	errs = append(errs, setScaler(*filter))
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	o.Quality = siteDefaults.JPEGQuality
+	if *compressLevel > 0 {
+		o.Quality = *compressLevel
+	}
+
+	for _, path := range inputs {
+		img, _, err := loadImage(path)
+		if err != nil {
+			return err
+		}
+		name := *outputName
+		if name == "" {
+			name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		name = strings.TrimSuffix(filepath.Base(name), ".dzi")
+		levels, tiles, err := o.makePyramid(img, name)
+		if err != nil {
+			return err
+		}
+		attrs := []any{"file", path, "size", fmt.Sprintf("%dx%d", img.Bounds().Dx(), img.Bounds().Dy()), "levels", levels, "tiles", tiles}
+		if o.Layout == "xyz" {
+			// Leaflet needs the largest zoom and the full size to place the tiles
+			attrs = append(attrs, "max_zoom", levels-1, "path", filepath.Join(outputRoot, "tiles", name))
+		} else {
+			attrs = append(attrs, "path", filepath.Join(outputRoot, "tiles", name+".dzi"))
+		}
+		slog.Info("Tile pyramid saved", attrs...)
+	}
+	return nil
+}
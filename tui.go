@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// tuiSetting is a slider of the tui subcommand, stepping through the values
+// of the option it is named after
+type tuiSetting struct {
+	name   string   // option name, as in presets and sidecars
+	label  string   // name shown on screen
+	values []string // values from left to right; "" leaves the option unset
+	unit   string
+	off    string // shown for ""
+	index  int
+}
+
+// reset moves s back to the value leaving its option unset
+func (s *tuiSetting) reset() {
+	s.index = slices.Index(s.values, "")
+}
+
+// value returns the option value s is set to, or "" if it is unset
+func (s *tuiSetting) value() string {
+	return s.values[s.index]
+}
+
+// tuiSteps returns the numbers from first to last, step apart, as option values
+func tuiSteps(first, last, step float64) []string {
+	var values []string
+	for i := 0; first+float64(i)*step <= last+step/1000; i++ {
+		values = append(values, strconv.FormatFloat(first+float64(i)*step, 'f', -1, 64))
+	}
+	return values
+}
+
+// newTUISettings returns the sliders of the tui subcommand, each leaving its
+// option unset
+func newTUISettings() []tuiSetting {
+	settings := []tuiSetting{
+		{name: "resize", label: "Resize", values: append(tuiSteps(5, 95, 5), ""), unit: "%", off: "100%"},
+		{name: "compress", label: "Quality", values: append(tuiSteps(5, 100, 5), ""), off: "default"},
+		{name: "format", label: "Format", values: []string{"", "jpeg", "png", "gif", "qoi", "webp"}, off: "as input"},
+		{name: "blur", label: "Blur", values: append([]string{""}, tuiSteps(0.5, 20, 0.5)...), unit: " px", off: "off"},
+		{name: "pixelate", label: "Pixelate", values: append([]string{""}, tuiSteps(2, 64, 2)...), unit: " px", off: "off"},
+		{name: "posterize", label: "Posterize", values: []string{"", "32", "24", "16", "12", "8", "6", "4", "3", "2"}, unit: " levels", off: "off"},
+		{name: "vignette", label: "Vignette", values: append([]string{""}, tuiSteps(0.05, 1, 0.05)...), off: "off"},
+		{name: "noise", label: "Noise", values: append([]string{""}, tuiSteps(2, 40, 2)...), off: "off"},
+	}
+	for i := range settings {
+		settings[i].reset()
+	}
+	return settings
+}
+
+// tuiKeys splits bytes read from the terminal into keys. Arrow keys arrive
+// as escape sequences such as ESC [ A, everything else as single bytes.
+func tuiKeys(input []byte) []string {
+	var keys []string
+	for len(input) > 0 {
+		n := 1
+		if input[0] == 0x1b && len(input) >= 3 && (input[1] == '[' || input[1] == 'O') {
+			n = 3
+		}
+		keys = append(keys, string(input[:n]))
+		input = input[n:]
+	}
+	return keys
+}
+
+// tuiBarWidth is the width of a slider in characters
+const tuiBarWidth = 24
+
+// tui is an interactive session of the tui subcommand
+type tui struct {
+	input      string
+	data       []byte
+	base       *processOptions
+	protocol   string
+	presetName string
+	settings   []tuiSetting
+	selected   int
+	out        *bufio.Writer
+
+	// The result of processing the input with the current settings
+	preview image.Image
+	result  processResult
+	size    int
+	err     error
+
+	busy  bool
+	saved string // path of the preset file once written
+}
+
+// options returns the options the sliders are set to
+func (t *tui) options() map[string]string {
+	options := map[string]string{}
+	for _, s := range t.settings {
+		if v := s.value(); v != "" {
+			options[s.name] = v
+		}
+	}
+	return options
+}
+
+// process runs the pipeline on the input with the current settings, keeping
+// the output decoded for the preview
+func (t *tui) process() {
+	t.preview, t.err = nil, nil
+	opts, err := t.base.withOptions(t.options())
+	if err != nil {
+		t.err = err
+		return
+	}
+	var encoded bytes.Buffer
+	t.result, t.err = processImage(context.Background(), opts, t.input, t.data, nil, t.input, &encoded)
+	if t.err != nil {
+		return
+	}
+	t.size = encoded.Len()
+	t.preview, _, t.err = decodeImage(&encoded)
+}
+
+// savePreset writes the options the sliders are set to to the preset file
+func (t *tui) savePreset() error {
+	path, err := prepareOutputPath("presets", t.presetName)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Preset tuned on %s\n", filepath.Base(t.input))
+	for _, s := range t.settings {
+		if v := s.value(); v != "" {
+			fmt.Fprintf(&b, "%s: %s\n", s.name, v)
+		}
+	}
+	if err := writeFileAtomic(path, []byte(b.String())); err != nil {
+		return fmt.Errorf("failed to write preset: %w", err)
+	}
+	t.saved = path
+	return nil
+}
+
+// handle acts on a key press. It reports whether a setting changed, so the
+// input needs processing again, and whether the session is over.
+func (t *tui) handle(key string) (changed, quit bool) {
+	s := &t.settings[t.selected]
+	switch key {
+	case "\x1b[A", "\x1bOA", "k":
+		t.selected = (t.selected + len(t.settings) - 1) % len(t.settings)
+	case "\x1b[B", "\x1bOB", "j":
+		t.selected = (t.selected + 1) % len(t.settings)
+	case "\x1b[C", "\x1bOC", "l", "+":
+		if s.index < len(s.values)-1 {
+			s.index++
+			changed = true
+		}
+	case "\x1b[D", "\x1bOD", "h", "-":
+		if s.index > 0 {
+			s.index--
+			changed = true
+		}
+	case "r":
+		old := s.index
+		s.reset()
+		changed = s.index != old
+	case "s":
+		if err := t.savePreset(); err != nil {
+			t.err = err
+		}
+	case "q", "\x1b", "\x03":
+		quit = true
+	}
+	return changed, quit
+}
+
+// draw redraws the screen: the preview at the top, if full, and the sliders
+// below it
+func (t *tui) draw(full bool) error {
+	size := terminalSize(os.Stdout)
+	if size.columns == 0 || size.rows == 0 {
+		size = termSize{columns: 80, rows: 24}
+	}
+	// A status line, the sliders and a line of help fill the bottom rows
+	panelTop := max(1, size.rows-len(t.settings)-1)
+	if full {
+		t.out.WriteString("\x1b[H\x1b[2J")
+		if t.protocol == "kitty" {
+			t.out.WriteString("\x1b_Ga=d\x1b\\")
+		}
+		if t.preview != nil {
+			if err := t.drawPreview(size, panelTop-2); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Fprintf(t.out, "\x1b[%d;1H\x1b[K", panelTop)
+	switch {
+	case t.busy:
+		t.out.WriteString("Processing...")
+	case t.err != nil:
+		fmt.Fprintf(t.out, "\x1b[31mError: %v\x1b[0m", t.err)
+	default:
+		r := t.result
+		fmt.Fprintf(t.out, "%s %dx%d → %dx%d %s, %.1f KB", filepath.Base(t.input), r.SourceWidth, r.SourceHeight, r.Width, r.Height, r.Format, float64(t.size)/1024)
+	}
+	if t.saved != "" {
+		fmt.Fprintf(t.out, "  (saved %s)", t.saved)
+	}
+	t.out.WriteByte('\n')
+
+	for i, s := range t.settings {
+		filled := s.index * tuiBarWidth / (len(s.values) - 1)
+		label := fmt.Sprintf("  %-10s", s.label)
+		if i == t.selected {
+			label = fmt.Sprintf("\x1b[7m> %-10s\x1b[0m", s.label)
+		}
+		value := s.off
+		if v := s.value(); v != "" {
+			value = v + s.unit
+		}
+		fmt.Fprintf(t.out, "\x1b[K%s %s%s %s\n", label, strings.Repeat("█", filled), strings.Repeat("░", tuiBarWidth-filled), value)
+	}
+	fmt.Fprintf(t.out, "\x1b[K↑/↓ choose  ←/→ adjust  r reset  s save preset to output/presets/%s  q quit", t.presetName)
+	return t.out.Flush()
+}
+
+// drawPreview draws the processed image at the cursor, fitted to the width
+// of the terminal and the given number of rows
+func (t *tui) drawPreview(size termSize, rows int) error {
+	if rows < 1 {
+		return nil
+	}
+	img := t.preview
+	b := img.Bounds()
+	if t.protocol == "ansi" {
+		// Each character shows two rows of pixels
+		columns := min(size.columns, max(1, rows*2*b.Dx()/b.Dy()))
+		return encodeTextArt(t.out, flattenAlpha(img, defaultBackground), "ansi", columns)
+	}
+	// Terminals that do not report their size in pixels mostly have cells
+	// about this size
+	cellWidth, cellHeight := 10, 20
+	if size.width > 0 && size.height > 0 {
+		cellWidth, cellHeight = size.width/size.columns, size.height/size.rows
+	}
+	maxWidth, maxHeight := size.columns*cellWidth, rows*cellHeight
+	if b.Dx() > maxWidth || b.Dy() > maxHeight {
+		img = fitWithin(img, maxWidth, maxHeight)
+	}
+	return writePreview(t.out, img, t.protocol, max(maxWidth, maxHeight))
+}
+
+// run shows the session until q is pressed
+func (t *tui) run() error {
+	// Log messages would be drawn over the screen; errors are shown in the
+	// status line instead
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	defer slog.SetDefault(logger)
+
+	keys := make(chan string, 64)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			for _, key := range tuiKeys(buf[:n]) {
+				keys <- key
+			}
+		}
+	}()
+
+	// Switch to the alternate screen and hide the cursor, restoring both
+	// on the way out
+	t.out.WriteString("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		t.out.WriteString("\x1b[?25h\x1b[?1049l")
+		t.out.Flush()
+	}()
+
+	t.process()
+	if err := t.draw(true); err != nil {
+		return err
+	}
+	for key := range keys {
+		changed, quit := t.handle(key)
+		// Take the keys pressed while the last change was processed in one
+		// go, so that holding down an arrow key does not fall behind
+		for len(keys) > 0 && !quit {
+			c, q := t.handle(<-keys)
+			changed, quit = changed || c, q
+		}
+		if quit {
+			return nil
+		}
+		if changed {
+			t.busy = true
+			if err := t.draw(false); err != nil {
+				return err
+			}
+			t.process()
+			t.busy = false
+		}
+		if err := t.draw(changed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runTUI implements the tui subcommand
+func runTUI(args []string) error {
+	fs := flag.NewFlagSet("tui", flag.ExitOnError)
+	presetName := fs.String("output", "preset.yaml", "Name of the preset file written to output/presets when s is pressed")
+	protocol := fs.String("protocol", "auto", "Terminal graphics protocol for the preview: auto, kitty, iterm, sixel or ansi (colored text for terminals without graphics)")
+	setupLogging := addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s tui [flags] image\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("exactly one input image is required")
+	}
+	input := fs.Arg(0)
+	if isArchive(input) || isVideo(input) {
+		return errors.New("tui needs an image input, not an archive or video")
+	}
+	if !slices.Contains(previewProtocols, *protocol) {
+		return fmt.Errorf("invalid protocol %q: expected %s", *protocol, strings.Join(previewProtocols, ", "))
+	}
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return errors.New("tui needs an interactive terminal")
+	}
+	if *protocol == "auto" {
+		*protocol = detectPreviewProtocol()
+	}
+
+	data, err := readInputFile(input)
+	if err != nil {
+		return fmt.Errorf("failed to read input file: %w", err)
+	}
+	// The sliders are applied on top of the defaults of the main command
+	base := addProcessFlags(flag.NewFlagSet("tui", flag.ContinueOnError))
+	if err := base.setup(); err != nil {
+		return err
+	}
+
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed to set up terminal: %w", err)
+	}
+	t := &tui{
+		input:      input,
+		data:       data,
+		base:       base,
+		protocol:   *protocol,
+		presetName: filepath.Base(*presetName),
+		settings:   newTUISettings(),
+		out:        bufio.NewWriter(os.Stdout),
+	}
+	err = t.run()
+	restore()
+	if err == nil && t.saved != "" {
+		slog.Info("Preset saved", "path", t.saved)
+	}
+	return err
+}
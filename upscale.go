@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log/slog"
+)
+
+// upscaler enlarges images by a fixed factor with a super-resolution model
+type upscaler interface {
+	upscale(ctx context.Context, img image.Image) (image.Image, error)
+}
+
+// loadUpscaler loads the super-resolution model at a path. It is set by
+// onnx.go in builds with the onnx tag, see there.
+var loadUpscaler func(modelPath string) (upscaler, error)
+
+// activeUpscaler is the model loaded by -upscale-model, if any
+var activeUpscaler upscaler
+
+// setUpscaler loads the super-resolution model used to enlarge images, or
+// unloads it when modelPath is empty
+func setUpscaler(modelPath string) error {
+	activeUpscaler = nil
+	if modelPath == "" {
+		return nil
+	}
+	if loadUpscaler == nil {
+		return errors.New("this build cannot run upscale models; rebuild with -tags onnx")
+	}
+	u, err := loadUpscaler(modelPath)
+	if err != nil {
+		return fmt.Errorf("failed to load upscale model: %w", err)
+	}
+	activeUpscaler = u
+	slog.Debug("Loaded upscale model", "path", modelPath)
+	return nil
+}
+
+// enlargeImage scales img up to width x height. With a super-resolution
+// model loaded, img is run through it first and the result resampled to the
+// exact size.
+func enlargeImage(ctx context.Context, img image.Image, width, height uint) (image.Image, error) {
+	if activeUpscaler != nil {
+		up, err := activeUpscaler.upscale(ctx, img)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upscale image: %w", err)
+		}
+		slog.Info("Upscaled image with model", "size", fmt.Sprintf("%dx%d", up.Bounds().Dx(), up.Bounds().Dy()))
+		img = up
+	}
+	return scaleImage(img, width, height), nil
+}
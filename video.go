@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// videoExts are the extensions of inputs read as video, whose poster frame
+// is extracted with ffmpeg and processed like an image
+var videoExts = []string{".mp4", ".m4v", ".mov", ".mkv", ".webm", ".avi"}
+
+// isVideo reports whether path names a video input
+func isVideo(path string) bool {
+	return slices.Contains(videoExts, strings.ToLower(filepath.Ext(path)))
+}
+
+// extractVideoFrame runs ffmpeg to decode the frame of the video at path
+// shown at offset and returns it as a PNG. ffmpeg seeks to the keyframe
+// before offset and decodes forward from there, so only a few frames are
+// decoded whatever the length of the video.
+func extractVideoFrame(ctx context.Context, ffmpeg, path string, offset time.Duration) ([]byte, error) {
+	if isObjectURI(path) {
+		return nil, errors.New("video input must be a local file")
+	}
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, "-nostdin", "-v", "error",
+		"-ss", strconv.FormatFloat(offset.Seconds(), 'f', 3, 64), "-i", path,
+		"-frames:v", "1", "-an", "-f", "image2pipe", "-c:v", "png", "-")
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("video input needs ffmpeg, which was not found: install it or give its path with -ffmpeg")
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("ffmpeg failed: %w", err)
+	}
+	if out.Len() == 0 {
+		return nil, fmt.Errorf("no frame at %s: the video may be shorter", offset)
+	}
+	slog.Info("Extracted video frame", "at", offset, "input", path)
+	return out.Bytes(), nil
+}
@@ -0,0 +1,85 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"syscall/js"
+)
+
+func init() {
+	jsMain = serveJS
+}
+
+// serveJS exposes imgProcessor.Transform to JavaScript and keeps the
+// program running to answer calls
+func serveJS() {
+	api := js.Global().Get("Object").New()
+	api.Set("Transform", js.FuncOf(jsTransform))
+	js.Global().Set("imgProcessor", api)
+	select {}
+}
+
+// jsTransform implements imgProcessor.Transform(image, options, filename).
+// image is a Uint8Array, options an object of option names and values as
+// accepted by the server, and filename an optional name whose extension
+// identifies PDF and Netpbm input. It returns a promise of an object with
+// the encoded image, its format, width and height.
+func jsTransform(this js.Value, args []js.Value) any {
+	promise := js.Global().Get("Promise")
+	return promise.New(js.FuncOf(func(this js.Value, handlers []js.Value) any {
+		resolve, reject := handlers[0], handlers[1]
+		go func() {
+			result, err := transformJS(args)
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(result)
+		}()
+		return nil
+	}))
+}
+
+// transformJS runs the pipeline on the arguments of imgProcessor.Transform
+func transformJS(args []js.Value) (js.Value, error) {
+	if len(args) == 0 || args[0].Type() != js.TypeObject {
+		return js.Value{}, errors.New("Transform expects a Uint8Array image")
+	}
+	data := make([]byte, args[0].Get("length").Int())
+	js.CopyBytesToGo(data, args[0])
+
+	options := map[string]string{}
+	if len(args) > 1 && args[1].Type() == js.TypeObject {
+		keys := js.Global().Get("Object").Call("keys", args[1])
+		for i := range keys.Length() {
+			name := keys.Index(i).String()
+			options[name] = js.Global().Get("String").Invoke(args[1].Get(name)).String()
+		}
+	}
+	filename := "image"
+	if len(args) > 2 && args[2].Type() == js.TypeString {
+		filename = args[2].String()
+	}
+
+	opts, err := parseRequestOptions(processOptions{Filter: "lanczos"}, options)
+	if err != nil {
+		return js.Value{}, err
+	}
+	var encoded bytes.Buffer
+	result, err := processImage(context.Background(), opts, filename, data, nil, "result", &encoded)
+	if err != nil {
+		return js.Value{}, err
+	}
+
+	image := js.Global().Get("Uint8Array").New(encoded.Len())
+	js.CopyBytesToJS(image, encoded.Bytes())
+	out := js.Global().Get("Object").New()
+	out.Set("image", image)
+	out.Set("format", result.Format)
+	out.Set("width", result.Width)
+	out.Set("height", result.Height)
+	return out, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/SvnFrs/go-transform/ops"
+)
+
+// Operations run in the order they are registered, and files' init
+// functions in the order of their names, so stamps registered here come
+// after the operations that change colors and would otherwise alter them.
+
+func init() {
+	ops.RegisterOperation("embed-qr", "Stamp a QR code of a URL or text onto the image, given as text@position[,size]. The position is top-left, top-right, bottom-left, bottom-right, center or x,y, and the size in pixels defaults to a fifth of the shorter side", parseEmbedQR)
+}
+
+// embedQROp draws a QR code with its quiet zone onto the image
+type embedQROp struct {
+	code     *qrCode
+	position string      // a corner or center, or empty to use point
+	point    image.Point // top-left corner of the code
+	size     int         // 0 picks a fifth of the shorter side
+}
+
+// parseEmbedQR parses text@position[,size]. The text is everything before
+// the last @, so it may contain @ itself.
+func parseEmbedQR(value string) (Operation, error) {
+	at := strings.LastIndex(value, "@")
+	if at <= 0 {
+		return nil, fmt.Errorf("expected text@position[,size], e.g. https://example.com@bottom-right")
+	}
+	code, err := encodeQR([]byte(value[:at]), qrMedium)
+	if err != nil {
+		return nil, err
+	}
+	op := embedQROp{code: code}
+
+	parts := strings.Split(value[at+1:], ",")
+	switch parts[0] {
+	case "top-left", "top-right", "bottom-left", "bottom-right", "center":
+		op.position, parts = parts[0], parts[1:]
+	default:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid position %q: expected top-left, top-right, bottom-left, bottom-right, center or x,y", value[at+1:])
+		}
+		x, errX := strconv.Atoi(parts[0])
+		y, errY := strconv.Atoi(parts[1])
+		if errX != nil || errY != nil || x < 0 || y < 0 {
+			return nil, fmt.Errorf("invalid position %q: expected top-left, top-right, bottom-left, bottom-right, center or x,y", value[at+1:])
+		}
+		op.point, parts = image.Pt(x, y), parts[2:]
+	}
+	switch len(parts) {
+	case 0:
+	case 1:
+		if op.size, err = strconv.Atoi(parts[0]); err != nil || op.size < 1 {
+			return nil, fmt.Errorf("invalid size %q: expected a number of pixels", parts[0])
+		}
+	default:
+		return nil, fmt.Errorf("expected text@position[,size], e.g. https://example.com@bottom-right,200")
+	}
+	return op, nil
+}
+
+// Apply draws the code with whole pixels per module, as large as fits the
+// size. Codes in a corner are inset by a tenth of their size.
+func (op embedQROp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	size := op.size
+	if size == 0 {
+		size = min(width, height) / 5
+	}
+	modules := op.code.size + 2*qrQuietZone
+	scale := size / modules
+	if scale < 1 {
+		return nil, fmt.Errorf("a QR code of %d pixels is too small for its %d modules; give a larger size or image", size, modules)
+	}
+	stamp := op.code.image(scale, qrQuietZone, color.Black, color.White)
+	side, inset := stamp.Rect.Dx(), size/10
+
+	pt := op.point
+	switch op.position {
+	case "top-left":
+		pt = image.Pt(inset, inset)
+	case "top-right":
+		pt = image.Pt(width-side-inset, inset)
+	case "bottom-left":
+		pt = image.Pt(inset, height-side-inset)
+	case "bottom-right":
+		pt = image.Pt(width-side-inset, height-side-inset)
+	case "center":
+		pt = image.Pt((width-side)/2, (height-side)/2)
+	}
+	r := image.Rectangle{Min: pt, Max: pt.Add(stamp.Rect.Size())}
+	if !r.In(image.Rect(0, 0, width, height)) {
+		return nil, fmt.Errorf("the %dx%d QR code at %d,%d does not fit in the %dx%d image", side, side, pt.X, pt.Y, width, height)
+	}
+
+	// Draw onto a copy at the origin, keeping the image's depth
+	out := newSampleBuffer(img).img.(draw.Image)
+	draw.Draw(out, r, stamp, image.Point{}, draw.Src)
+	slog.Info("Embedded QR code", "modules", op.code.size, "size", fmt.Sprintf("%dx%d", side, side), "at", fmt.Sprintf("%d,%d", pt.X, pt.Y))
+	return out, nil
+}
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"math/bits"
+	"slices"
+)
+
+// WebP output is written losslessly in the VP8L format, see
+// https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+// Images of at most 256 colors are stored as palette indices; others have
+// green subtracted from red and blue and, from effort 1, each 16x16 tile
+// predicted from its neighbours. The pixels are then coded with LZ77
+// backward references, a color cache from effort 3, and one set of prefix
+// codes for the whole image.
+
+// webpDefaultEffort is the effort of WebP output, as cwebp's default method
+const webpDefaultEffort = 4
+
+// vp8lMaxSize is the largest width and height of a VP8L image
+const vp8lMaxSize = 1 << 14
+
+// VP8L transform types
+const (
+	vp8lPredictor     = 0
+	vp8lSubtractGreen = 2
+	vp8lColorIndexing = 3
+)
+
+const (
+	vp8lLiterals    = 256
+	vp8lLengthCodes = 24
+	vp8lDistCodes   = 40
+	vp8lMaxCopy     = 4096        // longest backward reference
+	vp8lWindow      = 1<<20 - 120 // farthest backward reference
+	vp8lTileBits    = 4           // predictor tiles are 16x16
+	vp8lCacheMult   = 0x1e35a7bd  // color cache hash multiplier
+)
+
+// vp8lCodeLengthOrder is the order in which the lengths of the code length
+// code are written
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// vp8lDistanceMap holds the offsets of the 120 short distance codes, as
+// y<<4 | (8-x) for the pixel x to the right and y rows above
+var vp8lDistanceMap = [120]uint8{
+	0x18, 0x07, 0x17, 0x19, 0x28, 0x06, 0x27, 0x29, 0x16, 0x1a,
+	0x26, 0x2a, 0x38, 0x05, 0x37, 0x39, 0x15, 0x1b, 0x36, 0x3a,
+	0x25, 0x2b, 0x48, 0x04, 0x47, 0x49, 0x14, 0x1c, 0x35, 0x3b,
+	0x46, 0x4a, 0x24, 0x2c, 0x58, 0x45, 0x4b, 0x34, 0x3c, 0x03,
+	0x57, 0x59, 0x13, 0x1d, 0x56, 0x5a, 0x23, 0x2d, 0x44, 0x4c,
+	0x55, 0x5b, 0x33, 0x3d, 0x68, 0x02, 0x67, 0x69, 0x12, 0x1e,
+	0x66, 0x6a, 0x22, 0x2e, 0x54, 0x5c, 0x43, 0x4d, 0x65, 0x6b,
+	0x32, 0x3e, 0x78, 0x01, 0x77, 0x79, 0x53, 0x5d, 0x11, 0x1f,
+	0x64, 0x6c, 0x42, 0x4e, 0x76, 0x7a, 0x21, 0x2f, 0x75, 0x7b,
+	0x31, 0x3f, 0x63, 0x6d, 0x52, 0x5e, 0x00, 0x74, 0x7c, 0x41,
+	0x4f, 0x10, 0x20, 0x62, 0x6e, 0x30, 0x73, 0x7d, 0x51, 0x5f,
+	0x40, 0x72, 0x7e, 0x61, 0x6f, 0x50, 0x71, 0x7f, 0x60, 0x70,
+}
+
+// webpSettings are the encoding choices made for an effort from 0 to 6
+type webpSettings struct {
+	predict   bool // use the predictor transform
+	chain     int  // earlier positions tried for each backward reference
+	cacheBits int  // log2 of the color cache size, 0 for none
+	tryBoth   bool // also code without the cache, keeping the smaller
+}
+
+func webpSettingsFor(effort int) webpSettings {
+	switch {
+	case effort <= 0:
+		return webpSettings{}
+	case effort <= 2:
+		return webpSettings{predict: true, chain: 16}
+	case effort <= 4:
+		return webpSettings{predict: true, chain: 64, cacheBits: 10}
+	default:
+		return webpSettings{predict: true, chain: 512, cacheBits: 10, tryBoth: true}
+	}
+}
+
+// EncodeWebP writes img to w as a lossless WebP, trading speed for size by
+// effort from 0 (fastest) to 6 (smallest)
+func EncodeWebP(w io.Writer, img image.Image, effort int) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > vp8lMaxSize || height > vp8lMaxSize {
+		return fmt.Errorf("WebP images are 1 to %d pixels wide and high, got %dx%d", vp8lMaxSize, width, height)
+	}
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok || b.Min != (image.Point{}) {
+		nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+	}
+	argb := make([]uint32, width*height)
+	alpha := uint32(0)
+	for y := range height {
+		row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+4*width]
+		for x := range width {
+			p := row[4*x : 4*x+4]
+			argb[y*width+x] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+			if p[3] != 0xff {
+				alpha = 1
+			}
+		}
+	}
+
+	s := webpSettingsFor(effort)
+	var bw vp8lWriter
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	bw.write(alpha, 1)
+	bw.write(0, 3)
+
+	codedWidth := width
+	if palette := vp8lPalette(argb); palette != nil {
+		bw.write(1, 1)
+		bw.write(vp8lColorIndexing, 2)
+		bw.write(uint32(len(palette)-1), 8)
+		deltas := slices.Clone(palette)
+		for i := len(deltas) - 1; i > 0; i-- {
+			deltas[i] = subPixels(deltas[i], deltas[i-1])
+		}
+		bw.writeImageData(deltas, len(deltas), 0, s.chain, false)
+		argb, codedWidth = bundlePalette(argb, width, height, palette)
+	} else {
+		bw.write(1, 1)
+		bw.write(vp8lSubtractGreen, 2)
+		for i, p := range argb {
+			g := p >> 8 & 0xff
+			argb[i] = p&0xff00ff00 | (p>>16-g)&0xff<<16 | (p-g)&0xff
+		}
+		if s.predict {
+			bw.write(1, 1)
+			bw.write(vp8lPredictor, 2)
+			bw.write(vp8lTileBits-2, 3)
+			var modes []uint32
+			argb, modes = predictPixels(argb, width, height)
+			bw.writeImageData(modes, (width+1<<vp8lTileBits-1)>>vp8lTileBits, 0, s.chain, false)
+		}
+	}
+	bw.write(0, 1)
+	var uncached vp8lWriter
+	if s.tryBoth {
+		uncached = vp8lWriter{buf: slices.Clone(bw.buf), acc: bw.acc, nbits: bw.nbits}
+	}
+	bw.writeImageData(argb, codedWidth, s.cacheBits, s.chain, true)
+	if s.tryBoth {
+		// The cache pays off for graphics more than for photos
+		uncached.writeImageData(argb, codedWidth, 0, s.chain, true)
+		if len(uncached.buf) < len(bw.buf) {
+			bw = uncached
+		}
+	}
+	data := bw.flush()
+
+	header := make([]byte, 20)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+len(data)+len(data)&1))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	if len(data)&1 != 0 {
+		data = append(data, 0)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// vp8lPalette returns the sorted colors of argb, or nil if there are more
+// than 256 of them
+func vp8lPalette(argb []uint32) []uint32 {
+	seen := make(map[uint32]struct{}, 257)
+	for _, p := range argb {
+		if _, ok := seen[p]; !ok {
+			if seen[p] = struct{}{}; len(seen) > 256 {
+				return nil
+			}
+		}
+	}
+	palette := make([]uint32, 0, len(seen))
+	for p := range seen {
+		palette = append(palette, p)
+	}
+	slices.Sort(palette)
+	return palette
+}
+
+// bundlePalette replaces each pixel of argb with its index in palette, kept
+// in the green channel. Small palettes pack 2, 4 or 8 indices into one
+// pixel, which narrows the image.
+func bundlePalette(argb []uint32, width, height int, palette []uint32) ([]uint32, int) {
+	index := make(map[uint32]uint32, len(palette))
+	for i, p := range palette {
+		index[p] = uint32(i)
+	}
+	shift := 0
+	switch {
+	case len(palette) <= 2:
+		shift = 3
+	case len(palette) <= 4:
+		shift = 2
+	case len(palette) <= 16:
+		shift = 1
+	}
+	packed := (width + 1<<shift - 1) >> shift
+	bitsPerIndex := 8 >> shift
+	out := make([]uint32, packed*height)
+	for y := range height {
+		for x := range width {
+			i := index[argb[y*width+x]]
+			out[y*packed+x>>shift] |= i << (8 + (x&(1<<shift-1))*bitsPerIndex)
+		}
+	}
+	for i := range out {
+		out[i] |= 0xff000000
+	}
+	return out, packed
+}
+
+// subPixels subtracts each channel of b from that of a, modulo 256
+func subPixels(a, b uint32) uint32 {
+	alphaGreen := 0x00ff00ff + a&0xff00ff00 - b&0xff00ff00
+	redBlue := 0xff00ff00 + a&0x00ff00ff - b&0x00ff00ff
+	return alphaGreen&0xff00ff00 | redBlue&0x00ff00ff
+}
+
+// average2 averages each channel of a and b, rounding down
+func average2(a, b uint32) uint32 {
+	return (a^b)&0xfefefefe>>1 + a&b
+}
+
+// channelwise applies f to each channel of its arguments
+func channelwise(f func(a, b, c int) int, a, b, c uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		v := f(int(a>>shift&0xff), int(b>>shift&0xff), int(c>>shift&0xff))
+		out |= uint32(min(max(v, 0), 255)) << shift
+	}
+	return out
+}
+
+// predict returns the prediction of the pixel at i by predictor mode, for
+// pixels neither in the first row nor in the first column. The top-right
+// neighbour of the last column is the first pixel of the row itself, which
+// is where it lies in memory.
+func predict(mode int, argb []uint32, i, width int) uint32 {
+	l, t, tl, tr := argb[i-1], argb[i-width], argb[i-width-1], argb[i-width+1]
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return average2(average2(l, tr), t)
+	case 6:
+		return average2(l, tl)
+	case 7:
+		return average2(l, t)
+	case 8:
+		return average2(tl, t)
+	case 9:
+		return average2(t, tr)
+	case 10:
+		return average2(average2(l, tl), average2(t, tr))
+	case 11:
+		// The neighbour closest to the gradient estimate L+T-TL
+		abs := func(v int) int { return max(v, -v) }
+		var toL, toT int
+		for shift := 0; shift < 32; shift += 8 {
+			lc, tc, tlc := int(l>>shift&0xff), int(t>>shift&0xff), int(tl>>shift&0xff)
+			toL += abs(tc - tlc)
+			toT += abs(lc - tlc)
+		}
+		if toL < toT {
+			return l
+		}
+		return t
+	case 12:
+		return channelwise(func(a, b, c int) int { return a + b - c }, l, t, tl)
+	default:
+		return channelwise(func(a, b, _ int) int { return a + (a-b)/2 }, average2(l, t), tl, 0)
+	}
+}
+
+// residualCost estimates the bits a residual costs by the size of its
+// channels as signed values
+func residualCost(r uint32) int {
+	cost := 0
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(int8(r >> shift))
+		cost += max(v, -v)
+	}
+	return cost
+}
+
+// predictPixels applies the predictor transform: it picks for each tile the
+// mode whose residuals are smallest, and returns the residuals and the
+// image of modes, stored in the green channel
+func predictPixels(argb []uint32, width, height int) ([]uint32, []uint32) {
+	const tile = 1 << vp8lTileBits
+	tilesX, tilesY := (width+tile-1)/tile, (height+tile-1)/tile
+	modes := make([]uint32, tilesX*tilesY)
+	out := make([]uint32, len(argb))
+	out[0] = subPixels(argb[0], 0xff000000)
+	for x := 1; x < width; x++ {
+		out[x] = subPixels(argb[x], argb[x-1])
+	}
+	for ty := range tilesY {
+		for tx := range tilesX {
+			x0, y0 := max(tx*tile, 1), max(ty*tile, 1)
+			x1, y1 := min((tx+1)*tile, width), min((ty+1)*tile, height)
+			best, bestCost := 0, -1
+			for mode := range 14 {
+				cost := 0
+				for y := y0; y < y1; y++ {
+					for x := x0; x < x1; x++ {
+						i := y*width + x
+						cost += residualCost(subPixels(argb[i], predict(mode, argb, i, width)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[ty*tilesX+tx] = 0xff000000 | uint32(best)<<8
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					i := y*width + x
+					out[i] = subPixels(argb[i], predict(best, argb, i, width))
+				}
+			}
+		}
+	}
+	for y := 1; y < height; y++ {
+		out[y*width] = subPixels(argb[y*width], argb[(y-1)*width])
+	}
+	return out, modes
+}
+
+// vp8lSymbol is a literal pixel, a color cache hit or a backward reference
+type vp8lSymbol struct {
+	kind   uint8  // 0 literal, 1 cache hit, 2 backward reference
+	value  uint32 // the pixel, cache index or distance code
+	length int    // pixels copied by a backward reference
+}
+
+// vp8lPixelHash hashes the pixels at i and i+1 to find backward references
+func vp8lPixelHash(argb []uint32, i int) uint32 {
+	return (argb[i]*0x9e3779b1 ^ argb[i+1]*vp8lCacheMult) >> 14
+}
+
+// vp8lSymbols turns argb into symbols: backward references found among
+// the chain most recent positions with the same next two pixels, hits in a
+// color cache of 1<<cacheBits entries, and literals for the rest
+func vp8lSymbols(argb []uint32, width, cacheBits, chain int) []vp8lSymbol {
+	// Distances to pixels near above are written as short codes
+	distCodes := make(map[int]uint32, len(vp8lDistanceMap))
+	for i := len(vp8lDistanceMap) - 1; i >= 0; i-- {
+		v := int(vp8lDistanceMap[i])
+		if d := v>>4*width + 8 - v&0xf; d >= 1 {
+			distCodes[d] = uint32(i + 1)
+		}
+	}
+
+	var cache []uint32
+	if cacheBits > 0 {
+		cache = make([]uint32, 1<<cacheBits)
+	}
+	var head, prev []int32
+	if chain > 0 {
+		head = make([]int32, 1<<18)
+		for i := range head {
+			head[i] = -1
+		}
+		prev = make([]int32, len(argb))
+	}
+	n := len(argb)
+	insert := func(i int) {
+		if cache != nil {
+			cache[argb[i]*vp8lCacheMult>>(32-cacheBits)] = argb[i]
+		}
+		if head != nil && i+1 < n {
+			h := vp8lPixelHash(argb, i)
+			prev[i], head[h] = head[h], int32(i)
+		}
+	}
+
+	var symbols []vp8lSymbol
+	for i := 0; i < n; {
+		length, dist := 0, 0
+		if head != nil && i+1 < n {
+			limit := min(vp8lMaxCopy, n-i)
+			for c, j := 0, int(head[vp8lPixelHash(argb, i)]); j >= 0 && c < chain && i-j <= vp8lWindow; c, j = c+1, int(prev[j]) {
+				l := 0
+				for l < limit && argb[j+l] == argb[i+l] {
+					l++
+				}
+				if l > length {
+					length, dist = l, i-j
+					if l == limit {
+						break
+					}
+				}
+			}
+		}
+		if length >= 3 {
+			code, ok := distCodes[dist]
+			if !ok {
+				code = uint32(dist + len(vp8lDistanceMap))
+			}
+			symbols = append(symbols, vp8lSymbol{kind: 2, value: code, length: length})
+			for k := range length {
+				insert(i + k)
+			}
+			i += length
+			continue
+		}
+		p := argb[i]
+		if key := p * vp8lCacheMult >> (32 - cacheBits); cache != nil && cache[key] == p {
+			symbols = append(symbols, vp8lSymbol{kind: 1, value: key})
+		} else {
+			symbols = append(symbols, vp8lSymbol{value: p})
+		}
+		insert(i)
+		i++
+	}
+	return symbols
+}
+
+// vp8lPrefix splits a backward reference length or distance code v into
+// its prefix symbol and the extra bits that follow it
+func vp8lPrefix(v int) (symbol, extraBits int, extra uint32) {
+	d := v - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	h := bits.Len(uint(d)) - 1
+	return 2*h + d>>(h-1)&1, h - 1, uint32(d) & (1<<(h-1) - 1)
+}
+
+// vp8lWriter writes the bits of a VP8L bitstream, least significant first
+type vp8lWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *vp8lWriter) write(v uint32, n int) {
+	w.acc |= uint64(v) << w.nbits
+	w.nbits += uint(n)
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+// flush pads the last byte with zeros and returns the bitstream
+func (w *vp8lWriter) flush() []byte {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.buf
+}
+
+// writeImageData writes the entropy-coded pixels of argb, an image width
+// pixels wide. The main image also says it has no meta prefix codes,
+// which the images of transforms cannot have.
+func (w *vp8lWriter) writeImageData(argb []uint32, width, cacheBits, chain int, main bool) {
+	symbols := vp8lSymbols(argb, width, cacheBits, chain)
+	if cacheBits > 0 {
+		w.write(1, 1)
+		w.write(uint32(cacheBits), 4)
+	} else {
+		w.write(0, 1)
+	}
+	if main {
+		w.write(0, 1)
+	}
+
+	greenSize := vp8lLiterals + vp8lLengthCodes
+	if cacheBits > 0 {
+		greenSize += 1 << cacheBits
+	}
+	green := make([]int, greenSize)
+	var red, blue, alpha [vp8lLiterals]int
+	var dist [vp8lDistCodes]int
+	for _, s := range symbols {
+		switch s.kind {
+		case 0:
+			green[s.value>>8&0xff]++
+			red[s.value>>16&0xff]++
+			blue[s.value&0xff]++
+			alpha[s.value>>24]++
+		case 1:
+			green[vp8lLiterals+vp8lLengthCodes+int(s.value)]++
+		default:
+			l, _, _ := vp8lPrefix(s.length)
+			d, _, _ := vp8lPrefix(int(s.value))
+			green[vp8lLiterals+l]++
+			dist[d]++
+		}
+	}
+	codes := [5]*prefixCode{
+		newPrefixCode(green, 15), newPrefixCode(red[:], 15), newPrefixCode(blue[:], 15),
+		newPrefixCode(alpha[:], 15), newPrefixCode(dist[:], 15),
+	}
+	for _, c := range codes {
+		w.writeCode(c)
+	}
+	for _, s := range symbols {
+		switch s.kind {
+		case 0:
+			codes[0].put(w, int(s.value>>8&0xff))
+			codes[1].put(w, int(s.value>>16&0xff))
+			codes[2].put(w, int(s.value&0xff))
+			codes[3].put(w, int(s.value>>24))
+		case 1:
+			codes[0].put(w, vp8lLiterals+vp8lLengthCodes+int(s.value))
+		default:
+			l, n, extra := vp8lPrefix(s.length)
+			codes[0].put(w, vp8lLiterals+l)
+			w.write(extra, n)
+			d, n, extra := vp8lPrefix(int(s.value))
+			codes[4].put(w, d)
+			w.write(extra, n)
+		}
+	}
+}
+
+// prefixCode is a canonical prefix code, with each symbol's code stored
+// bit-reversed, as it is written
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint16
+	single  bool // at most one symbol is used, and takes no bits
+}
+
+// newPrefixCode builds a code of at most maxLength bits for symbols
+// occurring counts times
+func newPrefixCode(counts []int, maxLength int) *prefixCode {
+	c := &prefixCode{lengths: huffmanLengths(counts, maxLength), codes: make([]uint16, len(counts))}
+	var perLength [16]int
+	used := 0
+	for _, l := range c.lengths {
+		if l > 0 {
+			perLength[l]++
+			used++
+		}
+	}
+	c.single = used <= 1
+	var next [16]int
+	for l, code := 1, 0; l < 16; l++ {
+		code = (code + perLength[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range c.lengths {
+		if l > 0 {
+			c.codes[s] = bits.Reverse16(uint16(next[l])) >> (16 - l)
+			next[l]++
+		}
+	}
+	return c
+}
+
+func (c *prefixCode) put(w *vp8lWriter, symbol int) {
+	if !c.single {
+		w.write(uint32(c.codes[symbol]), int(c.lengths[symbol]))
+	}
+}
+
+// huffmanLengths returns Huffman code lengths of at most maxLength bits for
+// symbols occurring counts times. Rare symbols are made more common until
+// the code fits. A lone symbol gets length 1, though it is written with
+// no bits.
+func huffmanLengths(counts []int, maxLength int) []uint8 {
+	lengths := make([]uint8, len(counts))
+	var symbols []int
+	for s, n := range counts {
+		if n > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+	if len(symbols) < 2 {
+		for _, s := range symbols {
+			lengths[s] = 1
+		}
+		return lengths
+	}
+
+	type node struct{ count, left, right int }
+	for floor := 1; ; floor *= 2 {
+		leaves := len(symbols)
+		nodes := make([]node, 0, 2*leaves-1)
+		for _, s := range symbols {
+			nodes = append(nodes, node{max(counts[s], floor), s, 0})
+		}
+		slices.SortStableFunc(nodes, func(a, b node) int { return a.count - b.count })
+		// Leaves and merged nodes are each taken in order of count
+		leaf, merged := 0, leaves
+		next := func() int {
+			if leaf < leaves && (merged == len(nodes) || nodes[leaf].count <= nodes[merged].count) {
+				leaf++
+				return leaf - 1
+			}
+			merged++
+			return merged - 1
+		}
+		for range leaves - 1 {
+			a, b := next(), next()
+			nodes = append(nodes, node{nodes[a].count + nodes[b].count, a, b})
+		}
+		depth := make([]int, len(nodes))
+		deepest := 0
+		for i := len(nodes) - 1; i >= leaves; i-- {
+			depth[nodes[i].left] = depth[i] + 1
+			depth[nodes[i].right] = depth[i] + 1
+			deepest = max(deepest, depth[i]+1)
+		}
+		if deepest <= maxLength {
+			for i := range leaves {
+				lengths[nodes[i].left] = uint8(depth[i])
+			}
+			return lengths
+		}
+	}
+}
+
+// writeCode writes the lengths of c's symbols: as a simple code when at
+// most two symbols below 256 are used, or else coded by a code length code
+func (w *vp8lWriter) writeCode(c *prefixCode) {
+	var used []int
+	for s, l := range c.lengths {
+		if l > 0 {
+			used = append(used, s)
+		}
+	}
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		if len(used) == 0 {
+			used = []int{0}
+		}
+		w.write(1, 1)
+		w.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(used[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			w.write(uint32(used[1]), 8)
+		}
+		return
+	}
+
+	// Runs of lengths are written as 16 (repeat the previous length 3 to 6
+	// times), 17 (3 to 10 zeros) or 18 (11 to 138 zeros)
+	type token struct {
+		symbol int
+		extra  uint32
+	}
+	var tokens []token
+	for i := 0; i < len(c.lengths); {
+		l := c.lengths[i]
+		run := 1
+		for i+run < len(c.lengths) && c.lengths[i+run] == l {
+			run++
+		}
+		i += run
+		if l == 0 {
+			for run >= 11 {
+				n := min(run, 138)
+				tokens = append(tokens, token{18, uint32(n - 11)})
+				run -= n
+			}
+			if run >= 3 {
+				tokens = append(tokens, token{17, uint32(run - 3)})
+				run = 0
+			}
+		} else {
+			tokens = append(tokens, token{int(l), 0})
+			for run--; run >= 3; {
+				n := min(run, 6)
+				tokens = append(tokens, token{16, uint32(n - 3)})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, token{int(l), 0})
+		}
+	}
+	var counts [19]int
+	for _, t := range tokens {
+		counts[t.symbol]++
+	}
+	lengthCode := newPrefixCode(counts[:], 7)
+	n := len(vp8lCodeLengthOrder)
+	for n > 4 && lengthCode.lengths[vp8lCodeLengthOrder[n-1]] == 0 {
+		n--
+	}
+	w.write(0, 1)
+	w.write(uint32(n-4), 4)
+	for _, s := range vp8lCodeLengthOrder[:n] {
+		w.write(uint32(lengthCode.lengths[s]), 3)
+	}
+	// Every symbol's length is written
+	w.write(0, 1)
+	for _, t := range tokens {
+		lengthCode.put(w, t.symbol)
+		switch t.symbol {
+		case 16:
+			w.write(t.extra, 2)
+		case 17:
+			w.write(t.extra, 3)
+		case 18:
+			w.write(t.extra, 7)
+		}
+	}
+}
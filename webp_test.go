@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	images := map[string]*image.NRGBA{}
+	add := func(name string, w, h int, at func(x, y int) color.NRGBA) {
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := range h {
+			for x := range w {
+				img.SetNRGBA(x, y, at(x, y))
+			}
+		}
+		images[name] = img
+	}
+	add("pixel", 1, 1, func(x, y int) color.NRGBA { return color.NRGBA{10, 20, 30, 255} })
+	add("two colors", 37, 5, func(x, y int) color.NRGBA { return color.NRGBA{uint8(255 * ((x + y) % 2)), 0, 0, 255} })
+	add("sixteen colors", 33, 21, func(x, y int) color.NRGBA { return color.NRGBA{uint8(16 * ((x * y) % 16)), 7, 9, 255} })
+	add("gradient", 300, 200, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x), uint8(y), uint8(x + y), 255} })
+	add("noise", 67, 45, func(x, y int) color.NRGBA {
+		return color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256))}
+	})
+	images["logo"] = transparentLogo(130)
+
+	for name, img := range images {
+		for effort := range 7 {
+			var buf bytes.Buffer
+			if err := EncodeWebP(&buf, img, effort); err != nil {
+				t.Fatalf("%s at effort %d: %v", name, effort, err)
+			}
+			got, err := webp.Decode(&buf)
+			if err != nil {
+				t.Fatalf("%s at effort %d: %v", name, effort, err)
+			}
+			b := img.Bounds()
+			if got.Bounds() != b {
+				t.Fatalf("%s at effort %d: got %v, want %v", name, effort, got.Bounds(), b)
+			}
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if g, w := color.NRGBAModel.Convert(got.At(x, y)), img.NRGBAAt(x, y); g != w {
+						t.Fatalf("%s at effort %d: pixel (%d, %d) is %v, want %v", name, effort, x, y, g, w)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestWebPEffort(t *testing.T) {
+	defer func(e int) { encodeEffort = e }(encodeEffort)
+	defer func(d encoderDefaults) { siteDefaults = d }(siteDefaults)
+	siteDefaults.WebPEffort = 2
+	for effort, want := range map[int]int{-1: 2, 0: 0, 2: 1, 5: 3, 9: 6} {
+		encodeEffort = effort
+		if got := webpEffort(); got != want {
+			t.Errorf("-effort %d: got WebP effort %d, want %d", effort, got, want)
+		}
+	}
+}
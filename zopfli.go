@@ -0,0 +1,521 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"hash/adler32"
+	"math"
+	"math/bits"
+	"slices"
+)
+
+// Parameters of the zopfli-style encoder. Each block of input is parsed
+// zopfliIterations times, each time with the symbol costs of the previous
+// parse, and the smallest result is kept.
+const (
+	zopfliIterations = 15
+	zopfliBlockSize  = 1 << 18
+	zopfliMaxChain   = 8192
+	deflateWindow    = 32768
+	deflateMinMatch  = 3
+	deflateMaxMatch  = 258
+)
+
+// Length and distance symbol bases and extra bits from RFC 1951
+var (
+	deflateLengthBase  = [29]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	deflateLengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	deflateDistBase    = [30]int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	deflateDistExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	// Order in which code length code lengths are stored
+	deflateCodeLengthOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+// deflateLengthSymbols maps each match length to its index into
+// deflateLengthBase
+var deflateLengthSymbols = func() (t [deflateMaxMatch + 1]uint8) {
+	for s, base := range deflateLengthBase {
+		for l := base; l <= deflateMaxMatch; l++ {
+			t[l] = uint8(s)
+		}
+	}
+	return t
+}()
+
+// deflateLengthSymbol returns the index into deflateLengthBase of a match length
+func deflateLengthSymbol(length int) int {
+	return int(deflateLengthSymbols[length])
+}
+
+// deflateDistSymbol returns the distance code of a match distance. Above 4,
+// each pair of codes covers twice the distances of the pair before.
+func deflateDistSymbol(dist int) int {
+	if dist <= 4 {
+		return dist - 1
+	}
+	n := bits.Len(uint(dist-1)) - 1
+	return 2*n + (dist-1)>>(n-1)&1
+}
+
+// lz77Symbol is a literal (dist 0, length holds the byte) or a back-reference
+type lz77Symbol struct {
+	length, dist uint16
+}
+
+// lz77Matches records, for every input position, the shortest distance at
+// which each match length is available, as (length, distance) pairs of
+// increasing length and distance
+type lz77Matches struct {
+	offsets []int32
+	pairs   []uint32 // length<<16 | distance
+	same    []uint16 // number of bytes equal to the one at each position
+}
+
+// findMatches runs a hash-chain match finder over data
+func findMatches(ctx context.Context, data []byte) (*lz77Matches, error) {
+	m := &lz77Matches{offsets: make([]int32, len(data)+1), same: make([]uint16, len(data))}
+	for i := len(data) - 1; i >= 0; i-- {
+		m.same[i] = 1
+		if i+1 < len(data) && data[i+1] == data[i] && m.same[i+1] < math.MaxUint16 {
+			m.same[i] = m.same[i+1] + 1
+		}
+	}
+
+	const hashBits = 16
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(data))
+	hash := func(i int) uint32 {
+		return (uint32(data[i])<<16 | uint32(data[i+1])<<8 | uint32(data[i+2])) * 2654435761 >> (32 - hashBits)
+	}
+	for i := range data {
+		if i%(1<<16) == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		m.offsets[i] = int32(len(m.pairs))
+		if i+deflateMinMatch > len(data) {
+			continue
+		}
+		h := hash(i)
+		limit := min(deflateMaxMatch, len(data)-i)
+		best := deflateMinMatch - 1
+		for j, chain := head[h], 0; j >= 0 && i-int(j) <= deflateWindow && chain < zopfliMaxChain; j, chain = prev[j], chain+1 {
+			if data[int(j)+best] != data[i+best] {
+				continue
+			}
+			n := 0
+			for n < limit && data[int(j)+n] == data[i+n] {
+				n++
+			}
+			if n > best {
+				best = n
+				m.pairs = append(m.pairs, uint32(n)<<16|uint32(i-int(j)))
+				if n == limit {
+					break
+				}
+			}
+		}
+		prev[i] = head[h]
+		head[h] = int32(i)
+	}
+	m.offsets[len(data)] = int32(len(m.pairs))
+	return m, nil
+}
+
+// deflateCosts holds the estimated bit cost of each literal/length and
+// distance symbol, extra bits included where they are fixed
+type deflateCosts struct {
+	literal [256]float64
+	length  [deflateMaxMatch + 1]float64
+	dist    [30]float64
+}
+
+// fixedDeflateCosts returns the costs under the fixed Huffman codes, used
+// for the first parse
+func fixedDeflateCosts() *deflateCosts {
+	c := &deflateCosts{}
+	for i := range c.literal {
+		c.literal[i] = 8
+		if i >= 144 {
+			c.literal[i] = 9
+		}
+	}
+	for l := deflateMinMatch; l <= deflateMaxMatch; l++ {
+		s := deflateLengthSymbol(l)
+		c.length[l] = 7 + float64(deflateLengthExtra[s])
+		if s >= 23 {
+			c.length[l]++
+		}
+	}
+	for d := range c.dist {
+		c.dist[d] = 5 + float64(deflateDistExtra[d])
+	}
+	return c
+}
+
+// statisticalDeflateCosts derives costs from the symbol frequencies of a
+// previous parse, as the entropy of each symbol
+func statisticalDeflateCosts(litLen []int, dist []int) *deflateCosts {
+	entropy := func(freq []int) []float64 {
+		total := 0
+		for _, f := range freq {
+			total += f
+		}
+		costs := make([]float64, len(freq))
+		for i, f := range freq {
+			costs[i] = math.Log2(float64(max(total, 1))) - math.Log2(float64(max(f, 1)))
+		}
+		return costs
+	}
+	lit, d := entropy(litLen), entropy(dist)
+	c := &deflateCosts{}
+	copy(c.literal[:], lit[:256])
+	for l := deflateMinMatch; l <= deflateMaxMatch; l++ {
+		s := deflateLengthSymbol(l)
+		c.length[l] = lit[257+s] + float64(deflateLengthExtra[s])
+	}
+	for i := range c.dist {
+		c.dist[i] = d[i] + float64(deflateDistExtra[i])
+	}
+	return c
+}
+
+// parseOptimal finds the cheapest sequence of literals and matches for
+// data[start:end] under costs, by dynamic programming over the positions
+func parseOptimal(data []byte, start, end int, m *lz77Matches, costs *deflateCosts) []lz77Symbol {
+	n := end - start
+	cost := make([]float64, n+1)
+	for i := range cost {
+		cost[i] = math.Inf(1)
+	}
+	cost[0] = 0
+	step := make([]lz77Symbol, n+1) // how each position was reached
+
+	for i := start; i < end; i++ {
+		j := i - start
+		// Long runs of one byte are coded as maximum-length matches right
+		// away, as zopfli does, which keeps flat areas fast
+		if i > 0 && data[i-1] == data[i] && int(m.same[i]) > 2*deflateMaxMatch && i+deflateMaxMatch <= end {
+			c := cost[j] + costs.length[deflateMaxMatch] + costs.dist[0]
+			if c < cost[j+deflateMaxMatch] {
+				cost[j+deflateMaxMatch] = c
+				step[j+deflateMaxMatch] = lz77Symbol{deflateMaxMatch, 1}
+			}
+			i += deflateMaxMatch - 1
+			continue
+		}
+
+		if c := cost[j] + costs.literal[data[i]]; c < cost[j+1] {
+			cost[j+1] = c
+			step[j+1] = lz77Symbol{uint16(data[i]), 0}
+		}
+		length := deflateMinMatch - 1
+		for _, pair := range m.pairs[m.offsets[i]:m.offsets[i+1]] {
+			maxLength, dist := min(int(pair>>16), end-i), int(pair&0xffff)
+			distCost := cost[j] + costs.dist[deflateDistSymbol(dist)]
+			for length++; length <= maxLength; length++ {
+				if c := distCost + costs.length[length]; c < cost[j+length] {
+					cost[j+length] = c
+					step[j+length] = lz77Symbol{uint16(length), uint16(dist)}
+				}
+			}
+			length = max(length, maxLength)
+		}
+	}
+
+	var symbols []lz77Symbol
+	for j := n; j > 0; {
+		s := step[j]
+		symbols = append(symbols, s)
+		if s.dist == 0 {
+			j--
+		} else {
+			j -= int(s.length)
+		}
+	}
+	slices.Reverse(symbols)
+	return symbols
+}
+
+// deflateFrequencies counts the literal/length and distance symbols of a
+// parse, including the end of block
+func deflateFrequencies(symbols []lz77Symbol) (litLen []int, dist []int) {
+	litLen, dist = make([]int, 286), make([]int, 30)
+	for _, s := range symbols {
+		if s.dist == 0 {
+			litLen[s.length]++
+		} else {
+			litLen[257+deflateLengthSymbol(int(s.length))]++
+			dist[deflateDistSymbol(int(s.dist))]++
+		}
+	}
+	litLen[256] = 1
+	return litLen, dist
+}
+
+// huffmanCodeLengths returns code lengths of at most maxBits for the symbol
+// frequencies, following the length-limiting procedure of Annex K.2 of the
+// JPEG standard
+func huffmanCodeLengths(freq []int, maxBits int) []uint8 {
+	lengths := make([]uint8, len(freq))
+	var used []int
+	for i, f := range freq {
+		if f > 0 {
+			used = append(used, i)
+		}
+	}
+	if len(used) == 1 {
+		lengths[used[0]] = 1
+		return lengths
+	}
+
+	// Plain Huffman code sizes, merging the two least frequent nodes
+	type node struct {
+		weight  int
+		symbols []int
+	}
+	nodes := make([]node, len(used))
+	for i, s := range used {
+		nodes[i] = node{freq[s], []int{s}}
+	}
+	size := make([]int, len(freq))
+	for len(nodes) > 1 {
+		slices.SortStableFunc(nodes, func(a, b node) int { return cmp.Compare(a.weight, b.weight) })
+		a, b := nodes[0], nodes[1]
+		for _, s := range a.symbols {
+			size[s]++
+		}
+		for _, s := range b.symbols {
+			size[s]++
+		}
+		nodes = append(nodes[2:], node{a.weight + b.weight, append(a.symbols, b.symbols...)})
+	}
+
+	count := make([]int, max(slices.Max(size), maxBits)+1)
+	for _, s := range used {
+		count[size[s]]++
+	}
+	for i := len(count) - 1; i > maxBits; i-- {
+		for count[i] > 0 {
+			j := i - 2
+			for count[j] == 0 {
+				j--
+			}
+			count[i] -= 2
+			count[i-1]++
+			count[j+1] += 2
+			count[j]--
+		}
+	}
+
+	// The most frequent symbols get the shortest codes
+	slices.SortStableFunc(used, func(a, b int) int { return cmp.Compare(freq[b], freq[a]) })
+	k := 0
+	for l := 1; l <= maxBits; l++ {
+		for range count[l] {
+			lengths[used[k]] = uint8(l)
+			k++
+		}
+	}
+	return lengths
+}
+
+// completeCode gives codes of length 1 to unused symbols until at least two
+// are used, since zlib rejects a one-symbol distance or code length code
+func completeCode(lengths []uint8) {
+	used := 0
+	for _, l := range lengths {
+		if l > 0 {
+			used++
+		}
+	}
+	for i := 0; used < 2; i++ {
+		if lengths[i] == 0 {
+			lengths[i] = 1
+			used++
+		}
+	}
+}
+
+// canonicalCodes returns the canonical Huffman codes for code lengths,
+// bit-reversed for deflate's least significant bit first order
+func canonicalCodes(lengths []uint8) []uint16 {
+	var count [16]int
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+		}
+	}
+	var next [16]int
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	codes := make([]uint16, len(lengths))
+	for s, l := range lengths {
+		if l > 0 {
+			codes[s] = bits.Reverse16(uint16(next[l])) >> (16 - l)
+			next[l]++
+		}
+	}
+	return codes
+}
+
+// deflateBitWriter packs bits least significant first
+type deflateBitWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+func (w *deflateBitWriter) write(v uint32, n uint8) {
+	w.acc |= uint64(v) << w.n
+	w.n += uint(n)
+	for w.n >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.n -= 8
+	}
+}
+
+func (w *deflateBitWriter) flush() {
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc, w.n = 0, 0
+	}
+}
+
+// writeDynamicBlock writes symbols as a deflate block with Huffman codes
+// built for them
+func writeDynamicBlock(w *deflateBitWriter, symbols []lz77Symbol, final bool) {
+	litLenFreq, distFreq := deflateFrequencies(symbols)
+	litLen := huffmanCodeLengths(litLenFreq, 15)
+	dist := huffmanCodeLengths(distFreq, 15)
+	completeCode(dist)
+
+	hlit, hdist := len(litLen), len(dist)
+	for hlit > 257 && litLen[hlit-1] == 0 {
+		hlit--
+	}
+	for hdist > 1 && dist[hdist-1] == 0 {
+		hdist--
+	}
+
+	// Run-length code the concatenated code lengths with symbols 16-18
+	type clSymbol struct {
+		symbol, extra uint8
+	}
+	lengths := append(slices.Clone(litLen[:hlit]), dist[:hdist]...)
+	var cl []clSymbol
+	var clFreq [19]int
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		i += run
+		for run > 0 {
+			switch {
+			case l == 0 && run >= 11:
+				n := min(run, 138)
+				cl, run = append(cl, clSymbol{18, uint8(n - 11)}), run-n
+			case l == 0 && run >= 3:
+				n := min(run, 10)
+				cl, run = append(cl, clSymbol{17, uint8(n - 3)}), run-n
+			case l != 0 && run >= 4:
+				cl, run = append(cl, clSymbol{l, 0}), run-1
+				clFreq[l]++
+				for run >= 3 {
+					n := min(run, 6)
+					cl, run = append(cl, clSymbol{16, uint8(n - 3)}), run-n
+					clFreq[16]++
+				}
+				continue
+			default:
+				cl, run = append(cl, clSymbol{l, 0}), run-1
+			}
+			clFreq[cl[len(cl)-1].symbol]++
+		}
+	}
+	clLengths := huffmanCodeLengths(clFreq[:], 7)
+	completeCode(clLengths)
+	clCodes := canonicalCodes(clLengths)
+	hclen := 19
+	for hclen > 4 && clLengths[deflateCodeLengthOrder[hclen-1]] == 0 {
+		hclen--
+	}
+
+	header := uint32(2 << 1)
+	if final {
+		header |= 1
+	}
+	w.write(header, 3)
+	w.write(uint32(hlit-257), 5)
+	w.write(uint32(hdist-1), 5)
+	w.write(uint32(hclen-4), 4)
+	for _, s := range deflateCodeLengthOrder[:hclen] {
+		w.write(uint32(clLengths[s]), 3)
+	}
+	extraBits := map[uint8]uint8{16: 2, 17: 3, 18: 7}
+	for _, s := range cl {
+		w.write(uint32(clCodes[s.symbol]), clLengths[s.symbol])
+		w.write(uint32(s.extra), extraBits[s.symbol])
+	}
+
+	litLenCodes, distCodes := canonicalCodes(litLen), canonicalCodes(dist)
+	for _, s := range symbols {
+		if s.dist == 0 {
+			w.write(uint32(litLenCodes[s.length]), litLen[s.length])
+			continue
+		}
+		ls := deflateLengthSymbol(int(s.length))
+		w.write(uint32(litLenCodes[257+ls]), litLen[257+ls])
+		w.write(uint32(int(s.length)-deflateLengthBase[ls]), deflateLengthExtra[ls])
+		ds := deflateDistSymbol(int(s.dist))
+		w.write(uint32(distCodes[ds]), dist[ds])
+		w.write(uint32(int(s.dist)-deflateDistBase[ds]), deflateDistExtra[ds])
+	}
+	w.write(uint32(litLenCodes[256]), litLen[256])
+}
+
+// zopfliZlib compresses data into a zlib stream the way zopfli does:
+// exhaustive match finding, then for each block an optimal parse repeated
+// with costs taken from the previous parse. It is many times slower than
+// compress/zlib but typically 3-8% smaller.
+func zopfliZlib(ctx context.Context, data []byte) ([]byte, error) {
+	m, err := findMatches(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	w := &deflateBitWriter{out: []byte{0x78, 0xda}}
+	for start := 0; ; start += zopfliBlockSize {
+		end := min(start+zopfliBlockSize, len(data))
+		var best []byte
+		var bestSymbols []lz77Symbol
+		costs := fixedDeflateCosts()
+		for range zopfliIterations {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			symbols := parseOptimal(data, start, end, m, costs)
+			trial := &deflateBitWriter{}
+			writeDynamicBlock(trial, symbols, false)
+			trial.flush()
+			if best == nil || len(trial.out) < len(best) {
+				best, bestSymbols = trial.out, symbols
+			}
+			costs = statisticalDeflateCosts(deflateFrequencies(symbols))
+		}
+		writeDynamicBlock(w, bestSymbols, end == len(data))
+		if end == len(data) {
+			break
+		}
+	}
+	w.flush()
+	return binary.BigEndian.AppendUint32(w.out, adler32.Checksum(data)), nil
+}